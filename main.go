@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bufio"
+	crand "crypto/rand"
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"math"
 	"math/rand"
@@ -10,6 +15,9 @@ import (
 	"path"
 	"runtime/pprof"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackpal/Taipei-Torrent/torrent"
@@ -23,63 +31,263 @@ var (
 	createTorrent = flag.String("createTorrent", "", "If not empty, creates a torrent file from the given root. Writes to stdout")
 	createTracker = flag.String("createTracker", "", "Creates a tracker serving the given torrent file on the given address. Example --createTracker=:8080 to serve on port 8080.")
 
-	port                = flag.Int("port", 7777, "Port to listen on. 0 means pick random port. Note that 6881 is blacklisted by some trackers.")
+	createAnnounce    = flag.String("createAnnounce", "", "With -createTorrent, the trackers to announce to. Tiers are separated by ';' and trackers within a tier by ','.")
+	createWebSeeds    = flag.String("createWebSeeds", "", "With -createTorrent, a comma separated list of web seed URLs.")
+	createComment     = flag.String("createComment", "", "With -createTorrent, a comment to put in the torrent.")
+	createCreatedBy   = flag.String("createCreatedBy", "Taipei-Torrent", "With -createTorrent, the program that created the torrent.")
+	createSource      = flag.String("createSource", "", "With -createTorrent, the source tag some private trackers require.")
+	createPrivate     = flag.Bool("createPrivate", false, "With -createTorrent, mark the torrent private.")
+	createPieceLength = flag.Int64("createPieceLength", 0, "With -createTorrent, the piece length in bytes. 0 picks one from the total size.")
+	createHidden      = flag.Bool("createHidden", false, "With -createTorrent, include hidden files.")
+	createSymlinks    = flag.Bool("createSymlinks", false, "With -createTorrent, follow symlinks instead of skipping them.")
+
+	port                = flag.String("port", "7777", "Port to listen on, or a range of ports to try in turn, like 6881-6889. 0 means pick random port. Note that 6881 is blacklisted by some trackers.")
+	randomPort          = flag.Bool("randomPort", false, "Try the ports of the -port range in random order.")
+	listen              = flag.String("listen", "", "Comma separated addresses to listen for peers on, in place of every address, like 203.0.113.5,[2001:db8::5]:6882. Ones without a port use -port. The first one's port is announced.")
 	fileDir             = flag.String("fileDir", ".", "path to directory where files are stored")
+	labelDirs           = flag.String("labelDirs", "", "Where torrents with a label go, if they're added without a directory, as comma separated label=dir pairs, e.g. linux-iso=/data/iso,work=/data/work. The first of a torrent's labels with one is used.")
 	seedRatio           = flag.Float64("seedRatio", math.Inf(0), "Seed until ratio >= this value before quitting.")
+	seedTime            = flag.Duration("seedTime", 0, "Seed for at most this long, e.g. 72h, if -seedRatio doesn't stop the torrent first. 0 means no limit.")
+	pauseAtSeedLimit    = flag.Bool("pauseAtSeedLimit", false, "At -seedRatio or -seedTime, pause the torrent instead of stopping it. Useful with -rpcAddress.")
 	useDeadlockDetector = flag.Bool("useDeadlockDetector", false, "Panic and print stack dumps when the program is stuck.")
 	useLPD              = flag.Bool("useLPD", false, "Use Local Peer Discovery")
+	lpdInterval         = flag.Duration("lpdInterval", torrent.LPD_DEFAULT_INTERVAL, "How often to send Local Peer Discovery announcements.")
 	useUPnP             = flag.Bool("useUPnP", false, "Use UPnP to open port in firewall.")
 	useNATPMP           = flag.Bool("useNATPMP", false, "Use NAT-PMP to open port in firewall.")
 	gateway             = flag.String("gateway", "", "IP Address of gateway.")
+	portCheckURL        = flag.String("portCheckURL", "", "A URL that answers open or closed after trying to connect to our port, which replaces {port} in it. Without it, we try connecting to ourselves.")
 	useDHT              = flag.Bool("useDHT", false, "Use DHT to get peers.")
+	useDHT6             = flag.Bool("useDHT6", false, "Also run a DHT node over IPv6. Requires -useDHT.")
+	dhtReadOnly         = flag.Bool("dhtReadOnly", false, "Look peers up in the DHT without running a DHT node for others to query. Requires -useDHT.")
+	dhtMaxRequests      = flag.Float64("dhtMaxRequests", torrent.DHT_DEFAULT_MAX_REQUESTS_PER_SECOND, "Maximum DHT peer lookups started per second.")
+	dhtMaxOutstanding   = flag.Int("dhtMaxOutstanding", torrent.DHT_DEFAULT_MAX_OUTSTANDING, "Maximum DHT peer lookups in progress at once.")
+	dhtMaxInbound       = flag.Int64("dhtMaxInbound", 0, "Maximum DHT packets from other nodes processed per second. Packets beyond that are dropped. 0 means the DHT default.")
+	dhtMaxNodes         = flag.Int("dhtMaxNodes", 0, "Maximum size of the DHT routing table, which bounds its maintenance traffic. 0 means the DHT default.")
+	dhtBootstrapNodes   = flag.String("dhtBootstrapNodes", "", "Comma separated list of host:port DHT nodes to bootstrap from. Empty means use the built-in list.")
 	trackerlessMode     = flag.Bool("trackerlessMode", false, "Do not get peers from the tracker. Good for testing DHT mode.")
 	proxyAddress        = flag.String("proxyAddress", "", "Address of a SOCKS5 proxy to use.")
+	bindAddress         = flag.String("bindAddress", "", "Local address, or interface name like tun0, to send everything from. An interface's address is followed as it changes, and torrents pause while it has none.")
 	initialCheck        = flag.Bool("initialCheck", true, "Do an initial hash check on files when adding torrents.")
-	useSFTP             = flag.String("useSFTP", "", "SFTP connection string, to store torrents over SFTP. e.g. 'username:password@192.168.1.25:22/path/'")
+	zeroCopyUploads     = flag.Bool("zeroCopyUploads", false, "Send uploads from the files with sendfile, where the platform has it, rather than reading them in first.")
+	openFilesParallel   = flag.Int("openFilesParallel", torrent.OPEN_FILES_PARALLEL, "How many of a torrent's files to open at once, which speeds up adding torrents of many files on network file systems.")
+	useSFTP             = flag.String("useSFTP", "", "SFTP connection string, to store torrents over SFTP. e.g. 'username:password@192.168.1.25:22/path/'. The password may be left out to log in with -sftpKey or the ssh-agent.")
+	sftpKey             = flag.String("sftpKey", "", "Private key file to log in to the -useSFTP server with.")
+	sftpKeyPassphrase   = flag.String("sftpKeyPassphrase", "", "Passphrase of an encrypted -sftpKey.")
+	sftpAgent           = flag.Bool("sftpAgent", true, "Log in to the -useSFTP server with the keys of the ssh-agent at $SSH_AUTH_SOCK.")
+	sftpKnownHosts      = flag.String("sftpKnownHosts", "", "known_hosts file the -useSFTP server's host key must be in. Empty means ~/.ssh/known_hosts.")
+	sftpChannels        = flag.Int("sftpChannels", torrent.SFTP_DEFAULT_CHANNELS, "How many SFTP channels to open on each torrent's SSH connection to the -useSFTP server.")
 	useRamCache         = flag.Int("useRamCache", 0, "Size in MiB of cache in ram, to reduce traffic on torrent storage.")
 	useHdCache          = flag.Int("useHdCache", 0, "Size in MiB of cache in OS temp directory, to reduce traffic on torrent storage.")
 	execOnSeeding       = flag.String("execOnSeeding", "", "Command to execute when torrent has fully downloaded and has begun seeding.")
-	quickResume         = flag.Bool("quickResume", false, "Save torrenting data to resume faster. '-initialCheck' should be set to false, to prevent hash check on resume.")
+	onAdded             = flag.String("onAdded", "", "Command to run when a torrent is added. {name}, {infohash}, {dir}, {path}, {size}, {label} and {labels} in it are replaced by the torrent's.")
+	onComplete          = flag.String("onComplete", "", "Command to run, once, when a torrent finishes downloading. {name}, {infohash}, {dir}, {path}, {size}, {label} and {labels} in it are replaced by the torrent's.")
+	onRemoved           = flag.String("onRemoved", "", "Command to run when a torrent is removed. {name}, {infohash}, {dir}, {path}, {size}, {label} and {labels} in it are replaced by the torrent's.")
+	hookTimeout         = flag.Duration("hookTimeout", torrent.HOOK_DEFAULT_TIMEOUT, "How long -onAdded, -onComplete and -onRemoved commands may run before they're killed.")
+	quickResume         = flag.Bool("quickResume", true, "Save resume data in -dataDir, so restarting doesn't hash check files that haven't changed.")
+	reverifyInterval    = flag.Duration("reverifyInterval", 0, "How often to recheck the seed that was verified longest ago, such as 24h. It's paused while it's checked. 0 means never.")
 	maxActive           = flag.Int("maxActive", 16, "How many torrents should be active at a time. Torrents added beyond this value are queued.")
+	maxActiveDownloads  = flag.Int("maxActiveDownloads", 0, "How many of the active torrents may download at a time, the rest being queued by priority and then when they were added. 0 means no limit.")
+	maxActiveSeeds      = flag.Int("maxActiveSeeds", 0, "How many of the active torrents may seed at a time. 0 means no limit.")
 	memoryPerTorrent	= flag.Int("memoryPerTorrent", -1, "Maximum memory (in MiB) per torrent used for Active Pieces. 0 means minimum. -1 (default) means unlimited.")
+	maxPieceMemory      = flag.Int("maxPieceMemory", 0, "The most memory, in MiB, all the torrents' Active Pieces may take together. Each torrent may have one regardless. 0 means unlimited.")
+	maxDiskUsage        = flag.Int64("maxDiskUsage", 0, "The most disk space, in MiB, all the torrents' files may take together, with the -useHdCache cache. Torrents that don't fit aren't started, and downloads pause if the disk fills up. 0 means unlimited.")
+	dataDir             = flag.String("dataDir", ".", "path to directory where session state, such as known DHT nodes, is stored")
+	saveSession         = flag.Bool("saveSession", false, "Remember the torrents in -dataDir, with their directories and whether they're paused, and add them again when restarting.")
+	metadataDir         = flag.String("metadataDir", ".", "path to directory where torrents fetched from magnet links are saved and looked for. Empty means don't save them.")
+	crossSeedDir        = flag.String("crossSeedDir", "", "If not empty, look in this directory for files that already hold a torrent's data, perhaps under other names, and seed from them.")
+	crossSeedHashCheck  = flag.Bool("crossSeedHashCheck", false, "With -crossSeedDir, hash a piece of every matched file, not just the ambiguous ones.")
+	crossSeedYes        = flag.Bool("crossSeedYes", false, "With -crossSeedDir, use the matched files without asking.")
+	webSeedOnly         = flag.Bool("webSeedOnly", false, "Download only from the torrents' web seeds, without peers, trackers, DHT or LPD.")
+	maxDownloadRate     = flag.Int64("maxDownloadRate", 0, "Maximum download rate of all the torrents, in bytes per second. 0 means unlimited.")
+	maxUploadRate       = flag.Int64("maxUploadRate", 0, "Maximum upload rate of all the torrents, in bytes per second. 0 means unlimited.")
+	altDownloadRate     = flag.Int64("altDownloadRate", 0, "The alternative -maxDownloadRate, in force during -altSpeedSchedule. 0 means unlimited.")
+	altUploadRate       = flag.Int64("altUploadRate", 0, "The alternative -maxUploadRate, in force during -altSpeedSchedule. 0 means unlimited.")
+	altSpeedSchedule    = flag.String("altSpeedSchedule", "", "When the alternative rate limits are in force, in local time, e.g. 'Mon-Fri 09:00-18:00; Sat 10:00-12:00'. Periods ending before they start run past midnight.")
+	rpcAddress          = flag.String("rpcAddress", "", "If not empty, serve the HTTP JSON control API on this address, e.g. localhost:9091, with a web UI at /ui/. Keeps running after the torrents finish.")
+	watchDir            = flag.String("watchDir", "", "If not empty, add the .torrent files, and .magnet files holding a magnet link, put in this directory. Keeps running after the torrents finish.")
+	watchDirDelete      = flag.Bool("watchDirDelete", false, "With -watchDir, delete files once they're added, instead of renaming them to *.added.")
+	configFile          = flag.String("config", "", "If not empty, a JSON file of the settings that can change while running: the rate limits and -altSpeedSchedule, -blocklist, -disconnectBlocked, -watchDir and -watchDirDelete. Read at startup, over the flags, and again on SIGHUP or POST /api/reload.")
+	blocklistFile       = flag.String("blocklist", "", "If not empty, a file of IP ranges, one per line as an address, CIDR, first-last, or the P2P format, not to connect to or let in.")
+	disconnectBlocked   = flag.Bool("disconnectBlocked", false, "When the -blocklist is reloaded, disconnect the peers it now blocks.")
+	rpcToken            = flag.String("rpcToken", "", "The token control API requests must send, as 'Authorization: Bearer <token>'. Empty means make one up and log it.")
+	rpcMetrics          = flag.Bool("rpcMetrics", false, "With -rpcAddress, serve Prometheus metrics at /metrics. Scrapers need the -rpcToken too.")
+	rpcDebug            = flag.Bool("rpcDebug", false, "With -rpcAddress, serve Go's pprof profiles at /debug/pprof/, and what the torrents' loops are up to at /debug/state, for finding out why one's stuck. They need the -rpcToken too.")
+	streamAddress       = flag.String("streamAddress", "", "If not empty, serve the torrents' files on this address for streaming while they download, at /torrents/<info-hash>/<file index>, e.g. localhost:8080. There's no token, so keep it on localhost. Keeps running after the torrents finish.")
+	controlSocket       = flag.String("controlSocket", "", "If not empty, the unix socket (on Windows, loopback host:port) for handing torrents to the instance that's running. Torrents given when one is running are added to it; otherwise this instance serves the socket, and keeps running after the torrents finish.")
+	controlList         = flag.Bool("controlList", false, "With -controlSocket, list the running instance's torrents, and exit.")
+	controlRemove       = flag.String("controlRemove", "", "With -controlSocket, remove the torrent with this info-hash, in hex, from the running instance, and exit.")
+	controlDeleteData   = flag.Bool("controlDeleteData", false, "With -controlRemove, delete the torrent's files too.")
+	blockSize           = flag.Int("blockSize", torrent.STANDARD_BLOCK_LENGTH, "How many bytes to ask peers for at a time, a multiple of 16384 up to 131072. Peers that don't answer requests for more than 16384 are asked for that.")
+	rateHalfLife        = flag.Duration("rateHalfLife", torrent.DEFAULT_RATE_HALF_LIFE, "How quickly the shown transfer rates follow changes. After this long, a peer that stopped shows half its old rate.")
+	chokeRateHalfLife   = flag.Duration("chokeRateHalfLife", torrent.DEFAULT_CHOKE_RATE_HALF_LIFE, "How quickly the download rates that decide which peers to unchoke follow changes.")
+	logLevel            = flag.String("logLevel", "info", "The least important messages to log: debug, info, warn, error or none.")
+	jsonProgress        = flag.Bool("jsonProgress", false, "Write each torrent's progress to stdout as a JSON object a line, every -progressInterval and when its state changes, and a last one when done. The log goes to stderr.")
+	progressInterval    = flag.Duration("progressInterval", torrent.PROGRESS_DEFAULT_INTERVAL, "How often -jsonProgress reports.")
 )
 
 func parseTorrentFlags() (flags *torrent.TorrentFlags, err error) {
-	dialer, err := dialerFromFlags()
+	bind, err := bindingFromFlags()
+	if err != nil {
+		return
+	}
+	dialer, err := dialerFromFlags(bind)
+	if err != nil {
+		return
+	}
+	schedule, err := torrent.ParseSpeedSchedule(*altSpeedSchedule)
+	if err != nil {
+		return
+	}
+	listenPort, portRangeEnd, err := portFromFlags()
+	if err != nil {
+		return
+	}
+	labelDirMap, err := torrent.ParseLabelDirs(*labelDirs)
+	if err != nil {
+		return
+	}
+	fsProvider, err := fsproviderFromFlags()
 	if err != nil {
 		return
 	}
 	flags = &torrent.TorrentFlags{
 		Dial:                dialer,
-		Port:                portFromFlags(),
+		Bind:                bind,
+		Port:                listenPort,
+		PortRangeEnd:        portRangeEnd,
+		RandomPort:          *randomPort,
+		ListenAddresses:     splitList(*listen),
 		FileDir:             *fileDir,
+		LabelDirs:           labelDirMap,
 		SeedRatio:           *seedRatio,
+		SeedTime:            *seedTime,
+		PauseAtSeedLimit:    *pauseAtSeedLimit,
+		RateHalfLife:        *rateHalfLife,
+		ChokeRateHalfLife:   *chokeRateHalfLife,
+		BlockSize:           *blockSize,
 		UseDeadlockDetector: *useDeadlockDetector,
 		UseLPD:              *useLPD,
+		LPDInterval:         *lpdInterval,
 		UseDHT:              *useDHT,
 		UseUPnP:             *useUPnP,
 		UseNATPMP:           *useNATPMP,
 		TrackerlessMode:     *trackerlessMode,
 		// IP address of gateway
-		Gateway:            *gateway,
-		InitialCheck:       *initialCheck,
-		FileSystemProvider: fsproviderFromFlags(),
-		Cacher:             cacheproviderFromFlags(),
-		ExecOnSeeding:      *execOnSeeding,
-		QuickResume:        *quickResume,
-		MaxActive:          *maxActive,
-		MemoryPerTorrent:   *memoryPerTorrent,
+		Gateway:                 *gateway,
+		PortCheckURL:            *portCheckURL,
+		InitialCheck:            *initialCheck,
+		OpenFilesParallel:       *openFilesParallel,
+		ZeroCopyUploads:         *zeroCopyUploads,
+		FileSystemProvider:      fsProvider,
+		Cacher:                  cacheproviderFromFlags(),
+		ExecOnSeeding:           *execOnSeeding,
+		OnAdded:                 *onAdded,
+		OnComplete:              *onComplete,
+		OnRemoved:               *onRemoved,
+		HookTimeout:             *hookTimeout,
+		QuickResume:             *quickResume,
+		ReverifyInterval:        *reverifyInterval,
+		MaxActive:               *maxActive,
+		MaxActiveDownloads:      *maxActiveDownloads,
+		MaxActiveSeeds:          *maxActiveSeeds,
+		MemoryPerTorrent:        *memoryPerTorrent,
+		MaxPieceMemory:          *maxPieceMemory,
+		MaxDiskUsage:            *maxDiskUsage * 1024 * 1024,
+		DataDir:                 *dataDir,
+		SaveSession:             *saveSession,
+		MetadataDir:             *metadataDir,
+		DHTBootstrapNodes:       dhtBootstrapNodesFromFlags(),
+		UseDHT6:                 *useDHT6,
+		DHTReadOnly:             *dhtReadOnly,
+		DHTMaxRequestsPerSecond: *dhtMaxRequests,
+		DHTMaxOutstanding:       *dhtMaxOutstanding,
+		DHTMaxInboundPerSecond:  *dhtMaxInbound,
+		DHTMaxNodes:             *dhtMaxNodes,
+		CrossSeedDir:            *crossSeedDir,
+		CrossSeedHashCheck:      *crossSeedHashCheck,
+		CrossSeedConfirm:        crossSeedConfirmFromFlags(),
+		WebSeedOnly:             *webSeedOnly,
+		MaxDownloadRate:         *maxDownloadRate,
+		MaxUploadRate:           *maxUploadRate,
+		AltDownloadRate:         *altDownloadRate,
+		AltUploadRate:           *altUploadRate,
+		AltSpeedSchedule:        schedule,
+		RPCAddress:              *rpcAddress,
+		RPCToken:                rpcTokenFromFlags(),
+		RPCMetrics:              *rpcMetrics,
+		RPCDebug:                *rpcDebug,
+		StreamAddress:           *streamAddress,
+		WatchDir:                *watchDir,
+		WatchDirDelete:          *watchDirDelete,
+		ConfigFile:              *configFile,
+		Blocklist:               *blocklistFile,
+		DisconnectBlocked:       *disconnectBlocked,
 	}
 	return
 }
 
-func portFromFlags() int {
-	if *port != 0 {
-		return *port
+func rpcTokenFromFlags() string {
+	if *rpcAddress == "" || *rpcToken != "" {
+		return *rpcToken
+	}
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		log.Fatal("Couldn't make a control API token:", err)
+	}
+	token := hex.EncodeToString(b)
+	log.Println("Control API token:", token)
+	return token
+}
+
+var crossSeedPromptMutex sync.Mutex
+
+// Asks on the terminal before using cross-seed matches, unless -crossSeedYes.
+func crossSeedConfirmFromFlags() func(string, []torrent.CrossSeedMatch) bool {
+	if *crossSeedYes {
+		return nil
+	}
+	return func(name string, matches []torrent.CrossSeedMatch) bool {
+		crossSeedPromptMutex.Lock()
+		defer crossSeedPromptMutex.Unlock()
+		fmt.Fprintln(os.Stderr, "Files found for", name+":")
+		for _, m := range matches {
+			fmt.Fprintln(os.Stderr, "  ", m)
+		}
+		fmt.Fprint(os.Stderr, "Downloading the rest writes to these files. Use them? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
+
+func dhtBootstrapNodesFromFlags() (nodes []string) {
+	return splitList(*dhtBootstrapNodes)
+}
+
+// Splits a comma separated flag value, dropping empty entries.
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+func portFromFlags() (listenPort, portRangeEnd int, err error) {
+	low, high, isRange := strings.Cut(*port, "-")
+	if listenPort, err = strconv.Atoi(low); err == nil && isRange {
+		portRangeEnd, err = strconv.Atoi(high)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Bad -port %q", *port)
+	}
+	if listenPort != 0 || isRange {
+		return
 	}
 
 	rr := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return rr.Intn(48000) + 1025
+	return rr.Intn(48000) + 1025, 0, nil
 }
 
 func cacheproviderFromFlags() torrent.CacheProvider {
@@ -97,26 +305,53 @@ func cacheproviderFromFlags() torrent.CacheProvider {
 	return nil
 }
 
-func fsproviderFromFlags() torrent.FsProvider {
+func fsproviderFromFlags() (torrent.FsProvider, error) {
 	if len(*useSFTP) > 0 {
-		return torrent.NewSftpFsProvider(*useSFTP)
+		config, err := torrent.ParseSftpConnection(*useSFTP)
+		if err != nil {
+			return nil, err
+		}
+		config.KeyFile = *sftpKey
+		config.KeyPassphrase = *sftpKeyPassphrase
+		config.UseAgent = *sftpAgent
+		config.KnownHosts = *sftpKnownHosts
+		config.MaxChannels = *sftpChannels
+		return &torrent.SftpFsProvider{Config: config}, nil
 	}
-	return torrent.OsFsProvider{}
+	return torrent.OsFsProvider{}, nil
 }
 
-func dialerFromFlags() (proxy.Dialer, error) {
+func bindingFromFlags() (*torrent.Binding, error) {
+	if *bindAddress == "" {
+		return nil, nil
+	}
+	return torrent.NewBinding(*bindAddress)
+}
+
+// Dials through the proxy, if there is one, and from bind, if it's not nil.
+func dialerFromFlags(bind *torrent.Binding) (proxy.Dialer, error) {
+	var forward proxy.Dialer = proxy.Direct
+	if bind != nil {
+		forward = bind
+	}
 	if len(*proxyAddress) > 0 {
-		return proxy.SOCKS5("tcp", string(*proxyAddress), nil, &proxy.Direct)
+		return proxy.SOCKS5("tcp", string(*proxyAddress), nil, forward)
 	}
-	return proxy.FromEnvironment(), nil
+	return proxy.FromEnvironmentUsing(forward), nil
 }
 
 func main() {
 	flag.Usage = usage
 	flag.Parse()
 
+	level, err := torrent.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	torrent.SetLogger(torrent.StdLogger{Level: level})
+
 	if *createTorrent != "" {
-		err := torrent.WriteMetaInfoBytes(*createTorrent, *createTracker, os.Stdout)
+		err := writeTorrent(*createTorrent, os.Stdout)
 		if err != nil {
 			log.Fatal("Could not create torrent file:", err)
 		}
@@ -133,7 +368,10 @@ func main() {
 
 	args := flag.Args()
 	narg := flag.NArg()
-	if narg < 1 {
+	if *controlSocket != "" && controlClient(args) {
+		return
+	}
+	if narg < 1 && *rpcAddress == "" && *watchDir == "" && *configFile == "" && *controlSocket == "" && *streamAddress == "" && !*saveSession {
 		log.Println("Too few arguments. Torrent file or torrent URL required.")
 		usage()
 	}
@@ -162,18 +400,73 @@ func main() {
 		}(*memprofile)
 	}
 
-	if (*memoryPerTorrent) >=0 {  //User is worried about memory use.
+	if (*memoryPerTorrent) >=0 || *maxPieceMemory > 0 {  //User is worried about memory use.
 		debug.SetGCPercent(20)  //Set the GC to clear memory more often.
 	}
 	
+	var progress *progressWriter
+	if *jsonProgress {
+		log.SetOutput(os.Stderr)
+		progress = newProgressWriter(os.Stdout)
+		torrentFlags.Progress = progress.report
+		torrentFlags.ProgressInterval = *progressInterval
+	}
+
 	log.Println("Starting.")
 
 	err = torrent.RunTorrents(torrentFlags, args)
+	if err == torrent.ErrAlreadyRunning {
+		// It started as we did.
+		infoHashes, err := torrent.HandOff(*controlSocket, args)
+		printAdded(infoHashes, err)
+		return
+	}
+	if progress != nil {
+		progress.done(err)
+	}
 	if err != nil {
 		log.Fatal("Could not run torrents", args, err)
 	}
 }
 
+// Does what's asked of the instance serving -controlSocket. It returns false
+// if there's nothing to ask, or if torrents are to be added and no instance
+// is running, so this one should.
+func controlClient(args []string) bool {
+	switch {
+	case *controlList:
+		statuses, err := torrent.ControlList(*controlSocket)
+		if err != nil {
+			log.Fatal("Couldn't list the torrents: ", err)
+		}
+		for _, s := range statuses {
+			fmt.Printf("%s %5.1f%% %s\n", s.InfoHash, 100*float64(s.GoodPieces)/math.Max(1, float64(s.Pieces)), s.Name)
+		}
+	case *controlRemove != "":
+		if err := torrent.ControlRemove(*controlSocket, *controlRemove, *controlDeleteData); err != nil {
+			log.Fatal("Couldn't remove the torrent: ", err)
+		}
+	case len(args) > 0:
+		infoHashes, err := torrent.ControlAdd(*controlSocket, args)
+		if err == torrent.ErrNotRunning {
+			return false
+		}
+		printAdded(infoHashes, err)
+	default:
+		return false
+	}
+	return true
+}
+
+func printAdded(infoHashes []string, err error) {
+	for _, ih := range infoHashes {
+		fmt.Println("Added", ih)
+	}
+	if err != nil {
+		log.Fatal("Couldn't add torrents: ", err)
+	}
+}
+
 func usage() {
 	log.Printf("usage: torrent.Torrent [options] (torrent-file | torrent-url)")
 
@@ -185,7 +478,11 @@ func startTracker(addr string, torrentFiles []string) (err error) {
 	t := tracker.NewTracker()
 	// TODO(jackpal) Allow caller to choose port number
 	t.Addr = addr
-	dial, err := dialerFromFlags()
+	bind, err := bindingFromFlags()
+	if err != nil {
+		return
+	}
+	dial, err := dialerFromFlags(bind)
 	if err != nil {
 		return
 	}
@@ -225,3 +522,30 @@ func listenSigInt() chan os.Signal {
 	signal.Notify(c, os.Interrupt, os.Kill)
 	return c
 }
+
+// Creates a torrent from the -create flags, and writes it to w.
+func writeTorrent(root string, w io.Writer) (err error) {
+	opts := &torrent.CreateOptions{
+		PieceLength:    *createPieceLength,
+		IncludeHidden:  *createHidden,
+		FollowSymlinks: *createSymlinks,
+		Private:        *createPrivate,
+		Source:         *createSource,
+		WebSeeds:       splitList(*createWebSeeds),
+		Comment:        *createComment,
+		CreatedBy:      *createCreatedBy,
+	}
+	for _, tier := range strings.Split(*createAnnounce, ";") {
+		if trackers := splitList(tier); len(trackers) > 0 {
+			opts.AnnounceList = append(opts.AnnounceList, trackers)
+		}
+	}
+	if len(opts.AnnounceList) == 0 && *createTracker != "" {
+		opts.Announce = "http://" + *createTracker + "/announce"
+	}
+	m, err := torrent.CreateTorrent(root, opts)
+	if err != nil {
+		return
+	}
+	return m.Bencode(w)
+}
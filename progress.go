@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jackpal/Taipei-Torrent/torrent"
+)
+
+// The -jsonProgress output: a JSON object a line, for scripts. There's a
+// "progress" record for each torrent every -progressInterval, and whenever
+// one changes state, and a "done" record when we finish. The log goes to
+// stderr, so nothing else is written to stdout.
+
+type progressRecord struct {
+	Type         string // "progress"
+	Time         time.Time
+	Name         string
+	InfoHash     string
+	State        string  // As TorrentStatus.State says
+	Percent      float64 // Of the bytes, verified
+	Downloaded   uint64
+	Uploaded     uint64
+	DownloadRate float64 // In bytes per second
+	UploadRate   float64
+	ETA          float64 // In seconds, or -1 if there's no telling
+	Peers        int
+	CompletedAt  *time.Time `json:",omitempty"` // When it finished downloading, if it's done and that's known
+}
+
+type doneRecord struct {
+	Type       string // "done"
+	Time       time.Time
+	ExitStatus int
+	Error      string  `json:",omitempty"`
+	Elapsed    float64 // In seconds
+}
+
+type progressWriter struct {
+	mu    sync.Mutex // Progress is reported from a goroutine of its own
+	enc   *json.Encoder
+	start time.Time
+}
+
+func newProgressWriter(w io.Writer) *progressWriter {
+	return &progressWriter{enc: json.NewEncoder(w), start: time.Now()}
+}
+
+func (p *progressWriter) report(statuses []torrent.TorrentStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for i := range statuses {
+		s := &statuses[i]
+		r := progressRecord{
+			Type:         "progress",
+			Time:         now,
+			Name:         s.Name,
+			InfoHash:     s.InfoHash,
+			State:        s.State(),
+			Downloaded:   s.Downloaded,
+			Uploaded:     s.Uploaded,
+			DownloadRate: s.DownloadRate,
+			UploadRate:   s.UploadRate,
+			ETA:          -1,
+			Peers:        s.Connected,
+		}
+		if s.Size > 0 {
+			r.Percent = 100 * float64(s.Completed) / float64(s.Size)
+		}
+		if s.ETA >= 0 {
+			r.ETA = s.ETA.Seconds()
+		}
+		if !s.CompletedAt.IsZero() {
+			r.CompletedAt = &s.CompletedAt
+		}
+		p.enc.Encode(r)
+	}
+}
+
+// Writes the last record, for how the run ended.
+func (p *progressWriter) done(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := doneRecord{Type: "done", Time: time.Now(), Elapsed: time.Since(p.start).Seconds()}
+	if err != nil {
+		r.ExitStatus, r.Error = 1, err.Error()
+	}
+	p.enc.Encode(r)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackpal/Taipei-Torrent/torrent"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var out bytes.Buffer
+	p := newProgressWriter(&out)
+	finished := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	p.report([]torrent.TorrentStatus{
+		{Name: "a", HaveTorrent: true, Size: 200, Completed: 50, Left: 150, Connected: 3, ETA: 90 * time.Second},
+		{Name: "b", Adding: true, ETA: -1},
+		{Name: "c", HaveTorrent: true, Size: 200, Completed: 200, CompletedAt: finished},
+	})
+	p.done(errors.New("Disk full"))
+
+	dec := json.NewDecoder(&out)
+	var a, b, c progressRecord
+	var done doneRecord
+	for _, r := range []interface{}{&a, &b, &c, &done} {
+		if err := dec.Decode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Type != "progress" || a.State != "downloading" || a.Percent != 25 || a.ETA != 90 || a.Peers != 3 || a.CompletedAt != nil {
+		t.Errorf("First record %+v", a)
+	}
+	if b.State != "adding" || b.ETA != -1 || b.CompletedAt != nil {
+		t.Errorf("Second record %+v", b)
+	}
+	if c.State != "seeding" || c.Percent != 100 || c.CompletedAt == nil || !c.CompletedAt.Equal(finished) {
+		t.Errorf("Third record %+v", c)
+	}
+	if done.Type != "done" || done.ExitStatus != 1 || done.Error != "Disk full" || done.Elapsed < 0 {
+		t.Errorf("Last record %+v", done)
+	}
+	if dec.More() {
+		t.Error("More records than expected")
+	}
+}
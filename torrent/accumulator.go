@@ -1,55 +1,93 @@
 package torrent
 
-import "time"
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-// An accumulator that keeps track of the rate of increase.
+// An accumulator that keeps track of the rate of increase, as exponentially
+// weighted moving averages: one for each half-life its rate is asked for
+// with. Any goroutine can Add to it. The averages are brought up to date when
+// they're read, so nothing has to sample it on a ticker: what was added since
+// an average was last read counts for 1 - 2^(-elapsed/halfLife) of it, so at
+// a steady rate it comes out the same however often it's read, and after a
+// half-life with nothing added it's halved. The times are taken with
+// time.Now, whose monotonic clock keeps the wall clock's jumps out of it.
 type Accumulator struct {
-	maxRatePeriod time.Duration
-	rateSince     time.Time
-	last          time.Time
-	rate          float64
-	total         int64
-}
-
-func NewAccumulator(now time.Time, maxRatePeriod time.Duration) (acc *Accumulator) {
-	acc = &Accumulator{}
-	acc.maxRatePeriod = maxRatePeriod
-	acc.rateSince = now.Add(time.Second * -1)
-	acc.last = acc.rateSince
-	acc.rate = 0.0
-	acc.total = 0
-	return acc
-}
-
-func (a *Accumulator) Add(now time.Time, amount int64) {
-	a.total += amount
-	a.rate = (a.rate*float64(a.last.Sub(a.rateSince)) + float64(amount)) /
-		float64(now.Sub(a.rateSince))
-	a.last = now
-	newRateSince := now.Add(-a.maxRatePeriod)
-	if a.rateSince.Before(newRateSince) {
-		a.rateSince = newRateSince
+	total int64 // Use atomically
+	start time.Time
+
+	mu       sync.Mutex
+	averages []movingAverage
+}
+
+type movingAverage struct {
+	halfLife time.Duration
+	rate     float64 // Bytes per second
+	counted  int64   // total, when last read
+	at       time.Time
+}
+
+func NewAccumulator(now time.Time) *Accumulator {
+	return &Accumulator{start: now}
+}
+
+func (a *Accumulator) Add(amount int64) {
+	atomic.AddInt64(&a.total, amount)
+}
+
+// The average with halfLife. One that hasn't been read before starts from
+// when the accumulator was made. Call with mu held.
+func (a *Accumulator) average(halfLife time.Duration) *movingAverage {
+	for i := range a.averages {
+		if a.averages[i].halfLife == halfLife {
+			return &a.averages[i]
+		}
 	}
+	a.averages = append(a.averages, movingAverage{halfLife: halfLife, at: a.start})
+	return &a.averages[len(a.averages)-1]
 }
 
-func (a *Accumulator) GetRate(now time.Time) float64 {
-	a.Add(now, 0)
-	return a.GetRateNoUpdate()
+// GetRate is the rate in bytes per second, averaged with halfLife, as of now.
+func (a *Accumulator) GetRate(now time.Time, halfLife time.Duration) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m := a.average(halfLife)
+	elapsed := now.Sub(m.at)
+	if elapsed <= 0 {
+		return m.rate
+	}
+	total := a.getTotal()
+	recent := float64(total-m.counted) / elapsed.Seconds()
+	kept := math.Exp2(-float64(elapsed) / float64(halfLife))
+	m.rate = m.rate*kept + recent*(1-kept)
+	m.counted, m.at = total, now
+	return m.rate
 }
 
-func (a *Accumulator) GetRateNoUpdate() float64 {
-	return a.rate * float64(time.Second)
+// GetRateNoUpdate is the rate averaged with halfLife as of when it was last
+// read.
+func (a *Accumulator) GetRateNoUpdate(halfLife time.Duration) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.average(halfLife).rate
 }
 
-func (a *Accumulator) DurationUntilRate(now time.Time, newRate float64) time.Duration {
-	rate := a.rate
+// How long it would take the rate averaged with halfLife to come down to
+// newRate, if nothing more were added.
+func (a *Accumulator) DurationUntilRate(now time.Time, halfLife time.Duration, newRate float64) time.Duration {
+	rate := a.GetRate(now, halfLife)
 	if rate <= newRate {
 		return time.Duration(0)
 	}
-	dt := float64(now.Sub(a.rateSince))
-	return time.Duration(((rate * dt) / newRate) - dt)
+	if newRate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(float64(halfLife) * math.Log2(rate/newRate))
 }
 
 func (a *Accumulator) getTotal() int64 {
-	return a.total
+	return atomic.LoadInt64(&a.total)
 }
@@ -1,24 +1,84 @@
 package torrent
 
 import (
+	"math"
+	"sync"
 	"testing"
 	"time"
 )
 
+// At a steady rate, an average read every second climbs to it as
+// 1 - 2^(-t/halfLife), the same as one read only at the end, and with
+// nothing more added it halves each half-life, however often it's read.
 func TestAccumulator(t *testing.T) {
 	start := time.Now()
-	a := NewAccumulator(start, time.Minute)
-	checkAcc(t, a, 0)
-	a.Add(start, 1)
-	checkAcc(t, a, 1)
-	a.Add(start, 10)
-	checkAcc(t, a, 11)
-	checkRate(t, start, a, 11)
-	middle := start.Add(time.Second)
-	checkRate(t, middle, a, 5.5)
-	a.Add(middle, 10)
-	checkAcc(t, a, 21)
-	checkRate(t, middle, a, 10.5)
+	short, long := 4*time.Second, 16*time.Second
+	a := NewAccumulator(start)
+	now := start
+	for i := 0; i < 8; i++ {
+		now = now.Add(time.Second)
+		a.Add(1000)
+		a.GetRate(now, short)
+	}
+	checkRate(t, now, a, short, 1000*(1-math.Exp2(-2)))
+	checkRate(t, now, a, long, 1000*(1-math.Exp2(-0.5)))
+	for i := 8; i < 100; i++ {
+		now = now.Add(time.Second)
+		a.Add(1000)
+		a.GetRate(now, short)
+	}
+	checkRate(t, now, a, short, 1000*(1-math.Exp2(-25)))
+	checkAcc(t, a, 100*1000)
+
+	// Nothing for a half-life halves it.
+	converged := a.GetRateNoUpdate(short)
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		a.GetRate(now, short)
+	}
+	checkRate(t, now, a, short, converged/2)
+	slow := a.GetRate(now, long)
+	checkRate(t, now.Add(long), a, long, slow/2)
+
+	// Reading again at once changes nothing.
+	rate := a.GetRateNoUpdate(short)
+	checkRate(t, now, a, short, rate)
+}
+
+// A burst counts for half after a half-life, and half again after another:
+// a peer doesn't look fast for long on the strength of one.
+func TestAccumulatorBurst(t *testing.T) {
+	start := time.Now()
+	a := NewAccumulator(start)
+	a.Add(10000)
+	checkRate(t, start.Add(time.Second), a, time.Second, 5000)
+	checkRate(t, start.Add(2*time.Second), a, time.Second, 2500)
+	if d := a.DurationUntilRate(start.Add(2*time.Second), time.Second, 625); d != 2*time.Second {
+		t.Errorf("It takes %v to come down to 625", d)
+	}
+	if d := a.DurationUntilRate(start.Add(2*time.Second), time.Second, 5000); d != 0 {
+		t.Errorf("It takes %v to come down to more than it is", d)
+	}
+	// A read from before the last changes nothing.
+	checkRate(t, start, a, time.Second, 2500)
+}
+
+func TestAccumulatorConcurrent(t *testing.T) {
+	start := time.Now()
+	a := NewAccumulator(start)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				a.Add(1)
+				a.GetRate(time.Now(), time.Second)
+			}
+		}()
+	}
+	wg.Wait()
+	checkAcc(t, a, 8000)
 }
 
 func checkAcc(t *testing.T, a *Accumulator, expectedTotal int64) {
@@ -28,9 +88,9 @@ func checkAcc(t *testing.T, a *Accumulator, expectedTotal int64) {
 	}
 }
 
-func checkRate(t *testing.T, now time.Time, a *Accumulator, expectedRate float64) {
-	rate := a.GetRate(now)
-	if rate != expectedRate {
-		t.Errorf("a.GetRate(%v) = %g. Expected %g", now, rate, expectedRate)
+func checkRate(t *testing.T, now time.Time, a *Accumulator, halfLife time.Duration, expectedRate float64) {
+	rate := a.GetRate(now, halfLife)
+	if math.Abs(rate-expectedRate) > 1e-9*math.Max(1, expectedRate) {
+		t.Errorf("a.GetRate(%v, %v) = %g. Expected %g", now, halfLife, rate, expectedRate)
 	}
 }
@@ -0,0 +1,125 @@
+package torrent
+
+// Piece availability: how many of the connected peers have each piece, kept
+// up to date as they tell us what they have, so that the swarm's health can
+// be shown without going through every peer's pieces each time it's asked
+// for. A piece's copies are the peers' and, if we have it, ours: a torrent
+// with a piece nobody has won't finish until someone who has it turns up.
+//
+// Peers are counted once we know how many pieces there are, so a peer whose
+// bitfield came before the metadata is counted when it's applied.
+
+type availability struct {
+	peers   []int // Per piece, the counted peers that have it
+	byPeers []int // byPeers[n] is how many pieces n peers have
+	copies  []int // copies[n] is how many pieces there are n copies of
+}
+
+// Moves a piece in a histogram from one count to another.
+func moveCount(hist []int, from, to int) []int {
+	for len(hist) <= to {
+		hist = append(hist, 0)
+	}
+	hist[from]--
+	hist[to]++
+	return hist
+}
+
+// Counts the availability again from scratch, for when the pieces, or which
+// of them we have, change wholesale.
+func (ts *TorrentSession) countAvailability() {
+	a := &ts.availability
+	a.peers = make([]int, ts.totalPieces)
+	a.byPeers = []int{ts.totalPieces}
+	a.copies = []int{ts.totalPieces}
+	for i := 0; i < ts.totalPieces; i++ {
+		if ts.pieceSet != nil && ts.pieceSet.IsSet(i) {
+			a.copies = moveCount(a.copies, 0, 1)
+		}
+	}
+	for _, p := range ts.peers {
+		p.counted = false
+		ts.countPeer(p)
+	}
+}
+
+// Counts the peer's pieces, if it's told us what it has of the torrent we
+// know of.
+func (ts *TorrentSession) countPeer(p *peerState) {
+	if p.counted || p.have == nil || p.have.n != ts.totalPieces || ts.totalPieces == 0 {
+		return
+	}
+	p.counted = true
+	p.have.ForEachSet(func(i int) { ts.peerPieceCount(i, 1) })
+}
+
+// Stops counting the peer's pieces, as it's gone, or its bitfield's being
+// replaced.
+func (ts *TorrentSession) uncountPeer(p *peerState) {
+	if !p.counted {
+		return
+	}
+	p.counted = false
+	p.have.ForEachSet(func(i int) { ts.peerPieceCount(i, -1) })
+}
+
+func (ts *TorrentSession) peerPieceCount(piece, delta int) {
+	a := &ts.availability
+	n, ours := a.peers[piece], int(b2i(ts.pieceSet.IsSet(piece)))
+	a.peers[piece] = n + delta
+	a.byPeers = moveCount(a.byPeers, n, n+delta)
+	a.copies = moveCount(a.copies, n+ours, n+delta+ours)
+}
+
+// setPeerHave replaces what the peer has, counting it instead.
+func (ts *TorrentSession) setPeerHave(p *peerState, have *Bitset) {
+	ts.uncountPeer(p)
+	p.have = have
+	ts.countPeer(p)
+}
+
+// peerHas notes that the peer has the piece, as its Have said.
+func (ts *TorrentSession) peerHas(p *peerState, piece int) {
+	if p.have.IsSet(piece) {
+		return
+	}
+	p.have.Set(piece)
+	if p.counted {
+		ts.peerPieceCount(piece, 1)
+	}
+}
+
+// setHavePiece sets or clears a piece of ours, counting our copy.
+func (ts *TorrentSession) setHavePiece(piece int, have bool) {
+	if ts.pieceSet.IsSet(piece) == have {
+		return
+	}
+	if have {
+		ts.pieceSet.Set(piece)
+	} else {
+		ts.pieceSet.Clear(piece)
+	}
+	if a := &ts.availability; len(a.peers) == ts.totalPieces {
+		n := a.peers[piece]
+		a.copies = moveCount(a.copies, n+int(b2i(!have)), n+int(b2i(have)))
+	}
+}
+
+// Fills in the status's availability, and the copies there are of the
+// torrent. That takes as long as the most copies there are of a piece, not
+// as long as there are pieces.
+func (ts *TorrentSession) availabilityStatus(s *TorrentStatus) {
+	a := &ts.availability
+	if ts.totalPieces == 0 || len(a.peers) != ts.totalPieces {
+		return
+	}
+	s.Availability = make([]int, len(ts.peers)+1)
+	copy(s.Availability, a.byPeers)
+	for n, pieces := range a.copies {
+		if pieces > 0 {
+			s.DistributedCopies = float64(n) + float64(ts.totalPieces-pieces)/float64(ts.totalPieces)
+			s.CompleteCopy = n > 0
+			break
+		}
+	}
+}
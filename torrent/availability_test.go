@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// The availability kept up as peers come, go and tell us what they have,
+// and as we get and lose pieces, is what counting it all from scratch finds.
+func TestAvailability(t *testing.T) {
+	const pieces = 50
+	rng := rand.New(rand.NewSource(1))
+	ts := &TorrentSession{totalPieces: pieces, pieceSet: NewBitset(pieces), peers: make(map[string]*peerState)}
+	ts.countAvailability()
+	// Counted from scratch.
+	want := func() (s TorrentStatus) {
+		s.Availability = make([]int, len(ts.peers)+1)
+		copies := make([]int, pieces)
+		for i := 0; i < pieces; i++ {
+			copies[i] = int(b2i(ts.pieceSet.IsSet(i)))
+			for _, p := range ts.peers {
+				if p.have.n == pieces && p.have.IsSet(i) {
+					copies[i]++
+				}
+			}
+			s.Availability[copies[i]-int(b2i(ts.pieceSet.IsSet(i)))]++
+		}
+		least := copies[0]
+		for _, n := range copies {
+			least = min(least, n)
+		}
+		more := 0
+		for _, n := range copies {
+			if n > least {
+				more++
+			}
+		}
+		s.DistributedCopies = float64(least) + float64(more)/pieces
+		s.CompleteCopy = least > 0
+		return
+	}
+	randomHave := func() *Bitset {
+		b := NewBitset(pieces)
+		for i := 0; i < pieces; i++ {
+			if rng.Intn(3) == 0 {
+				b.Set(i)
+			}
+		}
+		return b
+	}
+	for step := 0; step < 2000; step++ {
+		var p *peerState
+		for _, p = range ts.peers {
+			break
+		}
+		switch op := rng.Intn(6); {
+		case op == 0 || p == nil:
+			p = &peerState{address: strconv.Itoa(step), have: NewBitset(pieces)}
+			ts.peers[p.address] = p
+			ts.countPeer(p)
+		case op == 1:
+			ts.setPeerHave(p, randomHave())
+		case op == 2:
+			ts.peerHas(p, rng.Intn(pieces))
+		case op == 3:
+			ts.uncountPeer(p)
+			delete(ts.peers, p.address)
+		case op == 4:
+			ts.setHavePiece(rng.Intn(pieces), rng.Intn(2) == 0)
+		case step%100 == 0:
+			ts.pieceSet = randomHave()
+			ts.countAvailability()
+		}
+		var got TorrentStatus
+		ts.availabilityStatus(&got)
+		w := want()
+		if !reflect.DeepEqual(got.Availability, w.Availability) || got.DistributedCopies != w.DistributedCopies || got.CompleteCopy != w.CompleteCopy {
+			t.Fatalf("Step %d: %v %v %v, counted %v %v %v", step, got.Availability, got.DistributedCopies, got.CompleteCopy,
+				w.Availability, w.DistributedCopies, w.CompleteCopy)
+		}
+	}
+}
+
+// A piece nobody has, ours included, leaves no complete copy, and under one
+// distributed copy.
+func TestAvailabilityMissingPiece(t *testing.T) {
+	ts := &TorrentSession{totalPieces: 4, pieceSet: NewBitset(4), peers: make(map[string]*peerState)}
+	ts.setHavePiece(0, true)
+	ts.countAvailability()
+	p := &peerState{address: "a", have: NewBitset(4)}
+	ts.peers[p.address] = p
+	ts.peerHas(p, 1)
+	ts.peerHas(p, 1)
+	ts.countPeer(p)
+	ts.peerHas(p, 2)
+	var s TorrentStatus
+	ts.availabilityStatus(&s)
+	if s.CompleteCopy || s.DistributedCopies != 0.75 || !reflect.DeepEqual(s.Availability, []int{2, 2}) {
+		t.Errorf("%+v", s)
+	}
+	ts.peerHas(p, 3)
+	ts.availabilityStatus(&s)
+	if !s.CompleteCopy || s.DistributedCopies != 1 {
+		t.Errorf("With every piece, %+v", s)
+	}
+}
@@ -0,0 +1,334 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Download and upload rate limits, shared by all the torrents. When they're
+// contended, each torrent gets a share by its bandwidth priority: weighted
+// fair queueing, the next bytes going to whoever's waited least for their
+// weight. A high priority torrent gets four times a low one's share, and
+// twice a normal one's, but any of them can use what the others leave.
+
+const (
+	BANDWIDTH_HIGH   = "high"
+	BANDWIDTH_NORMAL = "normal"
+	BANDWIDTH_LOW    = "low"
+)
+
+var bandwidthWeights = map[string]int32{
+	BANDWIDTH_HIGH:   4,
+	BANDWIDTH_NORMAL: 2,
+	BANDWIDTH_LOW:    1,
+}
+
+var errBadBandwidthPriority = errors.New("The bandwidth priority must be high, normal or low")
+
+// A rateLimiter lets through up to rate bytes a second. Going over puts it in
+// debt, which the next caller waits out. A nil rateLimiter, or a rate of 0,
+// means no limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64 // Up to a second's worth
+	last   time.Time
+	// The callers waiting their turn. The next is the one with the earliest
+	// virtual finish time: the virtual time it was asked at, plus its bytes
+	// over its weight.
+	waiting []*rateRequest
+	virtual float64 // The finish time of the last one let through
+	turn    *sync.Cond
+	// What's been through it, limited or not, if it's counted.
+	through *Accumulator
+}
+
+type rateRequest struct {
+	n      int
+	finish float64
+}
+
+// A torrent's requests of one rateLimiter. A nil rateFlow has the normal
+// weight.
+type rateFlow struct {
+	class  *bandwidthClass
+	finish float64 // Its last request's virtual finish time, guarded by the limiter's mu
+}
+
+func (f *rateFlow) weight() int32 {
+	if f == nil {
+		return bandwidthWeights[BANDWIDTH_NORMAL]
+	}
+	return atomic.LoadInt32(&f.class.weight)
+}
+
+// A torrent's bandwidth priority, and its flows for the two limits.
+type bandwidthClass struct {
+	weight   int32 // Atomic
+	down, up rateFlow
+}
+
+func newBandwidthClass() *bandwidthClass {
+	c := &bandwidthClass{weight: bandwidthWeights[BANDWIDTH_NORMAL]}
+	c.down.class, c.up.class = c, c
+	return c
+}
+
+func (c *bandwidthClass) priority() string {
+	w := atomic.LoadInt32(&c.weight)
+	for p, pw := range bandwidthWeights {
+		if pw == w {
+			return p
+		}
+	}
+	return BANDWIDTH_NORMAL
+}
+
+func (c *bandwidthClass) setPriority(priority string) error {
+	w, ok := bandwidthWeights[priority]
+	if !ok {
+		return errBadBandwidthPriority
+	}
+	atomic.StoreInt32(&c.weight, w)
+	return nil
+}
+
+func (l *rateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.tokens, l.last = rate, 0, time.Now()
+	if l.turn != nil {
+		// Those waiting may not have to any more.
+		l.turn.Broadcast()
+	}
+}
+
+func (l *rateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// wait takes n bytes' worth from the limiter for flow, waiting its turn, and
+// then for the limiter to be out of debt.
+func (l *rateLimiter) wait(n int, flow *rateFlow) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if l.through != nil {
+		l.through.Add(int64(n))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return
+	}
+	if l.turn == nil {
+		l.turn = sync.NewCond(&l.mu)
+	}
+	start := l.virtual
+	if flow != nil && flow.finish > start {
+		start = flow.finish
+	}
+	r := &rateRequest{n, start + float64(n)/float64(flow.weight())}
+	if flow != nil {
+		flow.finish = r.finish
+	}
+	l.waiting = append(l.waiting, r)
+	defer l.turn.Broadcast()
+	for {
+		if l.rate <= 0 {
+			l.remove(r)
+			return
+		}
+		if l.next() != r {
+			l.turn.Wait()
+			continue
+		}
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+		l.last = now
+		if l.tokens >= 0 {
+			l.tokens -= float64(n)
+			l.virtual = r.finish
+			l.remove(r)
+			return
+		}
+		delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+		time.Sleep(delay)
+		l.mu.Lock()
+	}
+}
+
+func (l *rateLimiter) next() (next *rateRequest) {
+	for _, r := range l.waiting {
+		if next == nil || r.finish < next.finish {
+			next = r
+		}
+	}
+	return
+}
+
+func (l *rateLimiter) remove(r *rateRequest) {
+	for i, w := range l.waiting {
+		if w == r {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+type bandwidth struct {
+	down, up rateLimiter
+
+	mu       sync.Mutex
+	limits   SpeedLimits
+	schedule SpeedSchedule
+}
+
+// SpeedLimits are the limits on all the torrents' rates, in bytes per second
+// with 0 meaning none, and which of them are in force.
+type SpeedLimits struct {
+	Download, Upload       int64
+	AltDownload, AltUpload int64 // The alternative limits
+	AltSpeed               bool  // The alternative limits are in force
+	AltSpeedManual         bool  // Switched by hand, rather than by the schedule
+}
+
+func newBandwidth(flags *TorrentFlags) *bandwidth {
+	b := &bandwidth{schedule: flags.AltSpeedSchedule}
+	now := time.Now()
+	b.down.through, b.up.through = NewAccumulator(now), NewAccumulator(now)
+	b.limits = SpeedLimits{
+		Download:    flags.MaxDownloadRate,
+		Upload:      flags.MaxUploadRate,
+		AltDownload: flags.AltDownloadRate,
+		AltUpload:   flags.AltUploadRate,
+		AltSpeed:    b.schedule.Active(time.Now()),
+	}
+	b.apply()
+	return b
+}
+
+// Sets the rate limiters to the limits in force. They keep working for the
+// connections using them, so nothing's dropped. Call with mu held, or
+// before b is shared.
+func (b *bandwidth) apply() {
+	if b.limits.AltSpeed {
+		b.down.SetRate(b.limits.AltDownload)
+		b.up.SetRate(b.limits.AltUpload)
+	} else {
+		b.down.SetRate(b.limits.Download)
+		b.up.SetRate(b.limits.Upload)
+	}
+}
+
+// The rates of everything through the limiters, protocol messages and all,
+// averaged with halfLife.
+func (b *bandwidth) rates(now time.Time, halfLife time.Duration) (down, up float64) {
+	return b.down.through.GetRate(now, halfLife), b.up.through.GetRate(now, halfLife)
+}
+
+func (b *bandwidth) Limits() SpeedLimits {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limits
+}
+
+// Changes the limits, but not which are in force.
+func (b *bandwidth) SetLimits(l SpeedLimits) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l.AltSpeed, l.AltSpeedManual = b.limits.AltSpeed, b.limits.AltSpeedManual
+	b.limits = l
+	b.apply()
+}
+
+// Switches to the alternative limits, or back, until SetAltSpeedScheduled.
+func (b *bandwidth) SetAltSpeed(on bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits.AltSpeedManual = true
+	b.setAltSpeed(on)
+}
+
+// Goes back to following the schedule.
+func (b *bandwidth) SetAltSpeedScheduled() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits.AltSpeedManual = false
+	b.setAltSpeed(b.schedule.Active(time.Now()))
+}
+
+// Changes the schedule, and switches the limits if it says to.
+func (b *bandwidth) setSchedule(s SpeedSchedule) {
+	b.mu.Lock()
+	b.schedule = s
+	b.mu.Unlock()
+	b.followSchedule(time.Now())
+}
+
+// Switches the limits if the schedule says to, unless they were switched by
+// hand.
+func (b *bandwidth) followSchedule(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.limits.AltSpeedManual {
+		b.setAltSpeed(b.schedule.Active(now))
+	}
+}
+
+func (b *bandwidth) setAltSpeed(on bool) {
+	if on == b.limits.AltSpeed {
+		return
+	}
+	b.limits.AltSpeed = on
+	if on {
+		log.Println("Switching to the alternative speed limits")
+	} else {
+		log.Println("Switching to the normal speed limits")
+	}
+	b.apply()
+}
+
+// A connection to a peer that keeps to the rate limits, at its torrent's
+// priority. It reads and writes in the peer's own goroutines, so waiting
+// doesn't hold up the torrent.
+type limitedConn struct {
+	net.Conn
+	b     *bandwidth
+	class *bandwidthClass
+}
+
+func (c *limitedConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.b.down.wait(n, &c.class.down)
+	return
+}
+
+func (c *limitedConn) Write(p []byte) (n int, err error) {
+	c.b.up.wait(len(p), &c.class.up)
+	return c.Conn.Write(p)
+}
+
+// BandwidthPriority is the torrent's share of the rate limits when they're
+// contended: "high", "normal" or "low".
+func (ts *TorrentSession) BandwidthPriority() string {
+	return ts.bandwidthClass.priority()
+}
+
+// SetBandwidthPriority takes effect at once, for every peer and web seed.
+func (ts *TorrentSession) SetBandwidthPriority(priority string) error {
+	return ts.bandwidthClass.setPriority(priority)
+}
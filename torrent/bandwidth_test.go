@@ -0,0 +1,120 @@
+package torrent
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l *rateLimiter
+	l.wait(1<<30, nil) // No limit
+	l = &rateLimiter{}
+	l.SetRate(300 * 1024)
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		l.wait(10*1024, nil)
+	}
+	// 300KiB at 300KiB/s, with nothing saved up.
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Took %v", elapsed)
+	}
+	l.SetRate(0)
+	start = time.Now()
+	l.wait(1<<30, nil)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Without a limit, took %v", elapsed)
+	}
+}
+
+// What goes through the limiters is counted, limited or not.
+func TestBandwidthRates(t *testing.T) {
+	b := newBandwidth(&TorrentFlags{MaxUploadRate: 1 << 30})
+	start := b.down.through.start
+	b.down.wait(1000, nil)
+	b.up.wait(3000, nil)
+	down, up := b.rates(start.Add(time.Second), time.Second)
+	if down != 500 || up != 1500 {
+		t.Errorf("Rates of %v and %v", down, up)
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	always, err := ParseSpeedSchedule("* 00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBandwidth(&TorrentFlags{MaxDownloadRate: 1000, MaxUploadRate: 500, AltDownloadRate: 100, AltUploadRate: 50, AltSpeedSchedule: always})
+	if l := b.Limits(); !l.AltSpeed || b.down.Rate() != 100 || b.up.Rate() != 50 {
+		t.Errorf("On the schedule, %+v", l)
+	}
+	b.SetAltSpeed(false)
+	b.followSchedule(time.Now())
+	if l := b.Limits(); l.AltSpeed || !l.AltSpeedManual || b.down.Rate() != 1000 {
+		t.Errorf("Switched off by hand, %+v", l)
+	}
+	b.SetAltSpeedScheduled()
+	if l := b.Limits(); !l.AltSpeed || l.AltSpeedManual || b.down.Rate() != 100 {
+		t.Errorf("Back on the schedule, %+v", l)
+	}
+	b.schedule = nil
+	b.followSchedule(time.Now())
+	if b.Limits().AltSpeed || b.up.Rate() != 500 {
+		t.Errorf("Off the schedule, %+v", b.Limits())
+	}
+	b.SetLimits(SpeedLimits{Download: 2000, Upload: 1000})
+	if l := b.Limits(); l.Download != 2000 || b.up.Rate() != 1000 {
+		t.Errorf("After changing the limits, %+v", l)
+	}
+}
+
+func TestBandwidthPriority(t *testing.T) {
+	l := &rateLimiter{}
+	l.SetRate(100 * 1024)
+	classes := map[string]*bandwidthClass{}
+	for p := range bandwidthWeights {
+		classes[p] = newBandwidthClass()
+		if err := classes[p].setPriority(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := newBandwidthClass().setPriority("urgent"); err != errBadBandwidthPriority {
+		t.Errorf("A bad priority, %v", err)
+	}
+
+	// Each torrent wants all it can get.
+	contend := func(classes map[string]*bandwidthClass, d time.Duration) map[string]int {
+		var mu sync.Mutex
+		got := map[string]int{}
+		var wg sync.WaitGroup
+		deadline := time.Now().Add(d)
+		for p, c := range classes {
+			wg.Add(1)
+			go func(p string, c *bandwidthClass) {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					l.wait(1024, &c.down)
+					mu.Lock()
+					got[p] += 1024
+					mu.Unlock()
+				}
+			}(p, c)
+		}
+		wg.Wait()
+		return got
+	}
+	got := contend(classes, 1500*time.Millisecond)
+	low := float64(got[BANDWIDTH_LOW])
+	if r := float64(got[BANDWIDTH_HIGH]) / low; r < 3 || r > 5.5 {
+		t.Errorf("High got %.1f times low's share: %v", r, got)
+	}
+	if r := float64(got[BANDWIDTH_NORMAL]) / low; r < 1.5 || r > 2.8 {
+		t.Errorf("Normal got %.1f times low's share: %v", r, got)
+	}
+
+	// Alone, a low priority torrent gets it all.
+	got = contend(map[string]*bandwidthClass{BANDWIDTH_LOW: classes[BANDWIDTH_LOW]}, 500*time.Millisecond)
+	if got[BANDWIDTH_LOW] < 35*1024 {
+		t.Errorf("Alone, low got %d bytes", got[BANDWIDTH_LOW])
+	}
+}
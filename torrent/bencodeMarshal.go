@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bencodeMarshal writes v in bencode. Dictionary keys are written in sorted
+// order, so the same value always encodes the same way, which info-hashes
+// depend on.
+//
+// Struct fields are named by their `bencode:"name"` tag, or their lower
+// cased field name. ",omitempty" leaves out zero values, and "-" leaves the
+// field out altogether. The fields of embedded structs are written as if
+// they were the outer struct's. rawBencode values are written as they are.
+func bencodeMarshal(w io.Writer, v interface{}) (err error) {
+	var b bytes.Buffer
+	if err = encodeBencode(&b, reflect.ValueOf(v)); err != nil {
+		return
+	}
+	_, err = w.Write(b.Bytes())
+	return
+}
+
+var rawBencodeType = reflect.TypeOf(rawBencode(nil))
+
+func encodeBencode(b *bytes.Buffer, v reflect.Value) (err error) {
+	if !v.IsValid() {
+		return fmt.Errorf("bencode: can't encode nil")
+	}
+	if v.Type() == rawBencodeType {
+		b.Write(v.Bytes())
+		return
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: can't encode nil %v", v.Type())
+		}
+		return encodeBencode(b, v.Elem())
+	case reflect.String:
+		writeBencodeString(b, v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b.WriteString("i" + strconv.FormatInt(v.Int(), 10) + "e")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		b.WriteString("i" + strconv.FormatUint(v.Uint(), 10) + "e")
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte is a string.
+			bs := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(bs), v)
+			writeBencodeString(b, string(bs))
+			return
+		}
+		b.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err = encodeBencode(b, v.Index(i)); err != nil {
+				return
+			}
+		}
+		b.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: can't encode %v, keys must be strings", v.Type())
+		}
+		keys := make([]string, 0, v.Len())
+		values := map[string]reflect.Value{}
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+			values[k.String()] = v.MapIndex(k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('d')
+		for _, k := range keys {
+			writeBencodeString(b, k)
+			if err = encodeBencode(b, values[k]); err != nil {
+				return
+			}
+		}
+		b.WriteByte('e')
+	case reflect.Struct:
+		fields := map[string]reflect.Value{}
+		structFields(v, fields)
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('d')
+		for _, k := range keys {
+			writeBencodeString(b, k)
+			if err = encodeBencode(b, fields[k]); err != nil {
+				return
+			}
+		}
+		b.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: can't encode %v", v.Type())
+	}
+	return
+}
+
+func writeBencodeString(b *bytes.Buffer, s string) {
+	b.WriteString(strconv.Itoa(len(s)))
+	b.WriteByte(':')
+	b.WriteString(s)
+}
+
+// Collects the fields of a struct that should be encoded, by key.
+func structFields(v reflect.Value, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+		fv := v.Field(i)
+		if f.Anonymous && name == "" && fv.Kind() == reflect.Struct {
+			structFields(fv, fields)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // Unexported
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if options == "omitempty" && isEmptyValue(fv) {
+			continue
+		}
+		if (fv.Kind() == reflect.Interface || fv.Kind() == reflect.Ptr) && fv.IsNil() {
+			continue
+		}
+		fields[name] = fv
+	}
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
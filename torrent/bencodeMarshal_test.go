@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+type marshalInner struct {
+	B string `bencode:"b"`
+	A int64  `bencode:"a"`
+}
+
+type marshalTest struct {
+	Name    string            `bencode:"name"`
+	Empty   string            `bencode:"empty,omitempty"`
+	Skipped string            `bencode:"-"`
+	Untaged int64             // Encoded as "untaged"
+	Bytes   []byte            `bencode:"bytes,omitempty"`
+	List    []string          `bencode:"list"`
+	Map     map[string]int64  `bencode:"map,omitempty"`
+	Inner   marshalInner      `bencode:"inner"`
+	Ptr     *marshalInner     `bencode:"ptr,omitempty"`
+	Raw     rawBencode        `bencode:"raw,omitempty"`
+	Any     interface{}       `bencode:"any,omitempty"`
+	Strings map[string]string `bencode:"zzz"`
+	hidden  int64
+}
+
+func TestBencodeMarshal(t *testing.T) {
+	for _, tt := range []struct {
+		in   interface{}
+		want string
+	}{
+		{"spam", "4:spam"},
+		{int64(-3), "i-3e"},
+		{uint8(7), "i7e"},
+		{[]byte("ab"), "2:ab"},
+		{[2]byte{'a', 'b'}, "2:ab"},
+		{[]interface{}{"a", int64(1), []string{}}, "l1:ai1elee"},
+		{map[string]interface{}{"b": rawBencode("d1:zi1e1:ai2ee"), "a": "x", "c": int64(3)}, "d1:a1:x1:bd1:zi1e1:ai2ee1:ci3ee"},
+		{&marshalTest{Name: "n", Skipped: "s", Untaged: 1, List: []string{"x"}, Inner: marshalInner{"b", 2}, hidden: 3},
+			"d5:innerd1:ai2e1:b1:be4:listl1:xe4:name1:n7:untagedi1e3:zzzdee"},
+		{marshalTest{Bytes: []byte{0}, Map: map[string]int64{"b": 1, "a": 2}, Ptr: &marshalInner{}, Raw: rawBencode("i5e"), Any: "y"},
+			"d3:any1:y5:bytes1:\x005:innerd1:ai0e1:b0:e4:listle3:mapd1:ai2e1:bi1ee4:name0:3:ptrd1:ai0e1:b0:e3:rawi5e7:untagedi0e3:zzzdee"},
+	} {
+		var b bytes.Buffer
+		if err := bencodeMarshal(&b, tt.in); err != nil {
+			t.Errorf("bencodeMarshal(%#v): %v", tt.in, err)
+			continue
+		}
+		if b.String() != tt.want {
+			t.Errorf("bencodeMarshal(%#v) = %q, want %q", tt.in, b.String(), tt.want)
+		}
+	}
+	for _, bad := range []interface{}{nil, 1.5, map[int]string{1: "a"}, []interface{}{nil}} {
+		if err := bencodeMarshal(&bytes.Buffer{}, bad); err == nil {
+			t.Errorf("bencodeMarshal(%#v) succeeded, expected an error", bad)
+		}
+	}
+}
+
+func TestBencodeMarshalRoundTrip(t *testing.T) {
+	info := InfoDict{PieceLength: 1 << 18, Pieces: "01234567890123456789", Name: "n", Private: 1,
+		Files: []FileDict{{Length: 0, Path: []string{"empty"}}, {Length: 3, Path: []string{"a", "b"}, Md5sum: "m"}}}
+	var b bytes.Buffer
+	if err := bencodeMarshal(&b, &info); err != nil {
+		t.Fatal(err)
+	}
+	var got InfoDict
+	if err := bencode.Unmarshal(bytes.NewReader(b.Bytes()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, info) {
+		t.Errorf("Round trip gave %+v, want %+v", got, info)
+	}
+	// Empty files still have a length.
+	if !bytes.Contains(b.Bytes(), []byte("d6:lengthi0e4:pathl5:emptyee")) {
+		t.Errorf("Empty file has no length: %q", b.String())
+	}
+}
+
+// Anything the decoder accepts should encode to something that decodes to
+// the same value, and encoding that again should change nothing.
+func FuzzBencodeRoundTrip(f *testing.F) {
+	for _, s := range []string{"i1e", "4:spam", "l4:spami-3ee", "d1:ad1:bl0:eee", "d4:infod6:lengthi5e4:name1:aee"} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if CheckBencode(data, false) != nil {
+			return
+		}
+		v, err := (&bencodeReader{data: data}).value()
+		if err != nil {
+			return
+		}
+		var b1, b2 bytes.Buffer
+		if err = bencodeMarshal(&b1, v); err != nil {
+			t.Fatalf("Can't encode %#v: %v", v, err)
+		}
+		v2, err := (&bencodeReader{data: b1.Bytes()}).value()
+		if err != nil {
+			t.Fatalf("Can't decode %q: %v", b1.Bytes(), err)
+		}
+		if !reflect.DeepEqual(v, v2) {
+			t.Fatalf("%q decoded to %#v, then %#v", data, v, v2)
+		}
+		if err = bencodeMarshal(&b2, v2); err != nil || !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+			t.Fatalf("Encoding isn't stable: %q, then %q", b1.Bytes(), b2.Bytes())
+		}
+		// The result is canonical.
+		if err = CheckBencode(b1.Bytes(), true); err != nil {
+			t.Fatalf("%q isn't canonical: %v", b1.Bytes(), err)
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Working with bencoded data as bytes, so that values we don't understand,
+// or that we'd encode differently, survive untouched.
+
+// A BencodeError says what's wrong with bencoded data, and where.
+type BencodeError struct {
+	Offset int
+	Path   string // The dictionary keys and list indexes leading to the bad value, e.g. info.files[3].length
+	Msg    string
+}
+
+func (e *BencodeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+	}
+	return fmt.Sprintf("bencode: %s at offset %d (%s)", e.Msg, e.Offset, e.Path)
+}
+
+// BencodeLimits bound what bencoded data from elsewhere may hold, so that
+// hostile data gets an error, rather than gigabytes of allocations or a
+// stack overflow in the decoder. A zero limit is no limit.
+type BencodeLimits struct {
+	MaxSize     int // Bytes in all
+	MaxString   int // Bytes in any one string
+	MaxDepth    int // Lists and dictionaries inside each other
+	MaxElements int // Values in any one list, or keys in any one dictionary
+}
+
+var (
+	// MetaInfoLimits are for .torrent files and the metadata peers send us,
+	// which can list a great many files, and hash a great many pieces.
+	MetaInfoLimits = BencodeLimits{MaxSize: 256 << 20, MaxString: 256 << 20, MaxDepth: 256, MaxElements: 1 << 22}
+	// WireLimits are for peers' extension messages and trackers' responses,
+	// which are small.
+	WireLimits = BencodeLimits{MaxSize: 1 << 20, MaxString: 1 << 20, MaxDepth: 32, MaxElements: 1 << 16}
+)
+
+// CheckBencode checks that data is a single well formed bencoded value,
+// within MetaInfoLimits.
+// In strict mode it also rejects things most decoders put up with: leading
+// zeros in integers and string lengths, unsorted or duplicate dictionary
+// keys, and data after the value.
+func CheckBencode(data []byte, strict bool) error {
+	return CheckBencodeLimits(data, strict, MetaInfoLimits)
+}
+
+// CheckBencodeLimits is CheckBencode, within limits.
+func CheckBencodeLimits(data []byte, strict bool, limits BencodeLimits) error {
+	end, err := checkBencodePrefix(data, strict, limits)
+	if err == nil && strict && end != len(data) {
+		err = (&bencodeScanner{}).fail(end, "trailing data")
+	}
+	return err
+}
+
+// Checks the value at the start of data, which may have more after it,
+// returning the offset just past it.
+func checkBencodePrefix(data []byte, strict bool, limits BencodeLimits) (end int, err error) {
+	s := &bencodeScanner{data: data, strict: strict, limits: limits}
+	if limits.MaxSize > 0 && len(data) > limits.MaxSize {
+		return 0, s.fail(limits.MaxSize, "too much data")
+	}
+	return s.value(0)
+}
+
+// bencodeSkip returns the offset just past the value that starts at pos.
+func bencodeSkip(data []byte, pos int) (end int, err error) {
+	return (&bencodeScanner{data: data}).value(pos)
+}
+
+type bencodeScanner struct {
+	data   []byte
+	strict bool
+	limits BencodeLimits
+	path   []bencodePathElem
+	depth  int
+}
+
+// A dictionary key, or a list index if key is nil. Only formatted when
+// there's an error, since files can have a great many of them.
+type bencodePathElem struct {
+	key   []byte
+	index int
+}
+
+func (s *bencodeScanner) fail(pos int, msg string) error {
+	path := ""
+	for _, p := range s.path {
+		if p.key == nil {
+			path += "[" + strconv.Itoa(p.index) + "]"
+			continue
+		}
+		if path != "" {
+			path += "."
+		}
+		path += string(p.key)
+	}
+	return &BencodeError{pos, path, msg}
+}
+
+// Checks the digits of an integer or string length.
+func (s *bencodeScanner) digits(digits []byte, signed bool) bool {
+	if signed && len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if s.strict && len(digits) > 0 && digits[0] == '0' {
+			return false // -0
+		}
+	}
+	if len(digits) == 0 || (s.strict && len(digits) > 1 && digits[0] == '0') {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the limits on going into a list or dictionary at pos.
+func (s *bencodeScanner) enter(pos int) error {
+	if s.depth++; s.limits.MaxDepth > 0 && s.depth > s.limits.MaxDepth {
+		return s.fail(pos, "nested too deeply")
+	}
+	return nil
+}
+
+// Checks the limits on the nth value of a list or dictionary, at pos.
+func (s *bencodeScanner) element(pos, n int) error {
+	if s.limits.MaxElements > 0 && n >= s.limits.MaxElements {
+		return s.fail(pos, "too many elements")
+	}
+	return nil
+}
+
+// value returns the offset just past the value that starts at pos.
+func (s *bencodeScanner) value(pos int) (end int, err error) {
+	data := s.data
+	if pos >= len(data) {
+		return 0, s.fail(pos, "unexpected end of data")
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		i := bytes.IndexByte(data[pos:], 'e')
+		if i < 0 {
+			return 0, s.fail(pos, "unterminated integer")
+		}
+		if !s.digits(data[pos+1:pos+i], true) {
+			return 0, s.fail(pos, "invalid integer")
+		}
+		return pos + i + 1, nil
+	case c == 'l':
+		if err = s.enter(pos); err != nil {
+			return
+		}
+		pos++
+		for n := 0; pos < len(data) && data[pos] != 'e'; n++ {
+			if err = s.element(pos, n); err != nil {
+				return
+			}
+			s.path = append(s.path, bencodePathElem{index: n})
+			pos, err = s.value(pos)
+			s.path = s.path[:len(s.path)-1]
+			if err != nil {
+				return
+			}
+		}
+		if pos >= len(data) {
+			return 0, s.fail(pos, "unterminated list")
+		}
+		s.depth--
+		return pos + 1, nil
+	case c == 'd':
+		if err = s.enter(pos); err != nil {
+			return
+		}
+		pos++
+		var last []byte
+		for n := 0; pos < len(data) && data[pos] != 'e'; n++ {
+			if err = s.element(pos, n); err != nil {
+				return
+			}
+			if data[pos] < '0' || data[pos] > '9' {
+				return 0, s.fail(pos, "dictionary key isn't a string")
+			}
+			var keyEnd int
+			if keyEnd, err = s.value(pos); err != nil {
+				return
+			}
+			key := data[pos:keyEnd]
+			key = key[bytes.IndexByte(key, ':')+1:]
+			if s.strict && n > 0 && bytes.Compare(last, key) >= 0 {
+				return 0, s.fail(pos, fmt.Sprintf("dictionary key %q out of order", key))
+			}
+			last = key
+			s.path = append(s.path, bencodePathElem{key: key})
+			pos, err = s.value(keyEnd)
+			s.path = s.path[:len(s.path)-1]
+			if err != nil {
+				return
+			}
+		}
+		if pos >= len(data) {
+			return 0, s.fail(pos, "unterminated dictionary")
+		}
+		s.depth--
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		i := bytes.IndexByte(data[pos:], ':')
+		if i < 0 || !s.digits(data[pos:pos+i], false) {
+			return 0, s.fail(pos, "invalid string length")
+		}
+		n, err := strconv.Atoi(string(data[pos : pos+i]))
+		if err == nil && s.limits.MaxString > 0 && n > s.limits.MaxString {
+			return 0, s.fail(pos, "string too long")
+		}
+		end = pos + i + 1 + n
+		if err != nil || end > len(data) || end < pos {
+			return 0, s.fail(pos, "string runs past the end of the data")
+		}
+		return end, nil
+	default:
+		return 0, s.fail(pos, fmt.Sprintf("unexpected %q", c))
+	}
+}
+
+// bencodeDictValues returns the raw bytes of each value in a bencoded
+// dictionary.
+func bencodeDictValues(data []byte) (values map[string][]byte, err error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("Not a bencoded dictionary")
+	}
+	values = map[string][]byte{}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		var keyEnd, valueEnd int
+		if keyEnd, err = bencodeSkip(data, pos); err != nil {
+			return
+		}
+		key := data[pos:keyEnd]
+		colon := bytes.IndexByte(key, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("Dictionary key at offset %d isn't a string", pos)
+		}
+		if valueEnd, err = bencodeSkip(data, keyEnd); err != nil {
+			return
+		}
+		values[string(key[colon+1:])] = data[keyEnd:valueEnd]
+		pos = valueEnd
+	}
+	if pos >= len(data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// A value that is already bencoded.
+type rawBencode []byte
@@ -0,0 +1,172 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBencodeSkip(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		end int
+	}{
+		{"i42e", 4},
+		{"4:spamxx", 6},
+		{"l4:spami1ee", 11},
+		{"d1:ad1:bi1eee", 13},
+		{"le", 2},
+	} {
+		if end, err := bencodeSkip([]byte(tt.in), 0); err != nil || end != tt.end {
+			t.Errorf("bencodeSkip(%q) = %d, %v, want %d", tt.in, end, err, tt.end)
+		}
+	}
+	for _, in := range []string{"", "i42", "5:spam", "l4:spam", "x", "d1:a"} {
+		if _, err := bencodeSkip([]byte(in), 0); err == nil {
+			t.Errorf("bencodeSkip(%q) succeeded, expected an error", in)
+		}
+	}
+}
+
+func TestBencodeDictValues(t *testing.T) {
+	values, err := bencodeDictValues([]byte("d1:bli1ei2ee1:ad1:xi3eee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"a": []byte("d1:xi3ee"), "b": []byte("li1ei2ee")}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %q, want %q", values, want)
+	}
+	if _, err = bencodeDictValues([]byte("li1ee")); err == nil {
+		t.Error("Expected an error for a list")
+	}
+}
+
+// Malformed input, and the error CheckBencode gives for it.
+var bencodeErrorTests = []struct {
+	in     string
+	strict bool
+	want   string
+}{
+	{"", false, "bencode: unexpected end of data at offset 0"},
+	{"i12", false, "bencode: unterminated integer at offset 0"},
+	{"ie", false, "bencode: invalid integer at offset 0"},
+	{"i1x2e", false, "bencode: invalid integer at offset 0"},
+	{"i-e", false, "bencode: invalid integer at offset 0"},
+	{"x", false, "bencode: unexpected 'x' at offset 0"},
+	{"5:abc", false, "bencode: string runs past the end of the data at offset 0"},
+	{"3x:abc", false, "bencode: invalid string length at offset 0"},
+	{"l1:a", false, "bencode: unterminated list at offset 4"},
+	{"di1ei2ee", false, "bencode: dictionary key isn't a string at offset 1"},
+	{"d4:infod5:filesld6:lengthixeeeee", false, "bencode: invalid integer at offset 25 (info.files[0].length)"},
+	{"d4:infod5:filesld6:lengthi1eed6:lengthi2eed6:lengthi-eeeee", false,
+		"bencode: invalid integer at offset 51 (info.files[2].length)"},
+	{"i03e", true, "bencode: invalid integer at offset 0"},
+	{"i-0e", true, "bencode: invalid integer at offset 0"},
+	{"03:abc", true, "bencode: invalid string length at offset 0"},
+	{"d1:bi1e1:ai2ee", true, "bencode: dictionary key \"a\" out of order at offset 7"},
+	{"d1:ai1e1:ai2ee", true, "bencode: dictionary key \"a\" out of order at offset 7"},
+	{"i1ei2e", true, "bencode: trailing data at offset 3"},
+}
+
+func TestCheckBencode(t *testing.T) {
+	for _, tt := range bencodeErrorTests {
+		err := CheckBencode([]byte(tt.in), tt.strict)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("CheckBencode(%q, %v) = %v, want %v", tt.in, tt.strict, err, tt.want)
+		}
+		if tt.strict {
+			// Lenient mode puts up with these.
+			if err = CheckBencode([]byte(tt.in), false); err != nil {
+				t.Errorf("CheckBencode(%q, false) = %v", tt.in, err)
+			}
+		}
+	}
+	for _, in := range []string{"i0e", "i-12e", "0:", "d1:ai1e1:bl3:abcee", "le", "de"} {
+		if err := CheckBencode([]byte(in), true); err != nil {
+			t.Errorf("CheckBencode(%q, true) = %v", in, err)
+		}
+	}
+}
+
+func TestBencodeLimits(t *testing.T) {
+	small := BencodeLimits{MaxSize: 32, MaxString: 4, MaxDepth: 3, MaxElements: 2}
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"llllee", "bencode: nested too deeply at offset 3 ([0][0][0])"},
+		{"li1ei2ei3ee", "bencode: too many elements at offset 7"},
+		{"d1:ai1e1:bi2e1:ci3ee", "bencode: too many elements at offset 13"},
+		{"5:abcde", "bencode: string too long at offset 0"},
+		{"999999999999:", "bencode: string too long at offset 0"},
+		{"99999999999999999999:", "bencode: string runs past the end of the data at offset 0"},
+		{"l" + strings.Repeat("1:a", 11) + "e", "bencode: too much data at offset 32"},
+		{"lllei1eee", ""},
+		{"d1:a4:abcde", ""},
+	} {
+		err := CheckBencodeLimits([]byte(tt.in), false, small)
+		if got := fmt.Sprint(err); (tt.want == "" && err != nil) || (tt.want != "" && got != tt.want) {
+			t.Errorf("CheckBencodeLimits(%q) = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+
+	// Far more nesting than the stack would take, if it were all followed.
+	deep := []byte("d4:info" + strings.Repeat("l", 10000000))
+	if err := CheckBencode(deep, false); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("CheckBencode of deep nesting = %v", err)
+	}
+	if _, _, err := decodeInfoDict(deep[7:]); err == nil {
+		t.Error("decodeInfoDict of deep nesting succeeded")
+	}
+	if _, err := ReadMetaInfo(bytes.NewReader(deep)); err == nil {
+		t.Error("ReadMetaInfo of deep nesting succeeded")
+	}
+}
+
+// How deep v goes, and its longest string and most elements.
+func bencodeValueSize(v interface{}) (depth, str, elements int) {
+	var children []interface{}
+	switch v := v.(type) {
+	case string:
+		return 0, len(v), 0
+	case []interface{}:
+		children = v
+	case map[string]interface{}:
+		for k, e := range v {
+			str = max(str, len(k))
+			children = append(children, e)
+		}
+	default:
+		return
+	}
+	elements = len(children)
+	for _, c := range children {
+		d, s, e := bencodeValueSize(c)
+		depth, str, elements = max(depth, d), max(str, s), max(elements, e)
+	}
+	return depth + 1, str, elements
+}
+
+// Whatever passes the limits is within them, and decodes.
+func FuzzBencodeLimits(f *testing.F) {
+	for _, s := range []string{"i1e", "4:spam", "llllee", "li1ei2ei3ee", "d1:ad1:bl0:eee", "9999999999:"} {
+		f.Add([]byte(s))
+	}
+	limits := BencodeLimits{MaxSize: 64, MaxString: 8, MaxDepth: 3, MaxElements: 3}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeInfoDict(data)
+		if CheckBencodeLimits(data, false, limits) != nil {
+			return
+		}
+		v, err := (&bencodeReader{data: data}).value()
+		if err != nil {
+			t.Fatalf("Passed the limits, but can't decode %q: %v", data, err)
+		}
+		if depth, str, elements := bencodeValueSize(v); depth > limits.MaxDepth || str > limits.MaxString || elements > limits.MaxElements {
+			t.Fatalf("%q passed the limits with depth %d, a %d byte string and %d elements", data, depth, str, elements)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"time"
+)
+
+// DHT scrape bloom filters. Source:
+// http://bittorrent.org/beps/bep_0033.html
+//
+// A DHT node that stores peers for an info-hash can summarize them in two
+// filters, BFsd for seeds and BFpe for downloaders, and get_peers queries
+// with "scrape":1 get the filters back. Filters from several nodes are OR'ed
+// together and the number of distinct peers estimated from the result.
+//
+// Every DHT_SCRAPE_INTERVAL, each torrent that may use the DHT is looked up
+// by our KRPC client (see krpc.go), with "scrape":1 in its get_peers
+// queries, and the estimate shows in its status as DHTScrape.
+//
+// TODO: Answer scrape queries too, with BFsd and BFpe for the info-hashes we
+// store peers for. It's the DHT library that stores peers and answers
+// queries, and it has no way to add the filters to its responses, so this
+// waits on a library that does, or on our KRPC client answering queries
+// itself. In read-only mode (see dhtReadOnly.go) we store no peers, so
+// there's nothing to answer with.
+
+const (
+	// How often each torrent's swarm is estimated.
+	DHT_SCRAPE_INTERVAL = 30 * time.Minute
+	// How often we look for torrents that are due an estimate.
+	dhtScrapeCheckPeriod = time.Minute
+
+	BLOOM_FILTER_BITS  = 2048
+	BLOOM_FILTER_BYTES = BLOOM_FILTER_BITS / 8
+	bloomFilterHashes  = 2
+)
+
+type bloomFilter [BLOOM_FILTER_BYTES]byte
+
+// Decodes a BFsd or BFpe value from a get_peers response.
+func newBloomFilterFromBytes(b []byte) (f *bloomFilter, err error) {
+	if len(b) != BLOOM_FILTER_BYTES {
+		return nil, errors.New("Bloom filter has wrong length")
+	}
+	f = new(bloomFilter)
+	copy(f[:], b)
+	return
+}
+
+// Add adds a peer's IP address, which must be IPv4 or IPv6.
+func (f *bloomFilter) Add(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	hash := sha1.Sum(ip)
+	for i := 0; i < bloomFilterHashes; i++ {
+		index := (int(hash[2*i]) | int(hash[2*i+1])<<8) % BLOOM_FILTER_BITS
+		f[index/8] |= 1 << uint(index%8)
+	}
+}
+
+// Merge adds the contents of other to f.
+func (f *bloomFilter) Merge(other *bloomFilter) {
+	for i := range f {
+		f[i] |= other[i]
+	}
+}
+
+// Estimate returns the approximate number of distinct addresses added.
+func (f *bloomFilter) Estimate() float64 {
+	zeros := 0
+	for _, b := range f {
+		for i := uint(0); i < 8; i++ {
+			if b&(1<<i) == 0 {
+				zeros++
+			}
+		}
+	}
+	// A full filter can't tell us anything beyond "a lot".
+	if zeros == 0 {
+		zeros = 1
+	}
+	m := float64(BLOOM_FILTER_BITS)
+	return math.Log(float64(zeros)/m) / (bloomFilterHashes * math.Log(1-1/m))
+}
+
+func (f *bloomFilter) Bytes() []byte {
+	return f[:]
+}
+
+// A swarm size estimate, combined from the scrape filters of several nodes.
+type dhtScrape struct {
+	seeds       bloomFilter
+	downloaders bloomFilter
+	responses   int
+}
+
+// Add merges the BFsd and BFpe values of one get_peers response.
+func (s *dhtScrape) Add(bfsd, bfpe []byte) (err error) {
+	seeds, err := newBloomFilterFromBytes(bfsd)
+	if err != nil {
+		return
+	}
+	downloaders, err := newBloomFilterFromBytes(bfpe)
+	if err != nil {
+		return
+	}
+	s.seeds.Merge(seeds)
+	s.downloaders.Merge(downloaders)
+	s.responses++
+	return
+}
+
+// Seeders and Downloaders estimate the number of peers of each kind, rounded
+// to the nearest whole peer.
+func (s *dhtScrape) Seeders() uint {
+	return uint(s.seeds.Estimate() + 0.5)
+}
+
+func (s *dhtScrape) Downloaders() uint {
+	return uint(s.downloaders.Estimate() + 0.5)
+}
+
+// DHTScrape is a torrent's swarm, as the DHT's scrape filters estimate it.
+type DHTScrape struct {
+	Seeders   uint
+	Leechers  uint
+	Responses int // Nodes whose filters went into the estimate
+	Time      time.Time
+}
+
+// scrapeDHT looks ih up, starting from the nodes at the addresses in start,
+// and combines the scrape filters of the nodes that have them. The nodes
+// that answer are saved in nodes.
+func scrapeDHT(krpc *krpcClient, nodes *dhtNodeTable, ih string, start []string) dhtScrape {
+	return krpc.lookup(ih, start, true, nodes).scrape
+}
+
+// Estimates the swarms of the torrents that are due it. Called on the
+// manager's loop.
+func (m *sessionManager) scrapeDHT(now time.Time) {
+	for _, ts := range m.sessions {
+		if now.Sub(m.dhtScraped[ts]) < DHT_SCRAPE_INTERVAL {
+			continue
+		}
+		m.dhtScraped[ts] = now
+		start := append(m.dhtNodes.Sample(dhtLookupStartNodes), m.dhtRouters...)
+		go ts.scrapeDHT(m.krpc, m.dhtNodes, start)
+	}
+}
+
+func (ts *TorrentSession) scrapeDHT(krpc *krpcClient, nodes *dhtNodeTable, start []string) {
+	var ih string
+	if ts.runInLoop(func() {
+		if ts.Session.UseDHT {
+			ih = ts.M.InfoHash
+		}
+	}) != nil || ih == "" {
+		return
+	}
+	s := scrapeDHT(krpc, nodes, ih, start)
+	if s.responses == 0 {
+		return
+	}
+	scrape := &DHTScrape{s.Seeders(), s.Downloaders(), s.responses, time.Now()}
+	ts.runInLoop(func() {
+		log.Println("[", ts.M.Info.Name, "] The DHT estimates", scrape.Seeders, "seeders and", scrape.Leechers,
+			"leechers, from", scrape.Responses, "nodes")
+		ts.dhtScrape = scrape
+	})
+}
@@ -0,0 +1,120 @@
+package torrent
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The test vector from BEP 33: 192.0.2.0 to 192.0.2.255 and
+// 2001:DB8:: to 2001:DB8::3E7.
+func bep33TestFilter() *bloomFilter {
+	f := new(bloomFilter)
+	for i := 0; i < 256; i++ {
+		f.Add(net.IPv4(192, 0, 2, byte(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP("2001:db8::")
+		ip[14], ip[15] = byte(i>>8), byte(i)
+		f.Add(ip)
+	}
+	return f
+}
+
+func TestBloomFilterEstimate(t *testing.T) {
+	f := bep33TestFilter()
+	if got := f.Estimate(); math.Abs(got-1224.93) > 0.001 {
+		t.Errorf("Estimate() = %v, want 1224.93", got)
+	}
+	if got := new(bloomFilter).Estimate(); got != 0 {
+		t.Errorf("Estimate() of an empty filter = %v, want 0", got)
+	}
+}
+
+func TestDHTScrape(t *testing.T) {
+	seeds := new(bloomFilter)
+	seeds.Add(net.ParseIP("1.2.3.4"))
+	downloaders := new(bloomFilter)
+	downloaders.Add(net.ParseIP("1.2.3.5"))
+	downloaders.Add(net.ParseIP("1.2.3.6"))
+
+	var s dhtScrape
+	if err := s.Add(seeds.Bytes(), downloaders.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	// A second node that knows about the same seed and one more.
+	seeds2 := new(bloomFilter)
+	seeds2.Add(net.ParseIP("1.2.3.4"))
+	seeds2.Add(net.ParseIP("5.6.7.8"))
+	if err := s.Add(seeds2.Bytes(), new(bloomFilter).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if s.Seeders() != 2 || s.Downloaders() != 2 {
+		t.Errorf("Seeders, Downloaders = %d, %d, want 2, 2", s.Seeders(), s.Downloaders())
+	}
+	if err := s.Add([]byte("short"), downloaders.Bytes()); err == nil {
+		t.Error("Add accepted a malformed filter")
+	}
+}
+
+// Compact node info for a node on the loopback address.
+func compactNode(id, addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return id + "\x7f\x00\x00\x01" + string([]byte{byte(p >> 8), byte(p)})
+}
+
+// A lookup asks the nodes it starts from, then the ones they point it to,
+// and combines the filters of those that have them.
+func TestScrapeDHT(t *testing.T) {
+	ih := strings.Repeat("\xff", 20)
+	seeds, downloaders := new(bloomFilter), new(bloomFilter)
+	seeds.Add(net.ParseIP("1.2.3.4"))
+	downloaders.Add(net.ParseIP("1.2.3.5"))
+	downloaders.Add(net.ParseIP("1.2.3.6"))
+	silent := newFakeDHTNode(t, func(string, map[string]interface{}) map[string]interface{} { return nil })
+	defer silent.Close()
+	near := newFakeDHTNode(t, func(q string, args map[string]interface{}) map[string]interface{} {
+		if q != "get_peers" || args["info_hash"] != ih || args["scrape"] != int64(1) {
+			t.Errorf("Asked %q %v", q, args)
+		}
+		return map[string]interface{}{"id": strings.Repeat("\xfe", 20), "BFsd": string(seeds.Bytes()), "BFpe": string(downloaders.Bytes())}
+	})
+	defer near.Close()
+	far := newFakeDHTNode(t, func(string, map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"id": strings.Repeat("\x01", 20),
+			"nodes": compactNode(strings.Repeat("\xfe", 20), near.Addr()) + compactNode(strings.Repeat("\xf0", 20), silent.Addr())}
+	})
+	defer far.Close()
+
+	c := newTestKRPCClient(t)
+	defer c.Close()
+	nodes := newDHTNodeTable("")
+	s := scrapeDHT(c, nodes, ih, []string{far.Addr()})
+	if s.responses != 1 || s.Seeders() != 1 || s.Downloaders() != 2 {
+		t.Errorf("Scraped %d responses, %d seeders and %d downloaders", s.responses, s.Seeders(), s.Downloaders())
+	}
+	if nodes.Len() != 2 {
+		t.Errorf("Saved %d nodes", nodes.Len())
+	}
+}
+
+func TestCloser(t *testing.T) {
+	target := "\x0f\x00"
+	for _, test := range []struct {
+		a, b   string
+		closer bool
+	}{
+		{"\x0e\x00", "\x1f\x00", true},
+		{"\x1f\x00", "\x0e\x00", false},
+		{"\x0f\x00", "\x0f\x00", false},
+		{"\x00\x00", "", true},
+		{"", "\x00\x00", false},
+	} {
+		if closer(test.a, test.b, target) != test.closer {
+			t.Errorf("closer(%x, %x) isn't %v", test.a, test.b, test.closer)
+		}
+	}
+}
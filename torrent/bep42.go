@@ -0,0 +1,158 @@
+package torrent
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// DHT security extension. Source:
+// http://bittorrent.org/beps/bep_0042.html
+//
+// A node ID is tied to the node's external IP address: the first 21 bits are
+// taken from a CRC32-C of the (masked) address, and the last byte holds the
+// random value that was mixed into the CRC.
+//
+// Once we know our external address, our own KRPC queries use an ID made for
+// it, and a new one when it changes (see krpc.go). Our lookups ignore the
+// answers of nodes whose IDs don't match their addresses, and such nodes
+// aren't passed to the DHT library's nodes. They're still saved, ranked
+// below those that do match (see dhtNodes.go).
+//
+// The DHT library's nodes make up their own IDs and can't be given one, and
+// take in the nodes they hear of from each other unchecked, so they don't
+// follow BEP 42. In read-only mode (see dhtReadOnly.go) they don't run, and
+// our KRPC client, which does, is all the DHT sees of us.
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var bep42V4Mask = []byte{0x03, 0x0f, 0x3f, 0xff}
+var bep42V6Mask = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+
+func bep42CRC(ip net.IP, r byte) uint32 {
+	var masked []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		masked = make([]byte, 4)
+		for i := range masked {
+			masked[i] = ip4[i] & bep42V4Mask[i]
+		}
+	} else {
+		masked = make([]byte, 8)
+		for i := range masked {
+			masked[i] = ip[i] & bep42V6Mask[i]
+		}
+	}
+	masked[0] |= (r & 0x7) << 5
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// bep42NodeID returns a DHT node ID that is valid for the external address ip.
+func bep42NodeID(ip net.IP, rnd *rand.Rand) string {
+	id := make([]byte, 20)
+	rnd.Read(id)
+	r := id[19]
+	crc := bep42CRC(ip, r)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x7
+	return string(id)
+}
+
+// bep42ValidNodeID reports whether id is an acceptable node ID for a node
+// contacting us from ip. Nodes on local networks are exempt.
+func bep42ValidNodeID(id string, ip net.IP) bool {
+	if bep42Exempt(ip) {
+		return true
+	}
+	if len(id) != 20 {
+		return false
+	}
+	crc := bep42CRC(ip, id[19])
+	return id[0] == byte(crc>>24) &&
+		id[1] == byte(crc>>16) &&
+		id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// bep42ValidNode reports whether id is an acceptable node ID for the node at
+// the host:port addr.
+func bep42ValidNode(addr, id string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && bep42ValidNodeID(id, ip)
+}
+
+var bep42ExemptNets = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"127.0.0.0/8",
+}
+
+func bep42Exempt(ip net.IP) bool {
+	for _, cidr := range bep42ExemptNets {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalAddress keeps a tally of what other parties (peers, trackers) tell
+// us our IP address is. Each source gets one vote; a later vote from the same
+// source replaces its earlier one.
+// Multiple goroutines may use an externalAddress at the same time.
+type externalAddress struct {
+	mu        sync.Mutex
+	votes     map[string]string // source -> ip
+	consensus string
+
+	// Receives the new consensus address whenever it changes.
+	Changes chan net.IP
+}
+
+func newExternalAddress() *externalAddress {
+	return &externalAddress{
+		votes:   make(map[string]string),
+		Changes: make(chan net.IP, 1),
+	}
+}
+
+// Vote records that source believes our external address is ip.
+func (e *externalAddress) Vote(source string, ip net.IP) {
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.votes[source] = ip.String()
+
+	counts := make(map[string]int)
+	for _, v := range e.votes {
+		counts[v]++
+	}
+	// Ties go to the current consensus, so it doesn't flap.
+	best := e.consensus
+	for v, n := range counts {
+		if n > counts[best] {
+			best = v
+		}
+	}
+	if best != e.consensus {
+		e.consensus = best
+		select {
+		case <-e.Changes:
+		default:
+		}
+		e.Changes <- net.ParseIP(best)
+	}
+}
+
+// IP returns the current consensus, or nil if nobody has told us yet.
+func (e *externalAddress) IP() net.IP {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return net.ParseIP(e.consensus)
+}
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// Test vectors from BEP 42.
+var bep42Tests = []struct {
+	ip     string
+	r      byte
+	prefix string // First three bytes; only the top 5 bits of the last one count.
+}{
+	{"124.31.75.21", 1, "5fbfbf"},
+	{"21.75.31.124", 86, "5a3ce9"},
+	{"65.23.51.170", 22, "a5d432"},
+	{"84.124.73.14", 65, "1b0321"},
+	{"43.213.53.83", 90, "e56f6c"},
+}
+
+func TestBEP42Vectors(t *testing.T) {
+	for _, tt := range bep42Tests {
+		ip := net.ParseIP(tt.ip)
+		want, _ := hex.DecodeString(tt.prefix)
+		crc := bep42CRC(ip, tt.r)
+		got := []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8)}
+		if got[0] != want[0] || got[1] != want[1] || got[2]&0xf8 != want[2]&0xf8 {
+			t.Errorf("bep42CRC(%v, %d) prefix = %x, want %x", ip, tt.r, got, want)
+		}
+	}
+}
+
+func TestBEP42NodeID(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, s := range []string{"124.31.75.21", "2001:db8::1"} {
+		ip := net.ParseIP(s)
+		id := bep42NodeID(ip, rnd)
+		if !bep42ValidNodeID(id, ip) {
+			t.Errorf("bep42NodeID(%v) = %x, not valid for that address", ip, id)
+		}
+		if bep42ValidNodeID(id, net.ParseIP("21.75.31.124")) {
+			t.Errorf("node ID %x for %v is also valid for another address", id, ip)
+		}
+	}
+	if !bep42ValidNodeID("short", net.ParseIP("192.168.1.1")) {
+		t.Errorf("Local addresses should be exempt from node ID checks")
+	}
+	if bep42ValidNodeID("short", net.ParseIP("124.31.75.21")) {
+		t.Errorf("A short node ID should not be valid")
+	}
+}
+
+func TestExternalAddressConsensus(t *testing.T) {
+	e := newExternalAddress()
+	if e.IP() != nil {
+		t.Fatalf("IP() = %v before any votes, want nil", e.IP())
+	}
+	a := net.ParseIP("1.2.3.4")
+	b := net.ParseIP("5.6.7.8")
+
+	e.Vote("peer1", a)
+	if got := <-e.Changes; !got.Equal(a) {
+		t.Errorf("Changes = %v, want %v", got, a)
+	}
+	// A tie doesn't change the consensus.
+	e.Vote("peer2", b)
+	if !e.IP().Equal(a) {
+		t.Errorf("IP() = %v after a tie, want %v", e.IP(), a)
+	}
+	// Voting again from the same source doesn't count twice.
+	e.Vote("peer2", b)
+	if !e.IP().Equal(a) {
+		t.Errorf("IP() = %v after a repeated vote, want %v", e.IP(), a)
+	}
+	e.Vote("peer3", b)
+	if got := <-e.Changes; !got.Equal(b) {
+		t.Errorf("Changes = %v, want %v", got, b)
+	}
+	e.Vote("peer4", net.ParseIP("127.0.0.1"))
+	if !e.IP().Equal(b) {
+		t.Errorf("IP() = %v after a loopback vote, want %v", e.IP(), b)
+	}
+}
@@ -0,0 +1,425 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// BitTorrent v2 and hybrid torrents. Source:
+// http://bittorrent.org/beps/bep_0052.html
+//
+// A v2 torrent describes its content as a file tree. Each file is hashed on
+// its own, as a merkle tree of SHA-256 hashes over 16KiB blocks, and every
+// file starts on a piece boundary. The "piece layers" outside the info
+// dictionary hold the hashes of each file's pieces. The info-hash is the
+// SHA-256 of the info dictionary, truncated to 20 bytes wherever the v1
+// protocol only has room for that many.
+//
+// A hybrid torrent has both v1 and v2 metadata for the same piece layout,
+// with v1 padding files keeping files aligned, so we treat it as a v1
+// torrent that can also be found under its v2 info-hash.
+//
+// TODO: The hash request, hashes and hash reject messages, so that a pure
+// v2 torrent can be fetched from a magnet link. Until then we need the
+// piece layers from a .torrent file.
+
+const (
+	BEP52_BLOCK_SIZE = 16 * 1024
+	META_VERSION_2   = 2
+)
+
+// A file in a v2 file tree.
+type FileDictV2 struct {
+	Path       []string
+	Length     int64
+	PiecesRoot string // The root of the file's merkle tree. Empty for empty files.
+}
+
+// Where a piece of a pure v2 torrent lives.
+type pieceV2 struct {
+	file   int   // Index into FilesV2
+	index  int   // Piece number within the file
+	length int64 // The last piece of a file may be short.
+}
+
+var zeroHash = make([]byte, sha256.Size)
+
+// merkleRoot returns the root of a merkle tree over leaves, padded out to
+// width leaves with pad. width must be a power of two.
+func merkleRoot(leaves [][]byte, width int, pad []byte) []byte {
+	layer := make([][]byte, width)
+	copy(layer, leaves)
+	for i := len(leaves); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			h := sha256.New()
+			h.Write(layer[2*i])
+			h.Write(layer[2*i+1])
+			next[i] = h.Sum(nil)
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// The leaf hashes for data, one per 16KiB block.
+func blockHashes(data []byte) (hashes [][]byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > BEP52_BLOCK_SIZE {
+			n = BEP52_BLOCK_SIZE
+		}
+		sum := sha256.Sum256(data[:n])
+		hashes = append(hashes, sum[:])
+		data = data[n:]
+	}
+	return
+}
+
+// The hash of one piece, as found in the piece layers.
+func pieceHashV2(piece []byte, pieceLength int64) []byte {
+	return merkleRoot(blockHashes(piece), int(pieceLength/BEP52_BLOCK_SIZE), zeroHash)
+}
+
+// The root of a file's merkle tree, from the hashes of its pieces.
+func piecesRootV2(layer [][]byte, pieceLength int64) []byte {
+	pad := merkleRoot(nil, int(pieceLength/BEP52_BLOCK_SIZE), zeroHash)
+	return merkleRoot(layer, int(roundUpToPowerOfTwo(uint64(len(layer)))), pad)
+}
+
+// hashFileV2 reads a file of the given length from r, and returns its pieces
+// root and piece layer. Files no longer than a piece have no piece layer.
+func hashFileV2(r io.ReaderAt, length, pieceLength int64) (root, layer string, err error) {
+	if length == 0 {
+		return
+	}
+	buf := make([]byte, pieceLength)
+	var hashes [][]byte
+	var blocks [][]byte
+	for off := int64(0); off < length; off += pieceLength {
+		piece := buf
+		if length-off < pieceLength {
+			piece = buf[:length-off]
+		}
+		if _, err = r.ReadAt(piece, off); err != nil && err != io.EOF {
+			return
+		}
+		err = nil
+		if length <= pieceLength {
+			blocks = blockHashes(piece)
+		}
+		hashes = append(hashes, pieceHashV2(piece, pieceLength))
+	}
+	if length <= pieceLength {
+		// The tree only needs to be as wide as the file.
+		root = string(merkleRoot(blocks, int(roundUpToPowerOfTwo(uint64(len(blocks)))), zeroHash))
+		return
+	}
+	root = string(piecesRootV2(hashes, pieceLength))
+	layer = string(bytes.Join(hashes, nil))
+	return
+}
+
+// Parses a v2 file tree into a list of files, in path order.
+func parseFileTree(tree map[string]interface{}, path []string) (files []FileDictV2, err error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok || name == "" {
+			err = fmt.Errorf("Bad file tree entry %q", name)
+			return
+		}
+		p := append(append([]string(nil), path...), name)
+		if entry, ok := node[""]; ok {
+			e, ok := entry.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("Bad file tree entry %q", name)
+				return
+			}
+			f := FileDictV2{Path: p, Length: getInt(e, "length"), PiecesRoot: getString(e, "pieces root")}
+			if f.Length < 0 || (f.Length > 0) != (len(f.PiecesRoot) == sha256.Size) {
+				err = fmt.Errorf("Bad file tree entry %q", name)
+				return
+			}
+			files = append(files, f)
+			continue
+		}
+		var sub []FileDictV2
+		if sub, err = parseFileTree(node, p); err != nil {
+			return
+		}
+		files = append(files, sub...)
+	}
+	return
+}
+
+// Builds the file tree for files, the reverse of parseFileTree.
+func fileTreeMap(files []FileDictV2) map[string]interface{} {
+	tree := map[string]interface{}{}
+	for _, f := range files {
+		dir := tree
+		for _, name := range f.Path[:len(f.Path)-1] {
+			sub, ok := dir[name].(map[string]interface{})
+			if !ok {
+				sub = map[string]interface{}{}
+				dir[name] = sub
+			}
+			dir = sub
+		}
+		entry := map[string]interface{}{"length": f.Length}
+		if f.PiecesRoot != "" {
+			entry["pieces root"] = f.PiecesRoot
+		}
+		dir[f.Path[len(f.Path)-1]] = map[string]interface{}{"": entry}
+	}
+	return tree
+}
+
+func getInt(m map[string]interface{}, k string) int64 {
+	if v, ok := m[k]; ok {
+		if i, ok := v.(int64); ok {
+			return i
+		}
+	}
+	return 0
+}
+
+// Reads the v2 parts of a torrent. topMap may be nil if we only have the
+// info dictionary.
+func (m *MetaInfo) parseV2(infoMap, topMap map[string]interface{}) (err error) {
+	m.MetaVersion = getInt(infoMap, "meta version")
+	if m.MetaVersion == 0 {
+		return
+	}
+	if m.MetaVersion != META_VERSION_2 {
+		return fmt.Errorf("Unknown meta version %v", m.MetaVersion)
+	}
+	tree, ok := infoMap["file tree"].(map[string]interface{})
+	if !ok {
+		return errors.New("v2 torrent has no file tree")
+	}
+	if m.FilesV2, err = parseFileTree(tree, nil); err != nil {
+		return
+	}
+	m.PieceLayers = nil
+	if layers, ok := topMap["piece layers"].(map[string]interface{}); ok {
+		m.PieceLayers = map[string]string{}
+		for k, v := range layers {
+			if s, ok := v.(string); ok {
+				m.PieceLayers[k] = s
+			}
+		}
+	}
+	return m.updateV2()
+}
+
+// Recomputes the v2 info-hash and piece layout, and checks the piece layers.
+func (m *MetaInfo) updateV2() (err error) {
+	if m.MetaVersion != META_VERSION_2 {
+		return
+	}
+	pieceLength := m.Info.PieceLength
+	if pieceLength < BEP52_BLOCK_SIZE || roundUpToPowerOfTwo(uint64(pieceLength)) != uint64(pieceLength) {
+		return fmt.Errorf("Bad v2 piece length %v", pieceLength)
+	}
+	sum := sha256.Sum256(m.rawInfo)
+	m.InfoHashV2 = string(sum[:])
+	if m.isV2Only() {
+		m.InfoHash = m.InfoHashV2[:20]
+	}
+	m.piecesV2 = nil
+	for i, f := range m.FilesV2 {
+		n := int((f.Length + pieceLength - 1) / pieceLength)
+		for j := 0; j < n; j++ {
+			length := pieceLength
+			if j == n-1 {
+				length = f.Length - int64(j)*pieceLength
+			}
+			m.piecesV2 = append(m.piecesV2, pieceV2{i, j, length})
+		}
+		if n <= 1 || !m.isV2Only() {
+			continue
+		}
+		layer, ok := m.PieceLayers[f.PiecesRoot]
+		if !ok || len(layer) != n*sha256.Size {
+			return fmt.Errorf("Missing or bad piece layer for %v", f.Path)
+		}
+		hashes := make([][]byte, n)
+		for j := range hashes {
+			hashes[j] = []byte(layer[j*sha256.Size : (j+1)*sha256.Size])
+		}
+		if string(piecesRootV2(hashes, pieceLength)) != f.PiecesRoot {
+			return fmt.Errorf("Piece layer for %v doesn't match its pieces root", f.Path)
+		}
+	}
+	return
+}
+
+// Whether this torrent has v2 metadata only, so its pieces have to be
+// checked against the v2 hashes.
+func (m *MetaInfo) isV2Only() bool {
+	return m.MetaVersion == META_VERSION_2 && m.Info.Pieces == ""
+}
+
+// The info-hashes peers may know this torrent by. Hybrid torrents have two.
+func (m *MetaInfo) InfoHashes() []string {
+	if len(m.InfoHashV2) == sha256.Size && m.InfoHashV2[:20] != m.InfoHash {
+		return []string{m.InfoHash, m.InfoHashV2[:20]}
+	}
+	return []string{m.InfoHash}
+}
+
+// Whether peers may know this torrent by ih.
+func (m *MetaInfo) hasInfoHash(ih string) bool {
+	for _, h := range m.InfoHashes() {
+		if h == ih {
+			return true
+		}
+	}
+	return false
+}
+
+// The info dictionary of a v2 or hybrid torrent.
+type infoDictV2 struct {
+	InfoDict
+	MetaVersion int64                  `bencode:"meta version"`
+	FileTree    map[string]interface{} `bencode:"file tree"`
+}
+
+// infoDict returns what to encode as the torrent's info dictionary.
+func (m *MetaInfo) infoDict() interface{} {
+	if m.MetaVersion == 0 {
+		return &m.Info
+	}
+	return &infoDictV2{m.Info, m.MetaVersion, fileTreeMap(m.FilesV2)}
+}
+
+// storeInfo returns the layout to store the torrent in. For pure v2 torrents
+// that's a v1 file list with padding files between the real ones, so that
+// pieces map onto the file store the same way as for v1 torrents.
+func (m *MetaInfo) storeInfo() *InfoDict {
+	if !m.isV2Only() {
+		return &m.Info
+	}
+	info := m.Info
+	if len(m.FilesV2) == 1 && len(m.FilesV2[0].Path) == 1 && m.FilesV2[0].Path[0] == info.Name {
+		info.Length = m.FilesV2[0].Length
+		return &info
+	}
+	last := -1
+	for i, f := range m.FilesV2 {
+		if f.Length > 0 {
+			last = i
+		}
+	}
+	info.Files = nil
+	for i, f := range m.FilesV2 {
+		info.Files = append(info.Files, FileDict{Length: f.Length, Path: f.Path})
+		if pad := f.Length % info.PieceLength; i < last && pad != 0 {
+			info.Files = append(info.Files, FileDict{
+				Length: info.PieceLength - pad,
+				Path:   []string{".pad", strconv.FormatInt(info.PieceLength-pad, 10)},
+				Attr:   "p",
+			})
+		}
+	}
+	return &info
+}
+
+// checkPieceV2 checks a piece of a pure v2 torrent. The piece may have been
+// padded out to the piece length; the padding isn't part of the file.
+func checkPieceV2(piece []byte, m *MetaInfo, pieceIndex int) (good bool, err error) {
+	if pieceIndex < 0 || pieceIndex >= len(m.piecesV2) {
+		err = fmt.Errorf("Piece %v out of range", pieceIndex)
+		return
+	}
+	p := m.piecesV2[pieceIndex]
+	if int64(len(piece)) < p.length {
+		err = fmt.Errorf("Piece %v is short", pieceIndex)
+		return
+	}
+	h, ref := m.pieceHasher(pieceIndex)
+	h.Write(piece[:p.length])
+	current := h.Sum(nil)
+	good = bytes.Equal(ref, current)
+	if !good {
+		err = fmt.Errorf("reference sha256: %x != piece sha256: %x", ref, current)
+	}
+	return
+}
+
+// Hashes a piece of a pure v2 torrent: the root of a merkle tree, width
+// wide, over the hashes of its blocks. It's written whole blocks, but for
+// the piece's last, so a piece can be written a segment at a time.
+type merkleHash struct {
+	blocks [][]byte
+	width  int
+}
+
+func (h *merkleHash) Write(p []byte) (int, error) {
+	h.blocks = append(h.blocks, blockHashes(p)...)
+	return len(p), nil
+}
+
+func (h *merkleHash) Sum(b []byte) []byte {
+	return append(b, merkleRoot(h.blocks, h.width, zeroHash)...)
+}
+
+func (h *merkleHash) Reset() {
+	h.blocks = nil
+}
+
+func (h *merkleHash) Size() int {
+	return sha256.Size
+}
+
+func (h *merkleHash) BlockSize() int {
+	return BEP52_BLOCK_SIZE
+}
+
+// The hasher for a piece of a pure v2 torrent, which is in range, and the
+// hash it should come to.
+func (m *MetaInfo) pieceHasherV2(pieceIndex int) (h hash.Hash, ref []byte) {
+	p := m.piecesV2[pieceIndex]
+	f := &m.FilesV2[p.file]
+	if f.Length <= m.Info.PieceLength {
+		// The tree only needs to be as wide as the file.
+		blocks := (f.Length + BEP52_BLOCK_SIZE - 1) / BEP52_BLOCK_SIZE
+		return &merkleHash{width: int(roundUpToPowerOfTwo(uint64(blocks)))}, []byte(f.PiecesRoot)
+	}
+	layer := m.PieceLayers[f.PiecesRoot]
+	return &merkleHash{width: int(m.Info.PieceLength / BEP52_BLOCK_SIZE)}, []byte(layer[p.index*sha256.Size : (p.index+1)*sha256.Size])
+}
+
+// checkPiecesV2 is checkPieces for pure v2 torrents.
+func checkPiecesV2(ctx context.Context, fs FileStore, m *MetaInfo) (good, bad int, goodBits *Bitset, err error) {
+	goodBits = NewBitset(len(m.piecesV2))
+	buf := make([]byte, m.Info.PieceLength)
+	for i, p := range m.piecesV2 {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		h, ref := m.pieceHasher(i)
+		if bytes.Equal(pieceSumAt(fs, int64(i)*m.Info.PieceLength, int(p.length), buf, h), ref) {
+			good++
+			goodBits.Set(i)
+		} else {
+			bad++
+		}
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeTorrentV2 writes files under dir/name and a pure v2 torrent for them,
+// returning the path of the .torrent file.
+func makeTorrentV2(t *testing.T, dir, name string, files []FileDictV2, contents [][]byte, pieceLength int64) string {
+	m := &MetaInfo{MetaVersion: META_VERSION_2, PieceLayers: map[string]string{}}
+	m.Info.Name = name
+	m.Info.PieceLength = pieceLength
+	for i := range files {
+		f := &files[i]
+		p := filepath.Join(append([]string{dir, name}, f.Path...)...)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, contents[i], 0600); err != nil {
+			t.Fatal(err)
+		}
+		f.Length = int64(len(contents[i]))
+		root, layer, err := hashFileV2(bytes.NewReader(contents[i]), f.Length, pieceLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.PiecesRoot = root
+		if layer != "" {
+			m.PieceLayers[root] = layer
+		}
+	}
+	m.FilesV2 = files
+	if err := m.UpdateInfoHash(nil); err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, name+".torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = m.Bencode(f); err != nil {
+		t.Fatal(err)
+	}
+	return torrentFile
+}
+
+func hashPair(a, b []byte) []byte {
+	h := sha256.New()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func TestMerkleRoot(t *testing.T) {
+	data := make([]byte, 2*BEP52_BLOCK_SIZE+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	h0 := sha256.Sum256(data[:BEP52_BLOCK_SIZE])
+	h1 := sha256.Sum256(data[BEP52_BLOCK_SIZE : 2*BEP52_BLOCK_SIZE])
+	h2 := sha256.Sum256(data[2*BEP52_BLOCK_SIZE:])
+	want := hashPair(hashPair(h0[:], h1[:]), hashPair(h2[:], zeroHash))
+	if got := merkleRoot(blockHashes(data), 4, zeroHash); !bytes.Equal(got, want) {
+		t.Errorf("merkleRoot = %x, want %x", got, want)
+	}
+	// A piece of 64KiB has room for 4 blocks, too.
+	if got := pieceHashV2(data, 4*BEP52_BLOCK_SIZE); !bytes.Equal(got, want) {
+		t.Errorf("pieceHashV2 = %x, want %x", got, want)
+	}
+	// A file no longer than a block is its own root.
+	root, layer, err := hashFileV2(bytes.NewReader(data[:100]), 100, BEP52_BLOCK_SIZE)
+	if want := sha256.Sum256(data[:100]); err != nil || root != string(want[:]) || layer != "" {
+		t.Errorf("hashFileV2 = %x, %x, %v, want %x", root, layer, err, want)
+	}
+}
+
+func TestPiecesRootV2(t *testing.T) {
+	// Three pieces of two blocks each: the fourth piece is padding, and
+	// hashes like a piece of zero blocks.
+	data := make([]byte, 5*BEP52_BLOCK_SIZE+1)
+	rand.New(rand.NewSource(2)).Read(data)
+	pieceLength := int64(2 * BEP52_BLOCK_SIZE)
+	root, layer, err := hashFileV2(bytes.NewReader(data), int64(len(data)), pieceLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layer) != 3*sha256.Size {
+		t.Fatalf("layer has %d bytes, want %d", len(layer), 3*sha256.Size)
+	}
+	pad := hashPair(zeroHash, zeroHash)
+	l := []byte(layer)
+	want := hashPair(hashPair(l[0:32], l[32:64]), hashPair(l[64:96], pad))
+	if root != string(want) {
+		t.Errorf("root = %x, want %x", root, want)
+	}
+}
+
+func TestParseFileTree(t *testing.T) {
+	root := string(make([]byte, 32))
+	tree := map[string]interface{}{
+		"b": map[string]interface{}{"": map[string]interface{}{"length": int64(1), "pieces root": root}},
+		"a": map[string]interface{}{
+			"y": map[string]interface{}{"": map[string]interface{}{"length": int64(0)}},
+			"x": map[string]interface{}{"": map[string]interface{}{"length": int64(2), "pieces root": root}},
+		},
+	}
+	files, err := parseFileTree(tree, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, filepath.Join(f.Path...))
+	}
+	if want := []string{"a/x", "a/y", "b"}; len(paths) != 3 || paths[0] != want[0] || paths[1] != want[1] || paths[2] != want[2] {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+	tree["c"] = map[string]interface{}{"": map[string]interface{}{"length": int64(5)}}
+	if _, err = parseFileTree(tree, nil); err == nil {
+		t.Error("Expected an error for a file without a pieces root")
+	}
+}
+
+func TestMetaInfoV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bep52")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pieceLength := int64(2 * BEP52_BLOCK_SIZE)
+	r := rand.New(rand.NewSource(3))
+	contents := [][]byte{make([]byte, 3*BEP52_BLOCK_SIZE+5), make([]byte, 10), make([]byte, 2*BEP52_BLOCK_SIZE)}
+	for _, c := range contents {
+		r.Read(c)
+	}
+	files := []FileDictV2{{Path: []string{"a"}}, {Path: []string{"d", "b"}}, {Path: []string{"d", "c"}}}
+	torrentFile := makeTorrentV2(t, dir, "v2", files, contents, pieceLength)
+
+	m, err := GetMetaInfo(nil, torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.isV2Only() || len(m.InfoHashV2) != sha256.Size || m.InfoHash != m.InfoHashV2[:20] {
+		t.Fatalf("Not parsed as a v2 torrent: %+v", m)
+	}
+	if want := sha256.Sum256(m.rawInfo); m.InfoHashV2 != string(want[:]) {
+		t.Errorf("InfoHashV2 = %x, want %x", m.InfoHashV2, want)
+	}
+	// a has 2 pieces, b and c one each. b and a are padded to a piece.
+	wantLengths := []int64{pieceLength, BEP52_BLOCK_SIZE + 5, 10, pieceLength}
+	if len(m.piecesV2) != len(wantLengths) {
+		t.Fatalf("%d pieces, want %d", len(m.piecesV2), len(wantLengths))
+	}
+	for i, p := range m.piecesV2 {
+		if p.length != wantLengths[i] {
+			t.Errorf("piece %d has length %d, want %d", i, p.length, wantLengths[i])
+		}
+	}
+	info := m.storeInfo()
+	var total int64
+	for _, f := range info.Files {
+		total += f.Length
+	}
+	if want := 3*pieceLength + int64(len(contents[2])); total != want {
+		t.Errorf("store size = %d, want %d", total, want)
+	}
+
+	good, err := checkPiece(contents[0][pieceLength:], m, 1)
+	if !good || err != nil {
+		t.Errorf("checkPiece(1) = %v, %v", good, err)
+	}
+	// Padding after the end of a file is ignored.
+	padded := append(append([]byte(nil), contents[1]...), make([]byte, pieceLength-10)...)
+	if good, err = checkPiece(padded, m, 2); !good || err != nil {
+		t.Errorf("checkPiece(2) = %v, %v", good, err)
+	}
+	if good, _ = checkPiece(contents[2], m, 2); good {
+		t.Error("checkPiece accepted the wrong data")
+	}
+
+	// A piece layer that doesn't match its root is rejected.
+	m.PieceLayers[files[0].PiecesRoot] = string(make([]byte, 2*sha256.Size))
+	if err = m.UpdateInfoHash(nil); err == nil {
+		t.Error("Expected an error for a bad piece layer")
+	}
+}
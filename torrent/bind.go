@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Binding our traffic to one local address, so that it only goes out by the
+// interface that has it, like a VPN's. If the interface loses its address,
+// dials fail rather than going out some other way, and the torrents pause
+// until it's back.
+
+// How often an interface's address is looked up again.
+const BIND_CHECK = 5 * time.Second
+
+var bindCheck = BIND_CHECK // Shortened by tests
+
+var errNoBindAddress = errors.New("The bind interface has no address")
+
+// A Binding is the local address we dial from: a fixed one, or an
+// interface's, which follows the interface's as it changes. A Binding is a
+// proxy.Dialer, so it can be TorrentFlags.Dial, or what a proxy dials
+// through.
+type Binding struct {
+	iface string // The interface's name, or "" for a fixed address
+	lock  sync.Mutex
+	ip    net.IP // nil while the interface has no address
+}
+
+// Looked up through this, so that tests needn't have the interfaces.
+var interfaceAddrs = func(name string) ([]net.Addr, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return ifi.Addrs()
+}
+
+// NewBinding binds to addr, an IP address or an interface's name.
+func NewBinding(addr string) (b *Binding, err error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return &Binding{ip: ip}, nil
+	}
+	if _, err = interfaceAddrs(addr); err != nil {
+		return nil, fmt.Errorf("Bad bind address %q: %v", addr, err)
+	}
+	b = &Binding{iface: addr}
+	b.update()
+	return
+}
+
+// The interface's IPv4 address, or if it has none, its first global IPv6 one.
+func interfaceIP(name string) (ip net.IP) {
+	addrs, err := interfaceAddrs(name)
+	if err != nil {
+		return
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if v4 := n.IP.To4(); v4 != nil {
+			return v4
+		}
+		if ip == nil && n.IP.IsGlobalUnicast() {
+			ip = n.IP
+		}
+	}
+	return
+}
+
+// Looks the interface's address up again, saying whether it's changed.
+func (b *Binding) update() (ip net.IP, changed bool) {
+	if b.iface == "" {
+		return b.IP(), false
+	}
+	ip = interfaceIP(b.iface)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	changed = !ip.Equal(b.ip)
+	b.ip = ip
+	return
+}
+
+// IP is the address we're bound to, or nil if the interface has none. A nil
+// Binding has none too.
+func (b *Binding) IP() net.IP {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.ip
+}
+
+func (b *Binding) String() string {
+	if b.iface != "" {
+		return b.iface
+	}
+	return b.ip.String()
+}
+
+// Dial dials from the bound address, failing if there's none.
+func (b *Binding) Dial(network, addr string) (net.Conn, error) {
+	d, err := b.dialer(network)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial(network, addr)
+}
+
+func (b *Binding) dialer(network string) (d *net.Dialer, err error) {
+	ip := b.IP()
+	if ip == nil {
+		return nil, errNoBindAddress
+	}
+	d = &net.Dialer{}
+	switch network {
+	case "udp", "udp4", "udp6":
+		d.LocalAddr = &net.UDPAddr{IP: ip}
+	default:
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return
+}
+
+// The local address for UDP sockets: nil for any if we're not bound.
+func (b *Binding) localUDPAddr() (addr *net.UDPAddr, err error) {
+	if b == nil {
+		return
+	}
+	ip := b.IP()
+	if ip == nil {
+		return nil, errNoBindAddress
+	}
+	return &net.UDPAddr{IP: ip}, nil
+}
+
+// Looks the interface's address up every bindCheck until ctx is done,
+// calling changed with the new one, or nil, when it changes.
+func (b *Binding) watch(ctx context.Context, changed func(ip net.IP)) {
+	if b.iface == "" {
+		return
+	}
+	ticker := time.NewTicker(bindCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ip, ok := b.update(); ok {
+				changed(ip)
+			}
+		}
+	}
+}
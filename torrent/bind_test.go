@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBindingAddress(t *testing.T) {
+	b, err := NewBinding("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := b.dialer("tcp")
+	if err != nil || d.LocalAddr.String() != "127.0.0.1:0" {
+		t.Errorf("TCP dialer %+v, %v", d, err)
+	}
+	if d, err = b.dialer("udp4"); err != nil || d.LocalAddr.(*net.UDPAddr).IP.String() != "127.0.0.1" {
+		t.Errorf("UDP dialer %+v, %v", d, err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := b.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Dialed from %v", ip)
+	}
+
+	// Unbound dialers leave UDP sockets be, and bound ones bind them.
+	if a, err := localUDPAddr(nil); a != nil || err != nil {
+		t.Errorf("Unbound UDP address %v, %v", a, err)
+	}
+	if a, err := localUDPAddr(boundDialer{nil, b}); err != nil || !a.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Bound UDP address %v, %v", a, err)
+	}
+}
+
+func TestBindingInterface(t *testing.T) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	defer func(d time.Duration) { bindCheck = d }(bindCheck)
+	bindCheck = 5 * time.Millisecond
+	var lock sync.Mutex
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.IPv4(10, 8, 0, 2), Mask: net.CIDRMask(24, 32)},
+	}
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if name != "tun0" {
+			return nil, errors.New("No such interface")
+		}
+		return addrs, nil
+	}
+
+	if _, err := NewBinding("eth9"); err == nil {
+		t.Error("Bound to a missing interface")
+	}
+	b, err := NewBinding("tun0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := b.IP(); !ip.Equal(net.IPv4(10, 8, 0, 2)) || b.String() != "tun0" {
+		t.Errorf("Bound to %v", ip)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan net.IP, 10)
+	go b.watch(ctx, func(ip net.IP) { changes <- ip })
+
+	// Without IPv4, the global IPv6 address.
+	lock.Lock()
+	addrs = addrs[:2]
+	lock.Unlock()
+	if ip := <-changes; !ip.Equal(net.ParseIP("2001:db8::5")) {
+		t.Errorf("Moved to %v", ip)
+	}
+
+	// The VPN drops: dials fail rather than going out another way.
+	lock.Lock()
+	addrs = nil
+	lock.Unlock()
+	if ip := <-changes; ip != nil {
+		t.Errorf("Lost the address, but have %v", ip)
+	}
+	if _, err = b.Dial("tcp", "127.0.0.1:1"); err != errNoBindAddress {
+		t.Errorf("Dialed without an address: %v", err)
+	}
+	if _, err = b.localUDPAddr(); err != errNoBindAddress {
+		t.Errorf("UDP without an address: %v", err)
+	}
+}
@@ -1,11 +1,18 @@
 package torrent
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math/bits"
 )
 
 // As defined by the bittorrent protocol, this bitset is big-endian, such that
 // the high bit of the first byte is block 0
+//
+// Operations on whole bitsets work a 64 bit word at a time. The bytes read as
+// big-endian words keep the same order, so bit i is word i/64's i%64th bit
+// from the top. The last word can be short; it reads as if padded with
+// zeros, and the bits past n are kept clear.
 
 type Bitset struct {
 	b        []byte
@@ -66,47 +73,131 @@ func (b *Bitset) checkRange(index int) {
 	}
 }
 
-func (b *Bitset) AndNot(b2 *Bitset) {
+func (b *Bitset) checkSize(b2 *Bitset) {
 	if b.n != b2.n {
 		panic(fmt.Sprintf("Unequal bitset sizes %d != %d", b.n, b2.n))
 	}
-	for i := 0; i < len(b.b); i++ {
-		b.b[i] = b.b[i] & ^b2.b[i]
+}
+
+func (b *Bitset) words() int {
+	return (len(b.b) + 7) >> 3
+}
+
+func (b *Bitset) word(k int) uint64 {
+	i := k << 3
+	if i+8 <= len(b.b) {
+		return binary.BigEndian.Uint64(b.b[i:])
+	}
+	var w uint64
+	for j, c := range b.b[i:] {
+		w |= uint64(c) << uint(56-8*j)
+	}
+	return w
+}
+
+func (b *Bitset) setWord(k int, w uint64) {
+	i := k << 3
+	if i+8 <= len(b.b) {
+		binary.BigEndian.PutUint64(b.b[i:], w)
+		return
+	}
+	for j := range b.b[i:] {
+		b.b[i+j] = byte(w >> uint(56-8*j))
+	}
+}
+
+// And clears the bits that aren't set in b2.
+func (b *Bitset) And(b2 *Bitset) {
+	b.checkSize(b2)
+	for k := 0; k < b.words(); k++ {
+		b.setWord(k, b.word(k)&b2.word(k))
+	}
+}
+
+// AndNot clears the bits that are set in b2.
+func (b *Bitset) AndNot(b2 *Bitset) {
+	b.checkSize(b2)
+	for k := 0; k < b.words(); k++ {
+		b.setWord(k, b.word(k)&^b2.word(k))
 	}
 	b.clearEnd()
 }
 
+// AnyAndNot is whether any bit is set in b but not in b2: for a peer's
+// pieces and ours, whether it has a piece we want.
+func (b *Bitset) AnyAndNot(b2 *Bitset) bool {
+	b.checkSize(b2)
+	for k := 0; k < b.words(); k++ {
+		if b.word(k)&^b2.word(k) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Count is how many bits are set.
+func (b *Bitset) Count() (n int) {
+	for k := 0; k < b.words(); k++ {
+		n += bits.OnesCount64(b.word(k))
+	}
+	return
+}
+
+// ForEachSet calls f with the index of each set bit, in order.
+func (b *Bitset) ForEachSet(f func(index int)) {
+	for k := 0; k < b.words(); k++ {
+		for w := b.word(k); w != 0; {
+			z := bits.LeadingZeros64(w)
+			f(k<<6 + z)
+			w &^= 1 << uint(63-z)
+		}
+	}
+}
+
 func (b *Bitset) clearEnd() {
 	if b.endIndex >= 0 {
 		b.b[b.endIndex] &= b.endMask
 	}
 }
 
+// Whether the bits past the end are clear.
 func (b *Bitset) IsEndValid() bool {
 	if b.endIndex >= 0 {
-		return (b.b[b.endIndex] & b.endMask) == 0
+		return (b.b[b.endIndex] &^ b.endMask) == 0
 	}
 	return true
 }
 
-// TODO: Make this fast
 func (b *Bitset) FindNextSet(index int) int {
-	for i := index; i < b.n; i++ {
-		if (b.b[i>>3] & byte(128>>byte(i&7))) != 0 {
-			return i
-		}
-	}
-	return -1
+	return b.findNext(index, 0)
 }
 
-// TODO: Make this fast
 func (b *Bitset) FindNextClear(index int) int {
-	for i := index; i < b.n; i++ {
-		if (b.b[i>>3] & byte(128>>byte(i&7))) == 0 {
-			return i
+	return b.findNext(index, ^uint64(0))
+}
+
+// The first bit from index that's set, once the words are xor'd with flip.
+func (b *Bitset) findNext(index int, flip uint64) int {
+	if index < 0 {
+		index = 0
+	}
+	if index >= b.n {
+		return -1
+	}
+	k := index >> 6
+	w := (b.word(k) ^ flip) & (^uint64(0) >> uint(index&63))
+	for {
+		if w != 0 {
+			if i := k<<6 + bits.LeadingZeros64(w); i < b.n {
+				return i
+			}
+			return -1
+		}
+		if k++; k >= b.words() {
+			return -1
 		}
+		w = b.word(k) ^ flip
 	}
-	return -1
 }
 
 func (b *Bitset) Bytes() []byte {
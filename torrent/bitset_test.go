@@ -0,0 +1,189 @@
+package torrent
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// The bit at a time versions the word at a time ones are checked against.
+
+func naiveCount(b *Bitset) (n int) {
+	for i := 0; i < b.n; i++ {
+		if b.IsSet(i) {
+			n++
+		}
+	}
+	return
+}
+
+func naiveAnyAndNot(b, b2 *Bitset) bool {
+	for i := 0; i < b.n; i++ {
+		if b.IsSet(i) && !b2.IsSet(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func naiveFindNext(b *Bitset, index int, set bool) int {
+	for i := index; i < b.n; i++ {
+		if b.IsSet(i) == set {
+			return i
+		}
+	}
+	return -1
+}
+
+// A bitset of n bits, each set with probability density.
+func randomBitset(r *rand.Rand, n int, density float64) *Bitset {
+	b := NewBitset(n)
+	for i := 0; i < n; i++ {
+		if r.Float64() < density {
+			b.Set(i)
+		}
+	}
+	return b
+}
+
+func copyBitset(b *Bitset) *Bitset {
+	return NewBitsetFromBytes(b.n, b.Bytes())
+}
+
+func TestBitsetWords(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sizes := []int{0, 1, 7, 8, 9, 63, 64, 65, 127, 128, 129, 1000, 4099}
+	for i := 0; i < 20; i++ {
+		sizes = append(sizes, r.Intn(300))
+	}
+	for _, n := range sizes {
+		for _, density := range []float64{0, 0.01, 0.5, 0.99, 1} {
+			b, b2 := randomBitset(r, n, density), randomBitset(r, n, density)
+			if r.Intn(3) == 0 {
+				// Often b2 has all of b, so nothing's wanted.
+				for i := 0; i < n; i++ {
+					if b.IsSet(i) {
+						b2.Set(i)
+					}
+				}
+			}
+			if got, want := b.Count(), naiveCount(b); got != want {
+				t.Errorf("%d bits at %v: Count %d, not %d", n, density, got, want)
+			}
+			if got, want := b.AnyAndNot(b2), naiveAnyAndNot(b, b2); got != want {
+				t.Errorf("%d bits at %v: AnyAndNot %v, not %v", n, density, got, want)
+			}
+			var each []int
+			b.ForEachSet(func(i int) { each = append(each, i) })
+			var want []int
+			for i := naiveFindNext(b, 0, true); i >= 0; i = naiveFindNext(b, i+1, true) {
+				want = append(want, i)
+			}
+			if len(each) != len(want) {
+				t.Errorf("%d bits at %v: ForEachSet gave %d bits, not %d", n, density, len(each), len(want))
+			} else {
+				for i := range each {
+					if each[i] != want[i] {
+						t.Errorf("%d bits at %v: ForEachSet gave %d, not %d", n, density, each[i], want[i])
+						break
+					}
+				}
+			}
+			for i := -1; i <= n+1; i++ {
+				if got, want := b.FindNextSet(i), naiveFindNext(b, max(i, 0), true); got != want {
+					t.Errorf("%d bits at %v: FindNextSet(%d) %d, not %d", n, density, i, got, want)
+				}
+				if got, want := b.FindNextClear(i), naiveFindNext(b, max(i, 0), false); got != want {
+					t.Errorf("%d bits at %v: FindNextClear(%d) %d, not %d", n, density, i, got, want)
+				}
+			}
+
+			and, andNot := copyBitset(b), copyBitset(b)
+			and.And(b2)
+			andNot.AndNot(b2)
+			for i := 0; i < n; i++ {
+				if and.IsSet(i) != (b.IsSet(i) && b2.IsSet(i)) {
+					t.Errorf("%d bits at %v: And has bit %d wrong", n, density, i)
+				}
+				if andNot.IsSet(i) != (b.IsSet(i) && !b2.IsSet(i)) {
+					t.Errorf("%d bits at %v: AndNot has bit %d wrong", n, density, i)
+				}
+			}
+			if !and.IsEndValid() || !andNot.IsEndValid() {
+				t.Errorf("%d bits at %v: bits set past the end", n, density)
+			}
+		}
+	}
+}
+
+func TestBitsetUnequalSizes(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("AnyAndNot of unequal bitsets didn't panic")
+		}
+	}()
+	NewBitset(10).AnyAndNot(NewBitset(11))
+}
+
+// 200 peers of a torrent with 100k pieces, where we have half of them: is
+// each interesting, and how many of them have each piece.
+const (
+	benchPieces = 100000
+	benchPeers  = 200
+)
+
+func benchBitsets() (ours *Bitset, peers []*Bitset) {
+	r := rand.New(rand.NewSource(1))
+	ours = randomBitset(r, benchPieces, 0.5)
+	for i := 0; i < benchPeers; i++ {
+		// Peers that only have what we have are the slow case, as every
+		// piece is looked at.
+		p := copyBitset(ours)
+		if i%2 == 0 {
+			p = randomBitset(r, benchPieces, 0.5)
+			p.And(ours)
+		}
+		peers = append(peers, p)
+	}
+	return
+}
+
+func BenchmarkBitsetInterest(b *testing.B) {
+	ours, peers := benchBitsets()
+	b.Run("naive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, p := range peers {
+				naiveAnyAndNot(p, ours)
+			}
+		}
+	})
+	b.Run("words", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, p := range peers {
+				p.AnyAndNot(ours)
+			}
+		}
+	})
+}
+
+func BenchmarkBitsetAvailability(b *testing.B) {
+	_, peers := benchBitsets()
+	availability := make([]int, benchPieces)
+	b.Run("naive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, p := range peers {
+				for j := 0; j < benchPieces; j++ {
+					if p.IsSet(j) {
+						availability[j]++
+					}
+				}
+			}
+		}
+	})
+	b.Run("words", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, p := range peers {
+				p.ForEachSet(func(j int) { availability[j]++ })
+			}
+		}
+	})
+}
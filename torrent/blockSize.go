@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"fmt"
+)
+
+// The longest block we ask for, and the longest we answer requests for.
+// Most clients won't serve more than this, and some not more than
+// STANDARD_BLOCK_LENGTH.
+const MAX_BLOCK_LENGTH = 128 * 1024
+
+// Says whether n is a block size a torrent can ask for. It's a multiple of
+// STANDARD_BLOCK_LENGTH, so a piece's blocks can be split into standard ones.
+func checkBlockSize(n int) error {
+	if n < STANDARD_BLOCK_LENGTH || n > MAX_BLOCK_LENGTH || n%STANDARD_BLOCK_LENGTH != 0 {
+		return fmt.Errorf("The block size must be a multiple of %d from %d to %d bytes, not %d", STANDARD_BLOCK_LENGTH, STANDARD_BLOCK_LENGTH, MAX_BLOCK_LENGTH, n)
+	}
+	return nil
+}
+
+// The block size from the flags, for torrents that don't have their own.
+func defaultBlockSize(flags *TorrentFlags) int {
+	if flags.BlockSize == 0 {
+		return STANDARD_BLOCK_LENGTH
+	}
+	return flags.BlockSize
+}
+
+// BlockSize is how much the torrent asks its peers for at a time. The last
+// block of a piece is shorter if the piece isn't a multiple of it.
+func (ts *TorrentSession) BlockSize() int {
+	return ts.blockSize
+}
+
+// SetBlockSize gives the torrent its own block size, in place of the
+// flags'. It's saved in its resume data. Pieces already being fetched keep
+// the size they were started with.
+func (ts *TorrentSession) SetBlockSize(n int) error {
+	if err := checkBlockSize(n); err != nil {
+		return err
+	}
+	return ts.runInLoop(func() {
+		ts.blockSize, ts.ownBlockSize = n, true
+		ts.saveResumeData()
+	})
+}
+
+// The block size to start a piece with for p: the torrent's, unless p's
+// been found not to answer requests for blocks that long.
+func (ts *TorrentSession) peerBlockSize(p *peerState) int {
+	if p.standardBlocks {
+		return STANDARD_BLOCK_LENGTH
+	}
+	return ts.blockSize
+}
+
+// Splits the piece's blocks into ones of n bytes, a divisor of its block
+// size, so a peer that's asked for blocks of n can fetch it. It can't if any
+// of its blocks has been asked for, as the requests are for the longer ones.
+func (v *ActivePiece) splitBlocks(n int) bool {
+	for _, c := range v.downloaderCount {
+		if c > 0 {
+			return false
+		}
+	}
+	counts := make([]int, (v.length+n-1)/n)
+	for i := range counts {
+		counts[i] = v.downloaderCount[i*n/v.blockSize]
+	}
+	v.downloaderCount, v.blockSize = counts, n
+	return true
+}
+
+// Whether p has been asked for a block longer than STANDARD_BLOCK_LENGTH
+// without ever sending one back.
+func (ts *TorrentSession) unansweredLongRequest(p *peerState) bool {
+	if p.sentLongBlock {
+		return false
+	}
+	for k := range p.our_requests {
+		if v, ok := ts.activePieces[int(k>>32)]; ok && v.blockSize > STANDARD_BLOCK_LENGTH {
+			return true
+		}
+	}
+	return false
+}
+
+// Falls back to standard blocks for p, which hasn't answered a request for
+// a longer one. What it was asked for is asked for again, from pieces it
+// can be asked for. Peers from its address are asked for standard blocks
+// too, for as long as the session lasts, in case it hung up on us.
+func (ts *TorrentSession) useStandardBlocks(p *peerState) (err error) {
+	ts.logger().Info("Peer didn't answer a long block request, asking it for standard blocks", "peer", p.address, "blockSize", ts.blockSize)
+	p.standardBlocks = true
+	ts.standardBlockPeers[p.address] = true
+	if err = ts.removeRequests(p); err != nil || p.peer_choking {
+		return
+	}
+	for i := 0; i < MAX_OUR_REQUESTS && err == nil; i++ {
+		err = ts.RequestBlock(p)
+	}
+	return
+}
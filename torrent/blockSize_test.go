@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckBlockSize(t *testing.T) {
+	for _, n := range []int{STANDARD_BLOCK_LENGTH, 48 * 1024, MAX_BLOCK_LENGTH} {
+		if err := checkBlockSize(n); err != nil {
+			t.Errorf("%d: %v", n, err)
+		}
+	}
+	for _, n := range []int{0, 8 * 1024, 20000, 2 * MAX_BLOCK_LENGTH} {
+		if checkBlockSize(n) == nil {
+			t.Errorf("%d is allowed", n)
+		}
+	}
+}
+
+// A piece that isn't a multiple of the block size ends with a short block,
+// and splits into standard blocks that keep what's been received.
+func TestActivePieceBlocks(t *testing.T) {
+	v := (*pieceMemory)(nil).newActivePiece(100000, 48*1024, true)
+	if len(v.downloaderCount) != 3 {
+		t.Fatalf("%d blocks", len(v.downloaderCount))
+	}
+	v.recordBlock(1)
+	v.downloaderCount[2] = 1
+	if v.splitBlocks(STANDARD_BLOCK_LENGTH) {
+		t.Fatal("Split a piece whose last block was asked for")
+	}
+	v.downloaderCount[2] = 0
+	if !v.splitBlocks(STANDARD_BLOCK_LENGTH) {
+		t.Fatal("Didn't split")
+	}
+	want := []int{0, 0, 0, -1, -1, -1, 0}
+	if v.blockSize != STANDARD_BLOCK_LENGTH || len(v.downloaderCount) != len(want) {
+		t.Fatalf("Split into %d blocks of %d", len(v.downloaderCount), v.blockSize)
+	}
+	for i, c := range want {
+		if v.downloaderCount[i] != c {
+			t.Errorf("Block %d: %d, not %d", i, v.downloaderCount[i], c)
+		}
+	}
+}
+
+// A session with a piece of 100000 bytes and a peer that has it.
+func blockSizeSession(t *testing.T, blockSize int) (ts *TorrentSession, p *peerState, theirs net.Conn) {
+	ts, p, theirs = hashingSession(t, [][]byte{make([]byte, STANDARD_BLOCK_LENGTH)})
+	ts.blockSize = blockSize
+	ts.lastPieceLength = 100000
+	p.peer_choking = false
+	return
+}
+
+// A peer that doesn't answer a request for a long block is asked for the
+// piece in standard blocks instead.
+func TestBlockSizeFallback(t *testing.T) {
+	ts, p, theirs := blockSizeSession(t, 64*1024)
+	defer theirs.Close()
+	if err := ts.RequestBlock(p); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMessage(theirs, REQUEST)
+	if msg == nil || bytesToUint32(msg[9:13]) != 64*1024 {
+		t.Fatalf("Requested %x", msg)
+	}
+	for k := range p.our_requests {
+		p.our_requests[k] = time.Now().Add(-time.Minute)
+	}
+	if err := ts.doCheckRequests(p); err != nil {
+		t.Fatal(err)
+	}
+	if !p.standardBlocks || !ts.standardBlockPeers[p.address] {
+		t.Error("Didn't fall back to standard blocks")
+	}
+	for i := 0; i < MAX_OUR_REQUESTS; i++ {
+		msg = readMessage(theirs, REQUEST)
+		if msg == nil || bytesToUint32(msg[1:5]) != 0 || bytesToUint32(msg[5:9]) != uint32(i*STANDARD_BLOCK_LENGTH) ||
+			bytesToUint32(msg[9:13]) != STANDARD_BLOCK_LENGTH {
+			t.Fatalf("Request %d was %x", i, msg)
+		}
+	}
+	if v := ts.activePieces[0]; v.blockSize != STANDARD_BLOCK_LENGTH || len(v.downloaderCount) != 7 {
+		t.Errorf("The piece has %d blocks of %d", len(v.downloaderCount), v.blockSize)
+	}
+}
+
+// A peer that has sent a long block isn't taken to not want to, and one that
+// hangs up on a request for one is asked for standard blocks next time.
+func TestBlockSizeFallbackOnClose(t *testing.T) {
+	ts, p, theirs := blockSizeSession(t, 64*1024)
+	defer theirs.Close()
+	if err := ts.RequestBlock(p); err != nil {
+		t.Fatal(err)
+	}
+	readMessage(theirs, REQUEST)
+	p.sentLongBlock = true
+	if ts.unansweredLongRequest(p) {
+		t.Error("A peer that's sent a long block didn't answer")
+	}
+	p.sentLongBlock = false
+	ts.ClosePeer(p)
+	if !ts.standardBlockPeers[p.address] {
+		t.Error("Will ask a peer that hung up for long blocks again")
+	}
+}
@@ -0,0 +1,160 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// An IP blocklist: peers from these addresses aren't connected to, or let
+// in. The file has a range on each line, in any of these forms:
+//
+//	203.0.113.7
+//	203.0.113.0/24
+//	203.0.113.0-203.0.113.255
+//	Some description:203.0.113.0-203.0.113.255
+//
+// The last is the P2P format most published lists use. IPv6 works the same.
+// Blank lines, and ones starting with # or //, are skipped, and so are lines
+// that can't be read, after logging a count of them.
+
+type ipRange struct {
+	first, last net.IP // 16 bytes, so IPv4 and IPv6 sort together
+}
+
+// Sorted by first, and merged, so they don't overlap.
+type ipRanges []ipRange
+
+func (r ipRanges) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	i := sort.Search(len(r), func(i int) bool { return bytes.Compare(r[i].last, ip) >= 0 })
+	return i < len(r) && bytes.Compare(r[i].first, ip) <= 0
+}
+
+// Parses a line of the blocklist file.
+func parseIPRange(line string) (r ipRange, err error) {
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Contains(line[i:], ".") {
+		// The P2P format's description. IPv6 ranges have colons too, but
+		// not in their last part.
+		line = line[i+1:]
+	}
+	line = strings.TrimSpace(line)
+	if strings.Contains(line, "/") {
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(line); err != nil {
+			return
+		}
+		r.first = n.IP.To16()
+		r.last = make(net.IP, net.IPv6len)
+		mask := n.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range r.last {
+			r.last[i] = r.first[i] | ^mask[i]
+		}
+		return
+	}
+	from, to := line, line
+	if i := strings.Index(line, "-"); i >= 0 {
+		from, to = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+	}
+	if r.first, r.last = net.ParseIP(from).To16(), net.ParseIP(to).To16(); r.first == nil || r.last == nil {
+		return r, fmt.Errorf("Not an address or range: %q", line)
+	}
+	if (r.first.To4() == nil) != (r.last.To4() == nil) || bytes.Compare(r.first, r.last) > 0 {
+		return r, fmt.Errorf("Not a range: %q", line)
+	}
+	return
+}
+
+// Reads a blocklist file. bad is how many lines couldn't be read, and
+// firstBad the first of their errors.
+func loadBlocklist(name string) (ranges ipRanges, bad int, firstBad error, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, e := parseIPRange(line)
+		if e != nil {
+			if bad++; firstBad == nil {
+				firstBad = fmt.Errorf("Line %d: %v", n, e)
+			}
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].first, ranges[j].first) < 0 })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r.first, merged[n-1].last) <= 0 {
+			if bytes.Compare(r.last, merged[n-1].last) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, bad, firstBad, nil
+}
+
+// The blocklist in force, shared by the manager and its sessions, and
+// replaced whole when it's reloaded. A nil one blocks nothing.
+type blocklist struct {
+	ranges atomic.Value // ipRanges
+}
+
+func (b *blocklist) set(r ipRanges) {
+	b.ranges.Store(r)
+}
+
+func (b *blocklist) blocked(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	r, _ := b.ranges.Load().(ipRanges)
+	return r.contains(ip)
+}
+
+// Whether the host:port address is blocked.
+func (b *blocklist) blockedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return b.blocked(net.ParseIP(host))
+}
+
+func (b *blocklist) blockedConn(c *BtConn) bool {
+	return c.RemoteAddr != nil && b.blockedAddr(c.RemoteAddr.String())
+}
+
+// Disconnects the peers the blocklist has come to block.
+func (ts *TorrentSession) dropBlocked() error {
+	return ts.runInLoop(func() {
+		for _, p := range ts.peers {
+			if ts.blocklist.blockedAddr(p.address) {
+				ts.logger().Info("Disconnecting a blocked peer", "peer", p.address)
+				ts.ClosePeer(p)
+			}
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIPRange(t *testing.T) {
+	for _, test := range []struct {
+		line        string
+		first, last string
+	}{
+		{"203.0.113.7", "203.0.113.7", "203.0.113.7"},
+		{"203.0.113.0/24", "203.0.113.0", "203.0.113.255"},
+		{"203.0.113.0 - 203.0.113.127", "203.0.113.0", "203.0.113.127"},
+		{"Some: bad people:203.0.113.0-203.0.113.9", "203.0.113.0", "203.0.113.9"},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"2001:db8::1-2001:db8::ff", "2001:db8::1", "2001:db8::ff"},
+	} {
+		r, err := parseIPRange(test.line)
+		if err != nil || !r.first.Equal(net.ParseIP(test.first)) || !r.last.Equal(net.ParseIP(test.last)) {
+			t.Errorf("%q: %v-%v, %v", test.line, r.first, r.last, err)
+		}
+	}
+	for _, line := range []string{"nonsense", "203.0.113.9-203.0.113.1", "203.0.113.0-2001:db8::1", "203.0.113.0/33"} {
+		if _, err := parseIPRange(line); err == nil {
+			t.Errorf("Read %q", line)
+		}
+	}
+}
+
+func TestLoadBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "blocklist")
+	if err = ioutil.WriteFile(name, []byte(`# Comments, blank lines and bad lines are skipped
+
+203.0.113.0/25
+203.0.113.100-203.0.113.200
+// An overlapping range, merged
+junk
+198.51.100.1
+2001:db8::/48
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ranges, bad, firstBad, err := loadBlocklist(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bad != 1 || firstBad == nil {
+		t.Errorf("%d bad lines, %v", bad, firstBad)
+	}
+	if len(ranges) != 3 {
+		t.Errorf("Ranges %v", ranges)
+	}
+	b := &blocklist{}
+	if b.blocked(net.ParseIP("203.0.113.1")) {
+		t.Error("An empty blocklist blocks")
+	}
+	b.set(ranges)
+	for addr, blocked := range map[string]bool{
+		"203.0.113.0:6881":           true,
+		"203.0.113.150:6881":         true,
+		"203.0.113.200:6881":         true,
+		"203.0.113.201:6881":         false,
+		"198.51.100.1:6881":          true,
+		"198.51.100.2:6881":          false,
+		"[2001:db8::5]:6881":         true,
+		"[2001:db8:1::5]:6881":       false,
+		"[::ffff:198.51.100.1]:6881": true,
+		"not an address":             false,
+	} {
+		if b.blockedAddr(addr) != blocked {
+			t.Errorf("%s blocked: %v", addr, !blocked)
+		}
+	}
+	if (*blocklist)(nil).blocked(net.ParseIP("198.51.100.1")) {
+		t.Error("A nil blocklist blocks")
+	}
+	if _, _, _, err = loadBlocklist(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Loaded a missing blocklist")
+	}
+}
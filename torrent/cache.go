@@ -5,6 +5,7 @@ import (
 	"log"
 	"math"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -27,16 +28,35 @@ func (a byTime) Len() int           { return len(a) }
 func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byTime) Less(i, j int) bool { return a[i].atime.Before(a[j].atime) }
 
+//Counts a provider's cache hits and misses, by piece.
+type cacheHits struct {
+	hits, misses uint64 //Access atomically
+}
+
+func (c *cacheHits) CacheHits() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+func (c *cacheHits) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
 //This provider creates a ram cache for each torrent.
 //Each time a cache is created or closed, all cache
 //are recalculated so they total <= capacity (in MiB).
 type RamCacheProvider struct {
 	capacity int
+	mu       sync.Mutex //Guards caches, as torrents make and close theirs on their own goroutines
 	caches   map[string]*RamCache
+	cacheHits
 }
 
 func NewRamCacheProvider(capacity int) CacheProvider {
-	rc := &RamCacheProvider{capacity, make(map[string]*RamCache)}
+	rc := &RamCacheProvider{capacity: capacity, caches: make(map[string]*RamCache)}
 	return rc
 }
 
@@ -45,12 +65,14 @@ func (r *RamCacheProvider) NewCache(infohash string, numPieces int, pieceSize in
 	rc := &RamCache{pieceSize: pieceSize, atimes: make([]time.Time, numPieces), store: make([][]byte, numPieces),
 		torrentLength: torrentLength, cacheProvider: r, capacity: &i, infohash: infohash, underlying: underlying}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.caches[infohash] = rc
 	r.rebalance()
 	return rc
 }
 
-//Rebalance the cache capacity allocations; has to be called on each cache creation or deletion.
+//Rebalance the cache capacity allocations; has to be called on each cache creation or deletion, with mu held.
 func (r *RamCacheProvider) rebalance() {
 	//Cache size is a diminishing return thing:
 	//The more of it a torrent has, the less of a difference additional cache makes.
@@ -72,13 +94,13 @@ func (r *RamCacheProvider) rebalance() {
 		log.Printf("Setting cache '%x' to new capacity %v (%v MiB)", cache.infohash, newCap, float32(newCap*cache.pieceSize)/float32(1024*1024))
 		cache.setCapacity(uint32(newCap))
 	}
-
-		for _, cache := range r.caches {
-			cache.trim()
-		}
-	}
+	//Each cache trims itself to its new capacity when it next adds a piece,
+	//on its own torrent's goroutine.
+}
 
 func (r *RamCacheProvider) cacheClosed(infohash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	delete(r.caches, infohash)
 	r.rebalance()
 }
@@ -109,29 +131,22 @@ func (r *RamCache) Close() error {
 	return r.underlying.Close()
 }
 
+//Drops the cached pieces, to free the memory.
+func (r *RamCache) Flush() error {
+	for i := range r.store {
+		if r.store[i] != nil {
+			r.removeBox(i)
+		}
+	}
+	return nil
+}
+
 func (r *RamCache) ReadAt(p []byte, off int64) (retInt int, retErr error) {
 	boxI := off / r.pieceSize
 	boxOff := off % r.pieceSize
 
 	for i := 0; i < len(p); {
-
-		var buffer []byte
-		if r.store[boxI] != nil { //in cache
-			buffer = r.store[boxI]
-			r.atimes[boxI] = time.Now()
-		} else { //not in cache
-			bufferLength := r.pieceSize
-			bufferOffset := boxI * r.pieceSize
-
-			if bufferLength > r.torrentLength-bufferOffset { //do we want the last, smaller than usual piece?
-				bufferLength = r.torrentLength - bufferOffset
-			}
-
-			buffer = make([]byte, bufferLength)
-			r.underlying.ReadAt(buffer, bufferOffset)
-			r.addBox(buffer, int(boxI))
-		}
-
+		buffer := r.box(boxI)
 		i += copy(p[i:], buffer[boxOff:])
 		boxI++
 		boxOff = 0
@@ -139,19 +154,72 @@ func (r *RamCache) ReadAt(p []byte, off int64) (retInt int, retErr error) {
 
 	retInt = len(p)
 	return
+}
+
+//The piece boxI, from the cache, or read into it.
+func (r *RamCache) box(boxI int64) (buffer []byte) {
+	r.cacheProvider.count(r.store[boxI] != nil)
+	if r.store[boxI] != nil { //in cache
+		buffer = r.store[boxI]
+		r.atimes[boxI] = time.Now()
+	} else { //not in cache
+		bufferLength := r.pieceSize
+		bufferOffset := boxI * r.pieceSize
+
+		if bufferLength > r.torrentLength-bufferOffset { //do we want the last, smaller than usual piece?
+			bufferLength = r.torrentLength - bufferOffset
+		}
+
+		buffer = make([]byte, bufferLength)
+		r.underlying.ReadAt(buffer, bufferOffset)
+		r.addBox(buffer, int(boxI))
+	}
+	return
+}
+
+//Lends the length bytes at off straight from the cache, rather than copying
+//them out, or nil if they aren't all in one piece. A box is never written to
+//once it's in the cache; evicting it only drops the cache's reference to it.
+//So a lent block stays good, and unchanged, for as long as it's held.
+func (r *RamCache) lendBlock(off int64, length int) []byte {
+	boxI := off / r.pieceSize
+	boxOff := off % r.pieceSize
+	if boxI >= int64(len(r.store)) || boxOff+int64(length) > r.pieceSize {
+		return nil
+	}
+	buffer := r.box(boxI)
+	if boxOff+int64(length) > int64(len(buffer)) {
+		return nil
+	}
+	return buffer[boxOff : boxOff+int64(length) : boxOff+int64(length)]
 			}
 
+//Writes the piece through, and caches it once it's written. A box we have
+//already may have been read in before the piece was, so it's dropped.
 func (r *RamCache) WritePiece(p []byte, boxI int) (n int, err error) {
-
-	if r.store[boxI] != nil { //box exists, our work is done
-		log.Println("Got a WritePiece for a piece we should already have:", boxI)
+	if r.store[boxI] != nil {
+		r.removeBox(boxI)
+	}
+	//TODO: Maybe goroutine the calls to underlying?
+	if n, err = r.underlying.WritePiece(p, boxI); err != nil {
 		return
-		}
+	}
+	// p is the caller's to reuse, so we keep a copy.
+	r.addBox(append([]byte(nil), p...), boxI)
+	return
+}
 
-	r.addBox(p, boxI)
+//Writes a segment of a piece that isn't verified yet through, dropping the
+//box we have of the piece, if any, as it's out of date.
+func (r *RamCache) WriteSegment(p []byte, boxI int, begin int) (n int, err error) {
+	if r.store[boxI] != nil {
+		r.removeBox(boxI)
+	}
+	return writeSegment(r.underlying, p, boxI, begin)
+}
 
-	//TODO: Maybe goroutine the calls to underlying?
-	return r.underlying.WritePiece(p, boxI)
+func (r *RamCache) writesSegments() bool {
+	return canWriteSegments(r.underlying)
 }
 
 func (r *RamCache) addBox(p []byte, boxI int) {
@@ -3,6 +3,7 @@ package torrent
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"log"
 	"testing"
@@ -63,3 +64,139 @@ func TestCachedFileStoreRead(t *testing.T) {
 		fs.Close()
 	}
 }
+
+// Piece buffers are reused once written, so the cache mustn't keep them.
+func TestRamCacheCopiesPieces(t *testing.T) {
+	ram, _ := NewRAMFileSystem()
+	info := &InfoDict{Name: "cached", Length: 1024, PieceLength: 512}
+	fs, _, err := NewFileStore(info, ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	tC := NewRamCacheProvider(2000).NewCache("test", 2, 512, 1024, fs)
+	buf := make([]byte, 512)
+	for i := range buf {
+		buf[i] = 1
+	}
+	tC.WritePiece(buf, 0)
+	for i := range buf {
+		buf[i] = 2
+	}
+	got := make([]byte, 512)
+	if _, err = tC.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != 1 || got[511] != 1 {
+		t.Errorf("The cache read back the reused buffer: %d...%d", got[0], got[511])
+	}
+}
+
+// Neither cache keeps the buffers it's given: a caller that reuses one
+// buffer for every piece it writes, and another for every read, gets back
+// what it wrote, as the pieces come and go from the cache.
+func TestCachesDontKeepBuffers(t *testing.T) {
+	const pieces, length = 8, 512
+	caches := map[string]CacheProvider{"ram": NewRamCacheProvider(2000), "hd": NewHdCacheProvider(2000)}
+	for name, provider := range caches {
+		ram, _ := NewRAMFileSystem()
+		info := &InfoDict{Name: "reused", Length: pieces * length, PieceLength: length}
+		files, _, err := NewFileStore(info, ram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := provider.NewCache("reused-"+name, pieces, length, pieces*length, files)
+		// Room for just a few pieces, so that they're evicted and read in
+		// again.
+		switch c := fs.(type) {
+		case *RamCache:
+			c.setCapacity(3)
+		case *HdCache:
+			c.setCapacity(3)
+		}
+		buf := make([]byte, length)
+		for i := 0; i < pieces; i++ {
+			for j := range buf {
+				buf[j] = byte(i + 1)
+			}
+			if _, err = fs.WritePiece(buf, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Last written first, while they're cached, and each twice.
+		for i := pieces - 1; i >= 0; i-- {
+			for round := 0; round < 2; round++ {
+				if _, err = fs.ReadAt(buf, int64(i)*length); err != nil {
+					t.Fatal(err)
+				}
+				if buf[0] != byte(i+1) || buf[length-1] != byte(i+1) {
+					t.Errorf("%s: read %d...%d of piece %d", name, buf[0], buf[length-1], i)
+				}
+				for j := range buf {
+					buf[j] = 0xff
+				}
+			}
+		}
+		fs.Close()
+	}
+}
+
+type failingWrites struct {
+	FileStore
+}
+
+func (failingWrites) WritePiece(p []byte, piece int) (int, error) {
+	return 0, errors.New("Disk error")
+}
+
+// WritePiece is where a piece is saved, with a cache or without: it's in the
+// files once it returns, even if the cache had read it in before, and it's
+// an error, not cached, if it couldn't be written.
+func TestWritePieceSaves(t *testing.T) {
+	caches := map[string]CacheProvider{"none": nil, "ram": NewRamCacheProvider(2000), "hd": NewHdCacheProvider(2000)}
+	for name, provider := range caches {
+		ram, _ := NewRAMFileSystem()
+		info := &InfoDict{Name: "saved", Length: 1024, PieceLength: 512}
+		files, _, err := NewFileStore(info, ram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := files
+		if provider != nil {
+			fs = provider.NewCache("saved-"+name, 2, 512, 1024, files)
+		}
+		piece := make([]byte, 512)
+		fs.ReadAt(piece, 0)
+		for i := range piece {
+			piece[i] = 1
+		}
+		if n, err := fs.WritePiece(piece, 0); n != 512 || err != nil {
+			t.Errorf("%s: wrote %d, %v", name, n, err)
+		}
+		got := make([]byte, 512)
+		for _, store := range []FileStore{files, fs} {
+			if _, err = store.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got[0] != 1 || got[511] != 1 {
+				t.Errorf("%s: read %d...%d back, not the piece", name, got[0], got[511])
+			}
+		}
+
+		var failing FileStore = failingWrites{files}
+		if provider != nil {
+			failing = provider.NewCache("failing-"+name, 2, 512, 1024, failing)
+		}
+		if _, err = failing.WritePiece(piece, 1); err == nil {
+			t.Errorf("%s: a failed write wasn't an error", name)
+		}
+		if _, err = failing.ReadAt(got, 512); err != nil {
+			t.Fatal(err)
+		}
+		if got[0] != 0 {
+			t.Errorf("%s: a piece that couldn't be written was cached", name)
+		}
+		failing.Close()
+		fs.Close()
+	}
+}
@@ -2,7 +2,7 @@ package torrent
 
 import (
 	"math/rand"
-	"sort"
+	"time"
 )
 
 // BitTorrent choking policy.
@@ -35,6 +35,16 @@ type ClassicChokePolicy struct {
 	counter            int    // When to choose a new optimisticUnchoker.
 }
 
+// How often a session chokes and unchokes its peers.
+const CHOKE_INTERVAL = 10 * time.Second
+
+// When a session first chokes its peers: at some random time in the first
+// interval, so that a manager's sessions, which mostly start together, don't
+// all choke theirs at once.
+func firstChoke(clock Clock) <-chan time.Time {
+	return clock.After(time.Duration(rand.Int63n(int64(CHOKE_INTERVAL))))
+}
+
 type ByDownloadBPS []Choker
 
 func (a ByDownloadBPS) Len() int {
@@ -55,8 +65,25 @@ const OPTIMISTIC_UNCHOKE_INDEX = HIGH_BANDWIDTH_SLOTS
 // How many cycles of this algorithm before we pick a new optimistic
 const OPTIMISTIC_UNCHOKE_COUNT = 3
 
+// Moves the k fastest chokers to the front, fastest first, leaving the rest
+// as they come: there may be thousands, and only the first few matter.
+func selectFastest(chokers []Choker, k int) {
+	if k > len(chokers) {
+		k = len(chokers)
+	}
+	for i := 0; i < k; i++ {
+		fastest, bps := i, chokers[i].DownloadBPS()
+		for j := i + 1; j < len(chokers); j++ {
+			if b := chokers[j].DownloadBPS(); b > bps {
+				fastest, bps = j, b
+			}
+		}
+		ByDownloadBPS(chokers).Swap(i, fastest)
+	}
+}
+
 func (ccp *ClassicChokePolicy) Choke(chokers []Choker) (unchokeCount int, err error) {
-	sort.Sort(ByDownloadBPS(chokers))
+	selectFastest(chokers, HIGH_BANDWIDTH_SLOTS)
 
 	optimistIndex := ccp.findOptimist(chokers)
 	if optimistIndex >= 0 {
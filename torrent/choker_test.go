@@ -3,7 +3,10 @@ package torrent
 import (
 	"fmt"
 	"math"
+	"math/rand"
+	"strconv"
 	"testing"
+	"time"
 )
 
 type testChoker struct {
@@ -106,3 +109,75 @@ func verifyClassicSortOrder(a []Choker, highBandwidthSlotCount int) bool {
 	}
 	return true
 }
+
+// 5000 interested peers over 200 sessions, with rates of up to 1 MB/s.
+func chokingSessions() (sessions []*TorrentSession) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		ts := &TorrentSession{peers: make(map[string]*peerState), chokePolicy: &ClassicChokePolicy{}, flags: &TorrentFlags{}}
+		for j := 0; j < 25; j++ {
+			p := NewPeerState(nil)
+			p.address = strconv.Itoa(j)
+			p.peer_interested = true
+			p.received.Add(int64(r.Float64() * 1e6))
+			ts.peers[p.address] = p
+		}
+		sessions = append(sessions, ts)
+	}
+	return
+}
+
+// The choker goes by what peers are sending now: one that sent a lot a while
+// ago ranks below one sending a little now.
+func TestChokeRecentRates(t *testing.T) {
+	now := time.Now()
+	ts := &TorrentSession{peers: make(map[string]*peerState), chokePolicy: &ClassicChokePolicy{}, flags: &TorrentFlags{}}
+	burst, steady := NewPeerState(nil), NewPeerState(nil)
+	burst.received = NewAccumulator(now.Add(-21 * time.Second))
+	burst.received.Add(1 << 20)
+	burst.received.GetRate(now.Add(-20*time.Second), DEFAULT_CHOKE_RATE_HALF_LIFE)
+	steady.received = NewAccumulator(now.Add(-time.Second))
+	steady.received.Add(50 * 1024)
+	for _, p := range []*peerState{burst, steady} {
+		p.address = fmt.Sprint(p == burst)
+		p.peer_interested = true
+		ts.peers[p.address] = p
+	}
+	ts.chokePeers()
+	if burst.DownloadBPS() >= steady.DownloadBPS() {
+		t.Errorf("The burst's %v is ahead of the steady peer's %v", burst.DownloadBPS(), steady.DownloadBPS())
+	}
+}
+
+func chokeAll(sessions []*TorrentSession) {
+	for _, ts := range sessions {
+		ts.chokePeers()
+	}
+}
+
+// How long it takes is BenchmarkChokeManyPeers's business: a test can't know
+// how fast the machine is.
+func TestChokeManyPeers(t *testing.T) {
+	sessions := chokingSessions()
+	chokeAll(sessions)
+	for _, ts := range sessions {
+		unchoked := 0
+		for _, p := range ts.peers {
+			if !p.am_choking {
+				unchoked++
+			}
+		}
+		if unchoked != OPTIMISTIC_UNCHOKE_INDEX+1 {
+			t.Fatalf("%d peers unchoked", unchoked)
+		}
+	}
+}
+
+func BenchmarkChokeManyPeers(b *testing.B) {
+	sessions := chokingSessions()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chokeAll(sessions)
+	}
+}
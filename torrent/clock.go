@@ -0,0 +1,36 @@
+package torrent
+
+import (
+	"time"
+)
+
+// A Clock is where a session gets the time for its own timers, and for what
+// it keeps track of with them: choking, announcing, keep-alives, request
+// timeouts, rates and seeding limits. Network deadlines, rate limits, web
+// seeds and the deadlock detector keep to the real clock. A fake one lets a
+// test run a session for minutes in moments.
+type Clock interface {
+	Now() time.Time
+	// After sends the time once d has passed.
+	After(d time.Duration) <-chan time.Time
+	// Tick sends the time every d, dropping ticks for a slow receiver.
+	Tick(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Tick(d time.Duration) <-chan time.Time  { return time.Tick(d) }
+
+// The flags' clock, or the real one.
+func flagsClock(flags *TorrentFlags) Clock {
+	if flags == nil || flags.Clock == nil {
+		return realClock{}
+	}
+	return flags.Clock
+}
+
+func (ts *TorrentSession) clock() Clock {
+	return flagsClock(ts.flags)
+}
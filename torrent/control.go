@@ -0,0 +1,246 @@
+package torrent
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// The control socket lets a second invocation hand its torrents to the
+// instance that's already running, rather than start competing sessions on
+// the same files. It's a unix socket, or on Windows a localhost TCP address.
+// Only one instance can serve it at a time. Where others could connect to it,
+// requests must carry a secret that only its owner can read: see
+// listenControl.
+//
+// A client sends one request and reads one response, each a 4 byte big-endian
+// length followed by that much JSON.
+
+const (
+	CONTROL_MAX_MESSAGE     = 16 << 20 // Bytes. Big enough for a few .torrent files.
+	CONTROL_TIMEOUT         = 30 * time.Second
+	CONTROL_HANDOFF_TIMEOUT = 10 * time.Second // How long HandOff waits for an instance that's starting up
+)
+
+var (
+	// ErrAlreadyRunning is returned by RunTorrents when another instance is
+	// serving the control socket.
+	ErrAlreadyRunning = errors.New("Another instance is serving the control socket")
+	// ErrNotRunning is returned by the control clients when no instance is
+	// serving the control socket.
+	ErrNotRunning = errors.New("No instance is serving the control socket")
+)
+
+type controlRequest struct {
+	Verb       string   // "add", "list" or "remove"
+	Torrents   []string // To add: URLs and magnet links
+	Data       [][]byte // To add: the contents of .torrent files
+	InfoHash   string   // To remove, in hex
+	DeleteData bool     // Remove the torrent's files too
+	Secret     string   // The server's, if it has one
+}
+
+type controlResponse struct {
+	Error      string
+	InfoHashes []string        // Of the torrents added, in hex
+	Torrents   []TorrentStatus // For list
+}
+
+func writeControlMessage(w io.Writer, v interface{}) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if len(data) > CONTROL_MAX_MESSAGE {
+		return fmt.Errorf("Control message of %d bytes is too long", len(data))
+	}
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	_, err = w.Write(append(buf, data...))
+	return
+}
+
+func readControlMessage(r io.Reader, v interface{}) (err error) {
+	var n uint32
+	if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+		return
+	}
+	if n > CONTROL_MAX_MESSAGE {
+		return fmt.Errorf("Control message of %d bytes is too long", n)
+	}
+	data := make([]byte, n)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return
+	}
+	return json.Unmarshal(data, v)
+}
+
+type controlServer struct {
+	listener net.Listener
+	lock     io.Closer // Held while we serve the socket
+	secret   string    // Requests must have it
+}
+
+// Claims the control socket, so that no other instance can serve it. It
+// returns ErrAlreadyRunning if one does.
+func claimControlSocket(addr string) (s *controlServer, err error) {
+	l, lock, secret, err := listenControl(addr)
+	if err != nil {
+		return
+	}
+	return &controlServer{l, lock, secret}, nil
+}
+
+// Serves requests for m until Close.
+func (s *controlServer) serve(m *sessionManager) {
+	log.Println("Serving the control socket on", s.listener.Addr())
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(m, conn)
+	}
+}
+
+func (s *controlServer) handle(m *sessionManager, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+	var req controlRequest
+	if err := readControlMessage(conn, &req); err != nil {
+		log.Println("Bad control request:", err)
+		return
+	}
+	var resp controlResponse
+	if subtle.ConstantTimeCompare([]byte(req.Secret), []byte(s.secret)) != 1 {
+		log.Println("Control request with the wrong secret")
+		resp.Error = "Wrong control secret"
+	} else if err := s.do(m, &req, &resp); err != nil {
+		resp.Error = err.Error()
+	}
+	if err := writeControlMessage(conn, &resp); err != nil {
+		log.Println("Couldn't answer a control request:", err)
+	}
+}
+
+func (s *controlServer) do(m *sessionManager, req *controlRequest, resp *controlResponse) (err error) {
+	switch req.Verb {
+	case "add":
+		var failed []string
+		added := func(ih string, err error) {
+			if err != nil {
+				failed = append(failed, err.Error())
+			} else {
+				resp.InfoHashes = append(resp.InfoHashes, hex.EncodeToString([]byte(ih)))
+			}
+		}
+		for _, t := range req.Torrents {
+			if !strings.HasPrefix(t, "magnet:") && !isTorrentURL(t) {
+				// The client sends files' contents, so it can add files we
+				// can't read.
+				added("", fmt.Errorf("%s isn't an http: or https: URL or a magnet link", t))
+				continue
+			}
+			added(m.AddTorrent(t))
+		}
+		for _, data := range req.Data {
+			added(m.AddTorrentFromBytes(data))
+		}
+		if len(failed) > 0 {
+			err = errors.New(strings.Join(failed, "; "))
+		}
+	case "list":
+		resp.Torrents, err = m.Statuses()
+	case "remove":
+		ih, e := hex.DecodeString(req.InfoHash)
+		if e != nil || len(ih) != 20 {
+			return errors.New("Bad info-hash")
+		}
+		err = m.RemoveTorrent(string(ih), req.DeleteData)
+	default:
+		err = fmt.Errorf("Unknown control verb %q", req.Verb)
+	}
+	return
+}
+
+func (s *controlServer) Close() error {
+	err := s.listener.Close()
+	s.lock.Close()
+	return err
+}
+
+func control(addr string, req *controlRequest) (resp controlResponse, err error) {
+	conn, err := dialControl(addr)
+	if err != nil {
+		return resp, ErrNotRunning
+	}
+	defer conn.Close()
+	if req.Secret, err = readControlSecret(addr); err != nil {
+		// It's listening, but hasn't written it yet.
+		return resp, ErrNotRunning
+	}
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+	if err = writeControlMessage(conn, req); err != nil {
+		return
+	}
+	if err = readControlMessage(conn, &resp); err == nil && resp.Error != "" {
+		err = errors.New(resp.Error)
+	}
+	return
+}
+
+// ControlAdd adds torrents to the instance serving the control socket at
+// addr. Torrents are files, URLs or magnet links; files are read here. It
+// returns the info-hashes of those added, in hex, even if some weren't.
+func ControlAdd(addr string, torrents []string) (infoHashes []string, err error) {
+	req := &controlRequest{Verb: "add"}
+	for _, t := range torrents {
+		if strings.HasPrefix(t, "magnet:") || isTorrentURL(t) {
+			req.Torrents = append(req.Torrents, t)
+			continue
+		}
+		data, err := ioutil.ReadFile(t)
+		if err != nil {
+			return nil, err
+		}
+		req.Data = append(req.Data, data)
+	}
+	resp, err := control(addr, req)
+	return resp.InfoHashes, err
+}
+
+// ControlList returns the status of the torrents of the instance serving the
+// control socket at addr.
+func ControlList(addr string) (statuses []TorrentStatus, err error) {
+	resp, err := control(addr, &controlRequest{Verb: "list"})
+	return resp.Torrents, err
+}
+
+// ControlRemove removes a torrent, by its info-hash in hex, from the instance
+// serving the control socket at addr.
+func ControlRemove(addr, infoHash string, deleteData bool) (err error) {
+	_, err = control(addr, &controlRequest{Verb: "remove", InfoHash: infoHash, DeleteData: deleteData})
+	return
+}
+
+// HandOff is ControlAdd, but if no instance is serving the control socket, it
+// waits up to CONTROL_HANDOFF_TIMEOUT for one to start. It's for when
+// RunTorrents returns ErrAlreadyRunning: the other instance may not be ready
+// for requests yet.
+func HandOff(addr string, torrents []string) (infoHashes []string, err error) {
+	for deadline := time.Now().Add(CONTROL_HANDOFF_TIMEOUT); ; time.Sleep(100 * time.Millisecond) {
+		infoHashes, err = ControlAdd(addr, torrents)
+		if err != ErrNotRunning || time.Now().After(deadline) {
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+//go:build !windows
+
+package torrent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// On unix, the control socket is a unix socket at addr. Whoever holds the
+// lock on addr + ".lock" serves it. The lock goes when its holder does, even
+// if it crashes, so a socket left behind doesn't stop the next instance.
+// Only its owner can use the socket, so it needs no secret.
+func listenControl(addr string) (l net.Listener, lock io.Closer, secret string, err error) {
+	f, err := os.OpenFile(addr+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = ErrAlreadyRunning
+		}
+		return
+	}
+	if l, err = listenPrivate(addr); err != nil {
+		f.Close()
+		return
+	}
+	return l, f, "", nil
+}
+
+// Listens on a unix socket at addr that only we may use. Others could
+// connect to it between its creation and a chmod, so it's created, and
+// chmod'ed, in a directory only we can get into, and then moved to addr.
+func listenPrivate(addr string) (l net.Listener, err error) {
+	dir, err := ioutil.TempDir(filepath.Dir(addr), "")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(tmp, 0600); err == nil {
+		// Replacing one left by an instance that's gone.
+		err = os.Rename(tmp, addr)
+	}
+	if err != nil {
+		ul.Close()
+		return
+	}
+	// It's no longer at tmp, so closing it must remove it from addr.
+	ul.SetUnlinkOnClose(false)
+	return unixListener{ul, addr}, nil
+}
+
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l unixListener) Close() error {
+	os.Remove(l.path)
+	return l.UnixListener.Close()
+}
+
+func readControlSecret(addr string) (string, error) {
+	return "", nil
+}
+
+func dialControl(addr string) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, CONTROL_TIMEOUT)
+}
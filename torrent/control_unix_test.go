@@ -0,0 +1,193 @@
+//go:build !windows
+
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestControlMessages(t *testing.T) {
+	var b bytes.Buffer
+	req := controlRequest{Verb: "remove", InfoHash: "ab", DeleteData: true}
+	if err := writeControlMessage(&b, &req); err != nil {
+		t.Fatal(err)
+	}
+	var got controlRequest
+	if err := readControlMessage(&b, &got); err != nil || got.Verb != req.Verb || got.InfoHash != req.InfoHash || !got.DeleteData {
+		t.Errorf("Got %+v, %v", got, err)
+	}
+	if err := readControlMessage(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}), &got); err == nil {
+		t.Error("Read a message that's too long")
+	}
+
+	// Paths would let clients add the server's files.
+	var s controlServer
+	var resp controlResponse
+	if err := s.do(nil, &controlRequest{Verb: "add", Torrents: []string{"/etc/passwd"}}, &resp); err == nil {
+		t.Error("Added a path")
+	}
+	if err := s.do(nil, &controlRequest{Verb: "start"}, &resp); err == nil {
+		t.Error("Did an unknown verb")
+	}
+}
+
+func TestClaimControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "control")
+	// A socket left behind by an instance that died.
+	if err = ioutil.WriteFile(addr, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Instances starting together: only one gets it.
+	const instances = 8
+	servers := make(chan *controlServer, instances)
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := claimControlSocket(addr)
+			if err == nil {
+				servers <- s
+			} else if err != ErrAlreadyRunning {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(servers)
+	var claimed []*controlServer
+	for s := range servers {
+		claimed = append(claimed, s)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("%d instances claimed the socket", len(claimed))
+	}
+	if fi, err := os.Stat(addr); err != nil || fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("Socket %v, %v", fi, err)
+	}
+	// The directory it was made in is gone.
+	if names, err := filepath.Glob(filepath.Join(dir, "*")); len(names) != 2 || err != nil {
+		t.Errorf("Left %v, %v", names, err)
+	}
+	claimed[0].Close()
+	if _, err := os.Stat(addr); !os.IsNotExist(err) {
+		t.Errorf("Once it's closed, the socket's there: %v", err)
+	}
+	s, err := claimControlSocket(addr)
+	if err != nil {
+		t.Fatal("Once it's closed:", err)
+	}
+	s.Close()
+}
+
+func TestControlHandOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "control")
+	if _, err = ControlList(addr); err != ErrNotRunning {
+		t.Errorf("With nothing running, %v", err)
+	}
+
+	writeWebSeedFiles(t, filepath.Join(dir, "files"), 20000, 10000)
+	meta, err := CreateTorrent(filepath.Join(dir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = meta.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		TrackerlessMode:    true,
+		SeedRatio:          math.Inf(0),
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	s, err := claimControlSocket(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.serve(m)
+
+	// Paths reach the server as the files' contents.
+	infoHashes, err := HandOff(addr, []string{torrentFile})
+	ih := hex.EncodeToString([]byte(meta.InfoHash))
+	if len(infoHashes) != 1 || infoHashes[0] != ih || err != nil {
+		t.Fatalf("Adding the torrent: %v %v", infoHashes, err)
+	}
+	if _, err = ControlAdd(addr, []string{filepath.Join(dir, "missing.torrent")}); !os.IsNotExist(err) {
+		t.Errorf("Adding a file that isn't there: %v", err)
+	}
+	if infoHashes, err = ControlAdd(addr, []string{torrentFile}); len(infoHashes) != 0 || err == nil ||
+		err.Error() != errDuplicateTorrent.Error() {
+		t.Errorf("Adding it again: %v %v", infoHashes, err)
+	}
+	waitForComplete(t, m, meta.InfoHash)
+	statuses, err := ControlList(addr)
+	if err != nil || len(statuses) != 1 || statuses[0].InfoHash != ih {
+		t.Fatalf("Listed %+v, %v", statuses, err)
+	}
+	if err = ControlRemove(addr, "zz", false); err == nil || !strings.Contains(err.Error(), "info-hash") {
+		t.Errorf("Removing a bad info-hash: %v", err)
+	}
+	if err = ControlRemove(addr, ih, false); err != nil {
+		t.Fatal(err)
+	}
+	waitForNoTorrents(t, m)
+}
+
+func TestControlSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "control")
+	s, err := claimControlSocket(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// As it is where others can connect.
+	s.secret = "secret"
+	go s.serve(nil)
+	if err = ControlRemove(addr, strings.Repeat("ab", 20), true); err == nil || !strings.Contains(err.Error(), "secret") {
+		t.Errorf("Without the secret, %v", err)
+	}
+}
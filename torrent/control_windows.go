@@ -0,0 +1,82 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// On Windows, the control socket is a TCP address, which must be a loopback
+// one, like 127.0.0.1:7778. Only one listener can have it, so having it is
+// the lock. Any local user can connect to it, so each run makes a secret and
+// writes it to a file in the user's application data, which only they can
+// read. Requests without it are refused. The file goes when we stop serving.
+func listenControl(addr string) (l net.Listener, lock io.Closer, secret string, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		err = errors.New("The control socket must be a loopback address, like 127.0.0.1:7778")
+		return
+	}
+	path, err := controlSecretPath(addr)
+	if err != nil {
+		return
+	}
+	if l, err = net.Listen("tcp", addr); err != nil {
+		if conn, e := dialControl(addr); e == nil {
+			conn.Close()
+			err = ErrAlreadyRunning
+		}
+		return
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err == nil {
+		secret = hex.EncodeToString(b)
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			err = ioutil.WriteFile(path, []byte(secret), 0600)
+		}
+	}
+	if err != nil {
+		l.Close()
+		return nil, nil, "", err
+	}
+	return l, secretFile(path), secret, nil
+}
+
+// Where the secret for the control socket at addr is kept.
+func controlSecretPath(addr string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer(":", "-", "[", "", "]", "").Replace(addr)
+	return filepath.Join(dir, "Taipei-Torrent", "control-"+name), nil
+}
+
+func readControlSecret(addr string) (string, error) {
+	path, err := controlSecretPath(addr)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(path)
+	return string(b), err
+}
+
+func dialControl(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, CONTROL_TIMEOUT)
+}
+
+// Closing it removes the secret's file.
+type secretFile string
+
+func (f secretFile) Close() error {
+	return os.Remove(string(f))
+}
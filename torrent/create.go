@@ -0,0 +1,172 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Creating torrents from files on disk.
+
+const (
+	CREATE_TARGET_PIECE_COUNT = 1500
+	CREATE_MIN_PIECE_LENGTH   = 16 * 1024
+	CREATE_MAX_PIECE_LENGTH   = 16 * 1024 * 1024
+)
+
+// Options for CreateTorrent. The zero value gives sensible defaults.
+type CreateOptions struct {
+	PieceLength    int64 // 0 picks one from the total size.
+	IncludeHidden  bool  // Include files and directories whose names start with ".".
+	FollowSymlinks bool  // Otherwise symlinks are skipped.
+
+	// These go in the info dictionary, so they change the info-hash.
+	Private bool
+	Source  string // Private trackers use this to tell their torrents apart.
+
+	Announce     string
+	AnnounceList [][]string // Tiers of trackers. Announce defaults to the first one.
+	WebSeeds     []string   // BEP 19 url-list
+	Comment      string
+	CreatedBy    string
+}
+
+// CreateTorrent builds a torrent for the file or directory at root. opts may
+// be nil.
+func CreateTorrent(root string, opts *CreateOptions) (m *MetaInfo, err error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	root = filepath.Clean(root)
+	fileInfo, err := os.Stat(root)
+	if err != nil {
+		return
+	}
+	m = &MetaInfo{
+		Announce:     opts.Announce,
+		AnnounceList: opts.AnnounceList,
+		WebSeeds:     opts.WebSeeds,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+	}
+	if m.Announce == "" && len(m.AnnounceList) > 0 && len(m.AnnounceList[0]) > 0 {
+		m.Announce = m.AnnounceList[0][0]
+	}
+	m.Info.Name = filepath.Base(root)
+	m.Info.Source = opts.Source
+	if opts.Private {
+		m.Info.Private = 1
+	}
+	var totalLength int64
+	// The file store opens files relative to dir.
+	dir := filepath.Dir(root)
+	if fileInfo.IsDir() {
+		dir = root
+		visited := map[string]bool{}
+		if m.Info.Files, err = walkFiles(root, nil, opts, visited); err != nil {
+			return
+		}
+		for _, f := range m.Info.Files {
+			totalLength += f.Length
+		}
+	} else {
+		m.Info.Length = fileInfo.Size()
+		totalLength = m.Info.Length
+	}
+	if totalLength == 0 {
+		err = errors.New("Can't create a torrent with no data")
+		return
+	}
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = createPieceLength(totalLength)
+	}
+	m.Info.PieceLength = pieceLength
+
+	fileStore, fileStoreLength, err := NewFileStore(&m.Info, &FileStoreFileSystemAdapter{&OSMetaInfoFileSystem{dir}})
+	if err != nil {
+		return
+	}
+	defer fileStore.Close()
+	if fileStoreLength != totalLength {
+		err = errors.New("Files changed while creating the torrent")
+		return
+	}
+	sums, err := computeSums(context.Background(), fileStore, totalLength, pieceLength)
+	if err != nil {
+		return
+	}
+	m.Info.Pieces = string(sums)
+	m.CreationDate = strconv.FormatInt(time.Now().Unix(), 10)
+	err = m.UpdateInfoHash(nil)
+	return
+}
+
+// Lists the files under dir/path, in name order.
+func walkFiles(dir string, path []string, opts *CreateOptions, visited map[string]bool) (files []FileDict, err error) {
+	full := filepath.Join(append([]string{dir}, path...)...)
+	// Following symlinks can lead us in circles.
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return
+	}
+	if visited[real] {
+		return
+	}
+	visited[real] = true
+
+	f, err := os.Open(full)
+	if err != nil {
+		return
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !opts.IncludeHidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+		p := append(append([]string(nil), path...), name)
+		var fi os.FileInfo
+		if fi, err = os.Lstat(filepath.Join(full, name)); err != nil {
+			return
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if !opts.FollowSymlinks {
+				continue
+			}
+			if fi, err = os.Stat(filepath.Join(full, name)); err != nil {
+				return
+			}
+		}
+		switch {
+		case fi.IsDir():
+			var sub []FileDict
+			if sub, err = walkFiles(dir, p, opts, visited); err != nil {
+				return
+			}
+			files = append(files, sub...)
+		case fi.Mode().IsRegular():
+			files = append(files, FileDict{Length: fi.Size(), Path: p})
+		}
+	}
+	return
+}
+
+// Chooses a power of two piece length that gives about
+// CREATE_TARGET_PIECE_COUNT pieces.
+func createPieceLength(totalLength int64) (pieceLength int64) {
+	pieceLength = CREATE_MIN_PIECE_LENGTH
+	for pieceLength < CREATE_MAX_PIECE_LENGTH && totalLength > pieceLength*CREATE_TARGET_PIECE_COUNT*3/2 {
+		pieceLength <<= 1
+	}
+	return
+}
@@ -0,0 +1,187 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func TestCreatePieceLength(t *testing.T) {
+	for _, tt := range []struct{ total, want int64 }{
+		{1, CREATE_MIN_PIECE_LENGTH},
+		{1500 * 16 * 1024, 16 * 1024},
+		{1500 * 1024 * 1024, 1024 * 1024},
+		{1 << 50, CREATE_MAX_PIECE_LENGTH},
+	} {
+		if got := createPieceLength(tt.total); got != tt.want {
+			t.Errorf("createPieceLength(%d) = %d, want %d", tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestCreateTorrent(t *testing.T) {
+	top, err := ioutil.TempDir("", "create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(top)
+	root := filepath.Join(top, "stuff")
+	content := make([]byte, 50*1024+7)
+	rand.New(rand.NewSource(5)).Read(content)
+	for name, data := range map[string][]byte{
+		"a":         content,
+		"sub/empty": nil,
+		"sub/z":     content[:100],
+		".hidden":   content[:3],
+	} {
+		p := filepath.Join(root, name)
+		if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	// A loop, which mustn't be followed forever.
+	if err = os.Symlink(root, filepath.Join(root, "sub", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := CreateTorrent(root, &CreateOptions{PieceLength: 16 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range m.Info.Files {
+		paths = append(paths, strings.Join(f.Path, "/"))
+	}
+	if want := []string{"a", "sub/empty", "sub/z"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Files = %v, want %v", paths, want)
+	}
+	if m.Info.Name != "stuff" || m.CreationDate == "" {
+		t.Errorf("Name = %q, CreationDate = %q", m.Info.Name, m.CreationDate)
+	}
+
+	// Round trip through our own parser.
+	torrentFile := filepath.Join(top, "stuff.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := GetMetaInfo(nil, torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.InfoHash != m.InfoHash || m2.CreationDate != m.CreationDate || !reflect.DeepEqual(m2.Info, m.Info) {
+		t.Errorf("Round trip gave %+v, want %+v", m2, m)
+	}
+	fs, _ := OsFsProvider{}.NewFS(root)
+	store, total, err := NewFileStore(&m2.Info, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if good, bad, _, err := checkPieces(context.Background(), store, total, m2); err != nil || bad != 0 || good == 0 {
+		t.Errorf("checkPieces = %d good, %d bad, %v", good, bad, err)
+	}
+
+	m, err = CreateTorrent(root, &CreateOptions{IncludeHidden: true, FollowSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths = nil
+	for _, f := range m.Info.Files {
+		paths = append(paths, strings.Join(f.Path, "/"))
+	}
+	if want := []string{".hidden", "a", "sub/empty", "sub/link", "sub/z"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Files = %v, want %v", paths, want)
+	}
+
+	// A single file.
+	m, err = CreateTorrent(filepath.Join(root, "a"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Info.Name != "a" || m.Info.Length != int64(len(content)) || len(m.Info.Files) != 0 {
+		t.Errorf("Single file torrent has info %+v", m.Info)
+	}
+	if _, err = CreateTorrent(filepath.Join(root, "sub", "empty"), nil); err == nil {
+		t.Error("Expected an error for a torrent with no data")
+	}
+}
+
+func TestCreateTorrentOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hello.txt")
+	if err = ioutil.WriteFile(file, []byte("hello world\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := &CreateOptions{
+		PieceLength:  16 * 1024,
+		Private:      true,
+		Source:       "SRC",
+		AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+		WebSeeds:     []string{"http://mirror/hello.txt"},
+		Comment:      "A comment",
+		CreatedBy:    "Taipei-Torrent",
+	}
+	m, err := CreateTorrent(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The canonical encoding of the info dictionary: sorted keys, with
+	// private and source inside it.
+	pieces, _ := hex.DecodeString("22596363b3de40b06f981fb85d82312e8c0ed511")
+	wantInfo := "d6:lengthi12e4:name9:hello.txt12:piece lengthi16384e6:pieces20:" + string(pieces) +
+		"7:privatei1e6:source3:SRCe"
+	if string(m.rawInfo) != wantInfo {
+		t.Errorf("info = %q, want %q", m.rawInfo, wantInfo)
+	}
+	if want := sha1.Sum([]byte(wantInfo)); m.InfoHash != string(want[:]) {
+		t.Errorf("InfoHash = %x, want %x", m.InfoHash, want)
+	}
+
+	var b bytes.Buffer
+	if err = m.Bencode(&b); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := bencode.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := decoded.(map[string]interface{})
+	for _, k := range []string{"announce", "announce-list", "comment", "created by", "creation date", "url-list"} {
+		if _, ok := top[k]; !ok {
+			t.Errorf("Missing top level key %q", k)
+		}
+	}
+	if _, ok := top["creation date"].(int64); !ok {
+		t.Errorf("creation date = %#v, want an integer", top["creation date"])
+	}
+	if top["announce"] != "http://a/announce" {
+		t.Errorf("announce = %v, want the first tracker", top["announce"])
+	}
+}
@@ -0,0 +1,212 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Cross-seeding: using data we already have on disk, perhaps under other
+// names, for a new torrent.
+
+// A CrossSeedMatch says which file on disk we'd use for one of a torrent's
+// files.
+type CrossSeedMatch struct {
+	Path     []string // The file in the torrent
+	Length   int64
+	Existing string // The file on disk with the same size, or "" if there isn't one
+	Verified bool   // A piece lying within the file matched the torrent
+}
+
+// FindCrossSeedMatches looks under searchDir for a file to use for each of
+// the torrent's files. Files match by size. When there's more than one
+// candidate, or hashCheck is set, a piece that lies within the file is
+// hashed to choose between them. Otherwise a file with the same name wins.
+func FindCrossSeedMatches(info *InfoDict, searchDir string, hashCheck bool) (matches []CrossSeedMatch, err error) {
+	bySize := map[int64][]string{}
+	err = filepath.Walk(searchDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && fi.Size() > 0 {
+			bySize[fi.Size()] = append(bySize[fi.Size()], p)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	files := info.Files
+	if len(files) == 0 {
+		files = []FileDict{{Length: info.Length, Path: []string{info.Name}}}
+	}
+	used := map[string]bool{}
+	var offset int64
+	for _, f := range files {
+		if f.Attr == "p" {
+			offset += f.Length
+			continue
+		}
+		match := CrossSeedMatch{Path: f.Path, Length: f.Length}
+		var candidates []string
+		for _, c := range bySize[f.Length] {
+			if !used[c] {
+				candidates = append(candidates, c)
+			}
+		}
+		piece, pieceOffset, canHash := pieceWithin(info, offset, f.Length)
+		for _, c := range sortByName(candidates, f.Path[len(f.Path)-1]) {
+			if canHash && (hashCheck || len(candidates) > 1) {
+				if !pieceMatches(info, c, piece, pieceOffset) {
+					continue
+				}
+				match.Verified = true
+			} else if hashCheck {
+				// Too small to check on its own.
+				continue
+			}
+			match.Existing = c
+			used[c] = true
+			break
+		}
+		matches = append(matches, match)
+		offset += f.Length
+	}
+	return
+}
+
+// Puts the candidates named name first.
+func sortByName(candidates []string, name string) (sorted []string) {
+	for _, c := range candidates {
+		if filepath.Base(c) == name {
+			sorted = append(sorted, c)
+		}
+	}
+	for _, c := range candidates {
+		if filepath.Base(c) != name {
+			sorted = append(sorted, c)
+		}
+	}
+	return
+}
+
+// The first piece that lies wholly within the file at offset, and where in
+// the file it starts.
+func pieceWithin(info *InfoDict, offset, length int64) (piece int, pieceOffset int64, ok bool) {
+	if info.PieceLength <= 0 {
+		return
+	}
+	piece = int((offset + info.PieceLength - 1) / info.PieceLength)
+	pieceOffset = int64(piece)*info.PieceLength - offset
+	ok = pieceOffset+info.PieceLength <= length && (piece+1)*sha1.Size <= len(info.Pieces)
+	return
+}
+
+func pieceMatches(info *InfoDict, file string, piece int, offset int64) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err = io.Copy(h, io.NewSectionReader(f, offset, info.PieceLength)); err != nil {
+		return false
+	}
+	return bytes.Equal(h.Sum(nil), []byte(info.Pieces[piece*sha1.Size:(piece+1)*sha1.Size]))
+}
+
+// crossSeedFileSystem opens the matched files where they are, and the rest
+// in the torrent's own directory.
+type crossSeedFileSystem struct {
+	FileSystem
+	existing map[string]string // Torrent path -> file on disk
+}
+
+func (c *crossSeedFileSystem) Open(name []string, length int64) (file File, err error) {
+	if p, ok := c.existing[path.Join(name...)]; ok {
+		return &osFile{filePath: p}, nil
+	}
+	return c.FileSystem.Open(name, length)
+}
+
+func (c *crossSeedFileSystem) Stat(name []string) (os.FileInfo, error) {
+	if p, ok := c.existing[path.Join(name...)]; ok {
+		return os.Stat(p)
+	}
+	if s, ok := c.FileSystem.(fileStater); ok {
+		return s.Stat(name)
+	}
+	return nil, errNoStat
+}
+
+// Files used where they are belong to something else, so they're kept when
+// the torrent's data is deleted.
+var errNotOurs = errors.New("Cross-seeded from another torrent's data")
+
+func (c *crossSeedFileSystem) Remove(name []string) error {
+	if p, ok := c.existing[path.Join(name...)]; ok {
+		return &os.PathError{Op: "remove", Path: p, Err: errNotOurs}
+	}
+	if r, ok := c.FileSystem.(fileRemover); ok {
+		return r.Remove(name)
+	}
+	return nil
+}
+
+// useCrossSeedMatches hard links the matched files into dir, where the
+// torrent is stored. Files that are already there are left alone. If a link
+// can't be made, say because the file's on another device, the file is used
+// where it is. Either way, completing the torrent writes to the matched
+// files, which is why the matches are confirmed first.
+func useCrossSeedMatches(matches []CrossSeedMatch, dir string, fs FileSystem) FileSystem {
+	existing := map[string]string{}
+	for _, m := range matches {
+		if m.Existing == "" {
+			continue
+		}
+		target := filepath.Join(dir, path.Clean("/" + path.Join(m.Path...))[1:])
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			err = os.Link(m.Existing, target)
+		}
+		if err != nil {
+			log.Println("Couldn't link", m.Existing, "to", target, "so using it where it is:", err)
+			existing[path.Join(m.Path...)] = m.Existing
+		}
+	}
+	if len(existing) == 0 {
+		return fs
+	}
+	return &crossSeedFileSystem{fs, existing}
+}
+
+// Describes a match for the log, or for the user to confirm.
+func (m CrossSeedMatch) String() string {
+	s := path.Join(m.Path...) + " <- "
+	if m.Existing == "" {
+		return s + "nothing"
+	}
+	s += m.Existing
+	if m.Verified {
+		s += " (verified)"
+	}
+	return s
+}
+
+// Counts the matches that found a file.
+func crossSeedMatched(matches []CrossSeedMatch) (n int) {
+	for _, m := range matches {
+		if m.Existing != "" {
+			n++
+		}
+	}
+	return
+}
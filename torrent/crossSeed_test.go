@@ -0,0 +1,130 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes a two file torrent under dir, with its data renamed in dir/search,
+// plus a decoy the same size as the second file. Returns the torrent's path.
+func writeCrossSeedTorrent(t *testing.T, dir string) (torrentFile string, info InfoDict) {
+	r := rand.New(rand.NewSource(1))
+	a, b, decoy := make([]byte, 40000), make([]byte, 30000), make([]byte, 30000)
+	r.Read(a)
+	r.Read(b)
+	r.Read(decoy)
+	info = InfoDict{PieceLength: 16384, Name: "t", Files: []FileDict{
+		{Length: int64(len(a)), Path: []string{"a"}}, {Length: int64(len(b)), Path: []string{"sub", "b"}}}}
+	data := append(append([]byte{}, a...), b...)
+	for i := 0; i < len(data); i += int(info.PieceLength) {
+		h := sha1.Sum(data[i:min(i+int(info.PieceLength), len(data))])
+		info.Pieces += string(h[:])
+	}
+	search := filepath.Join(dir, "search")
+	if err := os.MkdirAll(filepath.Join(search, "old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{"x": a, "old/y": b, "b": decoy} {
+		if err := ioutil.WriteFile(filepath.Join(search, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	torrentFile = filepath.Join(dir, "t.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = bencodeMarshal(f, map[string]interface{}{"info": &info}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestFindCrossSeedMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, info := writeCrossSeedTorrent(t, dir)
+	search := filepath.Join(dir, "search")
+
+	for _, hashCheck := range []bool{false, true} {
+		matches, err := FindCrossSeedMatches(&info, search, hashCheck)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 2 {
+			t.Fatalf("Got %d matches, want 2", len(matches))
+		}
+		// Only one file is the size of a.
+		if m := matches[0]; m.Existing != filepath.Join(search, "x") || m.Verified != hashCheck {
+			t.Errorf("hashCheck %v: a matched %v", hashCheck, m)
+		}
+		// The decoy has b's name, but not its data.
+		if m := matches[1]; m.Existing != filepath.Join(search, "old", "y") || !m.Verified {
+			t.Errorf("hashCheck %v: sub/b matched %v", hashCheck, m)
+		}
+	}
+
+	os.Remove(filepath.Join(search, "old", "y"))
+	matches, err := FindCrossSeedMatches(&info, search, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := matches[1]; m.Existing != filepath.Join(search, "b") || m.Verified {
+		t.Errorf("With only the decoy, sub/b matched %v", m)
+	}
+	if matches, _ = FindCrossSeedMatches(&info, search, true); matches[1].Existing != "" {
+		t.Errorf("With a hash check, sub/b matched %v", matches[1])
+	}
+}
+
+func TestCrossSeedSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	torrentFile, _ := writeCrossSeedTorrent(t, dir)
+	var asked []CrossSeedMatch
+	confirm := false
+	flags := &TorrentFlags{FileDir: filepath.Join(dir, "dl"), FileSystemProvider: OsFsProvider{}, MemoryPerTorrent: -1,
+		CrossSeedDir: filepath.Join(dir, "search"),
+		CrossSeedConfirm: func(name string, matches []CrossSeedMatch) bool {
+			asked = matches
+			return confirm
+		}}
+
+	ts, err := NewTorrentSession(flags, torrentFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.fileStore.Close()
+	if len(asked) != 2 || ts.goodPieces != 0 {
+		t.Errorf("Declined: asked about %v, have %d pieces", asked, ts.goodPieces)
+	}
+	os.RemoveAll(flags.FileDir)
+
+	confirm = true
+	ts, err = NewTorrentSession(flags, torrentFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.checkNow()
+	ts.fileStore.Close()
+	if ts.goodPieces != ts.totalPieces {
+		t.Errorf("Have %d of %d pieces after cross-seeding", ts.goodPieces, ts.totalPieces)
+	}
+	for _, p := range []string{"a", "sub/b"} {
+		fi, err := os.Stat(filepath.Join(flags.FileDir, "t", p))
+		if err != nil || !fi.Mode().IsRegular() {
+			t.Errorf("%s wasn't linked into the torrent's directory: %v", p, err)
+		}
+	}
+}
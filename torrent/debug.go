@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// What's going on inside, for finding out why a torrent's stuck: served, with
+// Go's profiles, under /debug/ by the control API with -rpcDebug. Each loop is
+// asked with a timeout, so that one that's stuck shows up as such, rather
+// than holding up the rest.
+//
+// Importing net/http/pprof registers its handlers on http.DefaultServeMux as
+// well, which nothing here serves.
+
+// How long a loop has to answer.
+var debugTimeout = 2 * time.Second
+
+type DebugState struct {
+	Goroutines int
+	// Whether the manager's loop answered. If it didn't, there are no
+	// torrents, as it keeps them.
+	Manager     bool
+	Adding      int // Torrents added that don't have a session yet
+	Queued      int // Torrents waiting for a free slot
+	Connections int // Peers that connected to us, waiting for the manager
+	PieceMemory int64
+	// Over every torrent.
+	CacheHits, CacheMisses uint64
+	DiskRead, DiskWritten  uint64 // Bytes
+	Torrents               []TorrentDebug
+}
+
+type TorrentDebug struct {
+	InfoHash string // In hex
+	Paused   bool
+	// Peers we've heard of waiting to be tried, and ones that have
+	// connected waiting to be added.
+	PeerHints, PeersToAdd int
+
+	// The rest are the loop's, and left out if it didn't answer.
+	Responding   bool
+	LoopLatency  time.Duration // How long it took to answer
+	Name         string
+	Peers        int
+	GoodPieces   int
+	TotalPieces  int
+	ActivePieces int
+	HashQueue    int // Pieces waiting to be hashed
+	PendingHaves int
+	PieceWaiters int // Readers waiting for pieces
+	FileHandles  int
+	// The pieces in its cache, and how many it can hold, with a cache.
+	CachedPieces, CacheCapacity int
+}
+
+// A cache that says how full it is.
+type cacheUsage interface {
+	usage() (pieces, capacity int)
+}
+
+func (r *RamCache) usage() (pieces, capacity int) {
+	return r.actualUsage, r.getCapacity()
+}
+
+func (r *HdCache) usage() (pieces, capacity int) {
+	return r.actualUsage, r.getCapacity()
+}
+
+// Runs f in the loop that reads commands, as run and runInLoop do, unless it
+// doesn't take it and run it within d. What f finds may only be looked at if
+// it did, as it may yet run later.
+func runWithin(commands chan<- func(), ended <-chan bool, d time.Duration, f func()) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	done := make(chan bool, 1)
+	select {
+	case commands <- func() { f(); done <- true }:
+	case <-ended:
+		return false
+	case <-timer.C:
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (m *sessionManager) DebugState() (s DebugState) {
+	s.Goroutines = runtime.NumGoroutine()
+	s.PieceMemory = m.memory.Used()
+	for _, cacher := range m.cachers() {
+		if c, ok := cacher.(cacheCounter); ok {
+			hits, misses := c.CacheHits()
+			s.CacheHits += hits
+			s.CacheMisses += misses
+		}
+	}
+	if m.disk != nil {
+		s.DiskRead, s.DiskWritten = atomic.LoadUint64(&m.disk.read), atomic.LoadUint64(&m.disk.written)
+	}
+	var adding, queued int
+	sessions := make(map[string]*TorrentSession)
+	s.Manager = runWithin(m.commands, m.ended, debugTimeout, func() {
+		adding, queued = len(m.adding), len(m.queue)
+		for ih, ts := range m.sessions {
+			sessions[ih] = ts
+		}
+	})
+	if !s.Manager {
+		return
+	}
+	s.Adding, s.Queued, s.Connections = adding, queued, len(m.conChan)
+	for ih, ts := range sessions {
+		d := ts.debugState()
+		d.InfoHash = ih
+		s.Torrents = append(s.Torrents, d)
+	}
+	sort.Slice(s.Torrents, func(i, j int) bool { return s.Torrents[i].InfoHash < s.Torrents[j].InfoHash })
+	return
+}
+
+func (ts *TorrentSession) debugState() (d TorrentDebug) {
+	d.Paused = ts.Paused()
+	d.PeerHints, d.PeersToAdd = len(ts.hintNewPeerChan), len(ts.addPeerChan)
+	var inLoop TorrentDebug
+	start := time.Now()
+	if !runWithin(ts.commands, ts.ended, debugTimeout, func() {
+		inLoop.LoopLatency = time.Since(start)
+		inLoop.Name = ts.M.Info.Name
+		inLoop.Peers = len(ts.peers)
+		inLoop.GoodPieces, inLoop.TotalPieces = ts.goodPieces, ts.totalPieces
+		inLoop.ActivePieces = len(ts.activePieces)
+		inLoop.HashQueue = len(ts.hashQueue)
+		inLoop.PendingHaves = len(ts.pendingHaves)
+		inLoop.PieceWaiters = len(ts.pieceWaiters)
+		inLoop.FileHandles = len(ts.fileHandles)
+		if c, ok := ts.fileStore.(cacheUsage); ok {
+			inLoop.CachedPieces, inLoop.CacheCapacity = c.usage()
+		}
+	}) {
+		return
+	}
+	inLoop.Paused, inLoop.PeerHints, inLoop.PeersToAdd = d.Paused, d.PeerHints, d.PeersToAdd
+	inLoop.Responding = true
+	return inLoop
+}
+
+// Serves Go's profiles, at /debug/pprof/ and under it.
+func servePprof(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
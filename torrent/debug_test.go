@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugState(t *testing.T) {
+	defer func(d time.Duration) { debugTimeout = d }(debugTimeout)
+	debugTimeout = 100 * time.Millisecond
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1}, 0)
+	m.stayUp = true
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+
+	// One session whose loop answers, and one that's stuck.
+	running := &TorrentSession{M: &MetaInfo{Info: InfoDict{Name: "running"}},
+		peers: map[string]*peerState{"peer": nil}, commands: make(chan func()), ended: make(chan bool),
+		hintNewPeerChan: make(chan peerHint, 2), addPeerChan: make(chan *BtConn, 2)}
+	running.hintNewPeerChan <- peerHint{}
+	stopLoop := make(chan bool)
+	defer close(stopLoop)
+	go func() {
+		for {
+			select {
+			case f := <-running.commands:
+				f()
+			case <-stopLoop:
+				return
+			}
+		}
+	}()
+	stuck := &TorrentSession{commands: make(chan func()), ended: make(chan bool), paused: 1,
+		hintNewPeerChan: make(chan peerHint, 2), addPeerChan: make(chan *BtConn, 2)}
+	m.run(func() { m.sessions = map[string]*TorrentSession{"aa": running, "bb": stuck} })
+	defer m.run(func() { m.sessions = map[string]*TorrentSession{} })
+
+	s := m.DebugState()
+	if !s.Manager || len(s.Torrents) != 2 || s.Goroutines == 0 {
+		t.Fatalf("State %+v", s)
+	}
+	if d := s.Torrents[0]; !d.Responding || d.InfoHash != "aa" || d.Name != "running" || d.Peers != 1 || d.PeerHints != 1 {
+		t.Errorf("Running torrent %+v", d)
+	}
+	if d := s.Torrents[1]; d.Responding || d.InfoHash != "bb" || !d.Paused {
+		t.Errorf("Stuck torrent %+v", d)
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1}, 0)
+	m.stayUp = true
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	server := httptest.NewServer(newRPCHandler(m, "secret"))
+	defer server.Close()
+	get := func(path, token string) (int, string) {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	paths := []string{"/debug/state", "/debug/pprof/", "/debug/pprof/goroutine?debug=1"}
+	for _, path := range paths {
+		if code, _ := get(path, "secret"); code != http.StatusNotFound {
+			t.Errorf("%s while off: %d", path, code)
+		}
+	}
+
+	m.flags.RPCDebug = true
+	for _, path := range paths {
+		if code, _ := get(path, "wrong"); code != http.StatusUnauthorized {
+			t.Errorf("%s without the token: %d", path, code)
+		}
+	}
+	code, body := get("/debug/state", "secret")
+	var s DebugState
+	if err := json.Unmarshal([]byte(body), &s); code != http.StatusOK || err != nil || !s.Manager {
+		t.Errorf("State %d, %v:\n%s", code, err, body)
+	}
+	if code, body := get("/debug/pprof/", "secret"); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("Profiles %d:\n%s", code, body)
+	}
+	if code, body := get("/debug/pprof/goroutine?debug=1", "secret"); code != http.StatusOK || !strings.Contains(body, "TestDebugEndpoints") {
+		t.Errorf("Goroutines %d:\n%s", code, body)
+	}
+}
@@ -0,0 +1,51 @@
+package torrent
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/nictuku/dht"
+)
+
+// IPv6 DHT support. Source:
+// http://bittorrent.org/beps/bep_0032.html
+//
+// We run a second DHT node over IPv6. BEP 32 wants a separate routing
+// table per address family, and two nodes give us that for free. If only
+// one of them starts, we keep it. Our own lookups (see krpc.go) ask for
+// nodes of both families with "want", and keep their closest nodes apart by
+// family. The saved nodes are sampled by family too (see dhtNodes.go).
+
+// Bootstrap nodes that are reachable over IPv6.
+var DHT_IPV6_BOOTSTRAP_NODES = []string{
+	"dht.transmissionbt.com:6881",
+	"dht.libtorrent.org:25401",
+}
+
+// Decodes a compact peer address from the DHT: 6 bytes for IPv4, 18 for IPv6.
+func decodeDHTPeer(peer string) string {
+	if len(peer) == 18 {
+		ip := net.IP(peer[0:16])
+		port := int(peer[16])<<8 | int(peer[17])
+		return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+	return dht.DecodePeerAddress(peer)
+}
+
+// Whether a host:port address is an IPv6 one.
+func isIPv6Addr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// The address family of a host:port address, as BEP 32's "want" names it.
+func dhtFamily(addr string) string {
+	if isIPv6Addr(addr) {
+		return "n6"
+	}
+	return "n4"
+}
@@ -0,0 +1,84 @@
+package torrent
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDecodeDHTPeer(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"\x01\x02\x03\x04\x1a\xe1", "1.2.3.4:6881"},
+		{"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1", "[2001:db8::1]:6881"},
+	} {
+		if got := decodeDHTPeer(tt.in); got != tt.want {
+			t.Errorf("decodeDHTPeer(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIsIPv6Addr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"1.2.3.4:6881":          false,
+		"[2001:db8::1]:6881":    true,
+		"[::ffff:1.2.3.4]:6881": false,
+		"example.com:6881":      false,
+		"garbage":               false,
+	} {
+		if got := isIPv6Addr(addr); got != want {
+			t.Errorf("isIPv6Addr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// Our lookups ask for nodes of both families, and follow the IPv6 nodes an
+// IPv4 node names, unless we're only in the IPv4 DHT.
+func TestLookupFamilies(t *testing.T) {
+	if conn, err := net.ListenPacket("udp", "[::1]:0"); err != nil {
+		t.Skip("No IPv6:", err)
+	} else {
+		conn.Close()
+	}
+	ih := strings.Repeat("\xff", 20)
+	peer6 := "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01\x1a\xe1" // [2001:db8::1]:6881
+	id6 := bep42NodeID(net.ParseIP("::1"), rand.New(rand.NewSource(1)))
+	var asked6 int32
+	node6 := newFakeDHTNodeOn(t, "[::1]:0", func(string, map[string]interface{}) map[string]interface{} {
+		atomic.AddInt32(&asked6, 1)
+		return map[string]interface{}{"id": id6, "values": []interface{}{peer6}}
+	})
+	defer node6.Close()
+	wants := make(chan interface{}, 2)
+	node4 := newFakeDHTNode(t, func(q string, args map[string]interface{}) map[string]interface{} {
+		wants <- args["want"]
+		_, port, _ := net.SplitHostPort(node6.Addr())
+		p, _ := strconv.Atoi(port)
+		return map[string]interface{}{"id": strings.Repeat("\x01", 20),
+			"nodes6": id6 + string(net.ParseIP("::1")) + string([]byte{byte(p >> 8), byte(p)})}
+	})
+	defer node4.Close()
+
+	c, err := newKRPCClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.families = []string{"n4", "n6"}
+	res := c.lookup(ih, []string{node4.Addr()}, false, newDHTNodeTable(""))
+	if want := <-wants; !reflect.DeepEqual(want, []interface{}{"n4", "n6"}) {
+		t.Errorf("Asked for %v", want)
+	}
+	if res.answered != 2 || len(res.peers) != 1 || res.peers[0] != peer6 {
+		t.Errorf("%d answered, with peers %q", res.answered, res.peers)
+	}
+
+	c.families = nil
+	res = c.lookup(ih, []string{node4.Addr(), node6.Addr()}, false, newDHTNodeTable(""))
+	if want := <-wants; want != nil || res.answered != 1 || atomic.LoadInt32(&asked6) != 1 {
+		t.Errorf("Asked for %v, asked the IPv6 node %d times", want, asked6)
+	}
+}
@@ -0,0 +1,206 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DHT bootstrapping and health reporting.
+
+const (
+	// How long we wait for a bootstrap node's name to resolve.
+	dhtBootstrapTimeout = 10 * time.Second
+	// How often the DHT health summary is logged.
+	dhtHealthLogPeriod = time.Minute
+	// If the DHT hasn't answered a query for this long, it's broken.
+	dhtBrokenAfter = 5 * time.Minute
+)
+
+// resolveBootstrapNodes resolves the host:port bootstrap nodes to addresses
+// of the given family (IPv6 if ipv6 is set) in parallel, giving each at most
+// timeout. It returns the addresses that resolved, and an error for each
+// node that didn't.
+func resolveBootstrapNodes(nodes []string, ipv6 bool, timeout time.Duration) (addrs []string, errs []error) {
+	type result struct {
+		addrs []string
+		err   error
+	}
+	results := make(chan result, len(nodes))
+	pending := 0
+	for _, node := range nodes {
+		if node == "" {
+			continue
+		}
+		pending++
+		go func(node string) {
+			a, err := resolveBootstrapNode(node, ipv6)
+			results <- result{a, err}
+		}(node)
+	}
+	deadline := time.After(timeout)
+	for ; pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				errs = append(errs, r.err)
+			} else {
+				addrs = append(addrs, r.addrs...)
+			}
+		case <-deadline:
+			errs = append(errs, fmt.Errorf("%d DHT bootstrap nodes timed out", pending))
+			return
+		}
+	}
+	return
+}
+
+func resolveBootstrapNode(node string, ipv6 bool) (addrs []string, err error) {
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return
+	}
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && (parsed.To4() == nil) == ipv6 {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	if len(addrs) == 0 {
+		family := "IPv4"
+		if ipv6 {
+			family = "IPv6"
+		}
+		err = fmt.Errorf("DHT bootstrap node %v has no %s address", node, family)
+	}
+	return
+}
+
+// DHTHealth summarizes the state of our DHT node.
+type DHTHealth struct {
+	KnownNodes     int       // Nodes we have heard from, including saved ones.
+	BootstrapNodes int       // Bootstrap node addresses that resolved.
+	Bootstrapped   bool      // Whether any DHT query has succeeded.
+	LastSuccess    time.Time // When a DHT query last succeeded.
+	Broken         bool      // Whether we seem to be cut off from the DHT.
+	ReadOnly       bool      // Whether we only look things up (BEP 43), so fewer nodes know us.
+
+	PeerRequests int // get_peers lookups we started, over all torrents.
+	Responses    int // Batches of peers the DHT gave back.
+	PeersFound   int // Peers in those batches.
+	Deferred     int // Peer requests held back by the DHT limits, to be made later.
+	Expired      int // Peer requests that found no peers in DHT_LOOKUP_TIMEOUT.
+
+	// Our KRPC client's traffic (see krpc.go). The DHT library doesn't
+	// count its own.
+	Queries   int   // Queries sent.
+	Replies   int   // Responses to them, errors among them.
+	Errors    int   // Error responses, and ones we couldn't use.
+	Timeouts  int   // Queries that went unanswered.
+	BytesSent int64 // In queries.
+	BytesRead int64 // In everything that reached us.
+}
+
+func (h DHTHealth) String() string {
+	state := "ok"
+	if h.Broken {
+		state = "broken"
+	} else if !h.Bootstrapped {
+		state = "bootstrapping"
+	}
+	if h.ReadOnly {
+		state += ", read-only"
+	}
+	last := "never"
+	if !h.LastSuccess.IsZero() {
+		last = time.Since(h.LastSuccess).Truncate(time.Second).String() + " ago"
+	}
+	return fmt.Sprintf("DHT: %s (known nodes: %d, bootstrap nodes: %d, last successful query: %s, "+
+		"queries: %d, %d bytes, replies: %d, errors: %d, timeouts: %d, %d bytes received, "+
+		"peer requests: %d, responses: %d, peers found: %d, deferred: %d, expired: %d)",
+		state, h.KnownNodes, h.BootstrapNodes, last,
+		h.Queries, h.BytesSent, h.Replies, h.Errors, h.Timeouts, h.BytesRead,
+		h.PeerRequests, h.Responses, h.PeersFound, h.Deferred, h.Expired)
+}
+
+// dhtHealthMonitor keeps track of what DHTHealth reports.
+// Multiple goroutines may use a dhtHealthMonitor at the same time.
+type dhtHealthMonitor struct {
+	mu             sync.Mutex
+	started        time.Time
+	bootstrapNodes int
+	lastSuccess    time.Time
+	nodes          *dhtNodeTable
+	krpc           *krpcClient // nil if we have none
+	limits         *dhtLimiter // nil if we have none
+	readOnly       bool
+	peerRequests   int
+	responses      int
+	peersFound     int
+	deferred       int
+}
+
+func newDHTHealthMonitor(nodes *dhtNodeTable, bootstrapNodes int) *dhtHealthMonitor {
+	return &dhtHealthMonitor{
+		started:        time.Now(),
+		bootstrapNodes: bootstrapNodes,
+		nodes:          nodes,
+	}
+}
+
+// Success records that a DHT query got an answer with peers in it.
+func (m *dhtHealthMonitor) Success(now time.Time, peers int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSuccess = now
+	m.responses++
+	m.peersFound += peers
+}
+
+// Request records that we asked the DHT for peers.
+func (m *dhtHealthMonitor) Request() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peerRequests++
+}
+
+// Deferred records that a peer request was over the DHT limits.
+func (m *dhtHealthMonitor) Deferred() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferred++
+}
+
+func (m *dhtHealthMonitor) Health(now time.Time) (h DHTHealth) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h.BootstrapNodes = m.bootstrapNodes
+	h.ReadOnly = m.readOnly
+	h.PeerRequests = m.peerRequests
+	h.Responses = m.responses
+	h.PeersFound = m.peersFound
+	h.Deferred = m.deferred
+	h.LastSuccess = m.lastSuccess
+	h.Bootstrapped = !m.lastSuccess.IsZero()
+	last := m.lastSuccess
+	if last.IsZero() {
+		last = m.started
+	}
+	h.Broken = now.Sub(last) > dhtBrokenAfter
+	if m.nodes != nil {
+		h.KnownNodes = m.nodes.Len()
+	}
+	if m.limits != nil {
+		h.Expired = m.limits.Expired()
+	}
+	if m.krpc != nil {
+		s := m.krpc.Stats()
+		h.Queries, h.Replies, h.Errors, h.Timeouts = s.Queries, s.Replies, s.Errors, s.Timeouts
+		h.BytesSent, h.BytesRead = s.BytesSent, s.BytesRead
+	}
+	return
+}
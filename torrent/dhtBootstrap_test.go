@@ -0,0 +1,67 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolveBootstrapNodes(t *testing.T) {
+	nodes := []string{"127.0.0.1:6881", "", "no-port", "[::1]:6881"}
+	addrs, errs := resolveBootstrapNodes(nodes, false, time.Second)
+	if want := []string{"127.0.0.1:6881"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("addrs = %v, want %v", addrs, want)
+	}
+	if len(errs) != 2 {
+		t.Errorf("errs = %v, want 2 errors", errs)
+	}
+	addrs, errs = resolveBootstrapNodes(nodes, true, time.Second)
+	if want := []string{"[::1]:6881"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("IPv6 addrs = %v, want %v", addrs, want)
+	}
+	if len(errs) != 2 {
+		t.Errorf("IPv6 errs = %v, want 2 errors", errs)
+	}
+}
+
+func TestDHTHealth(t *testing.T) {
+	nodes := newDHTNodeTable("")
+	nodes.Seen("10.0.0.1:6881", "01234567890123456789")
+	m := newDHTHealthMonitor(nodes, 3)
+	now := m.started
+
+	h := m.Health(now)
+	if h.Bootstrapped || h.Broken || h.KnownNodes != 1 || h.BootstrapNodes != 3 {
+		t.Errorf("Health at start = %+v", h)
+	}
+	if h = m.Health(now.Add(dhtBrokenAfter + time.Second)); !h.Broken {
+		t.Errorf("Health without answers = %+v, want broken", h)
+	}
+
+	m.Request()
+	m.Success(now.Add(time.Minute), 5)
+	h = m.Health(now.Add(2 * time.Minute))
+	if !h.Bootstrapped || h.Broken || h.PeerRequests != 1 || h.Responses != 1 || h.PeersFound != 5 {
+		t.Errorf("Health after an answer = %+v, want bootstrapped", h)
+	}
+	if h = m.Health(now.Add(time.Minute + dhtBrokenAfter + time.Second)); !h.Broken {
+		t.Errorf("Health long after the last answer = %+v, want broken", h)
+	}
+}
+
+func TestDHTHealthString(t *testing.T) {
+	h := DHTHealth{KnownNodes: 4, BootstrapNodes: 2}
+	want := "DHT: bootstrapping (known nodes: 4, bootstrap nodes: 2, last successful query: never, " +
+		"queries: 0, 0 bytes, replies: 0, errors: 0, timeouts: 0, 0 bytes received, " +
+		"peer requests: 0, responses: 0, peers found: 0, deferred: 0, expired: 0)"
+	if got := h.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	h.ReadOnly = true
+	want = "DHT: bootstrapping, read-only (known nodes: 4, bootstrap nodes: 2, last successful query: never, " +
+		"queries: 0, 0 bytes, replies: 0, errors: 0, timeouts: 0, 0 bytes received, " +
+		"peer requests: 0, responses: 0, peers found: 0, deferred: 0, expired: 0)"
+	if got := h.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+package torrent
+
+import (
+	"sync"
+	"time"
+)
+
+// Bounds on how much DHT traffic we generate.
+
+const (
+	DHT_DEFAULT_MAX_REQUESTS_PER_SECOND = 10
+	DHT_DEFAULT_MAX_OUTSTANDING         = 32
+	// A lookup's finished when its first peers come back, or after this.
+	DHT_LOOKUP_TIMEOUT = 30 * time.Second
+	// How often deferred peer requests are tried again.
+	DHT_RETRY_PERIOD = time.Second
+)
+
+// A token bucket. Tokens accumulate at rate per second, up to burst.
+// Multiple goroutines may use a tokenBucket at the same time.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// Take reports whether a token was available at time now, and uses it if so.
+func (b *tokenBucket) Take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Limits on the peer requests we make to the DHT. A request that's over
+// them is held back, and made once it isn't, in the order they came.
+type dhtLimiter struct {
+	requests *tokenBucket
+	max      int
+
+	mu          sync.Mutex
+	outstanding map[string]time.Time // Info-hashes being looked up -> when we started
+	waiting     []dhtRequest
+	expired     int // Lookups that ran out of time without finding peers
+}
+
+type dhtRequest struct {
+	ih       string
+	announce bool
+}
+
+// newDHTLimiter allows up to perSecond requests per second, with at most
+// outstanding of them in progress at once. Zero values mean the defaults.
+func newDHTLimiter(perSecond float64, outstanding int) *dhtLimiter {
+	if perSecond <= 0 {
+		perSecond = DHT_DEFAULT_MAX_REQUESTS_PER_SECOND
+	}
+	if outstanding <= 0 {
+		outstanding = DHT_DEFAULT_MAX_OUTSTANDING
+	}
+	return &dhtLimiter{
+		requests:    newTokenBucket(perSecond, 2*perSecond),
+		max:         outstanding,
+		outstanding: make(map[string]time.Time),
+	}
+}
+
+// Start reports whether a peer request for ih may be made now. If it may,
+// the caller must make it. If a lookup of ih is already in progress, it
+// isn't needed. Otherwise it's deferred, and Retry hands it back later.
+func (l *dhtLimiter) Start(ih string, announce bool, now time.Time) (start, deferred bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(now)
+	if _, ok := l.outstanding[ih]; ok {
+		return false, false
+	}
+	for i, r := range l.waiting {
+		if r.ih == ih {
+			l.waiting[i].announce = r.announce || announce
+			return false, false
+		}
+	}
+	if len(l.waiting) > 0 || !l.take(ih, now) {
+		l.waiting = append(l.waiting, dhtRequest{ih, announce})
+		return false, true
+	}
+	return true, false
+}
+
+// Done records that the lookup of ih has finished, freeing its place.
+func (l *dhtLimiter) Done(ih string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.outstanding, ih)
+}
+
+// Retry returns the deferred requests that may be made now. The caller must
+// make them.
+func (l *dhtLimiter) Retry(now time.Time) (requests []dhtRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(now)
+	for len(l.waiting) > 0 && l.take(l.waiting[0].ih, now) {
+		requests = append(requests, l.waiting[0])
+		l.waiting = l.waiting[1:]
+	}
+	return
+}
+
+// Takes a place for a lookup of ih, and then a token, if both are free.
+func (l *dhtLimiter) take(ih string, now time.Time) bool {
+	if len(l.outstanding) >= l.max || !l.requests.Take(now) {
+		return false
+	}
+	l.outstanding[ih] = now
+	return true
+}
+
+// The library doesn't say when a lookup that finds nothing is over, so
+// they're taken to be after DHT_LOOKUP_TIMEOUT.
+func (l *dhtLimiter) expire(now time.Time) {
+	for ih, started := range l.outstanding {
+		if now.Sub(started) >= DHT_LOOKUP_TIMEOUT {
+			delete(l.outstanding, ih)
+			l.expired++
+		}
+	}
+}
+
+// Expired returns how many lookups have run out of time without finding
+// any peers.
+func (l *dhtLimiter) Expired() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.expired
+}
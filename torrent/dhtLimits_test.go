@@ -0,0 +1,87 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 4)
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if !b.Take(now) {
+			t.Fatalf("Take %d of the initial burst failed", i)
+		}
+	}
+	if b.Take(now) {
+		t.Error("Take succeeded with an empty bucket")
+	}
+	now = now.Add(time.Second)
+	if !b.Take(now) || !b.Take(now) {
+		t.Error("Tokens should refill at the given rate")
+	}
+	if b.Take(now) {
+		t.Error("Take succeeded beyond the refill rate")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		b.Take(now)
+	}
+	if b.Take(now) {
+		t.Error("The bucket should not fill beyond its burst")
+	}
+}
+
+func TestDHTLimiterOutstanding(t *testing.T) {
+	l := newDHTLimiter(1000, 2)
+	now := time.Now()
+	if start, _ := l.Start("a", true, now); !start {
+		t.Fatal("The first request should be allowed")
+	}
+	if start, deferred := l.Start("a", true, now); start || deferred {
+		t.Error("A request for a lookup in progress should be neither made nor deferred")
+	}
+	if start, _ := l.Start("b", true, now); !start {
+		t.Fatal("The second request should be allowed")
+	}
+	if start, deferred := l.Start("c", false, now); start || !deferred {
+		t.Error("A third outstanding request should be deferred")
+	}
+	l.Start("c", true, now)
+	if requests := l.Retry(now); len(requests) != 0 {
+		t.Errorf("Retried %v with no room", requests)
+	}
+	l.Done("a")
+	if requests := l.Retry(now); !reflect.DeepEqual(requests, []dhtRequest{{"c", true}}) {
+		t.Errorf("Retried %v once a lookup was done", requests)
+	}
+	// Lookups that never say they're done time out.
+	if start, deferred := l.Start("d", true, now); start || !deferred {
+		t.Error("A request over the limit should be deferred")
+	}
+	if requests := l.Retry(now.Add(DHT_LOOKUP_TIMEOUT)); !reflect.DeepEqual(requests, []dhtRequest{{"d", true}}) {
+		t.Errorf("Retried %v once the lookups timed out", requests)
+	}
+}
+
+// A request that's deferred because too many are outstanding doesn't use up
+// a token.
+func TestDHTLimiterTokens(t *testing.T) {
+	l := newDHTLimiter(1, 1)
+	now := time.Now()
+	l.Start("a", true, now)
+	for i := 0; i < 5; i++ {
+		l.Start("b", true, now)
+		l.Retry(now)
+	}
+	l.Done("a")
+	// The burst is 2 tokens, and "a" had one of them.
+	if requests := l.Retry(now); len(requests) != 1 {
+		t.Errorf("Retried %v", requests)
+	}
+	l.Done("b")
+	if start, deferred := l.Start("c", true, now); start || !deferred {
+		t.Error("Made a request with no tokens left")
+	}
+}
@@ -0,0 +1,197 @@
+package torrent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Persistence of the DHT nodes we know about, so that a restarted client
+// doesn't have to wait minutes for the DHT to become useful again. Only
+// nodes that have answered a ping of ours are recorded, with the ID they
+// answered with: a peer's PORT message just tells us where to ping. Nodes
+// whose IDs BEP 42 allows for their addresses are saved and tried first.
+
+const (
+	dhtNodesFileName    = "dht-nodes.json"
+	dhtNodesFileVersion = 2 // Version 1 had no IDs
+	// How many nodes we keep on disk.
+	maxSavedDHTNodes = 256
+	// How many of the loaded nodes we ping at startup.
+	dhtNodesPingSample = 32
+	// How often the node table is written to disk while running.
+	dhtNodesSavePeriod = 5 * time.Minute
+	// A node that answered us this recently isn't pinged again before it's
+	// passed to the DHT.
+	dhtNodeFresh = 15 * time.Minute
+)
+
+type dhtNodeRecord struct {
+	ID       []byte // Empty for nodes saved by version 1
+	Addr     string
+	LastSeen time.Time
+}
+
+// Whether n's ID is one BEP 42 allows for its address. Nodes without IDs
+// aren't.
+func (n *dhtNodeRecord) valid() bool {
+	return len(n.ID) == 20 && bep42ValidNode(n.Addr, string(n.ID))
+}
+
+type dhtNodesFile struct {
+	Version int
+	Nodes   []dhtNodeRecord
+}
+
+// dhtNodeTable remembers the addresses of DHT nodes we have heard from.
+// Multiple goroutines may use a dhtNodeTable at the same time.
+type dhtNodeTable struct {
+	mu    sync.Mutex
+	path  string
+	nodes map[string]dhtNodeRecord
+}
+
+func newDHTNodeTable(dataDir string) *dhtNodeTable {
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return &dhtNodeTable{
+		path:  filepath.Join(dataDir, dhtNodesFileName),
+		nodes: make(map[string]dhtNodeRecord),
+	}
+}
+
+// Seen records that the DHT node at addr answered us, with its ID.
+func (t *dhtNodeTable) Seen(addr, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes[addr] = dhtNodeRecord{[]byte(id), addr, time.Now()}
+}
+
+// fresh reports whether the node at addr answered us within dhtNodeFresh.
+func (t *dhtNodeTable) fresh(addr string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.nodes[addr]
+	return ok && now.Sub(n.LastSeen) < dhtNodeFresh
+}
+
+// Valid reports whether the node at addr answered us with an ID BEP 42
+// allows for its address.
+func (t *dhtNodeTable) Valid(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.nodes[addr]
+	return ok && n.valid()
+}
+
+func (t *dhtNodeTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.nodes)
+}
+
+// Load reads the node table from disk. A missing, corrupt or
+// version-mismatched file leaves the table empty and returns an error
+// describing why, so the caller can fall back to a normal bootstrap.
+func (t *dhtNodeTable) Load() (err error) {
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return
+	}
+	var f dhtNodesFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return fmt.Errorf("Corrupt DHT node file %v: %v", t.path, err)
+	}
+	if f.Version != dhtNodesFileVersion && f.Version != 1 {
+		return fmt.Errorf("DHT node file %v has version %d, expected %d", t.path, f.Version, dhtNodesFileVersion)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, n := range f.Nodes {
+		if n.Addr == "" {
+			continue
+		}
+		if last, ok := t.nodes[n.Addr]; !ok || last.LastSeen.Before(n.LastSeen) {
+			t.nodes[n.Addr] = n
+		}
+	}
+	return
+}
+
+// Save writes the best ranked nodes to disk. The file is written to a
+// temporary name first so that a crash never leaves a truncated table behind.
+func (t *dhtNodeTable) Save() (err error) {
+	f := dhtNodesFile{Version: dhtNodesFileVersion, Nodes: t.recent(maxSavedDHTNodes)}
+	data, err := json.Marshal(&f)
+	if err != nil {
+		return
+	}
+	tmp := t.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, t.path)
+	return
+}
+
+// Sample returns the addresses of up to n of the best ranked nodes of each
+// address family. BEP 32 keeps the families apart, so a lookup in one only
+// starts from its own.
+func (t *dhtNodeTable) Sample(n int) (addrs []string) {
+	taken := make(map[bool]int) // By whether they're IPv6
+	for _, r := range t.recent(t.Len()) {
+		if ipv6 := isIPv6Addr(r.Addr); taken[ipv6] < n {
+			taken[ipv6]++
+			addrs = append(addrs, r.Addr)
+		}
+	}
+	return
+}
+
+func (t *dhtNodeTable) recent(n int) (records []dhtNodeRecord) {
+	t.mu.Lock()
+	records = make([]dhtNodeRecord, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		records = append(records, n)
+	}
+	t.mu.Unlock()
+	sort.Sort(byRank(records))
+	if len(records) > n {
+		records = records[:n]
+	}
+	return
+}
+
+// Nodes with valid IDs first, then the most recently seen.
+type byRank []dhtNodeRecord
+
+func (a byRank) Len() int      { return len(a) }
+func (a byRank) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRank) Less(i, j int) bool {
+	if vi, vj := a[i].valid(), a[j].valid(); vi != vj {
+		return vi
+	}
+	return a[i].LastSeen.After(a[j].LastSeen)
+}
+
+// verifyDHTNode pings the node at addr, unless it answered us recently, and
+// records it if it answers. It reports whether it's there.
+func verifyDHTNode(krpc *krpcClient, nodes *dhtNodeTable, addr string) bool {
+	if nodes.fresh(addr, time.Now()) {
+		return true
+	}
+	id, err := krpc.ping(addr)
+	if err != nil {
+		return false
+	}
+	nodes.Seen(addr, id)
+	return true
+}
@@ -0,0 +1,125 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDHTNodeTableSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhtnodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	table := newDHTNodeTable(dir)
+	now := time.Now()
+	for _, n := range []dhtNodeRecord{
+		{[]byte("id1"), "10.0.0.1:6881", now.Add(-2 * time.Hour)},
+		{[]byte("id2"), "10.0.0.2:6881", now},
+		{[]byte("id3"), "10.0.0.3:6881", now.Add(-time.Hour)},
+	} {
+		table.nodes[n.Addr] = n
+	}
+	err = table.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newDHTNodeTable(dir)
+	err = loaded.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.2:6881", "10.0.0.3:6881", "10.0.0.1:6881"}
+	if got := loaded.Sample(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sample(10) = %v, want %v", got, want)
+	}
+	if got := loaded.Sample(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("Sample(1) = %v, want %v", got, want[:1])
+	}
+	if id := string(loaded.nodes["10.0.0.3:6881"].ID); id != "id3" {
+		t.Errorf("Loaded ID %q", id)
+	}
+
+	// Version 1 files, without IDs, are still read.
+	err = ioutil.WriteFile(filepath.Join(dir, dhtNodesFileName), []byte(`{"Version":1,"Nodes":[{"Addr":"10.0.0.4:6881"}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded = newDHTNodeTable(dir); loaded.Load() != nil || !reflect.DeepEqual(loaded.Sample(10), []string{"10.0.0.4:6881"}) {
+		t.Errorf("Loaded version 1 as %v", loaded.Sample(10))
+	}
+}
+
+func TestDHTNodeTableBadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhtnodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	table := newDHTNodeTable(dir)
+	if err = table.Load(); !os.IsNotExist(err) {
+		t.Errorf("Load() of missing file = %v, want not-exist error", err)
+	}
+
+	for _, contents := range []string{
+		"",
+		"not json",
+		`{"Version":99,"Nodes":[{"Addr":"10.0.0.1:6881"}]}`,
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, dhtNodesFileName), []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table = newDHTNodeTable(dir)
+		if err = table.Load(); err == nil {
+			t.Errorf("Load() of %q succeeded, want error", contents)
+		}
+		if table.Len() != 0 {
+			t.Errorf("Load() of %q left %d nodes in the table", contents, table.Len())
+		}
+	}
+}
+
+// Nodes whose IDs BEP 42 allows for their addresses come first, however long
+// ago they were seen.
+func TestDHTNodeTableRank(t *testing.T) {
+	ip := net.ParseIP("203.0.113.7")
+	table := newDHTNodeTable("")
+	table.Seen("203.0.113.8:6881", "not the right id....")
+	table.Seen("203.0.113.7:6881", bep42NodeID(ip, rand.New(rand.NewSource(1))))
+	table.Seen("203.0.113.9:6881", "not the right id....")
+	n := table.nodes["203.0.113.7:6881"]
+	n.LastSeen = n.LastSeen.Add(-time.Hour)
+	table.nodes[n.Addr] = n
+	if got := table.Sample(2); !reflect.DeepEqual(got, []string{"203.0.113.7:6881", "203.0.113.9:6881"}) {
+		t.Errorf("Sampled %v", got)
+	}
+}
+
+// Each address family's nodes are sampled on their own.
+func TestDHTNodeTableSampleFamilies(t *testing.T) {
+	table := newDHTNodeTable("")
+	for _, addr := range []string{"203.0.113.7:6881", "203.0.113.8:6881", "[2001:db8::1]:6881", "[2001:db8::2]:6881"} {
+		table.Seen(addr, "not the right id....")
+	}
+	v4, v6 := 0, 0
+	for _, addr := range table.Sample(1) {
+		if isIPv6Addr(addr) {
+			v6++
+		} else {
+			v4++
+		}
+	}
+	if v4 != 1 || v6 != 1 {
+		t.Errorf("Sampled %d IPv4 nodes and %d IPv6 ones", v4, v6)
+	}
+}
@@ -0,0 +1,39 @@
+package torrent
+
+import (
+	"github.com/nictuku/dht"
+)
+
+// DHT read-only mode. Source:
+// http://bittorrent.org/beps/bep_0043.html
+//
+// With TorrentFlags.DHTReadOnly we don't run the DHT library's nodes, which
+// would answer queries and store peers for others. Our KRPC client (see
+// krpc.go) makes all our queries instead: it marks them "ro":1, so the nodes
+// it asks leave it out of their routing tables, and ignores the queries sent
+// to it. Each peer request is a lookup of its own, and an announcing one
+// then announces us to the closest nodes that answered. Our handshakes don't
+// set the DHT bit either.
+//
+// The nodes we know are the saved ones, the bootstrap nodes and the ones
+// that answer our lookups, without a routing table kept up between them, so
+// there are fewer than a full node would know. The DHT health line says
+// we're read-only, so that's no surprise.
+
+// lookup looks ih up for a peer request, announcing us if announce is set,
+// and sends the peers it finds to the manager's loop.
+func (d monitoredDHT) lookup(ih string, announce bool) {
+	start := append(d.nodes.Sample(dhtLookupStartNodes), d.routers...)
+	res := d.krpc.lookup(ih, start, false, d.nodes)
+	if res.answered == 0 {
+		d.limits.Done(ih)
+		return
+	}
+	if announce {
+		d.krpc.announce(ih, res.closest)
+	}
+	select {
+	case d.results <- map[dht.InfoHash][]string{dht.InfoHash(ih): res.peers}:
+	case <-d.quit:
+	}
+}
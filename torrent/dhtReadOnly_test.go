@@ -0,0 +1,68 @@
+package torrent
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nictuku/dht"
+)
+
+// A read-only peer request looks the info-hash up with our own queries, all
+// marked "ro", hands the peers to the manager and announces us to the nodes
+// that gave tokens.
+func TestReadOnlyLookup(t *testing.T) {
+	ih := strings.Repeat("\xff", 20)
+	peer := "\x01\x02\x03\x04\x1a\xe1" // 1.2.3.4:6881
+	var announced int32
+	near := newFakeDHTNode(t, func(q string, args map[string]interface{}) map[string]interface{} {
+		r := map[string]interface{}{"id": strings.Repeat("\xfe", 20)}
+		switch q {
+		case "get_peers":
+			r["token"], r["values"] = "near", []interface{}{peer}
+		case "announce_peer":
+			if args["info_hash"] != ih || args["token"] != "near" || args["port"] != int64(6881) {
+				t.Errorf("Announced %v", args)
+			}
+			atomic.AddInt32(&announced, 1)
+		default:
+			t.Errorf("Asked %q %v", q, args)
+		}
+		return r
+	})
+	defer near.Close()
+	far := newFakeDHTNode(t, func(q string, args map[string]interface{}) map[string]interface{} {
+		if q != "get_peers" {
+			t.Errorf("Asked the far node %q %v", q, args)
+		}
+		return map[string]interface{}{"id": strings.Repeat("\x01", 20), "nodes": compactNode(strings.Repeat("\xfe", 20), near.Addr())}
+	})
+	defer far.Close()
+
+	c := newTestKRPCClient(t)
+	defer c.Close()
+	c.setPort(6881)
+	nodes := newDHTNodeTable("")
+	results := make(chan map[dht.InfoHash][]string)
+	d := monitoredDHT{health: newDHTHealthMonitor(nodes, 1), limits: newDHTLimiter(0, 0), nodes: nodes, krpc: c,
+		routers: []string{far.Addr()}, results: results, quit: make(chan struct{})}
+	d.PeersRequest(ih, true)
+	select {
+	case r := <-results:
+		if peers := r[dht.InfoHash(ih)]; len(peers) != 1 || peers[0] != peer {
+			t.Errorf("Found %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No results")
+	}
+	if atomic.LoadInt32(&announced) != 1 {
+		t.Errorf("Announced to the near node %d times", announced)
+	}
+	if atomic.LoadInt32(&near.notRO)+atomic.LoadInt32(&far.notRO) != 0 {
+		t.Error("Sent queries without \"ro\"")
+	}
+	if nodes.Len() != 2 {
+		t.Errorf("Saved %d nodes", nodes.Len())
+	}
+}
@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// A cap on the disk space all the torrents take together, MaxDiskUsage, for
+// boxes shared with other things. A torrent's files may grow to its size, so
+// that much is committed to it from the start, however little is written
+// yet, and a torrent that would take the committed space over the cap isn't
+// started. What the files take now is measured every DISK_USAGE_CHECK, by the
+// blocks they use where the file system says, so preallocated sparse files
+// count for what's been written to them. A disk cache counts for all it may
+// take. If the files end up over the cap anyway, or the disk fills up with
+// other things, the downloads are paused until there's room again.
+
+const DISK_USAGE_CHECK = time.Minute
+
+// Downloads are paused when the disk has less than this free.
+const DISK_FREE_MIN = 64 * 1024 * 1024
+
+var diskFreeMin int64 = DISK_FREE_MIN // Changed by tests
+
+// DiskUsage is how the torrents' disk use stands against the cap. It's all
+// zero without one.
+type DiskUsage struct {
+	Cap       int64 // MaxDiskUsage, in bytes
+	Used      int64 // What the torrents' files take now, and the disk cache
+	Committed int64 // What they'd take once complete
+	Headroom  int64 // How big a torrent the cap has room for
+	Free      int64 // On the disk FileDir is on, or -1 if there's no telling
+	Full      bool  // The downloads are paused for want of room
+}
+
+// A CacheProvider that keeps its caches on disk.
+type diskCacher interface {
+	diskSpace() int64 // The most they take
+}
+
+// The most space the torrent's files take once complete.
+func infoSize(info *InfoDict) (size int64) {
+	if len(info.Files) == 0 {
+		return info.Length
+	}
+	for _, f := range info.Files {
+		size += f.Length
+	}
+	return
+}
+
+// How much space the files under path take. Missing files take none.
+func filesDiskUsage(path string) (used int64) {
+	filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			used += fileDiskUsage(fi)
+		}
+		return nil
+	})
+	return
+}
+
+// Measures the torrents' disk use. Called outside the manager's loop, since
+// it asks each torrent for its status, and looks at all their files.
+func (m *sessionManager) measureDisk() (u DiskUsage, err error) {
+	torrents, err := m.Torrents()
+	if err != nil {
+		return
+	}
+	u.Cap = m.flags.MaxDiskUsage
+	for _, cacher := range m.cachers() {
+		if c, ok := cacher.(diskCacher); ok {
+			u.Used += c.diskSpace()
+			u.Committed += c.diskSpace()
+		}
+	}
+	for _, ts := range torrents {
+		_, onOS := ts.storage.fs.(OsFsProvider)
+		status, e := ts.Status()
+		if e != nil {
+			continue
+		}
+		used := int64(status.Completed)
+		if path, ok := ts.content.Load().(string); ok && onOS {
+			used = filesDiskUsage(path)
+		}
+		u.Used += used
+		if used > status.Size {
+			u.Committed += used
+		} else {
+			u.Committed += status.Size
+		}
+	}
+	if u.Headroom = u.Cap - u.Committed; u.Headroom < 0 {
+		u.Headroom = 0
+	}
+	u.Free = freeDiskSpace(m.flags.FileDir)
+	return
+}
+
+// Refuses a torrent the cap doesn't have room for. Called while its session
+// is being created.
+func (m *sessionManager) checkDiskRoom(meta *MetaInfo) (err error) {
+	size := infoSize(meta.storeInfo())
+	if size == 0 {
+		// A magnet link, which we can't tell the size of yet.
+		return
+	}
+	u, err := m.measureDisk()
+	if err != nil {
+		return
+	}
+	if size > u.Headroom {
+		return fmt.Errorf("It needs %d bytes, and the disk usage cap of %d leaves room for %d", size, u.Cap, u.Headroom)
+	}
+	return
+}
+
+// Measures the disk use, and pauses the downloads if we're out of room, or
+// resumes them once there's room again. Run every DISK_USAGE_CHECK.
+func (m *sessionManager) checkDiskUsage() {
+	u, err := m.measureDisk()
+	if err != nil {
+		return
+	}
+	u.Full = u.Used > u.Cap || (u.Free >= 0 && u.Free < diskFreeMin)
+	m.run(func() {
+		switch {
+		case u.Full && m.diskPaused == nil:
+			log.Printf("Pausing the downloads: the torrents take %d bytes of the %d the disk usage cap allows, and %d are free", u.Used, u.Cap, u.Free)
+			m.diskPaused = make(map[*TorrentSession]bool)
+		case !u.Full && m.diskPaused != nil:
+			log.Println("There's room on the disk again, so resuming the downloads")
+			for ts := range m.diskPaused {
+				atomic.StoreInt32(&ts.diskFull, 0)
+				go ts.Resume()
+			}
+			m.diskPaused = nil
+		}
+		m.diskUsage = u
+		if m.diskPaused != nil {
+			// Including downloads resumed by hand since.
+			for _, ts := range m.sessions {
+				m.diskPause(ts)
+			}
+		}
+	})
+}
+
+func (m *sessionManager) diskPause(ts *TorrentSession) {
+	if !ts.Paused() && !ts.isComplete() {
+		m.diskPaused[ts] = true
+		atomic.StoreInt32(&ts.diskFull, 1)
+		go ts.Pause()
+	}
+}
+
+// Whether the torrent's paused for want of disk space.
+func (ts *TorrentSession) diskPaused() bool {
+	return atomic.LoadInt32(&ts.diskFull) != 0
+}
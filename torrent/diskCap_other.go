@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+
+package torrent
+
+import (
+	"os"
+)
+
+// Files are taken to be as big as they say.
+func fileDiskUsage(fi os.FileInfo) int64 {
+	return fi.Size()
+}
+
+func freeDiskSpace(dir string) int64 {
+	return -1
+}
@@ -0,0 +1,150 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilesDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskCap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("some data"))
+	err = f.Truncate(1 << 24)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := filesDiskUsage(dir)
+	if used < 9 || used > 1<<24 {
+		t.Errorf("Uses %d", used)
+	}
+	if runtime.GOOS == "linux" && used >= 1<<24 {
+		t.Errorf("The sparse file counts for all of its %d bytes", used)
+	}
+	if used = filesDiskUsage(filepath.Join(dir, "missing")); used != 0 {
+		t.Errorf("A missing file uses %d", used)
+	}
+}
+
+func TestDiskCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskCap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeWebSeedFiles(t, filepath.Join(dir, "a"), 20000, 10000)
+	writeWebSeedFiles(t, filepath.Join(dir, "src", "b"), 30000)
+	writeWebSeedFiles(t, filepath.Join(dir, "src", "c"), 20000)
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		TrackerlessMode:    true,
+		SeedRatio:          math.Inf(0),
+		MaxActive:          3,
+		MemoryPerTorrent:   -1,
+		MaxDiskUsage:       70000,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	add := func(path string) string {
+		meta, err := CreateTorrent(path, &CreateOptions{PieceLength: 16384})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data bytes.Buffer
+		if err = meta.Bencode(&data); err != nil {
+			t.Fatal(err)
+		}
+		ih, err := m.AddTorrentFromBytes(data.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ih
+	}
+	status := func(ih string) (s TorrentStatus) {
+		statuses, err := m.Statuses()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s = range statuses {
+			if s.InfoHash == hex.EncodeToString([]byte(ih)) {
+				return
+			}
+		}
+		return TorrentStatus{}
+	}
+	waitFor := func(what string, f func() bool) {
+		for deadline := time.Now().Add(10 * time.Second); !f(); time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for", what)
+			}
+		}
+	}
+
+	// a is complete, and b, with nobody to download it from, never will be.
+	a := add(filepath.Join(dir, "a"))
+	waitForComplete(t, m, a)
+	waitFor("a to seed", func() bool {
+		ts, _, _ := m.Torrent(a)
+		return ts.isComplete()
+	})
+	b := add(filepath.Join(dir, "src", "b"))
+	waitFor("b to start", func() bool { return status(b).HaveTorrent })
+	// There isn't room for c's 20000 bytes.
+	c := add(filepath.Join(dir, "src", "c"))
+	waitFor("c to fail", func() bool { return status(c).Error != "" })
+	if s := status(c); !strings.Contains(s.Error, "disk usage cap") {
+		t.Errorf("c's error is %q", s.Error)
+	}
+
+	// The disk filling up pauses b, but not a.
+	defer func(min int64) { diskFreeMin = min }(diskFreeMin)
+	diskFreeMin = math.MaxInt64
+	m.checkDiskUsage()
+	waitFor("b to pause", func() bool { return status(b).Paused })
+	if s := status(b); s.State() != "error" || !strings.Contains(s.Error, "disk") {
+		t.Errorf("Paused for want of room, b is %s: %q", s.State(), s.Error)
+	}
+	if s := status(a); s.Paused || s.Error != "" {
+		t.Errorf("a was paused: %+v", s)
+	}
+	stats, err := m.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := stats.Disk; !d.Full || d.Cap != 70000 || d.Committed < 60000 || d.Headroom != d.Cap-d.Committed || d.Used < 30000 {
+		t.Errorf("Disk usage %+v", d)
+	}
+
+	diskFreeMin = 0
+	m.checkDiskUsage()
+	waitFor("b to resume", func() bool { return !status(b).Paused })
+	if s := status(b); s.Error != "" {
+		t.Errorf("Resumed, b's error is %q", s.Error)
+	}
+	if stats, _ = m.Stats(); stats.Disk.Full {
+		t.Error("Still full")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd
+
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The blocks the file takes, which is less than its size if it's sparse.
+func fileDiskUsage(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
+
+// The space free for us on the disk dir is on, or the one it'll be made on.
+func freeDiskSpace(dir string) int64 {
+	for {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err == nil {
+			return int64(st.Bavail) * int64(st.Bsize)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return -1
+		}
+		dir = parent
+	}
+}
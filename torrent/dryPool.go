@@ -0,0 +1,125 @@
+package torrent
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// When the peer pool runs dry. A torrent that's still downloading whose peers
+// have all gone, and that has none left to try, would otherwise sit waiting
+// for the trackers' next regular announce, which can be half an hour off.
+// Once it's been that way for DRY_POOL_GRACE it asks again straight away: the
+// trackers, if their min interval's passed, the DHT and LPD. If that doesn't
+// bring a peer it asks again after DRY_POOL_RETRY, twice as long each time up
+// to DRY_POOL_MAX_RETRY, so a swarm that's really dead isn't hammered.
+//
+// The status shows how long it's been dry, what's been tried and what came of
+// it, so a dead swarm can be told from a client that's given up: we never do.
+
+const (
+	DRY_POOL_GRACE     = 30 * time.Second
+	DRY_POOL_RETRY     = time.Minute
+	DRY_POOL_MAX_RETRY = 30 * time.Minute
+)
+
+type dryPool struct {
+	since       time.Time // Zero unless the pool's dry
+	attempts    int
+	lastAttempt time.Time
+	next        time.Time
+	asked       []string
+	tooSoon     bool
+	found       int // Peers tried, when the last attempt was made
+	recoveries  int // Times it found a peer again after trying, this session
+}
+
+// DryPoolStatus is what's being done about a torrent that has no peers and
+// none to try.
+type DryPoolStatus struct {
+	Since       time.Time // When the last peer went, or it started without any
+	Attempts    int       // How many times we've asked for more since
+	LastAttempt time.Time // Zero before the first
+	NextAttempt time.Time
+	// Where the last attempt asked: "trackers", "dht" and "lpd".
+	Asked []string
+	// The trackers weren't asked, as it was within their min interval.
+	TooSoon bool
+	// Peers heard of since the last attempt. None of them could be
+	// connected to, or it wouldn't be dry.
+	PeersFound int
+}
+
+// Whether we want peers, have none and have none left to try.
+func (ts *TorrentSession) poolDry() bool {
+	return !ts.Paused() && !ts.flags.WebSeedOnly && len(ts.peers) == 0 &&
+		atomic.LoadInt32(&ts.dialing) == 0 &&
+		(ts.totalPieces == 0 || ts.goodPieces < ts.totalPieces)
+}
+
+// checkDryPool notices when the pool runs dry, and asks for peers when
+// they're due. It's called every heartbeat, on the main loop.
+func (ts *TorrentSession) checkDryPool(now time.Time) {
+	d := &ts.dryPool
+	if !ts.poolDry() {
+		if !d.since.IsZero() {
+			if d.attempts > 0 && len(ts.peers) > 0 {
+				log.Println("[", ts.M.Info.Name, "] Found peers again, after asking", d.attempts, "times")
+				d.recoveries++
+			}
+			*d = dryPool{recoveries: d.recoveries}
+		}
+		return
+	}
+	if d.since.IsZero() {
+		d.since, d.next = now, now.Add(DRY_POOL_GRACE)
+		return
+	}
+	if now.Before(d.next) {
+		return
+	}
+	d.asked, d.tooSoon = nil, false
+	if !ts.trackerLessMode {
+		if err := ts.announceToEveryTracker(now); err == nil {
+			d.asked = append(d.asked, "trackers")
+		} else {
+			d.tooSoon = true
+		}
+	}
+	if ts.Session.UseDHT {
+		ts.dhtPeersRequest()
+		d.asked = append(d.asked, "dht")
+	}
+	if ts.lpd != nil {
+		go ts.lpd.AnnounceNow(ts.M.InfoHash)
+		d.asked = append(d.asked, "lpd")
+	}
+	retry := DRY_POOL_RETRY << uint(min(d.attempts, 10))
+	if retry > DRY_POOL_MAX_RETRY {
+		retry = DRY_POOL_MAX_RETRY
+	}
+	d.attempts++
+	d.lastAttempt, d.next = now, now.Add(retry)
+	d.found = ts.peersFound.Total()
+	log.Println("[", ts.M.Info.Name, "] Out of peers, asking", d.asked, "for more; next in", retry)
+}
+
+// The dry pool's status, or nil if it isn't dry.
+func (ts *TorrentSession) dryPoolStatus() *DryPoolStatus {
+	d := &ts.dryPool
+	if d.since.IsZero() {
+		return nil
+	}
+	s := &DryPoolStatus{
+		Since:       d.since,
+		Attempts:    d.attempts,
+		LastAttempt: d.lastAttempt,
+		NextAttempt: d.next,
+		Asked:       append([]string(nil), d.asked...),
+		TooSoon:     d.tooSoon,
+	}
+	if d.attempts > 0 {
+		s.PeersFound = ts.peersFound.Total() - d.found
+	}
+	return s
+}
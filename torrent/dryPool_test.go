@@ -0,0 +1,81 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type countingDHT chan string
+
+func (d countingDHT) PeersRequest(ih string, announce bool) { d <- ih }
+func (d countingDHT) AddNode(addr string)                   {}
+
+// A torrent out of peers waits DRY_POOL_GRACE, then asks the DHT, and the
+// trackers once they'll have it, backing off up to DRY_POOL_MAX_RETRY until
+// a peer turns up. Paused, or with peers, it isn't dry.
+func TestDryPool(t *testing.T) {
+	dht := make(countingDHT, 20)
+	now := time.Now()
+	ts := &TorrentSession{M: &MetaInfo{InfoHash: "ih", Info: InfoDict{Name: "dry"}}, flags: &TorrentFlags{},
+		peers: make(map[string]*peerState), dht: dht, totalPieces: 4, lastAnnounce: now.Add(time.Hour)}
+	ts.Session.UseDHT = true
+	asked := func(want int) {
+		t.Helper()
+		for i := 0; i < want; i++ {
+			select {
+			case <-dht:
+			case <-time.After(time.Second):
+				t.Fatalf("Asked the DHT %d times, not %d", i, want)
+			}
+		}
+		select {
+		case <-dht:
+			t.Fatalf("Asked the DHT more than %d times", want)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	ts.checkDryPool(now)
+	if s := ts.dryPoolStatus(); s == nil || !s.Since.Equal(now) || s.Attempts != 0 || !s.NextAttempt.Equal(now.Add(DRY_POOL_GRACE)) {
+		t.Fatalf("Once dry, %+v", s)
+	}
+	ts.checkDryPool(now.Add(DRY_POOL_GRACE - time.Second))
+	asked(0)
+	ts.checkDryPool(now.Add(DRY_POOL_GRACE))
+	asked(1)
+	s := ts.dryPoolStatus()
+	if s.Attempts != 1 || !reflect.DeepEqual(s.Asked, []string{"dht"}) || !s.TooSoon ||
+		!s.NextAttempt.Equal(now.Add(DRY_POOL_GRACE+DRY_POOL_RETRY)) {
+		t.Errorf("After asking, %+v", s)
+	}
+	ts.peersFound[PEER_SOURCE_DHT] += 2
+	if s = ts.dryPoolStatus(); s.PeersFound != 2 {
+		t.Errorf("Found %d peers", s.PeersFound)
+	}
+
+	// Backing off.
+	at := now.Add(DRY_POOL_GRACE)
+	for retry := DRY_POOL_RETRY; retry <= DRY_POOL_MAX_RETRY; retry *= 2 {
+		ts.checkDryPool(at.Add(retry - time.Second))
+		asked(0)
+		at = at.Add(retry)
+		ts.checkDryPool(at)
+		asked(1)
+	}
+	if s = ts.dryPoolStatus(); !s.NextAttempt.Equal(at.Add(DRY_POOL_MAX_RETRY)) || s.PeersFound != 0 {
+		t.Errorf("Backed off to %v, %+v", s.NextAttempt.Sub(at), s)
+	}
+
+	ts.peers["peer"] = &peerState{}
+	ts.checkDryPool(at)
+	if s = ts.dryPoolStatus(); s != nil || ts.dryPool.recoveries != 1 {
+		t.Errorf("With a peer, %+v and %d recoveries", s, ts.dryPool.recoveries)
+	}
+	delete(ts.peers, "peer")
+	ts.paused = 1
+	ts.checkDryPool(at)
+	if s = ts.dryPoolStatus(); s != nil {
+		t.Errorf("Paused, %+v", s)
+	}
+}
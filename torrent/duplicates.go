@@ -0,0 +1,84 @@
+package torrent
+
+import "log"
+
+// Torrents added again. Whether it's the same .torrent dropped in the watch
+// directory twice, or a magnet link for a torrent we have the file of, or the
+// other way round, it's known by its info-hash before anything's done about
+// its files, and rather than a second session for them, the torrent we have
+// takes what the new one brings: its trackers, web seeds and labels, and if
+// we only had a magnet link that's still waiting for the metadata from peers,
+// the .torrent's, so it can start at once. A paused torrent can be resumed by
+// adding it again.
+//
+// The add is still errDuplicateTorrent, so that those adding can tell it
+// from one that's new, with the info-hash of the torrent we have.
+
+// What of again is new to the torrent we have as ih: the trackers, web seeds
+// and metadata it brings, and the labels it's added with. It's
+// errDuplicateTorrent, with the info-hash we have it as. A torrent that's
+// still being added takes them when its session starts; a session that's
+// running is returned, for the caller to give them to off the manager's loop.
+func (m *sessionManager) addedAgain(ih string, again *MetaInfo, labels []string, resume bool) (infoHash string, ts *TorrentSession, err error) {
+	if ts = m.byHash[ih]; ts != nil {
+		return ts.M.InfoHash, ts, errDuplicateTorrent
+	}
+	a := m.adding[ih]
+	trackers := fullAnnounceList(again.Announce, again.AnnounceList)
+	if a.meta != nil && a.meta.Info.Private != 0 {
+		if _, added := mergeTrackers(fullAnnounceList(a.meta.Announce, a.meta.AnnounceList), append(a.trackers, trackers...)); len(added) > 0 {
+			return ih, nil, errPrivateTrackers
+		}
+	}
+	a.trackers = append(a.trackers, trackers...)
+	a.webSeeds = appendUnique(a.webSeeds, again.WebSeeds...)
+	a.labels = appendUnique(a.labels, labels...)
+	if a.info == nil {
+		a.info = againInfo(again)
+	}
+	if resume {
+		a.paused = false
+	}
+	return ih, nil, errDuplicateTorrent
+}
+
+// again, if it's a .torrent, with metadata a magnet link's session could
+// take.
+func againInfo(again *MetaInfo) *MetaInfo {
+	if len(again.rawInfo) == 0 {
+		return nil
+	}
+	return again
+}
+
+// addedAgain gives the session what the torrent's been added again with:
+// trackers, web seeds and labels it doesn't have, and info's metadata if it's
+// a magnet link's that's waiting for it. It resumes the torrent if resume's set
+// and it's paused. Only the trackers can fail, as a private torrent's can't be
+// added to.
+func (ts *TorrentSession) addedAgain(trackers [][]string, webSeeds []string, info *MetaInfo, labels []string, resume bool) (err error) {
+	ts.runInLoop(func() {
+		// Before the metadata, which could make it private: a .torrent's
+		// own trackers are the ones it may use.
+		if len(trackers) > 0 {
+			_, err = ts.addTrackers(trackers)
+		}
+		if info != nil && !ts.Session.HaveTorrent {
+			log.Println("[", ts.M.Info.Name, "] Taking the metadata from the torrent added again")
+			ts.gotMetadata(string(info.rawInfo))
+		}
+		for _, u := range webSeeds {
+			if !validWebSeed(u) || ts.torrentHasWebSeed(u) || contains(ts.webSeedState.Added, u) {
+				continue
+			}
+			if e := ts.addUserWebSeed(u); e != nil {
+				log.Println("[", ts.M.Info.Name, "] Couldn't add web seed", u+":", e)
+			}
+		}
+		ts.addLabels(labels)
+		if resume && !ts.Queued() {
+			ts.resume()
+		}
+	})
+	return
+}
@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A torrent added as a .torrent and then as a magnet link, or the other way
+// round, has one session, which takes the trackers and web seeds of both, and
+// the .torrent's metadata if the magnet link came first, whether its session
+// is running or still queued.
+func TestAddedAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addedAgain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	announce := func(name string) string { return tracker.URL + "/" + name }
+
+	var torrents [3]*MetaInfo
+	var data [3][]byte
+	for i, name := range []string{"first", "second", "third"} {
+		writeWebSeedFiles(t, filepath.Join(dir, name), 20000+i)
+		if torrents[i], err = CreateTorrent(filepath.Join(dir, name), &CreateOptions{PieceLength: 16384,
+			Announce: announce(name)}); err != nil {
+			t.Fatal(err)
+		}
+		torrents[i].WebSeeds = []string{"http://127.0.0.1:1/" + name + "/"}
+		var b bytes.Buffer
+		if err = torrents[i].Bencode(&b); err != nil {
+			t.Fatal(err)
+		}
+		data[i] = b.Bytes()
+	}
+	magnet := func(meta *MetaInfo, tracker, webSeed string) string {
+		return "magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(meta.InfoHash)) +
+			"&tr=" + url.QueryEscape(tracker) + "&ws=" + url.QueryEscape(webSeed)
+	}
+
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		DataDir:            filepath.Join(dir, "data"),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		SeedRatio:          math.Inf(0),
+		MaxActive:          2,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	session := func(ih string) *TorrentSession {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			ts, _, err := m.Torrent(ih)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ts != nil {
+				return ts
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for the session of %x", ih)
+			}
+		}
+	}
+	complete := func(ih string) *TorrentSession {
+		t.Helper()
+		ts := session(ih)
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			s, err := ts.Status()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Pieces > 0 && s.GoodPieces == s.Pieces {
+				return ts
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %x to complete, %+v", ih, s)
+			}
+		}
+	}
+	took := func(ts *TorrentSession, trackers [][]string, webSeed string) {
+		t.Helper()
+		var announceList [][]string
+		var added []string
+		ts.runInLoop(func() {
+			announceList = fullAnnounceList(ts.M.Announce, ts.M.AnnounceList)
+			added = ts.webSeedState.Added
+		})
+		if !reflect.DeepEqual(announceList, trackers) || !reflect.DeepEqual(added, []string{webSeed}) {
+			t.Errorf("%s has trackers %q and web seeds %q", ts.M.Info.Name, announceList, added)
+		}
+	}
+
+	// The .torrent, then the magnet link, which resumes it.
+	ih, err := m.AddTorrentFromBytes(data[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := complete(ih)
+	if err = first.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.AddTorrentWith(magnet(torrents[0], announce("more"), "http://127.0.0.1:1/more/"), AddOptions{Resume: true})
+	if err != errDuplicateTorrent || again != ih {
+		t.Errorf("Adding the magnet link: %x, %v", again, err)
+	}
+	took(first, [][]string{{announce("first")}, {announce("more")}}, "http://127.0.0.1:1/more/")
+	if first.Paused() {
+		t.Error("Adding it again didn't resume it")
+	}
+
+	// The magnet link, then the .torrent, which it gets the metadata from.
+	if ih, err = m.AddTorrent(magnet(torrents[1], announce("more"), "http://127.0.0.1:1/more/")); err != nil {
+		t.Fatal(err)
+	}
+	second := session(ih)
+	if again, err = m.AddTorrentFromBytes(data[1]); err != errDuplicateTorrent || again != ih {
+		t.Errorf("Adding the .torrent: %x, %v", again, err)
+	}
+	complete(ih)
+	if second.M.Info.Name != "second" {
+		t.Errorf("Named %q", second.M.Info.Name)
+	}
+	took(second, [][]string{{announce("more")}, {announce("second")}}, "http://127.0.0.1:1/second/")
+
+	// The same, while the magnet link's waiting its turn.
+	if ih, err = m.AddTorrent(magnet(torrents[2], announce("more"), "http://127.0.0.1:1/more/")); err != nil {
+		t.Fatal(err)
+	}
+	if again, err = m.AddTorrentFromBytes(data[2]); err != errDuplicateTorrent || again != ih {
+		t.Errorf("Adding the .torrent while queued: %x, %v", again, err)
+	}
+	if err = m.RemoveTorrent(first.M.InfoHash, false); err != nil {
+		t.Fatal(err)
+	}
+	third := complete(ih)
+	took(third, [][]string{{announce("more")}, {announce("third")}}, "http://127.0.0.1:1/third/")
+	if running, err := m.Torrents(); err != nil || len(running) != 2 {
+		t.Errorf("%d torrents, %v", len(running), err)
+	}
+}
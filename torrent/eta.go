@@ -0,0 +1,80 @@
+package torrent
+
+import (
+	"math"
+	"time"
+)
+
+// The estimated time left goes by how fast Left has gone down, smoothed over
+// longer than the peers' rates are, so that peers coming and going, and
+// pieces finishing in bursts, don't throw it about. Only verified pieces
+// count, so it's the wanted bytes that are left, however many we download
+// again. In the endgame, when every piece that's left is being fetched, the
+// last few blocks come in as fast as the peers are sending now, which the
+// smoothed rate is slow to catch up with.
+const ETA_HALF_LIFE = 30 * time.Second
+
+type etaEstimator struct {
+	rate float64 // Bytes of Left a second
+	left uint64  // When last sampled
+	at   time.Time
+}
+
+// Called on the heartbeat.
+func (e *etaEstimator) sample(now time.Time, left uint64) {
+	if e.at.IsZero() {
+		e.left, e.at = left, now
+		return
+	}
+	elapsed := now.Sub(e.at)
+	if elapsed <= 0 {
+		return
+	}
+	var done float64
+	if left < e.left {
+		done = float64(e.left - left)
+	}
+	// Like rateCounter, so it comes out the same however often it's sampled.
+	kept := math.Exp2(-float64(elapsed) / float64(ETA_HALF_LIFE))
+	e.rate = e.rate*kept + done/elapsed.Seconds()*(1-kept)
+	e.left, e.at = left, now
+}
+
+func (e *etaEstimator) estimate(left uint64) time.Duration {
+	switch {
+	case left == 0:
+		return 0
+	case e.rate < 1:
+		return -1
+	}
+	eta := float64(left) / e.rate
+	if eta > float64(math.MaxInt64/time.Second) {
+		return -1
+	}
+	return time.Duration(eta * float64(time.Second))
+}
+
+// The estimate in the endgame: no longer than what's left takes at the
+// peers' rate now, if they're sending anything, and never under a second, as
+// it's not done till the last piece is verified.
+func (e *etaEstimator) estimateEndgame(left uint64, downloadRate float64) time.Duration {
+	eta := e.estimate(left)
+	if left == 0 {
+		return eta
+	}
+	if downloadRate >= 1 {
+		if now := time.Duration(float64(left) / downloadRate * float64(time.Second)); eta < 0 || now < eta {
+			eta = now
+		}
+	}
+	if eta >= 0 && eta < time.Second {
+		eta = time.Second
+	}
+	return eta
+}
+
+// Whether every piece we don't have is being fetched.
+func (ts *TorrentSession) endgame() bool {
+	return ts.Session.HaveTorrent && ts.goodPieces < ts.totalPieces &&
+		len(ts.activePieces) >= ts.totalPieces-ts.goodPieces
+}
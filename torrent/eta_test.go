@@ -0,0 +1,65 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestETA(t *testing.T) {
+	var e etaEstimator
+	if eta := e.estimate(1000); eta != -1 {
+		t.Errorf("Before any samples, ETA %v", eta)
+	}
+	if eta := e.estimate(0); eta != 0 {
+		t.Errorf("With nothing left, ETA %v", eta)
+	}
+	// 1000 bytes a second, in bursts.
+	now := time.Now()
+	left := uint64(1000000)
+	e.sample(now, left)
+	for i := 0; i < 300; i++ {
+		now = now.Add(time.Second)
+		if i%4 == 0 {
+			left -= 4000
+		}
+		e.sample(now, left)
+	}
+	want := time.Duration(left/1000) * time.Second
+	if eta := e.estimate(left); eta < want*8/10 || eta > want*12/10 {
+		t.Errorf("ETA %v, want about %v", eta, want)
+	}
+	// Going up, as a recheck can make it, isn't progress.
+	e.sample(now.Add(time.Second), left+100000)
+	if eta := e.estimate(left); eta < want {
+		t.Errorf("After Left went up, ETA %v", eta)
+	}
+}
+
+func TestETAEndgame(t *testing.T) {
+	var e etaEstimator
+	now := time.Now()
+	e.sample(now, 100000)
+	e.sample(now.Add(time.Minute), 10000)
+	smoothed := e.estimate(10000)
+	// Peers sending faster than the smoothed rate bring it in.
+	if eta := e.estimateEndgame(10000, 10000); eta != time.Second {
+		t.Errorf("At 10000 bytes/s, ETA %v", eta)
+	}
+	// But not slower ones, or none.
+	for _, rate := range []float64{0, 1} {
+		if eta := e.estimateEndgame(10000, rate); eta != smoothed {
+			t.Errorf("At %v bytes/s, ETA %v, want %v", rate, eta, smoothed)
+		}
+	}
+	// The last bytes aren't done till they are.
+	if eta := e.estimateEndgame(10, 1e6); eta != time.Second {
+		t.Errorf("With 10 bytes left, ETA %v", eta)
+	}
+	if eta := e.estimateEndgame(0, 1e6); eta != 0 {
+		t.Errorf("With nothing left, ETA %v", eta)
+	}
+	var unsampled etaEstimator
+	if eta := unsampled.estimateEndgame(20000, 10000); eta != 2*time.Second {
+		t.Errorf("Before any samples, at 10000 bytes/s, ETA %v", eta)
+	}
+}
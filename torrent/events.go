@@ -0,0 +1,145 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happened to a torrent.
+type EventType int
+
+const (
+	EVENT_PIECE_VERIFIED EventType = iota // A downloaded piece passed its hash check, and was written
+	EVENT_PIECE_FAILED                    // A downloaded piece failed its hash check
+	EVENT_COMPLETED                       // We have every piece. Sent once, after the last is written.
+	EVENT_ERROR                           // Err says what went wrong
+	EVENT_PEER_CONNECTED
+	EVENT_PEER_DISCONNECTED
+	EVENT_METADATA_RECEIVED // A magnet link's metadata arrived
+	EVENT_CHECK_PROGRESS    // Every second while the data's checked, and when a check stops. Piece is how many pieces have been.
+	NUM_EVENT_TYPES
+)
+
+var eventTypeNames = [NUM_EVENT_TYPES]string{"piece verified", "piece failed", "completed", "error",
+	"peer connected", "peer disconnected", "metadata received", "check progress"}
+
+func (t EventType) String() string {
+	if t >= 0 && t < NUM_EVENT_TYPES {
+		return eventTypeNames[t]
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+type Event struct {
+	Type     EventType
+	InfoHash string
+	Time     time.Time
+	Piece    int    // For piece events, and how many pieces have been checked
+	Peer     string // The peer's address, for peer events
+	Err      error  // For EVENT_ERROR
+}
+
+// A Subscription gets a torrent's events on C, in order. The torrent doesn't
+// wait for a slow reader: when C's buffer is full, the oldest event in it is
+// dropped to make room, and counted in Dropped. So the latest events, like
+// EVENT_COMPLETED, always get through. C is closed when the session ends, or
+// on Close.
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	dropped int64 // Use atomically
+	feed    *eventFeed
+}
+
+// Dropped says how many events didn't fit in C.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close stops the events, and closes C.
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	if s.feed.subs[s] {
+		delete(s.feed.subs, s)
+		close(s.c)
+	}
+}
+
+// The subscriptions to a session's events. The main loop sends them, and
+// anyone may subscribe.
+type eventFeed struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]bool
+	closed bool
+}
+
+func newEventFeed() *eventFeed {
+	return &eventFeed{subs: make(map[*Subscription]bool)}
+}
+
+func (f *eventFeed) subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, feed: f}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		close(c)
+	} else {
+		f.subs[s] = true
+	}
+	return s
+}
+
+func (f *eventFeed) send(e Event) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s := range f.subs {
+		for {
+			select {
+			case s.c <- e:
+			default:
+				select {
+				case <-s.c:
+					atomic.AddInt64(&s.dropped, 1)
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Ends every subscription.
+func (f *eventFeed) close() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for s := range f.subs {
+		close(s.c)
+	}
+	f.subs = nil
+}
+
+// Subscribe returns a Subscription to the torrent's events, holding up to
+// buffer of them.
+func (ts *TorrentSession) Subscribe(buffer int) *Subscription {
+	return ts.events.subscribe(buffer)
+}
+
+func (ts *TorrentSession) emit(e Event) {
+	e.InfoHash, e.Time = ts.M.InfoHash, time.Now()
+	ts.events.send(e)
+}
@@ -0,0 +1,48 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func TestEventFeed(t *testing.T) {
+	f := newEventFeed()
+	s := f.subscribe(2)
+	other := f.subscribe(0)
+	for i := 0; i < 3; i++ {
+		f.send(Event{Type: EVENT_PIECE_VERIFIED, Piece: i})
+	}
+	// The oldest is dropped to make room.
+	if e := <-s.C; e.Piece != 1 {
+		t.Errorf("First event %+v", e)
+	}
+	if e := <-s.C; e.Piece != 2 {
+		t.Errorf("Second event %+v", e)
+	}
+	if s.Dropped() != 1 {
+		t.Errorf("Dropped %d", s.Dropped())
+	}
+	if e := <-other.C; e.Piece != 2 || other.Dropped() != 2 {
+		t.Errorf("With no buffer asked for, got %+v and dropped %d", e, other.Dropped())
+	}
+
+	other.Close()
+	other.Close()
+	if _, ok := <-other.C; ok {
+		t.Error("Closing didn't close C")
+	}
+	f.send(Event{Type: EVENT_COMPLETED})
+	f.close()
+	if e := <-s.C; e.Type != EVENT_COMPLETED {
+		t.Errorf("Last event %+v", e)
+	}
+	if _, ok := <-s.C; ok {
+		t.Error("Ending the feed didn't close C")
+	}
+	s.Close()
+	if _, ok := <-f.subscribe(1).C; ok {
+		t.Error("Subscribed to an ended feed")
+	}
+	if EVENT_COMPLETED.String() != "completed" || EventType(99).String() != "EventType(99)" {
+		t.Error("Bad event type names")
+	}
+}
@@ -0,0 +1,33 @@
+package torrent
+
+import (
+	"log"
+	"os/exec"
+)
+
+// Runs a command once a torrent has finished downloading.
+func ExampleTorrentSession_Subscribe() {
+	flags := &TorrentFlags{
+		FileDir:            ".",
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          1,
+	}
+	ts, err := NewTorrentSession(flags, "example.torrent", 6881)
+	if err != nil {
+		log.Fatal(err)
+	}
+	events := ts.Subscribe(16)
+	go func() {
+		for e := range events.C {
+			if e.Type == EVENT_COMPLETED {
+				if err := exec.Command("notify-send", "Downloaded "+ts.M.Info.Name).Run(); err != nil {
+					log.Println("Couldn't run the command:", err)
+				}
+			}
+		}
+	}()
+	ts.DoTorrent()
+}
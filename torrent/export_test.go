@@ -0,0 +1,27 @@
+package torrent
+
+// What the tests in package torrent_test need of sessions' insides. They're
+// there, not here, so that they can use the swarm package, which uses this
+// one.
+
+var ErrNotFailed = errNotFailed
+
+// LimitUpload gives the session a bandwidth limiter of its own, which
+// uploads rate bytes a second. Call it before DoTorrent.
+func (ts *TorrentSession) LimitUpload(rate int64) {
+	ts.bandwidth = newBandwidth(&TorrentFlags{MaxUploadRate: rate})
+}
+
+// LimitPieceMemory gives the session a budget of limit bytes for its active
+// pieces' buffers. Call it before DoTorrent.
+func (ts *TorrentSession) LimitPieceMemory(limit int64) {
+	ts.pieceMemory = newPieceMemory(limit)
+}
+
+func (ts *TorrentSession) PieceMemoryUsed() int64 {
+	return ts.pieceMemory.Used()
+}
+
+func (ts *TorrentSession) StorageFull() bool {
+	return ts.storageFull()
+}
@@ -0,0 +1,298 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// File handles let a frontend that serves a torrent's files while they
+// download, like a filesystem, tell the session what's being read. The pieces
+// under a handle's last read, and FILE_READAHEAD bytes past it, are picked
+// before any others until the handle's closed. Reads of pieces we don't have
+// yet wait for them, rather than return zeros, unless the handle's opened not
+// to, when they read what there is and say what isn't there yet.
+//
+// A handle's Reader is an io.ReadSeeker of the file as well, for those that
+// want one, like http.ServeContent.
+
+const (
+	FILE_READAHEAD    = 8 << 20 // Bytes
+	FILE_READ_TIMEOUT = 60 * time.Second
+)
+
+var (
+	errReadTimeout  = errors.New("Timed out waiting for the pieces to download")
+	errHandleClosed = errors.New("File handle is closed")
+	errNoMetadata   = errors.New("Don't have the torrent's metadata yet")
+)
+
+// A FileHandle is an open file of a torrent. Its methods may be called from
+// any goroutine.
+type FileHandle struct {
+	ts     *TorrentSession
+	path   []string
+	offset int64 // Of the file, in the torrent
+	size   int64
+	FileOptions
+	// The pieces to pick first, or -1s. The rest is owned by the main loop.
+	first, last int
+	closed      bool
+}
+
+// FileOptions are how a FileHandle reads.
+type FileOptions struct {
+	// Reads of pieces we don't have return what's before them, and an
+	// *ErrDataNotYetAvailable, rather than wait.
+	NoWait bool
+	// The pieces being read aren't picked first. Reads that wait may wait a
+	// long time.
+	NoPriority bool
+}
+
+// ErrDataNotYetAvailable is what a read of a file that doesn't wait returns
+// when some of it hasn't downloaded yet. The file's bytes from Offset, for
+// Length, are missing, up to the end of the read or the next bytes we have.
+type ErrDataNotYetAvailable struct {
+	Offset, Length int64
+}
+
+func (e *ErrDataNotYetAvailable) Error() string {
+	return fmt.Sprintf("Bytes %d to %d of the file haven't downloaded yet", e.Offset, e.Offset+e.Length)
+}
+
+// The offset into the torrent and the length of file i.
+func (f *fileStore) fileRange(i int) (offset, length int64) {
+	return f.offsets[i], f.files[i].length
+}
+
+// OpenFile opens the file with index i in the torrent's info dictionary, or
+// the torrent's only file.
+func (ts *TorrentSession) OpenFile(i int) (h *FileHandle, err error) {
+	return ts.OpenFileWith(i, FileOptions{})
+}
+
+// OpenFileWith is OpenFile, with options.
+func (ts *TorrentSession) OpenFileWith(i int, options FileOptions) (h *FileHandle, err error) {
+	e := ts.runInLoop(func() {
+		if ts.files == nil {
+			err = errNoMetadata
+			return
+		}
+		if i < 0 || i >= len(ts.files.files) {
+			err = fmt.Errorf("No file %d", i)
+			return
+		}
+		h = &FileHandle{ts: ts, path: ts.fileStorePath(i), FileOptions: options, first: -1, last: -1}
+		h.offset, h.size = ts.files.fileRange(i)
+		ts.fileHandles = append(ts.fileHandles, h)
+	})
+	if e != nil {
+		return nil, e
+	}
+	return
+}
+
+func (h *FileHandle) Size() int64 {
+	return h.size
+}
+
+// Path is the file's path in the torrent, without the torrent's directory.
+func (h *FileHandle) Path() []string {
+	return h.path
+}
+
+// ReadAt reads the file at off. It waits up to FILE_READ_TIMEOUT for the
+// pieces it needs, which are picked first meanwhile, unless the handle's
+// options say otherwise.
+func (h *FileHandle) ReadAt(p []byte, off int64) (n int, err error) {
+	return h.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is ReadAt, but stops waiting when ctx is done, returning
+// ctx.Err().
+func (h *FileHandle) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off >= h.size {
+		return 0, io.EOF
+	}
+	want := p
+	if int64(len(want)) > h.size-off {
+		want = want[:h.size-off]
+	}
+	ts := h.ts
+	timeout := time.After(FILE_READ_TIMEOUT)
+	for {
+		var ready chan bool
+		if e := ts.runInLoop(func() { n, ready, err = h.read(want, off) }); e != nil {
+			return 0, e
+		}
+		if ready == nil {
+			break
+		}
+		select {
+		case <-ready:
+		case <-ts.ended:
+			return 0, errSessionEnded
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-timeout:
+			return 0, errReadTimeout
+		}
+	}
+	if err == nil && len(want) < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// Moves the handle's window to the read, and reads it if we have its pieces.
+// If we don't, it returns a channel that's closed when more pieces arrive, or
+// if the handle doesn't wait, reads what's before them. Called on the main
+// loop.
+func (h *FileHandle) read(p []byte, off int64) (n int, ready chan bool, err error) {
+	if h.closed {
+		return 0, nil, errHandleClosed
+	}
+	ts := h.ts
+	start := h.offset + off
+	if !h.NoPriority {
+		end := start + int64(len(p)) + FILE_READAHEAD
+		if end > h.offset+h.size {
+			end = h.offset + h.size
+		}
+		h.first, h.last = ts.piecesFor(start, end-start)
+	}
+	first, last := ts.piecesFor(start, int64(len(p)))
+	for i := first; i <= last; i++ {
+		if ts.pieceSet.IsSet(i) {
+			continue
+		}
+		if !h.NoWait {
+			ready = make(chan bool)
+			ts.pieceWaiters = append(ts.pieceWaiters, ready)
+			return
+		}
+		j := i + 1
+		for j <= last && !ts.pieceSet.IsSet(j) {
+			j++
+		}
+		pieceLength := ts.M.Info.PieceLength
+		missing, missingEnd := int64(i)*pieceLength, int64(j)*pieceLength
+		if missing < start {
+			missing = start
+		}
+		if end := start + int64(len(p)); missingEnd > end {
+			missingEnd = end
+		}
+		if n = int(missing - start); n > 0 {
+			if n, err = ts.fileStore.ReadAt(p[:n], start); err != nil {
+				return
+			}
+		}
+		return n, nil, &ErrDataNotYetAvailable{missing - h.offset, missingEnd - missing}
+	}
+	n, err = ts.fileStore.ReadAt(p, start)
+	return
+}
+
+// A FileReader reads its handle's file from where it's seeked to, as an
+// io.ReadSeeker, giving up waiting for pieces when its context is done.
+type FileReader struct {
+	h   *FileHandle
+	ctx context.Context
+	off int64
+}
+
+// Reader returns a reader of the file, at its start, whose reads give up
+// waiting when ctx is done. Closing the handle closes it too.
+func (h *FileHandle) Reader(ctx context.Context) *FileReader {
+	return &FileReader{h: h, ctx: ctx}
+}
+
+func (r *FileReader) Read(p []byte) (n int, err error) {
+	n, err = r.h.ReadAtContext(r.ctx, p, r.off)
+	r.off += int64(n)
+	return
+}
+
+// ReadAt reads the file at off, without moving the reader.
+func (r *FileReader) ReadAt(p []byte, off int64) (n int, err error) {
+	return r.h.ReadAtContext(r.ctx, p, off)
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.h.size
+	default:
+		return 0, errors.New("Bad whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// Close drops the handle's priority.
+func (h *FileHandle) Close() error {
+	ts := h.ts
+	return ts.runInLoop(func() {
+		h.closed = true
+		for i, o := range ts.fileHandles {
+			if o == h {
+				ts.fileHandles = append(ts.fileHandles[:i], ts.fileHandles[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+// The path of the file store's file i.
+func (ts *TorrentSession) fileStorePath(i int) []string {
+	info := ts.M.storeInfo()
+	if len(info.Files) == 0 {
+		return []string{info.Name}
+	}
+	return info.Files[i].Path
+}
+
+// The pieces the length bytes at offset lie in.
+func (ts *TorrentSession) piecesFor(offset, length int64) (first, last int) {
+	pieceLength := ts.M.Info.PieceLength
+	first = int(offset / pieceLength)
+	if length < 1 {
+		length = 1
+	}
+	last = int((offset + length - 1) / pieceLength)
+	return first, min(last, ts.totalPieces-1)
+}
+
+// Picks the first piece in an open file's window that p has and we don't, or
+// returns -1. The files opened first come first.
+func (ts *TorrentSession) choosePriorityPiece(p *peerState) int {
+	for _, h := range ts.fileHandles {
+		if h.first >= 0 {
+			if piece := ts.checkRange(p, h.first, h.last+1); piece >= 0 {
+				return piece
+			}
+		}
+	}
+	return -1
+}
+
+// Wakes the reads waiting for pieces, so they look again.
+func (ts *TorrentSession) wakeReaders() {
+	for _, c := range ts.pieceWaiters {
+		close(c)
+	}
+	ts.pieceWaiters = nil
+}
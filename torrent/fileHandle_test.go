@@ -0,0 +1,288 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPiecesFor(t *testing.T) {
+	ts := webSeedTestSession()
+	for _, c := range []struct {
+		offset, length int64
+		first, last    int
+	}{
+		{0, 100, 0, 0},
+		{99, 2, 0, 1},
+		{150, 0, 1, 1},
+		{250, 10000, 2, 9},
+	} {
+		if first, last := ts.piecesFor(c.offset, c.length); first != c.first || last != c.last {
+			t.Errorf("%d bytes at %d: got %d..%d, want %d..%d", c.length, c.offset, first, last, c.first, c.last)
+		}
+	}
+}
+
+func TestChoosePriorityPiece(t *testing.T) {
+	ts := webSeedTestSession()
+	p := &peerState{have: NewBitset(10)}
+	for i := 0; i < 10; i++ {
+		p.have.Set(i)
+	}
+	ts.pieceSet.Set(5)
+	ts.activePieces[6] = &ActivePiece{}
+	ts.fileHandles = []*FileHandle{{first: -1, last: -1}, {first: 5, last: 8}, {first: 2, last: 3}}
+	// 5 we have and 6 is being fetched.
+	if piece := ts.ChoosePiece(p); piece != 7 {
+		t.Errorf("Chose %d, want 7", piece)
+	}
+	p.have.Clear(7)
+	p.have.Clear(8)
+	if piece := ts.ChoosePiece(p); piece != 2 {
+		t.Errorf("Chose %d, want 2", piece)
+	}
+}
+
+func TestFileHandle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileHandle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "seed")
+	if err = os.MkdirAll(filepath.Join(seedDir, "content"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	a := make([]byte, 50*1024)
+	b := make([]byte, 150*1024)
+	r := rand.New(rand.NewSource(7))
+	r.Read(a)
+	r.Read(b)
+	if err = ioutil.WriteFile(filepath.Join(seedDir, "content", "a"), a, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(seedDir, "content", "b"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateTorrent(filepath.Join(seedDir, "content"), &CreateOptions{PieceLength: 32 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	leechFlags := &TorrentFlags{
+		FileDir:            filepath.Join(dir, "leech"),
+		SeedRatio:          math.Inf(0),
+		UseDHT:             true,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}
+	leecher, leecherDone := startTestSession(t, leechFlags, torrentFile, swarm)
+	defer func() {
+		leecher.Quit()
+		<-leecherDone
+	}()
+	i := 0
+	if m.Info.Files[0].Path[0] != "b" {
+		i = 1
+	}
+	h, err := leecher.OpenFile(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Size() != int64(len(b)) {
+		t.Fatalf("Size %d, want %d", h.Size(), len(b))
+	}
+
+	// Nobody has the data yet, so the read waits for the seeder.
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, 2000)
+	read := make(chan result)
+	go func() {
+		n, err := h.ReadAt(buf, int64(len(b)-1000))
+		read <- result{n, err}
+	}()
+	seedFlags := *leechFlags
+	seedFlags.Port = 0
+	seedFlags.FileDir = seedDir
+	seeder, seederDone := startTestSession(t, &seedFlags, torrentFile, swarm)
+	defer func() {
+		seeder.Quit()
+		<-seederDone
+	}()
+	res := <-read
+	if res.n != 1000 || res.err != io.EOF || !bytes.Equal(buf[:1000], b[len(b)-1000:]) {
+		t.Errorf("Read %d bytes, %v", res.n, res.err)
+	}
+	if _, err = h.ReadAt(buf, h.Size()); err != io.EOF {
+		t.Errorf("Read at the end: %v", err)
+	}
+
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var open int
+	leecher.runInLoop(func() { open = len(leecher.fileHandles) })
+	if open != 0 {
+		t.Errorf("Still have %d handles", open)
+	}
+	if _, err = h.ReadAt(buf, 0); err != errHandleClosed {
+		t.Errorf("Read after Close: %v", err)
+	}
+	if _, err = leecher.OpenFile(2); err == nil {
+		t.Error("Opened a file that isn't there")
+	}
+}
+
+// Handles that don't wait read what there is of files that start and end in
+// the middle of pieces, up to the first piece we don't have, and say what
+// isn't there.
+func TestFileHandleNoWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileHandleNoWait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// With 16KiB pieces, b is in pieces 3 and 4, from 50000 to 80000, and c
+	// starts in 4.
+	content := filepath.Join(dir, "content")
+	if err = os.MkdirAll(content, 0700); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(208))
+	files := make(map[string][]byte)
+	for _, file := range []struct {
+		name string
+		size int
+	}{{"a", 50000}, {"b", 30000}, {"c", 40000}} {
+		files[file.name] = make([]byte, file.size)
+		r.Read(files[file.name])
+		if err = ioutil.WriteFile(filepath.Join(content, file.name), files[file.name], 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := CreateTorrent(content, &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Spoil piece 4, in b.
+	b := append([]byte(nil), files["b"]...)
+	b[len(b)-1]++
+	if err = ioutil.WriteFile(filepath.Join(content, "b"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, done := startTestSession(t, &TorrentFlags{
+		FileDir:            dir,
+		SeedRatio:          math.Inf(0),
+		TrackerlessMode:    true,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}, torrentFile, &fakeDHTSwarm{peers: make(map[string][]string)})
+	defer func() {
+		ts.Quit()
+		<-done
+	}()
+	if s := waitForCheck(t, ts); s.GoodPieces != s.Pieces-1 {
+		t.Fatalf("Have %d of %d pieces", s.GoodPieces, s.Pieces)
+	}
+	index := make(map[string]int)
+	for i, file := range m.Info.Files {
+		index[file.Path[0]] = i
+	}
+	open := func(name string, options FileOptions) *FileHandle {
+		h, err := ts.OpenFileWith(index[name], options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	h := open("b", FileOptions{NoWait: true})
+	buf := make([]byte, 40000)
+	n, err := h.ReadAt(buf, 100)
+	var missing *ErrDataNotYetAvailable
+	if !errors.As(err, &missing) || *missing != (ErrDataNotYetAvailable{4*16384 - 50000, 30000 - (4*16384 - 50000)}) ||
+		n != 4*16384-50000-100 || !bytes.Equal(buf[:n], files["b"][100:100+n]) {
+		t.Errorf("Reading b: %d bytes, %v", n, err)
+	}
+	// The missing bytes run to the end of the read.
+	if n, err = h.ReadAt(buf[:100], 15500); !errors.As(err, &missing) || n != 4*16384-50000-15500 ||
+		*missing != (ErrDataNotYetAvailable{4*16384 - 50000, int64(100 - n)}) {
+		t.Errorf("Reading b over its pieces: %d bytes, %v", n, err)
+	}
+	rd := h.Reader(context.Background())
+	if _, err = rd.Seek(-30000, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rd)
+	if !errors.As(err, &missing) || !bytes.Equal(got, files["b"][:4*16384-50000]) {
+		t.Errorf("Reading b from the start: %d bytes, %v", len(got), err)
+	}
+	var first int
+	ts.runInLoop(func() { first = h.first })
+	if first != 3 {
+		t.Errorf("b's read picks from piece %d", first)
+	}
+
+	// c's first bytes are in 4, but the rest are there.
+	h = open("c", FileOptions{NoWait: true, NoPriority: true})
+	if n, err = h.ReadAt(buf[:10], 0); n != 0 || !errors.As(err, &missing) || *missing != (ErrDataNotYetAvailable{0, 10}) {
+		t.Errorf("Reading the start of c: %d bytes, %v", n, err)
+	}
+	if n, err = h.ReadAt(buf, 5*16384-80000); n != 40000-(5*16384-80000) || err != io.EOF ||
+		!bytes.Equal(buf[:n], files["c"][5*16384-80000:]) {
+		t.Errorf("Reading the rest of c: %d bytes, %v", n, err)
+	}
+	ts.runInLoop(func() { first = h.first })
+	if first != -1 {
+		t.Errorf("c's read picks from piece %d", first)
+	}
+
+	// A handle that waits, waits until it's told not to.
+	h = open("b", FileOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rd = h.Reader(ctx)
+	if n, err = rd.ReadAt(buf[:10], 0); n != 10 || err != nil || !bytes.Equal(buf[:10], files["b"][:10]) {
+		t.Errorf("Reading the start of b: %d bytes, %v", n, err)
+	}
+	if n, err = rd.ReadAt(buf[:10], 20000); err != context.DeadlineExceeded {
+		t.Errorf("Reading the end of b: %d bytes, %v", n, err)
+	}
+}
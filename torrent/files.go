@@ -1,8 +1,13 @@
 package torrent
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 // Interface for a file.
@@ -25,18 +30,50 @@ type FileSystem interface {
 }
 
 // A torrent file store.
-// WritePiece should be called for full, verified pieces only;
+// WritePiece should be called for full, verified pieces only; it's where a
+// piece is saved, so it returns once the piece is in the files, or with the
+// error that kept it out of them. A store that caches pieces writes them
+// through, whether or not it has them already.
+//
+// A store may also be able to take a long piece a segment at a time, before
+// it's verified; see segmentWriter.
+//
+// The buffers given to ReadAt and WritePiece are the caller's again once
+// they return, and are reused, as piece and block buffers are pooled. So a
+// store mustn't keep them, or any slice of them: one that holds on to data,
+// like a cache, keeps a copy. lendBlock is the other way round; see
+// blockLender.
 type FileStore interface {
 	io.ReaderAt
 	io.Closer
 	WritePiece(buffer []byte, piece int) (written int, err error)
 }
 
+// A FileStore that holds on to data besides the files, like a cache, lets
+// go of it with Flush.
+type flusher interface {
+	Flush() error
+}
+
+// A FileStore that holds blocks in memory can lend them for sending, without
+// copying them, with lendBlock. What it lends must stay unchanged for as long
+// as it's held. It's nil if the block can't be lent.
+type blockLender interface {
+	lendBlock(off int64, length int) []byte
+}
+
 type fileStore struct {
 	fileSystem FileSystem
 	offsets    []int64
 	files      []fileEntry // Stored in increasing globalOffset order
 	pieceSize  int64
+
+	// Where each file ends, so finding one reads a single flat array.
+	ends []int64
+	// The file the last read or write ended in. Pieces are mostly read and
+	// written in order, so this is where the next one usually starts.
+	last   int32
+	closed int32 // Set by the first Close
 }
 
 type fileEntry struct {
@@ -45,55 +82,220 @@ type fileEntry struct {
 }
 
 func NewFileStore(info *InfoDict, fileSystem FileSystem) (f FileStore, totalSize int64, err error) {
+	return NewFileStoreContext(context.Background(), info, fileSystem)
+}
+
+// NewFileStoreContext is like NewFileStore, but stops opening files when ctx
+// is done, closing the ones it's opened and returning ctx.Err().
+func NewFileStoreContext(ctx context.Context, info *InfoDict, fileSystem FileSystem) (f FileStore, totalSize int64, err error) {
+	return openFileStore(ctx, info, fileSystem, 0, nil)
+}
+
+// How many files are opened at once, by default. Opening a file can take a
+// round trip or more on a network file system, and torrents can have tens of
+// thousands of them.
+const OPEN_FILES_PARALLEL = 16
+
+// How far opening a torrent's files has got, for showing while it's added.
+// Written by the opener, so use atomically.
+type openProgress struct {
+	opened, files int64
+}
+
+// Makes a fileStore, opening up to parallel files at once, or
+// OPEN_FILES_PARALLEL if it's 0, and counting them in progress if it isn't
+// nil. If an Open fails, the opens still to come are given up on, and every
+// file opened is closed.
+func openFileStore(ctx context.Context, info *InfoDict, fileSystem FileSystem, parallel int, progress *openProgress) (f FileStore, totalSize int64, err error) {
 	fs := &fileStore{}
 	fs.fileSystem = fileSystem
 	fs.pieceSize = info.PieceLength
 	numFiles := len(info.Files)
 	if numFiles == 0 {
 		// Create dummy Files structure.
-		info = &InfoDict{Files: []FileDict{FileDict{info.Length, []string{info.Name}, info.Md5sum}}}
+		info = &InfoDict{Files: []FileDict{FileDict{Length: info.Length, Path: []string{info.Name}, Md5sum: info.Md5sum}}}
 		numFiles = 1
 	}
 	fs.files = make([]fileEntry, numFiles)
 	fs.offsets = make([]int64, numFiles)
+	fs.ends = make([]int64, numFiles)
+	var toOpen []int
 	for i, _ := range info.Files {
 		src := &info.Files[i]
-		var file File
-		file, err = fs.fileSystem.Open(src.Path, src.Length)
-		if err != nil {
-			// Close all files opened up to now.
-			for i2 := 0; i2 < i; i2++ {
-				fs.files[i2].file.Close()
-			}
-			return
+		if src.Attr == "p" {
+			fs.files[i].file = padFile{}
+		} else {
+			toOpen = append(toOpen, i)
 		}
-		fs.files[i].file = file
 		fs.files[i].length = src.Length
 		fs.offsets[i] = totalSize
 		totalSize += src.Length
+		fs.ends[i] = totalSize
+	}
+	if progress != nil {
+		atomic.StoreInt64(&progress.files, int64(len(toOpen)))
+	}
+
+	if parallel <= 0 {
+		parallel = OPEN_FILES_PARALLEL
+	}
+	if parallel > len(toOpen) {
+		parallel = len(toOpen)
+	}
+	opening, stop := context.WithCancel(ctx)
+	defer stop()
+	next := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if opening.Err() != nil {
+					continue
+				}
+				src := &info.Files[i]
+				file, e := fs.fileSystem.Open(src.Path, src.Length)
+				if e != nil {
+					mu.Lock()
+					if err == nil {
+						err = e
+					}
+					mu.Unlock()
+					stop()
+					continue
+				}
+				// Each file has its own entry, so this needs no lock.
+				fs.files[i].file = file
+				if progress != nil {
+					atomic.AddInt64(&progress.opened, 1)
+				}
+			}
+		}()
+	}
+	for _, i := range toOpen {
+		if opening.Err() != nil {
+			break
+		}
+		select {
+		case next <- i:
+		case <-opening.Done():
+		}
+	}
+	close(next)
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		// Close all files opened up to now.
+		for i := range fs.files {
+			if file := fs.files[i].file; file != nil {
+				file.Close()
+			}
+		}
+		return
 	}
 	f = fs
 	return
 }
 
+// A BEP 47 padding file. Padding is all zeros, so there's nothing to store.
+type padFile struct{}
+
+func (padFile) ReadAt(p []byte, off int64) (n int, err error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (padFile) WriteAt(p []byte, off int64) (n int, err error) {
+	for i := range p {
+		if p[i] != 0 {
+			return i, errors.New("Unexpected non-zero data in padding file.")
+		}
+	}
+	return len(p), nil
+}
+
+func (padFile) Close() error {
+	return nil
+}
+
+// The index of the file holding the byte at offset, or len(f.files) if it's
+// past the end. Empty files share their offset with the file after them, so
+// there can be a run of files at an offset; this is the first of them that
+// isn't empty.
 func (f *fileStore) find(offset int64) int {
-	// Binary search
-	offsets := f.offsets
-	low := 0
-	high := len(offsets)
-	for low < high-1 {
-		probe := (low + high) / 2
-		entry := offsets[probe]
-		if offset < entry {
-			high = probe
-		} else {
-			low = probe
+	// The file is the first whose end is past offset. Try the one the last
+	// call ended in, and the one after it, before searching.
+	if i := int(atomic.LoadInt32(&f.last)); i < len(f.ends) {
+		for _, j := range [2]int{i, i + 1} {
+			if j < len(f.ends) && f.ends[j] > offset && (j == 0 || f.ends[j-1] <= offset) {
+				return j
+			}
 		}
 	}
-	return low
+	// The ends only go up, so this is a binary search.
+	return sort.Search(len(f.ends), func(i int) bool { return f.ends[i] > offset })
 }
 
+// Remembers the file a read or write ended in, for find.
+func (f *fileStore) ended(index int) {
+	if index >= len(f.ends) {
+		index = len(f.ends) - 1
+	}
+	if index >= 0 && int(atomic.LoadInt32(&f.last)) != index {
+		atomic.StoreInt32(&f.last, int32(index))
+	}
+}
+
+// The indexes of the first and last files that the length bytes at offset
+// lie in. Empty files in between are counted too.
+func (f *fileStore) filesFor(offset, length int64) (first, last int) {
+	first, last = f.find(offset), f.find(offset+length-1)
+	if last >= len(f.files) {
+		last = len(f.files) - 1
+	}
+	return
+}
+
+// ErrOffsetBeyondStore is what reading a FileStore from its end, or past it,
+// returns: no piece lies there, so the offset is wrong.
+var ErrOffsetBeyondStore = errors.New("Read from past the end of the store")
+
+// ErrWriteBeyondStore is what writing data past the end of a FileStore
+// returns. Zeros may be written there, as they pad out the last piece, but
+// nothing else: data there can't belong to the torrent.
+type ErrWriteBeyondStore struct {
+	Offset int64 // Of the first byte that isn't zero
+	Size   int64 // Of the store
+}
+
+func (e *ErrWriteBeyondStore) Error() string {
+	return fmt.Sprintf("Non-zero data written at %d, past the end of the %d byte store", e.Offset, e.Size)
+}
+
+// The length of all the files together.
+func (f *fileStore) size() int64 {
+	if len(f.ends) == 0 {
+		return 0
+	}
+	return f.ends[len(f.ends)-1]
+}
+
+// A read that runs off the end of the store reads zeros, which n counts.
+// One that starts at the end, or past it, reads zeros too, but n is 0 and
+// err is ErrOffsetBeyondStore.
 func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	if len(p) > 0 && off >= f.size() {
+		for i := range p {
+			p[i] = 0
+		}
+		return 0, ErrOffsetBeyondStore
+	}
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -105,7 +307,7 @@ func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
 				chunk = space
 			}
 			var nThisTime int
-			nThisTime, err = entry.file.ReadAt(p[0:chunk], itemOffset)
+			nThisTime, err = readFullAt(entry.file, p[0:chunk], itemOffset)
 			n = n + nThisTime
 			if err != nil {
 				return
@@ -115,16 +317,31 @@ func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
 		}
 		index++
 	}
+	f.ended(index - 1)
 	// At this point if there's anything left to read it means we've run off the
 	// end of the file store. Read zeros. This is defined by the bittorrent protocol.
 	for i, _ := range p {
 		p[i] = 0
 	}
+	n += len(p)
 	return
 }
 
+// n counts the bytes written to the files, which leaves out any zeros past
+// the end of the store.
 func (f *fileStore) WritePiece(p []byte, piece int) (n int, err error) {
-	off := int64(piece) * f.pieceSize
+	return f.writeAt(p, int64(piece)*f.pieceSize)
+}
+
+func (f *fileStore) WriteSegment(p []byte, piece int, begin int) (n int, err error) {
+	return f.writeAt(p, int64(piece)*f.pieceSize+int64(begin))
+}
+
+func (f *fileStore) writesSegments() bool {
+	return true
+}
+
+func (f *fileStore) writeAt(p []byte, off int64) (n int, err error) {
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -136,7 +353,7 @@ func (f *fileStore) WritePiece(p []byte, piece int) (n int, err error) {
 				chunk = space
 			}
 			var nThisTime int
-			nThisTime, err = entry.file.WriteAt(p[0:chunk], itemOffset)
+			nThisTime, err = writeFullAt(entry.file, p[0:chunk], itemOffset)
 			n += nThisTime
 			if err != nil {
 				return
@@ -146,27 +363,80 @@ func (f *fileStore) WritePiece(p []byte, piece int) (n int, err error) {
 		}
 		index++
 	}
+	f.ended(index - 1)
 	// At this point if there's anything left to write it means we've run off the
 	// end of the file store. Check that the data is zeros.
 	// This is defined by the bittorrent protocol.
 	for i, _ := range p {
 		if p[i] != 0 {
-			err = errors.New("Unexpected non-zero data at end of store.")
-			n = n + i
-			return
+			return n, &ErrWriteBeyondStore{off + int64(i), f.size()}
+		}
+	}
+	return
+}
+
+// How many times in a row a File can read or write nothing, without saying
+// why, before we give up on it.
+const MAX_EMPTY_FILE_OPS = 100
+
+// Reads all of p from the file at off. Files, network backed ones
+// especially, can read less than asked without an error, so we go on from
+// where they stopped. They can also return io.EOF along with the last of
+// their bytes, which isn't an error; ending before p's full is.
+func readFullAt(file File, p []byte, off int64) (n int, err error) {
+	for empty := 0; n < len(p) && err == nil; {
+		var nThisTime int
+		nThisTime, err = file.ReadAt(p[n:], off+int64(n))
+		n += nThisTime
+		if nThisTime > 0 {
+			empty = 0
+		} else if empty++; empty == MAX_EMPTY_FILE_OPS && err == nil {
+			err = io.ErrNoProgress
+		}
+	}
+	if err == io.EOF {
+		if n == len(p) {
+			err = nil
+		} else {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return
+}
+
+// Writes all of p to the file at off, going on after short writes.
+func writeFullAt(file File, p []byte, off int64) (n int, err error) {
+	for empty := 0; n < len(p) && err == nil; {
+		var nThisTime int
+		nThisTime, err = file.WriteAt(p[n:], off+int64(n))
+		n += nThisTime
+		if nThisTime > 0 {
+			empty = 0
+		} else if empty++; empty == MAX_EMPTY_FILE_OPS && err == nil {
+			err = io.ErrShortWrite
 		}
 	}
-	n = n + len(p)
 	return
 }
 
+// Close closes every file, and the file system, even if some fail, and
+// returns all their errors together: a File might only find out it couldn't
+// save what was written when it's closed. Closing again does nothing.
 func (f *fileStore) Close() (err error) {
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return nil
+	}
+	var errs []error
 	for i := range f.files {
-		f.files[i].file.Close()
+		if e := f.files[i].file.Close(); e != nil {
+			errs = append(errs, fmt.Errorf("File %d: %w", i, e))
+		}
 	}
 
 	if f.fileSystem != nil {
-		err = f.fileSystem.Close()
+		if e := f.fileSystem.Close(); e != nil {
+			errs = append(errs, e)
+		}
 	}
-	return
+	return errors.Join(errs...)
 }
@@ -1,10 +1,22 @@
 package torrent
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testFile struct {
@@ -30,8 +42,8 @@ var tests []testFile = []testFile{{
 }}
 
 func mkFileStore(tf testFile) (fs *fileStore, err error) {
-	f := fileEntry{tf.fileLen, &osFile{tf.path}}
-	return &fileStore{fileSystem: nil, offsets: []int64{0}, files: []fileEntry{f}, pieceSize: 512}, nil
+	f := fileEntry{tf.fileLen, &osFile{filePath: tf.path}}
+	return &fileStore{fileSystem: nil, offsets: []int64{0}, files: []fileEntry{f}, pieceSize: 512, ends: []int64{tf.fileLen}}, nil
 }
 
 func TestFileStoreRead(t *testing.T) {
@@ -55,3 +67,592 @@ func TestFileStoreRead(t *testing.T) {
 		}
 	}
 }
+
+// A FileSystem that cancels a context on its second Open, and counts the
+// files left open.
+type cancellingFS struct {
+	FileSystem
+	cancel func()
+	mu     sync.Mutex
+	opens  int
+	open   int
+}
+
+type closeCounter struct {
+	File
+	fs *cancellingFS
+}
+
+func (c closeCounter) Close() error {
+	c.fs.mu.Lock()
+	c.fs.open--
+	c.fs.mu.Unlock()
+	return c.File.Close()
+}
+
+func (c *cancellingFS) Open(name []string, length int64) (File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opens++; c.opens == 2 {
+		c.cancel()
+	}
+	f, err := c.FileSystem.Open(name, length)
+	if err == nil {
+		c.open++
+		f = closeCounter{f, c}
+	}
+	return f, err
+}
+
+func TestNewFileStoreCancelled(t *testing.T) {
+	ram, err := NewRAMFileSystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs := &cancellingFS{FileSystem: ram, cancel: cancel}
+	info := &InfoDict{PieceLength: 10, Files: []FileDict{
+		{Length: 10, Path: []string{"a"}}, {Length: 10, Path: []string{"b"}}, {Length: 10, Path: []string{"c"}}}}
+	if _, _, err = NewFileStoreContext(ctx, info, fs); err != context.Canceled {
+		t.Errorf("Got %v", err)
+	}
+	// Files are opened in parallel, so the third may have been started
+	// before the second cancelled.
+	if fs.opens < 2 || fs.open != 0 {
+		t.Errorf("Opened %d, and left %d open", fs.opens, fs.open)
+	}
+}
+
+func TestFileStoreEmptyFiles(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		lengths []int64
+		// The file each offset is found in, from 0 to one past the end.
+		found []int
+	}{
+		{"first", []int64{0, 0, 3, 2}, []int{2, 2, 2, 3, 3, 4}},
+		{"middle", []int64{3, 0, 0, 2}, []int{0, 0, 0, 3, 3, 4}},
+		{"last", []int64{3, 2, 0, 0}, []int{0, 0, 0, 1, 1, 4}},
+		{"everywhere", []int64{0, 2, 0, 2, 0}, []int{1, 1, 3, 3, 5}},
+		{"only", []int64{0, 0, 0}, []int{3}},
+	} {
+		ram, err := NewRAMFileSystem()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := &InfoDict{PieceLength: 4}
+		for i, l := range test.lengths {
+			info.Files = append(info.Files, FileDict{Length: l, Path: []string{string(rune('a' + i))}})
+		}
+		store, size, err := NewFileStore(info, ram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := store.(*fileStore)
+		// Whichever file the last read or write ended in.
+		for last := range test.lengths {
+			fs.last = int32(last)
+			for offset, want := range test.found {
+				if got := fs.find(int64(offset)); got != want {
+					t.Errorf("%s: after file %d, offset %d is in file %d, not %d", test.name, last, offset, got, want)
+				}
+			}
+		}
+
+		// Write it all a piece at a time, and read it back across the files.
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i + 1)
+		}
+		for piece := 0; int64(piece)*info.PieceLength < size; piece++ {
+			end := int64(piece+1) * info.PieceLength
+			if end > size {
+				end = size
+			}
+			if n, err := fs.WritePiece(data[int64(piece)*info.PieceLength:end], piece); err != nil || int64(n) != end-int64(piece)*info.PieceLength {
+				t.Errorf("%s: writing piece %d, %d, %v", test.name, piece, n, err)
+			}
+		}
+		got := make([]byte, size+2)
+		if n, err := fs.ReadAt(got, 0); size > 0 && (n != len(got) || err != nil) {
+			t.Errorf("%s: reading, %d, %v", test.name, n, err)
+		} else if size == 0 && err != ErrOffsetBeyondStore {
+			t.Errorf("%s: reading an empty store, %v", test.name, err)
+		}
+		if !bytes.Equal(got[:size], data) || !bytes.Equal(got[size:], []byte{0, 0}) {
+			t.Errorf("%s: read %v, wrote %v", test.name, got, data)
+		}
+		// Each file has its own part.
+		var offset int64
+		for i, l := range test.lengths {
+			b := make([]byte, l)
+			if _, err = fs.files[i].file.ReadAt(b, 0); err != nil || !bytes.Equal(b, data[offset:offset+l]) {
+				t.Errorf("%s: file %d has %v, %v", test.name, i, b, err)
+			}
+			offset += l
+		}
+		if size == 0 {
+			// Zeros can still be written past the end, though they
+			// aren't written anywhere; anything else can't.
+			if n, err := fs.WritePiece(make([]byte, 4), 0); n != 0 || err != nil {
+				t.Errorf("%s: writing zeros past the end, %d, %v", test.name, n, err)
+			}
+			n, err := fs.WritePiece([]byte{0, 0, 1, 0}, 0)
+			if e, ok := err.(*ErrWriteBeyondStore); n != 0 || !ok || e.Offset != 2 || e.Size != 0 {
+				t.Errorf("%s: writing data past the end, %d, %v", test.name, n, err)
+			}
+		} else if first, last := fs.filesFor(0, size); fs.files[first].length == 0 || fs.files[last].length == 0 {
+			t.Errorf("%s: spans files %d to %d", test.name, first, last)
+		}
+	}
+}
+
+// Reads that end at the end of the store, run off it, or start past it.
+func TestFileStoreReadAtEnd(t *testing.T) {
+	ram, _ := NewRAMFileSystem()
+	info := &InfoDict{PieceLength: 4, Files: []FileDict{{Length: 3, Path: []string{"a"}}, {Length: 5, Path: []string{"b"}}}}
+	fs, size, err := NewFileStore(info, ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fs.WritePiece(data[:4], 0)
+	fs.WritePiece(data[4:], 1)
+	for _, test := range []struct {
+		off, length int64
+		n           int
+		err         error
+	}{
+		{4, 4, 4, nil},
+		{size - 1, 1, 1, nil},
+		{6, 4, 4, nil},
+		{size - 1, 16, 16, nil},
+		{size, 1, 0, ErrOffsetBeyondStore},
+		{size + 12, 4, 0, ErrOffsetBeyondStore},
+		{size, 0, 0, nil},
+	} {
+		got := make([]byte, test.length)
+		for i := range got {
+			got[i] = 0xff
+		}
+		n, err := fs.ReadAt(got, test.off)
+		if n != test.n || err != test.err {
+			t.Errorf("%d bytes at %d: read %d, %v, not %d, %v", test.length, test.off, n, err, test.n, test.err)
+		}
+		want := make([]byte, test.length)
+		if test.off < size {
+			copy(want, data[test.off:])
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%d bytes at %d: read %v, not %v", test.length, test.off, got, want)
+		}
+	}
+}
+
+// A File that reads and writes at most 7 bytes at a time, and says io.EOF
+// along with the last of its bytes.
+type shortFile struct {
+	File
+	length int64
+}
+
+func (s shortFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if len(p) > 7 {
+		p = p[:7]
+	}
+	n, err = s.File.ReadAt(p, off)
+	if err == nil && off+int64(n) == s.length {
+		err = io.EOF
+	}
+	return
+}
+
+func (s shortFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if len(p) > 7 {
+		p = p[:7]
+	}
+	return s.File.WriteAt(p, off)
+}
+
+// A File that never gets anywhere.
+type stuckFile struct {
+	File
+}
+
+func (stuckFile) ReadAt(p []byte, off int64) (int, error)  { return 0, nil }
+func (stuckFile) WriteAt(p []byte, off int64) (int, error) { return 0, nil }
+
+func TestFileStoreShortReadsAndWrites(t *testing.T) {
+	lengths := []int64{30, 0, 5, 64}
+	info := &InfoDict{PieceLength: 16}
+	for i, l := range lengths {
+		info.Files = append(info.Files, FileDict{Length: l, Path: []string{string(rune('a' + i))}})
+	}
+	data := make([]byte, 99)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	contents := func(short bool) (got []byte, files [][]byte) {
+		ram, err := NewRAMFileSystem()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, _, err := NewFileStore(info, ram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := store.(*fileStore)
+		if short {
+			for i := range fs.files {
+				fs.files[i].file = shortFile{fs.files[i].file, fs.files[i].length}
+			}
+		}
+		for piece := 0; piece*16 < len(data); piece++ {
+			end := (piece + 1) * 16
+			if end > len(data) {
+				end = len(data)
+			}
+			if n, err := fs.WritePiece(data[piece*16:end], piece); err != nil || n != end-piece*16 {
+				t.Fatalf("Writing piece %d: %d, %v", piece, n, err)
+			}
+		}
+		got = make([]byte, len(data))
+		if n, err := fs.ReadAt(got, 0); err != nil || n != len(data) {
+			t.Fatalf("Reading: %d, %v", n, err)
+		}
+		for i, l := range lengths {
+			b := make([]byte, l)
+			readFullAt(fs.files[i].file, b, 0)
+			files = append(files, b)
+		}
+		return
+	}
+	want, wantFiles := contents(false)
+	got, gotFiles := contents(true)
+	if !bytes.Equal(want, data) || !bytes.Equal(got, want) || !reflect.DeepEqual(gotFiles, wantFiles) {
+		t.Errorf("Short reads and writes gave %v, %v, not %v, %v", got, gotFiles, want, wantFiles)
+	}
+
+	// But a File that gets nowhere is given up on.
+	ram, _ := NewRAMFileSystem()
+	stuck, _ := ram.Open([]string{"stuck"}, 10)
+	fs := &fileStore{offsets: []int64{0}, files: []fileEntry{{10, stuckFile{stuck}}}, pieceSize: 10, ends: []int64{10}}
+	if _, err := fs.ReadAt(make([]byte, 10), 0); err != io.ErrNoProgress {
+		t.Errorf("Reading a stuck file: %v", err)
+	}
+	if _, err := fs.WritePiece(make([]byte, 10), 0); err != io.ErrShortWrite {
+		t.Errorf("Writing a stuck file: %v", err)
+	}
+	// And one that ends early is an error.
+	fs.files[0].file = shortFile{stuck, 7}
+	if _, err := fs.ReadAt(make([]byte, 10), 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("Reading past the end of a file: %v", err)
+	}
+}
+
+// A File that holds nothing, so the benchmarks time the store and not the
+// files.
+type nullFile struct{}
+
+func (nullFile) ReadAt(p []byte, off int64) (int, error)  { return len(p), nil }
+func (nullFile) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+func (nullFile) Close() error                             { return nil }
+
+const benchFileLen = 1024
+
+func benchFileStore(n int) *fileStore {
+	files := make([]fileEntry, n)
+	offsets, ends := make([]int64, n), make([]int64, n)
+	for i := range files {
+		files[i] = fileEntry{benchFileLen, nullFile{}}
+		offsets[i] = int64(i) * benchFileLen
+		ends[i] = offsets[i] + benchFileLen
+	}
+	// A piece size of 1 lets WritePiece write at any offset.
+	return &fileStore{offsets: offsets, files: files, pieceSize: 1, ends: ends}
+}
+
+// Reads and writes that span one file, two, and many, in order through the
+// store and at random, for stores of 10, 10k and 200k files.
+func BenchmarkFileStore(b *testing.B) {
+	spans := []struct {
+		name   string
+		start  int64 // Into the first file
+		length int
+	}{
+		{"1file", 256, 256},
+		{"2files", benchFileLen / 2, benchFileLen},
+		{"many", benchFileLen / 2, 8 * benchFileLen},
+	}
+	for _, n := range []int{10, 10000, 200000} {
+		fs := benchFileStore(n)
+		size := int64(n) * benchFileLen
+		for _, span := range spans {
+			p := make([]byte, span.length)
+			// The offsets to go through: each file's in turn, or shuffled.
+			inOrder := make([]int64, 0, n)
+			for off := span.start; off+int64(span.length) <= size; off += int64(span.length) {
+				inOrder = append(inOrder, off)
+			}
+			random := make([]int64, len(inOrder))
+			for i, j := range rand.New(rand.NewSource(1)).Perm(len(inOrder)) {
+				random[i] = inOrder[j]
+			}
+			for _, order := range []struct {
+				name string
+				offs []int64
+			}{{"seq", inOrder}, {"random", random}} {
+				offs := order.offs
+				b.Run(fmt.Sprintf("%d/%s/%s/read", n, span.name, order.name), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						if _, err := fs.ReadAt(p, offs[i%len(offs)]); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+				b.Run(fmt.Sprintf("%d/%s/%s/write", n, span.name, order.name), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						if _, err := fs.WritePiece(p, int(offs[i%len(offs)])); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// A File whose Close fails, like one on a network file system that only finds
+// out then that it couldn't save what was written.
+type closeFailFile struct {
+	File
+	err    error
+	closes *int
+}
+
+func (f closeFailFile) Close() error {
+	*f.closes++
+	f.File.Close()
+	return f.err
+}
+
+func TestFileStoreCloseErrors(t *testing.T) {
+	ram, _ := NewRAMFileSystem()
+	errA, errC := errors.New("a failed"), errors.New("c failed")
+	var closes int
+	var files []fileEntry
+	for i, err := range []error{errA, nil, errC} {
+		f, _ := ram.Open([]string{string(rune('a' + i))}, 10)
+		files = append(files, fileEntry{10, closeFailFile{f, err, &closes}})
+	}
+	fs := &fileStore{offsets: []int64{0, 10, 20}, files: files, pieceSize: 10, ends: []int64{10, 20, 30}}
+
+	err := fs.Close()
+	if !errors.Is(err, errA) || !errors.Is(err, errC) {
+		t.Errorf("Close returned %v, not both files' errors", err)
+	}
+	if closes != 3 {
+		t.Errorf("Closed %d files of 3", closes)
+	}
+	// Closing again doesn't close the files again.
+	if err = fs.Close(); err != nil || closes != 3 {
+		t.Errorf("Closing again returned %v, and closed %d files", err, closes)
+	}
+
+	// The caches pass it on.
+	closes = 0
+	fs = &fileStore{offsets: []int64{0, 10, 20}, files: files, pieceSize: 10, ends: []int64{10, 20, 30}}
+	cache := NewRamCacheProvider(1).NewCache("closing", 3, 10, 30, fs)
+	if err = cache.Close(); !errors.Is(err, errA) {
+		t.Errorf("Closing the cache returned %v", err)
+	}
+}
+
+// A FileSystem that's slow to open files, like one across a network, and
+// fails to open the file named fail.
+type slowFS struct {
+	FileSystem
+	mu            sync.Mutex
+	opening, most int // At once
+	open          int
+	fail          string
+}
+
+type slowFile struct {
+	File
+	name string
+	fs   *slowFS
+}
+
+func (f slowFile) Close() error {
+	f.fs.mu.Lock()
+	f.fs.open--
+	f.fs.mu.Unlock()
+	return f.File.Close()
+}
+
+func (s *slowFS) Open(name []string, length int64) (File, error) {
+	s.mu.Lock()
+	if s.opening++; s.opening > s.most {
+		s.most = s.opening
+	}
+	s.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opening--
+	if name[0] == s.fail {
+		return nil, errors.New("Couldn't open " + name[0])
+	}
+	f, err := s.FileSystem.Open(name, length)
+	if err == nil {
+		s.open++
+		f = slowFile{f, name[0], s}
+	}
+	return f, err
+}
+
+func TestNewFileStoreParallel(t *testing.T) {
+	ram, _ := NewRAMFileSystem()
+	info := &InfoDict{PieceLength: 10}
+	for i := 0; i < 100; i++ {
+		info.Files = append(info.Files, FileDict{Length: int64(i % 3), Path: []string{fmt.Sprint(i)}})
+	}
+	info.Files[50].Attr = "p"
+
+	slow := &slowFS{FileSystem: ram}
+	var progress openProgress
+	store, size, err := openFileStore(context.Background(), info, slow, 8, &progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slow.most < 2 || slow.most > 8 {
+		t.Errorf("Opened %d files at once, with 8 allowed", slow.most)
+	}
+	if progress.opened != 99 || progress.files != 99 {
+		t.Errorf("Progress says %d of %d files opened, not 99 of 99", progress.opened, progress.files)
+	}
+	fs := store.(*fileStore)
+	var offset int64
+	for i, e := range fs.files {
+		if i == 50 {
+			if _, ok := e.file.(padFile); !ok {
+				t.Errorf("File 50 is a %T, not padding", e.file)
+			}
+		} else if f, ok := e.file.(slowFile); !ok || f.name != fmt.Sprint(i) {
+			t.Errorf("File %d is %v", i, e.file)
+		}
+		if e.length != info.Files[i].Length || fs.offsets[i] != offset {
+			t.Errorf("File %d is %d bytes at %d", i, e.length, fs.offsets[i])
+		}
+		offset += e.length
+	}
+	if size != offset {
+		t.Errorf("Size %d, not %d", size, offset)
+	}
+	fs.Close()
+
+	// A file that can't be opened stops the rest, and the ones opened are
+	// closed.
+	slow = &slowFS{FileSystem: ram, fail: "30"}
+	if _, _, err = openFileStore(context.Background(), info, slow, 8, nil); err == nil || err.Error() != "Couldn't open 30" {
+		t.Errorf("Got %v", err)
+	}
+	if slow.open != 0 {
+		t.Errorf("Left %d files open", slow.open)
+	}
+}
+
+// The zeros that pad out the last piece aren't written, or counted, past the
+// end of the store; anything else there is an error, saying where.
+func TestWritePiecePastEnd(t *testing.T) {
+	ram, _ := NewRAMFileSystem()
+	fs, _, err := NewFileStore(&InfoDict{Name: "end", Length: 10, PieceLength: 8}, ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if n, err := fs.WritePiece([]byte{1, 2, 0, 0, 0, 0, 0, 0}, 1); n != 2 || err != nil {
+		t.Errorf("Writing the padded last piece, %d, %v", n, err)
+	}
+	n, err := fs.WritePiece([]byte{1, 2, 0, 4, 0, 0, 0, 0}, 1)
+	if e, ok := err.(*ErrWriteBeyondStore); n != 2 || !ok || e.Offset != 11 || e.Size != 10 {
+		t.Errorf("Writing past the end, %d, %v", n, err)
+	}
+}
+
+// OS files, and the directories they go in, are only made when they're first
+// written to, and read as zeros until then, so a partly downloaded torrent
+// has only the files it's downloaded into. Empty files have nothing to
+// download, so they're made straight away.
+func TestOsFilesMadeWhenWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, _ := OsFsProvider{}.NewFS(dir)
+	info := &InfoDict{PieceLength: 4, Files: []FileDict{
+		{Length: 6, Path: []string{"a", "x"}},
+		{Length: 2, Path: []string{"b", "y"}},
+		{Length: 2, Path: []string{"pad"}, Attr: "p"},
+		{Length: 4, Path: []string{"c", "d", "z"}},
+		{Length: 0, Path: []string{"e", "empty"}},
+	}}
+	onDisk := func() (paths []string) {
+		filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if rel, _ := filepath.Rel(dir, p); err == nil && rel != "." {
+				paths = append(paths, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		sort.Strings(paths)
+		return
+	}
+	store, _, err := NewFileStore(info, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := onDisk(); !reflect.DeepEqual(paths, []string{"e", "e/empty"}) {
+		t.Errorf("Opened, %q are on disk", paths)
+	}
+	got := make([]byte, 8)
+	if n, err := store.ReadAt(got, 4); n != 8 || err != nil || !bytes.Equal(got, make([]byte, 8)) {
+		t.Errorf("Read %v before writing, %d, %v", got, n, err)
+	}
+	// The second piece spills into the second file.
+	if _, err = store.WritePiece([]byte{1, 2, 3, 4}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if paths := onDisk(); !reflect.DeepEqual(paths, []string{"a", "a/x", "b", "b/y", "e", "e/empty"}) {
+		t.Errorf("After a piece, %q are on disk", paths)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "a", "x")); err != nil || fi.Size() != 6 {
+		t.Errorf("a/x is %v, %v", fi, err)
+	}
+	if n, err := store.ReadAt(got, 0); n != 8 || err != nil || !bytes.Equal(got, []byte{0, 0, 0, 0, 1, 2, 3, 4}) {
+		t.Errorf("Read %v, %d, %v", got, n, err)
+	}
+	store.Close()
+
+	// Opening them again finds the ones there are, and still doesn't make
+	// the rest.
+	if store, _, err = NewFileStore(info, fs); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if n, err := store.ReadAt(got, 0); n != 8 || err != nil || !bytes.Equal(got, []byte{0, 0, 0, 0, 1, 2, 3, 4}) {
+		t.Errorf("Opened again, read %v, %d, %v", got, n, err)
+	}
+	if paths := onDisk(); len(paths) != 6 {
+		t.Errorf("Opened again, %q are on disk", paths)
+	}
+	if _, err = store.WritePiece([]byte{0, 0, 7, 8}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c", "d", "z")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Web seeds (BEP 19): a plain web server with a copy of the torrent's files.
+// Pieces are fetched with Range requests on the files they lie in.
+
+type getRightSeed struct {
+	seed        WebSeed
+	pieceLength int64
+}
+
+// A webSeedRangeError says the server doesn't do Range requests, so it's no
+// use to us.
+type webSeedRangeError struct {
+	url string
+}
+
+func (e *webSeedRangeError) Error() string {
+	return fmt.Sprintf("Web seed %s ignores Range requests", e.url)
+}
+
+// One Range request for each file the pieces lie in.
+func (g *getRightSeed) webSeedParts(pieces []webSeedPiece) (parts []webSeedPart) {
+	start := int64(pieces[0].index) * g.pieceLength
+	end := start
+	for _, p := range pieces {
+		end += int64(p.length)
+	}
+	for _, f := range g.seed.Files {
+		lo, hi := f.Offset, f.Offset+f.Length
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo >= hi {
+			continue
+		}
+		part := webSeedPart{url: f.URL, length: hi - lo}
+		if f.URL != "" {
+			// Padding files are all zeros, so they have no URL.
+			f, offset, length := f, lo-f.Offset, hi-lo
+			part.open = func(ctx context.Context, client *http.Client) (io.ReadCloser, error) {
+				return g.openRange(ctx, client, f, offset, length)
+			}
+		}
+		parts = append(parts, part)
+	}
+	return
+}
+
+// Asks for length bytes of the file from offset.
+func (g *getRightSeed) openRange(ctx context.Context, client *http.Client, f WebSeedFile, offset, length int64) (body io.ReadCloser, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", f.URL, nil)
+	if err != nil {
+		return
+	}
+	last := offset + length - 1
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, last))
+	r, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	switch r.StatusCode {
+	case http.StatusPartialContent:
+		var first, end int64
+		if cr := r.Header.Get("Content-Range"); cr != "" {
+			if _, err = fmt.Sscanf(cr, "bytes %d-%d", &first, &end); err != nil || first != offset || end != last {
+				err = fmt.Errorf("Web seed sent %q for bytes %d-%d of %s", cr, offset, last, f.URL)
+			}
+		}
+	case http.StatusOK:
+		// The whole file, which is fine if that's what we asked for.
+		if offset != 0 || length != f.Length {
+			err = &webSeedRangeError{f.URL}
+		}
+	case http.StatusServiceUnavailable:
+		err = &webSeedBusyError{retryAfter(r.Header.Get("Retry-After"))}
+	default:
+		err = &webSeedStatusError{f.URL, r.StatusCode}
+	}
+	if err != nil {
+		r.Body.Close()
+		return
+	}
+	return r.Body, nil
+}
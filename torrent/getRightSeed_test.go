@@ -0,0 +1,142 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Writes a directory of files of the given sizes with random contents, and
+// returns their contents one after the other.
+func writeWebSeedFiles(t *testing.T, dir string, sizes ...int) (content []byte) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(19))
+	for i, size := range sizes {
+		b := make([]byte, size)
+		r.Read(b)
+		if err := ioutil.WriteFile(filepath.Join(dir, string(rune('a'+i))), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		content = append(content, b...)
+	}
+	return
+}
+
+func TestGetRightSeedFetchPieces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getright")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := writeWebSeedFiles(t, filepath.Join(dir, "d"), 5000, 3000)
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	m := &MetaInfo{WebSeeds: []string{server.URL}}
+	m.Info = InfoDict{PieceLength: 4096, Name: "d", Files: []FileDict{
+		{Length: 5000, Path: []string{"a"}}, {Length: 3000, Path: []string{"b"}}}}
+	g := &getRightSeed{m.ResolveWebSeeds()[0], m.Info.PieceLength}
+
+	// The second piece spans both files.
+	for _, pieces := range [][]webSeedPiece{{{1, 3904}}, {{0, 4096}, {1, 3904}}} {
+		data, err := fetchPieces(g, pieces)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := pieces[0].index * 4096
+		if !bytes.Equal(data, content[start:]) {
+			t.Errorf("Pieces %v don't match the files", pieces)
+		}
+	}
+
+	// A server that ignores Range is no use for part of a file.
+	whole := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content[:5000])
+	}))
+	defer whole.Close()
+	m.WebSeeds = []string{whole.URL}
+	g = &getRightSeed{m.ResolveWebSeeds()[0], m.Info.PieceLength}
+	if _, err = fetchPieces(g, []webSeedPiece{{1, 3904}}); err == nil {
+		t.Error("Got a piece from a server that ignores Range")
+	} else if _, ok := err.(*webSeedRangeError); !ok {
+		t.Errorf("Got %v, expected a webSeedRangeError", err)
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "served")
+	content := writeWebSeedFiles(t, filepath.Join(seedDir, "files"), 70000, 1, 50000)
+	m, err := CreateTorrent(filepath.Join(seedDir, "files"), &CreateOptions{PieceLength: 32 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	files := http.FileServer(http.Dir(seedDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	m.WebSeeds = []string{server.URL + "/"}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leechDir := filepath.Join(dir, "leech")
+	flags := &TorrentFlags{
+		FileDir:            leechDir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          0,
+	}
+	if err = os.Mkdir(leechDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	leecher, done := startTestSession(t, flags, torrentFile, swarm)
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for the web seed download")
+	}
+	var got []byte
+	for _, name := range []string{"a", "b", "c"} {
+		b, err := ioutil.ReadFile(filepath.Join(leechDir, "files", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Downloaded %d bytes that don't match the %d bytes served", len(got), len(content))
+	}
+	if leecher.Session.WebSeedDownloaded != uint64(len(content)) || leecher.Session.Downloaded != leecher.Session.WebSeedDownloaded {
+		t.Errorf("Web seeds downloaded %d of %d bytes, want all %d", leecher.Session.WebSeedDownloaded, leecher.Session.Downloaded, len(content))
+	}
+	// The pieces are small enough to fetch in one run, a request per file.
+	if requests != 3 {
+		t.Errorf("Made %d requests for 3 files", requests)
+	}
+}
@@ -0,0 +1,50 @@
+package torrent
+
+import (
+	"time"
+)
+
+// A verified piece's Have isn't sent to every peer at once, but waits a little
+// for the pieces verified after it, so that a burst of them, as at the end of
+// a recheck or on a fast connection, goes to each peer in one write, rather
+// than one for every piece and peer. They go through the peer's writer like
+// any other message, behind whatever's queued before them. A peer that was
+// sent our bitfield after a piece was verified isn't told of it again.
+
+// How long a Have waits for others, at most.
+const HAVE_BATCH_INTERVAL = 250 * time.Millisecond
+
+func (ts *TorrentSession) queueHave(piece int) {
+	if len(ts.pendingHaves) == 0 {
+		ts.haveFlush = ts.clock().After(HAVE_BATCH_INTERVAL)
+	}
+	ts.pendingHaves = append(ts.pendingHaves, piece)
+}
+
+func (ts *TorrentSession) sendBitfield(p *peerState) {
+	p.SendBitfield(ts.pieceSet)
+	p.havesSent = len(ts.pendingHaves)
+}
+
+// Sends each peer the queued Haves for the pieces it doesn't have.
+func (ts *TorrentSession) flushHaves() {
+	for _, p := range ts.peers {
+		if p.have == nil {
+			continue
+		}
+		var msgs []byte
+		for _, piece := range ts.pendingHaves[p.havesSent:] {
+			if piece < p.have.n && p.have.IsSet(piece) {
+				continue
+			}
+			msgs = append(msgs, 0, 0, 0, 5, HAVE, 0, 0, 0, 0)
+			uint32ToBytes(msgs[len(msgs)-4:], uint32(piece))
+		}
+		p.havesSent = 0
+		if len(msgs) > 0 {
+			p.sendFramed(msgs)
+		}
+	}
+	ts.pendingHaves = ts.pendingHaves[:0]
+	ts.haveFlush = nil
+}
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// The next write to conn.
+func readWrite(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func haveMessages(pieces ...int) (msgs []byte) {
+	for _, piece := range pieces {
+		msgs = append(msgs, 0, 0, 0, 5, HAVE, 0, 0, 0, byte(piece))
+	}
+	return
+}
+
+// A peer with piece 1 is told of 0 and 2 in one write, and a peer sent our
+// bitfield after 0 and 1 only of 2.
+func TestHavesBatched(t *testing.T) {
+	// One's left, so that the torrent isn't finished.
+	pieces := make([][]byte, 5)
+	for i := range pieces {
+		pieces[i] = make([]byte, STANDARD_BLOCK_LENGTH)
+	}
+	ts, p, theirs := hashingSession(t, pieces)
+	defer theirs.Close()
+	p.have = NewBitset(len(pieces))
+	p.have.Set(1)
+	finish := func(piece int) {
+		ts.activePieces[piece] = newActivePiece(STANDARD_BLOCK_LENGTH)
+		copy(ts.activePieces[piece].buffer, pieces[piece])
+		ts.RecordBlock(p, uint32(piece), 0, STANDARD_BLOCK_LENGTH)
+		hashQueued(ts)
+	}
+	finish(0)
+	finish(1)
+
+	ours2, theirs2 := net.Pipe()
+	defer theirs2.Close()
+	p2 := NewPeerState(ours2)
+	p2.address = "peer2"
+	p2.have = NewBitset(len(pieces))
+	ts.peers[p2.address] = p2
+	go p2.peerWriter(make(chan peerMessage, 1))
+	ts.sendBitfield(p2)
+	if msg := readMessage(theirs2, BITFIELD); msg == nil || msg[1] != 0xc0 {
+		t.Fatalf("Sent bitfield %x", msg)
+	}
+	finish(2)
+	if ts.haveFlush == nil || len(ts.pendingHaves) != 3 {
+		t.Fatalf("%d Haves queued", len(ts.pendingHaves))
+	}
+
+	ts.flushHaves()
+	if got, want := readWrite(t, theirs), haveMessages(0, 2); !bytes.Equal(got, want) {
+		t.Errorf("Sent the first peer %x, not %x", got, want)
+	}
+	if got, want := readWrite(t, theirs2), haveMessages(2); !bytes.Equal(got, want) {
+		t.Errorf("Sent the second peer %x, not %x", got, want)
+	}
+	if ts.haveFlush != nil || len(ts.pendingHaves) != 0 {
+		t.Error("Haves left queued")
+	}
+
+	// The next ones are told to both.
+	finish(3)
+	ts.flushHaves()
+	for _, conn := range []net.Conn{theirs, theirs2} {
+		if got, want := readWrite(t, conn), haveMessages(3); !bytes.Equal(got, want) {
+			t.Errorf("Sent %x, not %x", got, want)
+		}
+	}
+}
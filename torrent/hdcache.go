@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -19,27 +20,35 @@ import (
 //are recalculated so they total <= capacity (in MiB).
 type HdCacheProvider struct {
 	capacity int
+	mu       sync.Mutex //Guards caches, as torrents make and close theirs on their own goroutines
 	caches   map[string]*HdCache
+	cacheHits
 }
 
 func NewHdCacheProvider(capacity int) CacheProvider {
 	os.Mkdir(filepath.FromSlash(os.TempDir()+"/taipeitorrent"), 0777)
-	rc := &HdCacheProvider{capacity, make(map[string]*HdCache)}
+	rc := &HdCacheProvider{capacity: capacity, caches: make(map[string]*HdCache)}
 	return rc
 }
 
+func (r *HdCacheProvider) diskSpace() int64 {
+	return int64(r.capacity) * 1024 * 1024
+}
+
 func (r *HdCacheProvider) NewCache(infohash string, numPieces int, pieceSize int64, torrentLength int64, underlying FileStore) FileStore {
 	i := uint32(1)
 	rc := &HdCache{pieceSize: pieceSize, atimes: make([]time.Time, numPieces), boxExists: *NewBitset(numPieces),
 		boxPrefix:     filepath.FromSlash(os.TempDir() + "/taipeitorrent/" + hex.EncodeToString([]byte(infohash)) + "-"),
 		torrentLength: torrentLength, cacheProvider: r, capacity: &i, infohash: infohash, underlying: underlying}
 	rc.empty() //clear out any detritus from previous runs
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.caches[infohash] = rc
 	r.rebalance()
 	return rc
 }
 
-//Rebalance the cache capacity allocations; has to be called on each cache creation or deletion.
+//Rebalance the cache capacity allocations; has to be called on each cache creation or deletion, with mu held.
 func (r *HdCacheProvider) rebalance() {
 	//Cache size is a diminishing return thing:
 	//The more of it a torrent has, the less of a difference additional cache makes.
@@ -61,13 +70,13 @@ func (r *HdCacheProvider) rebalance() {
 		log.Printf("Setting cache '%x' to new capacity %v (%v MiB)", cache.infohash, newCap, float32(newCap*cache.pieceSize)/float32(1024*1024))
 		cache.setCapacity(uint32(newCap))
 	}
-
-		for _, cache := range r.caches {
-			cache.trim()
-		}
-	}
+	//Each cache trims itself to its new capacity when it next adds a piece,
+	//on its own torrent's goroutine.
+}
 
 func (r *HdCacheProvider) cacheClosed(infohash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	delete(r.caches, infohash)
 	r.rebalance()
 }
@@ -107,12 +116,23 @@ func (r *HdCache) empty() {
 	}
 }
 
+//Drops the cached pieces, to free the disk space.
+func (r *HdCache) Flush() error {
+	for i := 0; i < r.boxExists.Len(); i++ {
+		if r.boxExists.IsSet(i) {
+			r.removeBox(i)
+		}
+	}
+	return nil
+}
+
 func (r *HdCache) ReadAt(p []byte, off int64) (retInt int, retErr error) {
 	boxI := int(off / r.pieceSize)
 	boxOff := off % r.pieceSize
 
 	for i := 0; i < len(p); {
 		copied := 0
+		r.cacheProvider.count(r.boxExists.IsSet(boxI))
 		if !r.boxExists.IsSet(boxI) { //not in cache
 			bufferLength := r.pieceSize
 			bufferOffset := int64(boxI) * r.pieceSize
@@ -155,17 +175,31 @@ func (r *HdCache) ReadAt(p []byte, off int64) (retInt int, retErr error) {
 	return
 		}
 
+//Writes the piece through, and caches it once it's written. A box we have
+//already may have been read in before the piece was, so it's dropped.
 func (r *HdCache) WritePiece(p []byte, boxI int) (n int, retErr error) {
-
-	if r.boxExists.IsSet(boxI) { //box exists, our work is done
-		log.Println("Got a WritePiece for a piece we should already have:", boxI)
+	if r.boxExists.IsSet(boxI) {
+		r.removeBox(boxI)
+	}
+	//TODO: Maybe goroutine the calls to underlying?
+	if n, retErr = r.underlying.WritePiece(p, boxI); retErr != nil {
 		return
-		}
-
+	}
 	r.addBox(p, boxI)
+	return
+}
 
-	//TODO: Maybe goroutine the calls to underlying?
-	return r.underlying.WritePiece(p, boxI)
+//Writes a segment of a piece that isn't verified yet through, dropping the
+//box we have of the piece, if any, as it's out of date.
+func (r *HdCache) WriteSegment(p []byte, boxI int, begin int) (n int, err error) {
+	if r.boxExists.IsSet(boxI) {
+		r.removeBox(boxI)
+	}
+	return writeSegment(r.underlying, p, boxI, begin)
+}
+
+func (r *HdCache) writesSegments() bool {
+	return canWriteSegments(r.underlying)
 }
 
 func (r *HdCache) addBox(p []byte, boxI int) {
@@ -0,0 +1,157 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hooks: commands run when a torrent is added, finishes downloading, or is
+// removed, for post-processing and notifications. A hook's command is split
+// into words, and then these are replaced in each word, so names with spaces
+// stay one argument:
+//
+//	{name}      The torrent's name
+//	{infohash}  Its info-hash, in hex
+//	{dir}       The directory its files go under
+//	{path}      Its files: the single file, or the directory holding them
+//	{size}      Its size in bytes
+//	{label}     Its first label, or nothing
+//	{labels}    Its labels, comma separated
+//
+// A hook runs in the background with a time limit, and what it prints is
+// logged. Its failing doesn't affect the torrent. A torrent's hooks run one
+// at a time, in the order of their events, so its complete hook doesn't race
+// its added one.
+
+const HOOK_DEFAULT_TIMEOUT = 10 * time.Minute
+
+type hook struct {
+	event   string // What it's run on, for the log
+	command string
+	vars    *strings.Replacer
+	name    string // The torrent's
+}
+
+func (ts *TorrentSession) hook(event, command string) *hook {
+	if command == "" {
+		return nil
+	}
+	path, _ := ts.content.Load().(string)
+	labels, label := ts.Labels(), ""
+	if len(labels) > 0 {
+		label = labels[0]
+	}
+	// One pass over each word, so a variable in a name or a label is left
+	// as it is.
+	return &hook{event, command, strings.NewReplacer(
+		"{name}", ts.M.Info.Name,
+		"{infohash}", hex.EncodeToString([]byte(ts.M.InfoHash)),
+		"{dir}", ts.fileDir,
+		"{path}", path,
+		"{size}", strconv.FormatInt(ts.totalSize, 10),
+		"{label}", label,
+		"{labels}", strings.Join(labels, ","),
+	), ts.M.Info.Name}
+}
+
+// The hook's command, split and with its variables replaced.
+func (h *hook) args() (args []string) {
+	for _, word := range strings.Fields(h.command) {
+		if h.vars != nil {
+			word = h.vars.Replace(word)
+		}
+		args = append(args, word)
+	}
+	return
+}
+
+// Runs the hook, waiting for it, for at most timeout, or
+// HOOK_DEFAULT_TIMEOUT if it's 0. A nil hook does nothing.
+func (h *hook) run(timeout time.Duration) (err error) {
+	if h == nil {
+		return
+	}
+	if timeout <= 0 {
+		timeout = HOOK_DEFAULT_TIMEOUT
+	}
+	args := h.args()
+	if len(args) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		log.Println("[", h.name, "]", h.event, "hook:", scanner.Text())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Println("[", h.name, "] The", h.event, "hook took longer than", timeout, "so it was killed")
+	} else if err != nil {
+		log.Println("[", h.name, "] The", h.event, "hook failed:", err)
+	}
+	return
+}
+
+// A torrent's hooks waiting to run, in order.
+type hookQueue struct {
+	mu      sync.Mutex
+	pending []*hook
+	running bool
+}
+
+// Runs the hook in the background once the ones before it have run. A nil
+// hook does nothing.
+func (q *hookQueue) add(h *hook, timeout time.Duration) {
+	if h == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, h)
+	if !q.running {
+		q.running = true
+		go q.runAll(timeout)
+	}
+}
+
+func (q *hookQueue) runAll(timeout time.Duration) {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		h := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+		h.run(timeout)
+	}
+}
+
+// Runs the completion hook, once: the resume data remembers it ran, so
+// restarting doesn't run it again. Called in the loop once the last piece is
+// written.
+func (ts *TorrentSession) runCompleteHook() {
+	if ts.flags.OnComplete == "" || ts.completeHookRan {
+		return
+	}
+	ts.completeHookRan = true
+	// So the hook sees all the files.
+	if f, ok := ts.fileStore.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			log.Println("[", ts.M.Info.Name, "] Couldn't flush the cache:", err)
+		}
+	}
+	ts.saveResumeData()
+	ts.hooks.add(ts.hook("complete", ts.flags.OnComplete), ts.flags.HookTimeout)
+}
@@ -0,0 +1,130 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHookArgs(t *testing.T) {
+	ts := &TorrentSession{M: &MetaInfo{InfoHash: "\xab\xcd", Info: InfoDict{Name: "My Files"}}, fileDir: "/downloads", totalSize: 100}
+	ts.content.Store("/downloads/My Files")
+	h := ts.hook("test", "mv  {path} /done/{name}-{infohash}.{size}")
+	if args := h.args(); !reflect.DeepEqual(args, []string{"mv", "/downloads/My Files", "/done/My Files-abcd.100"}) {
+		t.Errorf("Args %q", args)
+	}
+	// Variables in the name aren't replaced in turn.
+	ts.M.Info.Name = "{dir}{infohash}"
+	h = ts.hook("test", "echo {name}")
+	if args := h.args(); !reflect.DeepEqual(args, []string{"echo", "{dir}{infohash}"}) {
+		t.Errorf("Args %q", args)
+	}
+	if err := (*hook)(nil).run(0); err != nil {
+		t.Errorf("A nil hook: %v", err)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("No sleep command")
+	}
+	start := time.Now()
+	if err := (&hook{event: "test", command: "sleep 10"}).run(100 * time.Millisecond); err == nil {
+		t.Error("A hook that ran too long didn't fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Killing the hook took %v", elapsed)
+	}
+}
+
+func TestCompleteHook(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("No shell to run the hook")
+	}
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "served")
+	content := writeWebSeedFiles(t, filepath.Join(seedDir, "files"), 40000, 30000)
+	server := httptest.NewServer(http.FileServer(http.Dir(seedDir)))
+	defer server.Close()
+	m, err := CreateTorrent(filepath.Join(seedDir, "files"), &CreateOptions{PieceLength: 16384, WebSeeds: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hookLog := filepath.Join(dir, "hooks.log")
+	script := filepath.Join(dir, "hook.sh")
+	if err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+hookLog+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	flags := &TorrentFlags{
+		FileDir:            filepath.Join(dir, "leech"),
+		DataDir:            filepath.Join(dir, "data"),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		QuickResume:        true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          math.Inf(0),
+		WebSeedOnly:        true,
+		OnAdded:            script + " added {name}",
+		OnComplete:         script + " complete {name} {size}",
+	}
+	run := func() {
+		done := make(chan error)
+		go func() { done <- RunTorrents(flags, []string{torrentFile}) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("Timed out waiting for the download")
+		}
+	}
+	waitForLog := func(want string) {
+		var got []byte
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if got, _ = ioutil.ReadFile(hookLog); string(got) == want {
+				return
+			}
+		}
+		t.Fatalf("Hooks logged %q, want %q", got, want)
+	}
+
+	run()
+	waitForLog("added files\ncomplete files 70000\n")
+	if r := loadResumeData(flags.DataDir, m.InfoHash); r == nil || !r.CompleteHookRan {
+		t.Errorf("The resume data doesn't say the hook ran: %+v", r)
+	}
+	// Damaged and downloaded again, it's still only completed once.
+	damaged := filepath.Join(flags.FileDir, "files", "a")
+	if err = ioutil.WriteFile(damaged, make([]byte, 40000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	waitForLog("added files\ncomplete files 70000\nadded files\n")
+	if b, err := ioutil.ReadFile(damaged); err != nil || !bytes.Equal(b, content[:40000]) {
+		t.Errorf("Not downloaded again: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP seeds (BEP 17): a script on a web server that serves the torrent's
+// pieces, one per request, given the info-hash and a piece number.
+
+type httpSeed struct {
+	url      string
+	infoHash string
+}
+
+// The URL of a request for a piece.
+func (h *httpSeed) pieceURL(piece int) string {
+	sep := "?"
+	if strings.Contains(h.url, "?") {
+		sep = "&"
+	}
+	return h.url + sep + "info_hash=" + url.QueryEscape(h.infoHash) + "&piece=" + strconv.Itoa(piece)
+}
+
+// One request for each piece.
+func (h *httpSeed) webSeedParts(pieces []webSeedPiece) (parts []webSeedPart) {
+	for _, p := range pieces {
+		p := p
+		parts = append(parts, webSeedPart{h.pieceURL(p.index), int64(p.length),
+			func(ctx context.Context, client *http.Client) (io.ReadCloser, error) {
+				return h.openPiece(ctx, client, p)
+			}})
+	}
+	return
+}
+
+func (h *httpSeed) openPiece(ctx context.Context, client *http.Client, p webSeedPiece) (body io.ReadCloser, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", h.pieceURL(p.index), nil)
+	if err != nil {
+		return
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	switch r.StatusCode {
+	case http.StatusOK:
+		return r.Body, nil
+	case http.StatusServiceUnavailable:
+		// The server is busy. The body says how many seconds to wait.
+		b, _ := ioutil.ReadAll(io.LimitReader(r.Body, 32))
+		err = &webSeedBusyError{retryAfter(strings.TrimSpace(string(b)))}
+	default:
+		err = &webSeedStatusError{h.pieceURL(p.index), r.StatusCode}
+	}
+	r.Body.Close()
+	return
+}
+
+// Parses a number of seconds to wait, defaulting to WEB_SEED_RETRY.
+func retryAfter(s string) time.Duration {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return WEB_SEED_RETRY
+}
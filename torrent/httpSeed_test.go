@@ -0,0 +1,131 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHTTPSeedPieceURL(t *testing.T) {
+	h := &httpSeed{"http://seed/s.php", "\x01 abcdefghijklmnopq"}
+	if got, want := h.pieceURL(3), "http://seed/s.php?info_hash=%01+abcdefghijklmnopq&piece=3"; got != want {
+		t.Errorf("pieceURL = %v, want %v", got, want)
+	}
+	h.url = "http://seed/s.php?id=7"
+	if got, want := h.pieceURL(0), "http://seed/s.php?id=7&info_hash=%01+abcdefghijklmnopq&piece=0"; got != want {
+		t.Errorf("pieceURL = %v, want %v", got, want)
+	}
+}
+
+// Serves pieces of data like an HTTP seed.
+func httpSeedHandler(infoHash string, data []byte, pieceLength int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("info_hash") != infoHash {
+			http.NotFound(w, r)
+			return
+		}
+		piece, err := strconv.Atoi(r.FormValue("piece"))
+		if err != nil || piece < 0 || piece*pieceLength >= len(data) {
+			http.Error(w, "bad piece", http.StatusBadRequest)
+			return
+		}
+		w.Write(data[piece*pieceLength : min(len(data), (piece+1)*pieceLength)])
+	}
+}
+
+func TestHTTPSeedFetchPieces(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxy")
+	server := httptest.NewServer(httpSeedHandler("ih", data, 10))
+	defer server.Close()
+	h := &httpSeed{server.URL, "ih"}
+	got, err := fetchPieces(h, []webSeedPiece{{2, 10}, {3, 5}})
+	if err != nil || string(got) != "klmnopqrstuvwxy" {
+		t.Errorf("fetchPieces = %q, %v", got, err)
+	}
+	if _, err = fetchPieces(h, []webSeedPiece{{0, 11}}); err == nil {
+		t.Error("Expected an error for a short piece")
+	}
+	if _, err = fetchPieces(h, []webSeedPiece{{9, 10}}); err == nil {
+		t.Error("Expected an error for a missing piece")
+	}
+
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("42"))
+	}))
+	defer busy.Close()
+	_, err = fetchPieces(&httpSeed{busy.URL, "ih"}, []webSeedPiece{{0, 10}})
+	if e, ok := err.(*webSeedBusyError); !ok || e.retryAfter != 42*time.Second {
+		t.Errorf("Busy server gave %#v, want a 42s webSeedBusyError", err)
+	}
+}
+
+func TestHTTPSeedDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 200*1024+5)
+	rand.New(rand.NewSource(5)).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(dir, "content"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateTorrent(filepath.Join(dir, "content"), &CreateOptions{PieceLength: 32 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(httpSeedHandler(m.InfoHash, content, 32*1024))
+	defer server.Close()
+	m.HTTPSeeds = []string{server.URL + "/seed"}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leechDir := filepath.Join(dir, "leech")
+	flags := &TorrentFlags{
+		FileDir:            leechDir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          0,
+	}
+	if err = os.Mkdir(leechDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	leecher, done := startTestSession(t, flags, torrentFile, swarm)
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for the HTTP seed download")
+	}
+	got, err := ioutil.ReadFile(filepath.Join(leechDir, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Downloaded %d bytes that don't match the %d bytes served", len(got), len(content))
+	}
+	if len(leecher.webSeedPool) != 1 || leecher.webSeedPool[0].health.Downloaded != int64(len(content)) {
+		t.Errorf("HTTP seed downloaded %d bytes, want %d", leecher.webSeedPool[0].health.Downloaded, len(content))
+	}
+	if leecher.Session.Downloaded != uint64(len(content)) {
+		t.Errorf("Session downloaded %d bytes, want %d", leecher.Session.Downloaded, len(content))
+	}
+}
@@ -0,0 +1,84 @@
+package swarm
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock is a torrent.Clock that only moves when it's told to.
+// Multiple goroutines may use a Clock at the same time.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// A channel waiting for the clock to reach at, and then, if it's a ticker,
+// every period after.
+type waiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewClock returns a clock that says it's now until it's moved.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.wait(d, 0)
+}
+
+// Tick, like time.Tick, returns nil if d isn't positive.
+func (c *Clock) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return c.wait(d, d)
+}
+
+func (c *Clock) wait(d, period time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{c.now.Add(d), period, make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		w.c <- c.now
+		return w.c
+	}
+	c.waiters = append(c.waiters, w)
+	return w.c
+}
+
+// Advance moves the clock on by d, sending on the channels of the timers
+// and tickers that are due. A ticker that's due more than once in d sends
+// once, as a real one does for a receiver that's slow.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		select {
+		case w.c <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.at.After(c.now) {
+				w.at = w.at.Add(w.period)
+			}
+			waiting = append(waiting, w)
+		}
+	}
+	c.waiters = waiting
+}
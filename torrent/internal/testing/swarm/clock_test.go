@@ -0,0 +1,51 @@
+package swarm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewClock(start)
+	after, tick := c.After(2*time.Second), c.Tick(time.Second)
+	ready := func(ch <-chan time.Time) (time.Time, bool) {
+		select {
+		case now := <-ch:
+			return now, true
+		default:
+			return time.Time{}, false
+		}
+	}
+
+	c.Advance(time.Second)
+	if _, ok := ready(after); ok {
+		t.Error("After fired early")
+	}
+	if now, ok := ready(tick); !ok || !now.Equal(start.Add(time.Second)) {
+		t.Errorf("First tick %v, %v", now, ok)
+	}
+	c.Advance(time.Second)
+	if now, ok := ready(after); !ok || !now.Equal(c.Now()) {
+		t.Errorf("After %v, %v", now, ok)
+	}
+	// A tick that's missed is dropped.
+	c.Advance(3 * time.Second)
+	c.Advance(time.Second)
+	if _, ok := ready(tick); !ok {
+		t.Error("No tick")
+	}
+	if _, ok := ready(tick); ok {
+		t.Error("Two ticks waiting")
+	}
+	c.Advance(time.Hour)
+	if _, ok := ready(after); ok {
+		t.Error("After fired twice")
+	}
+	if !c.Now().Equal(start.Add(time.Hour + 6*time.Second)) {
+		t.Errorf("Now is %v", c.Now())
+	}
+	if c.Tick(0) != nil {
+		t.Error("Ticking every 0s")
+	}
+}
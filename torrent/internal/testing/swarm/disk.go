@@ -0,0 +1,66 @@
+package swarm
+
+import (
+	"path"
+	"sync"
+
+	"github.com/jackpal/Taipei-Torrent/torrent"
+)
+
+// A Disk is a torrent.FsProvider that keeps its files in RAM. Unlike the
+// "ram" provider's, they're still there when it's opened again, so a node
+// can be given a seed's files before it starts, and they can be read back
+// after. Every file system it makes has the same files, whatever the
+// directory.
+type Disk struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+type diskFS struct {
+	d *Disk
+}
+
+type diskFile struct {
+	d    *Disk
+	name string
+}
+
+func (d *Disk) NewFS(directory string) (torrent.FileSystem, error) {
+	return diskFS{d}, nil
+}
+
+func (fs diskFS) Open(name []string, length int64) (torrent.File, error) {
+	key := path.Join(name...)
+	fs.d.mu.Lock()
+	defer fs.d.mu.Unlock()
+	if fs.d.files == nil {
+		fs.d.files = make(map[string][]byte)
+	}
+	if b := fs.d.files[key]; int64(len(b)) != length {
+		resized := make([]byte, length)
+		copy(resized, b)
+		fs.d.files[key] = resized
+	}
+	return diskFile{fs.d, key}, nil
+}
+
+func (fs diskFS) Close() error {
+	return nil
+}
+
+func (f diskFile) ReadAt(p []byte, off int64) (n int, err error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	return copy(p, f.d.files[f.name][off:]), nil
+}
+
+func (f diskFile) WriteAt(p []byte, off int64) (n int, err error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	return copy(f.d.files[f.name][off:], p), nil
+}
+
+func (f diskFile) Close() error {
+	return nil
+}
@@ -0,0 +1,507 @@
+// Package swarm runs torrent sessions together in a swarm in the process,
+// for testing how they get on with each other: how pieces spread, what's
+// requested of whom, what happens over minutes of their time. Its nodes keep
+// their files in RAM and talk over net.Pipe connections, each with an
+// address of its own, and find each other through a tracker the test can
+// script. Every message they send each other is seen by the test, in order.
+//
+// The sessions take the time from the swarm's Clock, which moves only while
+// the swarm's waiting for something. While the nodes are sending each other
+// messages, or waiting for blocks they've asked for, it keeps pace with the
+// real clock, so that what's under way isn't timed out early, even by a peer
+// whose uploads are limited on the real clock. While they're quiet, it runs
+// ahead. A test can wait for minutes of the sessions' time in a second or two
+// of its own.
+//
+// It's in a package of its own, so that the features of package torrent can
+// ship with tests of it in a swarm. Those tests are in package torrent_test.
+package swarm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpal/Taipei-Torrent/torrent"
+)
+
+const (
+	// The tracker's address, which the swarm's torrents announce to.
+	TRACKER = "tracker.swarm:80"
+	// How far the clock moves for each QUIET of real time the nodes are
+	// quiet for.
+	STEP  = time.Second
+	QUIET = 10 * time.Millisecond
+	// How long a wait can take in real time, however little the clock's
+	// moved, before it gives up.
+	REAL_TIMEOUT = 2 * time.Minute
+	// How long a node's check of its files can take.
+	CHECK_TIMEOUT = 10 * time.Second
+)
+
+// A Swarm is the nodes sharing a torrent of random bytes.
+type Swarm struct {
+	Meta    *torrent.MetaInfo
+	Content []byte // What the torrent's file holds
+	Clock   *Clock
+
+	t           testing.TB
+	dir         string // Has the .torrent file
+	torrentFile string
+	tracker     *pipeListener
+
+	mu    sync.Mutex
+	nodes []*Node
+	// PeersFor gives the peers the tracker tells a node that announces, of
+	// the ones it knows of. Nil gives all of them.
+	PeersFor func(n *Node, known []*Node) []*Node
+	// Every message sent over the swarm's connections.
+	sent  []message
+	links []*link
+}
+
+// A Node is one of a swarm's sessions.
+type Node struct {
+	Addr    string
+	Session *torrent.TorrentSession
+
+	swarm    *Swarm
+	provider torrent.FsProvider
+	done     chan bool
+	started  bool
+	// Whether the tracker's heard from it, so it gives it out.
+	announced bool
+}
+
+type message struct {
+	from, to string
+	msg      []byte // Without its length
+}
+
+// New makes a swarm for a torrent of size random bytes, in pieces of
+// pieceLength. Stop it when the test's done.
+func New(t testing.TB, size int, pieceLength int64) *Swarm {
+	dir, err := ioutil.TempDir("", "swarm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(dir, "content"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := torrent.CreateTorrent(filepath.Join(dir, "content"), &torrent.CreateOptions{PieceLength: pieceLength, Announce: "http://" + TRACKER + "/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Swarm{Meta: m, Content: content, Clock: NewClock(time.Now()), t: t, dir: dir, torrentFile: torrentFile, tracker: newPipeListener()}
+	go http.Serve(s.tracker, http.HandlerFunc(s.announce))
+	return s
+}
+
+// AddNode adds a node that keeps its files on a Disk of its own, a seed if
+// seed is set. It's started by Start.
+func (s *Swarm) AddNode(seed bool) *Node {
+	return s.AddNodeWith(seed, &Disk{}, nil)
+}
+
+// AddNodeWith adds a node that keeps its files with provider, with flags
+// changed by setup if it isn't nil. A seed's files are written with
+// provider, which must keep them for the session to find.
+func (s *Swarm) AddNodeWith(seed bool, provider torrent.FsProvider, setup func(flags *torrent.TorrentFlags)) *Node {
+	s.mu.Lock()
+	n := &Node{Addr: fmt.Sprintf("10.0.0.%d:6881", len(s.nodes)+1), swarm: s, provider: provider, done: make(chan bool)}
+	s.nodes = append(s.nodes, n)
+	s.mu.Unlock()
+	if seed {
+		if _, err := n.file(func(f torrent.File) (int, error) { return f.WriteAt(s.Content, 0) }); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	flags := &torrent.TorrentFlags{
+		FileSystemProvider: provider,
+		Dial:               dialer{s, n.Addr},
+		Clock:              s.Clock,
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          math.Inf(0),
+	}
+	if setup != nil {
+		setup(flags)
+	}
+	ts, err := torrent.NewTorrentSession(flags, s.torrentFile, 6881)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	n.Session = ts
+	return n
+}
+
+// Does f with the node's file.
+func (n *Node) file(f func(torrent.File) (int, error)) (int, error) {
+	fs, err := n.provider.NewFS("")
+	if err != nil {
+		return 0, err
+	}
+	defer fs.Close()
+	file, err := fs.Open([]string{n.swarm.Meta.Info.Name}, int64(len(n.swarm.Content)))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return f(file)
+}
+
+func (n *Node) Start() {
+	n.swarm.mu.Lock()
+	n.started = true
+	n.swarm.mu.Unlock()
+	go func() {
+		n.Session.DoTorrent()
+		close(n.done)
+	}()
+}
+
+// Stop stops every node, waiting for them, and the tracker.
+func (s *Swarm) Stop() {
+	for _, n := range s.nodes {
+		if n.started {
+			n.Session.Quit()
+			<-n.done
+		}
+	}
+	s.tracker.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Run moves the clock on until done returns true or d has passed on it. It
+// returns whether done did.
+func (s *Swarm) Run(d time.Duration, done func() bool) bool {
+	end, realEnd := s.Clock.Now().Add(d), time.Now().Add(REAL_TIMEOUT)
+	sent, _ := s.activity()
+	for !done() {
+		if !s.Clock.Now().Before(end) || time.Now().After(realEnd) {
+			return false
+		}
+		start := time.Now()
+		time.Sleep(QUIET)
+		n, waiting := s.activity()
+		if n != sent || waiting {
+			sent = n
+			s.Clock.Advance(time.Since(start))
+		} else {
+			s.Clock.Advance(STEP)
+		}
+	}
+	return true
+}
+
+// How many messages the nodes have sent each other, and whether any are
+// waiting for blocks they've asked for.
+func (s *Swarm) activity() (sent int, waiting bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.links {
+		waiting = waiting || l.waiting()
+	}
+	return len(s.sent), waiting
+}
+
+// WaitForComplete waits for each node to have every piece, failing the test
+// if they don't within d on the clock.
+func (s *Swarm) WaitForComplete(d time.Duration, nodes ...*Node) {
+	s.t.Helper()
+	complete := s.Run(d, func() bool {
+		for _, n := range nodes {
+			if st := n.Status(); st.GoodPieces != st.Pieces {
+				return false
+			}
+		}
+		return true
+	})
+	if !complete {
+		s.t.Fatalf("Not complete after %v", d)
+	}
+}
+
+// Status is the node's session's, failing the test if it's ended.
+func (n *Node) Status() torrent.TorrentStatus {
+	st, err := n.Session.Status()
+	if err != nil {
+		n.swarm.t.Fatal(err)
+	}
+	return st
+}
+
+// WaitForCheck waits for the node's check of its files, if it's checking,
+// to be done, and returns its status then.
+func (n *Node) WaitForCheck() torrent.TorrentStatus {
+	n.swarm.t.Helper()
+	for deadline := time.Now().Add(CHECK_TIMEOUT); ; time.Sleep(20 * time.Millisecond) {
+		if st := n.Status(); !st.Checking {
+			return st
+		}
+		if time.Now().After(deadline) {
+			n.swarm.t.Fatal("Timed out waiting for the check")
+		}
+	}
+}
+
+// Content is what the node's files hold.
+func (n *Node) Content() []byte {
+	b := make([]byte, len(n.swarm.Content))
+	if _, err := n.file(func(f torrent.File) (int, error) { return f.ReadAt(b, 0) }); err != nil {
+		n.swarm.t.Fatal(err)
+	}
+	return b
+}
+
+// Messages returns the messages of type id sent from one node to another,
+// either of which may be nil for any.
+func (s *Swarm) Messages(id byte, from, to *Node) (msgs [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.sent {
+		if len(m.msg) > 0 && m.msg[0] == id && (from == nil || m.from == from.Addr) && (to == nil || m.to == to.Addr) {
+			msgs = append(msgs, m.msg)
+		}
+	}
+	return
+}
+
+// RequestedBlocks returns the blocks requested in msgs, as piece<<32 |
+// begin, and how many times.
+func RequestedBlocks(msgs [][]byte) map[uint64]int {
+	blocks := make(map[uint64]int)
+	for _, m := range msgs {
+		if len(m) == 13 {
+			blocks[uint64(binary.BigEndian.Uint32(m[1:5]))<<32|uint64(binary.BigEndian.Uint32(m[5:9]))]++
+		}
+	}
+	return blocks
+}
+
+// Announces, as the tracker: the announcing node, known by where it's
+// connecting from, is given the peers that have announced before it.
+func (s *Swarm) announce(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	var self *Node
+	var known []*Node
+	for _, n := range s.nodes {
+		if n.Addr == r.RemoteAddr {
+			self = n
+		} else if n.announced {
+			known = append(known, n)
+		}
+	}
+	if self == nil {
+		s.mu.Unlock()
+		http.Error(w, "Not in the swarm", http.StatusForbidden)
+		return
+	}
+	self.announced = true
+	peers := known
+	if s.PeersFor != nil {
+		peers = s.PeersFor(self, known)
+	}
+	s.mu.Unlock()
+	var compact []byte
+	for _, n := range peers {
+		a, _ := net.ResolveTCPAddr("tcp", n.Addr)
+		compact = append(compact, a.IP.To4()...)
+		compact = append(compact, byte(a.Port>>8), byte(a.Port))
+	}
+	fmt.Fprintf(w, "d8:intervali1e5:peers%d:%se", len(compact), compact)
+}
+
+// Connects a node to another, or to the tracker, over a pipe.
+type dialer struct {
+	s    *Swarm
+	from string
+}
+
+func (d dialer) Dial(network, addr string) (net.Conn, error) {
+	ours, theirs := net.Pipe()
+	a := &conn{Conn: ours, swarm: d.s, local: d.from, remote: addr}
+	b := &conn{Conn: theirs, swarm: d.s, local: addr, remote: d.from}
+	if addr == TRACKER {
+		if !d.s.tracker.connect(b) {
+			return nil, errors.New("The tracker's stopped")
+		}
+		return a, nil
+	}
+	var to *Node
+	d.s.mu.Lock()
+	for _, n := range d.s.nodes {
+		if n.Addr == addr && n.started {
+			to = n
+		}
+	}
+	d.s.mu.Unlock()
+	if to == nil {
+		return nil, errors.New("Connection refused")
+	}
+	l := &link{}
+	a.link, b.link = l, l
+	b.side = 1
+	d.s.mu.Lock()
+	d.s.links = append(d.s.links, l)
+	d.s.mu.Unlock()
+	go func() {
+		c, err := torrent.ReadBtConn(b)
+		if err != nil {
+			b.Close()
+			return
+		}
+		to.Session.AcceptNewPeer(c)
+	}()
+	return a, nil
+}
+
+// One end of a pipe between two of the swarm's addresses. Connections between
+// nodes pass what they write, after the header, on to the swarm.
+type conn struct {
+	net.Conn
+	swarm         *Swarm
+	local, remote string
+	link          *link  // Nil for the tracker's
+	side          int    // Which end of the link it is
+	written       []byte // Not yet a whole message
+	headerDone    bool
+}
+
+// A connection between two nodes. Use it with the swarm's lock held.
+type link struct {
+	asked  [2]map[uint64]bool // The blocks each end's waiting for, as piece<<32 | begin
+	closed bool
+}
+
+// Takes note of a message sent from side.
+func (l *link) sent(side int, msg []byte) {
+	var block uint64
+	if len(msg) >= 9 {
+		block = uint64(binary.BigEndian.Uint32(msg[1:5]))<<32 | uint64(binary.BigEndian.Uint32(msg[5:9]))
+	}
+	switch {
+	case msg[0] == torrent.REQUEST && len(msg) == 13:
+		if l.asked[side] == nil {
+			l.asked[side] = make(map[uint64]bool)
+		}
+		l.asked[side][block] = true
+	case msg[0] == torrent.CANCEL && len(msg) == 13:
+		delete(l.asked[side], block)
+	case msg[0] == torrent.PIECE && len(msg) >= 9:
+		delete(l.asked[1-side], block)
+	case msg[0] == torrent.CHOKE:
+		// Without the fast extension, it drops their requests.
+		l.asked[1-side] = nil
+	}
+}
+
+func (l *link) waiting() bool {
+	return !l.closed && len(l.asked[0])+len(l.asked[1]) > 0
+}
+
+func (c *conn) Close() error {
+	if c.link != nil {
+		c.swarm.mu.Lock()
+		c.link.closed = true
+		c.swarm.mu.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+func (c *conn) LocalAddr() net.Addr  { return addr(c.local) }
+func (c *conn) RemoteAddr() net.Addr { return addr(c.remote) }
+
+// Writes come from one goroutine at a time: the session's peer writer, or the
+// one sending the header before it's started.
+func (c *conn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	if c.link != nil {
+		c.written = append(c.written, p[:n]...)
+		if !c.headerDone {
+			if len(c.written) < 68 {
+				return
+			}
+			c.written, c.headerDone = c.written[68:], true
+		}
+		for len(c.written) >= 4 {
+			length := int(binary.BigEndian.Uint32(c.written[:4]))
+			if len(c.written) < 4+length {
+				break
+			}
+			msg := append([]byte(nil), c.written[4:4+length]...)
+			c.written = c.written[4+length:]
+			c.swarm.mu.Lock()
+			c.swarm.sent = append(c.swarm.sent, message{c.local, c.remote, msg})
+			if len(msg) > 0 {
+				c.link.sent(c.side, msg)
+			}
+			c.swarm.mu.Unlock()
+		}
+	}
+	return
+}
+
+type addr string
+
+func (a addr) Network() string { return "tcp" }
+func (a addr) String() string  { return string(a) }
+
+// A net.Listener whose connections are handed to it.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan bool
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan bool)}
+}
+
+func (l *pipeListener) connect(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return addr(TRACKER) }
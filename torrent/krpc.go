@@ -0,0 +1,455 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// KRPC, the DHT's protocol. Source:
+// http://bittorrent.org/beps/bep_0005.html
+//
+// The DHT library makes its own queries, but doesn't tell us who answered
+// them. krpcClient makes the queries whose answers we need, from a UDP socket
+// of its own, and in read-only mode (see dhtReadOnly.go) all of them. It only
+// asks: queries sent to it are ignored, so its own say so with BEP 43's
+// "ro":1, and other nodes leave it out of their routing tables. Its node ID
+// is a random one until setExternalIP gives it one BEP 42 allows.
+
+const (
+	// How long we wait for a node to answer.
+	KRPC_TIMEOUT = 5 * time.Second
+	// Queries in flight at once. More wait for one of them to finish.
+	krpcMaxOutstanding = 64
+	krpcMaxPacket      = 4096
+	// A lookup starts from this many of the saved nodes, and the bootstrap
+	// nodes, and asks dhtLookupAlpha nodes at a time, closest first. It's
+	// done once the closest dhtLookupK nodes that answered are closer than
+	// any left to ask, or after dhtLookupMaxQueries.
+	dhtLookupStartNodes = 16
+	dhtLookupAlpha      = 4
+	dhtLookupK          = 8
+	dhtLookupMaxQueries = 64
+)
+
+var errKRPCTimeout = errors.New("The DHT node didn't answer")
+
+// krpcClient sends KRPC queries and matches the responses to them.
+// Multiple goroutines may use a krpcClient at the same time.
+type krpcClient struct {
+	conn    net.PacketConn
+	timeout time.Duration
+	slots   chan bool // One entry per query in flight.
+	// The address families we look nodes up in, as BEP 32's "want" names
+	// them. Set before the client's used. Empty means just IPv4.
+	families []string
+
+	mu      sync.Mutex
+	id      string // Our node ID
+	port    int    // The port we announce, as peers. See setPort.
+	next    uint16 // The next transaction ID
+	pending map[string]*krpcQuery
+	stats   krpcStats
+}
+
+// Our KRPC client's traffic since it started.
+type krpcStats struct {
+	Queries   int   // Sent
+	Replies   int   // Responses to them
+	Errors    int   // Error replies, and responses we couldn't use
+	Timeouts  int   // Queries that went unanswered
+	BytesSent int64 // In queries
+	BytesRead int64 // In every packet that reached us
+}
+
+// A query waiting for its response.
+type krpcQuery struct {
+	addr  string // Who it was sent to. Only they can answer it.
+	reply chan krpcReply
+}
+
+type krpcReply struct {
+	r   map[string]interface{}
+	err error
+}
+
+// newKRPCClient listens on a port of its own, on bind if it's not nil.
+func newKRPCClient(bind net.IP) (c *krpcClient, err error) {
+	addr := ":0"
+	if bind != nil {
+		addr = net.JoinHostPort(bind.String(), "0")
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return
+	}
+	id := make([]byte, 20)
+	if _, err = rand.Read(id); err != nil {
+		conn.Close()
+		return
+	}
+	c = &krpcClient{
+		conn:    conn,
+		timeout: KRPC_TIMEOUT,
+		slots:   make(chan bool, krpcMaxOutstanding),
+		id:      string(id),
+		pending: make(map[string]*krpcQuery),
+	}
+	go c.read()
+	return
+}
+
+// setExternalIP makes our node ID one that BEP 42 allows for ip.
+func (c *krpcClient) setExternalIP(ip net.IP) {
+	id := bep42NodeID(ip, mrand.New(mrand.NewSource(time.Now().UnixNano())))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id = id
+}
+
+// setPort sets the port we tell nodes we're a peer on when we announce.
+func (c *krpcClient) setPort(port int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.port = port
+}
+
+func (c *krpcClient) Stats() krpcStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *krpcClient) ID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+func (c *krpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// query sends the query method, with args, to the node at addr, and returns
+// the "r" dictionary of its response. An error response is an error.
+func (c *krpcClient) query(addr, method string, args map[string]interface{}) (r map[string]interface{}, err error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	c.slots <- true
+	defer func() { <-c.slots }()
+
+	c.mu.Lock()
+	t := string([]byte{byte(c.next >> 8), byte(c.next)})
+	c.next++
+	args["id"] = c.id
+	q := &krpcQuery{udpAddr.String(), make(chan krpcReply, 1)}
+	c.pending[t] = q
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, t)
+		c.mu.Unlock()
+	}()
+
+	var buf bytes.Buffer
+	if err = bencode.Marshal(&buf, map[string]interface{}{"t": t, "y": "q", "q": method, "a": args, "ro": 1}); err != nil {
+		return
+	}
+	if _, err = c.conn.WriteTo(buf.Bytes(), udpAddr); err != nil {
+		return
+	}
+	c.count(func(s *krpcStats) {
+		s.Queries++
+		s.BytesSent += int64(buf.Len())
+	})
+	select {
+	case reply := <-q.reply:
+		return reply.r, reply.err
+	case <-time.After(c.timeout):
+		c.count(func(s *krpcStats) { s.Timeouts++ })
+		return nil, errKRPCTimeout
+	}
+}
+
+func (c *krpcClient) count(f func(s *krpcStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.stats)
+}
+
+// Reads responses until the socket's closed, handing each to its query.
+func (c *krpcClient) read() {
+	buf := make([]byte, krpcMaxPacket)
+	for {
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		c.count(func(s *krpcStats) { s.BytesRead += int64(n) })
+		decoded, err := bencode.Decode(bytes.NewReader(buf[:n]))
+		if err != nil {
+			continue
+		}
+		msg, _ := decoded.(map[string]interface{})
+		t, _ := msg["t"].(string)
+		c.mu.Lock()
+		q := c.pending[t]
+		c.mu.Unlock()
+		if q == nil || q.addr != from.String() {
+			// Too late, someone else's, or a query.
+			continue
+		}
+		var reply krpcReply
+		switch msg["y"] {
+		case "r":
+			if reply.r, _ = msg["r"].(map[string]interface{}); reply.r == nil {
+				reply.err = errors.New("Bad KRPC response")
+			}
+		case "e":
+			reply.err = fmt.Errorf("KRPC error %v", msg["e"])
+		default:
+			continue
+		}
+		c.count(func(s *krpcStats) {
+			if s.Replies++; reply.err != nil {
+				s.Errors++
+			}
+		})
+		select {
+		case q.reply <- reply:
+		default:
+		}
+	}
+}
+
+// ping asks the node at addr for its ID.
+func (c *krpcClient) ping(addr string) (id string, err error) {
+	r, err := c.query(addr, "ping", map[string]interface{}{})
+	if err != nil {
+		return
+	}
+	if id, _ = r["id"].(string); len(id) != 20 {
+		return "", errors.New("Bad DHT node ID")
+	}
+	return
+}
+
+// A node we've heard of from another's response.
+type krpcNode struct {
+	id, addr string
+	token    string // What it gave us to announce to it with, if it's answered get_peers
+}
+
+// The parts of a get_peers response we use.
+type getPeersResponse struct {
+	id         string
+	token      string
+	values     []string   // Peers for the info-hash, in compact form
+	nodes      []krpcNode // The nodes closest to the info-hash it knows
+	bfsd, bfpe string     // The scrape filters, if it has peers for it
+}
+
+// getPeers asks the node at addr for peers for ih, and with scrape, for the
+// scrape filters of BEP 33.
+func (c *krpcClient) getPeers(addr, ih string, scrape bool) (resp *getPeersResponse, err error) {
+	args := map[string]interface{}{"info_hash": ih}
+	if scrape {
+		args["scrape"] = 1
+	}
+	if len(c.families) > 0 {
+		args["want"] = c.families
+	}
+	r, err := c.query(addr, "get_peers", args)
+	if err != nil {
+		return
+	}
+	resp = &getPeersResponse{}
+	if resp.id, _ = r["id"].(string); len(resp.id) != 20 {
+		return nil, errors.New("Bad DHT node ID")
+	}
+	nodes, _ := r["nodes"].(string)
+	resp.nodes = decodeCompactNodes(nodes, 6)
+	nodes6, _ := r["nodes6"].(string)
+	resp.nodes = append(resp.nodes, decodeCompactNodes(nodes6, 18)...)
+	resp.bfsd, _ = r["BFsd"].(string)
+	resp.bfpe, _ = r["BFpe"].(string)
+	resp.token, _ = r["token"].(string)
+	values, _ := r["values"].([]interface{})
+	for _, v := range values {
+		if peer, ok := v.(string); ok && (len(peer) == 6 || len(peer) == 18) {
+			resp.values = append(resp.values, peer)
+		}
+	}
+	return
+}
+
+// announcePeer tells the node at addr that we're a peer for ih, on port,
+// with the token it gave us.
+func (c *krpcClient) announcePeer(addr, ih, token string, port int) (err error) {
+	_, err = c.query(addr, "announce_peer", map[string]interface{}{"info_hash": ih, "port": port, "token": token})
+	return
+}
+
+// What a get_peers lookup found.
+type lookupResult struct {
+	peers    []string   // In compact form, each once
+	closest  []krpcNode // The dhtLookupK closest nodes that answered, in each family
+	scrape   dhtScrape  // With scrape, their filters combined
+	answered int
+}
+
+// lookup looks ih up, starting from the nodes at the addresses in start,
+// collecting the peers the nodes have for it and, with scrape, their scrape
+// filters. The nodes that answer are saved in nodes, but the answers of those
+// whose IDs BEP 42 doesn't allow are ignored. Each address family we look in
+// has its own closest nodes, as BEP 32 wants.
+func (c *krpcClient) lookup(ih string, start []string, scrape bool, nodes *dhtNodeTable) (res lookupResult) {
+	type family struct {
+		candidates, answered []krpcNode
+	}
+	families := map[string]*family{"n4": new(family)}
+	if len(c.families) > 0 {
+		families = make(map[string]*family)
+		for _, f := range c.families {
+			families[f] = new(family)
+		}
+	}
+	seen := make(map[string]bool)
+	add := func(n krpcNode) {
+		if f := families[dhtFamily(n.addr)]; f != nil && !seen[n.addr] {
+			seen[n.addr] = true
+			f.candidates = append(f.candidates, n)
+		}
+	}
+	for _, addr := range start {
+		add(krpcNode{addr: addr})
+	}
+	peers := make(map[string]bool)
+	type result struct {
+		addr string
+		resp *getPeersResponse
+	}
+	for queries := 0; queries < dhtLookupMaxQueries; {
+		var round []krpcNode
+		for _, f := range families {
+			sortByDistance(f.candidates, ih)
+			if len(f.candidates) == 0 ||
+				len(f.answered) >= dhtLookupK && !closer(f.candidates[0].id, f.answered[dhtLookupK-1].id, ih) {
+				continue
+			}
+			n := min(dhtLookupAlpha, len(f.candidates))
+			round = append(round, f.candidates[:n]...)
+			f.candidates = f.candidates[n:]
+		}
+		if len(round) == 0 {
+			break
+		}
+		queries += len(round)
+		results := make(chan result, len(round))
+		for _, n := range round {
+			go func(addr string) {
+				resp, err := c.getPeers(addr, ih, scrape)
+				if err != nil {
+					resp = nil
+				}
+				results <- result{addr, resp}
+			}(n.addr)
+		}
+		for range round {
+			r := <-results
+			if r.resp == nil {
+				continue
+			}
+			nodes.Seen(r.addr, r.resp.id)
+			if !bep42ValidNode(r.addr, r.resp.id) {
+				// Its ID could be one it chose to be near ih. See bep42.go.
+				continue
+			}
+			f := families[dhtFamily(r.addr)]
+			f.answered = append(f.answered, krpcNode{r.resp.id, r.addr, r.resp.token})
+			if r.resp.bfsd != "" || r.resp.bfpe != "" {
+				// A node with bad filters is just left out.
+				res.scrape.Add([]byte(r.resp.bfsd), []byte(r.resp.bfpe))
+			}
+			for _, peer := range r.resp.values {
+				if !peers[peer] {
+					peers[peer] = true
+					res.peers = append(res.peers, peer)
+				}
+			}
+			for _, n := range r.resp.nodes {
+				add(n)
+			}
+		}
+		for _, f := range families {
+			sortByDistance(f.answered, ih)
+		}
+	}
+	for _, f := range families {
+		res.answered += len(f.answered)
+		res.closest = append(res.closest, f.answered[:min(dhtLookupK, len(f.answered))]...)
+	}
+	return
+}
+
+// announce tells the nodes that gave us tokens that we're a peer for ih, on
+// the port set with setPort. It returns how many of them took it.
+func (c *krpcClient) announce(ih string, nodes []krpcNode) (announced int) {
+	c.mu.Lock()
+	port := c.port
+	c.mu.Unlock()
+	errs := make(chan error, len(nodes))
+	asked := 0
+	for _, n := range nodes {
+		if n.token == "" {
+			continue
+		}
+		asked++
+		go func(n krpcNode) {
+			errs <- c.announcePeer(n.addr, ih, n.token, port)
+		}(n)
+	}
+	for ; asked > 0; asked-- {
+		if <-errs == nil {
+			announced++
+		}
+	}
+	return
+}
+
+// Whether the node ID a is closer to target than b. IDs we don't know are
+// the furthest.
+func closer(a, b, target string) bool {
+	if len(a) != len(target) || len(b) != len(target) {
+		return len(a) == len(target) && len(b) != len(target)
+	}
+	for i := 0; i < len(target); i++ {
+		if da, db := a[i]^target[i], b[i]^target[i]; da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+func sortByDistance(nodes []krpcNode, target string) {
+	sort.SliceStable(nodes, func(i, j int) bool { return closer(nodes[i].id, nodes[j].id, target) })
+}
+
+// Decodes compact node info: each node's ID, then its address in addrLength
+// bytes, 6 for IPv4 and 18 for IPv6.
+func decodeCompactNodes(b string, addrLength int) (nodes []krpcNode) {
+	for n := 20 + addrLength; len(b) >= n; b = b[n:] {
+		nodes = append(nodes, krpcNode{id: b[:20], addr: decodeDHTPeer(b[20:n])})
+	}
+	return
+}
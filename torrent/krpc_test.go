@@ -0,0 +1,180 @@
+package torrent
+
+import (
+	"bytes"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// A DHT node that answers each query with handle's "r" dictionary, or
+// doesn't answer if it's nil.
+type fakeDHTNode struct {
+	conn   net.PacketConn
+	handle func(q string, args map[string]interface{}) map[string]interface{}
+	notRO  int32 // Queries without "ro":1. Use atomically.
+}
+
+func newFakeDHTNode(t *testing.T, handle func(q string, args map[string]interface{}) map[string]interface{}) *fakeDHTNode {
+	return newFakeDHTNodeOn(t, "127.0.0.1:0", handle)
+}
+
+func newFakeDHTNodeOn(t *testing.T, addr string, handle func(q string, args map[string]interface{}) map[string]interface{}) *fakeDHTNode {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeDHTNode{conn: conn, handle: handle}
+	go n.serve()
+	return n
+}
+
+func (n *fakeDHTNode) Addr() string { return n.conn.LocalAddr().String() }
+func (n *fakeDHTNode) Close()       { n.conn.Close() }
+
+func (n *fakeDHTNode) serve() {
+	buf := make([]byte, krpcMaxPacket)
+	for {
+		size, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		decoded, err := bencode.Decode(bytes.NewReader(buf[:size]))
+		if err != nil {
+			continue
+		}
+		msg := decoded.(map[string]interface{})
+		if msg["ro"] != int64(1) {
+			atomic.AddInt32(&n.notRO, 1)
+		}
+		q, _ := msg["q"].(string)
+		args, _ := msg["a"].(map[string]interface{})
+		r := n.handle(q, args)
+		if r == nil {
+			continue
+		}
+		var out bytes.Buffer
+		bencode.Marshal(&out, map[string]interface{}{"t": msg["t"], "y": "r", "r": r})
+		n.conn.WriteTo(out.Bytes(), from)
+	}
+}
+
+func newTestKRPCClient(t *testing.T) *krpcClient {
+	c, err := newKRPCClient(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.timeout = 200 * time.Millisecond
+	return c
+}
+
+// A node that answers a ping is recorded with its ID, and one that doesn't
+// isn't. Neither is pinged again while it's fresh.
+func TestVerifyDHTNode(t *testing.T) {
+	const id = "abcdefghij0123456789"
+	var pings int32
+	node := newFakeDHTNode(t, func(q string, args map[string]interface{}) map[string]interface{} {
+		if q != "ping" || len(args["id"].(string)) != 20 {
+			t.Errorf("Queried %q with %v", q, args)
+		}
+		atomic.AddInt32(&pings, 1)
+		return map[string]interface{}{"id": id}
+	})
+	defer node.Close()
+	silent := newFakeDHTNode(t, func(string, map[string]interface{}) map[string]interface{} { return nil })
+	defer silent.Close()
+	c := newTestKRPCClient(t)
+	defer c.Close()
+	nodes := newDHTNodeTable("")
+
+	if !verifyDHTNode(c, nodes, node.Addr()) || !verifyDHTNode(c, nodes, node.Addr()) || atomic.LoadInt32(&pings) != 1 {
+		t.Errorf("Verified the node after %d pings", pings)
+	}
+	if got := string(nodes.nodes[node.Addr()].ID); got != id {
+		t.Errorf("Recorded ID %q", got)
+	}
+	// Our ID's BEP 42's, once we know our address.
+	ip := net.ParseIP("203.0.113.7")
+	if c.setExternalIP(ip); !bep42ValidNodeID(c.ID(), ip) {
+		t.Errorf("ID %x for %v", c.ID(), ip)
+	}
+	if verifyDHTNode(c, nodes, silent.Addr()) || nodes.Len() != 1 {
+		t.Errorf("Verified a node that didn't answer, and have %d nodes", nodes.Len())
+	}
+	// The two pings, and the one that went unanswered.
+	if s := c.Stats(); s.Queries != 2 || s.Replies != 1 || s.Errors != 0 || s.Timeouts != 1 || s.BytesSent == 0 || s.BytesRead == 0 {
+		t.Errorf("Counted %+v", s)
+	}
+}
+
+// Responses from anyone but the node asked are ignored.
+func TestKRPCWrongAddress(t *testing.T) {
+	c := newTestKRPCClient(t)
+	defer c.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	silent := newFakeDHTNode(t, func(string, map[string]interface{}) map[string]interface{} { return nil })
+	defer silent.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := c.ping(silent.Addr())
+		done <- err
+	}()
+	// Transaction IDs start at 0.
+	var out bytes.Buffer
+	bencode.Marshal(&out, map[string]interface{}{"t": "\x00\x00", "y": "r", "r": map[string]interface{}{"id": "abcdefghij0123456789"}})
+	for i := 0; i < 5; i++ {
+		other.WriteTo(out.Bytes(), c.conn.LocalAddr())
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-done; err != errKRPCTimeout {
+		t.Errorf("Pinged, %v", err)
+	}
+}
+
+// A lookup ignores the answers of nodes whose IDs don't match their
+// addresses, but saves them. The IPv6 loopback address isn't one of BEP 42's
+// exempt local networks.
+func TestLookupBEP42(t *testing.T) {
+	if conn, err := net.ListenPacket("udp", "[::1]:0"); err != nil {
+		t.Skip("No IPv6:", err)
+	} else {
+		conn.Close()
+	}
+	ih := strings.Repeat("\xff", 20)
+	answer := func(id, peer string) func(string, map[string]interface{}) map[string]interface{} {
+		return func(string, map[string]interface{}) map[string]interface{} {
+			return map[string]interface{}{"id": id, "values": []interface{}{peer}}
+		}
+	}
+	validID := bep42NodeID(net.ParseIP("::1"), mrand.New(mrand.NewSource(1)))
+	good := newFakeDHTNodeOn(t, "[::1]:0", answer(validID, "\x01\x02\x03\x04\x1a\xe1"))
+	defer good.Close()
+	bad := newFakeDHTNodeOn(t, "[::1]:0", answer(strings.Repeat("\xfe", 20), "\x05\x06\x07\x08\x1a\xe1"))
+	defer bad.Close()
+
+	c, err := newKRPCClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.timeout = 200 * time.Millisecond
+	c.families = []string{"n4", "n6"}
+	nodes := newDHTNodeTable("")
+	res := c.lookup(ih, []string{good.Addr(), bad.Addr()}, false, nodes)
+	if res.answered != 1 || len(res.peers) != 1 || res.peers[0] != "\x01\x02\x03\x04\x1a\xe1" {
+		t.Errorf("%d answered, with peers %q", res.answered, res.peers)
+	}
+	if !nodes.Valid(good.Addr()) || nodes.Valid(bad.Addr()) || nodes.Len() != 2 {
+		t.Errorf("Saved %d nodes, good valid: %v, bad valid: %v", nodes.Len(), nodes.Valid(good.Addr()), nodes.Valid(bad.Addr()))
+	}
+}
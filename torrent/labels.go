@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Labels: freeform tags, like "linux-iso" or "work", for keeping a large
+// library in order. They don't change how a torrent's transferred. They're
+// given when it's added, or set later, and saved in the session state. The
+// status shows them, the control API can list just the torrents with some,
+// and hooks get them as {label}, the first, and {labels}, all of them comma
+// separated. Adding a torrent we have again adds its labels to the ones it
+// has.
+//
+// With LabelDirs, a torrent added without a directory of its own goes in the
+// one of its first label that has one.
+
+const MAX_LABEL_LENGTH = 64
+
+var errBadLabel = fmt.Errorf("Labels can be up to %d bytes, without commas, '=' or control characters", MAX_LABEL_LENGTH)
+
+// cleanLabels trims the labels, dropping empty ones and repeats, and keeping
+// their order otherwise.
+func cleanLabels(labels []string) (clean []string, err error) {
+	for _, l := range labels {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		if len(l) > MAX_LABEL_LENGTH || strings.ContainsAny(l, ",=") || strings.IndexFunc(l, unicode.IsControl) >= 0 {
+			return nil, errBadLabel
+		}
+		clean = appendUnique(clean, l)
+	}
+	return
+}
+
+// ParseLabelDirs parses LabelDirs written as "label=dir,label=dir".
+func ParseLabelDirs(s string) (dirs map[string]string, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		label, dir, ok := strings.Cut(item, "=")
+		label, dir = strings.TrimSpace(label), strings.TrimSpace(dir)
+		if !ok || label == "" || dir == "" {
+			return nil, fmt.Errorf("Bad label directory %q, not label=dir", item)
+		}
+		if _, err = cleanLabels([]string{label}); err != nil {
+			return nil, err
+		}
+		if dirs == nil {
+			dirs = make(map[string]string)
+		}
+		dirs[label] = dir
+	}
+	return
+}
+
+// The directory of the first of labels that has one, or "".
+func (m *sessionManager) labelDir(labels []string) string {
+	for _, l := range labels {
+		if dir := m.flags.LabelDirs[l]; dir != "" {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Labels can be called from any goroutine.
+func (ts *TorrentSession) Labels() []string {
+	labels, _ := ts.labels.Load().([]string)
+	return labels
+}
+
+// SetLabels replaces the torrent's labels. It's errBadLabel if one of them
+// can't be a label.
+func (ts *TorrentSession) SetLabels(labels []string) (err error) {
+	if labels, err = cleanLabels(labels); err != nil {
+		return
+	}
+	return ts.runInLoop(func() { ts.labels.Store(labels) })
+}
+
+// Adds labels, already clean, to the torrent's. Like SetLabels, it's only
+// called on the main loop, so they aren't lost between the load and the
+// store.
+func (ts *TorrentSession) addLabels(labels []string) {
+	if len(labels) > 0 {
+		ts.labels.Store(appendUnique(append([]string(nil), ts.Labels()...), labels...))
+	}
+}
+
+// Whether the torrent has every one of labels.
+func hasLabels(s *TorrentStatus, labels []string) bool {
+	for _, l := range labels {
+		if !contains(s.Labels, l) {
+			return false
+		}
+	}
+	return true
+}
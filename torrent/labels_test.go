@@ -0,0 +1,158 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCleanLabels(t *testing.T) {
+	tests := []struct {
+		labels, clean []string
+		err           error
+	}{
+		{nil, nil, nil},
+		{[]string{" work ", "", "linux-iso", "work", "  "}, []string{"work", "linux-iso"}, nil},
+		{[]string{"Work", "work"}, []string{"Work", "work"}, nil},
+		{[]string{"a,b"}, nil, errBadLabel},
+		{[]string{"a=b"}, nil, errBadLabel},
+		{[]string{"new\nline"}, nil, errBadLabel},
+		{[]string{string(make([]byte, MAX_LABEL_LENGTH+1))}, nil, errBadLabel},
+	}
+	for _, test := range tests {
+		if clean, err := cleanLabels(test.labels); !reflect.DeepEqual(clean, test.clean) || err != test.err {
+			t.Errorf("Cleaning %q: %q, %v", test.labels, clean, err)
+		}
+	}
+}
+
+func TestParseLabelDirs(t *testing.T) {
+	dirs, err := ParseLabelDirs(" linux-iso = /data/iso,work=/data/work=2, ")
+	if want := map[string]string{"linux-iso": "/data/iso", "work": "/data/work=2"}; err != nil || !reflect.DeepEqual(dirs, want) {
+		t.Errorf("Parsed %q, %v", dirs, err)
+	}
+	if dirs, err = ParseLabelDirs(""); err != nil || dirs != nil {
+		t.Errorf("Parsed nothing as %q, %v", dirs, err)
+	}
+	for _, bad := range []string{"work", "=/data", "work=", "a,b=/data"} {
+		if _, err = ParseLabelDirs(bad); err == nil {
+			t.Errorf("Parsed %q", bad)
+		}
+	}
+}
+
+// Labels given when a torrent's added choose its directory, and can be
+// listed by, changed, added to by adding it again, saved, and used by hooks.
+func TestLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	isoDir := filepath.Join(dir, "iso")
+	writeWebSeedFiles(t, filepath.Join(isoDir, "files"), 20000)
+	meta, err := CreateTorrent(filepath.Join(isoDir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if err = meta.Bencode(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            filepath.Join(dir, "downloads"),
+		LabelDirs:          map[string]string{"iso": isoDir, "other": dir},
+		DataDir:            filepath.Join(dir, "data"),
+		SeedRatio:          math.Inf(0),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		TrackerlessMode:    true,
+		MaxActive:          2,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	server := httptest.NewServer(newRPCHandler(m, "secret"))
+	defer server.Close()
+
+	var added rpcAddResponse
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents",
+		rpcAddRequest{Data: data.Bytes(), Labels: []string{" work", "iso", "work"}}, &added); code != http.StatusAccepted {
+		t.Fatalf("Adding it, %d", code)
+	}
+	const magnet = "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=unlabelled"
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents", rpcAddRequest{Torrent: magnet}, nil); code != http.StatusAccepted {
+		t.Fatalf("Adding a magnet link, %d", code)
+	}
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents", rpcAddRequest{Torrent: magnet, Labels: []string{"a,b"}}, nil); code != http.StatusBadRequest {
+		t.Errorf("Adding it with a bad label, %d", code)
+	}
+	// Its files are where its label's directory says, so it's complete.
+	waitForComplete(t, m, meta.InfoHash)
+	var s TorrentStatus
+	if rpcCall(t, server, "secret", "GET", "/api/torrents/"+added.InfoHash, nil, &s); s.FileDir != isoDir ||
+		!reflect.DeepEqual(s.Labels, []string{"work", "iso"}) {
+		t.Errorf("In %s, labelled %q", s.FileDir, s.Labels)
+	}
+
+	for query, want := range map[string]int{"": 2, "?label=iso": 1, "?label=iso&label=work": 1, "?label=iso&label=other": 0} {
+		var list []TorrentStatus
+		if code := rpcCall(t, server, "secret", "GET", "/api/torrents"+query, nil, &list); code != http.StatusOK || list == nil || len(list) != want {
+			t.Errorf("Listing %q, %d %+v", query, code, list)
+		}
+	}
+
+	path := "/api/torrents/" + added.InfoHash + "/labels"
+	if code := rpcCall(t, server, "secret", "PUT", path, rpcLabels{[]string{"archive", "a=b"}}, nil); code != http.StatusBadRequest {
+		t.Errorf("Setting a bad label, %d", code)
+	}
+	var labels rpcLabels
+	if code := rpcCall(t, server, "secret", "PUT", path, rpcLabels{[]string{"archive"}}, &labels); code != http.StatusOK ||
+		!reflect.DeepEqual(labels.Labels, []string{"archive"}) {
+		t.Errorf("Setting the labels, %d %q", code, labels.Labels)
+	}
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents",
+		rpcAddRequest{Data: data.Bytes(), Labels: []string{"more", "archive"}}, nil); code != http.StatusOK {
+		t.Errorf("Adding it again, %d", code)
+	}
+	ts, _, err := m.Torrent(meta.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); !reflect.DeepEqual(ts.Labels(), []string{"archive", "more"}); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Labelled %q after adding it again", ts.Labels())
+		}
+	}
+
+	var state *sessionState
+	m.run(func() { state = m.sessionState() })
+	for _, saved := range state.Torrents {
+		want := []string{"archive", "more"}
+		if saved.Magnet != "" {
+			want = nil
+		}
+		if !reflect.DeepEqual(saved.Labels, want) {
+			t.Errorf("Saved %+v", saved)
+		}
+	}
+	var args []string
+	ts.runInLoop(func() { args = ts.hook("complete", "sort {label} {labels}").args() })
+	if !reflect.DeepEqual(args, []string{"sort", "archive", "archive,more"}) {
+		t.Errorf("Hook args %q", args)
+	}
+}
@@ -0,0 +1,201 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// Torrents with very long pieces, 16 MiB or 32 MiB, would have each active
+// piece take a buffer that long, and each hash check read a whole piece
+// into memory. So a piece longer than SEGMENTED_PIECE_LENGTH is fetched
+// straight into the store, its blocks written as they arrive, and hashed
+// by reading it back PIECE_SEGMENT_LENGTH bytes at a time. Until its hash
+// is good, what's in the files for it is just as untrusted as a buffer's
+// blocks: it isn't in the pieceSet, so it isn't read or uploaded.
+
+// Pieces longer than this are fetched and hashed in segments.
+const SEGMENTED_PIECE_LENGTH = 8 * 1024 * 1024
+
+// How much of a piece is read at a time to hash it. It's a multiple of
+// BEP52_BLOCK_SIZE, so a v2 piece's block hashes can be worked out a
+// segment at a time.
+const PIECE_SEGMENT_LENGTH = 256 * 1024
+
+// A FileStore that can be given a piece a segment at a time, before it's
+// verified, with WriteSegment. Unlike WritePiece, the piece may turn out to
+// be bad, so a store that caches pieces drops what it has of it rather than
+// keep the segment. writesSegments says whether it can, which a store that
+// wraps another can only if that one can.
+type segmentWriter interface {
+	WriteSegment(p []byte, piece int, begin int) (written int, err error)
+	writesSegments() bool
+}
+
+var errNoSegments = errors.New("The store can't take pieces in segments")
+
+// Writes a segment to the store under a wrapper.
+func writeSegment(store FileStore, p []byte, piece int, begin int) (n int, err error) {
+	if w, ok := store.(segmentWriter); ok {
+		return w.WriteSegment(p, piece, begin)
+	}
+	return 0, errNoSegments
+}
+
+func canWriteSegments(store FileStore) bool {
+	w, ok := store.(segmentWriter)
+	return ok && w.writesSegments()
+}
+
+// A piece to fetch, with blocks of blockSize: in a buffer from the budget,
+// or if it's too long for that and the store can take it in segments, in
+// the store, which takes nothing from the budget.
+func (ts *TorrentSession) startPiece(piece, blockSize int, force bool) *ActivePiece {
+	length := ts.pieceLength(piece)
+	if length > SEGMENTED_PIECE_LENGTH && canWriteSegments(ts.fileStore) {
+		return &ActivePiece{downloaderCount: make([]int, (length+blockSize-1)/blockSize),
+			length: length, blockSize: blockSize, store: ts.fileStore}
+	}
+	return ts.pieceMemory.newActivePiece(length, blockSize, force)
+}
+
+// Puts data, from begin in the piece, in its buffer or the store.
+func (v *ActivePiece) write(piece, begin int, data []byte) (err error) {
+	if v.store == nil {
+		copy(v.buffer[begin:], data)
+		return
+	}
+	_, err = writeSegment(v.store, data, piece, begin)
+	return
+}
+
+// Pads a segmented piece of a pure v2 torrent out to the piece length in
+// the store, as finishPiece does a buffer.
+func (ts *TorrentSession) padSegmentedPiece(piece int, v *ActivePiece) (err error) {
+	zeros := make([]byte, PIECE_SEGMENT_LENGTH)
+	for begin := v.length; begin < int(ts.M.Info.PieceLength) && err == nil; begin += len(zeros) {
+		_, err = writeSegment(v.store, zeros[:min(len(zeros), int(ts.M.Info.PieceLength)-begin)], piece, begin)
+	}
+	return
+}
+
+// Reads the session's store in its loop, for the piece hashers.
+type loopReader struct {
+	ts *TorrentSession
+}
+
+func (r loopReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if e := r.ts.runInLoop(func() { n, err = r.ts.fileStore.ReadAt(p, off) }); e != nil {
+		err = e
+	}
+	return
+}
+
+// Reads a store from one goroutine at a time, for hashers that read long
+// pieces themselves. A store needn't be safe to read from more than one.
+type serialReader struct {
+	mu sync.Mutex
+	r  io.ReaderAt
+}
+
+func (s *serialReader) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.ReadAt(p, off)
+}
+
+// Reads the length bytes at off in r into h, and returns their sum. They're
+// read into buf: whole, if it's long enough, or else len(buf) bytes at a
+// time.
+func hashPieceAt(r io.ReaderAt, off int64, length int, buf []byte, h hash.Hash) (sum []byte, err error) {
+	for done := 0; done < length; {
+		segment := buf[:min(len(buf), length-done)]
+		if _, err = r.ReadAt(segment, off+int64(done)); err != nil {
+			return
+		}
+		h.Write(segment)
+		done += len(segment)
+	}
+	return h.Sum(nil), nil
+}
+
+// hashPieceAt for the checks of a torrent's data, which hash every piece
+// they can and compare the sums: errors reading a piece are ignored, since
+// missing data just fails the check.
+func pieceSumAt(r io.ReaderAt, off int64, length int, buf []byte, h hash.Hash) []byte {
+	sum, _ := hashPieceAt(r, off, length, buf, h)
+	return sum
+}
+
+// checkPieceAt is checkPiece for a piece of length bytes read from r, a
+// segment at a time, rather than from a buffer.
+func checkPieceAt(r io.ReaderAt, m *MetaInfo, pieceIndex int, length int) (good bool, err error) {
+	if m.isV2Only() {
+		if pieceIndex < 0 || pieceIndex >= len(m.piecesV2) {
+			err = fmt.Errorf("Piece %v out of range", pieceIndex)
+			return
+		}
+		length = int(m.piecesV2[pieceIndex].length)
+	}
+	h, ref := m.pieceHasher(pieceIndex)
+	var currentSum []byte
+	if currentSum, err = hashPieceAt(r, int64(pieceIndex)*m.Info.PieceLength, length, make([]byte, min(length, PIECE_SEGMENT_LENGTH)), h); err != nil {
+		return
+	}
+	good = bytes.Equal(ref, currentSum)
+	if !good {
+		err = fmt.Errorf("reference hash: %x != piece hash: %x", ref, currentSum)
+	}
+	return
+}
+
+// computeSums for pieces too long to read whole: each hasher reads the
+// pieces it hashes itself, a segment at a time, taking turns with the
+// others at the store.
+func computeSegmentedSums(ctx context.Context, fs FileStore, totalLength int64, pieceLength int64, hashers int) (sums []byte, err error) {
+	numPieces := (totalLength + pieceLength - 1) / pieceLength
+	r := &serialReader{r: fs}
+	pieces := make(chan int64)
+	results := make(chan chunk, hashers)
+	for i := 0; i < hashers; i++ {
+		go func() {
+			buf := make([]byte, PIECE_SEGMENT_LENGTH)
+			for i := range pieces {
+				length := pieceLength
+				if left := totalLength - i*pieceLength; left < length {
+					length = left
+				}
+				sum := pieceSumAt(r, i*pieceLength, int(length), buf, sha1.New())
+				select {
+				case results <- chunk{i, sum}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(pieces)
+		for i := int64(0); i < numPieces; i++ {
+			select {
+			case pieces <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	sums = make([]byte, sha1.Size*numPieces)
+	for i := int64(0); i < numPieces; i++ {
+		select {
+		case h := <-results:
+			copy(sums[h.i*sha1.Size:], h.data)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Pieces read a segment at a time hash as they do whole.
+func TestCheckPieceAt(t *testing.T) {
+	const pieceLength = 3*PIECE_SEGMENT_LENGTH + 100
+	content := make([]byte, 2*pieceLength+PIECE_SEGMENT_LENGTH/2)
+	rand.New(rand.NewSource(1)).Read(content)
+	m := &MetaInfo{Info: InfoDict{PieceLength: pieceLength}}
+	for off := 0; off < len(content); off += pieceLength {
+		sum := sha1.Sum(content[off:min(len(content), off+pieceLength)])
+		m.Info.Pieces += string(sum[:])
+	}
+	for i := 0; i < 3; i++ {
+		length := min(pieceLength, len(content)-i*pieceLength)
+		if good, err := checkPieceAt(bytes.NewReader(content), m, i, length); !good || err != nil {
+			t.Errorf("Piece %d: %v, %v", i, good, err)
+		}
+	}
+	content[pieceLength+PIECE_SEGMENT_LENGTH+1]++
+	if good, _ := checkPieceAt(bytes.NewReader(content), m, 1, pieceLength); good {
+		t.Error("A bad piece is good")
+	}
+	if good, _ := checkPieceAt(bytes.NewReader(content[:pieceLength]), m, 1, pieceLength); good {
+		t.Error("A piece that can't be read is good")
+	}
+}
+
+func TestCheckPieceAtV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bep52")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pieceLength := int64(2 * PIECE_SEGMENT_LENGTH)
+	r := rand.New(rand.NewSource(4))
+	contents := [][]byte{make([]byte, 3*PIECE_SEGMENT_LENGTH+5), make([]byte, 10)}
+	for _, c := range contents {
+		r.Read(c)
+	}
+	files := []FileDictV2{{Path: []string{"a"}}, {Path: []string{"b"}}}
+	m, err := GetMetaInfo(nil, makeTorrentV2(t, dir, "v2", files, contents, pieceLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The store, with a padded out to a piece boundary.
+	store := append(append(append([]byte(nil), contents[0]...), make([]byte, PIECE_SEGMENT_LENGTH-5)...), contents[1]...)
+	for i := range m.piecesV2 {
+		if good, err := checkPieceAt(bytes.NewReader(store), m, i, 0); !good || err != nil {
+			t.Errorf("Piece %d: %v, %v", i, good, err)
+		}
+	}
+	store[len(store)-1]++
+	if good, _ := checkPieceAt(bytes.NewReader(store), m, 2, 0); good {
+		t.Error("A bad piece is good")
+	}
+}
+
+// Segments go to the files at their place in the piece, and a cache drops
+// what it has of the piece, which they make out of date.
+func TestWriteSegment(t *testing.T) {
+	ram, _ := NewRAMFileSystem()
+	info := &InfoDict{Name: "segments", Length: 1000, PieceLength: 512}
+	fs, _, err := NewFileStore(info, ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewRamCacheProvider(1).NewCache("segments", 2, 512, 1000, &meteredStore{fs, newDiskStats()})
+	defer cache.Close()
+	if !canWriteSegments(cache) {
+		t.Fatal("The cache can't take segments")
+	}
+	old := bytes.Repeat([]byte{1}, 488)
+	if _, err = cache.WritePiece(old, 1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := cache.(segmentWriter).WriteSegment([]byte{2, 3, 4}, 1, 100); n != 3 || err != nil {
+		t.Fatalf("Wrote %d, %v", n, err)
+	}
+	got := make([]byte, 4)
+	cache.ReadAt(got, 512+99)
+	if !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Errorf("Read %v", got)
+	}
+	// The last piece is 488 bytes long, so this runs past the end.
+	if _, err = cache.(segmentWriter).WriteSegment([]byte{5, 5}, 1, 487); err == nil {
+		t.Error("Wrote past the end of the store")
+	}
+	if canWriteSegments(NewRamCacheProvider(1).NewCache("failing", 1, 512, 512, failingWrites{})) {
+		t.Error("A cache over a store that can't take segments can")
+	}
+}
@@ -1,11 +1,18 @@
 package torrent
 
 import (
+	"errors"
 	"fmt"
 	"github.com/jackpal/gateway"
+	"io"
 	"log"
+	"math/rand"
 	"net"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // btConn wraps an incoming network connection and contains metadata that helps
@@ -16,79 +23,388 @@ type BtConn struct {
 	header     []byte
 	Infohash   string
 	id         string
+	source     PeerSource
 }
 
+// How many times the listen ports are all tried before we give up, waiting
+// LISTEN_RETRY_DELAY between the first tries and twice as long each time
+// after. A port can be taken for a moment, like while a previous run's
+// connections linger.
+const (
+	LISTEN_ATTEMPTS    = 4
+	LISTEN_RETRY_DELAY = time.Second
+)
+
+var listenRetryDelay = LISTEN_RETRY_DELAY // Shortened by tests
+
+// When Accept fails, like when we're out of file descriptors, the listener
+// waits ACCEPT_BACKOFF before trying again, twice as long after each failure
+// in a row, up to ACCEPT_BACKOFF_MAX, rather than spin. A peer that connects
+// has HEADER_TIMEOUT to send its header.
+const (
+	ACCEPT_BACKOFF     = 5 * time.Millisecond
+	ACCEPT_BACKOFF_MAX = time.Second
+	HEADER_TIMEOUT     = 30 * time.Second
+)
+
 // listenForPeerConnections listens on a TCP port for incoming connections and
 // demuxes them to the appropriate active torrentSession based on the InfoHash
 // in the header.
 func ListenForPeerConnections(flags *TorrentFlags) (conChan chan *BtConn, listenPort int, err error) {
-	listener, listenPort, err := CreateListener(flags)
+	conChan = make(chan *BtConn)
+	ls, err := startPeerListeners(flags, conChan)
 	if err != nil {
 		return
 	}
-	conChan = make(chan *BtConn)
-	_, portstring, err := net.SplitHostPort(listener.Addr().String())
+	return conChan, ls[0].externalPort, nil
+}
+
+// A peerListener accepts peers' connections and hands them on, until it's
+// closed.
+type peerListener struct {
+	listener     net.Listener
+	ip           net.IP       // The one we're bound to, or nil for all of them
+	port         int          // The one we're bound to
+	externalPort int          // The one peers should connect to
+	mapping      *portMapping // Or nil
+
+	// How accept is doing, for status. Use them atomically.
+	accepting    int32 // 1 while accept runs
+	failing      int32 // 1 while Accept fails, until it succeeds again
+	acceptErrors int64
+	acceptError  atomic.Value // The last one, as a string
+}
+
+// An address to listen for peers on: an IP, or nil for every one, and the
+// ports to try.
+type listenAddress struct {
+	ip    net.IP
+	ports []int
+}
+
+// The network that binds only a's family.
+func (a listenAddress) network() string {
+	switch {
+	case a.ip == nil:
+		return "tcp"
+	case a.ip.To4() != nil:
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+func (a listenAddress) String() string {
+	host := ""
+	if a.ip != nil {
+		host = a.ip.String()
+	}
+	if len(a.ports) == 1 {
+		return net.JoinHostPort(host, strconv.Itoa(a.ports[0]))
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.ports[0])+"-"+strconv.Itoa(a.ports[len(a.ports)-1]))
+}
+
+// Listens on each of the flags' addresses, handing the connections to
+// conChan. Only the first IPv4 listener is mapped, since a NAT has the one
+// external address, and IPv6 ones don't need it. An address we can't listen
+// on is only logged, as long as we listen on another. The first listener's
+// port is the one we announce.
+func startPeerListeners(flags *TorrentFlags, conChan chan *BtConn) (ls []*peerListener, err error) {
+	addrs, err := listenAddresses(flags)
 	if err != nil {
-		log.Printf("Listener failed while finding the host/port for %v: %v", portstring, err)
 		return
 	}
-	go func() {
-		for {
-			var conn net.Conn
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Println("Listener accept failed:", err)
-				continue
+	mapped := false
+	for _, a := range addrs {
+		useNAT := !mapped && (a.ip == nil || a.ip.To4() != nil)
+		l, e := createListener(flags, a, LISTEN_ATTEMPTS, useNAT)
+		if e != nil {
+			log.Println("Couldn't listen for peers on", a, ":", e)
+			err = e
+			continue
+		}
+		mapped = mapped || useNAT
+		ls = append(ls, l)
+	}
+	if len(ls) == 0 {
+		return nil, err
+	}
+	err = nil
+	// So the DHT uses the same port.
+	flags.Port = ls[0].port
+	for _, l := range ls {
+		go l.accept(conChan)
+	}
+	return
+}
+
+// Where the flags say to listen: each of ListenAddresses, or every address,
+// on the flags' ports unless the address has its own.
+func listenAddresses(flags *TorrentFlags) (addrs []listenAddress, err error) {
+	ports, err := listenPorts(flags)
+	if err != nil {
+		return
+	}
+	if len(flags.ListenAddresses) == 0 {
+		return []listenAddress{{ports: ports}}, nil
+	}
+	for _, s := range flags.ListenAddresses {
+		a := listenAddress{ports: ports}
+		host, port, e := net.SplitHostPort(s)
+		if e != nil {
+			// Just an address.
+			host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		} else {
+			p, e := strconv.Atoi(port)
+			if e != nil || p < 0 || p > 65535 {
+				return nil, fmt.Errorf("Bad port in listen address %q", s)
+			}
+			a.ports = []int{p}
+		}
+		if host != "" {
+			if a.ip = net.ParseIP(host); a.ip == nil {
+				return nil, fmt.Errorf("Bad listen address %q", s)
+			}
+		}
+		addrs = append(addrs, a)
+	}
+	return
+}
+
+// Our addresses of each family to give trackers (BEP 7), besides the one
+// they see us connect from. Only public addresses we were told to listen on
+// are given, since an IPv6 address can say more about us than users like.
+type announceAddrs struct {
+	ipv4, ipv6 string
+}
+
+func announceAddrsFor(ls []*peerListener) (a announceAddrs) {
+	for _, l := range ls {
+		if l.ip == nil || !l.ip.IsGlobalUnicast() || l.ip.IsPrivate() || l.mapping != nil {
+			continue
+		}
+		endpoint := net.JoinHostPort(l.ip.String(), strconv.Itoa(l.externalPort))
+		if l.ip.To4() != nil {
+			if a.ipv4 == "" {
+				a.ipv4 = endpoint
 			}
-			header, err := readHeader(conn)
-			if err != nil {
-				log.Println("Error reading header: ", err)
-				continue
+		} else if a.ipv6 == "" {
+			a.ipv6 = endpoint
+		}
+	}
+	return
+}
+
+func (l *peerListener) accept(conChan chan *BtConn) {
+	atomic.StoreInt32(&l.accepting, 1)
+	defer atomic.StoreInt32(&l.accepting, 0)
+	var delay time.Duration
+	failures := 0
+	for {
+		conn, err := l.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			atomic.AddInt64(&l.acceptErrors, 1)
+			l.acceptError.Store(err.Error())
+			if failures++; failures == 1 {
+				atomic.StoreInt32(&l.failing, 1)
+				log.Println("Listener accept failed:", err)
 			}
-			peersInfoHash := string(header[8:28])
-			id := string(header[28:48])
-			conChan <- &BtConn{
-				header:     header,
-				Infohash:   peersInfoHash,
-				id:         id,
-				conn:       conn,
-				RemoteAddr: conn.RemoteAddr(),
+			if delay *= 2; delay < ACCEPT_BACKOFF {
+				delay = ACCEPT_BACKOFF
+			} else if delay > ACCEPT_BACKOFF_MAX {
+				delay = ACCEPT_BACKOFF_MAX
 			}
+			time.Sleep(delay)
+			continue
+		}
+		if failures > 0 {
+			log.Println("Accepting peers again, after", failures, "failures")
+			atomic.StoreInt32(&l.failing, 0)
+			delay, failures = 0, 0
+		}
+		go l.handshake(conn, conChan)
+	}
+}
+
+// Reads the header of a peer that's connected, and hands its connection on.
+// Anything that goes wrong, even a panic, only costs that connection.
+func (l *peerListener) handshake(conn net.Conn, conChan chan *BtConn) {
+	defer func() {
+		if r := recover(); r != nil {
+			packageLogger().Error("Panic taking a peer's connection", "peer", conn.RemoteAddr(), "panic", r, "stack", string(debug.Stack()))
+			conn.Close()
 		}
 	}()
+	btconn, err := ReadBtConn(conn)
+	if err != nil {
+		packageLogger().Debug("Couldn't read the header", "peer", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	conChan <- btconn
+}
+
+// ReadBtConn reads the header of a peer that's connected to us, waiting up
+// to HEADER_TIMEOUT for it, for the session its info-hash is for to
+// AcceptNewPeer.
+func ReadBtConn(conn net.Conn) (btconn *BtConn, err error) {
+	conn.SetReadDeadline(time.Now().Add(HEADER_TIMEOUT))
+	header, err := readHeader(conn)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	return &BtConn{
+		header:     header,
+		Infohash:   string(header[8:28]),
+		id:         string(header[28:48]),
+		conn:       conn,
+		RemoteAddr: conn.RemoteAddr(),
+	}, nil
+}
+
+// Close stops listening, and takes the port's mapping down.
+func (l *peerListener) Close() error {
+	err := l.listener.Close()
+	if l.mapping != nil {
+		if e := l.mapping.close(); e != nil {
+			log.Println("Couldn't remove the port mapping:", e)
+		}
+	}
+	return err
+}
+
+// Has portChanged called with the new external port when the NAT moves it,
+// and ipChanged with the NAT's external address.
+func (l *peerListener) followNAT(portChanged func(externalPort int), ipChanged func(ip net.IP)) {
+	if l.mapping != nil {
+		l.mapping.onChange(portChanged)
+		l.mapping.onExternalIP(ipChanged)
+	}
+}
+
+func (l *peerListener) status() (s PortStatus) {
+	if l.mapping != nil {
+		s = l.mapping.status()
+	} else {
+		s = PortStatus{Port: l.externalPort, InternalPort: l.port}
+	}
+	s.Address = l.listener.Addr().String()
+	s.Accepting = atomic.LoadInt32(&l.accepting) == 1 && atomic.LoadInt32(&l.failing) == 0
+	s.AcceptErrors = atomic.LoadInt64(&l.acceptErrors)
+	s.AcceptError, _ = l.acceptError.Load().(string)
+	return
+}
+
+// The ports to listen on, in the order to try them: Port to PortRangeEnd,
+// shuffled if RandomPort is set.
+func listenPorts(flags *TorrentFlags) (ports []int, err error) {
+	low, high := flags.Port, flags.PortRangeEnd
+	if high == 0 {
+		high = low
+	}
+	if low < 0 || high > 65535 || high < low {
+		return nil, fmt.Errorf("Bad listen port range %d-%d", low, high)
+	}
+	for p := low; p <= high; p++ {
+		ports = append(ports, p)
+	}
+	if flags.RandomPort {
+		rand.Shuffle(len(ports), func(i, j int) { ports[i], ports[j] = ports[j], ports[i] })
+	}
 	return
 }
 
+// Binds the first of a's ports that's free. If none is, it tries them all
+// again, up to attempts times.
+func bindPeerPort(a listenAddress, attempts int) (listener *net.TCPListener, port int, err error) {
+	ports := a.ports
+	delay := listenRetryDelay
+	for attempt := 1; ; attempt++ {
+		for _, p := range ports {
+			if listener, err = net.ListenTCP(a.network(), &net.TCPAddr{IP: a.ip, Port: p}); err == nil {
+				return listener, listener.Addr().(*net.TCPAddr).Port, nil
+			}
+			packageLogger().Debug("Couldn't listen", "port", p, "err", err)
+		}
+		if attempt >= attempts {
+			return
+		}
+		log.Printf("Couldn't listen on any of the %d ports: %v. Trying again in %v", len(ports), err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 func CreateListener(flags *TorrentFlags) (listener net.Listener, externalPort int, err error) {
-	nat, err := CreatePortMapping(flags)
+	ports, err := listenPorts(flags)
 	if err != nil {
-		err = fmt.Errorf("Unable to create NAT: %v", err)
 		return
 	}
-	listenPort := flags.Port
-	if nat != nil {
-		var external net.IP
-		if external, err = nat.GetExternalAddress(); err != nil {
-			err = fmt.Errorf("Unable to get external IP address from NAT: %v", err)
+	l, err := createListener(flags, listenAddress{ports: ports}, LISTEN_ATTEMPTS, true)
+	if err != nil {
+		return
+	}
+	return l.listener, l.externalPort, nil
+}
+
+// Binds one of a's ports, and then maps the port we got, if useNAT is set and
+// the flags ask for a NAT mapping. Mapping first would map the port we asked
+// for, which with port 0, or a taken port, isn't the one we listen on.
+func createListener(flags *TorrentFlags, a listenAddress, attempts int, useNAT bool) (l *peerListener, err error) {
+	var nat NAT
+	if useNAT {
+		nat, err = CreatePortMapping(flags)
+	}
+	if err != nil {
+		if flags.UseUPnP && flags.UseNATPMP {
+			err = fmt.Errorf("Unable to create NAT: %v", err)
 			return
 		}
-		log.Println("External ip address: ", external)
-		if listenPort, err = chooseListenPort(nat, listenPort); err != nil {
-			log.Println("Could not choose listen port.", err)
-			log.Println("Peer connectivity will be affected.")
-		}
+		// Peers can still reach us if the router's forwarding the port.
+		log.Println("Unable to create NAT, so peers may not reach us:", err)
+		nat, err = nil, nil
 	}
-	listener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: listenPort})
+	listener, listenPort, err := bindPeerPort(a, attempts)
 	if err != nil {
-		log.Fatal("Listen failed:", err)
+		err = fmt.Errorf("Listen failed: %v", err)
+		return
+	}
+	l = &peerListener{listener: listener, ip: a.ip, port: listenPort, externalPort: listenPort}
+	if nat != nil {
+		l.mapping, err = newPortMapping(nat, "tcp", listenPort)
+		if _, upnp := nat.(*upnpNAT); upnp && err != nil {
+			// Routers that answer UPnP, but won't map ports with it, may
+			// still with NAT-PMP.
+			log.Println("Couldn't map the listen port with UPnP, so trying NAT-PMP:", err)
+			if pmp, e := natPMPFor(flags); e == nil {
+				nat = pmp
+				l.mapping, err = newPortMapping(nat, "tcp", listenPort)
+			}
+		}
+		if err != nil {
+			log.Println("Could not map the listen port.", err)
+			log.Println("Peer connectivity will be affected.")
+			err = nil
+		} else {
+			s := l.mapping.status()
+			l.externalPort = s.Port
+			log.Println("Mapped the listen port with", s.Mapping, "until", s.LeaseExpires.Format(time.RFC3339))
+		}
+		// PCP only learns the external address from a mapping.
+		if external, e := nat.GetExternalAddress(); e != nil {
+			log.Println("Unable to get external IP address from NAT:", e)
+		} else {
+			log.Println("External ip address: ", external)
+		}
 	}
-	if listenPort == 0 {
-		_, portString, _ := net.SplitHostPort(listener.Addr().String())
-		listenPort, _ = strconv.Atoi(portString)
-		flags.Port = listenPort
+	log.Println("Listening for peers on", listener.Addr())
+	if l.externalPort != listenPort {
+		log.Println("Mapped to external port:", l.externalPort)
 	}
-	log.Println("Listening for peers on port:", listenPort)
-	externalPort = listenPort
 	return
 }
 
@@ -100,43 +416,48 @@ func CreatePortMapping(flags *TorrentFlags) (nat NAT, err error) {
 	}
 	if flags.UseUPnP {
 		log.Println("Using UPnP to open port.")
-		nat, err = Discover()
-	}
-	if flags.UseNATPMP {
-		var gatewayIP net.IP
-		if flags.Gateway == "" {
-			log.Printf("useNATPMP but gateway not provided, trying discovery")
-			gatewayIP, err = gateway.DiscoverGateway()
-			if err != nil {
-				return
+		if nat, err = Discover(); err != nil {
+			log.Println("UPnP failed, so trying NAT-PMP:", err)
+			var e error
+			if nat, e = natPMPFor(flags); e != nil {
+				err = fmt.Errorf("%v, and NAT-PMP: %v", err, e)
+			} else {
+				err = nil
 			}
-			log.Printf("...discovered gateway IP: %s", gatewayIP)
-		} else {
-			gatewayIP = net.ParseIP(flags.Gateway)
 		}
-		log.Println("Using NAT-PMP to open port.")
-		if gatewayIP == nil {
-			err = fmt.Errorf("Could not parse gateway %q", flags.Gateway)
-		}
-		nat = NewNatPMP(gatewayIP)
+	}
+	if flags.UseNATPMP {
+		nat, err = natPMPFor(flags)
 	}
 	return
 }
 
-func chooseListenPort(nat NAT, externalPort int) (listenPort int, err error) {
-	// TODO: Unmap port when exiting. (Right now we never exit cleanly.)
-	// TODO: Defend the port, remap when router reboots
-	listenPort, err = nat.AddPortMapping("tcp", externalPort, externalPort,
-		"Taipei-Torrent port "+strconv.Itoa(externalPort), 360000)
-	if err != nil {
+// NAT-PMP, or PCP, on the flags' gateway, or the one we find.
+func natPMPFor(flags *TorrentFlags) (nat NAT, err error) {
+	var gatewayIP net.IP
+	if flags.Gateway == "" {
+		log.Printf("NAT-PMP gateway not provided, trying discovery")
+		gatewayIP, err = gateway.DiscoverGateway()
+		if err != nil {
+			return
+		}
+		log.Printf("...discovered gateway IP: %s", gatewayIP)
+	} else {
+		gatewayIP = net.ParseIP(flags.Gateway)
+	}
+	log.Println("Using NAT-PMP to open port.")
+	if gatewayIP == nil {
+		err = fmt.Errorf("Could not parse gateway %q", flags.Gateway)
 		return
 	}
+	nat = newPMPOrPCP(gatewayIP)
 	return
 }
 
 func readHeader(conn net.Conn) (h []byte, err error) {
+	// A read can return less than we asked for, so each part's read in full.
 	header := make([]byte, 68)
-	_, err = conn.Read(header[0:1])
+	_, err = io.ReadFull(conn, header[0:1])
 	if err != nil {
 		err = fmt.Errorf("Couldn't read 1st byte: %v", err)
 		return
@@ -145,17 +466,17 @@ func readHeader(conn net.Conn) (h []byte, err error) {
 		err = fmt.Errorf("First byte is not 19")
 		return
 	}
-	_, err = conn.Read(header[1:20])
+	_, err = io.ReadFull(conn, header[1:20])
 	if err != nil {
 		err = fmt.Errorf("Couldn't read magic string: %v", err)
 		return
 	}
 	if string(header[1:20]) != "BitTorrent protocol" {
-		err = fmt.Errorf("Magic string is not correct: %v", string(header[1:20]))
+		err = fmt.Errorf("Magic string is not correct: %q", string(header[1:20]))
 		return
 	}
 	// Read rest of header
-	_, err = conn.Read(header[20:])
+	_, err = io.ReadFull(conn, header[20:])
 	if err != nil {
 		err = fmt.Errorf("Couldn't read rest of header")
 		return
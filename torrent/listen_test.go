@@ -0,0 +1,313 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListenPorts(t *testing.T) {
+	ports, err := listenPorts(&TorrentFlags{Port: 6881, PortRangeEnd: 6884})
+	if err != nil || len(ports) != 4 || ports[0] != 6881 || ports[3] != 6884 {
+		t.Errorf("Range: %v, %v", ports, err)
+	}
+	if ports, err = listenPorts(&TorrentFlags{Port: 7777}); err != nil || len(ports) != 1 || ports[0] != 7777 {
+		t.Errorf("One port: %v, %v", ports, err)
+	}
+	ports, err = listenPorts(&TorrentFlags{Port: 6881, PortRangeEnd: 6980, RandomPort: true})
+	if err != nil || len(ports) != 100 || sort.IntsAreSorted(ports) {
+		t.Errorf("Random: %v, %v", ports, err)
+	}
+	sort.Ints(ports)
+	if ports[0] != 6881 || ports[99] != 6980 {
+		t.Errorf("Random ports cover %d-%d", ports[0], ports[99])
+	}
+	for _, f := range []TorrentFlags{{Port: 6889, PortRangeEnd: 6881}, {Port: -1}, {Port: 65000, PortRangeEnd: 70000}} {
+		if _, err = listenPorts(&f); err == nil {
+			t.Errorf("Allowed %d-%d", f.Port, f.PortRangeEnd)
+		}
+	}
+}
+
+func TestBindPeerPort(t *testing.T) {
+	defer func(d time.Duration) { listenRetryDelay = d }(listenRetryDelay)
+	listenRetryDelay = time.Millisecond
+	taken, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+
+	// The taken port is skipped.
+	l, port, err := bindPeerPort(listenAddress{ports: []int{takenPort, 0}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if port == takenPort || port == 0 || l.Addr().(*net.TCPAddr).Port != port {
+		t.Errorf("Bound port %d, with %d taken", port, takenPort)
+	}
+
+	if _, _, err = bindPeerPort(listenAddress{ports: []int{takenPort}}, 3); err == nil {
+		t.Error("Bound a taken port")
+	}
+
+	// Freed while we wait to try again.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		taken.Close()
+	}()
+	listenRetryDelay = 20 * time.Millisecond
+	if l, port, err = bindPeerPort(listenAddress{ports: []int{takenPort}}, 3); err != nil || port != takenPort {
+		t.Errorf("After the port was freed: %d, %v", port, err)
+	} else {
+		l.Close()
+	}
+}
+
+func TestSetListenPort(t *testing.T) {
+	flags := &TorrentFlags{MaxActive: 1}
+	conChan := make(chan *BtConn)
+	ls, err := startPeerListeners(flags, conChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ls[0]
+	m := newSessionManager(context.Background(), flags, l.externalPort)
+	m.conChan = conChan
+	m.listener = l
+	m.stayUp = true
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+		m.listener.Close()
+	}()
+
+	oldPort := l.port
+	port, err := m.SetListenPort(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := m.PortStatus(); err != nil || s.Port != port || s.InternalPort != port || port == oldPort {
+		t.Errorf("Listening on %+v, %v; was %d, moved to %d", s, err, oldPort, port)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal("Not listening on the new port: ", err)
+	}
+	conn.Close()
+	// The old listener's closed in the background.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(oldPort)))
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Still listening on the old port")
+		}
+	}
+
+	if _, err = m.SetListenPort(70000); err == nil {
+		t.Error("Moved to port 70000")
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	addrs, err := listenAddresses(&TorrentFlags{Port: 6881, PortRangeEnd: 6882,
+		ListenAddresses: []string{"203.0.113.5", "[2001:db8::5]:7000", ":0"}})
+	if err != nil || len(addrs) != 3 {
+		t.Fatalf("%v, %v", addrs, err)
+	}
+	if s := addrs[0].String(); s != "203.0.113.5:6881-6882" || addrs[0].network() != "tcp4" {
+		t.Errorf("Address only: %s", s)
+	}
+	if s := addrs[1].String(); s != "[2001:db8::5]:7000" || addrs[1].network() != "tcp6" {
+		t.Errorf("With a port: %s", s)
+	}
+	if addrs[2].ip != nil || addrs[2].network() != "tcp" || len(addrs[2].ports) != 1 || addrs[2].ports[0] != 0 {
+		t.Errorf("Every address: %+v", addrs[2])
+	}
+	for _, bad := range []string{"nowhere:6881", "1.2.3.4:port", "1.2.3.4:70000"} {
+		if _, err = listenAddresses(&TorrentFlags{ListenAddresses: []string{bad}}); err == nil {
+			t.Errorf("Allowed %q", bad)
+		}
+	}
+}
+
+func TestStartPeerListeners(t *testing.T) {
+	defer func(d time.Duration) { listenRetryDelay = d }(listenRetryDelay)
+	listenRetryDelay = time.Millisecond
+	// 192.0.2.1 isn't ours, so it can't be bound.
+	flags := &TorrentFlags{ListenAddresses: []string{"192.0.2.1:0", "127.0.0.1:0", "127.0.0.1"}}
+	conChan := make(chan *BtConn)
+	ls, err := startPeerListeners(flags, conChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
+	if len(ls) != 2 || flags.Port != ls[0].port || ls[0].port == ls[1].port {
+		t.Fatalf("Listening on %v, announcing %d", ls, flags.Port)
+	}
+	for _, l := range ls {
+		if s := l.status(); s.Address != net.JoinHostPort("127.0.0.1", strconv.Itoa(l.port)) {
+			t.Errorf("Status %+v", s)
+		}
+		conn, err := net.Dial("tcp", l.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append([]byte{19}, []byte("BitTorrent protocol"+"01234567"+"01234567890123456789"+"-TT0000-012345678901")...))
+		if c := <-conChan; c.Infohash != "01234567890123456789" {
+			t.Errorf("Got %+v", c)
+		}
+		conn.Close()
+	}
+
+	if _, err = startPeerListeners(&TorrentFlags{ListenAddresses: []string{"192.0.2.1:0"}}, conChan); err == nil {
+		t.Error("Started without a listener")
+	}
+}
+
+func TestAnnounceAddrsFor(t *testing.T) {
+	ls := []*peerListener{
+		{externalPort: 6881},
+		{ip: net.ParseIP("10.0.0.2"), externalPort: 6881},
+		{ip: net.ParseIP("2001:db8::5"), externalPort: 6882},
+		{ip: net.ParseIP("203.0.113.5"), externalPort: 6881},
+		{ip: net.ParseIP("2001:db8::6"), externalPort: 6881},
+	}
+	if a := announceAddrsFor(ls); a.ipv4 != "203.0.113.5:6881" || a.ipv6 != "[2001:db8::5]:6882" {
+		t.Errorf("Announcing %+v", a)
+	}
+}
+
+// A listener whose Accept fails the first failures times, and whose first
+// connection panics when it's read.
+type flakyListener struct {
+	net.Listener
+	failures int
+	accepted int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, errors.New("Too many open files")
+	}
+	c, err := l.Listener.Accept()
+	if l.accepted++; err == nil && l.accepted == 1 {
+		c = panickyConn{c}
+	}
+	return c, err
+}
+
+type panickyConn struct{ net.Conn }
+
+func (panickyConn) Read([]byte) (int, error) { panic("Read") }
+
+func TestAcceptResilience(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &peerListener{listener: &flakyListener{Listener: tcp, failures: 5}}
+	conChan := make(chan *BtConn)
+	go l.accept(conChan)
+
+	// The first connection's handshake panics, and the connection is closed.
+	c1, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c1.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read from the connection that panicked: %v", err)
+	}
+
+	c2, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	header := append([]byte("\x13BitTorrent protocol"), make([]byte, 8)...)
+	header = append(header, "01234567890123456789-TT0000-012345678901"...)
+	c2.Write(header)
+	select {
+	case c := <-conChan:
+		if c.Infohash != "01234567890123456789" {
+			t.Errorf("Got info-hash %q", c.Infohash)
+		}
+		c.conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("The listener didn't hand on the next connection")
+	}
+	if s := l.status(); !s.Accepting || s.AcceptErrors != 5 || s.AcceptError != "Too many open files" {
+		t.Errorf("Status %+v", s)
+	}
+
+	l.Close()
+	for i := 0; l.status().Accepting; i++ {
+		if i > 100 {
+			t.Fatal("Still accepting once closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A connection that reads as data, at most n bytes at a time.
+type dribblingConn struct {
+	net.Conn
+	data []byte
+	n    int
+}
+
+func (c *dribblingConn) Read(b []byte) (n int, err error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(b) > c.n {
+		b = b[:c.n]
+	}
+	n = copy(b, c.data)
+	c.data = c.data[n:]
+	return
+}
+
+// A header's read whole however the connection splits it, and anything
+// else is refused.
+func FuzzReadHeader(f *testing.F) {
+	header := append([]byte("\x13BitTorrent protocol"), 0, 0, 0, 0, 0, 0x10, 0, 1)
+	header = append(header, "01234567890123456789-TT0000-012345678901"...)
+	f.Add(header, uint8(68))
+	f.Add(header, uint8(1))
+	f.Add(header[:40], uint8(7))
+	f.Add([]byte("\x13BitTorrent protocoX"), uint8(3))
+	f.Add([]byte("GET / HTTP/1.1\r\n"), uint8(16))
+	f.Fuzz(func(t *testing.T, data []byte, n uint8) {
+		if n == 0 {
+			n = 1
+		}
+		h, err := readHeader(&dribblingConn{data: data, n: int(n)})
+		good := len(data) >= 68 && string(data[:20]) == "\x13BitTorrent protocol"
+		if good && (err != nil || !bytes.Equal(h, data[20:68])) {
+			t.Fatalf("Read %q, %v reading %d at a time, from %q", h, err, n, data)
+		}
+		if !good && err == nil {
+			t.Fatalf("Read %q from %q", h, data)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// A Logger takes the package's messages, by level. keyvals are key, value
+// pairs to go with the message, like "peer", addr.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota // Per peer and per piece detail
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+	LOG_NONE // Nothing
+)
+
+var logLevelNames = [LOG_NONE + 1]string{"debug", "info", "warn", "error", "none"}
+
+func (l LogLevel) String() string {
+	if l >= 0 && l <= LOG_NONE {
+		return logLevelNames[l]
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel parses a level's name, like "info".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for l, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(l), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %q", s)
+}
+
+// StdLogger writes the messages at Level and above with the standard log
+// package, like: INFO Tracker response torrent=ubuntu seeders=10
+type StdLogger struct {
+	Level LogLevel
+}
+
+func (l StdLogger) Debug(msg string, keyvals ...interface{}) { l.log(LOG_DEBUG, msg, keyvals) }
+func (l StdLogger) Info(msg string, keyvals ...interface{})  { l.log(LOG_INFO, msg, keyvals) }
+func (l StdLogger) Warn(msg string, keyvals ...interface{})  { l.log(LOG_WARN, msg, keyvals) }
+func (l StdLogger) Error(msg string, keyvals ...interface{}) { l.log(LOG_ERROR, msg, keyvals) }
+
+func (l StdLogger) log(level LogLevel, msg string, keyvals []interface{}) {
+	if level >= l.Level {
+		log.Print(formatLog(level, msg, keyvals))
+	}
+}
+
+func formatLog(level LogLevel, msg string, keyvals []interface{}) string {
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=", keyvals[i])
+		if i+1 == len(keyvals) {
+			b.WriteString("MISSING")
+			break
+		}
+		v := fmt.Sprint(keyvals[i+1])
+		if v == "" || strings.ContainsAny(v, " \"=\n") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+// A Logger that says nothing.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+type loggerBox struct{ Logger }
+
+var theLogger atomic.Value
+
+func init() {
+	theLogger.Store(loggerBox{StdLogger{LOG_INFO}})
+}
+
+// SetLogger sends the package's messages to l, in place of a StdLogger at
+// LOG_INFO. A nil l drops them. It's safe to call at any time.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	theLogger.Store(loggerBox{l})
+}
+
+func packageLogger() Logger {
+	return theLogger.Load().(loggerBox).Logger
+}
+
+// A Logger that adds keyvals to every message.
+type fieldLogger struct {
+	l       Logger
+	keyvals []interface{}
+}
+
+func withFields(l Logger, keyvals ...interface{}) Logger {
+	return fieldLogger{l, keyvals}
+}
+
+func (f fieldLogger) with(keyvals []interface{}) []interface{} {
+	return append(f.keyvals[:len(f.keyvals):len(f.keyvals)], keyvals...)
+}
+
+func (f fieldLogger) Debug(msg string, keyvals ...interface{}) { f.l.Debug(msg, f.with(keyvals)...) }
+func (f fieldLogger) Info(msg string, keyvals ...interface{})  { f.l.Info(msg, f.with(keyvals)...) }
+func (f fieldLogger) Warn(msg string, keyvals ...interface{})  { f.l.Warn(msg, f.with(keyvals)...) }
+func (f fieldLogger) Error(msg string, keyvals ...interface{}) { f.l.Error(msg, f.with(keyvals)...) }
+
+// The session's Logger, which names the torrent.
+func (ts *TorrentSession) logger() Logger {
+	return withFields(packageLogger(), "torrent", ts.M.Info.Name)
+}
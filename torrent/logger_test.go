@@ -0,0 +1,80 @@
+package torrent
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFormatLog(t *testing.T) {
+	for _, c := range []struct {
+		level   LogLevel
+		keyvals []interface{}
+		want    string
+	}{
+		{LOG_INFO, nil, "INFO msg"},
+		{LOG_WARN, []interface{}{"peer", "1.2.3.4:5", "piece", 7}, "WARN msg peer=1.2.3.4:5 piece=7"},
+		{LOG_ERROR, []interface{}{"err", "no space left"}, `ERROR msg err="no space left"`},
+		{LOG_DEBUG, []interface{}{"name", ""}, `DEBUG msg name=""`},
+		{LOG_DEBUG, []interface{}{"odd"}, "DEBUG msg odd=MISSING"},
+	} {
+		if got := formatLog(c.level, "msg", c.keyvals); got != c.want {
+			t.Errorf("Got %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for l := LOG_DEBUG; l <= LOG_NONE; l++ {
+		got, err := ParseLogLevel(l.String())
+		if err != nil || got != l {
+			t.Errorf("%v: got %v, %v", l, got, err)
+		}
+	}
+	if l, err := ParseLogLevel("WARN"); err != nil || l != LOG_WARN {
+		t.Errorf("WARN: got %v, %v", l, err)
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Error("Parsed loud")
+	}
+}
+
+// Keeps what it's told, as formatLog would write it.
+type recordingLogger struct {
+	level LogLevel
+	got   []string
+}
+
+func (r *recordingLogger) add(level LogLevel, msg string, keyvals []interface{}) {
+	if level >= r.level {
+		r.got = append(r.got, formatLog(level, msg, keyvals))
+	}
+}
+
+func (r *recordingLogger) Debug(msg string, keyvals ...interface{}) { r.add(LOG_DEBUG, msg, keyvals) }
+func (r *recordingLogger) Info(msg string, keyvals ...interface{})  { r.add(LOG_INFO, msg, keyvals) }
+func (r *recordingLogger) Warn(msg string, keyvals ...interface{})  { r.add(LOG_WARN, msg, keyvals) }
+func (r *recordingLogger) Error(msg string, keyvals ...interface{}) { r.add(LOG_ERROR, msg, keyvals) }
+
+func TestSetLogger(t *testing.T) {
+	defer SetLogger(StdLogger{LOG_INFO})
+	r := &recordingLogger{level: LOG_INFO}
+	SetLogger(r)
+	ts := &TorrentSession{}
+	ts.M = &MetaInfo{}
+	ts.M.Info.Name = "ubuntu"
+	l := ts.logger()
+	l.Debug("Hidden")
+	l.Info("Shown", "peers", 3)
+	// The fields mustn't leak from one message into the next.
+	l.Warn("Again")
+	want := []string{"INFO Shown torrent=ubuntu peers=3", "WARN Again torrent=ubuntu"}
+	if fmt.Sprint(r.got) != fmt.Sprint(want) {
+		t.Errorf("Got %q, want %q", r.got, want)
+	}
+
+	SetLogger(nil)
+	packageLogger().Error("Dropped")
+	if len(r.got) != 2 {
+		t.Errorf("Logged after SetLogger(nil): %q", r.got)
+	}
+}
@@ -0,0 +1,216 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A tracker for the loopback test, that gives every peer that announces the
+// others that have, on 127.0.0.1, and tells the test what it's heard, as
+// "port event".
+type loopbackTracker struct {
+	*httptest.Server
+	events chan string
+
+	mu    sync.Mutex
+	ports []uint16
+}
+
+func newLoopbackTracker() *loopbackTracker {
+	tr := &loopbackTracker{events: make(chan string, 20)}
+	tr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		port, err := strconv.ParseUint(r.FormValue("port"), 10, 16)
+		if err != nil {
+			w.Write([]byte("d14:failure reason8:bad porte"))
+			return
+		}
+		var peers []byte
+		tr.mu.Lock()
+		known := false
+		for _, p := range tr.ports {
+			if p == uint16(port) {
+				known = true
+			} else {
+				peers = append(peers, 127, 0, 0, 1, byte(p>>8), byte(p))
+			}
+		}
+		if !known && r.FormValue("event") != "stopped" {
+			tr.ports = append(tr.ports, uint16(port))
+		}
+		tr.mu.Unlock()
+		tr.events <- r.FormValue("port") + " " + r.FormValue("event")
+		fmt.Fprintf(w, "d8:intervali1800e5:peers%d:%se", len(peers), peers)
+	}))
+	return tr
+}
+
+// Waits for the tracker to hear want.
+func (tr *loopbackTracker) heard(t *testing.T, want string) {
+	t.Helper()
+	for deadline := time.After(10 * time.Second); ; {
+		select {
+		case e := <-tr.events:
+			if e == want {
+				return
+			}
+			if e[len(e)-1] != ' ' {
+				// Only regular announces may come between.
+				t.Errorf("Heard %q waiting for %q", e, want)
+			}
+		case <-deadline:
+			t.Fatalf("Didn't hear %q", want)
+		}
+	}
+}
+
+// Two sessions on loopback, one seeding a torrent of a few files from its
+// directory and the other downloading it into its own, finding each other
+// through a tracker, without the cache and with it. What's downloaded is
+// what was seeded, and both sessions say they've stopped when they quit.
+func TestLoopbackTransfer(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		t.Run(fmt.Sprint("cached=", cached), func(t *testing.T) {
+			testLoopbackTransfer(t, cached)
+		})
+	}
+}
+
+func testLoopbackTransfer(t *testing.T, cached bool) {
+	dir, err := ioutil.TempDir("", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "seed")
+	leechDir := filepath.Join(dir, "leech")
+	if err = os.Mkdir(leechDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Files that start and end in the middle of pieces, a piece's worth that
+	// straddles two, and some in directories.
+	files := []struct {
+		name string
+		size int
+	}{{"a", 40000}, {"b", 1}, {filepath.Join("sub", "c"), 16384}, {filepath.Join("sub", "deeper", "d"), 25000}}
+	r := rand.New(rand.NewSource(207))
+	for _, file := range files {
+		b := make([]byte, file.size)
+		r.Read(b)
+		path := filepath.Join(seedDir, "files", file.name)
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := newLoopbackTracker()
+	defer tracker.Close()
+	m, err := CreateTorrent(filepath.Join(seedDir, "files"), &CreateOptions{PieceLength: 16384, Announce: tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seedFlags := &TorrentFlags{
+		FileDir:            seedDir,
+		SeedRatio:          math.Inf(0),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}
+	if cached {
+		seedFlags.Cacher = NewRamCacheProvider(1)
+	}
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	seeder, seederDone := startTestSession(t, seedFlags, torrentFile, swarm)
+	defer func() {
+		seeder.Quit()
+		<-seederDone
+	}()
+	if s := waitForCheck(t, seeder); s.GoodPieces != s.Pieces {
+		t.Fatalf("Seeder has %d of %d pieces", s.GoodPieces, s.Pieces)
+	}
+	seedPort := strconv.Itoa(int(seeder.Session.Port))
+	tracker.heard(t, seedPort+" started")
+
+	leechFlags := *seedFlags
+	leechFlags.Port = 0 // The seeder's listener filled in its port.
+	leechFlags.FileDir = leechDir
+	if cached {
+		leechFlags.Cacher = NewRamCacheProvider(1)
+	}
+	leecher, leecherDone := startTestSession(t, &leechFlags, torrentFile, swarm)
+	leechPort := strconv.Itoa(int(leecher.Session.Port))
+	tracker.heard(t, leechPort+" started")
+	tracker.heard(t, leechPort+" completed")
+
+	s, err := leecher.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GoodPieces != s.Pieces || s.Left != 0 || s.ETA != 0 || s.CompletedAt.IsZero() {
+		t.Errorf("Leecher has %d of %d pieces, %d left, ETA %v, completed at %v", s.GoodPieces, s.Pieces, s.Left, s.ETA, s.CompletedAt)
+	}
+	// One handshake each way, at least, and a piece message's header for
+	// every block.
+	if o := s.Overhead; o.Received["handshake"] < 68 || o.Sent["handshake"] < 68 || o.Sent["request"] == 0 ||
+		o.Received["piece_header"] < 13*uint64(s.Pieces) || o.Sent["tracker"] == 0 || o.Received["tracker"] == 0 || o.HashFailed != 0 {
+		t.Errorf("Overhead %+v", o)
+	}
+	leecher.Quit()
+	select {
+	case <-leecherDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The leecher didn't quit")
+	}
+	// The stopped announce is made before the session's done.
+	tracker.heard(t, leechPort+" stopped")
+
+	for _, file := range files {
+		name := file.name
+		want, err := ioutil.ReadFile(filepath.Join(seedDir, "files", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(leechDir, "files", name))
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: downloaded %d bytes that don't match the %d seeded", name, len(got), len(want))
+		}
+	}
+
+	seeder.Quit()
+	select {
+	case <-seederDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The seeder didn't quit")
+	}
+	tracker.heard(t, seedPort+" stopped")
+	if s, err = seeder.Status(); err == nil {
+		t.Errorf("The seeder's status after it quit: %+v", s)
+	}
+}
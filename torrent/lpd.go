@@ -3,18 +3,44 @@ package torrent
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	mathrand "math/rand"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
+// Local Peer Discovery. Source:
+// http://bittorrent.org/beps/bep_0014.html
+
 var (
 	request_template = "BT-SEARCH * HTTP/1.1\r\n" +
-		"Host: 239.192.152.143:6771\r\n" +
-		"Port: %u\r\n" +
-		"Infohash: %X\r\n\r\n"
+		"Host: %s\r\n" +
+		"Port: %d\r\n" +
+		"Infohash: %X\r\n" +
+		"cookie: %s\r\n\r\n"
+)
+
+const (
+	LPD_IPV4_GROUP = "239.192.152.143:6771"
+	LPD_IPV6_GROUP = "[ff15::efc0:988f]:6771"
+
+	// Default time between announcements of the same torrent.
+	LPD_DEFAULT_INTERVAL = 5 * time.Minute
+
+	// How much the interval is allowed to vary, so that clients started at
+	// the same time don't all announce at once.
+	LPD_JITTER = 0.1
+
+	// Each source address may send at most LPD_MAX_ANNOUNCES per
+	// LPD_RATE_WINDOW; anything beyond that is dropped.
+	LPD_MAX_ANNOUNCES = 20
+	LPD_RATE_WINDOW   = time.Minute
 )
 
 type Announce struct {
@@ -22,105 +48,264 @@ type Announce struct {
 	Infohash string
 }
 
+// One multicast socket, joined to one group on one interface.
+type lpdConn struct {
+	addr *net.UDPAddr
+	conn *net.UDPConn
+}
+
 type Announcer struct {
-	btPort uint16
-	addr   *net.UDPAddr
-	conn   *net.UDPConn
+	btPort   uint16
+	interval time.Duration
+	cookie   string
+	conns    []*lpdConn
+	limiter  *lpdRateLimiter
+
+	Announces chan *Announce
 
-	Announces       chan *Announce
-	activeAnnounces map[string]*time.Ticker
+	mu              sync.Mutex
+	activeAnnounces map[string]chan bool
 }
 
-func NewAnnouncer(listenPort uint16) (lpd *Announcer, err error) {
-	addr, err := net.ResolveUDPAddr("udp4", "239.192.152.143:6771")
+// NewAnnouncer joins the IPv4 and IPv6 LPD groups on every multicast capable
+// interface. It only fails if no group could be joined at all. An interval
+// of 0 means LPD_DEFAULT_INTERVAL.
+func NewAnnouncer(listenPort uint16, interval time.Duration) (lpd *Announcer, err error) {
+	if interval <= 0 {
+		interval = LPD_DEFAULT_INTERVAL
+	}
+	cookie, err := newLPDCookie()
 	if err != nil {
 		return
 	}
 
-	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
-	if err != nil {
+	var conns []*lpdConn
+	for _, group := range []struct{ network, addr string }{
+		{"udp4", LPD_IPV4_GROUP},
+		{"udp6", LPD_IPV6_GROUP},
+	} {
+		addr, e := net.ResolveUDPAddr(group.network, group.addr)
+		if e != nil {
+			err = e
+			continue
+		}
+		for _, ifi := range lpdInterfaces() {
+			conn, e := net.ListenMulticastUDP(group.network, ifi, addr)
+			if e != nil {
+				err = e
+				continue
+			}
+			conns = append(conns, &lpdConn{addr, conn})
+		}
+	}
+	if len(conns) == 0 {
+		if err == nil {
+			err = errors.New("No multicast interfaces")
+		}
 		return
 	}
+	err = nil
 
-	activeAnnounces := make(map[string]*time.Ticker)
 	lpd = &Announcer{
 		btPort:          listenPort,
-		addr:            addr,
-		conn:            conn,
+		interval:        interval,
+		cookie:          cookie,
+		conns:           conns,
+		limiter:         newLPDRateLimiter(LPD_MAX_ANNOUNCES, LPD_RATE_WINDOW),
 		Announces:       make(chan *Announce),
-		activeAnnounces: activeAnnounces,
+		activeAnnounces: make(map[string]chan bool),
 	}
 
-	go lpd.run()
+	for _, c := range conns {
+		go lpd.run(c)
+	}
+	return
+}
+
+// The interfaces to join the LPD groups on. A nil entry means the system
+// default, which is what we fall back to if the interfaces can't be listed.
+func lpdInterfaces() (ifis []*net.Interface) {
+	all, err := net.Interfaces()
+	if err == nil {
+		for i := range all {
+			ifi := &all[i]
+			if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 &&
+				ifi.Flags&net.FlagLoopback == 0 {
+				ifis = append(ifis, ifi)
+			}
+		}
+	}
+	if len(ifis) == 0 {
+		ifis = []*net.Interface{nil}
+	}
 	return
 }
 
-func (lpd *Announcer) run() {
+func newLPDCookie() (cookie string, err error) {
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (lpd *Announcer) run(c *lpdConn) {
 	for {
-		answer := make([]byte, 256)
-		_, from, err := lpd.conn.ReadFromUDP(answer)
+		answer := make([]byte, 512)
+		n, from, err := c.conn.ReadFromUDP(answer)
 		if err != nil {
 			log.Println("Error reading from UDP: ", err)
 			continue
 		}
 
-		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(answer)))
+		ann, cookie, err := parseAnnounce(answer[:n], from)
 		if err != nil {
-			log.Println("Error reading HTTP request from UDP: ", err)
+			log.Println(err)
 			continue
 		}
-
-		if req.Method != "BT-SEARCH" {
-			log.Println("Invalid method: ", req.Method)
-		}
-
-		ih := req.Header.Get("Infohash")
-		if ih == "" {
-			log.Println("No Infohash")
+		if cookie == lpd.cookie {
+			// It's our own announcement coming back to us.
 			continue
 		}
-
-		port := req.Header.Get("Port")
-		if port == "" {
-			log.Println("No port")
+		if !lpd.limiter.Allow(from.IP.String(), time.Now()) {
 			continue
 		}
+		lpd.Announces <- ann
+	}
+}
 
-		addr, err := net.ResolveTCPAddr("tcp4", from.IP.String()+":"+port)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		lpd.Announces <- &Announce{addr.String(), ih}
+// parseAnnounce parses an LPD announcement received from from. It returns the
+// announcement's cookie, if any, separately.
+func parseAnnounce(packet []byte, from *net.UDPAddr) (ann *Announce, cookie string, err error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		err = fmt.Errorf("Error reading HTTP request from UDP: %v", err)
+		return
 	}
+
+	if req.Method != "BT-SEARCH" {
+		err = fmt.Errorf("Invalid method: %v", req.Method)
+		return
+	}
+
+	ih := req.Header.Get("Infohash")
+	if ih == "" {
+		err = errors.New("No Infohash")
+		return
+	}
+
+	port := req.Header.Get("Port")
+	if port == "" {
+		err = errors.New("No port")
+		return
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(from.IP.String(), port))
+	if err != nil {
+		return
+	}
+	ann = &Announce{addr.String(), ih}
+	cookie = req.Header.Get("Cookie")
+	return
 }
 
+// Announce starts announcing ih on all the groups we joined, once right away
+// and then every interval (give or take LPD_JITTER) until StopAnnouncing.
 func (lpd *Announcer) Announce(ih string) {
+	lpd.mu.Lock()
+	if _, ok := lpd.activeAnnounces[ih]; ok {
+		lpd.mu.Unlock()
+		return
+	}
+	stop := make(chan bool)
+	lpd.activeAnnounces[ih] = stop
+	lpd.mu.Unlock()
+
 	go func() {
-		requestMessage := []byte(fmt.Sprintf(request_template, lpd.btPort,
-			ih))
+		for {
+			lpd.send(ih)
+			select {
+			case <-time.After(jitter(lpd.interval, LPD_JITTER)):
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// AnnounceNow sends one announcement of ih right away, besides the regular
+// ones.
+func (lpd *Announcer) AnnounceNow(ih string) {
+	lpd.send(ih)
+}
 
-		// Announce at launch, then every 5 minutes
-		_, err := lpd.conn.WriteToUDP(requestMessage, lpd.addr)
+func (lpd *Announcer) send(ih string) {
+	for _, c := range lpd.conns {
+		requestMessage := []byte(fmt.Sprintf(request_template, c.addr.String(),
+			lpd.btPort, ih, lpd.cookie))
+		_, err := c.conn.WriteToUDP(requestMessage, c.addr)
 		if err != nil {
 			log.Println(err)
 		}
+	}
+}
 
-		ticker := time.NewTicker(5 * time.Minute)
-		lpd.activeAnnounces[ih] = ticker
+func (lpd *Announcer) StopAnnouncing(ih string) {
+	lpd.mu.Lock()
+	defer lpd.mu.Unlock()
+	if stop, ok := lpd.activeAnnounces[ih]; ok {
+		close(stop)
+		delete(lpd.activeAnnounces, ih)
+	}
+}
 
-		for _ = range ticker.C {
-			_, err := lpd.conn.WriteToUDP(requestMessage, lpd.addr)
-			if err != nil {
-				log.Println(err)
-			}
+// jitter returns d randomly adjusted by up to +/- fraction of itself.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	return d + time.Duration((mathrand.Float64()*2-1)*fraction*float64(d))
+}
+
+// lpdRateLimiter counts announcements per source over fixed windows.
+type lpdRateLimiter struct {
+	mu      sync.Mutex
+	max     int
+	window  time.Duration
+	sources map[string]*lpdSourceCount
+}
+
+type lpdSourceCount struct {
+	start time.Time
+	n     int
+}
+
+func newLPDRateLimiter(max int, window time.Duration) *lpdRateLimiter {
+	return &lpdRateLimiter{
+		max:     max,
+		window:  window,
+		sources: make(map[string]*lpdSourceCount),
+	}
+}
+
+// Allow reports whether another announcement from source may be acted on.
+func (l *lpdRateLimiter) Allow(source string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.sources[source]
+	if !ok || now.Sub(c.start) >= l.window {
+		if !ok && len(l.sources) >= 1024 {
+			l.expire(now)
 		}
-	}()
+		c = &lpdSourceCount{start: now}
+		l.sources[source] = c
+	}
+	c.n++
+	return c.n <= l.max
 }
 
-func (lpd *Announcer) StopAnnouncing(ih string) {
-	if ticker, ok := lpd.activeAnnounces[ih]; ok {
-		ticker.Stop()
-		delete(lpd.activeAnnounces, ih)
+func (l *lpdRateLimiter) expire(now time.Time) {
+	for source, c := range l.sources {
+		if now.Sub(c.start) >= l.window {
+			delete(l.sources, source)
+		}
 	}
 }
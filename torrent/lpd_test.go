@@ -0,0 +1,67 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseAnnounce(t *testing.T) {
+	from := &net.UDPAddr{IP: net.ParseIP("192.168.1.5"), Port: 6771}
+	packet := fmt.Sprintf(request_template, LPD_IPV4_GROUP, 7777, "\x01\x02", "abcd")
+	ann, cookie, err := parseAnnounce([]byte(packet), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ann.Peer != "192.168.1.5:7777" || ann.Infohash != "0102" || cookie != "abcd" {
+		t.Errorf("parseAnnounce = %v, %q, want {192.168.1.5:7777 0102}, \"abcd\"", ann, cookie)
+	}
+
+	from6 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6771}
+	packet = fmt.Sprintf(request_template, LPD_IPV6_GROUP, 7777, "\x01\x02", "abcd")
+	ann, _, err = parseAnnounce([]byte(packet), from6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ann.Peer != "[fe80::1]:7777" {
+		t.Errorf("parseAnnounce peer = %v, want [fe80::1]:7777", ann.Peer)
+	}
+
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\nHost: x\r\nPort: 1\r\nInfohash: 01\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: x\r\nPort: 1\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: x\r\nInfohash: 01\r\n\r\n",
+		"garbage",
+	} {
+		if _, _, err = parseAnnounce([]byte(bad), from); err == nil {
+			t.Errorf("parseAnnounce(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestLPDRateLimiter(t *testing.T) {
+	l := newLPDRateLimiter(2, time.Minute)
+	now := time.Now()
+	if !l.Allow("a", now) || !l.Allow("a", now) {
+		t.Fatal("First two announces should be allowed")
+	}
+	if l.Allow("a", now) {
+		t.Error("Third announce in the window should be dropped")
+	}
+	if !l.Allow("b", now) {
+		t.Error("Other sources should not be limited")
+	}
+	if !l.Allow("a", now.Add(time.Minute)) {
+		t.Error("Announces should be allowed again in the next window")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Minute, 0.1)
+		if d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("jitter(1m, 0.1) = %v, out of range", d)
+		}
+	}
+}
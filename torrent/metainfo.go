@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
@@ -10,8 +11,11 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"golang.org/x/net/proxy"
@@ -21,21 +25,23 @@ import (
 )
 
 type FileDict struct {
-	Length int64
-	Path   []string
-	Md5sum string
+	Length int64    `bencode:"length"` // Other clients insist on a length, even for empty files.
+	Path   []string `bencode:"path,omitempty"`
+	Md5sum string   `bencode:"md5sum,omitempty"`
+	Attr   string   `bencode:"attr,omitempty"` // "p" for BEP 47 padding files
 }
 
 type InfoDict struct {
-	PieceLength int64 `bencode:"piece length"`
-	Pieces      string
-	Private     int64
-	Name        string
+	PieceLength int64  `bencode:"piece length,omitempty"`
+	Pieces      string `bencode:"pieces,omitempty"`
+	Private     int64  `bencode:"private,omitempty"`
+	Source      string `bencode:"source,omitempty"`
+	Name        string `bencode:"name,omitempty"`
 	// Single File Mode
-	Length int64
-	Md5sum string
+	Length int64  `bencode:"length,omitempty"`
+	Md5sum string `bencode:"md5sum,omitempty"`
 	// Multiple File mode
-	Files []FileDict
+	Files []FileDict `bencode:"files,omitempty"`
 }
 
 type MetaInfo struct {
@@ -47,6 +53,46 @@ type MetaInfo struct {
 	Comment      string
 	CreatedBy    string `bencode:"created by"`
 	Encoding     string
+
+	// BitTorrent v2 (BEP 52). MetaVersion is 2 for v2 and hybrid torrents.
+	MetaVersion int64
+	FilesV2     []FileDictV2
+	PieceLayers map[string]string // Pieces root -> hashes of the file's pieces
+	InfoHashV2  string            // The full SHA-256 info-hash
+
+	// Web seeds (BEP 19), from the url-list or the magnet link we were
+	// started with. ResolveWebSeeds gives the URL of each file.
+	WebSeeds []string
+
+	// HTTP seeds (BEP 17), which serve pieces rather than files.
+	HTTPSeeds []string
+
+	// Top level keys we don't understand, with their bencoded values.
+	// Bencode writes them back out.
+	Extra map[string][]byte
+
+	// The bencoded info dictionary that InfoHash was computed from, if we
+	// have it. Served to peers fetching metadata from us.
+	rawInfo []byte
+
+	piecesV2 []pieceV2 // The pieces of a pure v2 torrent
+
+	magnetName  string   // The display name of the magnet link, made safe
+	magnetPeers []string // Peers the magnet link told us about
+}
+
+// The top level keys GetMetaInfo reads. Others go in MetaInfo.Extra.
+var knownMetaInfoKeys = map[string]bool{
+	"info":          true,
+	"announce":      true,
+	"announce-list": true,
+	"creation date": true,
+	"comment":       true,
+	"created by":    true,
+	"encoding":      true,
+	"piece layers":  true,
+	"url-list":      true,
+	"httpseeds":     true,
 }
 
 func getString(m map[string]interface{}, k string) string {
@@ -82,9 +128,13 @@ func getSliceSliceString(m map[string]interface{}, k string) (aas [][]string) {
 }
 
 func GetMetaInfo(dialer proxy.Dialer, torrent string) (metaInfo *MetaInfo, err error) {
+	return getMetaInfo(context.Background(), dialer, torrent)
+}
+
+func getMetaInfo(ctx context.Context, dialer proxy.Dialer, torrent string) (metaInfo *MetaInfo, err error) {
 	var input io.ReadCloser
-	if strings.HasPrefix(torrent, "http:") {
-		r, err := proxyHttpGet(dialer, torrent)
+	if isTorrentURL(torrent) {
+		r, err := proxyHttpGet(ctx, dialer, torrent)
 		if err != nil {
 			return nil, err
 		}
@@ -96,15 +146,35 @@ func GetMetaInfo(dialer proxy.Dialer, torrent string) (metaInfo *MetaInfo, err e
 			return nil, err
 		}
 
-		ih, err := dht.DecodeInfoHash(magnet.InfoHashes[0])
-		if err != nil {
-			return nil, err
+		metaInfo = &MetaInfo{AnnounceList: magnet.Trackers}
+		metaInfo.WebSeeds = appendUnique(magnet.WebSeeds, magnet.AcceptableSources...)
+		metaInfo.magnetPeers = magnet.Peers
+		if len(magnet.InfoHashesV2) > 0 {
+			v2, err := hex.DecodeString(magnet.InfoHashesV2[0])
+			if err != nil {
+				return nil, err
+			}
+			metaInfo.InfoHashV2 = string(v2)
+			// A pure v2 torrent is known by its truncated v2 info-hash.
+			metaInfo.InfoHash = metaInfo.InfoHashV2[:20]
 		}
-
-		metaInfo = &MetaInfo{InfoHash: string(ih), AnnounceList: magnet.Trackers}
+		if len(magnet.InfoHashes) > 0 {
+			ih, err := dht.DecodeInfoHash(magnet.InfoHashes[0])
+			if err != nil {
+				return nil, err
+			}
+			metaInfo.InfoHash = string(ih)
+		}
+		ih := metaInfo.InfoHash
 
 		//Gives us something to call the torrent until metadata can be procurred
 		metaInfo.Info.Name = hex.EncodeToString([]byte(ih))
+		if len(magnet.Names) > 0 {
+			if name := sanitizeName(magnet.Names[0]); name != "" {
+				metaInfo.Info.Name = name
+				metaInfo.magnetName = name
+			}
+		}
 
 		return metaInfo, err
 
@@ -113,49 +183,67 @@ func GetMetaInfo(dialer proxy.Dialer, torrent string) (metaInfo *MetaInfo, err e
 			return
 		}
 	}
+	defer input.Close()
+	return ReadMetaInfo(input)
+}
 
-	// We need to calcuate the sha1 of the Info map, including every value in the
-	// map. The easiest way to do this is to read the data using the Decode
-	// API, and then pick through it manually.
-	var m interface{}
-	m, err = bencode.Decode(input)
-	input.Close()
+// ReadMetaInfo parses a .torrent file.
+func ReadMetaInfo(input io.Reader) (metaInfo *MetaInfo, err error) {
+	// We need to calcuate the sha1 of the Info map exactly as it was encoded,
+	// including values we don't understand. So we keep the raw bytes of each
+	// top level value, as well as decoding them.
+	data, err := ioutil.ReadAll(io.LimitReader(input, int64(MetaInfoLimits.MaxSize)+1))
 	if err != nil {
-		err = errors.New("Couldn't parse torrent file phase 1: " + err.Error())
 		return
 	}
-
-	topMap, ok := m.(map[string]interface{})
-	if !ok {
-		err = errors.New("Couldn't parse torrent file phase 2.")
+	// Our own check gives better errors than the decoder does.
+	if err = CheckBencode(data, false); err != nil {
+		err = errors.New("Couldn't parse torrent file: " + err.Error())
 		return
 	}
-
-	infoMap, ok := topMap["info"]
-	if !ok {
-		err = errors.New("Couldn't parse torrent file. info")
+	rawInfo, rawValues, topMap, err := decodeMetaInfo(data)
+	if err != nil {
+		err = errors.New("Couldn't parse torrent file phase 1: " + err.Error())
 		return
 	}
-	var b bytes.Buffer
-	if err = bencode.Marshal(&b, infoMap); err != nil {
+	if rawInfo == nil {
+		err = errors.New("Couldn't parse torrent file. info")
 		return
 	}
 	hash := sha1.New()
-	hash.Write(b.Bytes())
+	hash.Write(rawInfo)
 
 	var m2 MetaInfo
-	err = bencode.Unmarshal(&b, &m2.Info)
+	m2.rawInfo = rawInfo
+	infoMap, err := m2.decodeInfo(rawInfo)
 	if err != nil {
 		return
 	}
+	for k, v := range rawValues {
+		if !knownMetaInfoKeys[k] {
+			if m2.Extra == nil {
+				m2.Extra = map[string][]byte{}
+			}
+			m2.Extra[k] = v
+		}
+	}
 
 	m2.InfoHash = string(hash.Sum(nil))
+	if err = m2.parseV2(infoMap, topMap); err != nil {
+		return
+	}
 	m2.Announce = getString(topMap, "announce")
 	m2.AnnounceList = getSliceSliceString(topMap, "announce-list")
 	m2.CreationDate = getString(topMap, "creation date")
+	if d, ok := topMap["creation date"].(int64); ok {
+		// The spec says it's an integer, seconds since the epoch.
+		m2.CreationDate = strconv.FormatInt(d, 10)
+	}
 	m2.Comment = getString(topMap, "comment")
 	m2.CreatedBy = getString(topMap, "created by")
 	m2.Encoding = strings.ToUpper(getString(topMap, "encoding"))
+	m2.WebSeeds = getWebSeeds(topMap, "url-list")
+	m2.HTTPSeeds = getWebSeeds(topMap, "httpseeds")
 
 	metaInfo = &m2
 	return
@@ -299,7 +387,7 @@ func CreateMetaInfoFromFileSystem(fs MetaInfoFileSystem, root, tracker string, p
 		return
 	}
 	var sums []byte
-	sums, err = computeSums(fileStore, totalLength, int64(pieceLength))
+	sums, err = computeSums(context.Background(), fileStore, totalLength, int64(pieceLength))
 	if err != nil {
 		return
 	}
@@ -411,98 +499,74 @@ func (m *MetaInfo) addFiles(fs MetaInfoFileSystem, file string) (err error) {
 // Updates the InfoHash field. Call this after manually changing the Info data.
 func (m *MetaInfo) UpdateInfoHash(metaInfo *MetaInfo) (err error) {
 	var b bytes.Buffer
-	infoMap := m.Info.toMap()
-	if len(infoMap) > 0 {
-		err = bencode.Marshal(&b, infoMap)
-		if err != nil {
-			return
-		}
+	if err = bencodeMarshal(&b, m.infoDict()); err != nil {
+		return
 	}
 	hash := sha1.New()
 	hash.Write(b.Bytes())
 
 	m.InfoHash = string(hash.Sum(nil))
+	m.rawInfo = b.Bytes()
+	err = m.updateV2()
 	return
 }
 
-// Copy the non-default values from an InfoDict to a map.
-func (i *InfoDict) toMap() (m map[string]interface{}) {
-	id := map[string]interface{}{}
-	// InfoDict
-	if i.PieceLength != 0 {
-		id["piece length"] = i.PieceLength
-	}
-	if i.Pieces != "" {
-		id["pieces"] = i.Pieces
-	}
-	if i.Private != 0 {
-		id["private"] = i.Private
-	}
-	if i.Name != "" {
-		id["name"] = i.Name
-	}
-	if i.Length != 0 {
-		id["length"] = i.Length
-	}
-	if i.Md5sum != "" {
-		id["md5sum"] = i.Md5sum
-	}
-	if len(i.Files) > 0 {
-		var fi []map[string]interface{}
-		for ii := range i.Files {
-			f := &i.Files[ii]
-			fd := map[string]interface{}{}
-			if f.Length > 0 {
-				fd["length"] = f.Length
-			}
-			if len(f.Path) > 0 {
-				fd["path"] = f.Path
-			}
-			if f.Md5sum != "" {
-				fd["md5sum"] = f.Md5sum
-			}
-			if len(fd) > 0 {
-				fi = append(fi, fd)
-			}
-		}
-		if len(fi) > 0 {
-			id["files"] = fi
-		}
-	}
-	if len(id) > 0 {
-		m = id
-	}
-	return
+// The top level of a .torrent file, apart from the keys we don't know.
+type metaInfoFile struct {
+	Info         interface{}       `bencode:"info,omitempty"`
+	PieceLayers  map[string]string `bencode:"piece layers,omitempty"`
+	Announce     string            `bencode:"announce,omitempty"`
+	AnnounceList [][]string        `bencode:"announce-list,omitempty"`
+	CreationDate interface{}       `bencode:"creation date,omitempty"`
+	Comment      string            `bencode:"comment,omitempty"`
+	CreatedBy    string            `bencode:"created by,omitempty"`
+	Encoding     string            `bencode:"encoding,omitempty"`
+	WebSeeds     []string          `bencode:"url-list,omitempty"`
+	HTTPSeeds    []string          `bencode:"httpseeds,omitempty"`
 }
 
-// Encode to Bencode, but only encode non-default values.
+// Encode to Bencode, but only encode non-default values. The info dictionary
+// is written exactly as it was read or last hashed.
 func (m *MetaInfo) Bencode(w io.Writer) (err error) {
-	var mi map[string]interface{} = map[string]interface{}{}
-	id := m.Info.toMap()
-	if len(id) > 0 {
-		mi["info"] = id
+	f := metaInfoFile{
+		Info:         m.infoDict(),
+		PieceLayers:  m.PieceLayers,
+		Announce:     m.Announce,
+		AnnounceList: m.AnnounceList,
+		Comment:      m.Comment,
+		CreatedBy:    m.CreatedBy,
+		Encoding:     m.Encoding,
+		WebSeeds:     m.WebSeeds,
+		HTTPSeeds:    m.HTTPSeeds,
+	}
+	if len(m.rawInfo) > 0 {
+		f.Info = rawBencode(m.rawInfo)
 	}
 	// Do not encode InfoHash. Clients are supposed to calculate it themselves.
-	if m.Announce != "" {
-		mi["announce"] = m.Announce
+	if d, err := strconv.ParseInt(m.CreationDate, 10, 64); err == nil {
+		f.CreationDate = d
+	} else if m.CreationDate != "" {
+		f.CreationDate = m.CreationDate
 	}
-	if len(m.AnnounceList) > 0 {
-		mi["announce-list"] = m.AnnounceList
+	if len(m.Extra) == 0 {
+		return bencodeMarshal(w, f)
 	}
-	if m.CreationDate != "" {
-		mi["creation date"] = m.CreationDate
+	var b bytes.Buffer
+	if err = bencodeMarshal(&b, f); err != nil {
+		return
 	}
-	if m.Comment != "" {
-		mi["comment"] = m.Comment
+	known, err := bencodeDictValues(b.Bytes())
+	if err != nil {
+		return
 	}
-	if m.CreatedBy != "" {
-		mi["created by"] = m.CreatedBy
+	mi := map[string]rawBencode{}
+	for k, v := range m.Extra {
+		mi[k] = v
 	}
-	if m.Encoding != "" {
-		mi["encoding"] = m.Encoding
+	for k, v := range known {
+		mi[k] = v
 	}
-	bencode.Marshal(w, mi)
-	return
+	return bencodeMarshal(w, mi)
 }
 
 type TrackerResponse struct {
@@ -515,15 +579,17 @@ type TrackerResponse struct {
 	Incomplete     uint
 	Peers          string
 	Peers6         string
+	ExternalIP     string `bencode:"external ip"`
 }
 
 type SessionInfo struct {
-	PeerID     string
-	Port       uint16
-	OurAddresses map[string]bool //List of addresses that resolve to ourselves.
-	Uploaded   uint64
-	Downloaded uint64
-	Left       uint64
+	PeerID            string
+	Port              uint16
+	OurAddresses      map[string]bool //List of addresses that resolve to ourselves.
+	Uploaded          uint64
+	Downloaded        uint64
+	WebSeedDownloaded uint64 // The part of Downloaded that came from web seeds
+	Left              uint64
 
 	UseDHT      bool
 	FromMagnet  bool
@@ -538,22 +604,36 @@ type MetaDataExchange struct {
 	Pieces       [][]byte
 }
 
-func getTrackerInfo(dialer proxy.Dialer, url string) (tr *TrackerResponse, err error) {
-	r, err := proxyHttpGet(dialer, url)
+func getTrackerInfo(ctx context.Context, client *http.Client, url string, traffic *trafficCounter) (tr *TrackerResponse, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return
+	}
+	r, err := client.Do(req)
 	if err != nil {
 		return
 	}
 	defer r.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_TRACKER_RESPONSE+1))
+	traffic.addReceived(TRAFFIC_TRACKER, len(data))
+	if err != nil {
+		return
+	}
+	if len(data) > MAX_TRACKER_RESPONSE {
+		err = errTrackerResponseTooLong
+		return
+	}
 	if r.StatusCode >= 400 {
-		data, _ := ioutil.ReadAll(r.Body)
 		reason := "Bad Request " + string(data)
 		log.Println(reason)
 		err = errors.New(reason)
 		return
 	}
+	if err = CheckBencodeLimits(data, false, WireLimits); err != nil {
+		return
+	}
 	var tr2 TrackerResponse
-	err = bencode.Unmarshal(r.Body, &tr2)
-	r.Body.Close()
+	err = bencode.Unmarshal(bytes.NewReader(data), &tr2)
 	if err != nil {
 		return
 	}
@@ -561,21 +641,51 @@ func getTrackerInfo(dialer proxy.Dialer, url string) (tr *TrackerResponse, err e
 	return
 }
 
-func saveMetaInfo(metadata string) (err error) {
-	var info InfoDict
-	err = bencode.Unmarshal(bytes.NewReader([]byte(metadata)), &info)
+// Where saveMetaInfo keeps the torrent for an info-hash.
+func savedMetaInfoPath(dir, infoHash string) string {
+	return filepath.Join(dir, hex.EncodeToString([]byte(infoHash))+".torrent")
+}
+
+// saveMetaInfo writes a torrent whose metadata we fetched from peers to dir,
+// so that we don't have to fetch it again.
+func saveMetaInfo(dir string, m *MetaInfo) (err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	name := savedMetaInfoPath(dir, m.InfoHash)
+	f, err := ioutil.TempFile(dir, ".metainfo")
 	if err != nil {
 		return
 	}
+	err = m.Bencode(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
 
-	f, err := os.Create(info.Name + ".torrent")
+// loadSavedMetaInfo reads the torrent saveMetaInfo wrote for the magnet link
+// described by magnet. It's only trusted if it has the info-hash we expect.
+func loadSavedMetaInfo(dir string, magnet *MetaInfo) (m *MetaInfo, err error) {
+	m, err = GetMetaInfo(nil, savedMetaInfoPath(dir, magnet.InfoHash))
 	if err != nil {
-		log.Println("Error when opening file for creation: ", err)
 		return
 	}
-	defer f.Close()
-
-	_, err = f.WriteString(metadata)
-
+	if !m.hasInfoHash(magnet.InfoHash) {
+		return nil, fmt.Errorf("Saved torrent has info-hash %x, not %x", m.InfoHash, magnet.InfoHash)
+	}
+	// The magnet link may know about more trackers and web seeds.
+	if _, err := m.addTrackers(magnet.AnnounceList); err != nil {
+		log.Println("[", m.Info.Name, "] Ignoring the magnet link's trackers:", err)
+	}
+	m.WebSeeds = appendUnique(m.WebSeeds, magnet.WebSeeds...)
+	m.magnetName = magnet.magnetName
+	m.magnetPeers = magnet.magnetPeers
 	return
 }
@@ -0,0 +1,250 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// Decoding .torrent files without building a generic value for the whole
+// thing first. The info dictionary of a torrent with many files is large,
+// and most of it goes straight into []FileDict, so we decode it straight
+// there. Small values we don't model are decoded generically.
+
+type bencodeReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bencodeReader) fail(msg string) error {
+	return &BencodeError{Offset: r.pos, Msg: msg}
+}
+
+func (r *bencodeReader) peek() byte {
+	if r.pos >= len(r.data) {
+		return 0
+	}
+	return r.data[r.pos]
+}
+
+// The bytes of a string, without copying them.
+func (r *bencodeReader) bytes() (b []byte, err error) {
+	i := bytes.IndexByte(r.data[r.pos:], ':')
+	if i < 0 {
+		return nil, r.fail("invalid string length")
+	}
+	n, err := strconv.Atoi(string(r.data[r.pos : r.pos+i]))
+	start := r.pos + i + 1
+	if err != nil || n < 0 || n > len(r.data)-start {
+		return nil, r.fail("invalid string length")
+	}
+	r.pos = start + n
+	return r.data[start:r.pos], nil
+}
+
+func (r *bencodeReader) string() (s string, err error) {
+	if c := r.peek(); c < '0' || c > '9' {
+		return "", r.fail("expected a string")
+	}
+	b, err := r.bytes()
+	return string(b), err
+}
+
+func (r *bencodeReader) int() (n int64, err error) {
+	if r.peek() != 'i' {
+		return 0, r.fail("expected an integer")
+	}
+	i := bytes.IndexByte(r.data[r.pos:], 'e')
+	if i < 0 {
+		return 0, r.fail("unterminated integer")
+	}
+	if n, err = strconv.ParseInt(string(r.data[r.pos+1:r.pos+i]), 10, 64); err != nil {
+		return 0, r.fail("invalid integer")
+	}
+	r.pos += i + 1
+	return
+}
+
+// dict calls f for each key of a dictionary. f must read or skip the value.
+func (r *bencodeReader) dict(f func(key string) error) (err error) {
+	if r.peek() != 'd' {
+		return r.fail("expected a dictionary")
+	}
+	r.pos++
+	for r.peek() != 'e' {
+		var key []byte
+		if key, err = r.bytes(); err != nil {
+			return
+		}
+		if err = f(string(key)); err != nil {
+			return
+		}
+	}
+	r.pos++
+	return
+}
+
+// list calls f for each element of a list. f must read or skip it.
+func (r *bencodeReader) list(f func() error) (err error) {
+	if r.peek() != 'l' {
+		return r.fail("expected a list")
+	}
+	r.pos++
+	for r.peek() != 'e' {
+		if r.pos >= len(r.data) {
+			return r.fail("unterminated list")
+		}
+		if err = f(); err != nil {
+			return
+		}
+	}
+	r.pos++
+	return
+}
+
+// raw returns the bytes of the next value, without decoding it.
+func (r *bencodeReader) raw() (b []byte, err error) {
+	start := r.pos
+	if r.pos, err = bencodeSkip(r.data, r.pos); err != nil {
+		return
+	}
+	return r.data[start:r.pos], nil
+}
+
+// value decodes the next value generically, the way bencode.Decode does.
+func (r *bencodeReader) value() (v interface{}, err error) {
+	switch c := r.peek(); {
+	case c == 'i':
+		return r.int()
+	case c >= '0' && c <= '9':
+		return r.string()
+	case c == 'l':
+		l := []interface{}{}
+		err = r.list(func() (err error) {
+			var e interface{}
+			e, err = r.value()
+			l = append(l, e)
+			return
+		})
+		return l, err
+	case c == 'd':
+		d := map[string]interface{}{}
+		err = r.dict(func(key string) (err error) {
+			d[key], err = r.value()
+			return
+		})
+		return d, err
+	}
+	return nil, r.fail("unexpected data")
+}
+
+// The strings of a list, like a file's path.
+func (r *bencodeReader) strings() (l []string, err error) {
+	err = r.list(func() (err error) {
+		var s string
+		s, err = r.string()
+		l = append(l, s)
+		return
+	})
+	return
+}
+
+func (r *bencodeReader) fileDict() (f FileDict, err error) {
+	err = r.dict(func(key string) (err error) {
+		switch key {
+		case "length":
+			f.Length, err = r.int()
+		case "path":
+			f.Path, err = r.strings()
+		case "md5sum":
+			f.Md5sum, err = r.string()
+		case "attr":
+			f.Attr, err = r.string()
+		default:
+			_, err = r.raw()
+		}
+		return
+	})
+	return
+}
+
+// decodeInfoDict decodes a bencoded info dictionary. v2 holds the keys
+// parseV2 needs, if it's a v2 torrent.
+func decodeInfoDict(data []byte) (info InfoDict, v2 map[string]interface{}, err error) {
+	// The reader trusts what it reads to be within MetaInfoLimits.
+	if _, err = checkBencodePrefix(data, false, MetaInfoLimits); err != nil {
+		return
+	}
+	r := &bencodeReader{data: data}
+	err = r.dict(func(key string) (err error) {
+		switch key {
+		case "piece length":
+			info.PieceLength, err = r.int()
+		case "pieces":
+			// The only copy of the piece hashes.
+			info.Pieces, err = r.string()
+		case "private":
+			info.Private, err = r.int()
+		case "source":
+			info.Source, err = r.string()
+		case "name":
+			info.Name, err = r.string()
+		case "length":
+			info.Length, err = r.int()
+		case "md5sum":
+			info.Md5sum, err = r.string()
+		case "files":
+			err = r.list(func() (err error) {
+				var f FileDict
+				f, err = r.fileDict()
+				info.Files = append(info.Files, f)
+				return
+			})
+		case "meta version", "file tree":
+			if v2 == nil {
+				v2 = map[string]interface{}{}
+			}
+			v2[key], err = r.value()
+		default:
+			_, err = r.raw()
+		}
+		if err != nil {
+			err = fmt.Errorf("Bad %q in info dictionary: %v", key, err)
+		}
+		return
+	})
+	return
+}
+
+// decodeInfo sets m.Info from a bencoded info dictionary, returning the
+// values parseV2 needs.
+func (m *MetaInfo) decodeInfo(data []byte) (v2 map[string]interface{}, err error) {
+	info, v2, err := decodeInfoDict(data)
+	if err != nil {
+		return
+	}
+	m.Info = info
+	return
+}
+
+// decodeMetaInfo splits a .torrent file into its raw info dictionary, the
+// raw bytes of every other value, and the generic values of the keys
+// GetMetaInfo reads. data must have passed CheckBencode.
+func decodeMetaInfo(data []byte) (rawInfo []byte, rawValues map[string][]byte, topMap map[string]interface{}, err error) {
+	r := &bencodeReader{data: data}
+	rawValues = map[string][]byte{}
+	topMap = map[string]interface{}{}
+	err = r.dict(func(key string) (err error) {
+		start := r.pos
+		if key == "info" {
+			rawInfo, err = r.raw()
+		} else if knownMetaInfoKeys[key] {
+			topMap[key], err = r.value()
+		} else {
+			_, err = r.raw()
+		}
+		rawValues[key] = data[start:r.pos]
+		return
+	})
+	return
+}
@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func TestDecodeInfoDict(t *testing.T) {
+	info := InfoDict{
+		PieceLength: 16384,
+		Pieces:      "01234567890123456789",
+		Private:     1,
+		Source:      "x",
+		Name:        "dir",
+		Files: []FileDict{
+			{Length: 5, Path: []string{"a", "b"}, Md5sum: "m"},
+			{Length: 16379, Path: []string{".pad", "16379"}, Attr: "p"},
+		},
+	}
+	var b bytes.Buffer
+	withUnknown := struct {
+		InfoDict
+		Unknown []interface{} `bencode:"x-unknown"`
+	}{info, []interface{}{"y", int64(2)}}
+	if err := bencodeMarshal(&b, withUnknown); err != nil {
+		t.Fatal(err)
+	}
+	got, v2, err := decodeInfoDict(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, info) || v2 != nil {
+		t.Errorf("decodeInfoDict = %+v %v, want %+v", got, v2, info)
+	}
+
+	for _, bad := range []string{"d4:name3:abc", "d12:piece lengthi1x", "d5:filesl4:abcde", "d4:name3:ab"} {
+		if _, _, err = decodeInfoDict([]byte(bad)); err == nil {
+			t.Errorf("decodeInfoDict(%q) succeeded, expected an error", bad)
+		}
+	}
+}
+
+// Writes a torrent with n files, and returns its path.
+func writeManyFileTorrent(tb testing.TB, dir string, n int) string {
+	m := &MetaInfo{Announce: "http://tracker/announce"}
+	m.Info.Name = "many"
+	m.Info.PieceLength = 1 << 20
+	var total int64
+	for i := 0; i < n; i++ {
+		f := FileDict{Length: int64(1000 + i%5000), Path: []string{"d" + strconv.Itoa(i%100), "file" + strconv.Itoa(i)}}
+		total += f.Length
+		m.Info.Files = append(m.Info.Files, f)
+	}
+	m.Info.Pieces = string(make([]byte, 20*((total+m.Info.PieceLength-1)/m.Info.PieceLength)))
+	p := filepath.Join(dir, "many.torrent")
+	f, err := os.Create(p)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	if err = m.Bencode(f); err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+func TestGetMetaInfoManyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(writeManyFileTorrent(t, dir, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := GetMetaInfo(nil, filepath.Join(dir, "many.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generic decoder must agree.
+	var want MetaInfo
+	if err = bencode.Unmarshal(bytes.NewReader(data), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Info, want.Info) || m.Announce != want.Announce {
+		t.Error("Streaming and generic decoders disagree")
+	}
+}
+
+// Compare with BenchmarkDecodeGeneric200k, which decodes the way we used to.
+func BenchmarkGetMetaInfo200k(b *testing.B) {
+	dir, err := ioutil.TempDir("", "many")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := writeManyFileTorrent(b, dir, 200000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = GetMetaInfo(nil, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeGeneric200k(b *testing.B) {
+	dir, err := ioutil.TempDir("", "many")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(writeManyFileTorrent(b, dir, 200000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = bencode.Decode(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+		var m MetaInfo
+		if err = bencode.Unmarshal(bytes.NewReader(data), &m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package torrent
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -36,3 +42,169 @@ func testOnePieceLength(t *testing.T, totalLength int64) {
 		}
 	}
 }
+
+func TestMetaInfoRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metainfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The info dictionary has a key we don't know, and isn't sorted, so
+	// re-encoding it would change the info-hash.
+	info := "d4:name1:a6:lengthi1e12:piece lengthi16384e6:pieces20:01234567890123456789" +
+		"8:x-customli1ei2eee"
+	torrent := "d8:announce8:http://a4:info" + info + "7:x-extrad1:k1:vee"
+	torrentFile := filepath.Join(dir, "a.torrent")
+	if err = ioutil.WriteFile(torrentFile, []byte(torrent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := GetMetaInfo(nil, torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha1.Sum([]byte(info))
+	if m.InfoHash != string(want[:]) {
+		t.Errorf("InfoHash = %x, want %x", m.InfoHash, want)
+	}
+
+	m.AnnounceList = [][]string{{"http://a"}, {"http://b"}}
+	var b bytes.Buffer
+	if err = m.Bencode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b.Bytes(), []byte("4:info"+info)) {
+		t.Errorf("The info dictionary didn't survive: %q", b.String())
+	}
+	if !bytes.Contains(b.Bytes(), []byte("7:x-extrad1:k1:ve")) {
+		t.Errorf("The unknown key didn't survive: %q", b.String())
+	}
+	if err = ioutil.WriteFile(torrentFile, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := GetMetaInfo(nil, torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.InfoHash != m.InfoHash || len(m2.AnnounceList) != 2 {
+		t.Errorf("Round trip gave InfoHash %x, AnnounceList %v", m2.InfoHash, m2.AnnounceList)
+	}
+}
+
+func TestSavedMetaInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &MetaInfo{}
+	m.Info = InfoDict{PieceLength: 16384, Pieces: "01234567890123456789", Name: "a", Length: 1}
+	if err = m.UpdateInfoHash(nil); err != nil {
+		t.Fatal(err)
+	}
+	magnet := &MetaInfo{InfoHash: m.InfoHash, AnnounceList: [][]string{{"http://t/announce"}}}
+	if err = saveMetaInfo(dir, m); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := loadSavedMetaInfo(dir, magnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.InfoHash != m.InfoHash || saved.Info.Name != "a" || len(saved.AnnounceList) != 1 {
+		t.Errorf("Loaded %+v", saved)
+	}
+
+	// A saved file that doesn't match its name isn't trusted.
+	other := &MetaInfo{InfoHash: "abcdefghijabcdefghij"}
+	data, err := ioutil.ReadFile(savedMetaInfoPath(dir, m.InfoHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(savedMetaInfoPath(dir, other.InfoHash), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadSavedMetaInfo(dir, other); err == nil {
+		t.Error("Expected an error for a saved torrent with the wrong info-hash")
+	}
+	if _, err = loadSavedMetaInfo(dir, &MetaInfo{InfoHash: "01234567890123456789"}); !os.IsNotExist(err) {
+		t.Errorf("Missing saved torrent gave %v, want a not-exist error", err)
+	}
+}
+
+// Info dictionaries with keys we rarely see, or don't model, or in an order
+// we wouldn't write. The hashes were computed with sha1sum.
+var infoHashTests = []struct {
+	info string
+	hash string
+}{
+	{"d5:filesld4:attr1:p6:lengthi16379e4:pathl4:.pad5:16379eed6:lengthi5e6:md5sum32:0123456789abcdef0123456789abcdef4:pathl1:aeee4:name3:dir12:piece lengthi16384e6:pieces20:01234567890123456789e",
+		"beea72304d700c209619b2aab046652af39b1d4b"},
+	{"d6:lengthi10e4:name1:a12:piece lengthi16384e6:pieces20:012345678901234567897:privatei1e6:source3:ABC10:x-the-keys4:keepe",
+		"819f1aae0202b7af640a60851939497b721cf58a"},
+	{"d4:name1:a6:lengthi10e12:piece lengthi16384e6:pieces20:01234567890123456789e",
+		"acef8a414f8c4a440233a1bb34b79404474880b0"},
+}
+
+func TestInfoHashFromRawBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infohash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, tt := range infoHashTests {
+		torrentFile := filepath.Join(dir, "t.torrent")
+		data := "d8:announce14:http://t/a/ann4:info" + tt.info + "e"
+		if err = ioutil.WriteFile(torrentFile, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		m, err := GetMetaInfo(nil, torrentFile)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if got := hex.EncodeToString([]byte(m.InfoHash)); got != tt.hash {
+			t.Errorf("%d: info-hash %v, want %v", i, got, tt.hash)
+		}
+		// What we serve to peers fetching the metadata is what we hashed.
+		if string(m.rawInfo) != tt.info {
+			t.Errorf("%d: raw info %q, want %q", i, m.rawInfo, tt.info)
+		}
+		var b bytes.Buffer
+		if err = m.Bencode(&b); err != nil || b.String() != data {
+			t.Errorf("%d: wrote %q, %v, want %q", i, b.String(), err, data)
+		}
+	}
+}
+
+// A torrent file parses, or doesn't. One that parses is known by the hash of
+// its info dictionary as it was written, and keeps it when it's written out.
+func FuzzReadMetaInfo(f *testing.F) {
+	if data, err := ioutil.ReadFile("../testData/a.torrent"); err == nil {
+		f.Add(data)
+	}
+	for _, tt := range infoHashTests {
+		f.Add([]byte("d8:announce14:http://t/a/ann4:info" + tt.info + "e"))
+	}
+	f.Add([]byte("d4:infod4:name1:a12:piece lengthi16384e6:lengthi-1e6:pieces0:ee"))
+	f.Add([]byte("d4:infod5:filesld4:pathl2:..1:ae6:lengthi1eee4:name1:a12:piece lengthi1e6:pieces20:01234567890123456789ee"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ReadMetaInfo(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if sum := sha1.Sum(m.rawInfo); m.InfoHash != string(sum[:]) {
+			t.Fatalf("Info-hash %x, but the info dictionary's is %x", m.InfoHash, sum)
+		}
+		if m.validate() != nil {
+			return
+		}
+		m.storeInfo()
+		var b bytes.Buffer
+		if err = m.Bencode(&b); err != nil {
+			t.Fatalf("Can't write %q back out: %v", data, err)
+		}
+		m2, err := ReadMetaInfo(&b)
+		if err != nil || m2.InfoHash != m.InfoHash {
+			t.Fatalf("%q was written out as %q, which reads back as %v", data, b.Bytes(), err)
+		}
+	})
+}
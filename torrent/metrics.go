@@ -0,0 +1,302 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics in the Prometheus text format, served at /metrics by the control
+// API. Torrents are labelled with the start of their info-hash, which keeps
+// the labels short and free of odd characters, unlike their names.
+
+const METRICS_INFOHASH_LABEL_LENGTH = 12 // Hex digits
+
+// The upper bounds of the disk latency histograms' buckets, in seconds.
+var diskLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// A histogram that many goroutines can add to.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // Per bucket, not cumulative. The last is for +Inf.
+	sum    int64    // Nanoseconds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// What the torrents' files have had read and written, over every torrent.
+type diskStats struct {
+	read, written uint64 // Bytes
+	readLatency   *histogram
+	writeLatency  *histogram
+}
+
+func newDiskStats() *diskStats {
+	return &diskStats{readLatency: newHistogram(diskLatencyBuckets), writeLatency: newHistogram(diskLatencyBuckets)}
+}
+
+// A FileStore that keeps diskStats. It goes under any cache, so it sees
+// what really reaches the files.
+type meteredStore struct {
+	FileStore
+	stats *diskStats
+}
+
+func (m *meteredStore) ReadAt(p []byte, off int64) (n int, err error) {
+	start := time.Now()
+	n, err = m.FileStore.ReadAt(p, off)
+	m.stats.readLatency.observe(time.Since(start))
+	atomic.AddUint64(&m.stats.read, uint64(n))
+	return
+}
+
+func (m *meteredStore) WritePiece(buffer []byte, piece int) (n int, err error) {
+	start := time.Now()
+	n, err = m.FileStore.WritePiece(buffer, piece)
+	m.stats.writeLatency.observe(time.Since(start))
+	atomic.AddUint64(&m.stats.written, uint64(n))
+	return
+}
+
+func (m *meteredStore) WriteSegment(p []byte, piece int, begin int) (n int, err error) {
+	start := time.Now()
+	n, err = writeSegment(m.FileStore, p, piece, begin)
+	m.stats.writeLatency.observe(time.Since(start))
+	atomic.AddUint64(&m.stats.written, uint64(n))
+	return
+}
+
+func (m *meteredStore) writesSegments() bool {
+	return canWriteSegments(m.FileStore)
+}
+
+// A CacheProvider that counts how often its caches had what was read.
+type cacheCounter interface {
+	CacheHits() (hits, misses uint64)
+}
+
+// Writes metrics in the text format. The first error sticks, and the rest
+// of the writes are skipped.
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *metricsWriter) printf(format string, a ...interface{}) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, format, a...)
+	}
+}
+
+// Starts a metric family.
+func (m *metricsWriter) family(name, kind, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Writes a sample. labels are name, value pairs.
+func (m *metricsWriter) sample(name string, v float64, labels ...string) {
+	m.printf("%s", name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		m.printf("%s%s=%s", sep, labels[i], strconv.Quote(labels[i+1]))
+	}
+	if len(labels) > 0 {
+		m.printf("}")
+	}
+	m.printf(" %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (m *metricsWriter) histogram(name, help string, h *histogram) {
+	m.family(name, "histogram", help)
+	var total uint64
+	for i := range h.counts {
+		total += atomic.LoadUint64(&h.counts[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		m.sample(name+"_bucket", float64(total), "le", le)
+	}
+	m.sample(name+"_sum", time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+	m.sample(name+"_count", float64(total))
+}
+
+// Writes an Overhead's samples, one for each kind in each direction, with
+// labels before those.
+func (m *metricsWriter) overhead(name string, o *Overhead, labels ...string) {
+	for k := TrafficKind(0); k < NUM_TRAFFIC_KINDS; k++ {
+		m.sample(name, float64(o.Received[k.String()]), append(labels, "kind", k.String(), "direction", "received")...)
+		m.sample(name, float64(o.Sent[k.String()]), append(labels, "kind", k.String(), "direction", "sent")...)
+	}
+}
+
+// The short info-hash torrents are labelled with.
+func metricsLabel(s TorrentStatus) string {
+	if len(s.InfoHash) > METRICS_INFOHASH_LABEL_LENGTH {
+		return s.InfoHash[:METRICS_INFOHASH_LABEL_LENGTH]
+	}
+	return s.InfoHash
+}
+
+// The per-torrent metrics.
+var torrentMetrics = []struct {
+	name, kind, help string
+	value            func(s *TorrentStatus) float64
+}{
+	{"taipei_torrent_downloaded_bytes_total", "counter", "Bytes downloaded from peers, over every session.",
+		func(s *TorrentStatus) float64 { return float64(s.Downloaded) }},
+	{"taipei_torrent_uploaded_bytes_total", "counter", "Bytes uploaded to peers, over every session.",
+		func(s *TorrentStatus) float64 { return float64(s.Uploaded) }},
+	{"taipei_torrent_download_rate_bytes", "gauge", "Download rate, in bytes per second.",
+		func(s *TorrentStatus) float64 { return s.DownloadRate }},
+	{"taipei_torrent_upload_rate_bytes", "gauge", "Upload rate, in bytes per second.",
+		func(s *TorrentStatus) float64 { return s.UploadRate }},
+	{"taipei_torrent_peers", "gauge", "Connected peers.",
+		func(s *TorrentStatus) float64 { return float64(s.Connected) }},
+	{"taipei_torrent_pieces", "gauge", "Pieces in the torrent.",
+		func(s *TorrentStatus) float64 { return float64(s.Pieces) }},
+	{"taipei_torrent_good_pieces", "gauge", "Pieces we have.",
+		func(s *TorrentStatus) float64 { return float64(s.GoodPieces) }},
+	{"taipei_torrent_hash_failures_total", "counter", "Downloaded pieces that failed their hash check, this session.",
+		func(s *TorrentStatus) float64 { return float64(s.HashFailures) }},
+	{"taipei_torrent_duplicate_bytes_total", "counter", "Bytes of blocks downloaded that we had already, this session.",
+		func(s *TorrentStatus) float64 { return float64(s.Overhead.Duplicate) }},
+	{"taipei_torrent_hash_failed_bytes_total", "counter", "Bytes of pieces that failed their hash check, this session.",
+		func(s *TorrentStatus) float64 { return float64(s.Overhead.HashFailed) }},
+	{"taipei_torrent_distributed_copies", "gauge", "Whole copies of the torrent the connected peers and we have between us.",
+		func(s *TorrentStatus) float64 { return s.DistributedCopies }},
+	{"taipei_torrent_complete_copy", "gauge", "1 if we or a connected peer have every piece.",
+		func(s *TorrentStatus) float64 { return float64(b2i(s.CompleteCopy)) }},
+}
+
+// writeMetrics writes the torrents' metrics, and the shared ones, stats
+// among them.
+func writeMetrics(w io.Writer, stats *SessionStats, statuses []TorrentStatus, disk *diskStats, cachers []CacheProvider, dht *dhtHealthMonitor) error {
+	m := &metricsWriter{w: w}
+	m.family("taipei_torrents", "gauge", "Torrents, including those being added.")
+	m.sample("taipei_torrents", float64(len(statuses)))
+	m.family("taipei_torrents_by_state", "gauge", "Torrents in each state.")
+	for _, state := range []struct {
+		name  string
+		count int
+	}{
+		{"downloading", stats.Downloading},
+		{"seeding", stats.Seeding},
+		{"paused", stats.Paused},
+		{"queued", stats.Queued},
+		{"checking", stats.Checking},
+		{"adding", stats.Adding},
+		{"error", stats.Errored},
+	} {
+		m.sample("taipei_torrents_by_state", float64(state.count), "state", state.name)
+	}
+	for _, metric := range torrentMetrics {
+		m.family(metric.name, metric.kind, metric.help)
+		for i := range statuses {
+			m.sample(metric.name, metric.value(&statuses[i]), "infohash", metricsLabel(statuses[i]))
+		}
+	}
+	m.family("taipei_torrent_pieces_by_availability", "gauge", "Pieces that none, one, or more of the connected peers have.")
+	for _, s := range statuses {
+		if len(s.Availability) == 0 {
+			continue
+		}
+		var byPeers [3]int
+		for n, pieces := range s.Availability {
+			byPeers[min(n, 2)] += pieces
+		}
+		for n, peers := range []string{"0", "1", "2+"} {
+			m.sample("taipei_torrent_pieces_by_availability", float64(byPeers[n]), "infohash", metricsLabel(s), "peers", peers)
+		}
+	}
+	m.family("taipei_torrent_announces_total", "counter", "Tracker announces, this session, by whether they worked.")
+	for _, s := range statuses {
+		var ok, failed int
+		for _, t := range s.Trackers {
+			ok += t.Announces - t.Failures
+			failed += t.Failures
+		}
+		m.sample("taipei_torrent_announces_total", float64(ok), "infohash", metricsLabel(s), "result", "success")
+		m.sample("taipei_torrent_announces_total", float64(failed), "infohash", metricsLabel(s), "result", "failure")
+	}
+	m.family("taipei_torrent_overhead_bytes_total", "counter", "Bytes besides the pieces' blocks, this session, by kind and direction.")
+	for i := range statuses {
+		m.overhead("taipei_torrent_overhead_bytes_total", &statuses[i].Overhead, "infohash", metricsLabel(statuses[i]))
+	}
+	// Like the torrents' rates are their peers', added up.
+	m.family("taipei_download_rate_bytes", "gauge", "Download rate of all the torrents, in bytes per second.")
+	m.sample("taipei_download_rate_bytes", stats.DownloadRate)
+	m.family("taipei_upload_rate_bytes", "gauge", "Upload rate of all the torrents, in bytes per second.")
+	m.sample("taipei_upload_rate_bytes", stats.UploadRate)
+	m.family("taipei_session_downloaded_bytes_total", "counter", "Bytes every torrent has downloaded since we started, including removed ones.")
+	m.sample("taipei_session_downloaded_bytes_total", float64(stats.Downloaded))
+	m.family("taipei_session_uploaded_bytes_total", "counter", "Bytes every torrent has uploaded since we started, including removed ones.")
+	m.sample("taipei_session_uploaded_bytes_total", float64(stats.Uploaded))
+	m.family("taipei_lifetime_downloaded_bytes_total", "counter", "Bytes every torrent has downloaded, over every saved session.")
+	m.sample("taipei_lifetime_downloaded_bytes_total", float64(stats.LifetimeDownloaded))
+	m.family("taipei_lifetime_uploaded_bytes_total", "counter", "Bytes every torrent has uploaded, over every saved session.")
+	m.sample("taipei_lifetime_uploaded_bytes_total", float64(stats.LifetimeUploaded))
+	m.family("taipei_overhead_bytes_total", "counter", "Bytes every torrent has sent and received besides the pieces' blocks since we started, by kind and direction.")
+	m.overhead("taipei_overhead_bytes_total", &stats.Overhead)
+	m.family("taipei_duplicate_bytes_total", "counter", "Bytes of blocks every torrent downloaded that it had already, since we started.")
+	m.sample("taipei_duplicate_bytes_total", float64(stats.Overhead.Duplicate))
+	m.family("taipei_hash_failed_bytes_total", "counter", "Bytes of pieces that failed their hash check, over every torrent since we started.")
+	m.sample("taipei_hash_failed_bytes_total", float64(stats.Overhead.HashFailed))
+
+	if dht != nil {
+		h := dht.Health(time.Now())
+		m.family("taipei_dht_nodes", "gauge", "DHT nodes we've heard from.")
+		m.sample("taipei_dht_nodes", float64(h.KnownNodes))
+		m.family("taipei_dht_queries_total", "counter", "KRPC queries our own DHT client sent.")
+		m.sample("taipei_dht_queries_total", float64(h.Queries))
+		m.family("taipei_dht_replies_total", "counter", "Responses to our DHT client's queries, by whether they were errors.")
+		m.sample("taipei_dht_replies_total", float64(h.Replies-h.Errors), "result", "ok")
+		m.sample("taipei_dht_replies_total", float64(h.Errors), "result", "error")
+		m.family("taipei_dht_timeouts_total", "counter", "Our DHT client's queries that went unanswered.")
+		m.sample("taipei_dht_timeouts_total", float64(h.Timeouts))
+		m.family("taipei_dht_bytes_total", "counter", "Bytes our DHT client sent and received, by direction.")
+		m.sample("taipei_dht_bytes_total", float64(h.BytesSent), "direction", "sent")
+		m.sample("taipei_dht_bytes_total", float64(h.BytesRead), "direction", "received")
+		m.family("taipei_dht_peer_requests_total", "counter", "Peer lookups we started, over all torrents.")
+		m.sample("taipei_dht_peer_requests_total", float64(h.PeerRequests))
+		m.family("taipei_dht_peer_requests_expired_total", "counter", "Peer lookups that found no peers in time.")
+		m.sample("taipei_dht_peer_requests_expired_total", float64(h.Expired))
+	}
+	var hits, misses uint64
+	counted := false
+	for _, cacher := range cachers {
+		if c, ok := cacher.(cacheCounter); ok {
+			cacheHits, cacheMisses := c.CacheHits()
+			hits, misses, counted = hits+cacheHits, misses+cacheMisses, true
+		}
+	}
+	if counted {
+		m.family("taipei_cache_hits_total", "counter", "Pieces read from the cache.")
+		m.sample("taipei_cache_hits_total", float64(hits))
+		m.family("taipei_cache_misses_total", "counter", "Pieces the cache had to read from the files.")
+		m.sample("taipei_cache_misses_total", float64(misses))
+	}
+	if disk != nil {
+		m.family("taipei_disk_read_bytes_total", "counter", "Bytes read from the torrents' files.")
+		m.sample("taipei_disk_read_bytes_total", float64(atomic.LoadUint64(&disk.read)))
+		m.family("taipei_disk_written_bytes_total", "counter", "Bytes written to the torrents' files.")
+		m.sample("taipei_disk_written_bytes_total", float64(atomic.LoadUint64(&disk.written)))
+		m.histogram("taipei_disk_read_seconds", "How long reads from the torrents' files took.", disk.readLatency)
+		m.histogram("taipei_disk_write_seconds", "How long writing pieces to the torrents' files took.", disk.writeLatency)
+	}
+	return m.err
+}
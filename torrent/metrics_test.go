@@ -0,0 +1,163 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	statuses := []TorrentStatus{{
+		Name:         "a \"name\"\n",
+		InfoHash:     "0123456789abcdef0123456789abcdef01234567",
+		Downloaded:   1000,
+		DownloadRate: 12.5,
+		Pieces:       10,
+		GoodPieces:   4,
+		HashFailures: 2,
+		Trackers:     []TrackerStatus{{Announces: 3, Failures: 1}, {Announces: 2}},
+		Availability: []int{1, 3, 4, 2},
+		// We have one of the pieces nobody else has.
+		DistributedCopies: 1.9,
+		CompleteCopy:      true,
+		Overhead: Overhead{Received: map[string]uint64{"handshake": 68, "have": 36},
+			Sent: map[string]uint64{"handshake": 68}, TotalReceived: 104, TotalSent: 68, Duplicate: 16384},
+	}}
+	fs, err := NewRAMFileSystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _, err := NewFileStore(&InfoDict{Name: "x", Length: 200, PieceLength: 100}, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := newDiskStats()
+	cache := NewRamCacheProvider(1).(*RamCacheProvider)
+	store := cache.NewCache("ih", 2, 100, 200, &meteredStore{files, disk})
+	store.WritePiece(make([]byte, 100), 1)
+	// The first read misses the cache, and the second hits it.
+	store.ReadAt(make([]byte, 100), 0)
+	store.ReadAt(make([]byte, 100), 0)
+	disk.readLatency.observe(2 * time.Second)
+
+	stats := SessionStats{Downloaded: 1000, LifetimeDownloaded: 5000}
+	stats.tally(statuses)
+	var b bytes.Buffer
+	if err := writeMetrics(&b, &stats, statuses, disk, []CacheProvider{cache}, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE taipei_torrent_downloaded_bytes_total counter\n",
+		`taipei_torrent_downloaded_bytes_total{infohash="0123456789ab"} 1000` + "\n",
+		`taipei_torrent_download_rate_bytes{infohash="0123456789ab"} 12.5` + "\n",
+		`taipei_torrent_good_pieces{infohash="0123456789ab"} 4` + "\n",
+		`taipei_torrent_hash_failures_total{infohash="0123456789ab"} 2` + "\n",
+		`taipei_torrent_distributed_copies{infohash="0123456789ab"} 1.9` + "\n",
+		`taipei_torrent_complete_copy{infohash="0123456789ab"} 1` + "\n",
+		`taipei_torrent_pieces_by_availability{infohash="0123456789ab",peers="0"} 1` + "\n",
+		`taipei_torrent_pieces_by_availability{infohash="0123456789ab",peers="1"} 3` + "\n",
+		`taipei_torrent_pieces_by_availability{infohash="0123456789ab",peers="2+"} 6` + "\n",
+		`taipei_torrent_announces_total{infohash="0123456789ab",result="success"} 4` + "\n",
+		`taipei_torrent_announces_total{infohash="0123456789ab",result="failure"} 1` + "\n",
+		`taipei_torrent_duplicate_bytes_total{infohash="0123456789ab"} 16384` + "\n",
+		`taipei_torrent_overhead_bytes_total{infohash="0123456789ab",kind="have",direction="received"} 36` + "\n",
+		`taipei_torrent_overhead_bytes_total{infohash="0123456789ab",kind="have",direction="sent"} 0` + "\n",
+		`taipei_overhead_bytes_total{kind="handshake",direction="sent"} 68` + "\n",
+		"taipei_duplicate_bytes_total 16384\n",
+		"taipei_torrents 1\n",
+		"taipei_download_rate_bytes 12.5\n",
+		`taipei_torrents_by_state{state="downloading"} 1` + "\n",
+		`taipei_torrents_by_state{state="seeding"} 0` + "\n",
+		"taipei_session_downloaded_bytes_total 1000\n",
+		"taipei_lifetime_downloaded_bytes_total 5000\n",
+		"taipei_cache_hits_total 1\n",
+		"taipei_cache_misses_total 1\n",
+		"taipei_disk_read_bytes_total 100\n",
+		"taipei_disk_written_bytes_total 100\n",
+		`taipei_disk_read_seconds_bucket{le="1"} 1` + "\n",
+		`taipei_disk_read_seconds_bucket{le="5"} 2` + "\n",
+		`taipei_disk_read_seconds_bucket{le="+Inf"} 2` + "\n",
+		"taipei_disk_read_seconds_count 2\n",
+		"taipei_disk_write_seconds_count 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("No %q in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "name") || strings.Contains(out, "taipei_dht_nodes") {
+		t.Errorf("Unexpected metrics in\n%s", out)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1, RPCMetrics: true}, 0)
+	m.stayUp = true
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	server := httptest.NewServer(newRPCHandler(m, "secret"))
+	defer server.Close()
+	get := func(token string) (int, string) {
+		req, err := http.NewRequest("GET", server.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	if code, body := get("secret"); code != http.StatusOK || !strings.Contains(body, "taipei_torrents 0\n") {
+		t.Errorf("Got %d:\n%s", code, body)
+	}
+	if code, _ := get("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Without the token, %d", code)
+	}
+	m.flags.RPCMetrics = false
+	if code, _ := get("secret"); code != http.StatusNotFound {
+		t.Errorf("With metrics off, %d", code)
+	}
+}
+
+func TestWriteDHTMetrics(t *testing.T) {
+	nodes := newDHTNodeTable("")
+	nodes.Seen("10.0.0.1:6881", "01234567890123456789")
+	health := newDHTHealthMonitor(nodes, 1)
+	health.limits = newDHTLimiter(0, 0)
+	now := time.Now()
+	health.limits.Start("ih", false, now)
+	health.limits.Retry(now.Add(DHT_LOOKUP_TIMEOUT))
+	health.Request()
+	var b bytes.Buffer
+	if err := writeMetrics(&b, &SessionStats{}, nil, newDiskStats(), nil, health); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"taipei_dht_nodes 1\n",
+		"taipei_dht_queries_total 0\n",
+		`taipei_dht_replies_total{result="error"} 0` + "\n",
+		`taipei_dht_bytes_total{direction="sent"} 0` + "\n",
+		"taipei_dht_peer_requests_total 1\n",
+		"taipei_dht_peer_requests_expired_total 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("No %q in\n%s", want, out)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package torrent
 import (
 	"fmt"
 	"net"
+	"time"
 
 	natpmp "github.com/jackpal/go-nat-pmp"
 )
@@ -11,8 +12,6 @@ import (
 
 // TODO:
 //  + Register for changes to the external address.
-//  + Re-register port mapping when router reboots.
-//  + A mechanism for keeping a port mapping registered.
 
 type natPMPClient struct {
 	client *natpmp.Client
@@ -34,6 +33,12 @@ func (n *natPMPClient) GetExternalAddress() (addr net.IP, err error) {
 
 func (n *natPMPClient) AddPortMapping(protocol string, externalPort, internalPort int,
 	description string, timeout int) (mappedExternalPort int, err error) {
+	mappedExternalPort, _, _, err = n.addPortMappingLease(protocol, externalPort, internalPort, description, timeout)
+	return
+}
+
+func (n *natPMPClient) addPortMappingLease(protocol string, externalPort, internalPort int,
+	description string, timeout int) (mappedExternalPort int, granted time.Duration, epoch uint32, err error) {
 	if timeout <= 0 {
 		err = fmt.Errorf("timeout must not be <= 0")
 		return
@@ -44,9 +49,19 @@ func (n *natPMPClient) AddPortMapping(protocol string, externalPort, internalPor
 		return
 	}
 	mappedExternalPort = int(response.MappedExternalPort)
+	granted = time.Duration(response.PortMappingLifetimeInSeconds) * time.Second
+	epoch = response.SecondsSinceStartOfEpoc
 	return
 }
 
+func (n *natPMPClient) epoch() (seconds uint32, err error) {
+	response, err := n.client.GetExternalAddress()
+	if err != nil {
+		return
+	}
+	return response.SecondsSinceStartOfEpoc, nil
+}
+
 func (n *natPMPClient) DeletePortMapping(protocol string, externalPort, internalPort int) (err error) {
 	// To destroy a mapping, send an add-port with
 	// an internalPort of the internal port to destroy, an external port of zero and a time of zero.
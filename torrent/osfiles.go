@@ -2,9 +2,13 @@ package torrent
 
 import (
 	"errors"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // a torrent FileSystem that is backed by real OS files
@@ -12,9 +16,16 @@ type osFileSystem struct {
 	storePath string
 }
 
-// A torrent File that is backed by an OS file
+// A torrent File that is backed by an OS file. One that wasn't there when
+// it was opened isn't made, nor are the directories it goes in, until it's
+// first written to, so that a torrent's files and directories only appear
+// once something's downloaded into them. Until then it reads as the zeros
+// it'd be made with.
 type osFile struct {
 	filePath string
+	length   int64
+	mu       sync.Mutex // Held while it's made
+	pending  int32      // Set, atomically, until it's made
 }
 
 type OsFsProvider struct{}
@@ -23,21 +34,65 @@ func (o OsFsProvider) NewFS(directory string) (fs FileSystem, err error) {
 	return &osFileSystem{directory}, nil
 }
 
-func (o *osFileSystem) Open(name []string, length int64) (file File, err error) {
+func (o *osFileSystem) path(name []string) string {
 	// Clean the source path before appending to the storePath. This
 	// ensures that source paths that start with ".." can't escape.
 	cleanSrcPath := path.Clean("/" + path.Join(name...))[1:]
-	fullPath := path.Join(o.storePath, cleanSrcPath)
-	err = ensureDirectory(fullPath)
-	if err != nil {
+	return path.Join(o.storePath, cleanSrcPath)
+}
+
+func (o *osFileSystem) Open(name []string, length int64) (file File, err error) {
+	osfile := &osFile{filePath: o.path(name), length: length}
+	if _, err = os.Stat(osfile.filePath); os.IsNotExist(err) && length > 0 {
+		// There's nothing to download to an empty file, so that's made now.
+		osfile.pending = 1
+		return osfile, nil
+	}
+	if err = ensureDirectory(osfile.filePath); err != nil {
 		return
 	}
-	osfile := &osFile{fullPath}
-	file = osfile
-	err = osfile.ensureExists(length)
+	return osfile, osfile.ensureExists(length)
+}
+
+func (o *osFileSystem) Stat(name []string) (os.FileInfo, error) {
+	return os.Stat(o.path(name))
+}
+
+var errOutsideRoot = errors.New("Not under the download directory")
+
+// Remove deletes a file, and whatever directories that leaves empty below
+// the file system's own. It won't delete a file that a symlinked directory
+// puts outside the file system.
+func (o *osFileSystem) Remove(name []string) (err error) {
+	p := o.path(name)
+	root := path.Clean(o.storePath)
+	if !within(root, path.Dir(p)) {
+		return &os.PathError{Op: "remove", Path: p, Err: errOutsideRoot}
+	}
+	if err = os.Remove(p); err != nil {
+		return
+	}
+	for dir := path.Dir(p); strings.HasPrefix(dir, root+"/"); dir = path.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
 	return
 }
 
+// Whether dir is root or below it, once symlinks are followed.
+func within(root, dir string) bool {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err == nil {
+		var realDir string
+		if realDir, err = filepath.EvalSymlinks(dir); err == nil {
+			return realDir == realRoot || strings.HasPrefix(realDir, realRoot+string(filepath.Separator))
+		}
+	}
+	// If it's not there, there's nothing there to delete.
+	return os.IsNotExist(err)
+}
+
 func (o *osFileSystem) Close() error {
 	return nil
 }
@@ -86,7 +141,41 @@ func (o *osFile) ensureExists(length int64) (err error) {
 	return
 }
 
+// Makes the file, if it hasn't been.
+func (o *osFile) make() (err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if atomic.LoadInt32(&o.pending) == 0 {
+		return
+	}
+	if err = ensureDirectory(o.filePath); err == nil {
+		err = o.ensureExists(o.length)
+	}
+	if err == nil {
+		atomic.StoreInt32(&o.pending, 0)
+	}
+	return
+}
+
+// Whether it's yet to be made.
+func (o *osFile) isPending() bool {
+	return atomic.LoadInt32(&o.pending) != 0
+}
+
 func (o *osFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if o.isPending() {
+		if off >= o.length {
+			return 0, io.EOF
+		}
+		n = len(p)
+		if int64(n) > o.length-off {
+			n, err = int(o.length-off), io.EOF
+		}
+		for i := range p[:n] {
+			p[i] = 0
+		}
+		return
+	}
 	file, err := os.OpenFile(o.filePath, os.O_RDWR, 0600)
 	if err != nil {
 		return
@@ -96,6 +185,11 @@ func (o *osFile) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (o *osFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if o.isPending() {
+		if err = o.make(); err != nil {
+			return
+		}
+	}
 	file, err := os.OpenFile(o.filePath, os.O_RDWR, 0600)
 	if err != nil {
 		return
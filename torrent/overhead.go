@@ -0,0 +1,152 @@
+package torrent
+
+import (
+	"sync/atomic"
+)
+
+// Overhead: the bytes a torrent sends and receives besides the blocks of its
+// pieces, and the blocks that were wasted, so that downloading 105 GB for a
+// 90 GB torrent can be accounted for. Peers' messages are counted as they're
+// framed, by kind, lengths and all, and a piece message's header is overhead
+// while its block is payload. The handshake's counted once it's done, and a
+// tracker's announce as its URL or packets, and the response. The IP, TCP and
+// HTTP headers under them aren't counted, and nor is the DHT's traffic,
+// whose node is every torrent's and doesn't say.
+//
+// Of the blocks downloaded, those that we had already by the time they came
+// are duplicates, and the pieces that failed their hash check were downloaded
+// for nothing. Both are in Downloaded as well.
+
+type TrafficKind int
+
+const (
+	TRAFFIC_HANDSHAKE    TrafficKind = iota // The BitTorrent handshake
+	TRAFFIC_STATE                           // Choke, unchoke, interested and not
+	TRAFFIC_HAVE                            // Have messages
+	TRAFFIC_BITFIELD                        // Bitfields
+	TRAFFIC_REQUEST                         // Requests and cancels
+	TRAFFIC_PIECE_HEADER                    // The headers of piece messages, around their blocks
+	TRAFFIC_EXTENSION                       // Extension handshakes, metadata and the like
+	TRAFFIC_KEEPALIVE                       // Keep-alives
+	TRAFFIC_OTHER                           // Messages we don't know
+	TRAFFIC_TRACKER                         // Announces and their responses
+	NUM_TRAFFIC_KINDS
+)
+
+var trafficKindNames = [NUM_TRAFFIC_KINDS]string{"handshake", "state", "have", "bitfield", "request",
+	"piece_header", "extension", "keepalive", "other", "tracker"}
+
+func (k TrafficKind) String() string {
+	return trafficKindNames[k]
+}
+
+// Overhead is what a torrent's sent and received besides its pieces' blocks,
+// in bytes, this session, and the downloads that went to waste.
+type Overhead struct {
+	// By kind, named as TrafficKind's String says.
+	Received map[string]uint64
+	Sent     map[string]uint64
+	// The kinds added up.
+	TotalReceived uint64
+	TotalSent     uint64
+	Duplicate     uint64 // Blocks we had already by the time they came
+	HashFailed    uint64 // Pieces that failed their hash check
+}
+
+// Adds o2's bytes to o's.
+func (o *Overhead) add(o2 Overhead) {
+	if o.Received == nil {
+		o.Received, o.Sent = make(map[string]uint64), make(map[string]uint64)
+	}
+	for k, n := range o2.Received {
+		o.Received[k] += n
+	}
+	for k, n := range o2.Sent {
+		o.Sent[k] += n
+	}
+	o.TotalReceived += o2.TotalReceived
+	o.TotalSent += o2.TotalSent
+	o.Duplicate += o2.Duplicate
+	o.HashFailed += o2.HashFailed
+}
+
+// A torrent's counts, which its peers' readers and writers, and its tracker
+// announces, add to as they go. All atomic. A nil counter counts nothing.
+type trafficCounter struct {
+	received, sent        [NUM_TRAFFIC_KINDS]int64
+	duplicate, hashFailed int64
+}
+
+func (c *trafficCounter) addReceived(kind TrafficKind, n int) {
+	if c != nil {
+		atomic.AddInt64(&c.received[kind], int64(n))
+	}
+}
+
+func (c *trafficCounter) addSent(kind TrafficKind, n int) {
+	if c != nil {
+		atomic.AddInt64(&c.sent[kind], int64(n))
+	}
+}
+
+// The kind of a message, without its length, and the bytes of it, with its
+// length, that are overhead: all of them but a piece message's block.
+func messageOverhead(msg []byte) (kind TrafficKind, n int) {
+	if len(msg) == 0 {
+		return TRAFFIC_KEEPALIVE, 4
+	}
+	n = 4 + len(msg)
+	switch msg[0] {
+	case CHOKE, UNCHOKE, INTERESTED, NOT_INTERESTED:
+		kind = TRAFFIC_STATE
+	case HAVE:
+		kind = TRAFFIC_HAVE
+	case BITFIELD:
+		kind = TRAFFIC_BITFIELD
+	case REQUEST, CANCEL:
+		kind = TRAFFIC_REQUEST
+	case PIECE:
+		kind, n = TRAFFIC_PIECE_HEADER, 4+min(len(msg), 9)
+	case EXTENSION:
+		kind = TRAFFIC_EXTENSION
+	default:
+		kind = TRAFFIC_OTHER
+	}
+	return
+}
+
+// Counts a message read from a peer.
+func (c *trafficCounter) receivedMessage(msg []byte) {
+	c.addReceived(messageOverhead(msg))
+}
+
+// Counts a message written to a peer: msg's header, unless it's framed, in
+// which case it's whole messages, each with its length.
+func (c *trafficCounter) sentMessage(msg outMessage) {
+	if !msg.framed {
+		c.addSent(messageOverhead(msg.header))
+		return
+	}
+	for b := msg.header; len(b) >= 4; {
+		n := int(bytesToUint32(b))
+		if n > len(b)-4 {
+			n = len(b) - 4
+		}
+		c.addSent(messageOverhead(b[4 : 4+n]))
+		b = b[4+n:]
+	}
+}
+
+// The counts so far.
+func (c *trafficCounter) overhead() (o Overhead) {
+	o.Received, o.Sent = make(map[string]uint64), make(map[string]uint64)
+	for k := TrafficKind(0); k < NUM_TRAFFIC_KINDS; k++ {
+		received, sent := uint64(atomic.LoadInt64(&c.received[k])), uint64(atomic.LoadInt64(&c.sent[k]))
+		o.Received[k.String()], o.Sent[k.String()] = received, sent
+		o.TotalReceived += received
+		o.TotalSent += sent
+	}
+	o.Duplicate = uint64(atomic.LoadInt64(&c.duplicate))
+	o.HashFailed = uint64(atomic.LoadInt64(&c.hashFailed))
+	return
+}
@@ -0,0 +1,49 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func TestMessageOverhead(t *testing.T) {
+	tests := []struct {
+		msg  []byte
+		kind TrafficKind
+		n    int
+	}{
+		{nil, TRAFFIC_KEEPALIVE, 4},
+		{[]byte{UNCHOKE}, TRAFFIC_STATE, 5},
+		{[]byte{HAVE, 0, 0, 0, 7}, TRAFFIC_HAVE, 9},
+		{[]byte{BITFIELD, 0xff, 0x80}, TRAFFIC_BITFIELD, 7},
+		{make([]byte, 13), TRAFFIC_STATE, 17}, // A choke, as far as we can tell
+		{append([]byte{PIECE}, make([]byte, 8+16384)...), TRAFFIC_PIECE_HEADER, 13},
+		{[]byte{PIECE, 0}, TRAFFIC_PIECE_HEADER, 6},
+		{[]byte{EXTENSION, 0, 'd', 'e'}, TRAFFIC_EXTENSION, 8},
+		{[]byte{99}, TRAFFIC_OTHER, 5},
+	}
+	for _, test := range tests {
+		if kind, n := messageOverhead(test.msg); kind != test.kind || n != test.n {
+			t.Errorf("%v: %v, %d bytes", test.msg, kind, n)
+		}
+	}
+}
+
+// A framed message's messages are counted one by one, and a piece message's
+// block isn't counted at all.
+func TestSentMessage(t *testing.T) {
+	var c trafficCounter
+	c.sentMessage(outMessage{header: []byte{PIECE, 0, 0, 0, 1, 0, 0, 0, 0}, block: make([]byte, 16384)})
+	c.sentMessage(outMessage{header: []byte{0, 0, 0, 1, INTERESTED, 0, 0, 0, 5, HAVE, 0, 0, 0, 2, 0, 0, 0, 0}, framed: true})
+	o := c.overhead()
+	if o.Sent["piece_header"] != 13 || o.Sent["state"] != 5 || o.Sent["have"] != 9 || o.Sent["keepalive"] != 4 || o.TotalSent != 31 {
+		t.Errorf("Sent %+v", o)
+	}
+	var nothing *trafficCounter
+	nothing.sentMessage(outMessage{header: []byte{UNCHOKE}})
+
+	var total Overhead
+	total.add(o)
+	total.add(o)
+	if total.Sent["have"] != 18 || total.TotalSent != 62 || total.TotalReceived != 0 {
+		t.Errorf("Added up, %+v", total)
+	}
+}
@@ -0,0 +1,188 @@
+package torrent
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Port Control Protocol (RFC 6887) client, for the MAP requests we need.
+// PCP took over from NAT-PMP, on the same port. Gateways that only speak
+// NAT-PMP answer PCP requests with an unsupported version error, so we try
+// PCP first and fall back.
+
+const (
+	PCP_PORT    = 5351
+	PCP_TIMEOUT = 4 * time.Second // For a request, resends and all
+)
+
+const (
+	pcpVersion             = 2
+	pcpOpAnnounce          = 0
+	pcpOpMap               = 1
+	pcpResponse            = 0x80 // Set in responses' opcodes
+	pcpResultSuccess       = 0
+	pcpResultUnsuppVersion = 1
+)
+
+var errPCPUnsupported = errors.New("The gateway doesn't speak PCP")
+
+type pcpClient struct {
+	gateway *net.UDPAddr
+	timeout time.Duration
+	// Identifies our mappings to the gateway, so that we can renew and
+	// delete them.
+	nonce      [12]byte
+	lock       sync.Mutex
+	externalIP net.IP // From the last mapping
+}
+
+func newPCPClient(gateway net.IP) *pcpClient {
+	c := &pcpClient{gateway: &net.UDPAddr{IP: gateway, Port: PCP_PORT}, timeout: PCP_TIMEOUT}
+	crand.Read(c.nonce[:])
+	return c
+}
+
+// Uses PCP if the gateway speaks it, and NAT-PMP if it doesn't.
+func newPMPOrPCP(gateway net.IP) NAT {
+	c := newPCPClient(gateway)
+	if _, err := c.epoch(); err != nil {
+		packageLogger().Debug("Not using PCP", "gateway", gateway, "err", err)
+		return NewNatPMP(gateway)
+	}
+	packageLogger().Info("Gateway speaks PCP", "gateway", gateway)
+	return c
+}
+
+// Sends a request, resending it at doubling intervals, until its response
+// comes back.
+func (c *pcpClient) call(op byte, lifetime uint32, payload []byte) (resp []byte, err error) {
+	conn, err := net.DialUDP("udp", nil, c.gateway)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	req := make([]byte, 24, 24+len(payload))
+	req[0] = pcpVersion
+	req[1] = op
+	binary.BigEndian.PutUint32(req[4:8], lifetime)
+	copy(req[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+	req = append(req, payload...)
+
+	buf := make([]byte, 1100) // The biggest PCP message
+	deadline := time.Now().Add(c.timeout)
+	for wait := 250 * time.Millisecond; time.Now().Before(deadline); wait *= 2 {
+		if _, err = conn.Write(req); err != nil {
+			return
+		}
+		readBy := time.Now().Add(wait)
+		if readBy.After(deadline) {
+			readBy = deadline
+		}
+		conn.SetReadDeadline(readBy)
+		for {
+			var n int
+			if n, err = conn.Read(buf); err != nil {
+				break
+			}
+			if n >= 2 && buf[0] != pcpVersion {
+				// NAT-PMP's answer to a version it doesn't know.
+				return nil, errPCPUnsupported
+			}
+			if n < 24 || buf[1] != op|pcpResponse {
+				continue
+			}
+			switch buf[3] {
+			case pcpResultSuccess:
+				return buf[:n], nil
+			case pcpResultUnsuppVersion:
+				return nil, errPCPUnsupported
+			default:
+				return nil, fmt.Errorf("PCP request failed with result code %d", buf[3])
+			}
+		}
+	}
+	return nil, fmt.Errorf("No PCP response from %v: %v", c.gateway, err)
+}
+
+// The gateway's epoch, from an ANNOUNCE.
+func (c *pcpClient) epoch() (seconds uint32, err error) {
+	resp, err := c.call(pcpOpAnnounce, 0, nil)
+	if err != nil {
+		return
+	}
+	return binary.BigEndian.Uint32(resp[8:12]), nil
+}
+
+func (c *pcpClient) mapPort(protocol string, externalPort, internalPort int, lifetime int) (resp []byte, err error) {
+	var proto byte
+	switch protocol {
+	case "tcp":
+		proto = 6
+	case "udp":
+		proto = 17
+	default:
+		return nil, fmt.Errorf("Can't map protocol %q", protocol)
+	}
+	payload := make([]byte, 36)
+	copy(payload[0:12], c.nonce[:])
+	payload[12] = proto
+	binary.BigEndian.PutUint16(payload[16:18], uint16(internalPort))
+	binary.BigEndian.PutUint16(payload[18:20], uint16(externalPort))
+	// No preference for the external address.
+	copy(payload[20:36], net.IPv4zero.To16())
+	if resp, err = c.call(pcpOpMap, uint32(lifetime), payload); err != nil {
+		return
+	}
+	if len(resp) < 60 || !bytes.Equal(resp[24:36], c.nonce[:]) {
+		return nil, errors.New("Bad PCP MAP response")
+	}
+	return
+}
+
+func (c *pcpClient) addPortMappingLease(protocol string, externalPort, internalPort int,
+	description string, timeout int) (mappedExternalPort int, granted time.Duration, epoch uint32, err error) {
+	if timeout <= 0 {
+		err = fmt.Errorf("timeout must not be <= 0")
+		return
+	}
+	resp, err := c.mapPort(protocol, externalPort, internalPort, timeout)
+	if err != nil {
+		return
+	}
+	granted = time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	epoch = binary.BigEndian.Uint32(resp[8:12])
+	mappedExternalPort = int(binary.BigEndian.Uint16(resp[42:44]))
+	c.lock.Lock()
+	c.externalIP = append(net.IP(nil), resp[44:60]...)
+	c.lock.Unlock()
+	return
+}
+
+func (c *pcpClient) AddPortMapping(protocol string, externalPort, internalPort int,
+	description string, timeout int) (mappedExternalPort int, err error) {
+	mappedExternalPort, _, _, err = c.addPortMappingLease(protocol, externalPort, internalPort, description, timeout)
+	return
+}
+
+func (c *pcpClient) DeletePortMapping(protocol string, externalPort, internalPort int) (err error) {
+	// A lifetime of 0 deletes the mapping with our nonce.
+	_, err = c.mapPort(protocol, 0, internalPort, 0)
+	return
+}
+
+// PCP has no request for the external address on its own, so this is the
+// one the last mapping got.
+func (c *pcpClient) GetExternalAddress() (addr net.IP, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.externalIP == nil {
+		return nil, errors.New("No PCP mapping yet")
+	}
+	return c.externalIP, nil
+}
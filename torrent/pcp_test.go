@@ -0,0 +1,112 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// Serves PCP on localhost, answering requests with respond. It returns the
+// requests it got on the channel.
+func fakePCPServer(t *testing.T, respond func(req []byte) []byte) (addr *net.UDPAddr, requests chan []byte) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	requests = make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := append([]byte(nil), buf[:n]...)
+			requests <- req
+			conn.WriteToUDP(respond(req), from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr), requests
+}
+
+// Grants half the lifetime asked for, on the port after the one suggested.
+func pcpMapResponse(req []byte) []byte {
+	resp := make([]byte, len(req))
+	copy(resp, req)
+	resp[1] |= pcpResponse
+	resp[3] = pcpResultSuccess
+	lifetime := binary.BigEndian.Uint32(req[4:8])
+	binary.BigEndian.PutUint32(resp[4:8], lifetime/2)
+	binary.BigEndian.PutUint32(resp[8:12], 77)
+	copy(resp[12:24], make([]byte, 12))
+	if req[1] == pcpOpMap {
+		suggested := binary.BigEndian.Uint16(req[42:44])
+		binary.BigEndian.PutUint16(resp[42:44], suggested+1)
+		copy(resp[44:60], net.IPv4(5, 6, 7, 8).To16())
+	}
+	return resp
+}
+
+func testPCPClient(addr *net.UDPAddr) *pcpClient {
+	c := newPCPClient(addr.IP)
+	c.gateway = addr
+	c.timeout = 2 * time.Second
+	return c
+}
+
+func TestPCPMap(t *testing.T) {
+	addr, requests := fakePCPServer(t, pcpMapResponse)
+	c := testPCPClient(addr)
+	if _, err := c.GetExternalAddress(); err == nil {
+		t.Error("Got an external address before mapping")
+	}
+	if epoch, err := c.epoch(); err != nil || epoch != 77 {
+		t.Errorf("Epoch %d, %v", epoch, err)
+	}
+	if req := <-requests; len(req) != 24 || req[0] != pcpVersion || req[1] != pcpOpAnnounce {
+		t.Errorf("ANNOUNCE %x", req)
+	}
+
+	port, granted, epoch, err := c.addPortMappingLease("tcp", 6881, 7000, "test", 7200)
+	if err != nil || port != 6882 || granted != time.Hour || epoch != 77 {
+		t.Errorf("Mapped %d for %v at epoch %d, %v", port, granted, epoch, err)
+	}
+	req := <-requests
+	if len(req) != 60 || req[1] != pcpOpMap || req[36] != 6 || binary.BigEndian.Uint16(req[40:42]) != 7000 ||
+		binary.BigEndian.Uint32(req[4:8]) != 7200 || !net.IP(req[8:24]).Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("MAP %x", req)
+	}
+	if ip, err := c.GetExternalAddress(); err != nil || !ip.Equal(net.IPv4(5, 6, 7, 8)) {
+		t.Errorf("External address %v, %v", ip, err)
+	}
+
+	if err = c.DeletePortMapping("tcp", 6882, 7000); err != nil {
+		t.Fatal(err)
+	}
+	req = <-requests
+	if binary.BigEndian.Uint32(req[4:8]) != 0 || string(req[24:36]) != string(c.nonce[:]) {
+		t.Errorf("Delete %x", req)
+	}
+
+	if _, err = c.AddPortMapping("sctp", 1, 1, "test", 10); err == nil {
+		t.Error("Mapped sctp")
+	}
+}
+
+func TestPCPUnsupported(t *testing.T) {
+	// How a NAT-PMP gateway answers.
+	addr, _ := fakePCPServer(t, func(req []byte) []byte { return []byte{0, 128, 0, 1, 0, 0, 0, 0} })
+	if _, err := testPCPClient(addr).epoch(); err != errPCPUnsupported {
+		t.Errorf("From a NAT-PMP gateway: %v", err)
+	}
+	addr, _ = fakePCPServer(t, func(req []byte) []byte {
+		resp := pcpMapResponse(req)
+		resp[3] = 2 // NOT_AUTHORIZED
+		return resp
+	})
+	if _, err := testPCPClient(addr).AddPortMapping("tcp", 6881, 6881, "test", 10); err == nil {
+		t.Error("Mapped when not authorized")
+	}
+}
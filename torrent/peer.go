@@ -3,7 +3,6 @@ package torrent
 import (
 	"bytes"
 	"io"
-	"log"
 	"net"
 	"time"
 
@@ -14,18 +13,37 @@ const MAX_OUR_REQUESTS = 2
 const MAX_PEER_REQUESTS = 10
 const STANDARD_BLOCK_LENGTH = 16 * 1024
 
+// A message read from a peer. Its buffer is the reader's, from
+// getMessageBuffer, and goes back once the loop has handled it, so nothing
+// may keep any of it.
 type peerMessage struct {
 	peer    *peerState
 	message []byte // nil means an error occurred
 }
 
+// A message waiting to be sent. A piece message's block is kept apart from
+// its header, so that it can be sent from where it lies, which may be the
+// cache, without copying it in behind the header. Nothing may change the
+// block once it's queued. Or the block may be where it lies in a file, for
+// the kernel to send; see zeroCopy.go.
+type outMessage struct {
+	header []byte
+	block  []byte
+	file   *fileBlock
+	framed bool // The header is whole messages, lengths and all
+}
+
 type peerState struct {
 	address         string
 	id              string
-	writeChan       chan []byte
-	writeChan2      chan []byte
+	client          string     // The name the peer gave in its extension handshake
+	source          PeerSource // Where we heard about the peer
+	writeChan       chan outMessage
+	writeChan2      chan outMessage
 	lastReadTime    time.Time
+	clock           Clock   // The session's
 	have            *Bitset // What the peer has told us it has
+	counted         bool    // In the torrent's availability
 	conn            net.Conn
 	am_choking      bool // this client is choking the peer
 	am_interested   bool // this client is interested in the peer
@@ -39,24 +57,33 @@ type peerState struct {
 
 	theirExtensions map[string]int
 
-	downloaded Accumulator
-}
-
-func (p *peerState) creditDownload(length int64) {
-	p.downloaded.Add(time.Now(), length)
-}
-
-func (p *peerState) computeDownloadRate() {
-	// Has the side effect of computing the download rate.
-	p.downloaded.GetRate(time.Now())
+	// A bitfield received before we had the torrent's metadata.
+	pendingBitfield []byte
+
+	// How many of the session's pendingHaves our bitfield told it of.
+	havesSent int
+
+	// Whether it's to be asked for standard blocks only, having not
+	// answered a request for a longer one, and whether it's sent us a longer
+	// one. See blockSize.go.
+	standardBlocks bool
+	sentLongBlock  bool
+
+	// Piece data, counted by peerReader and peerWriter.
+	received *Accumulator
+	sent     *Accumulator
+	// The torrent's overhead, which they count too. See overhead.go.
+	traffic *trafficCounter
+	// Its download rate as the choker last worked it out.
+	chokeRate float64
 }
 
 func (p *peerState) DownloadBPS() float32 {
-	return float32(p.downloaded.GetRateNoUpdate())
+	return float32(p.chokeRate)
 }
 
-func queueingWriter(in, out chan []byte) {
-	queue := make(map[int][]byte)
+func queueingWriter(in, out chan outMessage) {
+	queue := make(map[int]outMessage)
 	head, tail := 0, 0
 L:
 	for {
@@ -89,14 +116,22 @@ L:
 }
 
 func NewPeerState(conn net.Conn) *peerState {
-	writeChan := make(chan []byte)
-	writeChan2 := make(chan []byte)
+	return newPeerState(conn, realClock{})
+}
+
+// A peer of a session with clock.
+func newPeerState(conn net.Conn, clock Clock) *peerState {
+	writeChan := make(chan outMessage)
+	writeChan2 := make(chan outMessage)
 	go queueingWriter(writeChan, writeChan2)
-	return &peerState{writeChan: writeChan, writeChan2: writeChan2, conn: conn,
+	now := clock.Now()
+	return &peerState{writeChan: writeChan, writeChan2: writeChan2, conn: conn, clock: clock,
 		am_choking: true, peer_choking: true,
 		peer_requests:        make(map[uint64]bool, MAX_PEER_REQUESTS),
 		our_requests:         make(map[uint64]time.Time, MAX_OUR_REQUESTS),
-		can_receive_bitfield: true}
+		can_receive_bitfield: true,
+		received:             NewAccumulator(now),
+		sent:                 NewAccumulator(now)}
 }
 
 func (p *peerState) Close() {
@@ -160,7 +195,7 @@ func (p *peerState) SendBitfield(bs *Bitset) {
 	p.sendMessage(msg)
 }
 
-func (p *peerState) SendExtensions(port uint16) {
+func (p *peerState) SendExtensions(port uint16, metadataSize int) {
 
 	handshake := map[string]interface{}{
 		"m": map[string]int{
@@ -168,6 +203,18 @@ func (p *peerState) SendExtensions(port uint16) {
 		},
 		"v": "Taipei-Torrent dev",
 	}
+	if metadataSize > 0 {
+		handshake["metadata_size"] = metadataSize
+	}
+	// Tell the peer what its address looks like from here.
+	if host, _, err := net.SplitHostPort(p.address); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			handshake["yourip"] = string(ip)
+		}
+	}
 
 	var buf bytes.Buffer
 	err := bencode.Marshal(&buf, handshake)
@@ -190,7 +237,23 @@ func (p *peerState) sendOneCharMessage(b byte) {
 }
 
 func (p *peerState) sendMessage(b []byte) {
-	p.writeChan <- b
+	p.writeChan <- outMessage{header: b}
+}
+
+// Sends msgs, which are already framed, in one write.
+func (p *peerState) sendFramed(msgs []byte) {
+	p.writeChan <- outMessage{header: msgs, framed: true}
+}
+
+// Sends a piece message, whose header is header, and whose block is block.
+func (p *peerState) sendPiece(header, block []byte) {
+	p.writeChan <- outMessage{header: header, block: block}
+}
+
+// Sends a piece message, whose header is header, and whose block is sent
+// from its file.
+func (p *peerState) sendPieceFromFile(header []byte, block *fileBlock) {
+	p.writeChan <- outMessage{header: header, file: block}
 }
 
 func (p *peerState) keepAlive(now time.Time) {
@@ -207,29 +270,12 @@ func uint32ToBytes(buf []byte, n uint32) {
 	buf[3] = byte(n)
 }
 
-func writeNBOUint32(conn net.Conn, n uint32) (err error) {
-	var buf []byte = make([]byte, 4)
-	uint32ToBytes(buf, n)
-	_, err = conn.Write(buf[0:])
-	return
-}
-
 func bytesToUint32(buf []byte) uint32 {
 	return (uint32(buf[0]) << 24) |
 		(uint32(buf[1]) << 16) |
 		(uint32(buf[2]) << 8) | uint32(buf[3])
 }
 
-func readNBOUint32(conn net.Conn) (n uint32, err error) {
-	var buf [4]byte
-	_, err = conn.Read(buf[0:])
-	if err != nil {
-		return
-	}
-	n = bytesToUint32(buf[0:])
-	return
-}
-
 // This func is designed to be run as a goroutine. It
 // listens for messages on a channel and sends them to a peer.
 
@@ -237,9 +283,14 @@ func (p *peerState) peerWriter(errorChan chan peerMessage) {
 	// log.Println("Writing messages")
 	var lastWriteTime time.Time
 
+	var length [4]byte
 	for msg := range p.writeChan2 {
-		now := time.Now()
-		if len(msg) == 0 {
+		now := p.clock.Now()
+		n := len(msg.header) + len(msg.block)
+		if msg.file != nil {
+			n += msg.file.length
+		}
+		if n == 0 && !msg.framed {
 			// This is a keep-alive message.
 			if now.Sub(lastWriteTime) < 2*time.Minute {
 				// Don't need to send keep-alive because we have recently sent a
@@ -250,17 +301,34 @@ func (p *peerState) peerWriter(errorChan chan peerMessage) {
 		}
 		lastWriteTime = now
 
-		// log.Println("Writing", uint32(len(msg)), p.conn.RemoteAddr())
-		err := writeNBOUint32(p.conn, uint32(len(msg)))
-		if err != nil {
-			log.Println(err)
-			break
+		// log.Println("Writing", uint32(n), p.conn.RemoteAddr())
+		// The length, header and block go in one write, a writev where the
+		// connection has it.
+		uint32ToBytes(length[:], uint32(n))
+		buffers := net.Buffers{length[:], msg.header}
+		if msg.framed {
+			buffers = buffers[1:]
+		} else if msg.block != nil {
+			buffers = append(buffers, msg.block)
+		}
+		var err error
+		if msg.file != nil {
+			err = writeFileBlock(p.conn, buffers, msg.file)
+		} else {
+			_, err = buffers.WriteTo(p.conn)
 		}
-		_, err = p.conn.Write(msg)
 		if err != nil {
-			// log.Println("Failed to write a message", p.address, len(msg), msg, err)
+			packageLogger().Debug("Couldn't write to peer", "peer", p.address, "err", err)
 			break
 		}
+		p.traffic.sentMessage(msg)
+		if msg.file != nil {
+			p.sent.Add(int64(msg.file.length))
+		} else if msg.block != nil {
+			p.sent.Add(int64(len(msg.block)))
+		} else {
+			p.sent.Add(int64(piecePayload(msg.header)))
+		}
 	}
 	// log.Println("peerWriter exiting")
 	errorChan <- peerMessage{p, nil}
@@ -271,29 +339,27 @@ func (p *peerState) peerWriter(errorChan chan peerMessage) {
 
 func (p *peerState) peerReader(msgChan chan peerMessage) {
 	// log.Println("Reading messages")
+	var header [4]byte
 	for {
-		var n uint32
-		n, err := readNBOUint32(p.conn)
+		_, err := io.ReadFull(p.conn, header[:])
 		if err != nil {
 			break
 		}
-		if n > 130*1024 {
+		n := bytesToUint32(header[:])
+		if n > MAX_MESSAGE_LENGTH {
 			// log.Println("Message size too large: ", n)
 			break
 		}
 
-		var buf []byte
-		if n == 0 {
-			// keep-alive - we want an empty message
-			buf = make([]byte, 1)
-		} else {
-			buf = make([]byte, n)
-		}
-
+		// A keep-alive is an empty message.
+		buf := getMessageBuffer(int(n))
 		_, err = io.ReadFull(p.conn, buf)
 		if err != nil {
+			putMessageBuffer(buf)
 			break
 		}
+		p.received.Add(int64(piecePayload(buf)))
+		p.traffic.receivedMessage(buf)
 		msgChan <- peerMessage{p, buf}
 	}
 
@@ -302,7 +368,7 @@ func (p *peerState) peerReader(msgChan chan peerMessage) {
 }
 
 func (p *peerState) sendMetadataRequest(piece int) {
-	log.Printf("Sending metadata request for piece %d to %s\n", piece, p.address)
+	packageLogger().Debug("Sending metadata request", "piece", piece, "peer", p.address)
 
 	m := map[string]int{
 		"msg_type": METADATA_REQUEST,
@@ -322,3 +388,49 @@ func (p *peerState) sendMetadataRequest(piece int) {
 
 	p.sendMessage(msg)
 }
+
+func (p *peerState) sendMetadataPiece(piece int, metadata []byte) {
+	// Checked before it's multiplied, which could overflow.
+	if piece < 0 || piece >= (len(metadata)+METADATA_PIECE_SIZE-1)/METADATA_PIECE_SIZE {
+		p.sendMetadataReject(piece)
+		return
+	}
+	start := piece * METADATA_PIECE_SIZE
+	end := min(start+METADATA_PIECE_SIZE, len(metadata))
+
+	m := map[string]int{
+		"msg_type":   METADATA_DATA,
+		"piece":      piece,
+		"total_size": len(metadata),
+	}
+	p.sendMetadataMessage(m, metadata[start:end])
+}
+
+func (p *peerState) sendMetadataReject(piece int) {
+	m := map[string]int{
+		"msg_type": METADATA_REJECT,
+		"piece":    piece,
+	}
+	p.sendMetadataMessage(m, nil)
+}
+
+func (p *peerState) sendMetadataMessage(m map[string]int, data []byte) {
+	code, ok := p.theirExtensions["ut_metadata"]
+	if !ok {
+		return
+	}
+
+	var raw bytes.Buffer
+	err := bencode.Marshal(&raw, m)
+	if err != nil {
+		return
+	}
+
+	msg := make([]byte, 2+raw.Len()+len(data))
+	msg[0] = EXTENSION
+	msg[1] = byte(code)
+	copy(msg[2:], raw.Bytes())
+	copy(msg[2+raw.Len():], data)
+
+	p.sendMessage(msg)
+}
@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Where we learned about a peer.
+type PeerSource int
+
+const (
+	PEER_SOURCE_INCOMING PeerSource = iota // The peer connected to us.
+	PEER_SOURCE_TRACKER
+	PEER_SOURCE_DHT
+	PEER_SOURCE_PEX
+	PEER_SOURCE_LPD
+	PEER_SOURCE_MAGNET // x.pe= in the magnet link
+	NUM_PEER_SOURCES
+)
+
+var peerSourceNames = [NUM_PEER_SOURCES]string{"incoming", "tracker", "dht", "pex", "lpd", "magnet"}
+
+func (s PeerSource) String() string {
+	if s >= 0 && s < NUM_PEER_SOURCES {
+		return peerSourceNames[s]
+	}
+	return fmt.Sprintf("PeerSource(%d)", int(s))
+}
+
+// A peer address we might connect to, and where it came from.
+type peerHint struct {
+	addr   string
+	source PeerSource
+}
+
+// Peer counts, by source.
+type PeerSourceCounts [NUM_PEER_SOURCES]int
+
+func (c PeerSourceCounts) Total() (total int) {
+	for _, n := range c {
+		total += n
+	}
+	return
+}
+
+// Lists the non-zero counts, e.g. "tracker: 3, dht: 1".
+func (c PeerSourceCounts) String() string {
+	var parts []string
+	for s, n := range c {
+		if n != 0 {
+			parts = append(parts, fmt.Sprintf("%v: %d", PeerSource(s), n))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,23 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func TestPeerSourceCounts(t *testing.T) {
+	var c PeerSourceCounts
+	if got := c.String(); got != "none" {
+		t.Errorf("String() of no peers = %q, want \"none\"", got)
+	}
+	c[PEER_SOURCE_TRACKER] = 3
+	c[PEER_SOURCE_DHT] = 1
+	if got, want := c.String(), "tracker: 3, dht: 1"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if c.Total() != 4 {
+		t.Errorf("Total() = %d, want 4", c.Total())
+	}
+	if got := PeerSource(42).String(); got != "PeerSource(42)" {
+		t.Errorf("String() of an unknown source = %q", got)
+	}
+}
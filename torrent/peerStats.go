@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"time"
+)
+
+// How quickly the rates shown for peers follow changes, unless the flags say
+// otherwise. After a half-life, a peer that stopped sending shows half its
+// old rate.
+const DEFAULT_RATE_HALF_LIFE = 5 * time.Second
+
+// How quickly the rates the choker goes by follow changes, unless the flags
+// say otherwise. It's shorter than the shown rates', so peers are unchoked
+// for what they're sending now, but long enough that a burst doesn't make a
+// peer look fast for long.
+const DEFAULT_CHOKE_RATE_HALF_LIFE = 2 * time.Second
+
+// PeerStats is what we've transferred with a connected peer, over its
+// connection. Only piece data counts.
+type PeerStats struct {
+	Downloaded   uint64
+	Uploaded     uint64
+	DownloadRate float64 // In bytes per second, smoothed
+	UploadRate   float64
+}
+
+// How many bytes of piece data a message carries.
+func piecePayload(msg []byte) int {
+	if len(msg) > 9 && msg[0] == PIECE {
+		return len(msg) - 9
+	}
+	return 0
+}
+
+func rateHalfLife(flags *TorrentFlags) time.Duration {
+	if flags.RateHalfLife > 0 {
+		return flags.RateHalfLife
+	}
+	return DEFAULT_RATE_HALF_LIFE
+}
+
+func (ts *TorrentSession) rateHalfLife() time.Duration {
+	return rateHalfLife(ts.flags)
+}
+
+func (ts *TorrentSession) chokeRateHalfLife() time.Duration {
+	if ts.flags.ChokeRateHalfLife > 0 {
+		return ts.flags.ChokeRateHalfLife
+	}
+	return DEFAULT_CHOKE_RATE_HALF_LIFE
+}
+
+func (p *peerState) stats(now time.Time, halfLife time.Duration) PeerStats {
+	return PeerStats{
+		Downloaded:   uint64(p.received.getTotal()),
+		Uploaded:     uint64(p.sent.getTotal()),
+		DownloadRate: p.received.GetRate(now, halfLife),
+		UploadRate:   p.sent.GetRate(now, halfLife),
+	}
+}
+
+// The torrent's rates are its peers' added up, and its web seeds', so that
+// they agree with the rates shown for the peers.
+func (ts *TorrentSession) rates(now time.Time) (download, upload float64) {
+	halfLife := ts.rateHalfLife()
+	for _, p := range ts.peers {
+		download += p.received.GetRate(now, halfLife)
+		upload += p.sent.GetRate(now, halfLife)
+	}
+	download += ts.webSeedReceived.GetRate(now, halfLife)
+	return
+}
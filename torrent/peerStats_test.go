@@ -0,0 +1,17 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func TestPiecePayload(t *testing.T) {
+	piece := make([]byte, 9+100)
+	piece[0] = PIECE
+	have := []byte{HAVE, 0, 0, 0, 1, 0, 0, 0, 0, 0}
+	if n := piecePayload(piece); n != 100 {
+		t.Errorf("A piece message carries %v", n)
+	}
+	if n := piecePayload(have); n != 0 {
+		t.Errorf("A have message carries %v", n)
+	}
+}
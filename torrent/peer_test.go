@@ -0,0 +1,309 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+const uploadPieceLength = 256 * 1024
+
+// A session that serves 1 MiB from RAM, through the RAM cache or not, to a
+// peer whose writer sends to conn.
+func uploadSession(t testing.TB, cached bool, conn net.Conn) (ts *TorrentSession, p *peerState, content []byte) {
+	content = make([]byte, 4*uploadPieceLength)
+	rand.New(rand.NewSource(1)).Read(content)
+	ram, _ := NewRAMFileSystem()
+	info := &InfoDict{Name: "upload", Length: int64(len(content)), PieceLength: uploadPieceLength}
+	fs, _, err := NewFileStore(info, ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		fs.WritePiece(content[i*uploadPieceLength:(i+1)*uploadPieceLength], i)
+	}
+	if cached {
+		fs = NewRamCacheProvider(16).NewCache("upload", 4, uploadPieceLength, int64(len(content)), fs)
+	}
+	ts = &TorrentSession{M: &MetaInfo{Info: *info}, fileStore: fs, flags: &TorrentFlags{}}
+	p = NewPeerState(conn)
+	p.am_choking = false
+	go p.peerWriter(make(chan peerMessage, 1))
+	return
+}
+
+func TestSendPiece(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		ours, theirs := net.Pipe()
+		ts, p, content := uploadSession(t, cached, ours)
+		index, begin := uint32(2), uint32(3*STANDARD_BLOCK_LENGTH)
+		go ts.sendRequest(p, index, begin, STANDARD_BLOCK_LENGTH)
+
+		msg := make([]byte, 4+9+STANDARD_BLOCK_LENGTH)
+		if _, err := io.ReadFull(theirs, msg); err != nil {
+			t.Fatal(err)
+		}
+		off := int(index)*uploadPieceLength + int(begin)
+		if bytesToUint32(msg) != 9+STANDARD_BLOCK_LENGTH || msg[4] != PIECE ||
+			bytesToUint32(msg[5:]) != index || bytesToUint32(msg[9:]) != begin ||
+			!bytes.Equal(msg[13:], content[off:off+STANDARD_BLOCK_LENGTH]) {
+			t.Errorf("Cached %v: sent %x...", cached, msg[:16])
+		}
+		ours.Close()
+		theirs.Close()
+	}
+}
+
+// Blocks sent as fast as a local socket takes them.
+func BenchmarkUpload(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			// Done once it's all been sent, not just queued.
+			want := int64(b.N) * (4 + 9 + STANDARD_BLOCK_LENGTH)
+			received := make(chan bool)
+			go func() {
+				defer close(received)
+				c, err := l.Accept()
+				if err == nil {
+					io.CopyN(ioutil.Discard, c, want)
+					c.Close()
+				}
+			}()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			ts, p, _ := uploadSession(b, cached, conn)
+			blocks := 4 * uploadPieceLength / STANDARD_BLOCK_LENGTH
+			b.SetBytes(STANDARD_BLOCK_LENGTH)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				block := i % blocks
+				index := uint32(block * STANDARD_BLOCK_LENGTH / uploadPieceLength)
+				begin := uint32(block*STANDARD_BLOCK_LENGTH) % uploadPieceLength
+				if err = ts.sendRequest(p, index, begin, STANDARD_BLOCK_LENGTH); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-received
+		})
+	}
+}
+
+// A connection that reads as the same messages over and over, until it's
+// read left bytes and closes.
+type repeatingConn struct {
+	net.Conn
+	data []byte
+	off  int
+	left int
+}
+
+func (c *repeatingConn) Read(b []byte) (n int, err error) {
+	if c.left == 0 {
+		return 0, io.EOF
+	}
+	if len(b) > c.left {
+		b = b[:c.left]
+	}
+	n = copy(b, c.data[c.off:])
+	c.off = (c.off + n) % len(c.data)
+	c.left -= n
+	return
+}
+
+// The messages a peer reads, given what its connection reads as.
+func readerPeer(data []byte, left int) (msgChan chan peerMessage) {
+	p := &peerState{conn: &repeatingConn{data: data, left: left}, received: NewAccumulator(time.Now())}
+	msgChan = make(chan peerMessage, 4)
+	go p.peerReader(msgChan)
+	return
+}
+
+func TestPeerReader(t *testing.T) {
+	// A keep-alive, then a have.
+	data := []byte{0, 0, 0, 0, 0, 0, 0, 5, HAVE, 0, 0, 0, 7}
+	msgChan := readerPeer(data, len(data))
+	if m := <-msgChan; m.message == nil || len(m.message) != 0 {
+		t.Errorf("Keep-alive read as %x", m.message)
+	}
+	if m := <-msgChan; !bytes.Equal(m.message, []byte{HAVE, 0, 0, 0, 7}) {
+		t.Errorf("Have read as %x", m.message)
+	}
+	if m := <-msgChan; m.message != nil {
+		t.Errorf("Read %x after the connection closed", m.message)
+	}
+
+	// A message that's too long is given up on before it's read.
+	long := make([]byte, 4)
+	uint32ToBytes(long, MAX_MESSAGE_LENGTH+1)
+	if m := <-readerPeer(long, 1<<20); m.message != nil {
+		t.Errorf("Read %d bytes of a message that's too long", len(m.message))
+	}
+}
+
+// Blocks read and handed back as the loop does, with how much garbage each
+// received MiB makes.
+func BenchmarkPeerReader(b *testing.B) {
+	msg := make([]byte, 4+9+STANDARD_BLOCK_LENGTH)
+	uint32ToBytes(msg, 9+STANDARD_BLOCK_LENGTH)
+	msg[4] = PIECE
+	msgChan := readerPeer(msg, b.N*len(msg))
+	b.SetBytes(STANDARD_BLOCK_LENGTH)
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		putMessageBuffer((<-msgChan).message)
+	}
+	b.StopTimer()
+	<-msgChan
+	runtime.ReadMemStats(&after)
+	mib := float64(b.N) * STANDARD_BLOCK_LENGTH / (1 << 20)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/mib, "allocs/MiB")
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/mib, "B/MiB")
+}
+
+// A torrent of 100000 random bytes in 32 KiB pieces, for fuzzing sessions.
+func fuzzMetaInfo(t testing.TB) *MetaInfo {
+	dir, err := ioutil.TempDir("", "fuzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(dir, "content"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateTorrent(filepath.Join(dir, "content"), &CreateOptions{PieceLength: 32 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// A session for fuzzing what a peer sends it: one with the torrent and every
+// other piece of it, or one from its magnet link that's still after the
+// metadata. Its one peer has every piece, is unchoked, and writes to nowhere.
+func fuzzSession(t testing.TB, meta *MetaInfo, magnet bool) (ts *TorrentSession, p *peerState, stop func()) {
+	flags := &TorrentFlags{FileSystemProvider: ramFsProvider{}, MemoryPerTorrent: -1}
+	m, torrent := *meta, ""
+	if magnet {
+		torrent = "magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(meta.InfoHash))
+		mm, err := GetMetaInfo(nil, torrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m = *mm
+	}
+	ts, err := newTorrentSession(context.Background(), flags, torrent, &m, "", 6881, nil, torrentStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < ts.totalPieces; i += 2 {
+		// Its content doesn't matter, only that it's there to send.
+		if _, err = ts.fileStore.WritePiece(make([]byte, ts.pieceLength(i)), i); err != nil {
+			t.Fatal(err)
+		}
+		ts.pieceSet.Set(i)
+		ts.goodPieces++
+	}
+	ours, theirs := net.Pipe()
+	go io.Copy(ioutil.Discard, theirs)
+	p = NewPeerState(ours)
+	p.address = "10.0.0.2:6881"
+	p.am_choking = false
+	p.have = NewBitset(ts.totalPieces)
+	for i := 0; i < ts.totalPieces; i++ {
+		p.have.Set(i)
+	}
+	ts.peers[p.address] = p
+	go p.peerWriter(make(chan peerMessage, 1))
+	return ts, p, func() {
+		close(p.writeChan)
+		ours.Close()
+		ts.cancel()
+	}
+}
+
+// Messages a peer might send, each with its length, as the loop reads them.
+func framed(msgs ...[]byte) (b []byte) {
+	for _, m := range msgs {
+		var length [4]byte
+		uint32ToBytes(length[:], uint32(len(m)))
+		b = append(append(b, length[:]...), m...)
+	}
+	return
+}
+
+// What a peer sends is read off the connection by peerReader and handled by
+// DoMessage, as the loop does, until the session drops the peer.
+func FuzzPeerMessages(f *testing.F) {
+	meta := fuzzMetaInfo(f)
+	have := []byte{HAVE, 0, 0, 0, 1}
+	request := []byte{REQUEST, 0, 0, 0, 2, 0, 0, 0x40, 0, 0, 0, 0x40, 0}
+	piece := append([]byte{PIECE, 0, 0, 0, 1, 0, 0, 0, 0}, make([]byte, STANDARD_BLOCK_LENGTH)...)
+	for _, magnet := range []bool{false, true} {
+		f.Add(magnet, framed([]byte{UNCHOKE}, []byte{INTERESTED}, request, []byte{CHOKE}))
+		f.Add(magnet, framed([]byte{BITFIELD, 0xf0}, have, []byte{UNCHOKE}, piece, []byte{CANCEL, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0x40, 0}))
+		f.Add(magnet, framed(nil, []byte{PORT, 0x1a, 0xe1}, []byte{NOT_INTERESTED}))
+		f.Add(magnet, framed(append([]byte{EXTENSION, EXTENSION_HANDSHAKE}, "d1:md11:ut_metadatai3ee13:metadata_sizei200e1:v4:test6:yourip4:\x7f\x00\x00\x01e"...)))
+		f.Add(magnet, framed(append([]byte{EXTENSION, 1}, "d8:msg_typei1e5:piecei0e10:total_sizei200eexxxx"...)))
+		f.Add(magnet, []byte{0, 0, 0xff, 0xff, PIECE})
+	}
+	f.Fuzz(func(t *testing.T, magnet bool, data []byte) {
+		ts, p, stop := fuzzSession(t, meta, magnet)
+		defer stop()
+		msgs := readerPeer(data, len(data))
+		dropped := false
+		for m := <-msgs; m.message != nil; m = <-msgs {
+			// Once the peer's dropped, the rest is read, but not handled.
+			if !dropped && ts.DoMessage(p, m.message) != nil {
+				dropped = true
+			}
+		}
+	})
+}
+
+// The payloads of extension messages, handled as they arrive: the handshake,
+// and ut_metadata's requests, data and rejections.
+func FuzzExtensionMessages(f *testing.F) {
+	meta := fuzzMetaInfo(f)
+	for _, magnet := range []bool{false, true} {
+		f.Add(magnet, append([]byte{EXTENSION_HANDSHAKE}, "d1:md11:ut_metadatai3e6:ut_pexi1ee13:metadata_sizei200e1:pi6881e4:reqqi250e1:v4:teste"...))
+		f.Add(magnet, append([]byte{1}, "d8:msg_typei0e5:piecei0ee"...))
+		f.Add(magnet, append([]byte{1}, "d8:msg_typei0e5:piecei562949953421312ee"...))
+		f.Add(magnet, append([]byte{1}, "d8:msg_typei1e5:piecei0e10:total_sizei200eexxxx"...))
+		f.Add(magnet, append([]byte{1}, "d8:msg_typei2e5:piecei0ee"...))
+		f.Add(magnet, append([]byte{2}, "d5:added6:\x7f\x00\x00\x01\x1a\xe1e"...))
+	}
+	f.Fuzz(func(t *testing.T, magnet bool, payload []byte) {
+		ts, p, stop := fuzzSession(t, meta, magnet)
+		defer stop()
+		// Their ut_metadata is 3, as if they'd shaken hands already.
+		p.theirExtensions = map[string]int{"ut_metadata": 3}
+		ts.DoExtension(payload, p)
+	})
+}
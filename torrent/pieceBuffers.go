@@ -0,0 +1,139 @@
+package torrent
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// The buffers pieces are downloaded into. They're big, a MiB or more each,
+// and there can be dozens of them at once, so rather than leave them to the
+// garbage collector they're pooled by length and shared between sessions.
+// Piece lengths are powers of two, but for the short last pieces; those
+// aren't pooled, as their lengths seldom come again.
+//
+// A buffer belongs to its ActivePiece from when it's made until it's
+// released, once the piece is written or given up on. Nothing may hold on to
+// it past that: WritePiece, in particular, has to copy anything it keeps.
+var pieceBuffers struct {
+	sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+func pieceBufferPool(length int) *sync.Pool {
+	if length <= 0 || length&(length-1) != 0 {
+		return nil
+	}
+	pieceBuffers.Lock()
+	defer pieceBuffers.Unlock()
+	p := pieceBuffers.pools[length]
+	if p == nil {
+		if pieceBuffers.pools == nil {
+			pieceBuffers.pools = make(map[int]*sync.Pool)
+		}
+		p = &sync.Pool{New: func() interface{} {
+			b := make([]byte, length)
+			return &b
+		}}
+		pieceBuffers.pools[length] = p
+	}
+	return p
+}
+
+// A buffer of length bytes. What's in it is left over from its last piece.
+func getPieceBuffer(length int) []byte {
+	if p := pieceBufferPool(length); p != nil {
+		return *p.Get().(*[]byte)
+	}
+	return make([]byte, length)
+}
+
+func putPieceBuffer(b []byte) {
+	if p := pieceBufferPool(len(b)); p != nil && cap(b) == len(b) {
+		p.Put(&b)
+	}
+}
+
+func newActivePiece(length int) *ActivePiece {
+	return (*pieceMemory)(nil).newActivePiece(length, STANDARD_BLOCK_LENGTH, true)
+}
+
+// Gives back the piece's buffer. Its blocks can't be received after this.
+func (a *ActivePiece) release() {
+	if a.buffer != nil {
+		a.memory.give(int64(len(a.buffer)))
+		putPieceBuffer(a.buffer)
+		a.buffer = nil
+	}
+}
+
+// The budget for the buffers of every session's active pieces, which the
+// manager shares among its sessions: with many fast peers and big pieces,
+// they'd take more memory than there is. A session that's at the budget
+// doesn't open new pieces, but finishes the ones it has, and goes on asking
+// more peers for their blocks in the endgame, which takes no more memory. It
+// can always have one piece, though, so that one session's pieces can't
+// hold up all the rest. A nil one has no limit.
+type pieceMemory struct {
+	limit int64 // In bytes, or 0 for no limit
+	used  int64 // Use atomically
+}
+
+func newPieceMemory(limit int64) *pieceMemory {
+	return &pieceMemory{limit: limit}
+}
+
+// A piece of length bytes, in blocks of blockSize, taken from the budget, or
+// nil if that would go over it and force isn't set.
+func (m *pieceMemory) newActivePiece(length, blockSize int, force bool) *ActivePiece {
+	if m != nil {
+		if used := atomic.AddInt64(&m.used, int64(length)); m.limit > 0 && used > m.limit && !force {
+			atomic.AddInt64(&m.used, -int64(length))
+			return nil
+		}
+	}
+	blocks := (length + blockSize - 1) / blockSize
+	return &ActivePiece{downloaderCount: make([]int, blocks), buffer: getPieceBuffer(length), memory: m, blockSize: blockSize, length: length}
+}
+
+func (m *pieceMemory) give(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.used, -n)
+	}
+}
+
+// Bytes of active pieces, over every session.
+func (m *pieceMemory) Used() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.used)
+}
+
+// The longest message a peer may send us. A block is at most
+// MAX_BLOCK_LENGTH, as that's the most we ask for, but a bitfield can be
+// longer: this one is big enough for a million pieces.
+const MAX_MESSAGE_LENGTH = 130 * 1024
+
+// The buffers peers' messages are read into, which are mostly blocks. They
+// go back to the pool once the loop has handled them: a block's copied into
+// its active piece's buffer, and nothing else keeps any of a message. The
+// longer ones, which are rare unless a torrent asks for long blocks, are
+// left to the garbage collector.
+const MESSAGE_BUFFER_LENGTH = 9 + STANDARD_BLOCK_LENGTH
+
+var messageBuffers = sync.Pool{New: func() interface{} {
+	return new([MESSAGE_BUFFER_LENGTH]byte)
+}}
+
+func getMessageBuffer(length int) []byte {
+	if length <= MESSAGE_BUFFER_LENGTH {
+		return messageBuffers.Get().(*[MESSAGE_BUFFER_LENGTH]byte)[:length]
+	}
+	return make([]byte, length)
+}
+
+func putMessageBuffer(b []byte) {
+	if cap(b) == MESSAGE_BUFFER_LENGTH {
+		messageBuffers.Put((*[MESSAGE_BUFFER_LENGTH]byte)(b[:MESSAGE_BUFFER_LENGTH]))
+	}
+}
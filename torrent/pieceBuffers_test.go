@@ -0,0 +1,66 @@
+package torrent
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Two sessions with room for 3 pieces between them. The first takes all 3,
+// and the second has one anyway; once the first finishes 2, the second can
+// open another, but no more.
+func TestPieceMemoryShared(t *testing.T) {
+	memory := newPieceMemory(3 * STANDARD_BLOCK_LENGTH)
+	pieces := make([][]byte, 8)
+	for i := range pieces {
+		pieces[i] = make([]byte, STANDARD_BLOCK_LENGTH)
+	}
+	var sessions []*TorrentSession
+	var peers []*peerState
+	for i := 0; i < 2; i++ {
+		ts, p, theirs := hashingSession(t, pieces)
+		defer theirs.Close()
+		go io.Copy(ioutil.Discard, theirs)
+		ts.pieceMemory = memory
+		ts.maxActivePieces = len(pieces)
+		p.peer_choking = false
+		sessions, peers = append(sessions, ts), append(peers, p)
+	}
+	requestAll := func(i int) {
+		for j := 0; j < len(pieces); j++ {
+			if err := sessions[i].RequestBlock(peers[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a, b := sessions[0], sessions[1]
+	check := func(activeA, activeB int) {
+		t.Helper()
+		if len(a.activePieces) != activeA || len(b.activePieces) != activeB {
+			t.Fatalf("%d and %d active pieces, not %d and %d", len(a.activePieces), len(b.activePieces), activeA, activeB)
+		}
+		if got, want := memory.Used(), int64(activeA+activeB)*STANDARD_BLOCK_LENGTH; got != want {
+			t.Fatalf("Used %d bytes, not %d", got, want)
+		}
+	}
+	requestAll(0)
+	requestAll(1)
+	check(3, 1)
+
+	finished := 0
+	for piece, v := range a.activePieces {
+		if finished++; finished > 2 {
+			break
+		}
+		copy(v.buffer, pieces[piece])
+		a.RecordBlock(peers[0], uint32(piece), 0, STANDARD_BLOCK_LENGTH)
+	}
+	hashQueued(a)
+	if a.goodPieces != 2 {
+		t.Fatalf("%d good pieces", a.goodPieces)
+	}
+	check(1, 1)
+	requestAll(1)
+	requestAll(0)
+	check(1, 2)
+}
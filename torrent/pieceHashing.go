@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"io"
+	"runtime"
+)
+
+// Pieces are hashed off the session loop, by a few goroutines of the
+// session's own, so that hashing a big piece doesn't hold up every other
+// peer's messages. A piece whose blocks have all arrived stays in
+// activePieces while it's hashed, with every block recorded, so nothing
+// requests it again or writes to its buffer. It's only saved, counted and
+// announced with a Have once its hash is back in the loop; if it's bad, it's
+// dropped, for its blocks to be requested again.
+
+// How many pieces a session hashes at once, at most.
+const MAX_PIECE_HASHERS = 4
+
+type pieceHash struct {
+	piece int
+	v     *ActivePiece
+	m     *MetaInfo
+	good  bool
+	err   error
+	// Called in the loop with the result, once the piece has been saved or
+	// dropped.
+	hashed func(good bool, err error)
+}
+
+func (ts *TorrentSession) startPieceHashers() {
+	for i := 0; i < min(runtime.GOMAXPROCS(0), MAX_PIECE_HASHERS); i++ {
+		go ts.pieceHasher()
+	}
+}
+
+func (ts *TorrentSession) pieceHasher() {
+	for {
+		select {
+		case h := <-ts.hashJobs:
+			h.good, h.err = h.check(loopReader{ts})
+			select {
+			case ts.hashResults <- h:
+			case <-ts.ended:
+				return
+			}
+		case <-ts.ended:
+			return
+		}
+	}
+}
+
+// Hashes the piece: its buffer, or if its blocks went to the store, what
+// the store has of it, read a segment at a time.
+func (h *pieceHash) check(store io.ReaderAt) (good bool, err error) {
+	if h.v.store != nil {
+		return checkPieceAt(store, h.m, h.piece, h.v.length)
+	}
+	return checkPiece(h.v.buffer, h.m, h.piece)
+}
+
+// Queues a piece whose blocks have all arrived to be hashed.
+func (ts *TorrentSession) hashPiece(piece int, v *ActivePiece, hashed func(good bool, err error)) {
+	ts.hashQueue = append(ts.hashQueue, &pieceHash{piece: piece, v: v, m: ts.M, hashed: hashed})
+}
+
+// The next piece to hand the hashers, and the channel to hand it on, which is
+// nil if there's nothing queued. The loop never waits for the hashers, since
+// they wait for it to take their results.
+func (ts *TorrentSession) nextPieceHash() (jobs chan<- *pieceHash, h *pieceHash) {
+	if len(ts.hashQueue) > 0 {
+		jobs, h = ts.hashJobs, ts.hashQueue[0]
+	}
+	return
+}
+
+func (ts *TorrentSession) pieceHashed(h *pieceHash) {
+	if ts.activePieces[h.piece] != h.v {
+		// A recheck dropped it while it was being hashed.
+		h.v.release()
+		return
+	}
+	good, err := ts.finishPiece(h)
+	h.hashed(good, err)
+	ts.topUpRequests()
+}
+
+// Requests blocks of the unchoked peers we aren't waiting on for any, now
+// that the piece that was being hashed is out of the way. Otherwise a peer we
+// had nothing more to ask of while it was being hashed, or whose blocks have
+// to be fetched again, could sit idle.
+func (ts *TorrentSession) topUpRequests() {
+	for _, p := range ts.peers {
+		if p.peer_choking || p.have == nil || len(p.our_requests) > 0 {
+			continue
+		}
+		for i := 0; i < MAX_OUR_REQUESTS; i++ {
+			if ts.RequestBlock(p) != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Hashes the queued pieces in place of the hashers, for sessions whose loop
+// isn't running.
+func hashQueued(ts *TorrentSession) {
+	for len(ts.hashQueue) > 0 {
+		h := ts.hashQueue[0]
+		ts.hashQueue = ts.hashQueue[1:]
+		h.good, h.err = h.check(ts.fileStore)
+		ts.pieceHashed(h)
+	}
+}
+
+// A session of 16 KiB pieces, with a peer that has them all.
+func hashingSession(t *testing.T, pieces [][]byte) (ts *TorrentSession, p *peerState, theirs net.Conn) {
+	var hashes string
+	for _, piece := range pieces {
+		sum := sha1.Sum(piece)
+		hashes += string(sum[:])
+	}
+	info := InfoDict{Name: "hashing", PieceLength: STANDARD_BLOCK_LENGTH, Length: int64(len(pieces)) * STANDARD_BLOCK_LENGTH, Pieces: hashes}
+	ram, _ := NewRAMFileSystem()
+	fs, _, err := NewFileStore(&info, ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = &TorrentSession{
+		M:            &MetaInfo{Info: info},
+		fileStore:    fs,
+		peers:        make(map[string]*peerState),
+		activePieces: make(map[int]*ActivePiece),
+		pieceSet:     NewBitset(len(pieces)),
+		totalPieces:  len(pieces),
+		ended:        make(chan bool),
+		events:       newEventFeed(),
+		blockSize:    STANDARD_BLOCK_LENGTH,
+
+		standardBlockPeers: make(map[string]bool),
+	}
+	ts.Session.HaveTorrent = true
+	ts.Session.Left = uint64(info.Length)
+	ts.lastPieceLength = STANDARD_BLOCK_LENGTH
+	ts.maxActivePieces = 2
+	var ours net.Conn
+	ours, theirs = net.Pipe()
+	p = NewPeerState(ours)
+	p.address = "peer"
+	p.have = NewBitset(len(pieces))
+	for i := range pieces {
+		p.have.Set(i)
+	}
+	ts.peers[p.address] = p
+	go p.peerWriter(make(chan peerMessage, 1))
+	return
+}
+
+// Reads the peer's messages until one of type id arrives, or none has for a
+// while.
+func readMessage(conn net.Conn, id byte) (msg []byte) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		var length [4]byte
+		if _, err := conn.Read(length[:]); err != nil {
+			return nil
+		}
+		msg = make([]byte, bytesToUint32(length[:]))
+		n := 0
+		for n < len(msg) {
+			m, err := conn.Read(msg[n:])
+			if err != nil {
+				return nil
+			}
+			n += m
+		}
+		if len(msg) > 0 && msg[0] == id {
+			return
+		}
+	}
+}
+
+func TestPieceHashedBeforeHave(t *testing.T) {
+	good := make([]byte, STANDARD_BLOCK_LENGTH)
+	good[0] = 1
+	ts, p, theirs := hashingSession(t, [][]byte{good, good})
+	defer theirs.Close()
+	ts.activePieces[0] = newActivePiece(STANDARD_BLOCK_LENGTH)
+	ts.requestBlockImp(p, 0, 0, true)
+	if msg := readMessage(theirs, REQUEST); msg == nil {
+		t.Fatal("Didn't request the block")
+	}
+
+	copy(ts.activePieces[0].buffer, good)
+	ts.RecordBlock(p, 0, 0, STANDARD_BLOCK_LENGTH)
+	if ts.pieceSet.IsSet(0) || ts.goodPieces != 0 || len(ts.hashQueue) != 1 {
+		t.Fatal("Counted the piece before it was hashed")
+	}
+	if ts.activePieces[0] == nil {
+		t.Fatal("Forgot the piece while it was being hashed")
+	}
+	// Blocks that come now don't touch it, or have it hashed twice.
+	ts.RecordBlock(p, 0, 0, STANDARD_BLOCK_LENGTH)
+	if len(ts.hashQueue) != 1 {
+		t.Fatalf("%d hashes queued", len(ts.hashQueue))
+	}
+	if msg := readMessage(theirs, HAVE); msg != nil {
+		t.Fatal("Sent a Have before the piece was hashed")
+	}
+
+	hashQueued(ts)
+	if !ts.pieceSet.IsSet(0) || ts.goodPieces != 1 || ts.activePieces[0] != nil {
+		t.Fatal("Didn't keep the piece once it was hashed")
+	}
+}
+
+func TestBadPieceRequestedAgain(t *testing.T) {
+	ts, p, theirs := hashingSession(t, [][]byte{make([]byte, STANDARD_BLOCK_LENGTH)})
+	defer theirs.Close()
+	ts.activePieces[0] = newActivePiece(STANDARD_BLOCK_LENGTH)
+	ts.activePieces[0].buffer[0] = 1
+	ts.RecordBlock(p, 0, 0, STANDARD_BLOCK_LENGTH)
+
+	// Another peer that we've nothing to ask of until it fails.
+	ours2, theirs2 := net.Pipe()
+	defer theirs2.Close()
+	p2 := NewPeerState(ours2)
+	p2.address = "peer2"
+	p2.have = NewBitset(1)
+	p2.have.Set(0)
+	p2.peer_choking = false
+	ts.peers[p2.address] = p2
+	go p2.peerWriter(make(chan peerMessage, 1))
+
+	requested := make(chan []byte)
+	go func() { requested <- readMessage(theirs2, REQUEST) }()
+	hashQueued(ts)
+	if ts.pieceSet.IsSet(0) || ts.hashFailures != 1 {
+		t.Fatal("Kept a bad piece")
+	}
+	if msg := <-requested; msg == nil || bytesToUint32(msg[1:5]) != 0 {
+		t.Fatal("Didn't request the bad piece again")
+	}
+}
+
+type writesBeyondStore struct {
+	FileStore
+}
+
+func (writesBeyondStore) WritePiece(p []byte, piece int) (int, error) {
+	return 0, &ErrWriteBeyondStore{Offset: 10, Size: 5}
+}
+
+// A piece that couldn't be written stops the torrent, for its files' sake,
+// unless what the peer sent can't be the torrent's, which drops the peer.
+func TestWriteBeyondStoreDropsPeer(t *testing.T) {
+	for _, beyond := range []bool{false, true} {
+		good := make([]byte, STANDARD_BLOCK_LENGTH)
+		ts, p, theirs := hashingSession(t, [][]byte{good})
+		ts.fileStore = failingWrites{ts.fileStore}
+		if beyond {
+			ts.fileStore = writesBeyondStore{ts.fileStore}
+		}
+		ts.activePieces[0] = newActivePiece(STANDARD_BLOCK_LENGTH)
+		copy(ts.activePieces[0].buffer, good)
+		ts.RecordBlock(p, 0, 0, STANDARD_BLOCK_LENGTH)
+		hashQueued(ts)
+		if ts.pieceSet.IsSet(0) {
+			t.Errorf("Beyond %v: kept the piece", beyond)
+		}
+		if failed := ts.storageErr != nil; failed == beyond {
+			t.Errorf("Beyond %v: storage failed %v", beyond, failed)
+		}
+		theirs.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := theirs.Write([]byte{0})
+		if closed := err == io.ErrClosedPipe; closed != beyond {
+			t.Errorf("Beyond %v: writing to the peer, %v", beyond, err)
+		}
+		theirs.Close()
+	}
+}
@@ -2,13 +2,18 @@
 package torrent
 
 import (
+	"context"
 	"crypto/sha1"
 	"errors"
 	"fmt"
+	"hash"
 	"runtime"
 )
 
-func checkPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, goodBits *Bitset, err error) {
+func checkPieces(ctx context.Context, fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, goodBits *Bitset, err error) {
+	if m.isV2Only() {
+		return checkPiecesV2(ctx, fs, m)
+	}
 	pieceLength := m.Info.PieceLength
 	numPieces := int((totalLength + pieceLength - 1) / pieceLength)
 	goodBits = NewBitset(int(numPieces))
@@ -17,7 +22,7 @@ func checkPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, g
 		err = errors.New("Incorrect Info.Pieces length")
 		return
 	}
-	currentSums, err := computeSums(fs, totalLength, m.Info.PieceLength)
+	currentSums, err := computeSums(ctx, fs, totalLength, m.Info.PieceLength)
 	if err != nil {
 		return
 	}
@@ -50,13 +55,16 @@ type chunk struct {
 
 // computeSums reads the file content and computes the SHA1 hash for each
 // piece. Spawns parallel goroutines to compute the hashes, since each
-// computation takes ~30ms.
-func computeSums(fs FileStore, totalLength int64, pieceLength int64) (sums []byte, err error) {
+// computation takes ~30ms. It gives up with ctx.Err() when ctx is done.
+func computeSums(ctx context.Context, fs FileStore, totalLength int64, pieceLength int64) (sums []byte, err error) {
+	if pieceLength > SEGMENTED_PIECE_LENGTH {
+		return computeSegmentedSums(ctx, fs, totalLength, pieceLength, runtime.GOMAXPROCS(0))
+	}
 	// Calculate the SHA1 hash for each piece in parallel goroutines.
 	hashes := make(chan chunk)
 	results := make(chan chunk, 3)
 	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		go hashPiece(hashes, results)
+		go hashPiece(ctx, hashes, results)
 	}
 
 	// Read file content and send to "pieces", keeping order.
@@ -69,7 +77,12 @@ func computeSums(fs FileStore, totalLength int64, pieceLength int64) (sums []byt
 			}
 			// Ignore errors.
 			fs.ReadAt(piece, i*pieceLength)
-			hashes <- chunk{i: i, data: piece}
+			select {
+			case hashes <- chunk{i: i, data: piece}:
+			case <-ctx.Done():
+				close(hashes)
+				return
+			}
 		}
 		close(hashes)
 	}()
@@ -77,26 +90,36 @@ func computeSums(fs FileStore, totalLength int64, pieceLength int64) (sums []byt
 	// Merge back the results.
 	sums = make([]byte, sha1.Size*numPieces)
 	for i := int64(0); i < numPieces; i++ {
-		h := <-results
-		copy(sums[h.i*sha1.Size:], h.data)
+		select {
+		case h := <-results:
+			copy(sums[h.i*sha1.Size:], h.data)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 	return
 }
 
-func hashPiece(h chan chunk, result chan chunk) {
+func hashPiece(ctx context.Context, h chan chunk, result chan chunk) {
 	hasher := sha1.New()
 	for piece := range h {
 		hasher.Reset()
 		_, err := hasher.Write(piece.data)
-		if err != nil {
-			result <- chunk{piece.i, nil}
-		} else {
-			result <- chunk{piece.i, hasher.Sum(nil)}
+		sum := chunk{piece.i, nil}
+		if err == nil {
+			sum.data = hasher.Sum(nil)
+		}
+		select {
+		case result <- sum:
+		case <-ctx.Done():
 		}
 	}
 }
 
 func checkPiece(piece []byte, m *MetaInfo, pieceIndex int) (good bool, err error) {
+	if m.isV2Only() {
+		return checkPieceV2(piece, m, pieceIndex)
+	}
 	ref := m.Info.Pieces
 	var currentSum []byte
 	currentSum, err = computePieceSum(piece)
@@ -113,6 +136,16 @@ func checkPiece(piece []byte, m *MetaInfo, pieceIndex int) (good bool, err error
 	return
 }
 
+// The hasher for the piece at pieceIndex, which is in range, and the sum it
+// should come to.
+func (m *MetaInfo) pieceHasher(pieceIndex int) (h hash.Hash, ref []byte) {
+	if m.isV2Only() {
+		return m.pieceHasherV2(pieceIndex)
+	}
+	base := pieceIndex * sha1.Size
+	return sha1.New(), []byte(m.Info.Pieces[base : base+sha1.Size])
+}
+
 func computePieceSum(piece []byte) (sum []byte, err error) {
 	hasher := sha1.New()
 
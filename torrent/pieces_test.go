@@ -1,11 +1,24 @@
 package torrent
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"testing"
 )
 
+func TestComputeSumsCancelled(t *testing.T) {
+	fs, err := mkFileStore(tests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = computeSums(ctx, fs, tests[0].fileLen, 25); err != context.Canceled {
+		t.Errorf("Got %v", err)
+	}
+}
+
 func TestComputeSums(t *testing.T) {
 	pieceLen := int64(25)
 	for _, testFile := range tests {
@@ -13,7 +26,7 @@ func TestComputeSums(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		sums, err := computeSums(fs, testFile.fileLen, pieceLen)
+		sums, err := computeSums(context.Background(), fs, testFile.fileLen, pieceLen)
 		if err != nil {
 			t.Fatal(err)
 		}
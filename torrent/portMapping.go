@@ -0,0 +1,308 @@
+package torrent
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Keeping our listen port mapped. NATs drop mappings when their leases run
+// out, and when they restart, so we ask again at half the lease we got, and
+// at once when we see the gateway's restarted: a NAT-PMP or PCP gateway's
+// epoch goes back, or a UPnP router no longer has the mapping. We keep an eye
+// on the external address too, since restarts can change it.
+
+const (
+	NAT_LEASE       = 2 * time.Hour // What we ask for
+	NAT_RETRY_DELAY = time.Minute   // After a failed renewal
+	NAT_CHECK       = time.Minute   // How often we look for gateways restarting
+)
+
+var natCheck = NAT_CHECK // Shortened by tests
+
+// A NAT that says how long it granted a mapping for, and its epoch: the
+// seconds since it started mapping ports.
+type leasingNAT interface {
+	NAT
+	addPortMappingLease(protocol string, externalPort, internalPort int,
+		description string, timeout int) (mappedExternalPort int, granted time.Duration, epoch uint32, err error)
+	epoch() (seconds uint32, err error)
+}
+
+// A NAT that can say whether it still has a mapping.
+type checkingNAT interface {
+	NAT
+	mappingExists(protocol string, externalPort int) (exists bool, err error)
+}
+
+// PortStatus is how our listen port is mapped, so that users can check that
+// peers can reach us.
+type PortStatus struct {
+	Address      string // What we're bound to, like [::]:6881
+	Port         int    // What peers should connect to
+	InternalPort int    // What we listen on
+	Mapping      string // "NAT-PMP", "PCP", "UPnP", or "" for none
+	ExternalIP   string // As the NAT tells it
+	LeaseExpires time.Time
+	Error        string // Why the last renewal failed
+
+	// Whether peers can connect, "open", "closed" or "unknown". Only the
+	// port we announce is tested.
+	Reachable string
+
+	// Whether we're taking peers' connections: not if the listener's closed,
+	// or accepting them fails. AcceptError is the last failure's, of
+	// AcceptErrors in all.
+	Accepting    bool
+	AcceptErrors int64
+	AcceptError  string
+}
+
+type portMapping struct {
+	nat          NAT
+	protocol     string
+	internalPort int
+	stop         chan bool
+	done         chan bool
+
+	lock         sync.Mutex
+	externalPort int
+	expires      time.Time
+	renewAt      time.Time
+	err          error
+	epoch        uint32 // The gateway's, when we last asked
+	epochAt      time.Time
+	externalIP   net.IP
+	checkFailed  bool                   // We couldn't check the mapping last time, and said so
+	changed      func(externalPort int) // Called when a renewal moves the external port
+	ipChanged    func(ip net.IP)        // Called when the NAT's external address changes
+}
+
+// Maps port on nat, and keeps it mapped until close.
+func newPortMapping(nat NAT, protocol string, port int) (pm *portMapping, err error) {
+	pm = &portMapping{
+		nat:          nat,
+		protocol:     protocol,
+		internalPort: port,
+		externalPort: port,
+		stop:         make(chan bool),
+		done:         make(chan bool),
+	}
+	if err = pm.mapPort(time.Now()); err != nil {
+		return nil, err
+	}
+	pm.checkExternalIP()
+	go pm.renew()
+	return
+}
+
+func natKind(nat NAT) string {
+	switch nat.(type) {
+	case *natPMPClient:
+		return "NAT-PMP"
+	case *pcpClient:
+		return "PCP"
+	case *upnpNAT:
+		return "UPnP"
+	}
+	return "NAT"
+}
+
+// Asks for the mapping, hoping to keep the external port we have.
+func (pm *portMapping) mapPort(now time.Time) (err error) {
+	pm.lock.Lock()
+	want := pm.externalPort
+	pm.lock.Unlock()
+	description := "Taipei-Torrent port " + strconv.Itoa(pm.internalPort)
+	lease := int(NAT_LEASE / time.Second)
+	var mapped int
+	granted := NAT_LEASE
+	var epoch uint32
+	l, leasing := pm.nat.(leasingNAT)
+	if leasing {
+		mapped, granted, epoch, err = l.addPortMappingLease(pm.protocol, want, pm.internalPort, description, lease)
+	} else {
+		mapped, err = pm.nat.AddPortMapping(pm.protocol, want, pm.internalPort, description, lease)
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.err = err
+	if err != nil {
+		retry := NAT_RETRY_DELAY
+		if left := pm.expires.Sub(now) / 2; left > 0 && left < retry {
+			retry = left
+		}
+		pm.renewAt = now.Add(retry)
+		return
+	}
+	pm.externalPort, pm.expires, pm.renewAt = mapped, now.Add(granted), now.Add(granted/2)
+	if leasing {
+		pm.epoch, pm.epochAt = epoch, now
+	}
+	return
+}
+
+func (pm *portMapping) renew() {
+	defer close(pm.done)
+	ticker := time.NewTicker(natCheck)
+	defer ticker.Stop()
+	for {
+		pm.lock.Lock()
+		wait := time.Until(pm.renewAt)
+		pm.lock.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-pm.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		case now := <-ticker.C:
+			timer.Stop()
+			lost := pm.lost(now)
+			pm.checkExternalIP()
+			if !lost {
+				continue
+			}
+		}
+		pm.remap()
+	}
+}
+
+// Whether the gateway's lost our mapping, as far as we can tell.
+func (pm *portMapping) lost(now time.Time) bool {
+	switch nat := pm.nat.(type) {
+	case leasingNAT:
+		if pm.restarted(nat, now) {
+			log.Println("The", natKind(pm.nat), "gateway restarted, mapping the port again")
+			return true
+		}
+	case checkingNAT:
+		pm.lock.Lock()
+		port := pm.externalPort
+		pm.lock.Unlock()
+		exists, err := nat.mappingExists(pm.protocol, port)
+		pm.lock.Lock()
+		defer pm.lock.Unlock()
+		if err != nil {
+			// Some routers can't look mappings up. They still get renewed.
+			if !pm.checkFailed {
+				log.Println("Couldn't check the port mapping is still there, so relying on renewals:", err)
+				pm.checkFailed = true
+			}
+			return false
+		}
+		pm.checkFailed = false
+		if !exists {
+			log.Println("The", natKind(pm.nat), "router lost our port mapping, mapping the port again")
+			return true
+		}
+	}
+	return false
+}
+
+// Asks the NAT for our external address, and says if it's changed.
+func (pm *portMapping) checkExternalIP() {
+	ip, err := pm.nat.GetExternalAddress()
+	if err != nil || ip == nil {
+		return
+	}
+	pm.lock.Lock()
+	old, ipChanged := pm.externalIP, pm.ipChanged
+	if ip.Equal(old) {
+		pm.lock.Unlock()
+		return
+	}
+	pm.externalIP = ip
+	pm.lock.Unlock()
+	if old != nil {
+		log.Println("The NAT's external address changed from", old, "to", ip)
+	}
+	if ipChanged != nil {
+		ipChanged(ip)
+	}
+}
+
+// Whether the gateway's restarted since we last asked about its epoch, by
+// RFC 6886's rule: its clock must keep up with ours, to within 1/8 and 2s.
+func (pm *portMapping) restarted(nat leasingNAT, now time.Time) bool {
+	epoch, err := nat.epoch()
+	if err != nil {
+		return false
+	}
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	elapsed := int64(now.Sub(pm.epochAt) / time.Second)
+	expected := int64(pm.epoch) + elapsed*7/8
+	pm.epoch, pm.epochAt = epoch, now
+	return int64(epoch) < expected-2
+}
+
+func (pm *portMapping) remap() {
+	pm.lock.Lock()
+	old := pm.externalPort
+	pm.lock.Unlock()
+	if err := pm.mapPort(time.Now()); err != nil {
+		log.Println("Couldn't renew the port mapping:", err)
+		return
+	}
+	pm.lock.Lock()
+	port, expires, changed := pm.externalPort, pm.expires, pm.changed
+	pm.lock.Unlock()
+	packageLogger().Debug("Renewed the port mapping", "port", port, "expires", expires)
+	if port != old {
+		log.Println("The NAT moved our external port from", old, "to", port)
+		if changed != nil {
+			changed(port)
+		}
+	}
+}
+
+// Has f called with the new external port when the NAT moves it.
+func (pm *portMapping) onChange(f func(externalPort int)) {
+	pm.lock.Lock()
+	pm.changed = f
+	pm.lock.Unlock()
+}
+
+// Has f called with the NAT's external address, now if we know it, and
+// whenever it changes.
+func (pm *portMapping) onExternalIP(f func(ip net.IP)) {
+	pm.lock.Lock()
+	pm.ipChanged = f
+	ip := pm.externalIP
+	pm.lock.Unlock()
+	if ip != nil && f != nil {
+		f(ip)
+	}
+}
+
+func (pm *portMapping) status() PortStatus {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	s := PortStatus{
+		Port:         pm.externalPort,
+		InternalPort: pm.internalPort,
+		Mapping:      natKind(pm.nat),
+		LeaseExpires: pm.expires,
+	}
+	if pm.externalIP != nil {
+		s.ExternalIP = pm.externalIP.String()
+	}
+	if pm.err != nil {
+		s.Error = pm.err.Error()
+	}
+	return s
+}
+
+// Stops renewing the mapping, and deletes it.
+func (pm *portMapping) close() error {
+	close(pm.stop)
+	<-pm.done
+	pm.lock.Lock()
+	external := pm.externalPort
+	pm.lock.Unlock()
+	return pm.nat.DeletePortMapping(pm.protocol, external, pm.internalPort)
+}
@@ -0,0 +1,231 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A leasingNAT whose leases, epoch and ports the tests pick.
+type fakeNAT struct {
+	lock    sync.Mutex
+	lease   time.Duration
+	epochs  uint32
+	moveTo  int // The external port to hand out from now on, if not 0
+	maps    int
+	deleted []int // The external ports deleted
+}
+
+func (f *fakeNAT) GetExternalAddress() (net.IP, error) {
+	return net.IPv4(1, 2, 3, 4), nil
+}
+
+func (f *fakeNAT) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (int, error) {
+	port, _, _, err := f.addPortMappingLease(protocol, externalPort, internalPort, description, timeout)
+	return port, err
+}
+
+func (f *fakeNAT) addPortMappingLease(protocol string, externalPort, internalPort int,
+	description string, timeout int) (int, time.Duration, uint32, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.maps++
+	if f.moveTo != 0 {
+		externalPort = f.moveTo
+	}
+	return externalPort, f.lease, f.epochs, nil
+}
+
+func (f *fakeNAT) DeletePortMapping(protocol string, externalPort, internalPort int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.deleted = append(f.deleted, externalPort)
+	return nil
+}
+
+func (f *fakeNAT) epoch() (uint32, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.epochs, nil
+}
+
+func (f *fakeNAT) counts() (maps int, deleted []int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.maps, append([]int(nil), f.deleted...)
+}
+
+func TestPortMappingRenewal(t *testing.T) {
+	nat := &fakeNAT{lease: 40 * time.Millisecond}
+	pm, err := newPortMapping(nat, "tcp", 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := pm.status()
+	if s.Port != 6881 || s.InternalPort != 6881 || s.Mapping != "NAT" || s.LeaseExpires.IsZero() || s.Error != "" {
+		t.Errorf("Status %+v", s)
+	}
+	// Renewed every 20ms.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if maps, _ := nat.counts(); maps >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Not renewed")
+		}
+	}
+	if err = pm.close(); err != nil {
+		t.Fatal(err)
+	}
+	maps, deleted := nat.counts()
+	if len(deleted) != 1 || deleted[0] != 6881 {
+		t.Errorf("Deleted %v", deleted)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if after, _ := nat.counts(); after != maps {
+		t.Errorf("Renewed %d times after close", after-maps)
+	}
+}
+
+func TestPortMappingGatewayRestart(t *testing.T) {
+	defer func(d time.Duration) { natCheck = d }(natCheck)
+	natCheck = 10 * time.Millisecond
+	nat := &fakeNAT{lease: time.Hour, epochs: 1000}
+	pm, err := newPortMapping(nat, "tcp", 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.close()
+	time.Sleep(50 * time.Millisecond)
+	if maps, _ := nat.counts(); maps != 1 {
+		t.Fatalf("Mapped %d times with the gateway up", maps)
+	}
+	nat.lock.Lock()
+	nat.epochs = 3
+	nat.lock.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if maps, _ := nat.counts(); maps == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Not mapped again after the gateway restarted")
+		}
+	}
+}
+
+func TestPortMappingMoved(t *testing.T) {
+	nat := &fakeNAT{lease: 40 * time.Millisecond}
+	pm, err := newPortMapping(nat, "tcp", 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := make(chan int, 1)
+	pm.onChange(func(port int) { moved <- port })
+	nat.lock.Lock()
+	nat.moveTo = 9999
+	nat.lock.Unlock()
+	select {
+	case port := <-moved:
+		if port != 9999 || pm.status().Port != 9999 {
+			t.Errorf("Moved to %d, status %+v", port, pm.status())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not told about the move")
+	}
+	pm.onChange(nil)
+	pm.close()
+	if _, deleted := nat.counts(); len(deleted) != 1 || deleted[0] != 9999 {
+		t.Errorf("Deleted %v", deleted)
+	}
+}
+
+// A NAT whose mappings fail.
+type brokenNAT struct{ fakeNAT }
+
+func (b *brokenNAT) addPortMappingLease(protocol string, externalPort, internalPort int,
+	description string, timeout int) (int, time.Duration, uint32, error) {
+	return 0, 0, 0, errors.New("No")
+}
+
+func TestPortMappingFailure(t *testing.T) {
+	if _, err := newPortMapping(&brokenNAT{}, "tcp", 6881); err == nil {
+		t.Error("Mapped on a broken NAT")
+	}
+}
+
+// A UPnP-like NAT that can lose mappings, and move its external address.
+type forgetfulNAT struct {
+	lock    sync.Mutex
+	mapped  bool
+	ip      net.IP
+	maps    int
+	lookups int
+}
+
+func (f *forgetfulNAT) GetExternalAddress() (net.IP, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.ip, nil
+}
+
+func (f *forgetfulNAT) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.mapped = true
+	f.maps++
+	return externalPort, nil
+}
+
+func (f *forgetfulNAT) DeletePortMapping(protocol string, externalPort, internalPort int) error {
+	return nil
+}
+
+func (f *forgetfulNAT) mappingExists(protocol string, externalPort int) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lookups++
+	return f.mapped, nil
+}
+
+func TestPortMappingLost(t *testing.T) {
+	defer func(d time.Duration) { natCheck = d }(natCheck)
+	natCheck = 10 * time.Millisecond
+	nat := &forgetfulNAT{ip: net.IPv4(1, 2, 3, 4)}
+	pm, err := newPortMapping(nat, "TCP", 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.close()
+	ips := make(chan net.IP, 2)
+	pm.onExternalIP(func(ip net.IP) { ips <- ip })
+	if ip := <-ips; !ip.Equal(net.IPv4(1, 2, 3, 4)) || pm.status().ExternalIP != "1.2.3.4" {
+		t.Errorf("First told %v, status %+v", ip, pm.status())
+	}
+
+	// The router restarts, forgetting the mapping, with a new address.
+	nat.lock.Lock()
+	nat.mapped = false
+	nat.ip = net.IPv4(5, 6, 7, 8)
+	nat.lock.Unlock()
+	select {
+	case ip := <-ips:
+		if !ip.Equal(net.IPv4(5, 6, 7, 8)) {
+			t.Errorf("Told %v", ip)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not told about the new address")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		nat.lock.Lock()
+		maps := nat.maps
+		nat.lock.Unlock()
+		if maps == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Not mapped again after the router lost the mapping")
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"time"
+)
+
+// Progress reports, for frontends that show how the torrents are doing
+// without running the RPC server, like the -jsonProgress output: every
+// torrent's status each ProgressInterval, and as soon as one changes state.
+
+const PROGRESS_DEFAULT_INTERVAL = 5 * time.Second
+
+// How often the states are looked at, between reports.
+const PROGRESS_CHECK = time.Second
+
+// Calls flags.Progress until the loop ends.
+func (m *sessionManager) reportProgress() {
+	interval := m.flags.ProgressInterval
+	if interval <= 0 {
+		interval = PROGRESS_DEFAULT_INTERVAL
+	}
+	check := PROGRESS_CHECK
+	if interval < check {
+		check = interval
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	var last time.Time
+	states := make(map[string]string) // By info-hash
+	for {
+		select {
+		case <-m.ended:
+			return
+		case now := <-ticker.C:
+			statuses, err := m.Statuses()
+			if err != nil {
+				return
+			}
+			changed := len(statuses) != len(states)
+			current := make(map[string]string, len(statuses))
+			for i := range statuses {
+				state := statuses[i].State()
+				current[statuses[i].InfoHash] = state
+				changed = changed || states[statuses[i].InfoHash] != state
+			}
+			states = current
+			if changed || now.Sub(last) >= interval {
+				m.flags.Progress(statuses)
+				last = now
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package torrent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReportProgress(t *testing.T) {
+	reports := make(chan []TorrentStatus, 10)
+	flags := &TorrentFlags{MaxActive: 1, ProgressInterval: time.Hour,
+		Progress: func(s []TorrentStatus) { reports <- s }}
+	m := newSessionManager(context.Background(), flags, 0)
+	m.stayUp = true
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	go m.reportProgress()
+	// The first look is a change, from nothing.
+	if s := <-reports; len(s) != 0 {
+		t.Errorf("First report %+v", s)
+	}
+	// As is a torrent failing.
+	m.run(func() { m.adding["ih"] = &addingTorrent{name: "bad", err: errDuplicateTorrent} })
+	select {
+	case s := <-reports:
+		if len(s) != 1 || s[0].State() != "error" {
+			t.Errorf("After a torrent failed, %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("A change of state wasn't reported")
+	}
+	select {
+	case s := <-reports:
+		t.Errorf("Reported %+v without a change, before the interval", s)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
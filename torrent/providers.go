@@ -0,0 +1,251 @@
+package torrent
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Providers by name. The file system a torrent's stored with, and the cache
+// in front of it, can be chosen when it's added, by the names their
+// factories are registered under, so that torrents in one session can be
+// stored in different ways. A factory makes a provider from an options
+// string, which means whatever it likes to it. The ones built in are:
+//
+//	File systems  "os"         The OS's files. No options
+//	              "ram"        Files in RAM, gone when we quit. No options
+//	              "sftp"       An SFTP server. The options are a connection
+//	                           string, as ParseSftpConnection takes, with
+//	                           optional key, passphrase, knownHosts, agent
+//	                           and channels parameters, as in
+//	                           user@host/dir?key=/home/me/.ssh/id_ed25519
+//	Caches        "none"       No cache, even if the flags have one
+//	              "ram", "hd"  A cache in RAM, or in the temp directory, of
+//	                           the options' MiB
+//
+// Torrents that choose the same provider with the same options share one,
+// and so share a cache's capacity.
+
+// An FsProviderFactory makes a FsProvider from its options.
+type FsProviderFactory func(options string) (FsProvider, error)
+
+// A CacheProviderFactory makes a CacheProvider from its options.
+type CacheProviderFactory func(options string) (CacheProvider, error)
+
+var (
+	providersLock  sync.Mutex
+	fsFactories    = map[string]FsProviderFactory{"os": newOsFsProvider, "ram": newRamFsProvider, "sftp": newSftpFsProvider}
+	cacheFactories = map[string]CacheProviderFactory{"none": newNoCacheProvider, "ram": newRamCacheProvider, "hd": newHdCacheProvider}
+)
+
+// ErrUnknownProvider is what asking for a provider by a name nothing's
+// registered under returns.
+type ErrUnknownProvider struct {
+	Kind      string // "file system" or "cache"
+	Name      string
+	Available []string // The names there are, sorted
+}
+
+func (e *ErrUnknownProvider) Error() string {
+	return fmt.Sprintf("No %s provider %q. There's %s", e.Kind, e.Name, strings.Join(e.Available, ", "))
+}
+
+// RegisterFsProvider makes the file system providers factory makes
+// available as name. It panics if name's taken, as registering is meant for
+// init, where that's a mistake.
+func RegisterFsProvider(name string, factory FsProviderFactory) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if _, ok := fsFactories[name]; ok || name == "" || factory == nil {
+		panic("torrent: RegisterFsProvider of " + strconv.Quote(name) + " twice, or of nothing")
+	}
+	fsFactories[name] = factory
+}
+
+// RegisterCacheProvider makes the cache providers factory makes available
+// as name, like RegisterFsProvider.
+func RegisterCacheProvider(name string, factory CacheProviderFactory) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if _, ok := cacheFactories[name]; ok || name == "" || factory == nil {
+		panic("torrent: RegisterCacheProvider of " + strconv.Quote(name) + " twice, or of nothing")
+	}
+	cacheFactories[name] = factory
+}
+
+// NewFsProvider makes a provider of the file systems registered as name.
+func NewFsProvider(name, options string) (FsProvider, error) {
+	providersLock.Lock()
+	factory, ok := fsFactories[name]
+	var names []string
+	for n := range fsFactories {
+		names = append(names, n)
+	}
+	providersLock.Unlock()
+	if !ok {
+		sort.Strings(names)
+		return nil, &ErrUnknownProvider{"file system", name, names}
+	}
+	return factory(options)
+}
+
+// NewCacheProvider makes a provider of the caches registered as name.
+func NewCacheProvider(name, options string) (CacheProvider, error) {
+	providersLock.Lock()
+	factory, ok := cacheFactories[name]
+	var names []string
+	for n := range cacheFactories {
+		names = append(names, n)
+	}
+	providersLock.Unlock()
+	if !ok {
+		sort.Strings(names)
+		return nil, &ErrUnknownProvider{"cache", name, names}
+	}
+	return factory(options)
+}
+
+func noProviderOptions(name, options string) error {
+	if options != "" {
+		return fmt.Errorf("The %s provider takes no options", name)
+	}
+	return nil
+}
+
+func newOsFsProvider(options string) (FsProvider, error) {
+	return OsFsProvider{}, noProviderOptions("os", options)
+}
+
+func newRamFsProvider(options string) (FsProvider, error) {
+	return ramFsProvider{}, noProviderOptions("ram", options)
+}
+
+func newSftpFsProvider(options string) (FsProvider, error) {
+	connection, query, _ := strings.Cut(options, "?")
+	c, err := ParseSftpConnection(connection)
+	if err != nil {
+		return nil, err
+	}
+	c.UseAgent = true
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("SFTP options %q: %w", query, err)
+	}
+	for k := range params {
+		v := params.Get(k)
+		switch k {
+		case "key":
+			c.KeyFile = v
+		case "passphrase":
+			c.KeyPassphrase = v
+		case "knownHosts":
+			c.KnownHosts = v
+		case "agent":
+			c.UseAgent, err = strconv.ParseBool(v)
+		case "channels":
+			c.MaxChannels, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("No SFTP option %q", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &SftpFsProvider{c}, nil
+}
+
+// A CacheProvider whose caches are the stores they're given, so a torrent
+// can do without the flags' cache.
+type noCacheProvider struct{}
+
+func (noCacheProvider) NewCache(infohash string, numPieces int, pieceLength int64, totalSize int64, underlying FileStore) FileStore {
+	return underlying
+}
+
+func newNoCacheProvider(options string) (CacheProvider, error) {
+	return noCacheProvider{}, noProviderOptions("none", options)
+}
+
+// The cache's capacity, in MiB.
+func cacheCapacity(name, options string) (capacity int, err error) {
+	if capacity, err = strconv.Atoi(options); err != nil || capacity <= 0 {
+		return 0, fmt.Errorf("The %s cache's options are its size in MiB, not %q", name, options)
+	}
+	return
+}
+
+func newRamCacheProvider(options string) (CacheProvider, error) {
+	capacity, err := cacheCapacity("ram", options)
+	if err != nil {
+		return nil, err
+	}
+	return NewRamCacheProvider(capacity), nil
+}
+
+func newHdCacheProvider(options string) (CacheProvider, error) {
+	capacity, err := cacheCapacity("hd", options)
+	if err != nil {
+		return nil, err
+	}
+	return NewHdCacheProvider(capacity), nil
+}
+
+// StorageProviders chooses the providers of a torrent's file system and
+// cache by name, with their options. Empty names mean the TorrentFlags'
+// FileSystemProvider and Cacher.
+type StorageProviders struct {
+	FileSystem        string
+	FileSystemOptions string
+	Cache             string
+	CacheOptions      string
+}
+
+// The providers a torrent's stored with, and the names they were chosen by.
+type torrentStorage struct {
+	StorageProviders
+	fs     FsProvider
+	cacher CacheProvider
+}
+
+// The providers that s chooses, made the first time they're chosen. Those
+// it doesn't are nil, for the session to use the flags'.
+func (m *sessionManager) storage(s StorageProviders) (t torrentStorage, err error) {
+	m.providersLock.Lock()
+	defer m.providersLock.Unlock()
+	t.StorageProviders = s
+	if s.FileSystem != "" {
+		key := s.FileSystem + "?" + s.FileSystemOptions
+		if t.fs = m.fsProviders[key]; t.fs == nil {
+			if t.fs, err = NewFsProvider(s.FileSystem, s.FileSystemOptions); err != nil {
+				return
+			}
+			m.fsProviders[key] = t.fs
+		}
+	}
+	if s.Cache != "" {
+		key := s.Cache + "?" + s.CacheOptions
+		if t.cacher = m.cacheProviders[key]; t.cacher == nil {
+			if t.cacher, err = NewCacheProvider(s.Cache, s.CacheOptions); err != nil {
+				return
+			}
+			m.cacheProviders[key] = t.cacher
+		}
+	}
+	return
+}
+
+// Every cache provider the torrents use. Any goroutine can call this.
+func (m *sessionManager) cachers() (cachers []CacheProvider) {
+	if m.flags.Cacher != nil {
+		cachers = append(cachers, m.flags.Cacher)
+	}
+	m.providersLock.Lock()
+	defer m.providersLock.Unlock()
+	for _, c := range m.cacheProviders {
+		cachers = append(cachers, c)
+	}
+	return
+}
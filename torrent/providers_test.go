@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A file system provider registered for the tests, that counts the
+// providers it's made.
+var testFsProviders int32
+
+func init() {
+	RegisterFsProvider("testRam", func(options string) (FsProvider, error) {
+		atomic.AddInt32(&testFsProviders, 1)
+		return ramFsProvider{}, nil
+	})
+}
+
+func TestProviderRegistry(t *testing.T) {
+	if p, err := NewFsProvider("os", ""); err != nil || p != (OsFsProvider{}) {
+		t.Errorf("os: %v, %v", p, err)
+	}
+	if _, err := NewFsProvider("os", "x"); err == nil {
+		t.Error("os took options")
+	}
+	var unknown *ErrUnknownProvider
+	if _, err := NewFsProvider("nfs", ""); !errors.As(err, &unknown) ||
+		!reflect.DeepEqual(unknown.Available, []string{"os", "ram", "sftp", "testRam"}) {
+		t.Errorf("nfs: %v", err)
+	}
+	if _, err := NewCacheProvider("ssd", ""); !errors.As(err, &unknown) ||
+		!strings.Contains(err.Error(), "hd, none, ram") {
+		t.Errorf("ssd: %v", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Registered testRam twice")
+			}
+		}()
+		RegisterFsProvider("testRam", newRamFsProvider)
+	}()
+
+	if c, err := NewCacheProvider("ram", "64"); err != nil || c.(*RamCacheProvider).capacity != 64 {
+		t.Errorf("ram cache: %v, %v", c, err)
+	}
+	for _, bad := range []string{"", "-1", "lots"} {
+		if _, err := NewCacheProvider("hd", bad); err == nil {
+			t.Errorf("hd cache of %q", bad)
+		}
+	}
+	store := failingWrites{}
+	if c, err := NewCacheProvider("none", ""); err != nil || c.NewCache("ih", 1, 1, 1, store) != FileStore(store) {
+		t.Errorf("none: %v, %v", c, err)
+	}
+
+	p, err := NewFsProvider("sftp", "me@example.com:2222/dl?key=/k&passphrase=p&knownHosts=/kh&agent=false&channels=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SftpConfig{Host: "example.com", Port: 2222, User: "me", KeyFile: "/k", KeyPassphrase: "p",
+		KnownHosts: "/kh", BaseDir: "/dl", MaxChannels: 2}
+	if c := p.(*SftpFsProvider).Config; c != want {
+		t.Errorf("sftp: %+v", c)
+	}
+	for _, bad := range []string{"example.com/dl", "me@example.com/dl?port=1", "me@example.com/dl?agent=maybe"} {
+		if _, err = NewFsProvider("sftp", bad); err == nil {
+			t.Errorf("sftp of %q", bad)
+		}
+	}
+}
+
+// Torrents added over the API with different providers are stored with
+// theirs, sharing them when they choose the same, and the choice is saved
+// with the session. An unknown provider is turned away, with the names
+// there are.
+func TestAddWithProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "providers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var torrents [3][]byte
+	for i := range torrents {
+		content := make([]byte, 64*1024)
+		rand.New(rand.NewSource(int64(i))).Read(content)
+		file := filepath.Join(dir, "content"+string(rune('a'+i)))
+		if err = ioutil.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := CreateTorrent(file, &CreateOptions{PieceLength: 16 * 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data bytes.Buffer
+		if err = meta.Bencode(&data); err != nil {
+			t.Fatal(err)
+		}
+		torrents[i] = data.Bytes()
+	}
+
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		DataDir:            filepath.Join(dir, "data"),
+		SeedRatio:          math.Inf(0),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		TrackerlessMode:    true,
+		MaxActive:          3,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer m.Quit()
+	server := httptest.NewServer(newRPCHandler(m, "secret"))
+	defer server.Close()
+
+	var e rpcError
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents", rpcAddRequest{Data: torrents[0], StorageProviders: StorageProviders{Cache: "ssd"}}, &e); code != http.StatusBadRequest ||
+		!strings.Contains(e.Error, "hd, none, ram") {
+		t.Errorf("Adding with an unknown cache, %d %v", code, e)
+	}
+
+	inRAM := StorageProviders{FileSystem: "testRam", Cache: "ram", CacheOptions: "8"}
+	before := atomic.LoadInt32(&testFsProviders)
+	var added [3]rpcAddResponse
+	for i, storage := range []StorageProviders{{}, inRAM, inRAM} {
+		if code := rpcCall(t, server, "secret", "POST", "/api/torrents", rpcAddRequest{Data: torrents[i], StorageProviders: storage}, &added[i]); code != http.StatusAccepted {
+			t.Fatalf("Adding torrent %d, %d", i, code)
+		}
+	}
+
+	// The files on disk are checked as good; those in RAM aren't there.
+	for i, want := range []int{4, 0, 0} {
+		var s TorrentStatus
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			rpcCall(t, server, "secret", "GET", "/api/torrents/"+added[i].InfoHash, nil, &s)
+			if !s.Adding && !s.Checking && s.Pieces > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for torrent %d, %+v", i, s)
+			}
+		}
+		if s.GoodPieces != want {
+			t.Errorf("Torrent %d has %d good pieces", i, s.GoodPieces)
+		}
+	}
+	if made := atomic.LoadInt32(&testFsProviders) - before; made != 1 {
+		t.Errorf("%d testRam providers made", made)
+	}
+	if cachers := m.cachers(); len(cachers) != 1 {
+		t.Errorf("Cache providers %v", cachers)
+	}
+
+	var state *sessionState
+	m.run(func() { state = m.sessionState() })
+	saved := make(map[string]StorageProviders)
+	for _, st := range state.Torrents {
+		saved[st.InfoHash] = st.Storage
+	}
+	if saved[added[0].InfoHash] != (StorageProviders{}) || saved[added[2].InfoHash] != inRAM {
+		t.Errorf("Saved %+v", saved)
+	}
+}
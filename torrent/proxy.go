@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"context"
 	"golang.org/x/net/proxy"
 	"net"
 	"net/http"
@@ -13,8 +14,12 @@ func proxyNetDial(dialer proxy.Dialer, network, address string) (net.Conn, error
 	return net.Dial(network, address)
 }
 
-func proxyHttpGet(dialer proxy.Dialer, url string) (r *http.Response, e error) {
-	return proxyHttpClient(dialer).Get(url)
+func proxyHttpGet(ctx context.Context, dialer proxy.Dialer, url string) (r *http.Response, e error) {
+	req, e := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if e != nil {
+		return
+	}
+	return proxyHttpClient(dialer).Do(req)
 }
 
 func proxyHttpClient(dialer proxy.Dialer) (client *http.Client) {
@@ -25,3 +30,27 @@ func proxyHttpClient(dialer proxy.Dialer) (client *http.Client) {
 	client = &http.Client{Transport: tr}
 	return
 }
+
+// A dialer that also says what local address UDP sockets should have, since
+// UDP doesn't go through dialers, or proxies.
+type udpBinder interface {
+	localUDPAddr() (*net.UDPAddr, error)
+}
+
+// Dials with the Dialer, binding UDP sockets to b.
+type boundDialer struct {
+	proxy.Dialer
+	b *Binding
+}
+
+func (d boundDialer) localUDPAddr() (*net.UDPAddr, error) {
+	return d.b.localUDPAddr()
+}
+
+// The local address for a UDP socket: nil, for any, unless dialer's bound.
+func localUDPAddr(dialer proxy.Dialer) (*net.UDPAddr, error) {
+	if b, ok := dialer.(udpBinder); ok {
+		return b.localUDPAddr()
+	}
+	return nil, nil
+}
@@ -0,0 +1,227 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Queueing: with MaxActiveDownloads or MaxActiveSeeds set, only that many
+// downloads, or seeds, run at once. The rest are queued: paused, having told
+// the trackers they've stopped, until one that runs finishes or is paused.
+// The ones that run are the highest priority, and then the first added.
+// Force started torrents run regardless, and don't take a slot.
+
+// How often the manager looks for torrents that finished downloading or were
+// paused, freeing their slots.
+const QUEUE_CHECK = 2 * time.Second
+
+var errNotQueueing = errors.New("The torrent isn't in a queue")
+
+// Queued says whether the torrent is waiting its turn, rather than paused by
+// the user.
+func (ts *TorrentSession) Queued() bool {
+	return atomic.LoadInt32(&ts.queued) != 0
+}
+
+// Pauses the torrent until the queue gets to it. A paused torrent stays
+// paused.
+func (ts *TorrentSession) queue() error {
+	return ts.runInLoop(func() {
+		if ts.Paused() {
+			return
+		}
+		log.Println("[", ts.M.Info.Name, "] Queued")
+		ts.pause()
+		atomic.StoreInt32(&ts.queued, 1)
+	})
+}
+
+// Starts the torrent, if the queue had held it up.
+func (ts *TorrentSession) unqueue() error {
+	return ts.runInLoop(func() {
+		if atomic.CompareAndSwapInt32(&ts.queued, 1, 0) {
+			ts.resume()
+		}
+	})
+}
+
+// QueuePriority is the torrent's place among the others: higher ones start
+// first.
+func (ts *TorrentSession) QueuePriority() int {
+	return int(atomic.LoadInt32(&ts.queuePriority))
+}
+
+// SetQueuePriority changes the torrent's priority in the queue. The manager
+// acts on it when it next looks at the queue.
+func (ts *TorrentSession) SetQueuePriority(priority int) error {
+	ts.setQueueOrder(priority, ts.added())
+	return ts.runInLoop(ts.saveResumeData)
+}
+
+// Any goroutine can call this, so the manager can without waiting for the
+// loop. The caller saves the resume data.
+func (ts *TorrentSession) setQueueOrder(priority int, added time.Time) {
+	atomic.StoreInt32(&ts.queuePriority, int32(priority))
+	atomic.StoreInt64(&ts.addedAt, added.UnixNano())
+}
+
+// When the torrent was first added, which orders torrents of the same
+// priority.
+func (ts *TorrentSession) added() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&ts.addedAt))
+}
+
+// ForceStart says whether the torrent runs regardless of the queue.
+func (ts *TorrentSession) ForceStart() bool {
+	return atomic.LoadInt32(&ts.forceStart) != 0
+}
+
+func (ts *TorrentSession) setForceStart(on bool) error {
+	return ts.runInLoop(func() {
+		atomic.StoreInt32(&ts.forceStart, b2i(on))
+		ts.saveResumeData()
+	})
+}
+
+func b2i(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// The torrent's place in its queue, 1 being next to start, or 0 if it's not
+// queued.
+func (ts *TorrentSession) queuePosition() int {
+	return int(atomic.LoadInt32(&ts.queuePos))
+}
+
+// Whether the torrent counts as a seed for the queue.
+func (ts *TorrentSession) isComplete() bool {
+	return atomic.LoadInt32(&ts.complete) != 0
+}
+
+// Higher priority first, and then first added.
+func queueLess(a, b *TorrentSession) bool {
+	if pa, pb := a.QueuePriority(), b.QueuePriority(); pa != pb {
+		return pa > pb
+	}
+	if aa, ab := a.added(), b.added(); !aa.Equal(ab) {
+		return aa.Before(ab)
+	}
+	return a.M.InfoHash < b.M.InfoHash
+}
+
+// The queues: the downloads and the seeds that want to run, in the order they
+// get to. Paused and force started torrents aren't in them.
+func (m *sessionManager) queues() (downloads, seeds []*TorrentSession) {
+	for _, ts := range m.sessions {
+		if _, ok := m.removing[ts]; ok || ts.ForceStart() || (ts.Paused() && !ts.Queued()) {
+			continue
+		}
+		if ts.isComplete() {
+			seeds = append(seeds, ts)
+		} else {
+			downloads = append(downloads, ts)
+		}
+	}
+	sort.Slice(downloads, func(i, j int) bool { return queueLess(downloads[i], downloads[j]) })
+	sort.Slice(seeds, func(i, j int) bool { return queueLess(seeds[i], seeds[j]) })
+	return
+}
+
+// Starts the torrents that have the slots, and queues the rest.
+func (m *sessionManager) updateQueue() {
+	if m.quitting {
+		return
+	}
+	for _, ts := range m.sessions {
+		if ts.ForceStart() && ts.Queued() {
+			go ts.unqueue()
+		}
+		atomic.StoreInt32(&ts.queuePos, 0)
+	}
+	downloads, seeds := m.queues()
+	fillSlots(downloads, m.flags.MaxActiveDownloads)
+	fillSlots(seeds, m.flags.MaxActiveSeeds)
+}
+
+// Runs the first max of queue, or all of it if max is 0, and queues the rest.
+func fillSlots(queue []*TorrentSession, max int) {
+	for i, ts := range queue {
+		if max <= 0 || i < max {
+			if ts.Queued() {
+				go ts.unqueue()
+			}
+			continue
+		}
+		atomic.StoreInt32(&ts.queuePos, int32(i-max+1))
+		if !ts.Queued() {
+			go ts.queue()
+		}
+	}
+}
+
+// MoveInQueue swaps the torrent with the one before it in its queue, or with
+// up unset, after it.
+func (m *sessionManager) MoveInQueue(infoHash string, up bool) (err error) {
+	if e := m.run(func() { err = m.moveInQueue(infoHash, up) }); e != nil {
+		return e
+	}
+	return
+}
+
+func (m *sessionManager) moveInQueue(infoHash string, up bool) error {
+	ts := m.byHash[infoHash]
+	if ts == nil {
+		return fmt.Errorf("No torrent %x", infoHash)
+	}
+	downloads, seeds := m.queues()
+	queue := downloads
+	if ts.isComplete() {
+		queue = seeds
+	}
+	for i, t := range queue {
+		if t != ts {
+			continue
+		}
+		j := i + 1
+		if up {
+			j = i - 1
+		}
+		if j < 0 || j >= len(queue) {
+			// Already at that end.
+			return nil
+		}
+		// Trading places leaves the others where they are.
+		other := queue[j]
+		p, added := ts.QueuePriority(), ts.added()
+		ts.setQueueOrder(other.QueuePriority(), other.added())
+		other.setQueueOrder(p, added)
+		go ts.runInLoop(ts.saveResumeData)
+		go other.runInLoop(other.saveResumeData)
+		m.updateQueue()
+		return nil
+	}
+	return errNotQueueing
+}
+
+// SetForceStart has the torrent run whatever the queue says, or with on
+// unset, take its turn again.
+func (m *sessionManager) SetForceStart(infoHash string, on bool) (err error) {
+	var ts *TorrentSession
+	if e := m.run(func() { ts = m.byHash[infoHash] }); e != nil {
+		return e
+	}
+	if ts == nil {
+		return fmt.Errorf("No torrent %x", infoHash)
+	}
+	if err = ts.setForceStart(on); err != nil {
+		return
+	}
+	return m.run(m.updateQueue)
+}
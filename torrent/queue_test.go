@@ -0,0 +1,56 @@
+package torrent
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A session for the queue to order. Its loop has ended, so queueing and
+// unqueueing it do nothing, and positions are all the queue changes.
+func queueTestSession(m *sessionManager, ih string, priority int, added time.Time) *TorrentSession {
+	ts := &TorrentSession{M: &MetaInfo{InfoHash: ih, Info: InfoDict{Name: ih}}, ended: make(chan bool)}
+	close(ts.ended)
+	ts.setQueueOrder(priority, added)
+	m.sessions[ih] = ts
+	m.byHash[ih] = ts
+	return ts
+}
+
+func TestQueueOrder(t *testing.T) {
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActiveDownloads: 1, MaxActiveSeeds: 1}, 0)
+	start := time.Now()
+	first := queueTestSession(m, "a", 0, start)
+	second := queueTestSession(m, "b", 0, start.Add(time.Second))
+	urgent := queueTestSession(m, "c", 5, start.Add(2*time.Second))
+	forced := queueTestSession(m, "d", 0, start.Add(-time.Second))
+	atomic.StoreInt32(&forced.forceStart, 1)
+	paused := queueTestSession(m, "e", 0, start.Add(-time.Second))
+	atomic.StoreInt32(&paused.paused, 1)
+	seed := queueTestSession(m, "f", 0, start)
+	atomic.StoreInt32(&seed.complete, 1)
+
+	m.updateQueue()
+	want := map[*TorrentSession]int{urgent: 0, first: 1, second: 2, forced: 0, paused: 0, seed: 0}
+	for ts, pos := range want {
+		if ts.queuePosition() != pos {
+			t.Errorf("%s is at %d, not %d", ts.M.InfoHash, ts.queuePosition(), pos)
+		}
+	}
+
+	// Moving the last one up puts it ahead of the first, and leaves the
+	// urgent one be.
+	if err := m.moveInQueue("b", true); err != nil {
+		t.Fatal(err)
+	}
+	if urgent.queuePosition() != 0 || second.queuePosition() != 1 || first.queuePosition() != 2 {
+		t.Errorf("After moving up: %d %d %d", urgent.queuePosition(), second.queuePosition(), first.queuePosition())
+	}
+	if err := m.moveInQueue("c", true); err != nil {
+		t.Errorf("Moving the first up: %v", err)
+	}
+	if err := m.moveInQueue("d", false); err != errNotQueueing {
+		t.Errorf("Moving a forced torrent: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package torrent
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Rate history, for drawing graphs of throughput: each torrent's rates, and
+// all of them together, once a second for RATE_HISTORY_SECONDS and once a
+// minute, averaged, for RATE_HISTORY_MINUTES. A sample is two float32s, so a
+// history takes (RATE_HISTORY_SECONDS + RATE_HISTORY_MINUTES) * 8 bytes,
+// 16 KiB, whatever's going on. The torrents sample theirs on the heartbeat,
+// and the manager adds up theirs.
+
+const (
+	RATE_HISTORY_SECONDS = 600  // Ten minutes
+	RATE_HISTORY_MINUTES = 1440 // A day
+)
+
+// RateSample is the download and upload rates, in bytes per second, around
+// Time.
+type RateSample struct {
+	Time     time.Time
+	Download float64
+	Upload   float64
+}
+
+// RateHistory is the rates, oldest first: a sample for each of the last
+// seconds, and the average for each of the last minutes.
+type RateHistory struct {
+	Seconds []RateSample
+	Minutes []RateSample
+}
+
+type rates struct {
+	download, upload float32
+}
+
+// Samples spaced interval apart, the oldest overwritten when it's full. Only
+// the newest's time is kept, so gaps are filled with zeros.
+type rateRing struct {
+	interval time.Duration
+	samples  []rates
+	next     int // Where the next sample goes
+	n        int // How many there are
+	last     time.Time
+}
+
+func newRateRing(interval time.Duration, size int) rateRing {
+	return rateRing{interval: interval, samples: make([]rates, size)}
+}
+
+// Puts in the sample for at's interval, replacing any that's there.
+func (r *rateRing) put(at time.Time, s rates) {
+	at = at.Truncate(r.interval)
+	if r.n > 0 && !at.After(r.last) {
+		if at.Equal(r.last) {
+			r.samples[(r.next+len(r.samples)-1)%len(r.samples)] = s
+		}
+		return
+	}
+	if r.n > 0 {
+		// Nobody sampled the intervals in between.
+		gap := int(at.Sub(r.last)/r.interval) - 1
+		if gap > len(r.samples) {
+			gap = len(r.samples)
+		}
+		for i := 0; i < gap; i++ {
+			r.push(rates{})
+		}
+	}
+	r.push(s)
+	r.last = at
+}
+
+func (r *rateRing) push(s rates) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.n < len(r.samples) {
+		r.n++
+	}
+}
+
+// The samples, oldest first.
+func (r *rateRing) get() (samples []RateSample) {
+	samples = make([]RateSample, r.n)
+	start := r.next - r.n + len(r.samples)
+	for i := range samples {
+		s := r.samples[(start+i)%len(r.samples)]
+		samples[i] = RateSample{r.last.Add(-time.Duration(r.n-1-i) * r.interval), float64(s.download), float64(s.upload)}
+	}
+	return
+}
+
+type rateHistory struct {
+	seconds rateRing
+	minutes rateRing
+	// The current minute's samples, added up.
+	minute     time.Time
+	sum        [2]float64
+	sumSamples int
+}
+
+func newRateHistory() *rateHistory {
+	return &rateHistory{
+		seconds: newRateRing(time.Second, RATE_HISTORY_SECONDS),
+		minutes: newRateRing(time.Minute, RATE_HISTORY_MINUTES),
+	}
+}
+
+func (h *rateHistory) add(now time.Time, download, upload float64) {
+	h.seconds.put(now, rates{float32(download), float32(upload)})
+	if minute := now.Truncate(time.Minute); !minute.Equal(h.minute) {
+		if h.sumSamples > 0 {
+			n := float64(h.sumSamples)
+			h.minutes.put(h.minute, rates{float32(h.sum[0] / n), float32(h.sum[1] / n)})
+		}
+		h.minute, h.sum, h.sumSamples = minute, [2]float64{}, 0
+	}
+	h.sum[0] += download
+	h.sum[1] += upload
+	h.sumSamples++
+}
+
+// The minutes are only the finished ones.
+func (h *rateHistory) get() RateHistory {
+	return RateHistory{h.seconds.get(), h.minutes.get()}
+}
+
+// Keeps the torrent's history, and publishes its rates for the manager's.
+// Called on the heartbeat.
+func (ts *TorrentSession) recordRates(now time.Time) {
+	download, upload := ts.rates(now)
+	ts.rateHistory.add(now, download, upload)
+	atomic.StoreUint64(&ts.downloadRate, math.Float64bits(download))
+	atomic.StoreUint64(&ts.uploadRate, math.Float64bits(upload))
+}
+
+// The rates the torrent last recorded. Any goroutine can call this.
+func (ts *TorrentSession) recordedRates() (download, upload float64) {
+	return math.Float64frombits(atomic.LoadUint64(&ts.downloadRate)),
+		math.Float64frombits(atomic.LoadUint64(&ts.uploadRate))
+}
+
+// RateHistory is the torrent's recent rates.
+func (ts *TorrentSession) RateHistory() (h RateHistory, err error) {
+	err = ts.runInLoop(func() { h = ts.rateHistory.get() })
+	return
+}
+
+// Adds up the torrents' rates, in the manager's loop.
+func (m *sessionManager) recordRates(now time.Time) {
+	var download, upload float64
+	for _, ts := range m.sessions {
+		d, u := ts.recordedRates()
+		download += d
+		upload += u
+	}
+	m.rateHistory.add(now, download, upload)
+}
+
+// RateHistory is the recent rates of all the torrents together.
+func (m *sessionManager) RateHistory() (h RateHistory, err error) {
+	err = m.run(func() { h = m.rateHistory.get() })
+	return
+}
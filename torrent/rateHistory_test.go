@@ -0,0 +1,40 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateHistory(t *testing.T) {
+	h := newRateHistory()
+	start := time.Date(2020, 1, 1, 10, 0, 58, 0, time.UTC)
+	h.add(start, 100, 10)
+	h.add(start.Add(time.Second), 300, 30)
+	// Two seconds go by without a sample.
+	h.add(start.Add(4*time.Second), 50, 5)
+	got := h.get()
+	if len(got.Seconds) != 5 {
+		t.Fatalf("Seconds %+v", got.Seconds)
+	}
+	for i, want := range []float64{100, 300, 0, 0, 50} {
+		s := got.Seconds[i]
+		if s.Download != want || !s.Time.Equal(start.Add(time.Duration(i)*time.Second)) {
+			t.Errorf("Second %d: %+v, not %v", i, s, want)
+		}
+	}
+	// The first minute's over, and averaged.
+	if len(got.Minutes) != 1 || got.Minutes[0].Download != 200 || got.Minutes[0].Upload != 20 ||
+		!got.Minutes[0].Time.Equal(start.Truncate(time.Minute)) {
+		t.Errorf("Minutes %+v", got.Minutes)
+	}
+
+	// Full, the oldest go.
+	for i := 0; i < RATE_HISTORY_SECONDS+10; i++ {
+		h.add(start.Add(time.Duration(5+i)*time.Second), float64(i), 0)
+	}
+	got = h.get()
+	if len(got.Seconds) != RATE_HISTORY_SECONDS || got.Seconds[0].Download != 10 ||
+		got.Seconds[RATE_HISTORY_SECONDS-1].Download != RATE_HISTORY_SECONDS+9 {
+		t.Errorf("Kept %d seconds, from %+v to %+v", len(got.Seconds), got.Seconds[0], got.Seconds[len(got.Seconds)-1])
+	}
+}
@@ -0,0 +1,217 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether peers can connect to us, which is what "connectable" means to
+// trackers and swarms. We find out three ways:
+//
+//   - Any peer from a public address that connects counts, since it came in
+//     from outside.
+//   - We dial our own external address with a handshake for a made up
+//     torrent. If our listener gets it, the port's open. If it doesn't, the
+//     NAT may just not loop connections back, so we still don't know.
+//   - With PortCheckURL, a service outside tries for us.
+//
+// If none of those says it's open by the time torrents have run for
+// REACHABILITY_GRACE, it's probably closed.
+
+const (
+	REACHABILITY_UNKNOWN = "unknown"
+	REACHABILITY_OPEN    = "open"
+	REACHABILITY_CLOSED  = "closed"
+)
+
+const (
+	REACHABILITY_GRACE   = 30 * time.Minute
+	REACHABILITY_CHECK   = time.Minute      // How often the grace period is checked
+	REACHABILITY_TIMEOUT = 30 * time.Second // For the self-dial and the check service
+)
+
+var reachabilityGrace = REACHABILITY_GRACE // Shortened by tests
+
+// Looked after by the manager's loop.
+type reachability struct {
+	state   string
+	probe   string    // The info-hash our self-dial uses, while it's under way
+	waiting time.Time // Since when torrents have run with nobody connecting, or zero
+}
+
+func newReachability() *reachability {
+	return &reachability{state: REACHABILITY_UNKNOWN}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// Takes note of an incoming connection. Returns true if it's our self-dial,
+// which isn't for any torrent.
+func (m *sessionManager) sawIncoming(c *BtConn) (probe bool) {
+	r := m.reachability
+	if r.probe != "" && c.Infohash == r.probe {
+		r.probe = ""
+		m.setReachability(REACHABILITY_OPEN, "our own connection to our external address reached us")
+		return true
+	}
+	if a, ok := c.RemoteAddr.(*net.TCPAddr); ok && isPublicIP(a.IP) {
+		m.setReachability(REACHABILITY_OPEN, "a peer connected from "+a.String())
+	}
+	return false
+}
+
+func (m *sessionManager) setReachability(state, why string) {
+	r := m.reachability
+	if state == r.state {
+		return
+	}
+	r.state = state
+	log.Println("Our peer port", m.listenPort, "is", state+":", why)
+	if state == REACHABILITY_CLOSED {
+		if m.flags.UseUPnP || m.flags.UseNATPMP {
+			log.Println("Mapping the port didn't help, so try forwarding it on your router by hand")
+		} else {
+			log.Println("Try -useUPnP or -useNATPMP, or forward the port on your router")
+		}
+	}
+}
+
+// Called every REACHABILITY_CHECK. Nobody connecting doesn't tell us much
+// until torrents have run a while.
+func (m *sessionManager) checkReachabilityGrace(now time.Time) {
+	r := m.reachability
+	running := false
+	for _, ts := range m.sessions {
+		if !ts.Paused() {
+			running = true
+			break
+		}
+	}
+	switch {
+	case !running || r.state != REACHABILITY_UNKNOWN:
+		r.waiting = time.Time{}
+	case r.waiting.IsZero():
+		r.waiting = now
+	case now.Sub(r.waiting) >= reachabilityGrace:
+		m.setReachability(REACHABILITY_CLOSED, fmt.Sprint("no peer has connected from outside in ", reachabilityGrace))
+	}
+}
+
+// Reachability is "open", "closed" or "unknown".
+func (m *sessionManager) Reachability() (state string, err error) {
+	err = m.run(func() { state = m.reachability.state })
+	return
+}
+
+// Tests whether our listen port can be reached, once it's mapped, and again
+// whenever it changes.
+func (m *sessionManager) testReachability() {
+	var port int
+	var ip net.IP
+	if m.run(func() {
+		port = m.listenPort
+		if m.listener != nil {
+			ip = net.ParseIP(m.listener.status().ExternalIP)
+		}
+	}) != nil || port == 0 {
+		return
+	}
+	if ip == nil {
+		ip = m.externalAddr.IP()
+	}
+	if m.flags.PortCheckURL != "" {
+		open, err := m.askPortChecker(port)
+		if err != nil {
+			log.Println("Couldn't ask", m.flags.PortCheckURL, "whether our port is open:", err)
+		} else {
+			m.run(func() {
+				if m.listenPort != port {
+					return
+				}
+				if open {
+					m.setReachability(REACHABILITY_OPEN, "the port check service reached us")
+				} else {
+					m.setReachability(REACHABILITY_CLOSED, "the port check service couldn't reach us")
+				}
+			})
+			return
+		}
+	}
+	if isPublicIP(ip) {
+		m.dialOurselves(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+}
+
+// Asks the check service whether it can connect to port. It answers "open"
+// or "closed".
+func (m *sessionManager) askPortChecker(port int) (open bool, err error) {
+	// Not through a proxy, since it's our address the service should try.
+	var dialer proxy.Dialer
+	if m.flags.Bind != nil {
+		dialer = m.flags.Bind
+	}
+	client := proxyHttpClient(dialer)
+	client.Timeout = REACHABILITY_TIMEOUT
+	r, err := client.Get(strings.Replace(m.flags.PortCheckURL, "{port}", strconv.Itoa(port), -1))
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("It answered %s", r.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 1024))
+	if err != nil {
+		return
+	}
+	switch answer := strings.ToLower(strings.TrimSpace(string(body))); answer {
+	case REACHABILITY_OPEN, REACHABILITY_CLOSED:
+		return answer == REACHABILITY_OPEN, nil
+	default:
+		return false, fmt.Errorf("It answered %q, not open or closed", answer)
+	}
+}
+
+// Sends a handshake for a made up torrent to addr, our external address. If
+// it reaches our listener, sawIncoming says the port's open.
+func (m *sessionManager) dialOurselves(addr string) {
+	probe := make([]byte, 20)
+	if _, err := rand.Read(probe); err != nil {
+		return
+	}
+	if m.run(func() { m.reachability.probe = string(probe) }) != nil {
+		return
+	}
+	d := &net.Dialer{Timeout: REACHABILITY_TIMEOUT}
+	if m.flags.Bind != nil {
+		var err error
+		if d, err = m.flags.Bind.dialer("tcp"); err != nil {
+			return
+		}
+		d.Timeout = REACHABILITY_TIMEOUT
+	}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		packageLogger().Debug("Couldn't dial our external address", "addr", addr, "err", err)
+		return
+	}
+	defer conn.Close()
+	header := make([]byte, 68)
+	copy(header, kBitTorrentHeader[0:])
+	copy(header[28:48], probe)
+	copy(header[48:68], peerID())
+	conn.SetDeadline(time.Now().Add(REACHABILITY_TIMEOUT))
+	conn.Write(header)
+	// Our listener hangs up once the manager sees it's us.
+	conn.Read(make([]byte, 1))
+}
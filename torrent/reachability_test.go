@@ -0,0 +1,101 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDialOurselves(t *testing.T) {
+	flags := &TorrentFlags{MaxActive: 1, ListenAddresses: []string{"127.0.0.1:0"}}
+	conChan := make(chan *BtConn)
+	ls, err := startPeerListeners(flags, conChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newSessionManager(context.Background(), flags, ls[0].externalPort)
+	m.conChan = conChan
+	m.listener = ls[0]
+	m.stayUp = true
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+		m.listener.Close()
+	}()
+
+	// A peer from our own network doesn't show we can be reached.
+	m.run(func() {
+		m.sawIncoming(&BtConn{RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 6881}})
+	})
+	if state, err := m.Reachability(); err != nil || state != REACHABILITY_UNKNOWN {
+		t.Errorf("After a local peer, %q, %v", state, err)
+	}
+	m.dialOurselves(net.JoinHostPort("127.0.0.1", strconv.Itoa(ls[0].port)))
+	if state, err := m.Reachability(); err != nil || state != REACHABILITY_OPEN {
+		t.Errorf("After dialing ourselves, %q, %v", state, err)
+	}
+	if s, err := m.PortStatus(); err != nil || s.Reachable != REACHABILITY_OPEN {
+		t.Errorf("Port status %+v, %v", s, err)
+	}
+}
+
+func TestReachabilityGrace(t *testing.T) {
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1}, 6881)
+	now := time.Now()
+	// Nobody connecting means nothing while no torrent runs.
+	m.checkReachabilityGrace(now)
+	m.checkReachabilityGrace(now.Add(2 * reachabilityGrace))
+	if m.reachability.state != REACHABILITY_UNKNOWN {
+		t.Errorf("Without torrents, %q", m.reachability.state)
+	}
+	m.sessions["ih"] = &TorrentSession{}
+	m.checkReachabilityGrace(now)
+	m.checkReachabilityGrace(now.Add(reachabilityGrace - time.Second))
+	if m.reachability.state != REACHABILITY_UNKNOWN {
+		t.Errorf("Before the grace period, %q", m.reachability.state)
+	}
+	m.checkReachabilityGrace(now.Add(reachabilityGrace))
+	if m.reachability.state != REACHABILITY_CLOSED {
+		t.Errorf("After the grace period, %q", m.reachability.state)
+	}
+	m.sawIncoming(&BtConn{RemoteAddr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 6881}})
+	if m.reachability.state != REACHABILITY_OPEN {
+		t.Errorf("After a peer from outside, %q", m.reachability.state)
+	}
+}
+
+func TestAskPortChecker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("port") != "6881" {
+			http.Error(w, "no port", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, r.URL.Query().Get("answer"))
+	}))
+	defer server.Close()
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1}, 6881)
+	for _, test := range []struct {
+		answer string
+		open   bool
+		ok     bool
+	}{
+		{"open%0A", true, true},
+		{"Closed", false, true},
+		{"maybe", false, false},
+	} {
+		m.flags.PortCheckURL = server.URL + "/?port={port}&answer=" + test.answer
+		open, err := m.askPortChecker(6881)
+		if open != test.open || (err == nil) != test.ok {
+			t.Errorf("Answering %q, got %v, %v", test.answer, open, err)
+		}
+	}
+	if _, err := m.askPortChecker(1); err == nil {
+		t.Error("A failed request wasn't an error")
+	}
+}
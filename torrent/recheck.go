@@ -0,0 +1,291 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A check hashes a torrent's data, away from the main loop, while the
+// torrent's paused: when it starts, if it has to, and again on a recheck.
+// Pausing the torrent stops the check within a piece, leaving it unchecked;
+// resuming it goes on from where the check stopped. So does restarting it,
+// as the resume data keeps the pieces that had been checked.
+type recheck struct {
+	wasPaused bool // Whether to stay paused afterwards
+	stopped   bool // Paused part way, so not to go on until it's resumed
+	// Stops the run in progress, or nil if there's none.
+	cancel   context.CancelFunc
+	runStart time.Time
+	read     int64 // Bytes hashed in this run. Written by the checker, so use atomically.
+
+	// The pieces checked so far, over every run, and those that were good.
+	// The checker writes them, so hold mu.
+	mu      sync.Mutex
+	checked *Bitset
+	good    *Bitset
+}
+
+func newRecheck(pieces int) *recheck {
+	return &recheck{checked: NewBitset(pieces), good: NewBitset(pieces)}
+}
+
+// A FileStore that counts what's read from it.
+type countingStore struct {
+	FileStore
+	read *int64
+}
+
+func (c *countingStore) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = c.FileStore.ReadAt(p, off)
+	atomic.AddInt64(c.read, int64(n))
+	return
+}
+
+var errChecking = errors.New("Torrent is being rechecked")
+
+// ForceRecheck pauses the torrent, forgets which pieces it has, and hashes
+// all its data again. Once that's done the torrent goes on with the pieces
+// that checked out, paused only if it was before. It returns once the check
+// has started; Status says how far it's got.
+func (ts *TorrentSession) ForceRecheck() (err error) {
+	if e := ts.runInLoop(func() { err = ts.forceRecheck() }); e != nil {
+		return e
+	}
+	return
+}
+
+func (ts *TorrentSession) forceRecheck() error {
+	if !ts.Session.HaveTorrent {
+		return errors.New("Don't have the torrent's metadata yet")
+	}
+	if ts.recheck != nil {
+		return errChecking
+	}
+	r := newRecheck(ts.totalPieces)
+	r.wasPaused = ts.Paused()
+	ts.pause()
+	ts.recheck = r
+	ts.logger().Info("Rechecking")
+
+	for _, v := range ts.activePieces {
+		if !v.isComplete() {
+			// Complete ones are being hashed, and are released once they
+			// have been.
+			v.release()
+		}
+	}
+	ts.activePieces = make(map[int]*ActivePiece)
+	ts.unverified = nil
+	ts.forgetVerified()
+	ts.pieceSet = NewBitset(ts.totalPieces)
+	ts.countAvailability()
+	ts.goodPieces = 0
+	ts.Session.Left = ts.bytesLeft()
+	// If we quit before the check's saved where it's got to, the next start
+	// shouldn't trust what we had before.
+	os.Remove(resumeDataPath(ts.flags.DataDir, ts.M.InfoHash))
+	ts.startCheck(r)
+	return nil
+}
+
+// Does the check that load left there and then, in the loop, as reload
+// does: a torrent whose metadata has only just come holds little data, if
+// any, and pausing it would drop the peers it came from.
+func (ts *TorrentSession) checkNow() {
+	r := ts.recheck
+	if r == nil {
+		return
+	}
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(ts.ctx)
+	r.mu.Lock()
+	todo := NewBitsetFromBytes(ts.totalPieces, r.checked.Bytes())
+	r.mu.Unlock()
+	ts.runCheck(ctx, r, todo)
+	if ctx.Err() != nil {
+		// Quitting.
+		return
+	}
+	// It was never paused for the check, so it mustn't be resumed.
+	r.wasPaused = true
+	ts.checkStopped(r)
+}
+
+// Starts a run of the check, of the pieces it hasn't checked yet.
+func (ts *TorrentSession) startCheck(r *recheck) {
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(ts.ctx)
+	r.stopped = false
+	r.runStart = time.Now()
+	atomic.StoreInt64(&r.read, 0)
+	r.mu.Lock()
+	todo := NewBitsetFromBytes(ts.totalPieces, r.checked.Bytes())
+	r.mu.Unlock()
+	go func() {
+		ts.runCheck(ctx, r, todo)
+		ts.logger().Info("Checked", "seconds", time.Since(r.runStart).Seconds())
+		ts.runInLoop(func() { ts.checkStopped(r) })
+	}()
+}
+
+// Hashes the pieces that aren't in done, reading them in order and hashing
+// them on a few goroutines, until they're all checked or ctx is done. It
+// reads no more than a piece after that.
+func (ts *TorrentSession) runCheck(ctx context.Context, r *recheck, done *Bitset) {
+	store := &countingStore{ts.fileStore, &r.read}
+	// Long pieces are read by the hashers a segment at a time, taking turns
+	// at the store, rather than each read whole before the next. See
+	// largePieces.go.
+	segmented := ts.M.Info.PieceLength > SEGMENTED_PIECE_LENGTH
+	shared := &serialReader{r: store}
+	type job struct {
+		i int
+		r io.ReaderAt
+	}
+	jobs := make(chan job)
+	var hashers sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			buf := make([]byte, min(int(ts.M.Info.PieceLength), SEGMENTED_PIECE_LENGTH))
+			if segmented {
+				buf = buf[:PIECE_SEGMENT_LENGTH]
+			}
+			for j := range jobs {
+				h, ref := ts.M.pieceHasher(j.i)
+				good := bytes.Equal(pieceSumAt(j.r, int64(j.i)*ts.M.Info.PieceLength, ts.pieceLength(j.i), buf, h), ref)
+				if ctx.Err() != nil {
+					// The read may have failed for the files being closed,
+					// so the piece can't be taken as bad.
+					continue
+				}
+				r.mu.Lock()
+				r.checked.Set(j.i)
+				if good {
+					r.good.Set(j.i)
+				}
+				r.mu.Unlock()
+			}
+		}()
+	}
+	for i := done.FindNextClear(0); i >= 0 && ctx.Err() == nil; i = done.FindNextClear(i + 1) {
+		j := job{i, shared}
+		var read chan bool
+		if !segmented {
+			read = make(chan bool)
+			j.r = &pieceRead{store, ts.pieceLength(i), read}
+		}
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+			continue
+		}
+		if read != nil {
+			<-read
+		}
+	}
+	close(jobs)
+	hashers.Wait()
+}
+
+// Reads a piece for a hasher, saying when it's been read, so that the next
+// is read only then.
+type pieceRead struct {
+	io.ReaderAt
+	left int
+	read chan bool // Closed once it's all been read, or a read failed
+}
+
+func (p *pieceRead) ReadAt(b []byte, off int64) (n int, err error) {
+	n, err = p.ReaderAt.ReadAt(b, off)
+	if p.left -= len(b); p.left <= 0 || err != nil {
+		close(p.read)
+	}
+	return
+}
+
+// Takes on what a run of the check found, whether it's done or was stopped.
+func (ts *TorrentSession) checkStopped(r *recheck) {
+	r.cancel()
+	r.cancel = nil
+	r.mu.Lock()
+	ts.pieceSet = NewBitsetFromBytes(ts.totalPieces, r.good.Bytes())
+	finished := r.checked.Count() == ts.totalPieces
+	r.mu.Unlock()
+	ts.goodPieces = ts.pieceSet.Count()
+	ts.countAvailability()
+	ts.Session.Left = ts.bytesLeft()
+	ts.emitCheckProgress()
+	if !finished {
+		if !r.stopped {
+			// Resumed before the run knew it had been stopped.
+			ts.startCheck(r)
+			return
+		}
+		ts.logger().Info("Check stopped", "checked", ts.checkedPieces(), "of", ts.totalPieces)
+		ts.saveResumeData()
+		return
+	}
+	ts.recheck = nil
+	ts.wakeReaders()
+	ts.logger().Info("Check done", "good", ts.goodPieces, "bad", ts.totalPieces-ts.goodPieces, "left", ts.Session.Left)
+	ts.saveResumeData()
+	ts.saveVerified()
+	if !r.wasPaused {
+		ts.resume()
+	}
+}
+
+// Stops the check's run in progress, if there is one, for the torrent's
+// been paused.
+func (r *recheck) stop() {
+	r.wasPaused = true
+	if r.cancel != nil {
+		r.stopped = true
+		r.cancel()
+	}
+}
+
+func (ts *TorrentSession) checking() bool {
+	return ts.recheck != nil && ts.recheck.cancel != nil
+}
+
+// How many pieces the check has checked, over every run.
+func (ts *TorrentSession) checkedPieces() int {
+	if ts.recheck == nil {
+		return 0
+	}
+	ts.recheck.mu.Lock()
+	defer ts.recheck.mu.Unlock()
+	return ts.recheck.checked.Count()
+}
+
+// How fast the check's run in progress is reading the data, in bytes per
+// second, and how long the rest of the check should take at that speed, or
+// -1 if there's no telling.
+func (ts *TorrentSession) checkRate(checked int) (rate float64, eta time.Duration) {
+	eta = -1
+	if !ts.checking() {
+		return
+	}
+	if elapsed := time.Since(ts.recheck.runStart).Seconds(); elapsed > 0 {
+		rate = float64(atomic.LoadInt64(&ts.recheck.read)) / elapsed
+	}
+	if rate > 0 {
+		left := float64(ts.totalPieces-checked) * float64(ts.M.Info.PieceLength)
+		eta = time.Duration(left / rate * float64(time.Second))
+	}
+	return
+}
+
+func (ts *TorrentSession) emitCheckProgress() {
+	ts.emit(Event{Type: EVENT_CHECK_PROGRESS, Piece: ts.checkedPieces()})
+}
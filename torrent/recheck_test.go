@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestForceRecheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeWebSeedFiles(t, filepath.Join(dir, "files"), 40000, 30000)
+	m, err := CreateTorrent(filepath.Join(dir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := &TorrentFlags{
+		FileDir:            dir,
+		DataDir:            dir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		QuickResume:        true,
+		TrackerlessMode:    true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          math.Inf(0),
+	}
+	ts, done := startTestSession(t, flags, torrentFile, &fakeDHTSwarm{peers: make(map[string][]string)})
+	defer func() {
+		ts.Quit()
+		<-done
+	}()
+	s := waitForCheck(t, ts)
+	if s.GoodPieces != s.Pieces {
+		t.Fatalf("Have %d of %d pieces to start with", s.GoodPieces, s.Pieces)
+	}
+
+	// Spoil the first piece behind the session's back.
+	if err = ioutil.WriteFile(filepath.Join(dir, "files", "a"), make([]byte, 40000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.ForceRecheck(); err != nil {
+		t.Fatal(err)
+	}
+	s = waitForCheck(t, ts)
+	// Pieces 0 and 1 lie within the zeroed file, and piece 2 straddles it.
+	if s.GoodPieces != s.Pieces-3 {
+		t.Errorf("After the recheck, have %d of %d pieces", s.GoodPieces, s.Pieces)
+	}
+	if s.Left != 3*16384 {
+		t.Errorf("%d bytes left", s.Left)
+	}
+	if s.Paused {
+		t.Error("Still paused after the recheck")
+	}
+
+	// A paused torrent stays paused.
+	if err = ts.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.ForceRecheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.ForceRecheck(); err != errChecking {
+		t.Errorf("Rechecking twice at once: %v", err)
+	}
+	s = waitForCheck(t, ts)
+	if !s.Paused || s.GoodPieces != s.Pieces-3 {
+		t.Errorf("After rechecking while paused, %+v", s)
+	}
+}
+
+// Waits for the session's check, if it's checking, to be done or stopped,
+// and returns its status then.
+func waitForCheck(t testing.TB, ts *TorrentSession) (s TorrentStatus) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		s, err := ts.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.Checking {
+			return s
+		}
+		if s.CheckedPart < 0 || s.CheckedPart > 1 {
+			t.Errorf("Checked %v of it", s.CheckedPart)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the check")
+		}
+	}
+}
+
+// A FileStore whose reads from an offset on wait until open is closed.
+type gatedStore struct {
+	FileStore
+	from    int64
+	reached chan bool
+	open    chan bool
+}
+
+func (g *gatedStore) ReadAt(p []byte, off int64) (int, error) {
+	if off >= g.from {
+		select {
+		case g.reached <- true:
+		default:
+		}
+		<-g.open
+	}
+	return g.FileStore.ReadAt(p, off)
+}
+
+// Pausing the check that starts a torrent stops it within a piece, and
+// resuming goes on with it. What it had checked survives a restart.
+func TestPauseCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pausecheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, flags, _ := writeResumeTorrent(t, dir, 40000, 30000)
+	flags.TrackerlessMode = true
+	flags.SeedRatio = math.Inf(0)
+	torrentFile := filepath.Join(dir, "files.torrent")
+	ts, err := NewTorrentSession(flags, torrentFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := &gatedStore{ts.fileStore, 2 * m.Info.PieceLength, make(chan bool, 1), make(chan bool)}
+	ts.fileStore = gate
+	events := ts.Subscribe(100)
+	done := make(chan bool)
+	go func() {
+		ts.DoTorrent()
+		close(done)
+	}()
+	defer func() {
+		ts.Quit()
+		<-done
+	}()
+
+	<-gate.reached
+	if err = ts.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	close(gate.open)
+	s := waitForCheck(t, ts)
+	// The piece being read when it was paused may or may not have been
+	// hashed.
+	if !s.Unchecked || !s.Paused || s.CheckedPieces < 2 || s.CheckedPieces > 3 || s.GoodPieces != s.CheckedPieces {
+		t.Fatalf("After pausing the check, %+v", s)
+	}
+	checked := s.CheckedPieces
+	saved := loadResumeData(flags.DataDir, m.InfoHash)
+	if saved == nil || NewBitsetFromBytes(5, saved.Checked).Count() != checked {
+		t.Fatalf("Saved %+v", saved)
+	}
+	var progress []int
+	for len(events.C) > 0 {
+		if e := <-events.C; e.Type == EVENT_CHECK_PROGRESS {
+			progress = append(progress, e.Piece)
+		}
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != checked {
+		t.Errorf("Progress events %v", progress)
+	}
+
+	if err = ts.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	s = waitForCheck(t, ts)
+	for deadline := time.Now().Add(10 * time.Second); s.Paused; time.Sleep(20 * time.Millisecond) {
+		if s, err = ts.Status(); err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for it to resume")
+		}
+	}
+	if s.Unchecked || s.GoodPieces != 5 || s.Left != 0 {
+		t.Errorf("After resuming the check, %+v", s)
+	}
+
+	// A restart goes on from what was saved, reading only the rest.
+	if err = saved.save(); err != nil {
+		t.Fatal(err)
+	}
+	ts2, err := NewTorrentSession(flags, torrentFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts2.fileStore.Close()
+	r := ts2.recheck
+	if r == nil || r.checked.Count() != checked || ts2.goodPieces != checked {
+		t.Fatalf("Restarted with %d good pieces, and check %+v", ts2.goodPieces, r)
+	}
+	unchecked := int64(0)
+	for i := 0; i < 5; i++ {
+		if !r.checked.IsSet(i) {
+			unchecked += int64(ts2.pieceLength(i))
+		}
+	}
+	ts2.checkNow()
+	if ts2.recheck != nil || ts2.goodPieces != 5 || r.read != unchecked {
+		t.Errorf("After the restarted check, %d good pieces, read %d bytes of %d", ts2.goodPieces, r.read, unchecked)
+	}
+}
@@ -0,0 +1,266 @@
+package torrent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Reloading: the settings a long running client can change without
+// restarting are read from the ConfigFile at startup, over the flags, and
+// again on SIGHUP, where there is one, or a reload through the API. It's a JSON object of any of
+//
+//	{
+//		"MaxDownloadRate": 1048576,
+//		"MaxUploadRate": 262144,
+//		"AltDownloadRate": 0,
+//		"AltUploadRate": 65536,
+//		"AltSpeedSchedule": "Mon-Fri 09:00-18:00",
+//		"Blocklist": "/etc/taipei/blocklist.p2p",
+//		"DisconnectBlocked": true,
+//		"WatchDir": "/srv/torrents/watch",
+//		"WatchDirDelete": false
+//	}
+//
+// Settings left out stay as they are. The blocklist is read again on every
+// reload, whether or not it's changed. Other TorrentFlags, like the listen
+// addresses or the data directory, can't change while we run, so they're
+// refused rather than ignored. Each setting's result is reported, and one
+// that's refused or can't be read leaves the others be.
+
+// ReloadResult says how reloading one setting went.
+type ReloadResult struct {
+	Setting string
+	Error   string // Why it's as it was, or "" if it's taken
+}
+
+var errRestartToChange = errors.New("Can't be changed while running: restart to change it")
+
+// The reloadable settings, as they are, and then as the config file has
+// them.
+type reloadConfig struct {
+	limits         SpeedLimits
+	schedule       SpeedSchedule
+	scheduleSet    bool
+	blocklist      string // The file
+	disconnect     bool   // Disconnect peers the blocklist comes to block
+	watchDir       string
+	watchDirDelete bool
+}
+
+func (m *sessionManager) reloadConfig() reloadConfig {
+	return reloadConfig{
+		limits:         m.bandwidth.Limits(),
+		blocklist:      m.blocklistFile,
+		disconnect:     m.disconnectBlocked,
+		watchDir:       m.watchDir,
+		watchDirDelete: m.watchDirDelete,
+	}
+}
+
+func (c *reloadConfig) set(key string, v json.RawMessage) (err error) {
+	switch key {
+	case "MaxDownloadRate":
+		return decodeRate(v, &c.limits.Download)
+	case "MaxUploadRate":
+		return decodeRate(v, &c.limits.Upload)
+	case "AltDownloadRate":
+		return decodeRate(v, &c.limits.AltDownload)
+	case "AltUploadRate":
+		return decodeRate(v, &c.limits.AltUpload)
+	case "AltSpeedSchedule":
+		var s string
+		if err = json.Unmarshal(v, &s); err != nil {
+			return
+		}
+		if c.schedule, err = ParseSpeedSchedule(s); err == nil {
+			c.scheduleSet = true
+		}
+		return
+	case "Blocklist":
+		return json.Unmarshal(v, &c.blocklist)
+	case "DisconnectBlocked":
+		return json.Unmarshal(v, &c.disconnect)
+	case "WatchDir":
+		var dir string
+		if err = json.Unmarshal(v, &dir); err != nil {
+			return
+		}
+		if dir != "" {
+			if fi, e := os.Stat(dir); e != nil {
+				return e
+			} else if !fi.IsDir() {
+				return fmt.Errorf("%s isn't a directory", dir)
+			}
+		}
+		c.watchDir = dir
+		return
+	case "WatchDirDelete":
+		return json.Unmarshal(v, &c.watchDirDelete)
+	}
+	if _, ok := reflect.TypeOf(TorrentFlags{}).FieldByName(key); ok {
+		return errRestartToChange
+	}
+	return errors.New("Unknown setting")
+}
+
+func decodeRate(v json.RawMessage, rate *int64) (err error) {
+	var r int64
+	if err = json.Unmarshal(v, &r); err != nil {
+		return
+	}
+	if r < 0 {
+		return errors.New("Rate limits can't be negative")
+	}
+	*rate = r
+	return
+}
+
+// Reload re-reads the ConfigFile, and the blocklist, and puts what they say
+// in force. err is set if the config file couldn't be read at all.
+func (m *sessionManager) Reload() (results []ReloadResult, err error) {
+	return m.reload(m.run)
+}
+
+// Reloads, doing what needs doing in the manager's loop with run. Before the
+// loop starts, that's just calling it.
+func (m *sessionManager) reload(run func(func()) error) (results []ReloadResult, err error) {
+	settings := make(map[string]json.RawMessage)
+	if m.flags.ConfigFile != "" {
+		data, e := ioutil.ReadFile(m.flags.ConfigFile)
+		if e == nil {
+			e = json.Unmarshal(data, &settings)
+		}
+		if e != nil {
+			return nil, fmt.Errorf("Couldn't read the config file %s: %v", m.flags.ConfigFile, e)
+		}
+	}
+	var c reloadConfig
+	if err = run(func() { c = m.reloadConfig() }); err != nil {
+		return
+	}
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	blocklistResult := -1
+	for _, k := range keys {
+		r := ReloadResult{Setting: k}
+		if e := c.set(k, settings[k]); e != nil {
+			r.Error = e.Error()
+		}
+		if k == "Blocklist" {
+			blocklistResult = len(results)
+		}
+		results = append(results, r)
+	}
+
+	// Read outside the loop, since the file can be big.
+	var ranges ipRanges
+	var blocklistErr error
+	if c.blocklist != "" {
+		var bad int
+		var firstBad error
+		if ranges, bad, firstBad, blocklistErr = loadBlocklist(c.blocklist); blocklistErr == nil {
+			log.Println("Blocking", len(ranges), "address ranges from", c.blocklist)
+			if bad > 0 {
+				log.Println("Skipped", bad, "lines of the blocklist that we couldn't read.", firstBad)
+			}
+		}
+	}
+	if c.blocklist != "" || blocklistResult >= 0 {
+		if blocklistResult < 0 {
+			blocklistResult = len(results)
+			results = append(results, ReloadResult{Setting: "Blocklist"})
+		}
+		if blocklistErr != nil {
+			results[blocklistResult].Error = blocklistErr.Error()
+		}
+	}
+
+	m.bandwidth.SetLimits(c.limits)
+	if c.scheduleSet {
+		m.bandwidth.setSchedule(c.schedule)
+	}
+	err = run(func() {
+		if blocklistErr == nil {
+			m.blocklistFile = c.blocklist
+			m.blocklist.set(ranges)
+			m.disconnectBlocked = c.disconnect
+			if c.disconnect {
+				for _, ts := range m.sessions {
+					go ts.dropBlocked()
+				}
+			}
+		}
+		if c.scheduleSet && len(c.schedule) > 0 && m.altSpeedChan == nil {
+			m.altSpeedChan = time.Tick(time.Minute)
+		}
+		m.watch(c.watchDir, c.watchDirDelete)
+	})
+	return
+}
+
+// Reads the config file and the blocklist at startup, before the loop
+// runs. Unlike a reload, anything that can't be used is an error.
+func (m *sessionManager) loadConfig() (err error) {
+	results, err := m.reload(func(f func()) error {
+		f()
+		return nil
+	})
+	for _, r := range results {
+		if err == nil && r.Error != "" {
+			err = fmt.Errorf("Couldn't use %s from the config: %s", r.Setting, r.Error)
+		}
+	}
+	return
+}
+
+// Reloads on each signal, logging how it went, until the loop ends.
+func (m *sessionManager) reloadOn(c chan os.Signal) {
+	for {
+		select {
+		case <-c:
+		case <-m.ended:
+			return
+		}
+		log.Println("Reloading the configuration")
+		results, err := m.Reload()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, r := range results {
+			if r.Error != "" {
+				log.Println("Couldn't reload", r.Setting+":", r.Error)
+			} else {
+				log.Println("Reloaded", r.Setting)
+			}
+		}
+	}
+}
+
+// Watches dir for torrents, in place of the directory we watched, if it's
+// changed. An empty dir stops watching.
+func (m *sessionManager) watch(dir string, deleteAdded bool) {
+	if dir == m.watchDir && deleteAdded == m.watchDirDelete && (m.watchStop != nil) == (dir != "") {
+		return
+	}
+	if m.watchStop != nil {
+		close(m.watchStop)
+		m.watchStop = nil
+	}
+	m.watchDir, m.watchDirDelete = dir, deleteAdded
+	if dir != "" {
+		m.stayUp = true
+		m.watchStop = make(chan bool)
+		go newDirWatcher(dir, deleteAdded, m).run(m.watchStop)
+	}
+}
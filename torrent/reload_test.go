@@ -0,0 +1,104 @@
+package torrent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config.json")
+	blocklistFile := filepath.Join(dir, "blocklist")
+	watchDir := filepath.Join(dir, "watch")
+	if err = os.Mkdir(watchDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, s string) {
+		if err := ioutil.WriteFile(name, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(blocklistFile, "203.0.113.0/24\n")
+	write(config, `{
+		"MaxDownloadRate": 1000,
+		"AltUploadRate": 50,
+		"AltSpeedSchedule": "Mon-Sun 00:00-24:00",
+		"Blocklist": "`+blocklistFile+`",
+		"WatchDir": "`+watchDir+`"
+	}`)
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1, MaxUploadRate: 200, ConfigFile: config}, 0)
+	if err = m.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+		m.watch("", false)
+	}()
+	if l := m.SpeedLimits(); l.Download != 1000 || l.Upload != 200 || l.AltUpload != 50 || !l.AltSpeed {
+		t.Errorf("Limits %+v", l)
+	}
+	if !m.blocklist.blockedAddr("203.0.113.5:6881") {
+		t.Error("The blocklist isn't in force")
+	}
+	var watching string
+	m.run(func() { watching = m.watchDir })
+	if watching != watchDir {
+		t.Errorf("Watching %q", watching)
+	}
+
+	// What can't be changed is refused, without holding up the rest.
+	write(blocklistFile, "198.51.100.0/24\n")
+	write(config, `{
+		"MaxDownloadRate": -5,
+		"MaxUploadRate": 300,
+		"Blocklist": "`+blocklistFile+`",
+		"WatchDir": "`+filepath.Join(dir, "missing")+`",
+		"ListenAddresses": ["127.0.0.1"],
+		"Color": "blue"
+	}`)
+	results, err := m.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := make(map[string]bool)
+	for _, r := range results {
+		failed[r.Setting] = r.Error != ""
+	}
+	want := map[string]bool{"Blocklist": false, "Color": true, "ListenAddresses": true, "MaxDownloadRate": true, "MaxUploadRate": false, "WatchDir": true}
+	if len(failed) != len(want) {
+		t.Errorf("Results %+v", results)
+	}
+	for setting, f := range want {
+		if failed[setting] != f {
+			t.Errorf("%s failed: %v, %+v", setting, failed[setting], results)
+		}
+	}
+	if l := m.SpeedLimits(); l.Download != 1000 || l.Upload != 300 {
+		t.Errorf("After reloading, limits %+v", l)
+	}
+	if m.blocklist.blockedAddr("203.0.113.5:6881") || !m.blocklist.blockedAddr("198.51.100.5:6881") {
+		t.Error("The blocklist wasn't reloaded")
+	}
+	m.run(func() { watching = m.watchDir })
+	if watching != watchDir {
+		t.Errorf("After failing to change it, watching %q", watching)
+	}
+
+	write(config, "{")
+	if _, err = m.Reload(); err == nil {
+		t.Error("Reloaded a broken config file")
+	}
+	// At startup, what can't be used is an error.
+	if err = newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1, Blocklist: filepath.Join(dir, "missing")}, 0).loadConfig(); err == nil {
+		t.Error("Started with a missing blocklist")
+	}
+}
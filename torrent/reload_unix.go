@@ -0,0 +1,14 @@
+//go:build !windows
+
+package torrent
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGHUP reloads, as daemons expect.
+func notifyReload(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
@@ -0,0 +1,8 @@
+package torrent
+
+import (
+	"os"
+)
+
+// There's no SIGHUP, so reloading is only through the API.
+func notifyReload(c chan os.Signal) {}
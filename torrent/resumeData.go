@@ -0,0 +1,282 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Fast resume: what we knew about a torrent when we last saved, so that
+// restarting it doesn't mean hashing all its data again.
+
+// Bumped whenever resumeData changes in a way older versions can't read.
+const RESUME_VERSION = 1
+
+// How often resume data is saved while a torrent runs, besides when it
+// stops.
+const RESUME_SAVE_INTERVAL = 5 * time.Minute
+
+type resumeData struct {
+	path    string
+	Version int
+	Pieces  []byte // The bitfield of pieces we verified
+	// The pieces checked so far by a check that was stopped part way, which
+	// goes on with the rest. Pieces then has the ones that were good.
+	Checked    []byte `json:",omitempty"`
+	Files      []resumeFile
+	Uploaded   uint64
+	Downloaded uint64
+	TrackerKey uint32
+	// Seeding time and limits carry over, so restarting doesn't reset them.
+	SeedingTime time.Duration
+	SeedLimits  *SeedLimits // The torrent's own, if it has them
+	BlockSize   int         `json:",omitempty"` // The torrent's own, if it has one
+	// Its place in the queue.
+	QueuePriority int
+	Added         time.Time
+	ForceStart    bool
+	// Where its files went, if not under the -fileDir.
+	FileDir string
+	// Whether the completion hook has run, so it only runs once.
+	CompleteHookRan bool
+	// When it last finished downloading, if we saw it.
+	CompletedAt time.Time
+}
+
+// The size and modification time of one of the torrent's files, in the
+// order of the info dictionary.
+type resumeFile struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// A FileSystem that can say how big its files are and when they last
+// changed, which resume data needs to know whether it can be trusted.
+type fileStater interface {
+	Stat(name []string) (os.FileInfo, error)
+}
+
+var errNoStat = errors.New("Can't stat files on this file system")
+
+func resumeDataPath(dataDir, infoHash string) string {
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return filepath.Join(dataDir, hex.EncodeToString([]byte(infoHash))+"-resume.json")
+}
+
+// Returns nil if there's no usable resume data for the torrent.
+func loadResumeData(dataDir, infoHash string) (r *resumeData) {
+	r = &resumeData{path: resumeDataPath(dataDir, infoHash)}
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Ignoring resume data:", err)
+		}
+		return nil
+	}
+	if err = json.Unmarshal(data, r); err != nil {
+		log.Println("Ignoring corrupt resume data", r.path, err)
+		return nil
+	}
+	if r.Version != RESUME_VERSION {
+		log.Println("Ignoring resume data", r.path, "from version", r.Version)
+		return nil
+	}
+	return
+}
+
+func (r *resumeData) save() (err error) {
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(r.path, ".resume", data)
+}
+
+// The sizes and modification times of the torrent's files. Padding files,
+// and files that aren't there, have neither.
+func statFiles(info *InfoDict, fs FileSystem) (files []resumeFile, err error) {
+	stater, ok := fs.(fileStater)
+	if !ok {
+		return nil, errNoStat
+	}
+	if len(info.Files) == 0 {
+		info = &InfoDict{Files: []FileDict{{Length: info.Length, Path: []string{info.Name}}}}
+	}
+	files = make([]resumeFile, len(info.Files))
+	for i, f := range info.Files {
+		if f.Attr == "p" {
+			continue
+		}
+		var fi os.FileInfo
+		if fi, err = stater.Stat(f.Path); os.IsNotExist(err) {
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		files[i] = resumeFile{fi.Size(), fi.ModTime()}
+	}
+	return
+}
+
+// Which of the torrent's files are as they were when the resume data was
+// saved. Returns nil if none of them can be trusted.
+func (r *resumeData) unchangedFiles(info *InfoDict, fs FileSystem) (unchanged []bool) {
+	if r == nil {
+		return nil
+	}
+	current, err := statFiles(info, fs)
+	if err != nil {
+		return nil
+	}
+	if len(r.Files) != len(current) {
+		log.Println("Ignoring resume data", r.path, "for", len(r.Files), "files, not", len(current))
+		return nil
+	}
+	unchanged = make([]bool, len(current))
+	for i, f := range current {
+		unchanged[i] = f.Size == r.Files[i].Size && f.ModTime.Equal(r.Files[i].ModTime)
+	}
+	return
+}
+
+// Takes the pieces the resume data says we have, as long as they lie
+// wholly in files that haven't changed, and hashes the rest. A piece that
+// spans a changed file and an unchanged one is hashed too. If the resume
+// data was saved part way through a check, that goes on instead, with the
+// pieces it hadn't checked and the ones in changed files; those are left to
+// the check rather than hashed here. Returns false if the resume data
+// doesn't fit the torrent.
+func (ts *TorrentSession) resumePieces(unchanged []bool) (pieces *Bitset, good int, check *recheck, ok bool) {
+	saved := NewBitsetFromBytes(ts.totalPieces, ts.resumeState.Pieces)
+	var checked *Bitset
+	if ts.resumeState.Checked != nil {
+		if checked = NewBitsetFromBytes(ts.totalPieces, ts.resumeState.Checked); checked == nil {
+			saved = nil
+		}
+	}
+	store, isFileStore := ts.fileStore.(*fileStore)
+	if saved == nil || !isFileStore || len(store.files) != len(unchanged) {
+		log.Println("[", ts.M.Info.Name, "] Ignoring resume data that doesn't fit the torrent")
+		return
+	}
+	ok = true
+	for i, same := range unchanged {
+		if !same && store.files[i].length > 0 {
+			log.Println("[", ts.M.Info.Name, "] File", i, "changed since the resume data was saved")
+		}
+	}
+	if checked != nil {
+		check = newRecheck(ts.totalPieces)
+		check.stopped = true
+	}
+	pieces = NewBitset(ts.totalPieces)
+	hashed := 0
+	for i := 0; i < ts.totalPieces; i++ {
+		start, length := int64(i)*ts.M.Info.PieceLength, int64(ts.pieceLength(i))
+		trusted := true
+		first, last := store.filesFor(start, length)
+		for f := first; f <= last; f++ {
+			if store.files[f].length > 0 && !unchanged[f] {
+				trusted = false
+				break
+			}
+		}
+		if check != nil {
+			if trusted && checked.IsSet(i) {
+				check.checked.Set(i)
+				if saved.IsSet(i) {
+					check.good.Set(i)
+					pieces.Set(i)
+					good++
+				}
+			}
+			continue
+		}
+		if trusted {
+			if saved.IsSet(i) {
+				pieces.Set(i)
+				good++
+			}
+			continue
+		}
+		hashed++
+		if good1, _ := checkPieceAt(store, ts.M, i, int(length)); good1 {
+			pieces.Set(i)
+			good++
+		}
+	}
+	if check != nil {
+		log.Printf("[ %s ] Resumed with %d pieces, going on with the check of %d more\n", ts.M.Info.Name, good, ts.totalPieces-check.checked.Count())
+		return
+	}
+	log.Printf("[ %s ] Resumed with %d pieces, checked %d of them again\n", ts.M.Info.Name, good, hashed)
+	return
+}
+
+// Saves what we need to resume the torrent quickly. Anything cached is
+// written out first, so the files hold every piece we say we have.
+func (ts *TorrentSession) saveResumeData() {
+	if !ts.flags.QuickResume || !ts.Session.HaveTorrent || ts.fileStore == nil {
+		return
+	}
+	if f, ok := ts.fileStore.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			log.Println("[", ts.M.Info.Name, "] Not saving resume data, since flushing the cache failed:", err)
+			return
+		}
+	}
+	files, err := statFiles(ts.M.storeInfo(), ts.fileSystem)
+	if err != nil {
+		log.Println("[", ts.M.Info.Name, "] Can't save resume data:", err)
+		return
+	}
+	r := &resumeData{
+		path:       resumeDataPath(ts.flags.DataDir, ts.M.InfoHash),
+		Version:    RESUME_VERSION,
+		Pieces:     ts.pieceSet.Bytes(),
+		Files:      files,
+		Uploaded:   ts.Session.Uploaded,
+		Downloaded: ts.Session.Downloaded,
+		TrackerKey: ts.trackerKey,
+
+		SeedingTime: ts.seedingTime(ts.clock().Now()),
+
+		QueuePriority: ts.QueuePriority(),
+		Added:         ts.added(),
+		ForceStart:    ts.ForceStart(),
+
+		CompleteHookRan: ts.completeHookRan,
+		CompletedAt:     ts.completedAt,
+	}
+	if c := ts.recheck; c != nil {
+		// Save how far the check's got, whether or not it's still going.
+		c.mu.Lock()
+		r.Pieces = append([]byte(nil), c.good.Bytes()...)
+		r.Checked = append([]byte(nil), c.checked.Bytes()...)
+		c.mu.Unlock()
+	}
+	if ts.fileDir != ts.flags.FileDir {
+		r.FileDir = ts.fileDir
+	}
+	if ts.ownSeedLimits {
+		l := ts.seedLimits
+		r.SeedLimits = &l
+	}
+	if ts.ownBlockSize {
+		r.BlockSize = ts.blockSize
+	}
+	if err = r.save(); err != nil {
+		log.Println("[", ts.M.Info.Name, "] Couldn't save resume data:", err)
+		return
+	}
+	ts.resumeState = r
+	ts.resumeSaved = ts.clock().Now()
+}
@@ -0,0 +1,176 @@
+package torrent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Changes a byte of a file. If keepTime is set, the file's modification time
+// stays as it was, so that only a hash check can tell.
+func corruptFile(t *testing.T, name string, offset int64, keepTime bool) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, offset)
+	b[0]++
+	_, err = f.WriteAt(b, offset)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := fi.ModTime()
+	if !keepTime {
+		mtime = mtime.Add(time.Second)
+	}
+	if err = os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Writes a torrent of files of the given sizes under dir, complete, and
+// returns a function that starts a session for it, as if restarting.
+func writeResumeTorrent(t *testing.T, dir string, sizes ...int) (m *MetaInfo, flags *TorrentFlags, start func() *TorrentSession) {
+	writeWebSeedFiles(t, filepath.Join(dir, "files"), sizes...)
+	m, err := CreateTorrent(filepath.Join(dir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags = &TorrentFlags{FileDir: dir, DataDir: filepath.Join(dir, "data"), FileSystemProvider: OsFsProvider{},
+		InitialCheck: true, MemoryPerTorrent: -1, QuickResume: true}
+	start = func() *TorrentSession {
+		ts, err := NewTorrentSession(flags, torrentFile, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.checkNow()
+		ts.fileStore.Close()
+		return ts
+	}
+	return
+}
+
+func TestResumeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Five pieces: 0 and 1 in a, 2 in both, 3 and 4 in b.
+	m, flags, start := writeResumeTorrent(t, dir, 40000, 30000)
+
+	ts := start()
+	if ts.goodPieces != 5 {
+		t.Fatalf("Have %d of 5 pieces", ts.goodPieces)
+	}
+	ts.Session.Uploaded = 1234
+	completedAt := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	ts.completedAt = completedAt
+	ts.saveResumeData()
+	key := ts.trackerKey
+
+	// Files that look the same aren't checked.
+	corruptFile(t, filepath.Join(dir, "files", "a"), 0, true)
+	ts = start()
+	if ts.goodPieces != 5 || ts.Session.Uploaded != 1234 || ts.trackerKey != key || !ts.completedAt.Equal(completedAt) {
+		t.Errorf("Resumed with %d pieces, uploaded %d, tracker key %x, completed at %v", ts.goodPieces, ts.Session.Uploaded, ts.trackerKey, ts.completedAt)
+	}
+
+	// Only the pieces in a file that changed are.
+	corruptFile(t, filepath.Join(dir, "files", "b"), 29999, false)
+	ts = start()
+	if ts.goodPieces != 4 || ts.pieceSet.IsSet(4) {
+		t.Errorf("Resumed with %d pieces after changing b", ts.goodPieces)
+	}
+
+	// Resume data we can't read means checking everything.
+	path := resumeDataPath(flags.DataDir, m.InfoHash)
+	for _, data := range []string{"{not json", `{"Version": 100}`} {
+		if err = ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		ts = start()
+		if ts.goodPieces != 3 || ts.pieceSet.IsSet(0) || ts.Session.Uploaded != 0 {
+			t.Errorf("With resume data %q, started with %d pieces", data, ts.goodPieces)
+		}
+	}
+}
+
+func TestResumeFileDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, flags, start := writeResumeTorrent(t, dir, 40000, 30000)
+	// The files are under dir, rather than the usual place.
+	flags.FileDir = filepath.Join(dir, "elsewhere")
+	ts, err := newTorrentSession(context.Background(), flags, "", m, dir, 0, nil, torrentStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.checkNow()
+	ts.fileStore.Close()
+	if ts.goodPieces != 5 {
+		t.Fatalf("Have %d of 5 pieces", ts.goodPieces)
+	}
+	ts.saveResumeData()
+
+	// Restarting finds them there.
+	if ts = start(); ts.goodPieces != 5 || ts.fileDir != dir {
+		t.Errorf("Restarted with %d pieces, under %s", ts.goodPieces, ts.fileDir)
+	}
+}
+
+func TestResumeChangedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Piece 0 is in a and b, 1 in b and c, 2 in c and d, 3 and 4 in d.
+	_, _, start := writeResumeTorrent(t, dir, 10000, 20000, 6000, 30000)
+	start().saveResumeData()
+	file := func(name string) string { return filepath.Join(dir, "files", name) }
+	// Damage that only a hash check finds.
+	corruptFile(t, file("a"), 0, true)
+	corruptFile(t, file("d"), 50000-36000, true)
+
+	// Touching c only checks the pieces it's in.
+	now := time.Now().Add(time.Minute)
+	if err = os.Chtimes(file("c"), now, now); err != nil {
+		t.Fatal(err)
+	}
+	ts := start()
+	if ts.goodPieces != 5 {
+		t.Errorf("Have %d of 5 pieces after touching c", ts.goodPieces)
+	}
+
+	// Changing b checks the pieces it shares with a and c too.
+	corruptFile(t, file("b"), 19999, false)
+	ts = start()
+	for piece, want := range []bool{false, false, true, true, true} {
+		if ts.pieceSet.IsSet(piece) != want {
+			t.Errorf("After changing b, have piece %d: %v, want %v", piece, !want, want)
+		}
+	}
+}
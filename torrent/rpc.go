@@ -0,0 +1,469 @@
+package torrent
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The HTTP control API. Requests must carry the token, as
+// "Authorization: Bearer <token>". Bodies and responses are JSON.
+//
+//	GET    /api/torrents                  The status of every torrent. ?label=l, as many times as need be, only those with every label given
+//	POST   /api/torrents                  Add {"Torrent": URL or magnet} or {"Data": .torrent file}, with an optional "Dir" for its files,
+//	                                      and optional "FileSystem" and "Cache" providers, by name, and their "FileSystemOptions" and
+//	                                      "CacheOptions" (see providers.go). "Resume": true resumes it if we have it already and it's paused.
+//	                                      "Labels": [...] labels it, or adds them to the labels of the one we have
+//	GET    /api/torrents/<info-hash>      The status of one
+//	DELETE /api/torrents/<info-hash>      Remove it. ?deleteData=true deletes its files too
+//	POST   /api/torrents/<info-hash>/pause
+//	POST   /api/torrents/<info-hash>/resume
+//	POST   /api/torrents/<info-hash>/reannounce
+//	POST   /api/torrents/<info-hash>/recheck
+//	POST   /api/torrents/<info-hash>/retry       Open its files again after they failed, checking the ones that did
+//	GET    /api/torrents/<info-hash>/history     RateHistory: its rates over the last ten minutes, and by the minute over the last day
+//	PUT    /api/torrents/<info-hash>/seedLimits  {"Ratio": r, "Time": nanoseconds}, negative or 0 meaning none
+//	PUT    /api/torrents/<info-hash>/queue       {"Priority": p, "ForceStart": f}, either left out staying as it is
+//	POST   /api/torrents/<info-hash>/moveUp      Trade places with the torrent before it in its queue
+//	POST   /api/torrents/<info-hash>/moveDown
+//	PUT    /api/torrents/<info-hash>/bandwidth   {"Priority": "high", "normal" or "low"}: its share of the speed limits
+//	PUT    /api/torrents/<info-hash>/blockSize   {"BlockSize": bytes}: how much it asks peers for at a time, a multiple of 16 KiB up to 128 KiB
+//	PUT    /api/torrents/<info-hash>/labels      {"Labels": [...]} in place of the ones it has. See labels.go
+//	GET    /api/limits                    SpeedLimits, in bytes/s with 0 meaning none
+//	PUT    /api/limits                    Change any of them
+//	PUT    /api/altSpeed                  {"Mode": "on", "off" or "schedule"}
+//	GET    /api/port                      PortStatus: the port peers connect on, how it's mapped, and whether they can
+//	PUT    /api/port                      Listen on {"Port": p} instead, and announce it
+//	GET    /api/listeners                 A PortStatus for each address we listen on, the announced one first
+//	GET    /api/stats                     SessionStats: how all the torrents are doing, together
+//	GET    /api/history                   RateHistory of all the torrents together
+//	POST   /api/reload                    Re-read the config file and the blocklist: a ReloadResult for each setting
+//	POST   /api/shutdown                  Stop every torrent and quit
+//	GET    /metrics                       Prometheus metrics, in the text format, with -rpcMetrics
+//	GET    /debug/state                   DebugState: what the manager and each torrent's loop are up to, with -rpcDebug
+//	GET    /debug/pprof/                  Go's profiles, as net/http/pprof serves them, with -rpcDebug
+//	GET    /ui/                           The web UI, which needs no token to load, but asks for it. See webUI.go
+//
+// Adding returns {"InfoHash": ...} at once, 202 Accepted. Poll the torrent's
+// status to see how loading and checking it goes. A torrent we have already is
+// 200 OK, with "AlreadyPresent": true, and the one we have takes its trackers
+// and web seeds.
+
+type rpcServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+func startRPCServer(m *sessionManager, addr, token string) (s *rpcServer, err error) {
+	if token == "" {
+		return nil, errors.New("The RPC server needs a token")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	log.Println("Serving the control API on", l.Addr(), "and the web UI at http://"+l.Addr().String()+"/ui/")
+	s = &rpcServer{l, &http.Server{Handler: newRPCHandler(m, token)}}
+	go s.server.Serve(l)
+	return
+}
+
+func (s *rpcServer) Close() error {
+	return s.server.Close()
+}
+
+type rpcHandler struct {
+	m     *sessionManager
+	token string
+	ui    http.Handler
+}
+
+func newRPCHandler(m *sessionManager, token string) http.Handler {
+	return &rpcHandler{m, token, newWebUIHandler()}
+}
+
+type rpcAddRequest struct {
+	Torrent string // A URL or magnet link
+	Data    []byte // Or the contents of a .torrent file
+	Dir     string // Where its files go, if not the -fileDir
+	StorageProviders
+	Resume bool // If we have it already and it's paused, resume it
+	Labels []string
+}
+
+type rpcAddResponse struct {
+	InfoHash       string
+	AlreadyPresent bool `json:",omitempty"`
+}
+
+type rpcAltSpeed struct {
+	Mode string // "on", "off", or "schedule"
+}
+
+type rpcQueue struct {
+	Priority   int
+	ForceStart bool
+}
+
+type rpcBandwidth struct {
+	Priority string
+}
+
+type rpcBlockSize struct {
+	BlockSize int
+}
+
+type rpcLabels struct {
+	Labels []string
+}
+
+type rpcPort struct {
+	Port int
+}
+
+type rpcError struct {
+	Error string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, rpcError{err.Error()})
+}
+
+func (h *rpcHandler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	return strings.HasPrefix(auth, prefix) &&
+		subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(h.token)) == 1
+}
+
+func (h *rpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p := r.URL.Path; r.Method == "GET" && (p == "/" || p == "/ui" || strings.HasPrefix(p, "/ui/")) {
+		h.ui.ServeHTTP(w, r)
+		return
+	}
+	if !h.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("Bad or missing token"))
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "api/torrents" && r.Method == "GET":
+		h.list(w, r.URL.Query()["label"])
+	case path == "metrics" && r.Method == "GET" && h.m.flags.RPCMetrics:
+		h.metrics(w)
+	case path == "debug/state" && r.Method == "GET" && h.m.flags.RPCDebug:
+		writeJSON(w, http.StatusOK, h.m.DebugState())
+	case strings.HasPrefix(r.URL.Path, "/debug/pprof/") && h.m.flags.RPCDebug:
+		servePprof(w, r)
+	case path == "api/torrents" && r.Method == "POST":
+		h.add(w, r)
+	case path == "api/limits" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, h.m.SpeedLimits())
+	case path == "api/limits" && r.Method == "PUT":
+		// Limits left out of the request stay as they are.
+		l := h.m.SpeedLimits()
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if l.Download < 0 || l.Upload < 0 || l.AltDownload < 0 || l.AltUpload < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("Rate limits can't be negative"))
+			return
+		}
+		h.m.SetSpeedLimits(l)
+		writeJSON(w, http.StatusOK, h.m.SpeedLimits())
+	case path == "api/altSpeed" && r.Method == "PUT":
+		var a rpcAltSpeed
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		switch a.Mode {
+		case "on", "off":
+			h.m.SetAltSpeed(a.Mode == "on")
+		case "schedule":
+			h.m.SetAltSpeedScheduled()
+		default:
+			writeError(w, http.StatusBadRequest, errors.New(`Mode must be "on", "off" or "schedule"`))
+			return
+		}
+		writeJSON(w, http.StatusOK, h.m.SpeedLimits())
+	case path == "api/port" && r.Method == "GET":
+		s, err := h.m.PortStatus()
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case path == "api/port" && r.Method == "PUT":
+		var p rpcPort
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		port, err := h.m.SetListenPort(p.Port)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rpcPort{port})
+	case path == "api/listeners" && r.Method == "GET":
+		ls, err := h.m.Listeners()
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ls)
+	case path == "api/history" && r.Method == "GET":
+		h, err := h.m.RateHistory()
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, h)
+	case path == "api/stats" && r.Method == "GET":
+		s, err := h.m.Stats()
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case path == "api/reload" && r.Method == "POST":
+		results, err := h.m.Reload()
+		if err == errManagerEnded {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if results == nil {
+			results = []ReloadResult{}
+		}
+		writeJSON(w, http.StatusOK, results)
+	case path == "api/shutdown" && r.Method == "POST":
+		if err := h.m.Quit(); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, struct{}{})
+	case len(parts) >= 3 && len(parts) <= 4 && parts[0] == "api" && parts[1] == "torrents":
+		h.torrent(w, r, parts[2], strings.Join(parts[3:], ""))
+	case strings.HasPrefix(path, "api/"):
+		writeError(w, http.StatusNotFound, errors.New("No such API call"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Lists the torrents with every one of labels.
+func (h *rpcHandler) list(w http.ResponseWriter, labels []string) {
+	statuses, err := h.m.Statuses()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	labelled := []TorrentStatus{}
+	for i := range statuses {
+		if hasLabels(&statuses[i], labels) {
+			labelled = append(labelled, statuses[i])
+		}
+	}
+	writeJSON(w, http.StatusOK, labelled)
+}
+
+func (h *rpcHandler) metrics(w http.ResponseWriter) {
+	stats, statuses, err := h.m.statsAndStatuses()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, &stats, statuses, h.m.disk, h.m.cachers(), h.m.dhtHealth)
+}
+
+func (h *rpcHandler) add(w http.ResponseWriter, r *http.Request) {
+	var req rpcAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var ih string
+	var err error
+	opts := AddOptions{Dir: req.Dir, Storage: req.StorageProviders, Resume: req.Resume, Labels: req.Labels}
+	switch {
+	case len(req.Data) > 0:
+		ih, err = h.m.AddTorrentFromBytesWith(req.Data, opts)
+	case strings.HasPrefix(req.Torrent, "magnet:") || isTorrentURL(req.Torrent):
+		ih, err = h.m.AddTorrentWith(req.Torrent, opts)
+	default:
+		// Not a path: that would let callers read the server's files.
+		err = errors.New("Add a torrent by its contents, an http: or https: URL or a magnet link")
+	}
+	if err == errDuplicateTorrent {
+		writeJSON(w, http.StatusOK, rpcAddResponse{InfoHash: hex.EncodeToString([]byte(ih)), AlreadyPresent: true})
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, rpcAddResponse{InfoHash: hex.EncodeToString([]byte(ih))})
+}
+
+func (h *rpcHandler) torrent(w http.ResponseWriter, r *http.Request, hexHash, action string) {
+	ih, err := hex.DecodeString(hexHash)
+	if err != nil || len(ih) != 20 {
+		writeError(w, http.StatusBadRequest, errors.New("Bad info-hash"))
+		return
+	}
+	ts, status, err := h.m.Torrent(string(ih))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	switch {
+	case action == "" && r.Method == "GET":
+		if ts != nil {
+			var s TorrentStatus
+			if s, err = ts.Status(); err == nil {
+				status = &s
+			}
+		}
+		if err == nil {
+			writeJSON(w, http.StatusOK, status)
+		}
+	case action == "" && r.Method == "DELETE":
+		if err = h.m.RemoveTorrent(string(ih), r.URL.Query().Get("deleteData") == "true"); err == nil {
+			writeJSON(w, http.StatusOK, rpcAddResponse{InfoHash: hexHash})
+		}
+	case r.Method == "POST" && (action == "pause" || action == "resume" || action == "reannounce" || action == "recheck" || action == "retry"):
+		if ts == nil {
+			writeError(w, http.StatusConflict, errors.New("The torrent is still being added"))
+			return
+		}
+		switch action {
+		case "pause":
+			err = ts.Pause()
+		case "resume":
+			err = ts.Resume()
+		case "reannounce":
+			err = ts.ForceAnnounce()
+		case "recheck":
+			err = ts.ForceRecheck()
+		case "retry":
+			err = ts.Retry()
+		}
+		if err == nil {
+			writeJSON(w, http.StatusOK, rpcAddResponse{InfoHash: hexHash})
+		}
+	case action == "history" && r.Method == "GET":
+		if ts == nil {
+			writeError(w, http.StatusConflict, errors.New("The torrent is still being added"))
+			return
+		}
+		var history RateHistory
+		if history, err = ts.RateHistory(); err == nil {
+			writeJSON(w, http.StatusOK, history)
+		}
+	case action == "seedLimits" && r.Method == "PUT":
+		var l SeedLimits
+		if err = json.NewDecoder(r.Body).Decode(&l); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if ts == nil {
+			writeError(w, http.StatusConflict, errors.New("The torrent is still being added"))
+			return
+		}
+		if err = ts.SetSeedLimits(l); err == nil {
+			writeJSON(w, http.StatusOK, l)
+		}
+	case action == "queue" && r.Method == "PUT":
+		if ts == nil {
+			writeError(w, http.StatusConflict, errors.New("The torrent is still being added"))
+			return
+		}
+		q := rpcQueue{ts.QueuePriority(), ts.ForceStart()}
+		if err = json.NewDecoder(r.Body).Decode(&q); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = ts.SetQueuePriority(q.Priority); err == nil {
+			err = h.m.SetForceStart(string(ih), q.ForceStart)
+		}
+		if err == nil {
+			writeJSON(w, http.StatusOK, q)
+		}
+	case action == "bandwidth" && r.Method == "PUT":
+		if ts == nil {
+			writeError(w, http.StatusConflict, errors.New("The torrent is still being added"))
+			return
+		}
+		var b rpcBandwidth
+		if err = json.NewDecoder(r.Body).Decode(&b); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = ts.SetBandwidthPriority(b.Priority); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, b)
+	case action == "blockSize" && r.Method == "PUT":
+		if ts == nil {
+			writeError(w, http.StatusConflict, errors.New("The torrent is still being added"))
+			return
+		}
+		var b rpcBlockSize
+		if err = json.NewDecoder(r.Body).Decode(&b); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = checkBlockSize(b.BlockSize); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = ts.SetBlockSize(b.BlockSize); err == nil {
+			writeJSON(w, http.StatusOK, b)
+		}
+	case action == "labels" && r.Method == "PUT":
+		if ts == nil {
+			writeError(w, http.StatusConflict, errors.New("The torrent is still being added"))
+			return
+		}
+		var l rpcLabels
+		if err = json.NewDecoder(r.Body).Decode(&l); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = ts.SetLabels(l.Labels); err == errBadLabel {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err == nil {
+			writeJSON(w, http.StatusOK, rpcLabels{ts.Labels()})
+		}
+	case (action == "moveUp" || action == "moveDown") && r.Method == "POST":
+		if err = h.m.MoveInQueue(string(ih), action == "moveUp"); err == nil {
+			writeJSON(w, http.StatusOK, rpcAddResponse{InfoHash: hexHash})
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("No such API call"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+	}
+}
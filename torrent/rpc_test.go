@@ -0,0 +1,270 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Calls the API, decoding the response into v unless it's nil.
+func rpcCall(t *testing.T, server *httptest.Server, token, method, path string, body, v interface{}) int {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestRPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 100*1024)
+	rand.New(rand.NewSource(6)).Read(content)
+	contentFile := filepath.Join(dir, "content")
+	if err = ioutil.WriteFile(contentFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := CreateTorrent(contentFile, &CreateOptions{PieceLength: 16 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var torrentData bytes.Buffer
+	if err = meta.Bencode(&torrentData); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		DataDir:            filepath.Join(dir, "data"),
+		SeedRatio:          math.Inf(0),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		TrackerlessMode:    true,
+		MaxActive:          2,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	server := httptest.NewServer(newRPCHandler(m, "secret"))
+	defer server.Close()
+
+	var list []TorrentStatus
+	if code := rpcCall(t, server, "wrong", "GET", "/api/torrents", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("With the wrong token, %d", code)
+	}
+	if code := rpcCall(t, server, "secret", "GET", "/api/torrents", nil, &list); code != http.StatusOK || len(list) != 0 {
+		t.Errorf("Listing no torrents, %d %v", code, list)
+	}
+	var e rpcError
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents", rpcAddRequest{Torrent: contentFile}, &e); code != http.StatusBadRequest || e.Error == "" {
+		t.Errorf("Adding a local path, %d %v", code, e)
+	}
+
+	var added rpcAddResponse
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents", rpcAddRequest{Data: torrentData.Bytes()}, &added); code != http.StatusAccepted {
+		t.Fatalf("Adding the torrent's data, %d", code)
+	}
+	var s TorrentStatus
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if code := rpcCall(t, server, "secret", "GET", "/api/torrents/"+added.InfoHash, nil, &s); code != http.StatusOK {
+			t.Fatalf("Status of the added torrent, %d", code)
+		}
+		if !s.Adding && s.Pieces > 0 && s.GoodPieces == s.Pieces {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the torrent to be checked, %+v", s)
+		}
+	}
+	if s.Name != "content" || s.Left != 0 {
+		t.Errorf("Added torrent's status %+v", s)
+	}
+	var again rpcAddResponse
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents", rpcAddRequest{Data: torrentData.Bytes()}, &again); code != http.StatusOK ||
+		again != (rpcAddResponse{added.InfoHash, true}) {
+		t.Errorf("Adding it twice, %d %+v", code, again)
+	}
+
+	const magnet = "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=other"
+	if code := rpcCall(t, server, "secret", "POST", "/api/torrents", rpcAddRequest{Torrent: magnet}, &added); code != http.StatusAccepted || added.InfoHash != "0123456789abcdef0123456789abcdef01234567" {
+		t.Fatalf("Adding a magnet link, %d %v", code, added)
+	}
+	if code := rpcCall(t, server, "secret", "GET", "/api/torrents", nil, &list); code != http.StatusOK || len(list) != 2 {
+		t.Errorf("Listing two torrents, %d %+v", code, list)
+	}
+
+	path := "/api/torrents/" + s.InfoHash
+	if code := rpcCall(t, server, "secret", "POST", path+"/pause", nil, nil); code != http.StatusOK {
+		t.Errorf("Pausing, %d", code)
+	}
+	if rpcCall(t, server, "secret", "GET", path, nil, &s); !s.Paused {
+		t.Error("Not paused")
+	}
+	if code := rpcCall(t, server, "secret", "POST", path+"/resume", nil, nil); code != http.StatusOK {
+		t.Errorf("Resuming, %d", code)
+	}
+	if rpcCall(t, server, "secret", "GET", path, nil, &s); s.Paused {
+		t.Error("Still paused")
+	}
+	if code := rpcCall(t, server, "secret", "POST", path+"/reannounce", nil, nil); code != http.StatusOK {
+		t.Errorf("Reannouncing, %d", code)
+	}
+	if code := rpcCall(t, server, "secret", "PUT", path+"/seedLimits", SeedLimits{2, 72 * time.Hour}, nil); code != http.StatusOK {
+		t.Errorf("Setting seed limits, %d", code)
+	}
+	if rpcCall(t, server, "secret", "GET", path, nil, &s); s.SeedLimits != (SeedLimits{2, 72 * time.Hour}) {
+		t.Errorf("Seed limits %+v", s.SeedLimits)
+	}
+	if code := rpcCall(t, server, "secret", "PUT", path+"/bandwidth", rpcBandwidth{"high"}, nil); code != http.StatusOK {
+		t.Errorf("Setting the bandwidth priority, %d", code)
+	}
+	if rpcCall(t, server, "secret", "GET", path, nil, &s); s.BandwidthPriority != BANDWIDTH_HIGH {
+		t.Errorf("Bandwidth priority %q", s.BandwidthPriority)
+	}
+	if code := rpcCall(t, server, "secret", "PUT", path+"/bandwidth", rpcBandwidth{"urgent"}, nil); code != http.StatusBadRequest {
+		t.Errorf("Setting a bad bandwidth priority, %d", code)
+	}
+	if code := rpcCall(t, server, "secret", "PUT", path+"/blockSize", rpcBlockSize{64 * 1024}, nil); code != http.StatusOK {
+		t.Errorf("Setting the block size, %d", code)
+	}
+	if rpcCall(t, server, "secret", "GET", path, nil, &s); s.BlockSize != 64*1024 {
+		t.Errorf("Block size %d", s.BlockSize)
+	}
+	if code := rpcCall(t, server, "secret", "PUT", path+"/blockSize", rpcBlockSize{1 << 20}, nil); code != http.StatusBadRequest {
+		t.Errorf("Setting too big a block size, %d", code)
+	}
+	if code := rpcCall(t, server, "secret", "POST", path+"/explode", nil, nil); code != http.StatusNotFound {
+		t.Errorf("An unknown action, %d", code)
+	}
+	if code := rpcCall(t, server, "secret", "GET", "/api/torrents/0000000000000000000000000000000000000000", nil, nil); code != http.StatusNotFound {
+		t.Errorf("An unknown torrent, %d", code)
+	}
+
+	var limits SpeedLimits
+	if code := rpcCall(t, server, "secret", "PUT", "/api/limits", map[string]int64{"Download": 1 << 20, "Upload": 1 << 19}, nil); code != http.StatusOK {
+		t.Errorf("Setting the limits, %d", code)
+	}
+	if code := rpcCall(t, server, "secret", "PUT", "/api/limits", map[string]int64{"AltUpload": 1 << 10}, nil); code != http.StatusOK {
+		t.Errorf("Setting an alternative limit, %d", code)
+	}
+	if rpcCall(t, server, "secret", "GET", "/api/limits", nil, &limits); limits != (SpeedLimits{Download: 1 << 20, Upload: 1 << 19, AltUpload: 1 << 10}) {
+		t.Errorf("Limits %+v", limits)
+	}
+	if code := rpcCall(t, server, "secret", "PUT", "/api/limits", map[string]int64{"Download": -1}, nil); code != http.StatusBadRequest {
+		t.Errorf("Setting a negative limit, %d", code)
+	}
+	if rpcCall(t, server, "secret", "PUT", "/api/altSpeed", rpcAltSpeed{"on"}, &limits); !limits.AltSpeed || !limits.AltSpeedManual || m.bandwidth.up.Rate() != 1<<10 {
+		t.Errorf("After switching to the alternative limits, %+v", limits)
+	}
+	if rpcCall(t, server, "secret", "GET", path, nil, &s); !s.AltSpeed {
+		t.Error("The torrent's status doesn't show the alternative limits")
+	}
+	if rpcCall(t, server, "secret", "PUT", "/api/altSpeed", rpcAltSpeed{"schedule"}, &limits); limits.AltSpeed || limits.AltSpeedManual || m.bandwidth.up.Rate() != 1<<19 {
+		t.Errorf("Back on the empty schedule, %+v", limits)
+	}
+	var port rpcPort
+	if code := rpcCall(t, server, "secret", "GET", "/api/port", nil, &port); code != http.StatusOK || port.Port != 0 {
+		t.Errorf("Port %d, %d", port.Port, code)
+	}
+	// This manager doesn't listen for peers.
+	if code := rpcCall(t, server, "secret", "PUT", "/api/port", rpcPort{6881}, nil); code != http.StatusConflict {
+		t.Errorf("Moving the listener, %d", code)
+	}
+
+	if code := rpcCall(t, server, "secret", "DELETE", "/api/torrents/"+added.InfoHash, nil, nil); code != http.StatusOK {
+		t.Errorf("Removing the magnet link, %d", code)
+	}
+	if code := rpcCall(t, server, "secret", "DELETE", path+"?deleteData=true", nil, nil); code != http.StatusOK {
+		t.Errorf("Removing the torrent, %d", code)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		rpcCall(t, server, "secret", "GET", "/api/torrents", nil, &list)
+		if len(list) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the torrents to stop, %+v", list)
+		}
+	}
+	if _, err = os.Stat(contentFile); !os.IsNotExist(err) {
+		t.Error("The torrent's data wasn't deleted:", err)
+	}
+
+	if code := rpcCall(t, server, "secret", "POST", "/api/shutdown", nil, nil); code != http.StatusAccepted {
+		t.Errorf("Shutting down, %d", code)
+	}
+	<-m.ended
+	if _, err = m.Torrents(); err != errManagerEnded {
+		t.Errorf("After quitting, %v", err)
+	}
+}
+
+func TestRPCWebUI(t *testing.T) {
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1}, 0)
+	server := httptest.NewServer(newRPCHandler(m, "secret"))
+	defer server.Close()
+	get := func(path string) (resp *http.Response, body string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+	// Loading the page doesn't take the token.
+	resp, body := get("/")
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/ui/" || !strings.Contains(body, `src="app.js"`) {
+		t.Errorf("The page: %d at %s, %q", resp.StatusCode, resp.Request.URL.Path, body)
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+		t.Errorf("Content-Security-Policy %q", csp)
+	}
+	for _, asset := range []string{"/ui/app.js", "/ui/style.css"} {
+		if resp, body = get(asset); resp.StatusCode != http.StatusOK || body == "" {
+			t.Errorf("%s: %d", asset, resp.StatusCode)
+		}
+	}
+	if resp, _ = get("/ui/missing.js"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("A missing asset: %d", resp.StatusCode)
+	}
+	// But what it shows does.
+	if resp, _ = get("/api/torrents"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("The API without the token: %d", resp.StatusCode)
+	}
+}
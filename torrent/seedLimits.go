@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// SeedLimits say when a complete torrent stops seeding: once its ratio
+// reaches Ratio or it's seeded for Time, whichever comes first. A negative
+// Ratio, or a Time of 0, means no limit of that kind.
+type SeedLimits struct {
+	Ratio float64
+	Time  time.Duration
+}
+
+// The limits from the flags, for torrents that don't have their own.
+func defaultSeedLimits(flags *TorrentFlags) SeedLimits {
+	ratio := flags.SeedRatio
+	if math.IsInf(ratio, 1) || math.IsNaN(ratio) {
+		ratio = -1
+	}
+	return SeedLimits{ratio, flags.SeedTime}
+}
+
+// SetSeedLimits gives the torrent its own seed limits, in place of the
+// flags'. They're saved in its resume data.
+func (ts *TorrentSession) SetSeedLimits(l SeedLimits) error {
+	return ts.runInLoop(func() {
+		ts.seedLimits, ts.ownSeedLimits = l, true
+		ts.saveResumeData()
+	})
+}
+
+// Keeps count of how long we've been seeding: complete and not paused.
+func (ts *TorrentSession) updateSeeding(now time.Time) {
+	complete := ts.totalPieces != 0 && ts.goodPieces == ts.totalPieces
+	atomic.StoreInt32(&ts.complete, b2i(complete))
+	seeding := complete && !ts.Paused()
+	if seeding && ts.seedingSince.IsZero() {
+		ts.seedingSince = now
+	} else if !seeding && !ts.seedingSince.IsZero() {
+		ts.seededFor += now.Sub(ts.seedingSince)
+		ts.seedingSince = time.Time{}
+	}
+}
+
+// How long we've seeded, over every session.
+func (ts *TorrentSession) seedingTime(now time.Time) time.Duration {
+	if ts.seedingSince.IsZero() {
+		return ts.seededFor
+	}
+	return ts.seededFor + now.Sub(ts.seedingSince)
+}
+
+func (ts *TorrentSession) ratio() float64 {
+	if ts.Session.Downloaded == 0 {
+		return 0
+	}
+	return float64(ts.Session.Uploaded) / float64(ts.Session.Downloaded)
+}
+
+// Says which seed limit the torrent has reached, if any.
+func (ts *TorrentSession) seedLimitReached(now time.Time) string {
+	if ts.totalPieces == 0 || ts.goodPieces < ts.totalPieces {
+		return ""
+	}
+	l := ts.seedLimits
+	if l.Ratio >= 0 && ts.ratio() >= l.Ratio {
+		return fmt.Sprint("Achieved target seed ratio ", l.Ratio)
+	}
+	if l.Time > 0 && ts.seedingTime(now) >= l.Time {
+		return fmt.Sprint("Seeded for ", l.Time)
+	}
+	return ""
+}
+
+// Stops seeding if the torrent has reached a seed limit. It says whether
+// the session should end.
+func (ts *TorrentSession) checkSeedLimits(now time.Time) (end bool) {
+	reason := ts.seedLimitReached(now)
+	if reason == "" {
+		return false
+	}
+	if !ts.flags.PauseAtSeedLimit {
+		log.Println("[", ts.M.Info.Name, "]", reason)
+		return true
+	}
+	log.Println("[", ts.M.Info.Name, "]", reason+", pausing. Raise its seed limits to seed more.")
+	ts.pause()
+	return false
+}
@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSeedLimits(t *testing.T) {
+	if l := defaultSeedLimits(&TorrentFlags{SeedRatio: math.Inf(0), SeedTime: time.Hour}); l.Ratio >= 0 || l.Time != time.Hour {
+		t.Errorf("Default limits %+v", l)
+	}
+	now := time.Now()
+	ts := &TorrentSession{
+		M:           &MetaInfo{},
+		totalPieces: 4,
+		goodPieces:  3,
+		seedLimits:  SeedLimits{Ratio: 2},
+	}
+	ts.Session.Downloaded, ts.Session.Uploaded = 100, 250
+	if r := ts.seedLimitReached(now); r != "" {
+		t.Errorf("Incomplete torrent reached %q", r)
+	}
+	ts.goodPieces = 4
+	if r := ts.seedLimitReached(now); r != "Achieved target seed ratio 2" {
+		t.Errorf("At ratio 2.5, %q", r)
+	}
+
+	ts.seedLimits = SeedLimits{Ratio: -1, Time: time.Hour}
+	ts.seededFor = 50 * time.Minute
+	ts.updateSeeding(now)
+	if r := ts.seedLimitReached(now.Add(5 * time.Minute)); r != "" {
+		t.Errorf("After 55 minutes, %q", r)
+	}
+	// Paused time doesn't count.
+	ts.paused = 1
+	ts.updateSeeding(now.Add(5 * time.Minute))
+	if got := ts.seedingTime(now.Add(time.Hour)); got != 55*time.Minute {
+		t.Errorf("Seeding time while paused %v", got)
+	}
+	ts.paused = 0
+	ts.updateSeeding(now.Add(time.Hour))
+	if r := ts.seedLimitReached(now.Add(time.Hour + 5*time.Minute)); r != "Seeded for 1h0m0s" {
+		t.Errorf("After an hour, %q", r)
+	}
+}
+
+func TestSeedLimitsResumeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seedLimits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := &resumeData{
+		path:        resumeDataPath(dir, "ih"),
+		Version:     RESUME_VERSION,
+		SeedingTime: 3 * time.Hour,
+		SeedLimits:  &SeedLimits{Ratio: 1.5, Time: 72 * time.Hour},
+	}
+	if err = r.save(); err != nil {
+		t.Fatal(err)
+	}
+	got := loadResumeData(dir, "ih")
+	if got == nil || got.SeedingTime != 3*time.Hour || got.SeedLimits == nil || *got.SeedLimits != *r.SeedLimits {
+		t.Errorf("Loaded %+v", got)
+	}
+}
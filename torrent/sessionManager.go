@@ -0,0 +1,1031 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nictuku/dht"
+)
+
+// The torrents RunTorrents is running, and the things they share. The
+// manager's fields belong to its loop; other goroutines, like the RPC
+// server, use the exported methods, which do their work in the loop.
+type sessionManager struct {
+	ctx        context.Context // Done once we're quitting
+	cancel     context.CancelFunc
+	flags      *TorrentFlags
+	listenPort int           // What we tell peers
+	listener   *peerListener // nil if we don't listen for peers
+	// On the ListenAddresses after the first, which SetListenPort leaves be.
+	moreListeners []*peerListener
+	announceAddrs announceAddrs
+	// Sessions we paused while the bind interface had no address, to resume
+	// when it's back. Nil while it has one.
+	bindPaused map[*TorrentSession]bool
+	// Likewise the downloads we paused for want of disk space. See diskCap.go.
+	diskPaused map[*TorrentSession]bool
+	diskUsage  DiskUsage
+	blocklist  *blocklist
+	bandwidth  *bandwidth
+	disk       *diskStats
+	memory     *pieceMemory // The sessions' budget for active pieces
+	trackers   *http.Client // The sessions' HTTP announces go through it
+	commands   chan func()
+	ended      chan bool
+	createChan chan *addingTorrent
+	startChan  chan *TorrentSession
+	doneChan   chan *TorrentSession
+	failChan   chan createFailure
+
+	sessions map[string]*TorrentSession // By info-hash
+	// Every info-hash peers may know a session by. Hybrid torrents have two.
+	byHash map[string]*TorrentSession
+	// Torrents added by info-hash that don't have a session yet.
+	adding   map[string]*addingTorrent
+	queue    []*addingTorrent         // Torrents waiting for a free slot
+	active   int                      // Sessions being created or running
+	removing map[*TorrentSession]bool // Sessions being removed -> whether to delete their files
+	quitting bool
+	// When quitting gives up on the torrents that haven't finished.
+	quitDeadline <-chan time.Time
+	// Keep running without torrents, since more can be added.
+	stayUp bool
+
+	conChan       chan *BtConn
+	dhtNode       *dht.DHT // nil if we have no IPv4 DHT node
+	dht4Results   chan map[dht.InfoHash][]string
+	dhtNode6      *dht.DHT
+	dht6Results   chan map[dht.InfoHash][]string
+	dhtNodes      *dhtNodeTable
+	krpc          *krpcClient                    // Our own DHT queries. See krpc.go.
+	krpcResults   chan map[dht.InfoHash][]string // Peers our lookups found, in read-only mode
+	dhtRouters    []string                       // The bootstrap nodes' addresses
+	dhtScraped    map[*TorrentSession]time.Time
+	dhtScrapeChan <-chan time.Time
+	dhtHealth     *dhtHealthMonitor
+	dhtLimits     *dhtLimiter
+	dhtHealthChan <-chan time.Time
+	dhtRetryChan  <-chan time.Time
+	dhtSaveChan   <-chan time.Time
+	externalAddr  *externalAddress
+	lpd           *Announcer
+	altSpeedChan  <-chan time.Time
+	queueChan     <-chan time.Time
+	rateHistory   *rateHistory
+	historyChan   <-chan time.Time
+	reachability  *reachability
+	// Set while we listen for peers. See reachability.go.
+	reachabilityChan <-chan time.Time
+	diskUsageChan    <-chan time.Time // Set with a disk usage cap
+	reverifyChan     <-chan time.Time // Set with -reverifyInterval. See verified.go.
+	storageRetryChan <-chan time.Time // See storageError.go.
+
+	// The providers torrents have chosen by name, by name and options. See
+	// providers.go.
+	providersLock  sync.Mutex
+	fsProviders    map[string]FsProvider
+	cacheProviders map[string]CacheProvider
+
+	// The reloadable settings in force. See reload.go.
+	blocklistFile     string
+	disconnectBlocked bool
+	watchDir          string
+	watchDirDelete    bool
+	watchStop         chan bool // Closed to stop watching
+
+	// The session state, with SaveSession. See sessionState.go.
+	stateLock            sync.Mutex // Held while saving it
+	sessionSaveChan      <-chan time.Time
+	transferred          map[*TorrentSession]transferred
+	uploaded, downloaded uint64        // Over every session
+	sessionStart         transferred   // What they were when we started
+	quitState            *sessionState // The torrents we had when we started quitting
+
+	removedOverhead Overhead // Of the torrents that have been removed this session
+}
+
+type addingTorrent struct {
+	torrent  string    // What it was added as, or "" if it was added as data
+	meta     *MetaInfo // Nil if it hasn't been read yet
+	name     string
+	dir      string // Where its files go, or "" for the usual place
+	storage  torrentStorage
+	trackers [][]string // From adds of it since, for its session
+	webSeeds []string   // Likewise
+	info     *MetaInfo  // The .torrent of a magnet link, added since
+	paused   bool       // Paused when we last ran
+	restored bool       // From the saved session, rather than newly added
+	priority string     // Its bandwidth priority when we last ran, or "" for normal
+	labels   []string   // See labels.go
+	err      error      // Why creating its session failed, if it did
+	remove   bool       // Removed before its session started
+	port     uint16     // Our listen port when it was queued
+	ctx      context.Context
+	cancel   context.CancelFunc // Gives up on creating its session
+	opening  openProgress       // Its files opened so far
+}
+
+type createFailure struct {
+	a   *addingTorrent
+	err error
+}
+
+func (a *addingTorrent) status(infoHash string) (s TorrentStatus) {
+	s = TorrentStatus{Name: a.name, InfoHash: hex.EncodeToString([]byte(infoHash)), Adding: a.err == nil, Labels: a.labels}
+	if s.Adding {
+		s.FilesOpened = int(atomic.LoadInt64(&a.opening.opened))
+		s.FilesToOpen = int(atomic.LoadInt64(&a.opening.files))
+	}
+	if a.err != nil {
+		s.Error = a.err.Error()
+	}
+	return
+}
+
+// How long quitting waits for the torrents to save their state and tell the
+// trackers they've stopped.
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
+var (
+	errManagerEnded     = errors.New("Not running torrents any more")
+	errDuplicateTorrent = errors.New("Already have that torrent")
+)
+
+func newSessionManager(ctx context.Context, flags *TorrentFlags, listenPort int) (m *sessionManager) {
+	m = &sessionManager{
+		flags:        flags,
+		listenPort:   listenPort,
+		bandwidth:    newBandwidth(flags),
+		disk:         newDiskStats(),
+		memory:       newPieceMemory(int64(flags.MaxPieceMemory) * 1024 * 1024),
+		trackers:     newTrackerHTTPClient(flags.Dial),
+		commands:     make(chan func()),
+		ended:        make(chan bool),
+		createChan:   make(chan *addingTorrent, flags.MaxActive),
+		startChan:    make(chan *TorrentSession, 1),
+		doneChan:     make(chan *TorrentSession, 1),
+		failChan:     make(chan createFailure, 1),
+		sessions:     make(map[string]*TorrentSession),
+		byHash:       make(map[string]*TorrentSession),
+		adding:       make(map[string]*addingTorrent),
+		removing:     make(map[*TorrentSession]bool),
+		transferred:  make(map[*TorrentSession]transferred),
+		dhtScraped:   make(map[*TorrentSession]time.Time),
+		externalAddr: newExternalAddress(),
+		lpd:          &Announcer{},
+		rateHistory:  newRateHistory(),
+		historyChan:  time.Tick(time.Second),
+		reachability: newReachability(),
+		blocklist:    &blocklist{},
+
+		fsProviders:    make(map[string]FsProvider),
+		cacheProviders: make(map[string]CacheProvider),
+
+		blocklistFile:     flags.Blocklist,
+		disconnectBlocked: flags.DisconnectBlocked,
+		watchDir:          flags.WatchDir,
+		watchDirDelete:    flags.WatchDirDelete,
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	if len(flags.AltSpeedSchedule) > 0 {
+		// Checked every minute, since the schedule goes by the minute.
+		m.altSpeedChan = time.Tick(time.Minute)
+	}
+	if flags.MaxActiveDownloads > 0 || flags.MaxActiveSeeds > 0 {
+		m.queueChan = time.Tick(QUEUE_CHECK)
+	}
+	if flags.MaxDiskUsage > 0 {
+		m.diskUsageChan = time.Tick(DISK_USAGE_CHECK)
+	}
+	if flags.SaveSession {
+		m.sessionSaveChan = time.Tick(SESSION_SAVE_INTERVAL)
+	}
+	if flags.ReverifyInterval > 0 {
+		m.reverifyChan = time.Tick(flags.ReverifyInterval)
+	}
+	m.storageRetryChan = time.Tick(STORAGE_RETRY_INTERVAL)
+	return
+}
+
+// Creates sessions one at a time, since creating one can mean hash checking
+// its files.
+func (m *sessionManager) createSessions() {
+	for a := range m.createChan {
+		var ts *TorrentSession
+		meta, err := a.meta, error(nil)
+		if meta == nil {
+			if meta, err = getMetaInfo(a.ctx, m.flags.Dial, a.torrent); err == nil && m.have(a, meta) {
+				err = errDuplicateTorrent
+			}
+		}
+		if err == nil && m.flags.MaxDiskUsage > 0 {
+			err = m.checkDiskRoom(meta)
+		}
+		if err == nil {
+			ts, err = newTorrentSession(a.ctx, m.flags, a.torrent, meta, a.dir, a.port, &a.opening, a.storage)
+		}
+		if err != nil {
+			a.cancel()
+			log.Println("Couldn't create torrent session for "+a.label()+" .", err)
+			m.failChan <- createFailure{a, err}
+		} else {
+			// The session's context comes from a's, which can go with it.
+			stop := ts.cancel
+			ts.cancel = func() { stop(); a.cancel() }
+			log.Printf("Created torrent session for %s", ts.M.Info.Name)
+			m.startChan <- ts
+		}
+	}
+}
+
+// Whether we have a torrent, apart from a, that's been read as meta. Torrents
+// from the command line aren't read until their sessions are created, so
+// restored ones may have them already.
+func (m *sessionManager) have(a *addingTorrent, meta *MetaInfo) (have bool) {
+	m.run(func() {
+		for _, ih := range meta.InfoHashes() {
+			if m.byHash[ih] != nil || (m.adding[ih] != nil && m.adding[ih] != a) {
+				have = true
+			}
+		}
+	})
+	return
+}
+
+// Starts creating a session for the torrent, or queues it if enough are
+// active.
+func (m *sessionManager) add(a *addingTorrent) {
+	if m.active < m.flags.MaxActive {
+		m.active++
+		a.port = uint16(m.listenPort)
+		a.ctx, a.cancel = context.WithCancel(m.ctx)
+		m.createChan <- a
+	} else {
+		m.queue = append(m.queue, a)
+	}
+}
+
+func (a *addingTorrent) label() string {
+	if a.torrent == "" && a.meta != nil {
+		return a.meta.Info.Name
+	}
+	return a.torrent
+}
+
+func (m *sessionManager) started(ts *TorrentSession) {
+	a := m.adding[ts.M.InfoHash]
+	delete(m.adding, ts.M.InfoHash)
+	if m.quitting || (a != nil && a.remove) || m.sessions[ts.M.InfoHash] != nil {
+		if m.sessions[ts.M.InfoHash] != nil {
+			log.Println("Already running", ts.M.Info.Name)
+		}
+		if ts.fileStore != nil {
+			if err := ts.fileStore.Close(); err != nil {
+				log.Println("Couldn't close the files of", ts.M.Info.Name+":", err)
+			}
+		}
+		ts.cancel()
+		m.ended1()
+		return
+	}
+	if m.flags.UseDHT {
+		ts.dht = m.dhtClient()
+	}
+	// In case it's changed since the session was created.
+	ts.usePort(uint16(m.listenPort))
+	ts.announceAddrs = m.announceAddrs
+	ts.disk = m.disk
+	ts.externalAddr = m.externalAddr
+	ts.bandwidth = m.bandwidth
+	ts.pieceMemory = m.memory
+	ts.trackerClient = m.trackers
+	ts.blocklist = m.blocklist
+	if a != nil && a.paused {
+		// Before it's started, so it doesn't announce first.
+		atomic.StoreInt32(&ts.paused, 1)
+	}
+	if a != nil && len(a.trackers) > 0 {
+		if _, err := ts.takeTrackers(a.trackers); err != nil {
+			log.Println("[", ts.M.Info.Name, "] Ignoring the trackers added to it:", err)
+		}
+	}
+	if a != nil && a.priority != "" {
+		if err := ts.SetBandwidthPriority(a.priority); err != nil {
+			log.Println("[", ts.M.Info.Name, "] Ignoring the saved bandwidth priority:", err)
+		}
+	}
+	if a != nil {
+		// Before its loop starts, and its added hook's made.
+		ts.addLabels(a.labels)
+	}
+	m.transferred[ts] = transferred{ts.Session.Uploaded, ts.Session.Downloaded}
+	ts.saveForSession()
+	if m.flags.UseLPD {
+		ts.lpd = m.lpd
+		m.lpd.Announce(ts.M.InfoHash)
+	}
+	m.sessions[ts.M.InfoHash] = ts
+	for _, ih := range ts.M.InfoHashes() {
+		m.byHash[ih] = ts
+	}
+	log.Printf("Starting torrent session for %s", ts.M.Info.Name)
+	if a == nil || !a.restored {
+		ts.hooks.add(ts.hook("added", m.flags.OnAdded), m.flags.HookTimeout)
+	}
+	go func(t *TorrentSession) {
+		t.DoTorrent()
+		m.doneChan <- t
+	}(ts)
+	if a != nil && (len(a.webSeeds) > 0 || a.info != nil) {
+		// They need its loop.
+		go ts.addedAgain(nil, a.webSeeds, a.info, nil, false)
+	}
+	if m.bindPaused != nil {
+		m.bindPause(ts)
+	}
+	if m.diskPaused != nil {
+		m.diskPause(ts)
+	}
+	m.updateQueue()
+}
+
+func (m *sessionManager) done(ts *TorrentSession) {
+	delete(m.sessions, ts.M.InfoHash)
+	delete(m.bindPaused, ts)
+	delete(m.diskPaused, ts)
+	// Its loop's done, so its counts are ours.
+	m.count(ts, ts.Session.Uploaded, ts.Session.Downloaded)
+	delete(m.transferred, ts)
+	delete(m.dhtScraped, ts)
+	m.removedOverhead.add(ts.traffic.overhead())
+	for _, ih := range ts.M.InfoHashes() {
+		delete(m.byHash, ih)
+	}
+	m.updateQueue()
+	if m.flags.UseLPD {
+		m.lpd.StopAnnouncing(ts.M.InfoHash)
+	}
+	if deleteData, ok := m.removing[ts]; ok {
+		delete(m.removing, ts)
+		ts.forget()
+		if deleteData {
+			for _, err := range ts.removeFiles() {
+				log.Println("[", ts.M.Info.Name, "] Couldn't delete", err)
+			}
+		}
+		ts.hooks.add(ts.hook("removed", m.flags.OnRemoved), m.flags.HookTimeout)
+	}
+	m.ended1()
+}
+
+// One fewer session is active, so start the next queued one.
+func (m *sessionManager) ended1() {
+	m.active--
+	if !m.quitting && len(m.queue) > 0 {
+		next := m.queue[0]
+		m.queue = m.queue[1:]
+		m.add(next)
+	}
+}
+
+// Whether the loop should end.
+func (m *sessionManager) finished() bool {
+	return m.active == 0 && len(m.queue) == 0 && (m.quitting || !m.stayUp)
+}
+
+func (m *sessionManager) quit() {
+	if m.quitting {
+		return
+	}
+	log.Println("Quitting")
+	m.quitting = true
+	if m.flags.SaveSession {
+		m.quitState = m.sessionState()
+	}
+	m.queue = nil
+	// Gives up on creating sessions, too.
+	m.cancel()
+	m.quitDeadline = time.After(SHUTDOWN_TIMEOUT)
+	for _, ts := range m.sessions {
+		go ts.Quit()
+	}
+}
+
+// Logs what didn't finish quitting in time.
+func (m *sessionManager) logUnfinished() {
+	for _, ts := range m.sessions {
+		log.Println("[", ts.M.Info.Name, "] Didn't finish quitting")
+	}
+	if creating := m.active - len(m.sessions); creating > 0 {
+		log.Println(creating, "torrent sessions were still being created")
+	}
+}
+
+// Runs f in the manager's loop.
+func (m *sessionManager) run(f func()) error {
+	done := make(chan bool)
+	select {
+	case m.commands <- func() { f(); close(done) }:
+	case <-m.ended:
+		return errManagerEnded
+	}
+	<-done
+	return nil
+}
+
+func (m *sessionManager) loop(quitChan chan os.Signal) {
+	defer close(m.ended)
+	done := m.ctx.Done()
+	for !m.finished() {
+		select {
+		case <-done:
+			done = nil
+			m.quit()
+		case f := <-m.commands:
+			f()
+		case ts := <-m.startChan:
+			m.started(ts)
+		case ts := <-m.doneChan:
+			m.done(ts)
+		case f := <-m.failChan:
+			// Kept, so its status says why, until it's removed or added again.
+			if f.a.meta != nil && m.adding[f.a.meta.InfoHash] == f.a {
+				if f.a.remove {
+					delete(m.adding, f.a.meta.InfoHash)
+				} else {
+					f.a.err = f.err
+				}
+			}
+			m.ended1()
+		case <-quitChan:
+			if m.quitting {
+				log.Println("Quitting now")
+				m.logUnfinished()
+				return
+			}
+			m.quit()
+		case <-m.quitDeadline:
+			log.Println("Gave up waiting for the torrents to quit after", SHUTDOWN_TIMEOUT)
+			m.logUnfinished()
+			return
+		case c := <-m.conChan:
+			//	log.Printf("New bt connection for ih %x", c.Infohash)
+			if m.sawIncoming(c) || m.blocklist.blockedConn(c) {
+				c.conn.Close()
+			} else if ts, ok := m.byHash[c.Infohash]; ok && !m.quitting {
+				ts.AcceptNewPeer(c)
+			} else {
+				c.conn.Close()
+			}
+		case dhtPeers := <-m.dht4Results:
+			hintDHTPeers(dhtPeers, m.byHash, m.dhtHealth, m.dhtLimits)
+		case dhtPeers := <-m.dht6Results:
+			hintDHTPeers(dhtPeers, m.byHash, m.dhtHealth, m.dhtLimits)
+		case dhtPeers := <-m.krpcResults:
+			hintDHTPeers(dhtPeers, m.byHash, m.dhtHealth, m.dhtLimits)
+		case now := <-m.dhtRetryChan:
+			m.dhtClient().retry(now)
+		case now := <-m.dhtScrapeChan:
+			m.scrapeDHT(now)
+		case ip := <-m.externalAddr.Changes:
+			log.Println("Our external IP address is", ip)
+			if m.krpc != nil {
+				m.krpc.setExternalIP(ip)
+			}
+		case now := <-m.altSpeedChan:
+			m.bandwidth.followSchedule(now)
+		case <-m.queueChan:
+			m.updateQueue()
+		case now := <-m.historyChan:
+			m.recordRates(now)
+		case now := <-m.reachabilityChan:
+			m.checkReachabilityGrace(now)
+		case <-m.diskUsageChan:
+			go m.checkDiskUsage()
+		case <-m.reverifyChan:
+			go m.reverify()
+		case <-m.storageRetryChan:
+			go m.retryStorage()
+		case <-m.sessionSaveChan:
+			go m.saveSession()
+		case <-m.dhtHealthChan:
+			log.Println(m.dhtHealth.Health(time.Now()))
+		case <-m.dhtSaveChan:
+			if err := m.dhtNodes.Save(); err != nil {
+				log.Println("Couldn't save DHT nodes:", err)
+			}
+		case announce := <-m.lpd.Announces:
+			hexhash, err := hex.DecodeString(announce.Infohash)
+			if err != nil {
+				log.Println("Err with hex-decoding:", err)
+			}
+			if ts, ok := m.byHash[string(hexhash)]; ok {
+				// log.Printf("Received LPD announce for ih %s", announce.Infohash)
+				ts.HintNewPeer(announce.Peer, PEER_SOURCE_LPD)
+			}
+		}
+	}
+}
+
+// Torrents returns the running torrents, by name.
+func (m *sessionManager) Torrents() (torrents []*TorrentSession, err error) {
+	err = m.run(func() {
+		for _, ts := range m.sessions {
+			torrents = append(torrents, ts)
+		}
+	})
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].M.Info.Name < torrents[j].M.Info.Name })
+	return
+}
+
+// Statuses returns the status of every torrent, including ones still being
+// added.
+func (m *sessionManager) Statuses() (statuses []TorrentStatus, err error) {
+	var adding []TorrentStatus
+	err = m.run(func() {
+		for ih, a := range m.adding {
+			adding = append(adding, a.status(ih))
+		}
+	})
+	if err != nil {
+		return
+	}
+	// Ask the sessions outside the manager's loop, so they don't hold it up.
+	torrents, err := m.Torrents()
+	for _, ts := range torrents {
+		if s, e := ts.Status(); e == nil {
+			statuses = append(statuses, s)
+		}
+	}
+	sort.Slice(adding, func(i, j int) bool { return adding[i].Name < adding[j].Name })
+	statuses = append(statuses, adding...)
+	return
+}
+
+// Torrent finds a torrent by its info-hash. If it's still being added, the
+// session is nil and status says how that's going.
+func (m *sessionManager) Torrent(infoHash string) (ts *TorrentSession, status *TorrentStatus, err error) {
+	if e := m.run(func() {
+		if ts = m.byHash[infoHash]; ts != nil {
+			return
+		}
+		a := m.adding[infoHash]
+		if a == nil {
+			err = fmt.Errorf("No torrent %x", infoHash)
+			return
+		}
+		s := a.status(infoHash)
+		status = &s
+	}); e != nil {
+		return nil, nil, e
+	}
+	return
+}
+
+// AddOptions are how a torrent's added, besides what it is.
+type AddOptions struct {
+	Dir string // Where its files go, if not under the -fileDir
+	// The providers it's stored with, if not the flags'. See providers.go.
+	Storage StorageProviders
+	// If we have it already and it's paused, it's resumed.
+	Resume bool
+	// Its labels, or ones to add to it if we have it already. The first
+	// with one of the LabelDirs says where its files go, if Dir doesn't.
+	Labels []string
+}
+
+// AddTorrent adds a torrent file, URL or magnet link. It returns as soon as
+// it's read the torrent; the session is created, which can mean hash checking
+// its files, in the background. If we have the torrent already, it's
+// errDuplicateTorrent, with the info-hash of the one we have, which takes
+// what's new in this one: see duplicates.go.
+func (m *sessionManager) AddTorrent(torrent string) (infoHash string, err error) {
+	return m.AddTorrentWith(torrent, AddOptions{})
+}
+
+// AddTorrentTo is like AddTorrent, but stores the torrent's files under dir
+// rather than the -fileDir. dir can't be inside another torrent's files.
+func (m *sessionManager) AddTorrentTo(torrent, dir string) (infoHash string, err error) {
+	return m.AddTorrentWith(torrent, AddOptions{Dir: dir})
+}
+
+// AddTorrentWith is like AddTorrent, with opts. It's an ErrUnknownProvider
+// if they choose a provider nothing's registered as, and errBadLabel if one
+// of the labels can't be.
+func (m *sessionManager) AddTorrentWith(torrent string, opts AddOptions) (infoHash string, err error) {
+	var input io.ReadCloser
+	if strings.HasPrefix(torrent, "magnet:") {
+		meta, err := getMetaInfo(m.ctx, m.flags.Dial, torrent)
+		if err != nil {
+			return "", err
+		}
+		return m.addMetaInfo(torrent, meta, opts)
+	} else if isTorrentURL(torrent) {
+		r, err := proxyHttpGet(m.ctx, m.flags.Dial, torrent)
+		if err != nil {
+			return "", err
+		}
+		input = r.Body
+	} else if input, err = os.Open(torrent); err != nil {
+		return
+	}
+	defer input.Close()
+	return m.addFromReader(torrent, input, opts)
+}
+
+// AddTorrentFromReader adds the torrent r holds the .torrent file of, like
+// AddTorrent.
+func (m *sessionManager) AddTorrentFromReader(r io.Reader) (infoHash string, err error) {
+	return m.addFromReader("", r, AddOptions{})
+}
+
+// AddTorrentFromBytes adds the torrent from the contents of its .torrent
+// file, like AddTorrent.
+func (m *sessionManager) AddTorrentFromBytes(data []byte) (infoHash string, err error) {
+	return m.AddTorrentFromBytesWith(data, AddOptions{})
+}
+
+// AddTorrentFromBytesTo is like AddTorrentFromBytes, but stores the files
+// under dir, like AddTorrentTo.
+func (m *sessionManager) AddTorrentFromBytesTo(data []byte, dir string) (infoHash string, err error) {
+	return m.AddTorrentFromBytesWith(data, AddOptions{Dir: dir})
+}
+
+// AddTorrentFromBytesWith is like AddTorrentFromBytes, with opts, like
+// AddTorrentWith.
+func (m *sessionManager) AddTorrentFromBytesWith(data []byte, opts AddOptions) (infoHash string, err error) {
+	return m.addFromReader("", bytes.NewReader(data), opts)
+}
+
+func (m *sessionManager) addFromReader(torrent string, r io.Reader, opts AddOptions) (infoHash string, err error) {
+	meta, err := ReadMetaInfo(r)
+	if err != nil {
+		return
+	}
+	// Bad torrents are turned away now, rather than when their session is
+	// created.
+	if err = meta.validate(); err != nil {
+		return
+	}
+	return m.addMetaInfo(torrent, meta, opts)
+}
+
+func (m *sessionManager) addMetaInfo(torrent string, meta *MetaInfo, opts AddOptions) (infoHash string, err error) {
+	infoHash = meta.InfoHash
+	labels, err := cleanLabels(opts.Labels)
+	if err != nil {
+		return
+	}
+	dir := opts.Dir
+	var have *TorrentSession
+	if e := m.run(func() {
+		if m.quitting {
+			err = errManagerEnded
+			return
+		}
+		for _, ih := range meta.InfoHashes() {
+			if m.byHash[ih] != nil || (m.adding[ih] != nil && m.adding[ih].err == nil) {
+				infoHash, have, err = m.addedAgain(ih, meta, labels, opts.Resume)
+				return
+			}
+		}
+		if dir == "" {
+			dir = m.labelDir(labels)
+		}
+		if dir != "" {
+			if err = m.checkFileDir(dir); err != nil {
+				return
+			}
+		}
+		var storage torrentStorage
+		if storage, err = m.storage(opts.Storage); err != nil {
+			return
+		}
+		a := &addingTorrent{torrent: torrent, meta: meta, name: meta.Info.Name, dir: dir, storage: storage, labels: labels}
+		m.adding[infoHash] = a
+		m.add(a)
+		if m.flags.SaveSession && !strings.HasPrefix(torrent, "magnet:") {
+			if err := saveMetaInfo(sessionTorrentsDir(m.flags.DataDir), meta); err != nil {
+				log.Println("Couldn't save", meta.Info.Name, "for the next session:", err)
+			}
+		}
+	}); e != nil {
+		return "", e
+	}
+	if have != nil {
+		if e := have.addedAgain(fullAnnounceList(meta.Announce, meta.AnnounceList), meta.WebSeeds, againInfo(meta), labels, opts.Resume); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Refuses a download directory inside another torrent's files, where the
+// two torrents' files would be mixed up, and each one's deleting and path
+// checks would trip over the other's.
+func (m *sessionManager) checkFileDir(dir string) error {
+	for _, ts := range m.sessions {
+		if content, ok := ts.content.Load().(string); ok && nestedIn(dir, content) {
+			return fmt.Errorf("%s is inside %s's files", dir, ts.M.Info.Name)
+		}
+	}
+	for _, a := range m.adding {
+		if a.err != nil || a.name == "" {
+			continue
+		}
+		base := a.dir
+		if base == "" {
+			base = m.flags.FileDir
+		}
+		if nestedIn(dir, filepath.Join(base, a.name)) {
+			return fmt.Errorf("%s is inside %s's files", dir, a.name)
+		}
+	}
+	return nil
+}
+
+// Whether dir is parent or below it.
+func nestedIn(dir, parent string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if parent, err = filepath.Abs(parent); err != nil {
+		return false
+	}
+	return dir == parent || strings.HasPrefix(dir, parent+string(filepath.Separator))
+}
+
+// RemoveTorrent stops a torrent and forgets it, along with its resume data.
+// With deleteData, its files are deleted once it's stopped, apart from ones
+// it didn't create.
+func (m *sessionManager) RemoveTorrent(infoHash string, deleteData bool) (err error) {
+	if e := m.run(func() {
+		if ts := m.byHash[infoHash]; ts != nil {
+			m.removing[ts] = deleteData
+			go ts.Quit()
+			return
+		}
+		a := m.adding[infoHash]
+		if a == nil {
+			err = fmt.Errorf("No torrent %x", infoHash)
+			return
+		}
+		for i, t := range m.queue {
+			if t == a {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				delete(m.adding, infoHash)
+				return
+			}
+		}
+		if a.err != nil {
+			delete(m.adding, infoHash)
+			return
+		}
+		// Its session is being created.
+		a.remove = true
+		a.cancel()
+	}); e != nil {
+		return e
+	}
+	return
+}
+
+// Quit stops every torrent, and then the manager. The torrents save their
+// state and tell the trackers they've stopped, for up to SHUTDOWN_TIMEOUT.
+func (m *sessionManager) Quit() error {
+	return m.run(m.quit)
+}
+
+// SetSpeedLimits changes the normal and alternative limits on the rates of
+// all the torrents. Which are in force doesn't change.
+func (m *sessionManager) SetSpeedLimits(l SpeedLimits) {
+	m.bandwidth.SetLimits(l)
+}
+
+func (m *sessionManager) SpeedLimits() SpeedLimits {
+	return m.bandwidth.Limits()
+}
+
+// SetAltSpeed switches to the alternative limits, or back to the normal
+// ones, until SetAltSpeedScheduled hands the choice back to the schedule.
+func (m *sessionManager) SetAltSpeed(on bool) {
+	m.bandwidth.SetAltSpeed(on)
+}
+
+func (m *sessionManager) SetAltSpeedScheduled() {
+	m.bandwidth.SetAltSpeedScheduled()
+}
+
+// PortStatus is how our listen port is mapped.
+func (m *sessionManager) PortStatus() (s PortStatus, err error) {
+	var l *peerListener
+	var reachable string
+	if err = m.run(func() { l, s.Port, reachable = m.listener, m.listenPort, m.reachability.state }); err != nil || l == nil {
+		return
+	}
+	s = l.status()
+	s.Reachable = reachable
+	return
+}
+
+// Listeners lists how each of our peer listeners is doing, the one whose port
+// we announce first.
+func (m *sessionManager) Listeners() (s []PortStatus, err error) {
+	var ls []*peerListener
+	var reachable string
+	if err = m.run(func() { ls, reachable = m.listeners(), m.reachability.state }); err != nil {
+		return
+	}
+	for i, l := range ls {
+		status := l.status()
+		if i == 0 {
+			// The others aren't tested.
+			status.Reachable = reachable
+		}
+		s = append(s, status)
+	}
+	return
+}
+
+func (m *sessionManager) listeners() []*peerListener {
+	if m.listener == nil {
+		return nil
+	}
+	return append([]*peerListener{m.listener}, m.moreListeners...)
+}
+
+// SetListenPort moves the peer listener to port, on the address it's bound
+// to, maps it in place of the old one, and announces it to the torrents'
+// trackers. The DHT stays on the port it has, and the listeners on the other
+// ListenAddresses stay where they are. It returns the port peers should
+// connect on, which a NAT can make different.
+func (m *sessionManager) SetListenPort(port int) (externalPort int, err error) {
+	if m.conChan == nil {
+		return 0, errors.New("Not listening for peers")
+	}
+	if port < 0 || port > 65535 {
+		return 0, fmt.Errorf("Bad port %d", port)
+	}
+	var ip net.IP
+	if e := m.run(func() {
+		if m.listener != nil {
+			ip = m.listener.ip
+		}
+	}); e != nil {
+		return 0, e
+	}
+	l, err := createListener(m.flags, listenAddress{ip: ip, ports: []int{port}}, 1, ip == nil || ip.To4() != nil)
+	if err != nil {
+		return
+	}
+	if e := m.run(func() { m.useListener(l) }); e != nil {
+		l.Close()
+		return 0, e
+	}
+	log.Println("Moved the peer listener to port", l.port)
+	return l.externalPort, nil
+}
+
+// Starts taking peers from l, in place of the listener we had.
+func (m *sessionManager) useListener(l *peerListener) {
+	old := m.listener
+	m.listener = l
+	go l.accept(m.conChan)
+	if old != nil {
+		go old.Close()
+	}
+	m.useExternalPort(l.externalPort)
+	m.followNAT(l)
+}
+
+// Tells peers the new port whenever l's NAT moves it, and counts what the NAT
+// says our address is alongside what peers and trackers say.
+func (m *sessionManager) followNAT(l *peerListener) {
+	l.followNAT(func(port int) {
+		m.run(func() {
+			if m.listener == l {
+				m.useExternalPort(port)
+			}
+		})
+	}, func(ip net.IP) {
+		m.externalAddr.Vote("nat", ip)
+	})
+}
+
+// Pauses every torrent while the bind interface has no address, since
+// nothing can get out, and resumes the ones we paused once it's back.
+func (m *sessionManager) bindChanged(ip net.IP) {
+	if ip == nil {
+		log.Println("The bind interface", m.flags.Bind, "lost its address, so pausing every torrent")
+		m.bindPaused = make(map[*TorrentSession]bool)
+		for _, ts := range m.sessions {
+			m.bindPause(ts)
+		}
+		return
+	}
+	log.Println("The bind interface", m.flags.Bind, "has address", ip)
+	for ts := range m.bindPaused {
+		go ts.Resume()
+	}
+	m.bindPaused = nil
+}
+
+func (m *sessionManager) bindPause(ts *TorrentSession) {
+	if !ts.Paused() {
+		m.bindPaused[ts] = true
+		go ts.Pause()
+	}
+}
+
+func (m *sessionManager) useExternalPort(port int) {
+	changed := port != m.listenPort
+	m.listenPort = port
+	m.announceAddrs = announceAddrsFor(m.listeners())
+	for _, ts := range m.sessions {
+		go ts.setListenPort(uint16(port), m.announceAddrs)
+	}
+	if m.krpc != nil {
+		m.krpc.setPort(port)
+	}
+	if changed {
+		m.reachability.state = REACHABILITY_UNKNOWN
+		go m.testReachability()
+	}
+}
+
+// forget deletes what we saved about the torrent.
+func (ts *TorrentSession) forget() {
+	os.Remove(resumeDataPath(ts.flags.DataDir, ts.M.InfoHash))
+	ts.forgetVerified()
+	if ts.flags.SaveSession {
+		os.Remove(savedMetaInfoPath(sessionTorrentsDir(ts.flags.DataDir), ts.M.InfoHash))
+	}
+	if ts.webSeedState != nil {
+		os.Remove(ts.webSeedState.path)
+	}
+}
+
+// RemoveErrors lists the files that couldn't be deleted.
+type RemoveErrors []error
+
+func (e RemoveErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return "Couldn't delete: " + strings.Join(s, "; ")
+}
+
+// removeFiles deletes the torrent's files, and the directories that leaves
+// empty. It carries on past files it can't delete, and returns them all.
+// Cross-seeded files used where they are belong to something else, so
+// they're kept.
+func (ts *TorrentSession) removeFiles() (errs RemoveErrors) {
+	remover, ok := ts.fileSystem.(fileRemover)
+	if !ok {
+		return
+	}
+	info := ts.M.storeInfo()
+	files := info.Files
+	if len(files) == 0 {
+		files = []FileDict{{Path: []string{info.Name}}}
+	}
+	for _, f := range files {
+		if f.Attr == "p" {
+			continue
+		}
+		err := remover.Remove(f.Path)
+		if pe, ok := err.(*os.PathError); ok && pe.Err == errNotOurs {
+			log.Println("[", ts.M.Info.Name, "] Keeping", pe.Path+",", "it was there before")
+		} else if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	if ts.dir != "" {
+		// Whatever's left, like empty directories.
+		if err := os.Remove(ts.dir); err != nil && !os.IsNotExist(err) {
+			log.Println("[", ts.M.Info.Name, "] Left", ts.dir, "behind:", err)
+		}
+	}
+	return
+}
+
+// A FileSystem that can delete its files.
+type fileRemover interface {
+	Remove(name []string) error
+}
@@ -0,0 +1,306 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionManagerForcedQuit(t *testing.T) {
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1}, 0)
+	m.conChan = make(chan *BtConn)
+	// A session that never finishes quitting.
+	stuck := &TorrentSession{M: &MetaInfo{InfoHash: "ih", Info: InfoDict{Name: "stuck"}}}
+	m.sessions[stuck.M.InfoHash] = stuck
+	m.byHash[stuck.M.InfoHash] = stuck
+	m.active = 1
+	quitChan := make(chan os.Signal, 1)
+	go m.loop(quitChan)
+
+	if err := m.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddTorrent("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"); err != errManagerEnded {
+		t.Errorf("Adding while quitting: %v", err)
+	}
+	// Peers aren't let in while quitting.
+	ours, theirs := net.Pipe()
+	m.conChan <- &BtConn{conn: ours, Infohash: "ih"}
+	theirs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := theirs.Read(make([]byte, 1)); err == nil {
+		t.Error("A peer got in while quitting")
+	}
+
+	// A second interrupt quits without waiting.
+	quitChan <- os.Interrupt
+	select {
+	case <-m.ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Still waiting for the stuck session")
+	}
+}
+
+func TestSessionManagerContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := newSessionManager(ctx, &TorrentFlags{MaxActive: 1}, 0)
+	m.stayUp = true
+	go m.loop(nil)
+	cancel()
+	select {
+	case <-m.ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Still running after the context was cancelled")
+	}
+}
+
+func TestAddTorrentFromBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addBytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeWebSeedFiles(t, filepath.Join(dir, "files"), 20000, 10000)
+	meta, err := CreateTorrent(filepath.Join(dir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if err = meta.Bencode(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		TrackerlessMode:    true,
+		SeedRatio:          math.Inf(0),
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+
+	if _, err = m.AddTorrentFromBytes([]byte("d4:infoe")); err == nil {
+		t.Error("Added a torrent without an info dictionary")
+	}
+	bad := *meta
+	bad.Info.Files = append([]FileDict(nil), meta.Info.Files...)
+	bad.Info.Files[0].Path = []string{"..", "escape"}
+	bad.rawInfo = nil
+	var badData bytes.Buffer
+	if err = bad.Bencode(&badData); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.AddTorrentFromBytes(badData.Bytes()); err == nil {
+		t.Error("Added a torrent with a path outside its directory")
+	}
+
+	ih, err := m.AddTorrentFromReader(bytes.NewReader(data.Bytes()))
+	if err != nil || ih != meta.InfoHash {
+		t.Fatalf("Adding the torrent: %x %v", ih, err)
+	}
+	if _, err = m.AddTorrentFromBytes(data.Bytes()); err != errDuplicateTorrent {
+		t.Errorf("Adding it again: %v", err)
+	}
+	waitForComplete(t, m, ih)
+	// The path route reads the same way.
+	torrentFile := filepath.Join(dir, "files.torrent")
+	if err = ioutil.WriteFile(torrentFile, data.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.AddTorrent(torrentFile); err != errDuplicateTorrent {
+		t.Errorf("Adding it by path: %v", err)
+	}
+}
+
+// Waits for the manager's session for ih to have every piece.
+func waitForComplete(t *testing.T, m *sessionManager, ih string) {
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		ts, _, err := m.Torrent(ih)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts != nil {
+			s, err := ts.Status()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.GoodPieces == s.Pieces {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the session")
+		}
+	}
+}
+
+// Waits for the manager to have no torrents.
+func waitForNoTorrents(t *testing.T, m *sessionManager) {
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		statuses, err := m.Statuses()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the torrents to stop")
+		}
+	}
+}
+
+func TestRemoveTorrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := filepath.Join(dir, "files")
+	writeWebSeedFiles(t, files, 20000, 10000)
+	meta, err := CreateTorrent(files, &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if err = meta.Bencode(&data); err != nil {
+		t.Fatal(err)
+	}
+	dataDir := filepath.Join(dir, "data")
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		QuickResume:        true,
+		DataDir:            dataDir,
+		TrackerlessMode:    true,
+		SeedRatio:          math.Inf(0),
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	add := func() {
+		if _, err := m.AddTorrentFromBytes(data.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		waitForComplete(t, m, meta.InfoHash)
+	}
+
+	add()
+	if err = m.RemoveTorrent(meta.InfoHash, false); err != nil {
+		t.Fatal(err)
+	}
+	waitForNoTorrents(t, m)
+	if _, err = os.Stat(resumeDataPath(dataDir, meta.InfoHash)); !os.IsNotExist(err) {
+		t.Error("The resume data wasn't removed:", err)
+	}
+	if _, err = os.Stat(filepath.Join(files, "a")); err != nil {
+		t.Error("Removing without deleting the data deleted it:", err)
+	}
+
+	add()
+	if err = m.RemoveTorrent(meta.InfoHash, true); err != nil {
+		t.Fatal(err)
+	}
+	waitForNoTorrents(t, m)
+	if _, err = os.Stat(files); !os.IsNotExist(err) {
+		t.Error("The torrent's directory is still there:", err)
+	}
+	if _, err = os.Stat(dir); err != nil {
+		t.Error("The download directory went too:", err)
+	}
+}
+
+func TestRemoveFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "removeFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "download", "t")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "sub"), outside} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name string) {
+		if err := ioutil.WriteFile(name, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(root, "sub", "ours"))
+	write(filepath.Join(outside, "crossSeeded"))
+	write(filepath.Join(outside, "linked"))
+	if err = os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	ts := &TorrentSession{
+		M: &MetaInfo{Info: InfoDict{Name: "t", Files: []FileDict{
+			{Path: []string{"sub", "ours"}},
+			{Path: []string{"crossSeeded"}},
+			{Path: []string{"link", "linked"}},
+			{Path: []string{"missing"}},
+		}}},
+		dir: root,
+		fileSystem: &crossSeedFileSystem{&osFileSystem{root},
+			map[string]string{"crossSeeded": filepath.Join(outside, "crossSeeded")}},
+	}
+	errs := ts.removeFiles()
+	if len(errs) != 1 {
+		t.Fatalf("Errors %v", errs)
+	}
+	if pe, ok := errs[0].(*os.PathError); !ok || pe.Err != errOutsideRoot {
+		t.Errorf("Deleting through the symlink: %v", errs[0])
+	}
+	if _, err = os.Stat(filepath.Join(root, "sub")); !os.IsNotExist(err) {
+		t.Error("The torrent's file or its directory is still there:", err)
+	}
+	for _, f := range []string{"crossSeeded", "linked"} {
+		if _, err = os.Stat(filepath.Join(outside, f)); err != nil {
+			t.Errorf("%s was deleted: %v", f, err)
+		}
+	}
+}
+
+func TestCheckFileDir(t *testing.T) {
+	m := newSessionManager(context.Background(), &TorrentFlags{FileDir: "/downloads", MaxActive: 1}, 0)
+	multi := &TorrentSession{M: &MetaInfo{InfoHash: "a", Info: InfoDict{Name: "album"}}}
+	multi.content.Store("/downloads/album")
+	m.sessions["a"] = multi
+	// Its metadata hasn't come yet.
+	m.sessions["b"] = &TorrentSession{M: &MetaInfo{InfoHash: "b"}}
+	m.adding["c"] = &addingTorrent{name: "film", dir: "/media"}
+
+	for dir, ok := range map[string]bool{
+		"/downloads":             true,
+		"/downloads/albums":      true,
+		"/downloads/album":       false,
+		"/downloads/album/extra": false,
+		"/media/film":            false,
+		"/media":                 true,
+	} {
+		if err := m.checkFileDir(dir); (err == nil) != ok {
+			t.Errorf("%s: %v", dir, err)
+		}
+	}
+}
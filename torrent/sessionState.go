@@ -0,0 +1,292 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Session state: with SaveSession, which torrents we have, and how they were
+// set up, so that restarting adds them again without being told. It goes in
+// DataDir, beside the torrents' resume data, which says which pieces they
+// have.
+
+// Bumped whenever sessionState changes in a way older versions can't read.
+const SESSION_STATE_VERSION = 1
+
+// How often the session state is saved, besides when we quit.
+const SESSION_SAVE_INTERVAL = time.Minute
+
+var errBadSavedTorrent = errors.New("The saved torrent has another info-hash")
+
+type sessionState struct {
+	path     string
+	Version  int
+	Torrents []savedTorrent
+	// Every torrent's transfers, over every session, including torrents
+	// since removed.
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// A torrent we had. Its .torrent file is saved in the torrents directory,
+// once we have it.
+type savedTorrent struct {
+	InfoHash string // In hex
+	Magnet   string // What it was added as, for a magnet link we have no metadata for
+	Dir      string // Where its files go, if not under the -fileDir
+	Paused   bool
+	// Its share of the rate limits, "high", "normal" or "low". Older state
+	// files have none, which is normal.
+	BandwidthPriority string
+	// The providers it chose to be stored with, if any.
+	Storage StorageProviders
+	// Tiers of trackers added to it by magnet links since it was added.
+	Trackers [][]string `json:",omitempty"`
+	Labels   []string   `json:",omitempty"`
+}
+
+// Bytes a session had transferred when we last counted them.
+type transferred struct {
+	uploaded, downloaded uint64
+}
+
+func sessionStatePath(dataDir string) string {
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return filepath.Join(dataDir, "session.json")
+}
+
+// Where the torrents' .torrent files are saved, named by info-hash.
+func sessionTorrentsDir(dataDir string) string {
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return filepath.Join(dataDir, "torrents")
+}
+
+// Returns an empty state if there's none. A state file we can't read is
+// kept as a .bak, rather than overwritten when we next save.
+func loadSessionState(dataDir string) (s *sessionState) {
+	s = &sessionState{path: sessionStatePath(dataDir), Version: SESSION_STATE_VERSION}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var saved sessionState
+	if err == nil {
+		if err = json.Unmarshal(data, &saved); err == nil && saved.Version != SESSION_STATE_VERSION {
+			err = fmt.Errorf("It's from version %d", saved.Version)
+		}
+	}
+	if err != nil {
+		log.Println("Ignoring session state", s.path+":", err)
+		if err = os.Rename(s.path, s.path+".bak"); err != nil {
+			log.Println("Couldn't keep the session state:", err)
+		}
+		return
+	}
+	saved.path = s.path
+	return &saved
+}
+
+func (s *sessionState) save() (err error) {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(s.path, ".session", data)
+}
+
+// Writes data to a temporary file beside path, named from prefix, and then
+// renames it over path, so that path is never half written.
+func writeFileAtomic(path, prefix string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+// Saves the torrent's .torrent file, for restoreSession. Magnet links have
+// none until their metadata comes.
+func (ts *TorrentSession) saveForSession() {
+	if !ts.flags.SaveSession || !ts.Session.HaveTorrent {
+		return
+	}
+	if err := saveMetaInfo(sessionTorrentsDir(ts.flags.DataDir), ts.M); err != nil {
+		log.Println("[", ts.M.Info.Name, "] Couldn't save the torrent for the next session:", err)
+	}
+}
+
+// Adds the torrents of the saved session. Called before the loop starts.
+func (m *sessionManager) restoreSession() {
+	state := loadSessionState(m.flags.DataDir)
+	m.uploaded, m.downloaded = state.Uploaded, state.Downloaded
+	m.sessionStart = transferred{state.Uploaded, state.Downloaded}
+	for _, t := range state.Torrents {
+		ih, err := hex.DecodeString(t.InfoHash)
+		if err != nil || len(ih) != 20 {
+			log.Println("Ignoring a saved torrent with info-hash", t.InfoHash)
+			continue
+		}
+		torrent := ""
+		meta, err := GetMetaInfo(nil, savedMetaInfoPath(sessionTorrentsDir(m.flags.DataDir), string(ih)))
+		if os.IsNotExist(err) && strings.HasPrefix(t.Magnet, "magnet:") {
+			torrent = t.Magnet
+			meta, err = GetMetaInfo(nil, torrent)
+		}
+		if err == nil && !meta.hasInfoHash(string(ih)) {
+			err = errBadSavedTorrent
+		}
+		if err != nil {
+			log.Println("Couldn't restore torrent", t.InfoHash+":", err)
+			continue
+		}
+		if m.adding[meta.InfoHash] != nil {
+			continue
+		}
+		storage, err := m.storage(t.Storage)
+		if err != nil {
+			log.Println("Couldn't restore", meta.Info.Name+":", err)
+			continue
+		}
+		log.Println("Restoring", meta.Info.Name)
+		a := &addingTorrent{torrent: torrent, meta: meta, name: meta.Info.Name, dir: t.Dir, paused: t.Paused,
+			priority: t.BandwidthPriority, restored: true, storage: storage, trackers: t.Trackers}
+		if a.labels, err = cleanLabels(t.Labels); err != nil {
+			log.Println("Ignoring", meta.Info.Name+"'s saved labels:", err)
+		}
+		m.adding[meta.InfoHash] = a
+		m.add(a)
+	}
+}
+
+// The state to save: the torrents we have, and those being added.
+func (m *sessionManager) sessionState() *sessionState {
+	s := &sessionState{path: sessionStatePath(m.flags.DataDir), Version: SESSION_STATE_VERSION,
+		Uploaded: m.uploaded, Downloaded: m.downloaded}
+	for ih, ts := range m.sessions {
+		if _, ok := m.removing[ts]; ok {
+			continue
+		}
+		t := savedTorrent{InfoHash: hex.EncodeToString([]byte(ih)), Paused: ts.Paused() && !ts.Queued(),
+			BandwidthPriority: ts.BandwidthPriority(), Storage: ts.storage.StorageProviders, Labels: ts.Labels()}
+		t.Trackers, _ = ts.addedTrackers.Load().([][]string)
+		if strings.HasPrefix(ts.torrentFile, "magnet:") {
+			t.Magnet = ts.torrentFile
+		}
+		if ts.fileDir != m.flags.FileDir {
+			t.Dir = ts.fileDir
+		}
+		s.Torrents = append(s.Torrents, t)
+	}
+	for ih, a := range m.adding {
+		if a.err != nil || a.remove {
+			continue
+		}
+		t := savedTorrent{InfoHash: hex.EncodeToString([]byte(ih)), Dir: a.dir, Paused: a.paused,
+			BandwidthPriority: a.priority, Storage: a.storage.StorageProviders, Trackers: a.trackers, Labels: a.labels}
+		if strings.HasPrefix(a.torrent, "magnet:") {
+			t.Magnet = a.torrent
+		}
+		s.Torrents = append(s.Torrents, t)
+	}
+	// Saved in the order they were added, so they're restored that way.
+	// The ones still being added go last.
+	added := make(map[string]time.Time)
+	for ih, ts := range m.sessions {
+		added[hex.EncodeToString([]byte(ih))] = ts.added()
+	}
+	sort.SliceStable(s.Torrents, func(i, j int) bool {
+		ai, iok := added[s.Torrents[i].InfoHash]
+		aj, jok := added[s.Torrents[j].InfoHash]
+		if iok != jok {
+			return iok
+		}
+		return ai.Before(aj)
+	})
+	return s
+}
+
+// Counts what the session's transferred since we last looked.
+func (m *sessionManager) count(ts *TorrentSession, uploaded, downloaded uint64) {
+	c, ok := m.transferred[ts]
+	if !ok {
+		return
+	}
+	if uploaded > c.uploaded {
+		m.uploaded += uploaded - c.uploaded
+	}
+	if downloaded > c.downloaded {
+		m.downloaded += downloaded - c.downloaded
+	}
+	m.transferred[ts] = transferred{uploaded, downloaded}
+}
+
+// Counts the sessions' transfers and saves the state. It asks the sessions
+// for their counts outside the manager's loop, so they don't hold it up.
+func (m *sessionManager) saveSession() {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	torrents, err := m.Torrents()
+	if err != nil {
+		return
+	}
+	statuses := make(map[*TorrentSession]TorrentStatus)
+	for _, ts := range torrents {
+		if s, err := ts.Status(); err == nil {
+			statuses[ts] = s
+		}
+	}
+	var s *sessionState
+	if m.run(func() {
+		for ts, status := range statuses {
+			m.count(ts, status.Uploaded, status.Downloaded)
+		}
+		s = m.sessionState()
+	}) != nil {
+		return
+	}
+	if err = s.save(); err != nil {
+		log.Println("Couldn't save the session state:", err)
+	}
+}
+
+// Saves the state once the loop's done. Quitting took the list of torrents
+// before they stopped, and they've all been counted since.
+func (m *sessionManager) saveFinalSession() {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	s := m.quitState
+	if s == nil {
+		s = m.sessionState()
+	}
+	s.Uploaded, s.Downloaded = m.uploaded, m.downloaded
+	if err := s.save(); err != nil {
+		log.Println("Couldn't save the session state:", err)
+	}
+}
@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSessionStateCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessionState")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := sessionStatePath(dir)
+	if s := loadSessionState(dir); len(s.Torrents) != 0 || s.path != path {
+		t.Errorf("Without a state file, loaded %+v", s)
+	}
+	for _, data := range []string{"{not json", `{"Version": 100, "Torrents": [{"InfoHash": "ab"}]}`} {
+		if err = ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if s := loadSessionState(dir); len(s.Torrents) != 0 {
+			t.Errorf("With state %q, loaded %+v", data, s)
+		}
+		if kept, err := ioutil.ReadFile(path + ".bak"); err != nil || string(kept) != data {
+			t.Errorf("Kept %q, %v", kept, err)
+		}
+	}
+
+	s := &sessionState{path: path, Version: SESSION_STATE_VERSION, Uploaded: 7,
+		Torrents: []savedTorrent{{InfoHash: "ab", Dir: "/media", Paused: true, BandwidthPriority: BANDWIDTH_LOW,
+			Trackers: [][]string{{"udp://tracker.example:6969"}}}}}
+	if err = s.save(); err != nil {
+		t.Fatal(err)
+	}
+	if l := loadSessionState(dir); l.Uploaded != 7 || len(l.Torrents) != 1 || !reflect.DeepEqual(l.Torrents[0], s.Torrents[0]) {
+		t.Errorf("Saved %+v, loaded %+v", s, l)
+	}
+}
+
+func TestRestoreSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restoreSession")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeWebSeedFiles(t, filepath.Join(dir, "files"), 20000, 10000)
+	meta, err := CreateTorrent(filepath.Join(dir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if err = meta.Bencode(&data); err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	if err = ioutil.WriteFile(torrentFile, data.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	flags := &TorrentFlags{
+		FileDir:            filepath.Join(dir, "downloads"),
+		DataDir:            filepath.Join(dir, "data"),
+		SaveSession:        true,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		TrackerlessMode:    true,
+		SeedRatio:          math.Inf(0),
+		MaxActive:          2,
+		MemoryPerTorrent:   -1,
+	}
+	start := func() *sessionManager {
+		m := newSessionManager(context.Background(), flags, 0)
+		m.stayUp = true
+		go m.createSessions()
+		m.restoreSession()
+		// Given again, as if on the command line.
+		m.add(&addingTorrent{torrent: torrentFile})
+		go m.loop(nil)
+		return m
+	}
+	stop := func(m *sessionManager) {
+		m.Quit()
+		<-m.ended
+		m.saveFinalSession()
+	}
+
+	m := newSessionManager(context.Background(), flags, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	if _, err = m.AddTorrentFromBytesWith(data.Bytes(), AddOptions{Dir: dir, Labels: []string{"kept"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitForComplete(t, m, meta.InfoHash)
+	ts, _, _ := m.Torrent(meta.InfoHash)
+	if err = ts.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	stop(m)
+
+	// It comes back where it was, paused and labelled, and the command
+	// line's copy is turned away.
+	m = start()
+	waitForComplete(t, m, meta.InfoHash)
+	statuses, err := m.Statuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || !statuses[0].Paused || statuses[0].FileDir != dir || !reflect.DeepEqual(statuses[0].Labels, []string{"kept"}) {
+		t.Errorf("Restored %+v", statuses)
+	}
+	if stats, err := m.Stats(); err != nil || stats.Torrents != 1 || stats.Paused != 1 {
+		t.Errorf("Stats %+v, %v", stats, err)
+	}
+
+	// Removed, it's forgotten.
+	if err = m.RemoveTorrent(meta.InfoHash, false); err != nil {
+		t.Fatal(err)
+	}
+	waitForNoTorrents(t, m)
+	stop(m)
+	if s := loadSessionState(flags.DataDir); len(s.Torrents) != 0 {
+		t.Errorf("After removing it, saved %+v", s.Torrents)
+	}
+	if _, err = os.Stat(savedMetaInfoPath(sessionTorrentsDir(flags.DataDir), meta.InfoHash)); !os.IsNotExist(err) {
+		t.Errorf("Kept its .torrent file: %v", err)
+	}
+}
+
+func TestSessionTotals(t *testing.T) {
+	m := newSessionManager(context.Background(), &TorrentFlags{MaxActive: 1}, 0)
+	m.uploaded = 100
+	ts := &TorrentSession{}
+	m.transferred[ts] = transferred{10, 20}
+	m.count(ts, 15, 20)
+	m.count(ts, 25, 30)
+	if m.uploaded != 115 || m.downloaded != 10 {
+		t.Errorf("Counted %d up and %d down", m.uploaded, m.downloaded)
+	}
+	// Sessions we don't know the start of aren't counted.
+	m.count(&TorrentSession{}, 1000, 1000)
+	if m.uploaded != 115 {
+		t.Errorf("Counted %d up", m.uploaded)
+	}
+}
@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"sort"
+	"time"
+)
+
+// SessionStats is how all the torrents are doing, together.
+type SessionStats struct {
+	// What every torrent has transferred since we started, including ones
+	// since removed.
+	Downloaded uint64
+	Uploaded   uint64
+	// And over every session, with SaveSession. Without it, the same as
+	// this session's.
+	LifetimeDownloaded uint64
+	LifetimeUploaded   uint64
+	Ratio              float64 // Lifetime uploaded over downloaded
+	DownloadRate       float64 // The torrents' rates, added up
+	UploadRate         float64
+	// Everything through the connections to peers and web seeds, protocol
+	// messages and all. Averaged over the same half-life.
+	WireDownloadRate float64
+	WireUploadRate   float64
+	// Every torrent's, this session, including removed ones.
+	Overhead Overhead
+
+	// How many torrents there are, and how many are in each state.
+	Torrents    int
+	Downloading int
+	Seeding     int
+	Paused      int
+	Queued      int // Waiting for a download or seed slot
+	Checking    int
+	Adding      int // Being added, or waiting to be
+	Errored     int // Couldn't be added
+
+	Disk DiskUsage // With MaxDiskUsage
+
+	PieceMemory int64 // Bytes the torrents' active pieces take, together
+}
+
+// Adds up the torrents' rates, and counts them by state.
+func (s *SessionStats) tally(statuses []TorrentStatus) {
+	s.Torrents = len(statuses)
+	for _, t := range statuses {
+		s.DownloadRate += t.DownloadRate
+		s.UploadRate += t.UploadRate
+		s.Overhead.add(t.Overhead)
+		switch t.State() {
+		case "error":
+			s.Errored++
+		case "adding":
+			s.Adding++
+		case "checking":
+			s.Checking++
+		case "queued":
+			s.Queued++
+		case "paused":
+			s.Paused++
+		case "seeding":
+			s.Seeding++
+		default:
+			s.Downloading++
+		}
+	}
+}
+
+// Stats says how all the torrents are doing.
+func (m *sessionManager) Stats() (s SessionStats, err error) {
+	s, _, err = m.statsAndStatuses()
+	return
+}
+
+// The session's stats, and every torrent's status, like Statuses. Counting
+// what the sessions have transferred since we last looked folds it into the
+// lifetime counts, as saving the session state does.
+func (m *sessionManager) statsAndStatuses() (s SessionStats, statuses []TorrentStatus, err error) {
+	torrents, err := m.Torrents()
+	if err != nil {
+		return
+	}
+	// Asked outside the manager's loop, so they don't hold it up.
+	for _, ts := range torrents {
+		if status, e := ts.Status(); e == nil {
+			statuses = append(statuses, status)
+		} else {
+			statuses = append(statuses, TorrentStatus{})
+		}
+	}
+	var adding []TorrentStatus
+	err = m.run(func() {
+		for i, ts := range torrents {
+			if statuses[i].InfoHash != "" {
+				m.count(ts, statuses[i].Uploaded, statuses[i].Downloaded)
+			}
+		}
+		s.LifetimeDownloaded, s.LifetimeUploaded = m.downloaded, m.uploaded
+		s.Downloaded = m.downloaded - m.sessionStart.downloaded
+		s.Uploaded = m.uploaded - m.sessionStart.uploaded
+		s.Disk = m.diskUsage
+		s.Overhead.add(m.removedOverhead)
+		s.PieceMemory = m.memory.Used()
+		s.WireDownloadRate, s.WireUploadRate = m.bandwidth.rates(time.Now(), rateHalfLife(m.flags))
+		for ih, a := range m.adding {
+			adding = append(adding, a.status(ih))
+		}
+	})
+	if err != nil {
+		return
+	}
+	// Sessions that ended before they could say.
+	running := statuses[:0]
+	for _, status := range statuses {
+		if status.InfoHash != "" {
+			running = append(running, status)
+		}
+	}
+	sort.Slice(adding, func(i, j int) bool { return adding[i].Name < adding[j].Name })
+	statuses = append(running, adding...)
+	if s.LifetimeDownloaded > 0 {
+		s.Ratio = float64(s.LifetimeUploaded) / float64(s.LifetimeDownloaded)
+	}
+	s.tally(statuses)
+	return
+}
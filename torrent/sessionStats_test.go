@@ -0,0 +1,28 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSessionStatsTally(t *testing.T) {
+	var s SessionStats
+	s.tally([]TorrentStatus{
+		{HaveTorrent: true, Left: 10, DownloadRate: 100},
+		{HaveTorrent: true, DownloadRate: 50, UploadRate: 20,
+			Overhead: Overhead{Received: map[string]uint64{"have": 9}, TotalReceived: 9, Duplicate: 5}},
+		{HaveTorrent: true, Paused: true},
+		{HaveTorrent: true, Paused: true, Queued: true},
+		{HaveTorrent: true, Checking: true},
+		// A magnet link waiting for its metadata is downloading it.
+		{},
+		{Adding: true},
+		{Error: "Bad torrent"},
+	})
+	want := SessionStats{DownloadRate: 150, UploadRate: 20, Torrents: 8,
+		Downloading: 2, Seeding: 1, Paused: 1, Queued: 1, Checking: 1, Adding: 1, Errored: 1,
+		Overhead: Overhead{Received: map[string]uint64{"have": 9}, Sent: map[string]uint64{}, TotalReceived: 9, Duplicate: 5}}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("Tallied %+v, not %+v", s, want)
+	}
+}
@@ -2,125 +2,307 @@ package torrent
 
 import (
 	"errors"
+	"fmt"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	pathpkg "path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-type SftpFsProvider struct {
-	Server     string
-	Username   string
-	Password   string
-	ServerPath string
+// How many SFTP channels a file system opens on its SSH connection, unless
+// its config says otherwise. Its files take turns with them.
+const SFTP_DEFAULT_CHANNELS = 4
+
+// The server didn't accept any of the ways we tried to log in.
+var ErrSftpAuth = errors.New("The SFTP server didn't accept our credentials")
+
+// The server's host key isn't the one in known_hosts, or isn't in it at all.
+var ErrSftpHostKey = errors.New("The SFTP server's host key doesn't match known_hosts")
+
+// A file or directory on the server that couldn't be made or opened.
+type SftpPathError struct {
+	Path string
+	Err  error
+}
+
+func (e *SftpPathError) Error() string {
+	return fmt.Sprintf("SFTP path %s: %v", e.Path, e.Err)
+}
+
+func (e *SftpPathError) Unwrap() error {
+	return e.Err
+}
+
+// SftpConfig says how to reach an SFTP server, and where on it torrents go.
+// At least one way of logging in is needed: Password, KeyFile or UseAgent.
+type SftpConfig struct {
+	Host string
+	Port int // 0 means 22
+	User string
+
+	Password      string
+	KeyFile       string // A private key, in PEM or OpenSSH format
+	KeyPassphrase string // If KeyFile is encrypted
+	UseAgent      bool   // Offer the keys of the ssh-agent at $SSH_AUTH_SOCK
+
+	// The known_hosts file the server's host key must be in. Empty means
+	// ~/.ssh/known_hosts. The key is never taken on trust.
+	KnownHosts string
+
+	BaseDir string // Torrents' directories go under this, on the server
+
+	// How many SFTP channels to open on the connection. 0 means
+	// SFTP_DEFAULT_CHANNELS.
+	MaxChannels int
+}
+
+func (c *SftpConfig) address() string {
+	port := c.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(c.Host, strconv.Itoa(port))
 }
 
-//Connection string:  username:password@example.com:8042/over/there/
-func NewSftpFsProvider(connection string) SftpFsProvider {
-	connSA := strings.Split(connection, "@")
-	authSA := strings.Split(connSA[0], ":")
-	serverSA := strings.SplitN(connSA[1], "/", 2)
-	path := "/"
-	if len(serverSA) == 2 { // {example.com:8042, over/there/}
-		path += serverSA[1]
+// Connection string: username[:password]@example.com[:8042]/over/there/
+func ParseSftpConnection(connection string) (c SftpConfig, err error) {
+	at := strings.LastIndex(connection, "@")
+	if at < 0 {
+		err = fmt.Errorf("SFTP connection string %q has no username@", connection)
+		return
+	}
+	c.User, c.Password, _ = strings.Cut(connection[:at], ":")
+	server, path, _ := strings.Cut(connection[at+1:], "/")
+	c.BaseDir = "/" + path
+	c.Host = server
+	if host, port, e := net.SplitHostPort(server); e == nil {
+		c.Host = host
+		if c.Port, err = strconv.Atoi(port); err != nil {
+			err = fmt.Errorf("SFTP connection string %q has a bad port", connection)
+			return
+		}
+	}
+	if c.User == "" || c.Host == "" {
+		err = fmt.Errorf("SFTP connection string %q needs a username and a host", connection)
 	}
-	sp := SftpFsProvider{
-		Username:   authSA[0],
-		Password:   authSA[1],
-		Server:     serverSA[0],
-		ServerPath: path,
+	return
+}
+
+type SftpFsProvider struct {
+	Config SftpConfig
+}
+
+// NewSftpFsProvider takes a connection string, as ParseSftpConnection does,
+// logging in with its password if it has one, or else the ssh-agent's keys.
+func NewSftpFsProvider(connection string) (*SftpFsProvider, error) {
+	c, err := ParseSftpConnection(connection)
+	if err != nil {
+		return nil, err
 	}
-	return sp
+	c.UseAgent = true
+	return &SftpFsProvider{c}, nil
 }
 
-func (o SftpFsProvider) NewFS(directory string) (fs FileSystem, err error) {
+func (o *SftpFsProvider) NewFS(directory string) (fs FileSystem, err error) {
 	sftpfs := &SftpFileSystem{
-		sp:               o,
+		config:           o.Config,
 		torrentDirectory: directory,
-		closed:           true,
 	}
-
-	return sftpfs, sftpfs.Connect()
+	if err = sftpfs.Connect(); err != nil {
+		return nil, err
+	}
+	return sftpfs, nil
 }
 
+// SftpFileSystem keeps its files on an SFTP server, over one SSH
+// connection. Its files share a few SFTP channels on it, each file keeping
+// to the one it was opened on.
 type SftpFileSystem struct {
-	sp               SftpFsProvider
+	config           SftpConfig
 	torrentDirectory string
-	sftpClient       *sftp.Client
 	sshClient        *ssh.Client
-	closed           bool //false normally, true if closed
+
+	mu       sync.Mutex
+	channels []*sftp.Client
+	next     int // Counts files opened once all the channels are
+	closed   bool
 }
 
-func (sfs *SftpFileSystem) Connect() error {
-	var auths []ssh.AuthMethod
-	if aconn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(aconn).Signers))
+func (sfs *SftpFileSystem) auths() (auths []ssh.AuthMethod, err error) {
+	c := &sfs.config
+	if c.KeyFile != "" {
+		var pemBytes []byte
+		if pemBytes, err = ioutil.ReadFile(c.KeyFile); err != nil {
+			return nil, fmt.Errorf("Couldn't read the SFTP key: %w", err)
+		}
+		var signer ssh.Signer
+		if c.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(c.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pemBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load the SFTP key %s: %w", c.KeyFile, err)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if c.UseAgent {
+		if aconn, e := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); e == nil {
+			auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(aconn).Signers))
+		}
+	}
+	if c.Password != "" {
+		auths = append(auths, ssh.Password(c.Password))
 	}
-	if len(sfs.sp.Password) != 0 {
-		auths = append(auths, ssh.Password(sfs.sp.Password))
+	if len(auths) == 0 {
+		return nil, fmt.Errorf("%w: no password, key or ssh-agent to log in with", ErrSftpAuth)
 	}
+	return
+}
 
-	config := ssh.ClientConfig{
-		User: sfs.sp.Username,
-		Auth: auths,
+func (sfs *SftpFileSystem) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	path := sfs.config.KnownHosts
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
 	}
-	var err error
-	sfs.sshClient, err = ssh.Dial("tcp", sfs.sp.Server, &config)
+	callback, err := knownhosts.New(path)
 	if err != nil {
-		log.Println("unable to connect to [%s]: %v", sfs.sp.Server, err)
-		return err
+		return nil, fmt.Errorf("Couldn't read known_hosts: %w", err)
 	}
+	return callback, nil
+}
 
-	sfs.sftpClient, err = sftp.NewClient(sfs.sshClient)
+// Connect makes the SSH connection, checking the server's host key, and
+// opens the first SFTP channel on it.
+func (sfs *SftpFileSystem) Connect() error {
+	auths, err := sfs.auths()
 	if err != nil {
-		log.Println("unable to start sftp subsytem: %v", err)
+		return err
+	}
+	known, err := sfs.hostKeyCallback()
+	if err != nil {
+		return err
+	}
+	var hostKeyErr error
+	config := ssh.ClientConfig{
+		User: sfs.config.User,
+		Auth: auths,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = known(hostname, remote, key)
+			return hostKeyErr
+		},
+	}
+	address := sfs.config.address()
+	sfs.sshClient, err = ssh.Dial("tcp", address, &config)
+	switch {
+	case err == nil:
+	case hostKeyErr != nil:
+		return fmt.Errorf("%w: %s: %v", ErrSftpHostKey, address, hostKeyErr)
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return fmt.Errorf("%w: %s as %s: %v", ErrSftpAuth, address, sfs.config.User, err)
+	default:
+		log.Printf("Unable to connect to %s: %v", address, err)
+		return err
+	}
+	if _, err = sfs.channel(); err != nil {
+		sfs.sshClient.Close()
 		return err
 	}
 	return nil
 }
 
+// The channel for the next file: a new one, until there are MaxChannels,
+// and then the ones there are, in turn.
+func (sfs *SftpFileSystem) channel() (*sftp.Client, error) {
+	sfs.mu.Lock()
+	defer sfs.mu.Unlock()
+	if sfs.closed {
+		return nil, os.ErrClosed
+	}
+	max := sfs.config.MaxChannels
+	if max <= 0 {
+		max = SFTP_DEFAULT_CHANNELS
+	}
+	if len(sfs.channels) < max {
+		c, err := sftp.NewClient(sfs.sshClient)
+		if err == nil {
+			sfs.channels = append(sfs.channels, c)
+			return c, nil
+		}
+		log.Println("Unable to start the sftp subsystem:", err)
+		if len(sfs.channels) == 0 {
+			return nil, err
+		}
+		// Make do with the ones we have.
+	}
+	c := sfs.channels[sfs.next%len(sfs.channels)]
+	sfs.next++
+	return c, nil
+}
+
 func (sfs *SftpFileSystem) translate(name []string) string {
 	path := pathpkg.Clean(sfs.torrentDirectory + "/" + pathpkg.Join(name...))
-	return pathpkg.Clean(filepath.Join(sfs.sp.ServerPath, path))
+	return pathpkg.Clean(pathpkg.Join(filepath.ToSlash(sfs.config.BaseDir), path))
 }
 
 func (sfs *SftpFileSystem) Open(name []string, length int64) (File, error) {
-	fullPath := sfs.translate(name)
-	err := sfs.ensureDirectory(fullPath)
+	client, err := sfs.channel()
 	if err != nil {
-		log.Println("Couldn't ensure directory:", fullPath)
+		return nil, err
+	}
+	fullPath := sfs.translate(name)
+	if err = sfs.ensureDirectory(client, fullPath); err != nil {
 		return nil, err
 	}
 
-	file, err := sfs.sftpClient.OpenFile(fullPath, os.O_RDWR)
+	file, err := client.OpenFile(fullPath, os.O_RDWR)
 	if err != nil {
-		file, err = sfs.sftpClient.Create(fullPath)
+		file, err = client.Create(fullPath)
 		if err != nil {
-			log.Println("Couldn't create file:", fullPath, "error:", err)
-			return nil, err
+			return nil, &SftpPathError{fullPath, err}
 		}
 	}
-	retVal := &SftpFile{file}
-	err = file.Truncate(length)
-	return retVal, err
+	if err = file.Truncate(length); err != nil {
+		file.Close()
+		return nil, &SftpPathError{fullPath, err}
+	}
+	return &SftpFile{file}, nil
 }
 
 func (sfs *SftpFileSystem) Close() (err error) {
+	sfs.mu.Lock()
+	defer sfs.mu.Unlock()
+	if sfs.closed {
+		return nil
+	}
 	sfs.closed = true
-	err = sfs.sftpClient.Close()
+	var errs []error
+	for _, c := range sfs.channels {
+		if e := c.Close(); e != nil {
+			errs = append(errs, e)
+		}
+	}
 	sfs.sshClient.Close()
-	if err != nil {
+	if err = errors.Join(errs...); err != nil {
 		log.Println("Error closing sftp client:", err)
 	}
 	return
 }
 
-func (sfs *SftpFileSystem) ensureDirectory(fullPath string) error {
+func (sfs *SftpFileSystem) ensureDirectory(client *sftp.Client, fullPath string) error {
 	fullPath = filepath.ToSlash(fullPath)
 	fullPath = pathpkg.Clean(fullPath)
 	path := strings.Split(fullPath, "/")
@@ -129,34 +311,34 @@ func (sfs *SftpFileSystem) ensureDirectory(fullPath string) error {
 	total := ""
 	for _, str := range path {
 		total += str + "/"
-		sfs.sftpClient.Mkdir(total)
+		client.Mkdir(total)
 		//We're not too concerned with if Mkdir gave an error, since it could just be that the
 		//directory already exists. And if not, then the final Stat call will error out anyway.
 	}
-	fi, err := sfs.sftpClient.Lstat(total)
+	fi, err := client.Lstat(total)
 	if err != nil {
-		return err
+		return &SftpPathError{total, err}
 	}
 
 	if fi.IsDir() {
 		return nil
 	}
 
-	return errors.New("Part of path isn't a directory! path=" + total)
+	return &SftpPathError{total, errors.New("Part of path isn't a directory")}
 }
 
+// SftpFile reads and writes at offsets, without a file position, so that
+// more than one goroutine can use it at once.
 type SftpFile struct {
 	file *sftp.File
 }
 
 func (sff *SftpFile) ReadAt(p []byte, off int64) (n int, err error) {
-	sff.file.Seek(off, os.SEEK_SET)
-	return sff.file.Read(p)
+	return sff.file.ReadAt(p, off)
 }
 
 func (sff *SftpFile) WriteAt(p []byte, off int64) (n int, err error) {
-	sff.file.Seek(off, os.SEEK_SET)
-	return sff.file.Write(p)
+	return sff.file.WriteAt(p, off)
 }
 
 func (sff *SftpFile) Close() error {
@@ -0,0 +1,239 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// A throwaway SSH server that serves SFTP, rooted nowhere in particular, so
+// tests use absolute paths under a temporary directory.
+type testSftpServer struct {
+	listener net.Listener
+	hostKey  ssh.PublicKey
+	channels int32 // SFTP subsystems started
+}
+
+func newTestSftpServer(t *testing.T, password string, userKey ssh.PublicKey) *testSftpServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if password != "" && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("Wrong password")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if userKey != nil && bytes.Equal(key.Marshal(), userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("Unknown key")
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSftpServer{listener: l, hostKey: signer.PublicKey()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testSftpServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "Sessions only")
+			continue
+		}
+		channel, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					atomic.AddInt32(&s.channels, 1)
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						go func() {
+							server.Serve()
+							server.Close()
+						}()
+					}
+				}
+			}
+		}()
+	}
+}
+
+func (s *testSftpServer) config(t *testing.T, dir string) SftpConfig {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.listener.Addr().String())}, s.hostKey)
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return SftpConfig{Host: host, Port: p, User: "test", KnownHosts: knownHosts,
+		BaseDir: filepath.Join(dir, "remote")}
+}
+
+// A passphrase protected key logs in, and files opened at once share the
+// configured number of channels while they're read and written together.
+func TestSftpKeyAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	userKey, _ := ssh.NewPublicKey(pub)
+	s := newTestSftpServer(t, "", userKey)
+	defer s.listener.Close()
+	config := s.config(t, dir)
+	config.KeyFile, config.KeyPassphrase, config.MaxChannels = keyFile, "secret", 2
+	fs, err := (&SftpFsProvider{config}).NewFS("torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	const files = 5
+	var wg sync.WaitGroup
+	for i := 0; i < files; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := fs.Open([]string{"sub", strconv.Itoa(i)}, 1000)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			want := bytes.Repeat([]byte{byte(i)}, 100)
+			for off := int64(0); off < 1000; off += 100 {
+				if _, err := f.WriteAt(want, off); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			got := make([]byte, 100)
+			if _, err := f.ReadAt(got, 900); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("File %d: read %v, %v", i, got[:4], err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&s.channels); n != 2 {
+		t.Errorf("%d SFTP channels", n)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "remote", "torrent", "sub", "3")); err != nil || fi.Size() != 1000 {
+		t.Errorf("The file on the server: %v, %v", fi, err)
+	}
+}
+
+// A server whose host key isn't in known_hosts, a wrong password and a path
+// that can't be made each fail in their own way.
+func TestSftpErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newTestSftpServer(t, "right", nil)
+	defer s.listener.Close()
+	config := s.config(t, dir)
+
+	config.Password = "wrong"
+	if _, err = (&SftpFsProvider{config}).NewFS("t"); !errors.Is(err, ErrSftpAuth) {
+		t.Errorf("A wrong password: %v", err)
+	}
+
+	config.Password = "right"
+	impostor := newTestSftpServer(t, "right", nil)
+	defer impostor.listener.Close()
+	config.Port = impostor.listener.Addr().(*net.TCPAddr).Port
+	if _, err = (&SftpFsProvider{config}).NewFS("t"); !errors.Is(err, ErrSftpHostKey) {
+		t.Errorf("A server with another host key: %v", err)
+	}
+
+	config.Port = s.listener.Addr().(*net.TCPAddr).Port
+	if err = os.MkdirAll(config.BaseDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(config.BaseDir, "t"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := (&SftpFsProvider{config}).NewFS("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	var pathErr *SftpPathError
+	if _, err = fs.Open([]string{"f"}, 10); !errors.As(err, &pathErr) {
+		t.Errorf("A path under a file: %v", err)
+	}
+}
+
+func TestParseSftpConnection(t *testing.T) {
+	c, err := ParseSftpConnection("me:pass:word@example.com:8042/over/there/")
+	if err != nil || c.User != "me" || c.Password != "pass:word" || c.Host != "example.com" ||
+		c.Port != 8042 || c.BaseDir != "/over/there/" {
+		t.Errorf("%+v, %v", c, err)
+	}
+	if c, err = ParseSftpConnection("me@example.com"); err != nil || c.Password != "" || c.address() != "example.com:22" {
+		t.Errorf("%+v, %v", c, err)
+	}
+	for _, bad := range []string{"example.com/x", "me@example.com:port/x", "@example.com"} {
+		if _, err = ParseSftpConnection(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A SpeedSchedule says when the alternative rate limits are in force. It's
+// a list of weekly periods, written like "Mon-Fri 09:00-18:00; Sat 10:00-12:00".
+// A period that ends before it starts runs past midnight, into the next day.
+//
+// Periods are in local wall clock time, and the schedule is checked against
+// the clock rather than timed, so DST changes just move the switch along with
+// the clock: a period starting in the hour that's skipped starts when the
+// clock jumps past it.
+type SpeedSchedule []SpeedPeriod
+
+type SpeedPeriod struct {
+	Days       [7]bool // Indexed by time.Weekday
+	Start, End int     // Minutes after midnight. End can be 24:00.
+}
+
+// Parses a day's name, or the start of it, like "Mon".
+func parseWeekday(s string) (d int, err error) {
+	s = strings.ToLower(s)
+	for d = 0; d < 7; d++ {
+		if len(s) >= 3 && strings.HasPrefix(strings.ToLower(time.Weekday(d).String()), s) {
+			return
+		}
+	}
+	return 0, fmt.Errorf("Unknown day %q", s)
+}
+
+// Parses a list of days, like "Mon-Fri", "Sat,Sun" or "*".
+func parseDays(s string) (days [7]bool, err error) {
+	if s == "*" || strings.EqualFold(s, "daily") {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		var first, last int
+		if first, err = parseWeekday(from); err != nil {
+			return
+		}
+		if last, err = parseWeekday(to); err != nil {
+			return
+		}
+		// Ranges can wrap around the week, like Sat-Mon.
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return
+}
+
+func parseClock(s string) (minutes int, err error) {
+	var h, m int
+	if _, err = fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("Bad time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// ParseSpeedSchedule parses a schedule like "Mon-Fri 09:00-18:00; Sat,Sun 10:00-12:00".
+func ParseSpeedSchedule(s string) (schedule SpeedSchedule, err error) {
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Bad schedule entry %q, want days and a time range", strings.TrimSpace(entry))
+		}
+		var p SpeedPeriod
+		if p.Days, err = parseDays(fields[0]); err != nil {
+			return nil, err
+		}
+		times := strings.Split(fields[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("Bad time range %q", fields[1])
+		}
+		if p.Start, err = parseClock(times[0]); err != nil {
+			return nil, err
+		}
+		if p.End, err = parseClock(times[1]); err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, p)
+	}
+	return
+}
+
+// Active says whether t, in local time, falls in one of the periods.
+func (s SpeedSchedule) Active(t time.Time) bool {
+	t = t.Local()
+	day := int(t.Weekday())
+	yesterday := (day + 6) % 7
+	minute := t.Hour()*60 + t.Minute()
+	for _, p := range s {
+		if p.Start < p.End {
+			if p.Days[day] && minute >= p.Start && minute < p.End {
+				return true
+			}
+		} else if (p.Days[day] && minute >= p.Start) || (p.Days[yesterday] && minute < p.End) {
+			return true
+		}
+	}
+	return false
+}
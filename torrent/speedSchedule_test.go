@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSpeedSchedule(t *testing.T) {
+	s, err := ParseSpeedSchedule("Mon-Fri 09:00-18:00; sat,Sunday 22:30-06:00;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+	weekend := [7]bool{true, false, false, false, false, false, true}
+	if len(s) != 2 || s[0] != (SpeedPeriod{weekdays, 9 * 60, 18 * 60}) || s[1] != (SpeedPeriod{weekend, 22*60 + 30, 6 * 60}) {
+		t.Errorf("Parsed %+v", s)
+	}
+	if s, err = ParseSpeedSchedule("Fri-Mon 00:00-24:00"); err != nil || s[0].Days != [7]bool{true, true, false, false, false, true, true} {
+		t.Errorf("A range around the weekend: %+v %v", s, err)
+	}
+	if s, err = ParseSpeedSchedule(""); err != nil || len(s) != 0 {
+		t.Errorf("Empty schedule: %v %v", s, err)
+	}
+	for _, bad := range []string{"Mon", "Mo 09:00-10:00", "Mon 9-10", "Mon 25:00-26:00", "Mon 09:00-10:00 extra"} {
+		if _, err := ParseSpeedSchedule(bad); err == nil {
+			t.Errorf("Parsed %q", bad)
+		}
+	}
+}
+
+func TestSpeedScheduleActive(t *testing.T) {
+	s, err := ParseSpeedSchedule("Mon-Fri 09:00-18:00; Sat 22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour, minute int) time.Time {
+		// 2024-01-01 was a Monday.
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	for _, c := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(1, 8, 59), false},
+		{at(1, 9, 0), true},
+		{at(5, 17, 59), true},
+		{at(5, 18, 0), false},
+		{at(6, 12, 0), false}, // Saturday
+		{at(6, 23, 0), true},  // Saturday night
+		{at(7, 5, 59), true},  // Into Sunday morning
+		{at(7, 6, 0), false},
+		{at(8, 3, 0), false}, // Sunday night isn't in it
+	} {
+		if got := s.Active(c.t); got != c.want {
+			t.Errorf("At %v, %v", c.t, got)
+		}
+	}
+}
+
+func TestSpeedScheduleDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No time zone data:", err)
+	}
+	saved := time.Local
+	time.Local = loc
+	defer func() { time.Local = saved }()
+	// 2:00 to 3:00 on 2024-03-10 was skipped.
+	s, err := ParseSpeedSchedule("Sun 02:30-04:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Date(2024, 3, 10, 1, 59, 0, 0, loc)
+	if s.Active(before) {
+		t.Error("Active before the period")
+	}
+	// A minute later the clock says 3:00, inside the period.
+	if !s.Active(before.Add(time.Minute)) {
+		t.Error("Not active once the clock jumped into the period")
+	}
+	// And it ends at 4:00 by the clock, only an hour later.
+	if !s.Active(before.Add(time.Hour)) || s.Active(before.Add(time.Hour+time.Minute)) {
+		t.Error("Wrong end, going by the clock")
+	}
+}
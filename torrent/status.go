@@ -0,0 +1,240 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// TorrentStatus is a snapshot of how a torrent is doing. It's meant for
+// showing to users, so it marshals to JSON as is.
+type TorrentStatus struct {
+	Name         string
+	InfoHash     string // In hex
+	HaveTorrent  bool   // False until we have a magnet link's metadata
+	Adding       bool   // Its session is still being created, or waiting to be
+	Error        string // Why it couldn't be added, or why it's stopped
+	Paused       bool
+	Checking     bool    // Its data is being checked
+	CheckedPart  float64 // The fraction of the pieces the check has hashed
+	Size         int64
+	Completed    uint64 // Bytes of verified pieces
+	Left         uint64
+	Pieces       int
+	GoodPieces   int
+	HashFailures int      // Downloaded pieces that failed their hash check, this session
+	Overhead     Overhead // What was transferred besides its pieces, and wasted. See overhead.go.
+	Downloaded   uint64
+	Uploaded     uint64
+	DownloadRate float64 // In bytes per second: the sum of the peers' and web seeds' rates
+	UploadRate   float64
+	ETA          time.Duration // How long Left should take at the recent pace: 0 once done, -1 if there's no telling
+	CompletedAt  time.Time     // When it finished downloading, if it has and we saw it, over every session
+	AltSpeed     bool          // The alternative speed limits are in force
+	Ratio        float64
+	SeedingTime  time.Duration // How long it's seeded, over every session
+	SeedLimits   SeedLimits
+
+	// A check that was stopped part way, by pausing it, and goes on once
+	// it's resumed.
+	Unchecked bool
+	// The pieces checked, and while checking, how fast the data's read, in
+	// bytes per second, and how long the rest should take: -1 if there's no
+	// telling.
+	CheckedPieces int
+	CheckRate     float64
+	CheckETA      time.Duration
+
+	// While it's being added: how many of its files are open, of how many.
+	FilesOpened, FilesToOpen int
+
+	// The pieces being downloaded, and hashed, and the memory they take.
+	ActivePieces     int
+	ActivePieceBytes int64
+
+	Queued bool // Waiting for a download or seed slot
+	// In the downloads' or seeds' queue: 1 starts next, and 0 isn't queued.
+	QueuePosition int
+	QueuePriority int
+	ForceStart    bool // Runs regardless of the queue
+
+	FileDir string   // The directory its files go under
+	Labels  []string // See labels.go
+
+	BandwidthPriority string // "high", "normal" or "low"
+	BlockSize         int    // How much it asks peers for at a time
+
+	Connected  int // Peers we're connected to
+	Seeds      int // Connected peers that have every piece
+	Leeches    int
+	KnownPeers int // Peers we've heard of and tried
+	// What the trackers last told us about the swarm.
+	SwarmSeeds   uint
+	SwarmLeeches uint
+	// While it's out of peers, with none to try, what's being done to find
+	// more. Nil otherwise. See dryPool.go.
+	DryPool           *DryPoolStatus
+	DryPoolRecoveries int // Times it found peers again after running out, this session
+
+	// Availability[n] is how many pieces n of the connected peers have.
+	Availability []int
+	// How many whole copies of the torrent the connected peers and we have
+	// between us: the fewest copies there are of any piece, and the part of
+	// the pieces there are more of. Under 1, some piece is nowhere to be had.
+	DistributedCopies float64
+	CompleteCopy      bool // Whether we or a connected peer have every piece
+
+	Trackers []TrackerStatus
+	// The swarm as the DHT estimates it, for torrents that use it. Nil
+	// until an estimate's been made. See bep33.go.
+	DHTScrape *DHTScrape
+	Peers     []PeerStatus
+	WebSeeds  []WebSeedHealth
+}
+
+// PeerStatus is how one connected peer is doing.
+type PeerStatus struct {
+	Address        string
+	Client         string
+	Source         string
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+	PeerStats
+	Progress float64 // The fraction of the pieces the peer has
+}
+
+// Status takes a snapshot of the torrent. The main loop takes it, so it's
+// consistent, and it only holds the loop up for as long as copying takes.
+func (ts *TorrentSession) Status() (status TorrentStatus, err error) {
+	err = ts.runInLoop(func() { status = ts.status() })
+	return
+}
+
+func (ts *TorrentSession) status() (s TorrentStatus) {
+	now := ts.clock().Now()
+	s = TorrentStatus{
+		Name:         ts.M.Info.Name,
+		InfoHash:     hex.EncodeToString([]byte(ts.M.InfoHash)),
+		HaveTorrent:  ts.Session.HaveTorrent,
+		Paused:       ts.Paused() && !ts.Queued(),
+		Checking:     ts.checking(),
+		Size:         ts.totalSize,
+		Left:         ts.Session.Left,
+		Pieces:       ts.totalPieces,
+		GoodPieces:   ts.goodPieces,
+		HashFailures: ts.hashFailures,
+		Overhead:     ts.traffic.overhead(),
+		Downloaded:   ts.Session.Downloaded,
+		Uploaded:     ts.Session.Uploaded,
+		Connected:    len(ts.peers),
+		KnownPeers:   ts.peersFound.Total(),
+		Trackers:     ts.trackerStatuses.get(),
+		DHTScrape:    ts.dhtScrape,
+		WebSeeds:     ts.webSeedHealth(),
+		Ratio:        ts.ratio(),
+		SeedingTime:  ts.seedingTime(now),
+		SeedLimits:   ts.seedLimits,
+
+		Queued:        ts.Queued(),
+		QueuePosition: ts.queuePosition(),
+		QueuePriority: ts.QueuePriority(),
+		ForceStart:    ts.ForceStart(),
+
+		FileDir: ts.fileDir,
+		Labels:  ts.Labels(),
+
+		BandwidthPriority: ts.BandwidthPriority(),
+		BlockSize:         ts.blockSize,
+	}
+	s.DownloadRate, s.UploadRate = ts.rates(now)
+	if ts.recheck != nil {
+		s.Unchecked = !s.Checking
+		s.CheckedPieces = ts.checkedPieces()
+		if ts.totalPieces > 0 {
+			s.CheckedPart = float64(s.CheckedPieces) / float64(ts.totalPieces)
+		}
+		s.CheckRate, s.CheckETA = ts.checkRate(s.CheckedPieces)
+	}
+	s.ETA = ts.eta.estimate(ts.Session.Left)
+	if ts.endgame() {
+		s.ETA = ts.eta.estimateEndgame(ts.Session.Left, s.DownloadRate)
+	}
+	if !ts.Session.HaveTorrent {
+		s.ETA = -1
+	} else if ts.Session.Left == 0 {
+		s.CompletedAt = ts.completedAt
+	}
+	if ts.bandwidth != nil {
+		s.AltSpeed = ts.bandwidth.Limits().AltSpeed
+	}
+	if ts.Session.HaveTorrent {
+		s.Completed = uint64(ts.totalSize) - ts.Session.Left
+	}
+	s.ActivePieces = len(ts.activePieces)
+	for _, v := range ts.activePieces {
+		s.ActivePieceBytes += int64(len(v.buffer))
+	}
+	if ts.diskPaused() && ts.Paused() {
+		s.Error = "Paused, since the disk usage cap, or the disk, is full"
+	}
+	if ts.storageErr != nil {
+		s.Error = "Stopped, since its files couldn't be written: " + ts.storageErr.Error()
+	}
+	s.DryPool, s.DryPoolRecoveries = ts.dryPoolStatus(), ts.dryPool.recoveries
+	if ts.ti != nil {
+		s.SwarmSeeds, s.SwarmLeeches = ts.ti.Complete, ts.ti.Incomplete
+	}
+
+	halfLife := ts.rateHalfLife()
+	for _, p := range ts.peers {
+		have := 0
+		if p.have != nil && p.have.n == ts.totalPieces {
+			have = p.have.Count()
+		}
+		ps := PeerStatus{
+			Address:        p.address,
+			Client:         p.client,
+			Source:         p.source.String(),
+			AmChoking:      p.am_choking,
+			AmInterested:   p.am_interested,
+			PeerChoking:    p.peer_choking,
+			PeerInterested: p.peer_interested,
+			PeerStats:      p.stats(now, halfLife),
+		}
+		if ts.totalPieces > 0 {
+			ps.Progress = float64(have) / float64(ts.totalPieces)
+			if have == ts.totalPieces {
+				s.Seeds++
+			} else {
+				s.Leeches++
+			}
+		}
+		s.Peers = append(s.Peers, ps)
+	}
+	sort.Slice(s.Peers, func(i, j int) bool { return s.Peers[i].Address < s.Peers[j].Address })
+	ts.availabilityStatus(&s)
+	return
+}
+
+// State sums up the status in a word: "error", "adding", "checking",
+// "queued", "paused", "seeding" or "downloading".
+func (s *TorrentStatus) State() string {
+	switch {
+	case s.Error != "":
+		return "error"
+	case s.Adding:
+		return "adding"
+	case s.Checking:
+		return "checking"
+	case s.Queued:
+		return "queued"
+	case s.Paused:
+		return "paused"
+	case s.HaveTorrent && s.Left == 0:
+		return "seeding"
+	default:
+		return "downloading"
+	}
+}
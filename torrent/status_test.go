@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrackerStatuses(t *testing.T) {
+	s := newTrackerStatuses([][]string{{"http://a/announce", "udp://b:80"}, {"http://c/announce"}})
+	s.record("udp://b:80", &TrackerResponse{Complete: 3, Incomplete: 4, Peers: "123456abcdef"}, nil)
+	s.record("http://c/announce", nil, errors.New("Connection refused"))
+	got := s.get()
+	if len(got) != 3 || got[0].URL != "http://a/announce" || !got[0].LastAnnounce.IsZero() {
+		t.Fatalf("Statuses %v", got)
+	}
+	if b := got[1]; b.Seeders != 3 || b.Leechers != 4 || b.Peers != 2 || b.Error != "" || b.LastAnnounce.IsZero() {
+		t.Errorf("After a good announce, %+v", b)
+	}
+	if c := got[2]; c.Error != "Connection refused" {
+		t.Errorf("After a failed announce, %+v", c)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "seed")
+	if err = os.Mkdir(seedDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 200*1024)
+	rand.New(rand.NewSource(5)).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(seedDir, "content"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateTorrent(filepath.Join(seedDir, "content"), &CreateOptions{PieceLength: 32 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	seedFlags := &TorrentFlags{
+		FileDir:            seedDir,
+		SeedRatio:          math.Inf(0),
+		UseDHT:             true,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}
+	seeder, seederDone := startTestSession(t, seedFlags, torrentFile, swarm)
+	leechFlags := *seedFlags
+	leechFlags.Port = 0
+	leechFlags.FileDir = filepath.Join(dir, "leech")
+	leecher, leecherDone := startTestSession(t, &leechFlags, torrentFile, swarm)
+
+	var s TorrentStatus
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		if s, err = leecher.Status(); err != nil {
+			t.Fatal(err)
+		}
+		if s.GoodPieces == s.Pieces && s.Seeds == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the download, status %+v", s)
+		}
+	}
+	if s.Name != "content" || s.Size != int64(len(content)) || s.Completed != uint64(len(content)) || s.Left != 0 ||
+		s.Downloaded != uint64(len(content)) || s.DownloadRate <= 0 {
+		t.Errorf("Leecher's status %+v", s)
+	}
+	if len(s.Peers) != 1 || s.Peers[0].Progress != 1 || s.Peers[0].Client != "Taipei-Torrent dev" || s.Peers[0].Source != "dht" {
+		t.Errorf("Leecher's peers %+v", s.Peers)
+	}
+	// The torrent's rate is its peers'.
+	if len(s.Peers) == 1 && (s.Peers[0].Downloaded < uint64(len(content)) || s.Peers[0].DownloadRate != s.DownloadRate) {
+		t.Errorf("Leecher's peer %+v, with the torrent at %v", s.Peers[0], s.DownloadRate)
+	}
+	// The seeder has every piece, and nobody else does.
+	if len(s.Availability) != 2 || s.Availability[1] != s.Pieces {
+		t.Errorf("Availability %v", s.Availability)
+	}
+	// With ours, there are two copies of each.
+	if s.DistributedCopies != 2 || !s.CompleteCopy {
+		t.Errorf("%v distributed copies, complete %v", s.DistributedCopies, s.CompleteCopy)
+	}
+	if _, err = json.Marshal(s); err != nil {
+		t.Error(err)
+	}
+
+	if s, err = seeder.Status(); err != nil {
+		t.Fatal(err)
+	}
+	// Endgame can send some blocks twice.
+	if s.Uploaded < uint64(len(content)) || s.UploadRate <= 0 || len(s.Peers) != 1 || s.Peers[0].UploadRate <= 0 {
+		t.Errorf("Seeder's status %+v", s)
+	}
+
+	seeder.Quit()
+	leecher.Quit()
+	<-seederDone
+	<-leecherDone
+	if _, err = seeder.Status(); err != errSessionEnded {
+		t.Errorf("Status of an ended session: %v", err)
+	}
+}
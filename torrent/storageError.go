@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A write to a torrent's files can fail for the files' sake rather than the
+// piece's: the disk fills up, an external drive is unplugged, the files are
+// made read-only. Fetching the piece again won't help, and neither will
+// fetching any other, so the torrent goes into an error state instead: it's
+// paused, which drops its peers and web seeds and tells the trackers it's
+// stopped, and nothing more is written to its files. Its status says why.
+// Other torrents carry on as they were.
+//
+// Retry, or Resume, opens the files again, anew, and checks the pieces in the
+// files that couldn't be written, as they may have lost what they held,
+// before going on. If it was the disk filling up, the manager retries by
+// itself once there's room on it again.
+
+// How often the manager looks for room for torrents whose disk filled up.
+const STORAGE_RETRY_INTERVAL = time.Minute
+
+var errNotFailed = errors.New("The torrent's files haven't failed")
+
+// Puts the torrent in the error state for err, from a write for piece. It's
+// called from the loop, maybe while a peer's message is being handled, so
+// the torrent's paused on the loop's next turn rather than there and then.
+func (ts *TorrentSession) storageFailed(piece int, err error) {
+	if ts.failedFiles == nil {
+		ts.failedFiles = make(map[int]bool)
+	}
+	if ts.files != nil {
+		first, last := ts.files.filesFor(int64(piece)*ts.M.Info.PieceLength, int64(ts.pieceLength(piece)))
+		for f := first; f <= last; f++ {
+			ts.failedFiles[f] = true
+		}
+	}
+	if ts.storageErr != nil {
+		return
+	}
+	ts.storageErr = err
+	if errors.Is(err, syscall.ENOSPC) {
+		atomic.StoreInt32(&ts.outOfSpace, 1)
+	}
+	ts.logger().Error("Stopping, since its files can't be written", "piece", piece, "err", err)
+	go ts.runInLoop(func() {
+		if ts.storageErr != nil {
+			ts.pause()
+		}
+	})
+}
+
+// Retry takes the torrent out of the error state its files failing put it
+// in, opening them again and checking what's in the ones that failed. The
+// torrent's paused while they're checked, and goes on afterwards. It's an
+// error if the files can't be opened, and the torrent stays as it was.
+func (ts *TorrentSession) Retry() (err error) {
+	if e := ts.runInLoop(func() { err = ts.retryStorage() }); e != nil {
+		return e
+	}
+	return
+}
+
+func (ts *TorrentSession) retryStorage() (err error) {
+	if ts.storageErr == nil {
+		return errNotFailed
+	}
+	if ts.checking() {
+		return errChecking
+	}
+	if err = ts.reopenFiles(); err != nil {
+		ts.logger().Error("Couldn't open the files again", "err", err)
+		return
+	}
+	ts.logger().Info("Opened the files again, checking the ones that failed", "files", len(ts.failedFiles))
+	affected := ts.failedPieces()
+	ts.storageErr, ts.failedFiles = nil, nil
+	atomic.StoreInt32(&ts.outOfSpace, 0)
+	ts.pause()
+
+	r := ts.recheck
+	if r == nil {
+		r = newRecheck(ts.totalPieces)
+		for i := 0; i < ts.totalPieces; i++ {
+			r.checked.Set(i)
+			if ts.pieceSet.IsSet(i) {
+				r.good.Set(i)
+			}
+		}
+		ts.recheck = r
+	}
+	r.wasPaused = false
+	r.mu.Lock()
+	affected.ForEachSet(func(i int) {
+		r.checked.Clear(i)
+		r.good.Clear(i)
+	})
+	r.mu.Unlock()
+	// What's been written of pieces still to come may be lost too.
+	for piece, v := range ts.activePieces {
+		if !v.isComplete() {
+			v.release()
+			delete(ts.activePieces, piece)
+		}
+	}
+	ts.forgetVerified()
+	ts.startCheck(r)
+	return
+}
+
+// The pieces that lie in the files that failed, or all of them if there's
+// no telling which those are.
+func (ts *TorrentSession) failedPieces() (pieces *Bitset) {
+	pieces = NewBitset(ts.totalPieces)
+	if ts.files == nil {
+		for i := 0; i < ts.totalPieces; i++ {
+			pieces.Set(i)
+		}
+		return
+	}
+	for f := range ts.failedFiles {
+		offset, length := ts.files.fileRange(f)
+		if length == 0 {
+			continue
+		}
+		last := int((offset + length - 1) / ts.M.Info.PieceLength)
+		for i := int(offset / ts.M.Info.PieceLength); i <= last && i < ts.totalPieces; i++ {
+			pieces.Set(i)
+		}
+	}
+	return
+}
+
+// Opens the torrent's files again, in place of ones that failed: those are
+// closed, with their file system, which may have gone, and the new ones get
+// a cache of their own, if there's one.
+func (ts *TorrentSession) reopenFiles() (err error) {
+	dir := ts.fileDir
+	if ts.dir != "" {
+		dir = ts.dir
+	}
+	info := ts.M.storeInfo()
+	fileSystem, err := ts.storage.fs.NewFS(dir)
+	if err != nil {
+		return
+	}
+	if ts.crossSeedMatches != nil {
+		fileSystem = useCrossSeedMatches(ts.crossSeedMatches, dir, fileSystem)
+	}
+	store, _, err := openFileStore(ts.ctx, info, fileSystem, ts.flags.OpenFilesParallel, nil)
+	if err != nil {
+		fileSystem.Close()
+		return
+	}
+	if e := ts.fileStore.Close(); e != nil {
+		ts.logger().Warn("Couldn't close the files that failed", "err", e)
+	}
+	ts.fileSystem = fileSystem
+	ts.fileStore = store
+	ts.files, _ = store.(*fileStore)
+	ts.wrapFileStore()
+	return
+}
+
+// Whether the torrent's in the error state for want of disk space. Any
+// goroutine can call this.
+func (ts *TorrentSession) storageFull() bool {
+	return atomic.LoadInt32(&ts.outOfSpace) != 0
+}
+
+// Retries the torrents whose disk filled up, if there's room on it again.
+// Run every STORAGE_RETRY_INTERVAL.
+func (m *sessionManager) retryStorage() {
+	torrents, err := m.Torrents()
+	if err != nil {
+		return
+	}
+	for _, ts := range torrents {
+		if !ts.storageFull() {
+			continue
+		}
+		path, _ := ts.content.Load().(string)
+		if free := freeDiskSpace(path); free < diskFreeMin {
+			// Including when there's no telling.
+			continue
+		}
+		log.Println("[", ts.M.Info.Name, "] There's room on the disk again, so retrying")
+		ts.Retry()
+	}
+}
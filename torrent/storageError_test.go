@@ -0,0 +1,39 @@
+package torrent
+
+import (
+	"syscall"
+	"testing"
+)
+
+// Only the pieces in the files that failed are checked again.
+func TestFailedPieces(t *testing.T) {
+	info := &InfoDict{PieceLength: 100, Files: []FileDict{
+		{Length: 150, Path: []string{"a"}},
+		{Length: 100, Path: []string{"b"}},
+		{Length: 50, Path: []string{"c"}},
+	}}
+	store, _, err := NewFileStore(info, &ramFileSystem{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &TorrentSession{M: &MetaInfo{Info: *info}, totalPieces: 3, lastPieceLength: 100, ended: make(chan bool)}
+	defer close(ts.ended)
+	ts.files = store.(*fileStore)
+
+	ts.failedFiles = map[int]bool{1: true}
+	if got := ts.failedPieces(); got.IsSet(0) || !got.IsSet(1) || !got.IsSet(2) {
+		t.Errorf("File b failing: %v", got)
+	}
+	ts.failedFiles = nil
+	ts.storageFailed(0, syscall.EROFS)
+	if got := ts.failedPieces(); !got.IsSet(0) || !got.IsSet(1) || got.IsSet(2) {
+		t.Errorf("Piece 0 failing: %v", got)
+	}
+	if ts.storageErr != syscall.EROFS || ts.storageFull() {
+		t.Errorf("Failed with %v, full %v", ts.storageErr, ts.storageFull())
+	}
+	ts.files = nil
+	if got := ts.failedPieces(); got.Count() != 3 {
+		t.Errorf("With no files to tell by: %v", got)
+	}
+}
@@ -0,0 +1,122 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The streaming server serves torrents' files over HTTP while they download,
+// so that a player can be pointed at them:
+//
+//	GET or HEAD /torrents/<info-hash>/<file index>
+//
+// Range requests are supported. The pieces a request reads, and
+// FILE_READAHEAD bytes past them, are fetched before any others, so seeking
+// moves the download along with the player. Players can't send a token, so
+// there isn't one: serve it on localhost.
+
+// Content types that mime may not know, for the files people stream.
+var mediaTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".mov":  "video/quicktime",
+	".ts":   "video/mp2t",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".srt":  "application/x-subrip",
+	".vtt":  "text/vtt",
+}
+
+func contentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := mediaTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	// Not sniffed, since that would wait for the first piece.
+	return "application/octet-stream"
+}
+
+type streamServer struct {
+	server *http.Server
+}
+
+func startStreamServer(m *sessionManager, addr string) (s *streamServer, err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	log.Println("Serving torrents' files on", l.Addr())
+	s = &streamServer{&http.Server{Handler: &streamHandler{m}}}
+	go s.server.Serve(l)
+	return
+}
+
+func (s *streamServer) Close() error {
+	return s.server.Close()
+}
+
+type streamHandler struct {
+	m *sessionManager
+}
+
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET and HEAD", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "torrents" {
+		http.NotFound(w, r)
+		return
+	}
+	ih, err := hex.DecodeString(parts[1])
+	if err != nil || len(ih) != 20 {
+		http.Error(w, "Bad info-hash", http.StatusBadRequest)
+		return
+	}
+	index, err := strconv.Atoi(parts[2])
+	if err != nil {
+		http.Error(w, "Bad file index", http.StatusBadRequest)
+		return
+	}
+	ts, _, err := h.m.Torrent(string(ih))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if ts == nil {
+		http.Error(w, "The torrent is still being added", http.StatusServiceUnavailable)
+		return
+	}
+	f, err := ts.OpenFile(index)
+	if err == errNoMetadata || err == errSessionEnded {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// Closing it when the player goes away lets other pieces be picked.
+	defer f.Close()
+	name := f.Path()[len(f.Path())-1]
+	w.Header().Set("Content-Type", contentType(name))
+	http.ServeContent(w, r, name, time.Time{}, f.Reader(r.Context()))
+}
@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentType(t *testing.T) {
+	for name, want := range map[string]string{
+		"Movie.MKV":  "video/x-matroska",
+		"a.mp4":      "video/mp4",
+		"index.html": "text/html; charset=utf-8",
+		"data":       "application/octet-stream",
+	} {
+		if got := contentType(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := writeWebSeedFiles(t, filepath.Join(dir, "files"), 10000, 30000)
+	if err = os.Rename(filepath.Join(dir, "files", "b"), filepath.Join(dir, "files", "b.mkv")); err != nil {
+		t.Fatal(err)
+	}
+	movie := content[10000:]
+	meta, err := CreateTorrent(filepath.Join(dir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if err = meta.Bencode(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		TrackerlessMode:    true,
+		SeedRatio:          math.Inf(0),
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	ih, err := m.AddTorrentFromBytes(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForComplete(t, m, ih)
+	server := httptest.NewServer(&streamHandler{m})
+	defer server.Close()
+	url := server.URL + "/torrents/" + hex.EncodeToString([]byte(ih)) + "/1"
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Range", "bytes=20000-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Type") != "video/x-matroska" ||
+		!bytes.Equal(body, movie[20000:]) {
+		t.Errorf("Range GET: %v %q, %d bytes", resp.Status, resp.Header.Get("Content-Type"), len(body))
+	}
+
+	resp, err = http.Head(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(movie)) || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("HEAD: %v, length %d", resp.Status, resp.ContentLength)
+	}
+
+	for path, want := range map[string]int{
+		"/torrents/" + hex.EncodeToString([]byte(ih)) + "/2": http.StatusNotFound,
+		"/torrents/" + hex.EncodeToString([]byte(ih)) + "/x": http.StatusBadRequest,
+		"/torrents/00/0": http.StatusBadRequest,
+		"/torrents/" + hex.EncodeToString(make([]byte, 20)) + "/0": http.StatusNotFound,
+		"/api/torrents": http.StatusNotFound,
+	} {
+		if resp, err = http.Get(server.URL + path); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: %v, want %d", path, resp.Status, want)
+		}
+	}
+	if resp, err = http.Post(url, "text/plain", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %v", resp.Status)
+	}
+
+	// The requests' handles were all closed.
+	ts, _, _ := m.Torrent(ih)
+	var open int
+	ts.runInLoop(func() { open = len(ts.fileHandles) })
+	if open != 0 {
+		t.Errorf("%d handles left open", open)
+	}
+}
@@ -0,0 +1,291 @@
+package torrent_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackpal/Taipei-Torrent/torrent"
+	"github.com/jackpal/Taipei-Torrent/torrent/internal/testing/swarm"
+)
+
+// Tests of sessions in a swarm. The times they're given are on the swarm's
+// clock.
+
+// A seed and a leecher: the leecher gets the torrent, asking for each block
+// once, since there's no one else to ask.
+func TestSwarmSeedToLeech(t *testing.T) {
+	s := swarm.New(t, 300*1024+17, 32*1024)
+	defer s.Stop()
+	seed, leech := s.AddNode(true), s.AddNode(false)
+	seed.Start()
+	if st := seed.WaitForCheck(); st.GoodPieces != st.Pieces {
+		t.Fatalf("The seed has %d of %d pieces", st.GoodPieces, st.Pieces)
+	}
+	leech.Start()
+	s.WaitForComplete(30*time.Second, leech)
+	if !bytes.Equal(leech.Content(), s.Content) {
+		t.Error("The leecher's files don't match the seed's")
+	}
+	blocks := (len(s.Content) + torrent.STANDARD_BLOCK_LENGTH - 1) / torrent.STANDARD_BLOCK_LENGTH
+	requests := swarm.RequestedBlocks(s.Messages(torrent.REQUEST, leech, seed))
+	if len(requests) != blocks {
+		t.Errorf("Requested %d blocks, not %d", len(requests), blocks)
+	}
+	for block, n := range requests {
+		if n > 1 {
+			t.Errorf("Requested block %d of piece %d %d times", block&0xffffffff, block>>32, n)
+		}
+	}
+	if pieces := s.Messages(torrent.PIECE, nil, leech); len(pieces) != blocks {
+		t.Errorf("Sent the leecher %d blocks, not %d", len(pieces), blocks)
+	}
+}
+
+// A slow seed and two leechers: they get most of the torrent from each other,
+// by fetching different pieces of it from the seed.
+func TestSwarmTwoLeechers(t *testing.T) {
+	s := swarm.New(t, 512*1024, 16*1024)
+	defer s.Stop()
+	seed := s.AddNode(true)
+	seed.Session.LimitUpload(128 * 1024)
+	a, b := s.AddNode(false), s.AddNode(false)
+	seed.Start()
+	seed.WaitForCheck()
+	a.Start()
+	b.Start()
+	s.WaitForComplete(60*time.Second, a, b)
+	for _, n := range []*swarm.Node{a, b} {
+		if !bytes.Equal(n.Content(), s.Content) {
+			t.Errorf("%s's files don't match the seed's", n.Addr)
+		}
+	}
+	blocks := len(s.Content) / torrent.STANDARD_BLOCK_LENGTH
+	fromSeed := len(s.Messages(torrent.PIECE, seed, nil))
+	ab, ba := len(s.Messages(torrent.PIECE, a, b)), len(s.Messages(torrent.PIECE, b, a))
+	t.Logf("%d blocks from the seed, %d from a to b, %d from b to a", fromSeed, ab, ba)
+	if ab == 0 || ba == 0 {
+		t.Errorf("The leechers didn't trade: %d blocks from a to b, %d back", ab, ba)
+	}
+	if fromSeed >= 2*blocks {
+		t.Errorf("The seed sent %d blocks, each leecher getting all %d from it", fromSeed, blocks)
+	}
+	// A leecher asks a peer for a block once. It asks another peer for it too
+	// only when the peer it's choosing for has nothing unclaimed to give it.
+	for _, n := range []*swarm.Node{a, b} {
+		for _, peer := range []*swarm.Node{seed, a, b} {
+			for block, k := range swarm.RequestedBlocks(s.Messages(torrent.REQUEST, n, peer)) {
+				if k > 1 {
+					t.Errorf("%s asked %s for block %d of piece %d %d times", n.Addr, peer.Addr, block&0xffffffff, block>>32, k)
+				}
+			}
+		}
+		twice := 0
+		for _, k := range swarm.RequestedBlocks(s.Messages(torrent.REQUEST, n, nil)) {
+			if k > 1 {
+				twice++
+			}
+		}
+		t.Logf("%s asked two peers for %d blocks", n.Addr, twice)
+	}
+}
+
+// A leecher the tracker gives no peers at first asks it again once it's been
+// without them for DRY_POOL_GRACE, and gets the torrent then.
+func TestSwarmDryPool(t *testing.T) {
+	s := swarm.New(t, 64*1024, 16*1024)
+	defer s.Stop()
+	announced := make(map[*swarm.Node]bool)
+	s.PeersFor = func(n *swarm.Node, known []*swarm.Node) []*swarm.Node {
+		if !announced[n] {
+			announced[n] = true
+			return nil
+		}
+		return known
+	}
+	seed, leech := s.AddNode(true), s.AddNode(false)
+	start := s.Clock.Now()
+	seed.Start()
+	seed.WaitForCheck()
+	leech.Start()
+	s.WaitForComplete(2*time.Minute, leech)
+	if d := s.Clock.Now().Sub(start); d < torrent.DRY_POOL_GRACE {
+		t.Errorf("Complete after %v, before asking again", d)
+	}
+}
+
+// A leecher asking for 48 KiB blocks of 64 KiB pieces: each piece is asked
+// for in a long block and a short one, and the last, shorter piece in a
+// single short block.
+func TestSwarmBlockSize(t *testing.T) {
+	const pieceLength = 64 * 1024
+	s := swarm.New(t, 300*1024+17, pieceLength)
+	defer s.Stop()
+	seed := s.AddNode(true)
+	leech := s.AddNodeWith(false, &swarm.Disk{}, func(f *torrent.TorrentFlags) { f.BlockSize = 48 * 1024 })
+	seed.Start()
+	seed.WaitForCheck()
+	leech.Start()
+	s.WaitForComplete(30*time.Second, leech)
+	if !bytes.Equal(leech.Content(), s.Content) {
+		t.Error("The leecher's files don't match the seed's")
+	}
+	want := make(map[uint64]uint32)
+	for piece := 0; piece*pieceLength < len(s.Content); piece++ {
+		length := min(pieceLength, len(s.Content)-piece*pieceLength)
+		for begin := 0; begin < length; begin += 48 * 1024 {
+			want[uint64(piece)<<32|uint64(begin)] = uint32(min(48*1024, length-begin))
+		}
+	}
+	requests := s.Messages(torrent.REQUEST, leech, seed)
+	if len(requests) != len(want) {
+		t.Errorf("%d requests, not %d", len(requests), len(want))
+	}
+	for _, m := range requests {
+		k := uint64(binary.BigEndian.Uint32(m[1:5]))<<32 | uint64(binary.BigEndian.Uint32(m[5:9]))
+		if length := binary.BigEndian.Uint32(m[9:13]); length != want[k] {
+			t.Errorf("Asked for %d bytes at %d of piece %d", length, k&0xffffffff, k>>32)
+		}
+	}
+}
+
+// A torrent with 32 MiB pieces is fetched into the leecher's files without
+// buffers for them: only its short last piece takes any of the memory
+// budget.
+func TestSwarmSegmentedPieces(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Moves 32 MiB")
+	}
+	s := swarm.New(t, 32*1024*1024+100*1024, 32*1024*1024)
+	defer s.Stop()
+	seed := s.AddNode(true)
+	leech := s.AddNodeWith(false, &swarm.Disk{}, func(f *torrent.TorrentFlags) { f.BlockSize = torrent.MAX_BLOCK_LENGTH })
+	leech.Session.LimitPieceMemory(1024 * 1024)
+	seed.Start()
+	if st := seed.WaitForCheck(); st.GoodPieces != st.Pieces {
+		t.Fatalf("The seed has %d of %d pieces", st.GoodPieces, st.Pieces)
+	}
+	leech.Start()
+	var st torrent.TorrentStatus
+	complete := s.Run(2*time.Minute, func() bool {
+		st = leech.Status()
+		if st.ActivePieceBytes > 100*1024 || leech.Session.PieceMemoryUsed() > 100*1024 {
+			t.Fatalf("%d bytes of piece buffers, %d of the budget", st.ActivePieceBytes, leech.Session.PieceMemoryUsed())
+		}
+		return st.GoodPieces == st.Pieces
+	})
+	if !complete {
+		t.Fatalf("%d of %d pieces", st.GoodPieces, st.Pieces)
+	}
+	if !bytes.Equal(leech.Content(), s.Content) {
+		t.Error("The leecher's files don't match the seed's")
+	}
+}
+
+// A disk in RAM, whose files are still there when it's opened again, that
+// fails writes with ENOSPC while it's full.
+type fillingDisk struct {
+	full  int32 // Use atomically
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+type fillingFS struct {
+	d *fillingDisk
+}
+
+type fillingFile struct {
+	d    *fillingDisk
+	name string
+}
+
+func (d *fillingDisk) NewFS(directory string) (torrent.FileSystem, error) {
+	return fillingFS{d}, nil
+}
+
+func (fs fillingFS) Open(name []string, length int64) (torrent.File, error) {
+	key := path.Join(name...)
+	fs.d.mu.Lock()
+	defer fs.d.mu.Unlock()
+	if b := fs.d.files[key]; int64(len(b)) != length {
+		resized := make([]byte, length)
+		copy(resized, b)
+		fs.d.files[key] = resized
+	}
+	return fillingFile{fs.d, key}, nil
+}
+
+func (fs fillingFS) Close() error {
+	return nil
+}
+
+func (f fillingFile) ReadAt(p []byte, off int64) (n int, err error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	return copy(p, f.d.files[f.name][off:]), nil
+}
+
+func (f fillingFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if atomic.LoadInt32(&f.d.full) != 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	return copy(f.d.files[f.name][off:], p), nil
+}
+
+func (f fillingFile) Close() error {
+	return nil
+}
+
+// A leecher whose disk is full stops, in the error state, while another in
+// the same swarm finishes. Once there's room, Retry checks its files and it
+// finishes too.
+func TestSwarmStorageError(t *testing.T) {
+	s := swarm.New(t, 16*torrent.STANDARD_BLOCK_LENGTH, 4*torrent.STANDARD_BLOCK_LENGTH)
+	defer s.Stop()
+	disk := &fillingDisk{full: 1, files: make(map[string][]byte)}
+	seed, full, other := s.AddNode(true), s.AddNodeWith(false, disk, nil), s.AddNode(false)
+	seed.Start()
+	seed.WaitForCheck()
+	full.Start()
+	other.Start()
+	s.WaitForComplete(20*time.Second, other)
+
+	var st torrent.TorrentStatus
+	stopped := s.Run(10*time.Second, func() bool {
+		st = full.Status()
+		return st.State() == "error" && st.Paused && st.Connected == 0
+	})
+	if !stopped {
+		t.Fatalf("The full leecher is %s, with %d peers: %q", st.State(), st.Connected, st.Error)
+	}
+	if !strings.Contains(st.Error, syscall.ENOSPC.Error()) {
+		t.Errorf("Its error is %q", st.Error)
+	}
+	if !full.Session.StorageFull() {
+		t.Error("It isn't out of space")
+	}
+	if err := seed.Session.Retry(); err != torrent.ErrNotFailed {
+		t.Errorf("Retrying the seed: %v", err)
+	}
+
+	atomic.StoreInt32(&disk.full, 0)
+	if err := full.Session.Retry(); err != nil {
+		t.Fatal(err)
+	}
+	s.WaitForComplete(20*time.Second, full)
+	if st = full.Status(); st.Error != "" || full.Session.StorageFull() {
+		t.Errorf("Still in error: %q", st.Error)
+	}
+	if !bytes.Equal(full.Content(), s.Content) {
+		t.Error("It finished with the wrong content")
+	}
+}
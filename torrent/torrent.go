@@ -2,25 +2,27 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	bencode "github.com/jackpal/bencode-go"
-	"github.com/nictuku/dht"
 	"github.com/nictuku/nettools"
 )
 
@@ -29,6 +31,13 @@ const (
 	TARGET_NUM_PEERS = 15
 )
 
+// How long a quitting torrent waits for the trackers to hear it's stopped.
+const STOPPED_ANNOUNCE_TIMEOUT = 5 * time.Second
+
+// The least time between announces ForceAnnounce allows, for trackers that
+// don't give a min interval.
+const FORCE_ANNOUNCE_COOLDOWN = 30 * time.Second
+
 // BitTorrent message types. Sources:
 // http://bittorrent.org/beps/bep_0003.html
 // http://wiki.theory.org/BitTorrentSpecification
@@ -56,6 +65,9 @@ const (
 	METADATA_REJECT
 )
 
+// Metadata is exchanged in pieces of this size (BEP 9).
+const METADATA_PIECE_SIZE = 16 * 1024
+
 func peerID() string {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	sid := "-tt" + strconv.Itoa(os.Getpid()) + "_" + strconv.FormatInt(r.Int63(), 10)
@@ -68,11 +80,19 @@ var kBitTorrentHeader = []byte{'\x13', 'B', 'i', 't', 'T', 'o', 'r',
 type ActivePiece struct {
 	downloaderCount []int // -1 means piece is already downloaded
 	buffer          []byte
+	memory          *pieceMemory // What the buffer was taken from, or nil
+	blockSize       int          // Its blocks' length, but for a short last one
+	length          int
+	// Where its blocks are written, rather than the buffer, if it's too long
+	// to buffer. See largePieces.go.
+	store FileStore
 }
 
-func (a *ActivePiece) chooseBlockToDownload(endgame bool) (index int) {
+// requested says which blocks the peer we're choosing for has been asked for
+// already. In the endgame, those aren't asked for again.
+func (a *ActivePiece) chooseBlockToDownload(endgame bool, requested func(block int) bool) (index int) {
 	if endgame {
-		return a.chooseBlockToDownloadEndgame()
+		return a.chooseBlockToDownloadEndgame(requested)
 	}
 	return a.chooseBlockToDownloadNormal()
 }
@@ -87,10 +107,10 @@ func (a *ActivePiece) chooseBlockToDownloadNormal() (index int) {
 	return -1
 }
 
-func (a *ActivePiece) chooseBlockToDownloadEndgame() (index int) {
+func (a *ActivePiece) chooseBlockToDownloadEndgame(requested func(block int) bool) (index int) {
 	index, minCount := -1, -1
 	for i, v := range a.downloaderCount {
-		if v >= 0 && (minCount == -1 || minCount > v) {
+		if v >= 0 && (minCount == -1 || minCount > v) && !requested(i) {
 			index, minCount = i, v
 		}
 	}
@@ -115,6 +135,13 @@ func (a *ActivePiece) isComplete() bool {
 	return true
 }
 
+// The parts of the DHT a torrent session talks to. A session only needs an
+// info-hash to ask for peers, so it can do so before it has the metadata.
+type dhtClient interface {
+	PeersRequest(ih string, announce bool)
+	AddNode(addr string)
+}
+
 type TorrentSession struct {
 	flags                *TorrentFlags
 	M                    *MetaInfo
@@ -122,9 +149,11 @@ type TorrentSession struct {
 	ti                   *TrackerResponse
 	torrentHeader        []byte
 	fileStore            FileStore
+	files                *fileStore    // Under fileStore's wrappers, for its offsets
+	opening              *openProgress // Counts the files opened, if it isn't nil
 	trackerReportChan    chan ClientStatusReport
 	trackerInfoChan      chan *TrackerResponse
-	hintNewPeerChan      chan string
+	hintNewPeerChan      chan peerHint
 	addPeerChan          chan *BtConn
 	peers                map[string]*peerState
 	peerMessageChan      chan peerMessage
@@ -134,44 +163,187 @@ type TorrentSession struct {
 	lastPieceLength      int
 	goodPieces           int
 	activePieces         map[int]*ActivePiece
+	hashJobs             chan *pieceHash
+	hashResults          chan *pieceHash
+	hashQueue            []*pieceHash // Complete pieces waiting for a hasher
 	maxActivePieces      int
 	heartbeat            chan bool
-	dht                  *dht.DHT
+	dht                  dhtClient
+	dhtAnnounces         int              // DHT peer requests made for this torrent
+	dhtScrape            *DHTScrape       // The latest, or nil
+	peersFound           PeerSourceCounts // New peers we tried, by source
+	traffic              trafficCounter   // See overhead.go
+	dialing              int32            // Connections to peers being made. Atomic.
+	dryPool              dryPool          // See dryPool.go
+	lpd                  *Announcer       // The manager's, if it's using LPD
+	externalAddr         *externalAddress
 	quit                 chan bool
 	ended                chan bool
 	trackerLessMode      bool
 	torrentFile          string
 	chokePolicy          ChokePolicy
 	chokePolicyHeartbeat <-chan time.Time
+	chokers              []Choker // Kept for the next time peers are choked
 	execOnSeedingDone    bool
+	webSeedPool          []*webSeed
+	webSeedResults       chan webSeedResult
+	webSeedClient        *http.Client
+	trackerClient        *http.Client // For HTTP announces, keeping their connections
+	webSeedState         *webSeedState
+	fileSystem           FileSystem
+	resumeState          *resumeData // What we saved last, if we're using resume data
+	resumeSaved          time.Time
+	trackerKey           uint32
+	announceAddrs        announceAddrs // Given to trackers along with our port
+	trackerStatuses      *trackerStatuses
+	retracker            <-chan time.Time // When to announce to the trackers next
+	// The tiers of trackers added to it since it was added, for the session
+	// state, as [][]string. See trackerMerge.go.
+	addedTrackers   atomic.Value
+	labels          atomic.Value // []string, set on the main loop. See labels.go.
+	webSeedReceived *Accumulator
+	rateHistory     *rateHistory
+	eta             etaEstimator
+	// Its rates, as math.Float64bits, for the manager's history. Atomic.
+	downloadRate, uploadRate uint64
+	bandwidth                *bandwidth      // Shared rate limits, or nil
+	pieceMemory              *pieceMemory    // The shared budget for active pieces, or nil
+	bandwidthClass           *bandwidthClass // Its share of them
+	dir                      string          // Where a multi-file torrent's files are
+	fileDir                  string          // The directory its files go under
+	storage                  torrentStorage
+	availability             availability // See availability.go
+	// Its files' path, dir or the single file's, as a string once it's
+	// loaded. The manager reads it.
+	content  atomic.Value
+	hooks    hookQueue // Run in order. See hooks.go.
+	commands chan func()
+	paused   int32 // Read from other goroutines, so use atomically
+	// The queue's, also atomic. See queue.go.
+	queued        int32 // Paused by the queue, rather than the user
+	queuePos      int32
+	queuePriority int32
+	forceStart    int32
+	complete      int32 // Set once we have every piece
+	diskFull      int32 // Set while the manager has it paused for want of disk space
+	// Why its files stopped it, and which of them failed. See
+	// storageError.go.
+	storageErr         error
+	failedFiles        map[int]bool
+	outOfSpace         int32            // Set, atomically, if storageErr was the disk filling up
+	crossSeedMatches   []CrossSeedMatch // The files it's cross-seeding, if any
+	blocklist          *blocklist       // The manager's, or nil
+	addedAt            int64            // In Unix nanoseconds
+	seedLimits         SeedLimits
+	ownSeedLimits      bool            // Set for this torrent, rather than from the flags
+	blockSize          int             // What we ask peers for. See blockSize.go.
+	ownBlockSize       bool            // Set for this torrent, rather than from the flags
+	standardBlockPeers map[string]bool // Addresses that didn't answer long block requests
+	seededFor          time.Duration   // Before seedingSince
+	seedingSince       time.Time       // Zero unless we're seeding
+	lastAnnounce       time.Time
+	recheck            *recheck // The recheck in progress, or nil
+	unverified         *Bitset  // Pieces trusted from the verified marker, and not hashed yet, or nil
+	events             *eventFeed
+	completedSent      bool      // Whether EVENT_COMPLETED has been sent
+	completeHookRan    bool      // Ever, as the resume data remembers
+	completedAt        time.Time // When it last finished downloading, as the resume data remembers
+	hashFailures       int
+	disk               *diskStats // Shared disk metrics, or nil
+	ctx                context.Context
+	cancel             context.CancelFunc
+	fileHandles        []*FileHandle    // Open, in the order they were opened
+	pieceWaiters       []chan bool      // Closed when a piece arrives
+	pendingHaves       []int            // Pieces whose Haves are waiting to go
+	haveFlush          <-chan time.Time // When they go, or nil
 }
 
 func NewTorrentSession(flags *TorrentFlags, torrent string, listenPort uint16) (t *TorrentSession, err error) {
+	return NewTorrentSessionContext(context.Background(), flags, torrent, listenPort)
+}
+
+// NewTorrentSessionContext is like NewTorrentSession, but gives up on
+// fetching the torrent, opening its files and hash checking them when ctx is
+// done, returning ctx.Err(). The session ends when ctx is done, too.
+func NewTorrentSessionContext(ctx context.Context, flags *TorrentFlags, torrent string, listenPort uint16) (t *TorrentSession, err error) {
+	m, err := getMetaInfo(ctx, flags.Dial, torrent)
+	if err != nil {
+		return
+	}
+	return newTorrentSession(ctx, flags, torrent, m, "", listenPort, nil, torrentStorage{})
+}
+
+// Makes a session for a torrent we've already read. torrent is what it was
+// read from, or "" if it wasn't read from a file, URL or magnet link. Its
+// files go under dir, or if that's "", where the resume data says they went
+// last time, or else flags.FileDir. They're stored with storage's providers,
+// or the flags' where it has none.
+func newTorrentSession(ctx context.Context, flags *TorrentFlags, torrent string, m *MetaInfo, dir string, listenPort uint16, opening *openProgress, storage torrentStorage) (t *TorrentSession, err error) {
+	clock := flagsClock(flags)
 	ts := &TorrentSession{
 		flags:                flags,
 		peers:                make(map[string]*peerState),
 		peerMessageChan:      make(chan peerMessage),
+		hintNewPeerChan:      make(chan peerHint, MAX_NUM_PEERS),
+		addPeerChan:          make(chan *BtConn, MAX_NUM_PEERS),
 		activePieces:         make(map[int]*ActivePiece),
+		hashJobs:             make(chan *pieceHash),
+		hashResults:          make(chan *pieceHash),
 		quit:                 make(chan bool),
 		ended:                make(chan bool),
+		events:               newEventFeed(),
 		torrentFile:          torrent,
 		chokePolicy:          &ClassicChokePolicy{},
-		chokePolicyHeartbeat: time.Tick(10 * time.Second),
+		chokePolicyHeartbeat: firstChoke(clock),
 		execOnSeedingDone:    len(flags.ExecOnSeeding) == 0,
-	}
+		webSeedResults:       make(chan webSeedResult),
+		commands:             make(chan func()),
+		webSeedReceived:      NewAccumulator(clock.Now()),
+		rateHistory:          newRateHistory(),
+		bandwidthClass:       newBandwidthClass(),
+		seedLimits:           defaultSeedLimits(flags),
+		blockSize:            defaultBlockSize(flags),
+		standardBlockPeers:   make(map[string]bool),
+		fileDir:              dir,
+		opening:              opening,
+		storage:              storage,
+	}
+	if ts.storage.fs == nil {
+		ts.storage.fs = flags.FileSystemProvider
+	}
+	if ts.storage.cacher == nil {
+		ts.storage.cacher = flags.Cacher
+	}
+	ts.ctx, ts.cancel = context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			ts.cancel()
+		}
+	}()
+	ts.webSeedClient = proxyHttpClient(flags.Dial)
+	ts.trackerClient = newTrackerHTTPClient(flags.Dial)
 	fromMagnet := strings.HasPrefix(torrent, "magnet:")
-	ts.M, err = GetMetaInfo(flags.Dial, torrent)
-	if err != nil {
-		return
+	ts.M = m
+	if fromMagnet && flags.MetadataDir != "" {
+		if saved, err := loadSavedMetaInfo(flags.MetadataDir, ts.M); err == nil {
+			log.Println("[", saved.Info.Name, "] Using saved metadata for", ts.M.Info.Name)
+			ts.M = saved
+			fromMagnet = false
+		} else if !os.IsNotExist(err) {
+			log.Println("[", ts.M.Info.Name, "] Ignoring saved metadata:", err)
+		}
 	}
 
-	if ts.M.Announce == "" && len(ts.M.AnnounceList) == 0 {
-		ts.trackerLessMode = true
-	} else {
-		ts.trackerLessMode = ts.flags.TrackerlessMode
+	ts.webSeedState = loadWebSeedState(flags.DataDir, ts.M.InfoHash)
+
+	if flags.WebSeedOnly && fromMagnet {
+		err = errors.New("Can't get a magnet link's metadata from web seeds")
+		return
 	}
 
-	dhtAllowed := flags.UseDHT && ts.M.Info.Private == 0
+	ts.trackerLessMode = !ts.usesTrackers()
+
+	dhtAllowed := flags.UseDHT && !flags.WebSeedOnly && ts.M.Info.Private == 0
 	if flags.UseDHT && !dhtAllowed {
 		log.Println("[", ts.M.Info.Name, "] Can't use DHT because torrent is marked Private")
 	}
@@ -188,43 +360,133 @@ func NewTorrentSession(flags *TorrentFlags, torrent string, listenPort uint16) (
 	}
 	ts.setHeader()
 
+	ts.trackerKey = rand.Uint32()
+	ts.setQueueOrder(0, time.Now())
+	if flags.QuickResume {
+		if r := loadResumeData(flags.DataDir, ts.M.InfoHash); r != nil {
+			ts.resumeState = r
+			ts.Session.Uploaded, ts.Session.Downloaded = r.Uploaded, r.Downloaded
+			ts.trackerKey = r.TrackerKey
+			ts.seededFor = r.SeedingTime
+			if r.SeedLimits != nil {
+				ts.seedLimits, ts.ownSeedLimits = *r.SeedLimits, true
+			}
+			if checkBlockSize(r.BlockSize) == nil {
+				ts.blockSize, ts.ownBlockSize = r.BlockSize, true
+			}
+			if !r.Added.IsZero() {
+				ts.setQueueOrder(r.QueuePriority, r.Added)
+			}
+			atomic.StoreInt32(&ts.forceStart, b2i(r.ForceStart))
+			ts.completeHookRan = r.CompleteHookRan
+			ts.completedAt = r.CompletedAt
+			if ts.fileDir == "" {
+				ts.fileDir = r.FileDir
+			}
+		}
+	}
+	if ts.fileDir == "" {
+		ts.fileDir = flags.FileDir
+	}
+
 	if !ts.Session.FromMagnet {
 		err = ts.load()
 	}
+	// So the queue knows a seed from a download before the loop's started.
+	ts.updateSeeding(ts.clock().Now())
 	return ts, err
 }
 
 func (ts *TorrentSession) reload(metadata string) (err error) {
-	var info InfoDict
-	err = bencode.Unmarshal(bytes.NewReader([]byte(metadata)), &info)
+	m := *ts.M
+	v2, err := m.decodeInfo([]byte(metadata))
+	if err == nil {
+		m.rawInfo = []byte(metadata)
+		err = m.parseV2(v2, nil)
+	}
 	if err != nil {
+		log.Println("[", ts.M.Info.Name, "] Error when reloading torrent: ", err)
+		ts.emit(Event{Type: EVENT_ERROR, Err: err})
+		return
+	}
+	*ts.M = m
+	if ts.M.isV2Only() {
+		err = errors.New("Can't fetch the piece layers of a v2 torrent from peers yet")
 		log.Println("[", ts.M.Info.Name, "] Error when reloading torrent: ", err)
 		return
 	}
-
-	ts.M.Info = info
 	err = ts.load()
+	if err != nil {
+		return
+	}
+	ts.emit(Event{Type: EVENT_METADATA_RECEIVED})
+	ts.wrapFileStore()
+	ts.checkNow()
 
-	if ts.flags.Cacher != nil && ts.fileStore != nil {
-		ts.fileStore = ts.flags.Cacher.NewCache(ts.M.InfoHash, ts.totalPieces, ts.M.Info.PieceLength, ts.totalSize, ts.fileStore)
+	// Peers may have told us what they have before we knew how many pieces
+	// there are.
+	for _, p := range ts.peers {
+		if p.pendingBitfield != nil {
+			have := NewBitsetFromBytes(ts.totalPieces, p.pendingBitfield)
+			p.pendingBitfield = nil
+			if have == nil {
+				log.Println("[", ts.M.Info.Name, "] Invalid bitfield data from", p.address)
+				continue
+			}
+			ts.setPeerHave(p, have)
+			ts.checkInteresting(p)
+		}
+	}
+
+	if ts.Session.UseDHT {
+		if ts.M.Info.Private != 0 {
+			log.Println("[", ts.M.Info.Name, "] Torrent is marked Private, no longer using DHT")
+			ts.Session.UseDHT = false
+		} else {
+			// Announce again now that we can actually serve the torrent.
+			ts.dhtPeersRequest()
+		}
 	}
 	return
 }
 
+// Puts the disk metrics, and then the cache, in front of the files.
+func (ts *TorrentSession) wrapFileStore() {
+	if ts.fileStore == nil {
+		return
+	}
+	if ts.disk != nil {
+		ts.fileStore = &meteredStore{ts.fileStore, ts.disk}
+	}
+	if ts.storage.cacher != nil {
+		ts.fileStore = ts.storage.cacher.NewCache(ts.M.InfoHash, ts.totalPieces, ts.M.Info.PieceLength, ts.totalSize, ts.fileStore)
+	}
+}
+
 func (ts *TorrentSession) load() (err error) {
 	log.Printf("[ %s ] Tracker: %v, Comment: %v, InfoHash: %x, Encoding: %v, Private: %v",
 		ts.M.Info.Name, ts.M.AnnounceList, ts.M.Comment, ts.M.InfoHash, ts.M.Encoding, ts.M.Info.Private)
-	if e := ts.M.Encoding; e != "" && e != "UTF-8" {
-		err = fmt.Errorf("Unknown encoding %v", e)
+	if err = ts.M.validate(); err != nil {
 		return
 	}
 
 	ext := ".torrent"
-	dir := ts.flags.FileDir
-	if len(ts.M.Info.Files) != 0 {
+	dir := ts.fileDir
+	info := ts.M.storeInfo()
+	if len(info.Files) != 0 {
 		torrentName := ts.M.Info.Name
+		if torrentName == "" {
+			torrentName = ts.M.magnetName
+		}
 		if torrentName == "" {
 			torrentName = filepath.Base(ts.torrentFile)
+			if ts.torrentFile == "" {
+				torrentName = hex.EncodeToString([]byte(ts.M.InfoHash))
+			}
+		} else if mn := ts.M.magnetName; mn != "" && mn != torrentName && ts.haveFilesIn(filepath.Join(dir, mn), info) {
+			// We've stored it under the magnet link's name before.
+			log.Println("[", ts.M.Info.Name, "] Using the existing directory", mn)
+			torrentName = mn
 		}
 		// canonicalize the torrent path and make sure it doesn't start with ".."
 		torrentName = path.Clean("/" + torrentName)
@@ -233,18 +495,33 @@ func (ts *TorrentSession) load() (err error) {
 		if strings.HasSuffix(strings.ToLower(dir), ext) {
 			dir = dir[:len(dir)-len(ext)]
 		}
+		ts.dir = dir
+		ts.content.Store(dir)
+	} else {
+		ts.content.Store(filepath.Join(dir, info.Name))
 	}
 
 	var fileSystem FileSystem
-	fileSystem, err = ts.flags.FileSystemProvider.NewFS(dir)
+	fileSystem, err = ts.storage.fs.NewFS(dir)
 	if err != nil {
 		return
 	}
 
-	ts.fileStore, ts.totalSize, err = NewFileStore(&ts.M.Info, fileSystem)
+	crossSeeded := false
+	if ts.flags.CrossSeedDir != "" {
+		fileSystem, crossSeeded = ts.crossSeed(info, dir, fileSystem)
+	}
+
+	// Opening the files creates or resizes them, so see what they were like
+	// first.
+	unchanged := ts.resumeState.unchangedFiles(info, fileSystem)
+
+	ts.fileSystem = fileSystem
+	ts.fileStore, ts.totalSize, err = openFileStore(ts.ctx, info, fileSystem, ts.flags.OpenFilesParallel, ts.opening)
 	if err != nil {
 		return
 	}
+	ts.files, _ = ts.fileStore.(*fileStore)
 
 	if ts.M.Info.PieceLength == 0 {
 		err = fmt.Errorf("Bad PieceLength: %v", ts.M.Info.PieceLength)
@@ -258,6 +535,10 @@ func (ts *TorrentSession) load() (err error) {
 	} else {
 		ts.totalPieces++
 	}
+	if ts.M.isV2Only() && ts.totalPieces != len(ts.M.piecesV2) {
+		err = fmt.Errorf("v2 layout has %v pieces, expected %v", ts.totalPieces, len(ts.M.piecesV2))
+		return
+	}
 
 	if ts.flags.MemoryPerTorrent < 0 {
 		ts.maxActivePieces = 2147483640
@@ -272,34 +553,18 @@ func (ts *TorrentSession) load() (err error) {
 	}
 	
 	ts.goodPieces = 0
-	if ts.flags.InitialCheck {
-		start := time.Now()
-		ts.goodPieces, _, ts.pieceSet, err = checkPieces(ts.fileStore, ts.totalSize, ts.M)
-		end := time.Now()
-		log.Printf("[ %s ] Computed missing pieces (%.2f seconds)\n", ts.M.Info.Name, end.Sub(start).Seconds())
-		if err != nil {
-			return
-		}
-	} else if ts.flags.QuickResume {
-		resumeFilePath := "./" + hex.EncodeToString([]byte(ts.M.InfoHash)) + "-haveBitset"
-		if resumeFile, err := os.Open(resumeFilePath); err == nil {
-			rfstat, _ := resumeFile.Stat()
-			tBA := make([]byte, 2*rfstat.Size())
-			count, _ := resumeFile.Read(tBA)
-			ts.pieceSet = NewBitsetFromBytes(ts.totalPieces, tBA[:count])
-			if ts.pieceSet == nil {
-				return fmt.Errorf("[ %s ] Malformed resume data: %v", ts.M.Info.Name, resumeFilePath)
-			}
-
-			for i := 0; i < ts.totalPieces; i++ {
-				if ts.pieceSet.IsSet(i) {
-					ts.goodPieces++
-				}
-			}
-			log.Printf("[ %s ] Got piece list from haveBitset file.\n", ts.M.Info.Name)
-		} else {
-			log.Printf("[ %s ] Couldn't open haveBitset file: %v", ts.M.Info.Name, err)
-		}
+	resumed := false
+	if unchanged != nil && !crossSeeded {
+		ts.pieceSet, ts.goodPieces, ts.recheck, resumed = ts.resumePieces(unchanged)
+	}
+	if !resumed && !crossSeeded {
+		resumed = ts.trustVerified()
+	}
+	if !resumed && (ts.flags.InitialCheck || crossSeeded) {
+		// The loop checks the pieces, so that the check can be paused. See
+		// recheck.go.
+		ts.recheck = newRecheck(ts.totalPieces)
+		log.Printf("[ %s ] Checking the pieces once it starts\n", ts.M.Info.Name)
 	}
 
 	if ts.pieceSet == nil { //Blank slate it is then.
@@ -308,10 +573,7 @@ func (ts *TorrentSession) load() (err error) {
 	}
 
 	bad := ts.totalPieces - ts.goodPieces
-	left := uint64(bad) * uint64(ts.M.Info.PieceLength)
-	if !ts.pieceSet.IsSet(ts.totalPieces - 1) {
-		left = left - uint64(ts.M.Info.PieceLength) + uint64(ts.lastPieceLength)
-	}
+	left := ts.bytesLeft()
 	ts.Session.Left = left
 
 	log.Println("[", ts.M.Info.Name, "] Good pieces:", ts.goodPieces, "Bad pieces:", bad, "Bytes left:", left)
@@ -325,29 +587,108 @@ func (ts *TorrentSession) load() (err error) {
 			p.have = NewBitset(ts.totalPieces)
 		}
 	}
+	ts.countAvailability()
+
+	// Web seeds are no use until we know the torrent's files.
+	ts.startWebSeeds()
+	if ts.flags.WebSeedOnly && len(ts.webSeedPool) == 0 {
+		err = errors.New("Can't download from web seeds only, since the torrent has no usable web seeds")
+		return
+	}
 
 	ts.Session.HaveTorrent = true
 	return
 }
 
+// Whether dir has one of the files of info, so that it's probably where we
+// stored this torrent before, rather than another torrent's directory. Files
+// are only made once they're written to, so it needn't be the first.
+func (ts *TorrentSession) haveFilesIn(dir string, info *InfoDict) bool {
+	if _, ok := ts.storage.fs.(OsFsProvider); !ok {
+		return false
+	}
+	for _, f := range info.Files {
+		if f.Attr == "p" {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(append([]string{dir}, f.Path...)...))
+		if err == nil && fi.Mode().IsRegular() && fi.Size() <= f.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// crossSeed looks for files we already have for the torrent, and if the
+// matches are confirmed, stores the torrent using them.
+func (ts *TorrentSession) crossSeed(info *InfoDict, dir string, fs FileSystem) (FileSystem, bool) {
+	if _, ok := ts.storage.fs.(OsFsProvider); !ok {
+		log.Println("[", ts.M.Info.Name, "] Cross-seeding needs files stored on disk")
+		return fs, false
+	}
+	matches, err := FindCrossSeedMatches(info, ts.flags.CrossSeedDir, ts.flags.CrossSeedHashCheck)
+	if err != nil {
+		log.Println("[", ts.M.Info.Name, "] Couldn't look for cross-seed files:", err)
+		return fs, false
+	}
+	if crossSeedMatched(matches) == 0 {
+		return fs, false
+	}
+	for _, m := range matches {
+		log.Println("[", ts.M.Info.Name, "] Cross-seed:", m)
+	}
+	if ts.flags.CrossSeedConfirm != nil && !ts.flags.CrossSeedConfirm(ts.M.Info.Name, matches) {
+		log.Println("[", ts.M.Info.Name, "] Not using the cross-seed files")
+		return fs, false
+	}
+	ts.crossSeedMatches = matches
+	return useCrossSeedMatches(matches, dir, fs), true
+}
+
 func (ts *TorrentSession) pieceLength(piece int) int {
+	if ts.M.isV2Only() {
+		// Each file ends with a short piece.
+		return int(ts.M.piecesV2[piece].length)
+	}
 	if piece < ts.totalPieces-1 {
 		return int(ts.M.Info.PieceLength)
 	}
 	return ts.lastPieceLength
 }
 
+// How many bytes of the pieces we don't have.
+func (ts *TorrentSession) bytesLeft() (left uint64) {
+	for i := 0; i < ts.totalPieces; i++ {
+		if !ts.pieceSet.IsSet(i) {
+			left += uint64(ts.pieceLength(i))
+		}
+	}
+	return
+}
+
 func (ts *TorrentSession) fetchTrackerInfo(event string) {
+	si := ts.Session
+	ts.logger().Debug("Announcing", "event", event, "uploaded", si.Uploaded, "downloaded", si.Downloaded, "left", si.Left)
+	ts.lastAnnounce = ts.clock().Now()
+	select {
+	case ts.trackerReportChan <- ts.statusReport(event):
+	case <-ts.ctx.Done():
+	}
+}
+
+func (ts *TorrentSession) statusReport(event string) ClientStatusReport {
 	m, si := ts.M, ts.Session
-	log.Println("[", ts.M.Info.Name, "] Stats: Uploaded", si.Uploaded, "Downloaded", si.Downloaded, "Left", si.Left)
-	ts.trackerReportChan <- ClientStatusReport{
-		event, m.InfoHash, si.PeerID, si.Port, si.Uploaded, si.Downloaded, si.Left}
+	return ClientStatusReport{
+		event, m.InfoHash, si.PeerID, si.Port, si.Uploaded, si.Downloaded, si.Left, ts.trackerKey,
+		ts.announceAddrs.ipv4, ts.announceAddrs.ipv6, &ts.traffic}
 }
 
 func (ts *TorrentSession) setHeader() {
 	header := make([]byte, 68)
 	copy(header, kBitTorrentHeader[0:])
-	if ts.Session.UseDHT {
+	// A read-only DHT client has no node for peers to put in their routing
+	// tables, so it doesn't tell them it has one.
+	if ts.Session.UseDHT && !ts.flags.DHTReadOnly {
 		header[27] = header[27] | 0x01
 	}
 	// Support Extension Protocol (BEP-0010)
@@ -362,11 +703,12 @@ func (ts *TorrentSession) Header() (header []byte) {
 }
 
 // Try to connect if the peer is not already in our peers.
+// source says where we heard about the peer.
 // Can be called from any goroutine.
-func (ts *TorrentSession) HintNewPeer(peer string) {
+func (ts *TorrentSession) HintNewPeer(peer string, source PeerSource) {
 	if len(ts.hintNewPeerChan) < cap(ts.hintNewPeerChan) { //We don't want to block the main loop because a single torrent is having problems
 	select {
-	case ts.hintNewPeerChan <- peer:
+	case ts.hintNewPeerChan <- peerHint{peer, source}:
 	case <-ts.ended:
 	}
 	} else {
@@ -374,11 +716,13 @@ func (ts *TorrentSession) HintNewPeer(peer string) {
 	}
 }
 
-func (ts *TorrentSession) tryNewPeer(peer string) bool {
-	if (ts.Session.HaveTorrent || ts.Session.FromMagnet) && len(ts.peers) < MAX_NUM_PEERS {
+func (ts *TorrentSession) tryNewPeer(peer string, source PeerSource) bool {
+	if (ts.Session.HaveTorrent || ts.Session.FromMagnet) && len(ts.peers) < MAX_NUM_PEERS && !ts.Paused() {
 		if _, ok := ts.Session.OurAddresses[peer]; !ok {
 		if _, ok := ts.peers[peer]; !ok {
-			go ts.connectToPeer(peer)
+			ts.peersFound[source]++
+			atomic.AddInt32(&ts.dialing, 1)
+			go ts.connectToPeer(peer, source)
 			return true
 		}
 		} else {
@@ -388,7 +732,18 @@ func (ts *TorrentSession) tryNewPeer(peer string) bool {
 	return false
 }
 
-func (ts *TorrentSession) connectToPeer(peer string) {
+// Connects to the peers named in the magnet link, if we aren't already.
+func (ts *TorrentSession) tryMagnetPeers() {
+	for _, peer := range ts.M.magnetPeers {
+		ts.tryNewPeer(peer, PEER_SOURCE_MAGNET)
+	}
+}
+
+func (ts *TorrentSession) connectToPeer(peer string, source PeerSource) {
+	defer atomic.AddInt32(&ts.dialing, -1)
+	if ts.blocklist.blockedAddr(peer) {
+		return
+	}
 	conn, err := proxyNetDial(ts.flags.Dial, "tcp", peer)
 	if err != nil {
 		// log.Println("[", ts.M.Info.Name, "] Failed to connect to", peer, err)
@@ -397,14 +752,17 @@ func (ts *TorrentSession) connectToPeer(peer string) {
 
 	_, err = conn.Write(ts.Header())
 	if err != nil {
-		log.Println("[", ts.M.Info.Name, "] Failed to send header to", peer, err)
+		ts.logger().Debug("Couldn't send the header", "peer", peer, "err", err)
 		return
 	}
+	ts.traffic.addSent(TRAFFIC_HANDSHAKE, len(ts.Header()))
 
 	theirheader, err := readHeader(conn)
 	if err != nil {
 		return
 	}
+	// The header's read after the protocol's name, its first 20 bytes.
+	ts.traffic.addReceived(TRAFFIC_HANDSHAKE, 20+len(theirheader))
 
 	peersInfoHash := string(theirheader[8:28])
 	id := string(theirheader[28:48])
@@ -414,16 +772,29 @@ func (ts *TorrentSession) connectToPeer(peer string) {
 		Infohash: peersInfoHash,
 		id:       id,
 		conn:     conn,
+		source:   source,
 	}
 	// log.Println("[", ts.M.Info.Name, "] Connected to", peer)
 	ts.AddPeer(btconn)
 }
 
 func (ts *TorrentSession) AcceptNewPeer(btconn *BtConn) {
-	_, err := btconn.conn.Write(ts.Header())
+	if ts.Paused() {
+		btconn.conn.Close()
+		return
+	}
+	header := ts.Header()
+	if btconn.Infohash != ts.M.InfoHash {
+		// A hybrid torrent's peer using the v2 info-hash. Answer in kind.
+		header = append([]byte(nil), header...)
+		copy(header[28:48], btconn.Infohash)
+	}
+	ts.traffic.addReceived(TRAFFIC_HANDSHAKE, 20+len(btconn.header))
+	_, err := btconn.conn.Write(header)
 	if err != nil {
 		return
 	}
+	ts.traffic.addSent(TRAFFIC_HANDSHAKE, len(header))
 	ts.AddPeer(btconn)
 }
 
@@ -442,7 +813,11 @@ func (ts *TorrentSession) AddPeer(btconn *BtConn) {
 
 func (ts *TorrentSession) addPeerImp(btconn *BtConn) {
 	if !ts.Session.HaveTorrent && !ts.Session.FromMagnet {
-		log.Println("[", ts.M.Info.Name, "] Rejecting peer because we don't have a torrent yet")
+		ts.logger().Debug("Rejecting peer, since we don't have a torrent yet", "peer", btconn.conn.RemoteAddr())
+		btconn.conn.Close()
+		return
+	}
+	if ts.Paused() {
 		btconn.conn.Close()
 		return
 	}
@@ -450,7 +825,7 @@ func (ts *TorrentSession) addPeerImp(btconn *BtConn) {
 	peer := btconn.conn.RemoteAddr().String()
 
 	if btconn.id == ts.Session.PeerID {
-		log.Println("[", ts.M.Info.Name, "] Rejecting self-connection:", peer, "<->", btconn.conn.LocalAddr())
+		ts.logger().Debug("Rejecting self-connection", "peer", peer, "local", btconn.conn.LocalAddr())
 		ts.Session.OurAddresses[btconn.conn.LocalAddr().String()] = true
 		ts.Session.OurAddresses[peer] = true
 		btconn.conn.Close()
@@ -459,15 +834,14 @@ func (ts *TorrentSession) addPeerImp(btconn *BtConn) {
 
 	for _, p := range ts.peers {
 		if p.id == btconn.id {
-			log.Println("[", ts.M.Info.Name, "] Rejecting peer because already have a peer with the same id")
+			ts.logger().Debug("Rejecting peer, since we have a peer with the same id", "peer", peer)
 			btconn.conn.Close()
 			return
 		}
 	}
 
-	// log.Println("[", ts.M.Info.Name, "] Adding peer", peer)
 	if len(ts.peers) >= MAX_NUM_PEERS {
-		log.Println("[", ts.M.Info.Name, "] We have enough peers. Rejecting additional peer", peer)
+		ts.logger().Debug("Rejecting peer, since we have enough", "peer", peer)
 		btconn.conn.Close()
 		return
 	}
@@ -483,9 +857,16 @@ func (ts *TorrentSession) addPeerImp(btconn *BtConn) {
 		}
 	}
 
-	ps := NewPeerState(btconn.conn)
+	conn := btconn.conn
+	if ts.bandwidth != nil {
+		conn = &limitedConn{conn, ts.bandwidth, ts.bandwidthClass}
+	}
+	ps := newPeerState(conn, ts.clock())
 	ps.address = peer
 	ps.id = btconn.id
+	ps.source = btconn.source
+	ps.standardBlocks = ts.standardBlockPeers[peer]
+	ps.traffic = &ts.traffic
 
 	// By default, a peer has no pieces. If it has pieces, it should send
 	// a BITFIELD message as a first message
@@ -496,25 +877,37 @@ func (ts *TorrentSession) addPeerImp(btconn *BtConn) {
 	ps.have = NewBitset(ts.totalPieces)
 
 	ts.peers[peer] = ps
+	ts.logger().Debug("Peer connected", "peer", peer, "source", ps.source, "client", ps.client)
+	ts.emit(Event{Type: EVENT_PEER_CONNECTED, Peer: peer})
 	go ps.peerWriter(ts.peerMessageChan)
 	go ps.peerReader(ts.peerMessageChan)
 
 	if int(theirheader[5])&0x10 == 0x10 {
-		ps.SendExtensions(ts.Session.Port)
+		ps.SendExtensions(ts.Session.Port, len(ts.M.rawInfo))
 	} else if ts.pieceSet != nil {
-		ps.SendBitfield(ts.pieceSet)
+		ts.sendBitfield(ps)
 	}
 }
 
 func (ts *TorrentSession) ClosePeer(peer *peerState) {
-	if ts.Session.ME != nil && !ts.Session.ME.Transferring {
+	if ts.Session.ME != nil && ts.Session.ME.Transferring && !ts.Session.HaveTorrent {
+		// We may have lost the peer the metadata was coming from. Let the
+		// next extension handshake pick up the transfer.
 		ts.Session.ME.Transferring = false
 	}
 
-	//log.Println("[", ts.M.Info.Name, "] Closing peer", peer.address)
+	if ts.unansweredLongRequest(peer) {
+		// It may have hung up on us for asking for too much.
+		ts.standardBlockPeers[peer.address] = true
+	}
 	_ = ts.removeRequests(peer)
 	peer.Close()
-	delete(ts.peers, peer.address)
+	ts.uncountPeer(peer)
+	if ts.peers[peer.address] == peer {
+		ts.logger().Debug("Peer disconnected", "peer", peer.address)
+		delete(ts.peers, peer.address)
+		ts.emit(Event{Type: EVENT_PEER_DISCONNECTED, Peer: peer.address})
+	}
 }
 
 func (ts *TorrentSession) deadlockDetector() {
@@ -544,20 +937,215 @@ func (ts *TorrentSession) Quit() (err error) {
 	return
 }
 
+// Pause stops the torrent's network activity: it closes the peer
+// connections, stops the web seeds, and tells the tracker it's stopped. The
+// files stay open, so Resume is quick. A queued torrent stays paused when its
+// turn comes.
+func (ts *TorrentSession) Pause() error {
+	return ts.runInLoop(func() {
+		atomic.StoreInt32(&ts.queued, 0)
+		ts.pause()
+	})
+}
+
+// Resume undoes Pause, finding peers again. A torrent the queue is holding
+// up waits its turn, unless it's force started. One its files stopped is
+// retried, as Retry does.
+func (ts *TorrentSession) Resume() (err error) {
+	if e := ts.runInLoop(func() {
+		if ts.storageErr != nil {
+			err = ts.retryStorage()
+		} else if !ts.Queued() {
+			ts.resume()
+		}
+	}); e != nil {
+		return e
+	}
+	return
+}
+
+// ForceAnnounce asks every tracker, and the DHT, for peers now, rather than
+// when they're next due. It won't announce to the trackers again within
+// their min interval, or FORCE_ANNOUNCE_COOLDOWN if that's longer.
+func (ts *TorrentSession) ForceAnnounce() (err error) {
+	if e := ts.runInLoop(func() { err = ts.forceAnnounce(ts.clock().Now()) }); e != nil {
+		return e
+	}
+	return
+}
+
+func (ts *TorrentSession) forceAnnounce(now time.Time) error {
+	if ts.Paused() {
+		return errPaused
+	}
+	if !ts.trackerLessMode {
+		if err := ts.announceToEveryTracker(now); err != nil {
+			return err
+		}
+	}
+	if ts.Session.UseDHT {
+		ts.dhtPeersRequest()
+	}
+	return nil
+}
+
+// Announces to every tracker, unless it's too soon since the last time.
+func (ts *TorrentSession) announceToEveryTracker(now time.Time) error {
+	cooldown := FORCE_ANNOUNCE_COOLDOWN
+	if ts.ti != nil && time.Duration(ts.ti.MinInterval)*time.Second > cooldown {
+		cooldown = time.Duration(ts.ti.MinInterval) * time.Second
+	}
+	if now.Sub(ts.lastAnnounce) < cooldown {
+		return errAnnounceTooSoon
+	}
+	ts.lastAnnounce = now
+	log.Println("[", ts.M.Info.Name, "] Announcing to every tracker")
+	announceAll(ts.ctx, ts.flags.Dial, ts.trackerClient, fullAnnounceList(ts.M.Announce, ts.M.AnnounceList),
+		ts.statusReport(""), ts.trackerStatuses, ts.trackerInfoChan, ts.ended)
+	return nil
+}
+
+// Starts the tracker client, on the main loop.
+func (ts *TorrentSession) startTrackers() {
+	// Start out polling tracker every 20 seconds until we get a response.
+	// Maybe be exponential backoff here?
+	ts.retracker = ts.clock().Tick(20 * time.Second)
+	ts.trackerInfoChan = make(chan *TrackerResponse)
+	ts.trackerReportChan = make(chan ClientStatusReport)
+	ts.trackerStatuses = startTrackerClient(ts.ctx, ts.flags.Dial, ts.trackerClient, ts.M.Announce, ts.M.AnnounceList, ts.trackerInfoChan, ts.trackerReportChan)
+}
+
+// Tells peers and trackers to connect on port from now on. Called on the
+// main loop, or before it starts.
+func (ts *TorrentSession) usePort(port uint16) {
+	ts.Session.Port = port
+	ts.Session.OurAddresses["127.0.0.1:"+strconv.Itoa(int(port))] = true
+}
+
+// setListenPort switches to port and addrs, announcing them to every tracker.
+func (ts *TorrentSession) setListenPort(port uint16, addrs announceAddrs) error {
+	return ts.runInLoop(func() {
+		if port == ts.Session.Port && addrs == ts.announceAddrs {
+			return
+		}
+		ts.usePort(port)
+		ts.announceAddrs = addrs
+		if !ts.trackerLessMode && !ts.Paused() {
+			ts.lastAnnounce = ts.clock().Now()
+			announceAll(ts.ctx, ts.flags.Dial, ts.trackerClient, fullAnnounceList(ts.M.Announce, ts.M.AnnounceList),
+				ts.statusReport(""), ts.trackerStatuses, ts.trackerInfoChan, ts.ended)
+		}
+	})
+}
+
+// Paused says whether the torrent is paused.
+func (ts *TorrentSession) Paused() bool {
+	return atomic.LoadInt32(&ts.paused) != 0
+}
+
+func (ts *TorrentSession) pause() {
+	if ts.recheck != nil {
+		ts.recheck.stop()
+	}
+	if ts.Paused() {
+		return
+	}
+	atomic.StoreInt32(&ts.paused, 1)
+	log.Println("[", ts.M.Info.Name, "] Pausing")
+	for _, peer := range ts.peers {
+		ts.ClosePeer(peer)
+	}
+	ts.stopWebSeeds()
+	if !ts.trackerLessMode && ts.Session.HaveTorrent {
+		ts.fetchTrackerInfo("stopped")
+	}
+	if f, ok := ts.fileStore.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			ts.logger().Error("Couldn't flush the cache", "err", err)
+		}
+	}
+	ts.saveResumeData()
+}
+
+func (ts *TorrentSession) resume() {
+	if ts.storageErr != nil {
+		ts.logger().Info("Staying paused until its files are retried")
+		return
+	}
+	if r := ts.recheck; r != nil {
+		r.wasPaused = false
+		if ts.checking() {
+			log.Println("[", ts.M.Info.Name, "] Will resume once the recheck's done")
+			r.stopped = false
+		} else {
+			log.Println("[", ts.M.Info.Name, "] Going on with the check")
+			ts.startCheck(r)
+		}
+		return
+	}
+	if !ts.Paused() {
+		return
+	}
+	atomic.StoreInt32(&ts.paused, 0)
+	log.Println("[", ts.M.Info.Name, "] Resuming")
+	if !ts.trackerLessMode && ts.Session.HaveTorrent {
+		ts.fetchTrackerInfo("started")
+	}
+	if ts.Session.UseDHT {
+		ts.dhtPeersRequest()
+	}
+	if !ts.flags.WebSeedOnly {
+		ts.tryMagnetPeers()
+	}
+	ts.scheduleWebSeeds()
+}
+
+var (
+	errSessionEnded    = errors.New("Torrent session has ended")
+	errPaused          = errors.New("Torrent is paused")
+	errAnnounceTooSoon = errors.New("Announced too recently, try again later")
+)
+
+// runInLoop has the torrent's main loop call f, so that f can use the
+// session's state.
+func (ts *TorrentSession) runInLoop(f func()) error {
+	done := make(chan bool)
+	select {
+	case ts.commands <- func() { f(); close(done) }:
+	case <-ts.ended:
+		return errSessionEnded
+	}
+	<-done
+	return nil
+}
+
 func (ts *TorrentSession) Shutdown() (err error) {
 	close(ts.ended)
+	ts.cancel()
 
+	ts.saveResumeData()
 	if ts.fileStore != nil {
 		err = ts.fileStore.Close()
 		if err != nil {
-			log.Println("[", ts.M.Info.Name, "] Error closing filestore:", err)
+			ts.logger().Error("Couldn't close the files", "err", err)
 		}
 	}
 
 	for _, peer := range ts.peers {
 		peer.Close()
 	}
+	ts.stopWebSeeds()
+	ts.events.close()
 
+	// Last, so the trackers hear our final stats. Paused torrents already
+	// told them.
+	if ts.trackerStatuses != nil && !ts.Paused() {
+		log.Println("[", ts.M.Info.Name, "] Telling the trackers we've stopped")
+		if !announceStopped(ts.flags.Dial, ts.trackerClient, fullAnnounceList(ts.M.Announce, ts.M.AnnounceList),
+			ts.statusReport("stopped"), ts.trackerStatuses, STOPPED_ANNOUNCE_TIMEOUT) {
+			log.Println("[", ts.M.Info.Name, "] No tracker heard we've stopped")
+		}
+	}
 	return
 }
 
@@ -567,67 +1155,87 @@ func (ts *TorrentSession) DoTorrent() {
 		go ts.deadlockDetector()
 	}
 
-	if ts.flags.Cacher != nil && ts.fileStore != nil {
-		ts.fileStore = ts.flags.Cacher.NewCache(ts.M.InfoHash, ts.totalPieces, ts.M.Info.PieceLength, ts.totalSize, ts.fileStore)
-	}
+	ts.wrapFileStore()
+	ts.startPieceHashers()
 
 	heartbeatDuration := 1 * time.Second
-	heartbeatChan := time.Tick(heartbeatDuration)
+	heartbeatChan := ts.clock().Tick(heartbeatDuration)
 
-	keepAliveChan := time.Tick(60 * time.Second)
-	var retrackerChan <-chan time.Time
-	ts.hintNewPeerChan = make(chan string, MAX_NUM_PEERS)
-	ts.addPeerChan = make(chan *BtConn, MAX_NUM_PEERS)
+	keepAliveChan := ts.clock().Tick(60 * time.Second)
 	if !ts.trackerLessMode {
-		// Start out polling tracker every 20 seconds until we get a response.
-		// Maybe be exponential backoff here?
-		retrackerChan = time.Tick(20 * time.Second)
-		ts.trackerInfoChan = make(chan *TrackerResponse)
-		ts.trackerReportChan = make(chan ClientStatusReport)
-		startTrackerClient(ts.flags.Dial, ts.M.Announce, ts.M.AnnounceList, ts.trackerInfoChan, ts.trackerReportChan)
+		ts.startTrackers()
 	}
 
-	if ts.Session.UseDHT {
-		ts.dht.PeersRequest(ts.M.InfoHash, true)
+	// The check load left, which the torrent stays paused for. One that was
+	// paused part way, and is restored paused, waits until it's resumed.
+	if r := ts.recheck; r != nil && !(r.stopped && ts.Paused()) {
+		r.wasPaused = ts.Paused()
+		atomic.StoreInt32(&ts.paused, 1)
+		ts.startCheck(r)
 	}
 
-	if !ts.trackerLessMode && ts.Session.HaveTorrent {
-		ts.fetchTrackerInfo("started")
+	// A torrent restored paused stays quiet until it's resumed.
+	if !ts.Paused() {
+		// Peers from the magnet link go first: they're the ones we were told
+		// to use.
+		if !ts.flags.WebSeedOnly {
+			ts.tryMagnetPeers()
+		}
+
+		if ts.Session.UseDHT {
+			ts.dhtPeersRequest()
+		}
+
+		if !ts.trackerLessMode && ts.Session.HaveTorrent {
+			ts.fetchTrackerInfo("started")
+		}
 	}
 
 	defer ts.Shutdown()
 
 	lastDownloaded := ts.Session.Downloaded
+	lastWebSeedDownloaded := ts.Session.WebSeedDownloaded
 
 	for {
 		if !ts.execOnSeedingDone && ts.goodPieces == ts.totalPieces {
 			ts.execOnSeeding()
 			ts.execOnSeedingDone = true
 		}
+		hashJobs, nextHash := ts.nextPieceHash()
 		select {
 		case <-ts.chokePolicyHeartbeat:
+			ts.chokePolicyHeartbeat = ts.clock().After(CHOKE_INTERVAL)
 			ts.chokePeers()
-		case hintNewPeer := <-ts.hintNewPeerChan:
-			ts.tryNewPeer(hintNewPeer)
+		case hashJobs <- nextHash:
+			ts.hashQueue = ts.hashQueue[1:]
+		case h := <-ts.hashResults:
+			ts.pieceHashed(h)
+		case <-ts.haveFlush:
+			ts.flushHaves()
+		case hint := <-ts.hintNewPeerChan:
+			ts.tryNewPeer(hint.addr, hint.source)
 		case btconn := <-ts.addPeerChan:
 			ts.addPeerImp(btconn)
-		case <-retrackerChan:
-			if !ts.trackerLessMode {
+		case <-ts.retracker:
+			if !ts.trackerLessMode && !ts.Paused() {
 				ts.fetchTrackerInfo("")
 			}
 		case ti := <-ts.trackerInfoChan:
 			ts.ti = ti
-			log.Println("[", ts.M.Info.Name, "] Torrent has", ts.ti.Complete, "seeders and", ts.ti.Incomplete, "leachers")
-			if !ts.trackerLessMode {
+			if ts.externalAddr != nil && (len(ti.ExternalIP) == net.IPv4len || len(ti.ExternalIP) == net.IPv6len) {
+				ts.externalAddr.Vote("tracker", net.IP(ti.ExternalIP))
+			}
+			ts.logger().Info("Tracker response", "seeders", ts.ti.Complete, "leechers", ts.ti.Incomplete)
+			if !ts.trackerLessMode && !ts.Paused() {
 				newPeerCount := 0
 				{
 					peers := ts.ti.Peers
 					if len(peers) > 0 {
 						const peerLen = 6
-						log.Println("[", ts.M.Info.Name, "] Tracker gave us", len(peers)/peerLen, "peers")
+						ts.logger().Debug("Tracker peers", "ipv4", len(peers)/peerLen)
 						for i := 0; i < len(peers); i += peerLen {
 							peer := nettools.BinaryToDottedPort(peers[i : i+peerLen])
-							if ts.tryNewPeer(peer) {
+							if ts.tryNewPeer(peer, PEER_SOURCE_TRACKER) {
 								newPeerCount++
 							}
 						}
@@ -637,19 +1245,19 @@ func (ts *TorrentSession) DoTorrent() {
 					peers6 := ts.ti.Peers6
 					if len(peers6) > 0 {
 						const peerLen = 18
-						log.Println("[", ts.M.Info.Name, "] Tracker gave us", len(peers6)/peerLen, "IPv6 peers")
+						ts.logger().Debug("Tracker peers", "ipv6", len(peers6)/peerLen)
 						for i := 0; i < len(peers6); i += peerLen {
 							peerEntry := peers6[i : i+peerLen]
 							host := net.IP(peerEntry[0:16])
 							port := int((uint(peerEntry[16]) << 8) | uint(peerEntry[17]))
 							peer := net.JoinHostPort(host.String(), strconv.Itoa(port))
-							if ts.tryNewPeer(peer) {
+							if ts.tryNewPeer(peer, PEER_SOURCE_TRACKER) {
 								newPeerCount++
 							}
 						}
 					}
 				}
-				log.Println("[", ts.M.Info.Name, "] Contacting", newPeerCount, "new peers")
+				ts.logger().Debug("Contacting new peers", "count", newPeerCount)
 			}
 
 			interval := ts.ti.Interval
@@ -660,16 +1268,22 @@ func (ts *TorrentSession) DoTorrent() {
 			} else if interval > maxInterval {
 				interval = maxInterval
 			}
-			log.Println("[", ts.M.Info.Name, "] ..checking again in", interval, "seconds")
-			retrackerChan = time.Tick(time.Duration(interval) * time.Second)
-
+			ts.logger().Debug("Next announce", "seconds", interval)
+			ts.retracker = ts.clock().Tick(time.Duration(interval) * time.Second)
+
+		case f := <-ts.commands:
+			f()
+		case r := <-ts.webSeedResults:
+			ts.doWebSeedResult(r)
+			ts.scheduleWebSeeds()
 		case pm := <-ts.peerMessageChan:
 			peer, message := pm.peer, pm.message
-			peer.lastReadTime = time.Now()
+			peer.lastReadTime = ts.clock().Now()
 			err2 := ts.DoMessage(peer, message)
+			putMessageBuffer(message)
 			if err2 != nil {
 				if err2 != io.EOF {
-					log.Println("[", ts.M.Info.Name, "] Closing peer", peer.address, "because", err2)
+					ts.logger().Debug("Closing peer", "peer", peer.address, "err", err2)
 				}
 				ts.ClosePeer(peer)
 			}
@@ -677,28 +1291,55 @@ func (ts *TorrentSession) DoTorrent() {
 			if ts.flags.UseDeadlockDetector {
 				ts.heartbeat <- true
 			}
-			ratio := float64(0.0)
-			if ts.Session.Downloaded > 0 {
-				ratio = float64(ts.Session.Uploaded) / float64(ts.Session.Downloaded)
+			now := ts.clock().Now()
+			ts.checkDryPool(now)
+			ts.updateSeeding(now)
+			ts.recordRates(now)
+			ts.eta.sample(now, ts.Session.Left)
+			if ts.checking() {
+				ts.emitCheckProgress()
+			}
+			if ts.Paused() {
+				ts.logger().Debug("Paused", "pieces", ts.goodPieces, "of", ts.totalPieces)
+				continue
+			}
+			ts.scheduleWebSeeds()
+			if now.Sub(ts.resumeSaved) >= RESUME_SAVE_INTERVAL {
+				ts.saveResumeData()
 			}
+			ratio := ts.ratio()
 			speed := humanSize(float64(ts.Session.Downloaded-lastDownloaded) / heartbeatDuration.Seconds())
 			lastDownloaded = ts.Session.Downloaded
-			log.Printf("[ %s ] Peers: %d downloaded: %d (%s/s) uploaded: %d ratio: %f pieces: %d/%d\n",
-				ts.M.Info.Name,
-				len(ts.peers),
-				ts.Session.Downloaded,
-				speed,
-				ts.Session.Uploaded,
-				ratio,
-				ts.goodPieces,
-				ts.totalPieces)
-			if ts.totalPieces != 0 && ts.goodPieces == ts.totalPieces && ratio >= ts.flags.SeedRatio {
-				log.Println("[", ts.M.Info.Name, "] Achieved target seed ratio", ts.flags.SeedRatio)
+			webSeedSpeed := humanSize(float64(ts.Session.WebSeedDownloaded-lastWebSeedDownloaded) / heartbeatDuration.Seconds())
+			lastWebSeedDownloaded = ts.Session.WebSeedDownloaded
+			ts.logger().Debug("Progress", "peers", len(ts.peers), "sources", ts.connectedPeerSources(),
+				"downloaded", ts.Session.Downloaded, "speed", speed+"/s", "uploaded", ts.Session.Uploaded,
+				"ratio", ratio, "pieces", ts.goodPieces, "of", ts.totalPieces)
+			if len(ts.webSeedPool) > 0 {
+				ts.logger().Debug("Web seeds", "count", len(ts.webSeedPool),
+					"downloaded", ts.Session.WebSeedDownloaded, "speed", webSeedSpeed+"/s")
+				for _, h := range ts.webSeedHealth() {
+					ts.logger().Debug("Web seed", "health", h)
+				}
+			}
+			if ts.flags.WebSeedOnly {
+				// There's nobody to seed to.
+				if ts.goodPieces == ts.totalPieces {
+					log.Println("[", ts.M.Info.Name, "] Downloaded from web seeds")
+					return
+				}
+				if ts.webSeedsDisabled() {
+					log.Println("[", ts.M.Info.Name, "] Giving up, since all the web seeds failed")
+					ts.emit(Event{Type: EVENT_ERROR, Err: errors.New("All the web seeds failed")})
+					return
+				}
+			}
+			if ts.checkSeedLimits(now) {
 				return
 			}
 			if len(ts.peers) < TARGET_NUM_PEERS && (ts.totalPieces == 0 || ts.goodPieces < ts.totalPieces) {
 				if ts.Session.UseDHT {
-					go ts.dht.PeersRequest(ts.M.InfoHash, true)
+					ts.dhtPeersRequest()
 				}
 				if !ts.trackerLessMode {
 					if ts.ti == nil || ts.ti.Complete > 100 {
@@ -707,7 +1348,11 @@ func (ts *TorrentSession) DoTorrent() {
 				}
 			}
 		case <-keepAliveChan:
-			now := time.Now()
+			ts.logger().Debug("Peers found", "sources", ts.peersFound, "dhtAnnounces", ts.dhtAnnounces)
+			if len(ts.peers) < TARGET_NUM_PEERS && !ts.flags.WebSeedOnly && !ts.Paused() {
+				ts.tryMagnetPeers()
+			}
+			now := ts.clock().Now()
 			for _, peer := range ts.peers {
 				if peer.lastReadTime.Second() != 0 && now.Sub(peer.lastReadTime) > 3*time.Minute {
 					// log.Println("[", ts.M.Info.Name, "] Closing peer", peer.address, "because timed out")
@@ -717,7 +1362,7 @@ func (ts *TorrentSession) DoTorrent() {
 				err2 := ts.doCheckRequests(peer)
 				if err2 != nil {
 					if err2 != io.EOF {
-						log.Println("[", ts.M.Info.Name, "] Closing peer", peer.address, "because", err2)
+						ts.logger().Debug("Closing peer", "peer", peer.address, "err", err2)
 					}
 					ts.ClosePeer(peer)
 					continue
@@ -727,24 +1372,45 @@ func (ts *TorrentSession) DoTorrent() {
 
 		case <-ts.quit:
 			log.Println("[", ts.M.Info.Name, "] Quitting torrent session")
-			ts.fetchTrackerInfo("stopped")
-			time.Sleep(10*time.Millisecond)
+			return
+		case <-ts.ctx.Done():
+			log.Println("[", ts.M.Info.Name, "] Torrent session cancelled")
 			return
 		}
 	}
 }
 
+func (ts *TorrentSession) dhtPeersRequest() {
+	for _, ih := range ts.M.InfoHashes() {
+		ts.dhtAnnounces++
+		go ts.dht.PeersRequest(ih, true)
+	}
+}
+
+// How many of our peers came from each source.
+func (ts *TorrentSession) connectedPeerSources() (counts PeerSourceCounts) {
+	for _, p := range ts.peers {
+		counts[p.source]++
+	}
+	return
+}
+
+// The interested peers' rates are worked out once, with the choke half-life,
+// so the policy sorts by rates that don't change under it, and a session's
+// chokers are kept from one time to the next.
 func (ts *TorrentSession) chokePeers() (err error) {
 	// log.Printf("[ %s ] Choking peers", ts.M.Info.Name)
 	peers := ts.peers
-	chokers := make([]Choker, 0, len(peers))
+	chokers := ts.chokers[:0]
+	now, halfLife := ts.clock().Now(), ts.chokeRateHalfLife()
 	for _, peer := range peers {
 		if peer.peer_interested {
-			peer.computeDownloadRate()
+			peer.chokeRate = peer.received.GetRate(now, halfLife)
 			// log.Printf("%s %g bps", peer.address, peer.DownloadBPS())
 			chokers = append(chokers, Choker(peer))
 		}
 	}
+	ts.chokers = chokers
 	var unchokeCount int
 	unchokeCount, err = ts.chokePolicy.Choke(chokers)
 	if err != nil {
@@ -767,8 +1433,9 @@ func (ts *TorrentSession) RequestBlock(p *peerState) (error) {
 		return nil
 	}
 
-	for k := range ts.activePieces {
-		if p.have.IsSet(k) {
+	blockSize := ts.peerBlockSize(p)
+	for k, v := range ts.activePieces {
+		if p.have.IsSet(k) && (v.blockSize <= blockSize || v.splitBlocks(blockSize)) {
 			err := ts.RequestBlock2(p, k, false) 
 			if err != io.EOF {
 				return err
@@ -784,8 +1451,8 @@ func (ts *TorrentSession) RequestBlock(p *peerState) (error) {
 	piece := ts.ChoosePiece(p)
 	if piece < 0 {
 		// No unclaimed pieces. See if we can double-up on an active piece
-		for k := range ts.activePieces {
-			if p.have.IsSet(k) {
+		for k, v := range ts.activePieces {
+			if p.have.IsSet(k) && (v.blockSize <= blockSize || v.splitBlocks(blockSize)) {
 				err := ts.RequestBlock2(p, k, true)
 				if err != io.EOF {
 					return err
@@ -798,13 +1465,19 @@ func (ts *TorrentSession) RequestBlock(p *peerState) (error) {
 		p.SetInterested(false)
 		return nil
 	}
-	pieceLength := ts.pieceLength(piece)
-	pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
-	ts.activePieces[piece] = &ActivePiece{make([]int, pieceCount), make([]byte, pieceLength)}
+	v := ts.startPiece(piece, blockSize, len(ts.activePieces) == 0)
+	if v == nil {
+		// Over the memory budget, so the active pieces are finished first.
+		return nil
+	}
+	ts.activePieces[piece] = v
 	return ts.RequestBlock2(p, piece, false)
 }
 
 func (ts *TorrentSession) ChoosePiece(p *peerState) (piece int) {
+	if piece = ts.choosePriorityPiece(p); piece >= 0 {
+		return
+	}
 	n := ts.totalPieces
 	start := rand.Intn(n)
 	piece = ts.checkRange(p, start, n)
@@ -830,7 +1503,10 @@ func (ts *TorrentSession) checkRange(p *peerState, start, end int) (piece int) {
 
 func (ts *TorrentSession) RequestBlock2(p *peerState, piece int, endGame bool) (err error) {
 	v := ts.activePieces[piece]
-	block := v.chooseBlockToDownload(endGame)
+	block := v.chooseBlockToDownload(endGame, func(block int) bool {
+		_, ok := p.our_requests[(uint64(piece)<<32)|uint64(block*v.blockSize)]
+		return ok
+	})
 	if block >= 0 {
 		ts.requestBlockImp(p, piece, block, true)
 	} else {
@@ -841,18 +1517,16 @@ func (ts *TorrentSession) RequestBlock2(p *peerState, piece int, endGame bool) (
 
 // Request or cancel a block
 func (ts *TorrentSession) requestBlockImp(p *peerState, piece int, block int, request bool) {
-	begin := block * STANDARD_BLOCK_LENGTH
+	blockSize := ts.activePieces[piece].blockSize
+	begin := block * blockSize
 	req := make([]byte, 13)
 	opcode := byte(REQUEST)
 	if !request {
 		opcode = byte(CANCEL)
 	}
-	length := STANDARD_BLOCK_LENGTH
-	if piece == ts.totalPieces-1 {
-		left := ts.lastPieceLength - begin
-		if left < length {
-			length = left
-		}
+	length := blockSize
+	if left := ts.pieceLength(piece) - begin; left < length {
+		length = left
 	}
 	// log.Println("[", ts.M.Info.Name, "] Requesting block", piece, ".", block, length, request)
 	req[0] = opcode
@@ -863,19 +1537,19 @@ func (ts *TorrentSession) requestBlockImp(p *peerState, piece int, block int, re
 	if !request {
 		delete(p.our_requests, requestIndex)
 	} else {
-		p.our_requests[requestIndex] = time.Now()
+		p.our_requests[requestIndex] = ts.clock().Now()
 	}
 	p.sendMessage(req)
 	return
 }
 
 func (ts *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32) (err error) {
-	block := begin / STANDARD_BLOCK_LENGTH
-	// log.Println("[", ts.M.Info.Name, "] Received block", piece, ".", block)
+	// log.Println("[", ts.M.Info.Name, "] Received block", piece, ".", begin)
 	requestIndex := (uint64(piece) << 32) | uint64(begin)
 	delete(p.our_requests, requestIndex)
 	v, ok := ts.activePieces[int(piece)]
 	if ok {
+		block := begin / uint32(v.blockSize)
 		requestCount := v.recordBlock(int(block))
 		if requestCount > 1 {
 			// Someone else has also requested this, so send cancel notices
@@ -889,55 +1563,91 @@ func (ts *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 			}
 		}
 		ts.Session.Downloaded += uint64(length)
-		if v.isComplete() {
-			delete(ts.activePieces, int(piece))
-
-			ok, err = checkPiece(v.buffer, ts.M, int(piece))
-			if !ok || err != nil {
-				log.Println("[", ts.M.Info.Name, "] Closing peer that sent a bad piece", piece, p.id, err)
-				p.Close()
-				return
-			}
-			ts.fileStore.WritePiece(v.buffer, int(piece))
-			ts.Session.Left -= uint64(len(v.buffer))
-			ts.pieceSet.Set(int(piece))
-			ts.goodPieces++
-			if ts.flags.QuickResume {
-				ioutil.WriteFile("./"+hex.EncodeToString([]byte(ts.M.InfoHash))+"-haveBitset", ts.pieceSet.Bytes(), 0777)
-			}
-			var percentComplete float32
-			if ts.totalPieces > 0 {
-				percentComplete = float32(ts.goodPieces*100) / float32(ts.totalPieces)
-			}
-			log.Println("[", ts.M.Info.Name, "] Have", ts.goodPieces, "of", ts.totalPieces,
-				"pieces", percentComplete, "% complete")
-			if ts.goodPieces == ts.totalPieces {
-				if !ts.trackerLessMode {
-					ts.fetchTrackerInfo("completed")
+		if requestCount >= 0 && v.isComplete() {
+			ts.hashPiece(int(piece), v, func(good bool, err error) {
+				if !good || err != nil {
+					ts.logger().Warn("Closing peer that sent a bad piece", "peer", p.address, "piece", piece, "err", err)
+					p.Close()
 				}
-				// TODO: Drop connections to all seeders.
-			}
-			for _, p := range ts.peers {
-				if p.have != nil {
-					if int(piece) < p.have.n && p.have.IsSet(int(piece)) {
-						// We don't do anything special. We rely on the caller
-						// to decide if this peer is still interesting.
-					} else {
-						// log.Println("[", ts.M.Info.Name, "] ...telling ", p)
-						haveMsg := make([]byte, 5)
-						haveMsg[0] = HAVE
-						uint32ToBytes(haveMsg[1:5], piece)
-						p.sendMessage(haveMsg)
-					}
-				}
-			}
+			})
 		}
 	} else {
-		log.Println("[", ts.M.Info.Name, "] Received a block we already have.", piece, block, p.address)
+		ts.logger().Debug("Received a block we already have", "piece", piece, "begin", begin, "peer", p.address)
+		atomic.AddInt64(&ts.traffic.duplicate, int64(length))
 	}
 	return
 }
 
+// finishPiece saves a piece whose blocks have all arrived if its hash was
+// good, and drops it either way.
+func (ts *TorrentSession) finishPiece(h *pieceHash) (good bool, err error) {
+	piece, v := h.piece, h.v
+	good, err = h.good, h.err
+	delete(ts.activePieces, piece)
+	defer v.release()
+	if !good || err != nil {
+		ts.hashFailures++
+		atomic.AddInt64(&ts.traffic.hashFailed, int64(ts.pieceLength(piece)))
+		ts.emit(Event{Type: EVENT_PIECE_FAILED, Piece: piece})
+		return
+	}
+	var e error
+	if v.store != nil {
+		// Its blocks are in the files already.
+		if ts.M.isV2Only() && piece < ts.totalPieces-1 {
+			e = ts.padSegmentedPiece(piece, v)
+		}
+	} else {
+		buffer := v.buffer
+		if ts.M.isV2Only() && piece < ts.totalPieces-1 {
+			// Pad the end of the file out to the next piece.
+			buffer = append(buffer, make([]byte, ts.M.Info.PieceLength-int64(len(buffer)))...)
+		}
+		_, e = ts.fileStore.WritePiece(buffer, piece)
+	}
+	if e != nil {
+		var beyond *ErrWriteBeyondStore
+		if errors.As(e, &beyond) {
+			// What was sent can't be the torrent's, so whoever sent it is
+			// dropped.
+			err = e
+		}
+		ts.logger().Error("Couldn't write piece", "piece", piece, "err", e)
+		ts.emit(Event{Type: EVENT_ERROR, Piece: piece, Err: e})
+		if err == nil {
+			// Otherwise not the peer's fault, but the files'.
+			ts.storageFailed(piece, e)
+		}
+		return
+	}
+	ts.Session.Left -= uint64(v.length)
+	ts.setHavePiece(piece, true)
+	ts.goodPieces++
+	ts.emit(Event{Type: EVENT_PIECE_VERIFIED, Piece: piece})
+	ts.wakeReaders()
+	ts.stopRedundantWebSeedFetches()
+	var percentComplete float32
+	if ts.totalPieces > 0 {
+		percentComplete = float32(ts.goodPieces*100) / float32(ts.totalPieces)
+	}
+	ts.logger().Debug("Piece done", "piece", piece, "have", ts.goodPieces, "of", ts.totalPieces, "percent", percentComplete)
+	if ts.goodPieces == ts.totalPieces {
+		ts.completedAt = ts.clock().Now()
+		if !ts.trackerLessMode {
+			ts.fetchTrackerInfo("completed")
+		}
+		ts.runCompleteHook()
+		ts.saveVerified()
+		if !ts.completedSent {
+			ts.completedSent = true
+			ts.emit(Event{Type: EVENT_COMPLETED})
+		}
+		// TODO: Drop connections to all seeders.
+	}
+	ts.queueHave(piece)
+	return
+}
+
 func (ts *TorrentSession) doChoke(p *peerState) (err error) {
 	p.peer_choking = true
 	err = ts.removeRequests(p)
@@ -948,29 +1658,37 @@ func (ts *TorrentSession) removeRequests(p *peerState) (err error) {
 	for k := range p.our_requests {
 		piece := int(k >> 32)
 		begin := int(k & 0xffffffff)
-		block := begin / STANDARD_BLOCK_LENGTH
-		// log.Println("[", ts.M.Info.Name, "] Forgetting we requested block ", piece, ".", block)
-		ts.removeRequest(piece, block)
+		// log.Println("[", ts.M.Info.Name, "] Forgetting we requested block ", piece, ".", begin)
+		ts.removeRequest(piece, begin)
 	}
 	p.our_requests = make(map[uint64]time.Time, MAX_OUR_REQUESTS)
 	return
 }
 
-func (ts *TorrentSession) removeRequest(piece, block int) {
+// Forgets a request for the block at begin in piece.
+func (ts *TorrentSession) removeRequest(piece, begin int) {
 	v, ok := ts.activePieces[piece]
-	if ok && v.downloaderCount[block] > 0 {
+	if !ok {
+		return
+	}
+	if block := begin / v.blockSize; v.downloaderCount[block] > 0 {
 		v.downloaderCount[block]--
 	}
 }
 
 func (ts *TorrentSession) doCheckRequests(p *peerState) (err error) {
-	now := time.Now()
+	now := ts.clock().Now()
 	for k, v := range p.our_requests {
 		if now.Sub(v).Seconds() > 30 {
 			piece := int(k >> 32)
-			block := int(k&0xffffffff) / STANDARD_BLOCK_LENGTH
-			// log.Println("[", ts.M.Info.Name, "] timing out request of", piece, ".", block)
-			ts.removeRequest(piece, block)
+			begin := int(k & 0xffffffff)
+			if a, ok := ts.activePieces[piece]; ok && a.blockSize > STANDARD_BLOCK_LENGTH && !p.sentLongBlock {
+				// Some peers ignore requests for blocks longer than they
+				// like.
+				return ts.useStandardBlocks(p)
+			}
+			// log.Println("[", ts.M.Info.Name, "] timing out request of", piece, ".", begin)
+			ts.removeRequest(piece, begin)
 		}
 	}
 	return
@@ -993,12 +1711,21 @@ func (ts *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 }
 
 func (ts *TorrentSession) extensionMessage(message []byte, p *peerState) (err error) {
-	if message[0] == EXTENSION {
+	switch message[0] {
+	case EXTENSION:
 		err := ts.DoExtension(message[1:], p)
 		if err != nil {
-			log.Printf("[ %s ] Failed extensions for %s: %s\n", ts.M.Info.Name, p.address, err)
+			ts.logger().Debug("Bad extension message", "peer", p.address, "err", err)
+		}
+	case BITFIELD:
+		// Keep it until the metadata tells us how many pieces there are.
+		if p.can_receive_bitfield {
+			p.pendingBitfield = append([]byte(nil), message[1:]...)
 		}
 	}
+	if message[0] != EXTENSION {
+		p.can_receive_bitfield = false
+	}
 	return
 }
 
@@ -1044,7 +1771,7 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		}
 		n := bytesToUint32(message[1:])
 		if n < uint32(p.have.n) {
-			p.have.Set(int(n))
+			ts.peerHas(p, int(n))
 			if !p.am_interested && !ts.pieceSet.IsSet(int(n)) {
 				p.SetInterested(true)
 			}
@@ -1056,10 +1783,11 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		if !p.can_receive_bitfield {
 			return errors.New("Late bitfield operation")
 		}
-		p.have = NewBitsetFromBytes(ts.totalPieces, message[1:])
-		if p.have == nil {
+		have := NewBitsetFromBytes(ts.totalPieces, message[1:])
+		if have == nil {
 			return errors.New("Invalid bitfield data")
 		}
+		ts.setPeerHave(p, have)
 		ts.checkInteresting(p)
 	case REQUEST:
 		// log.Println("[", ts.M.Info.Name, "] request", p.address)
@@ -1075,12 +1803,18 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		if !ts.pieceSet.IsSet(int(index)) {
 			return errors.New("we don't have that piece")
 		}
-		if int64(begin) >= ts.M.Info.PieceLength {
+		if int64(begin) >= int64(ts.pieceLength(int(index))) {
 			return errors.New("begin out of range")
 		}
-		if int64(begin)+int64(length) > ts.M.Info.PieceLength {
+		if int64(begin)+int64(length) > int64(ts.pieceLength(int(index))) {
 			return errors.New("begin + length out of range")
 		}
+		if length > MAX_BLOCK_LENGTH {
+			return errors.New("Block length too large")
+		}
+		if !ts.verifyLazily(int(index)) {
+			return nil
+		}
 		// TODO: Asynchronous
 		// p.AddRequest(index, begin, length)
 		return ts.sendRequest(p, index, begin, length)
@@ -1097,24 +1831,44 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		}
 		if ts.pieceSet.IsSet(int(index)) {
 			// We already have that piece, keep going
+			atomic.AddInt64(&ts.traffic.duplicate, int64(length))
 			break
 		}
-		if int64(begin) >= ts.M.Info.PieceLength {
+		if int64(begin) >= int64(ts.pieceLength(int(index))) {
 			return errors.New("begin out of range")
 		}
-		if int64(begin)+int64(length) > ts.M.Info.PieceLength {
+		if int64(begin)+int64(length) > int64(ts.pieceLength(int(index))) {
 			return errors.New("begin + length out of range")
 		}
-		if length > 128*1024 {
+		if length > MAX_BLOCK_LENGTH {
 			return errors.New("Block length too large")
 		}
 		v, ok := ts.activePieces[int(index)]
 		if !ok {
 			return errors.New("Received piece data we weren't expecting")
 		}
-		copy(v.buffer[begin:], message[9:])
+		if length > STANDARD_BLOCK_LENGTH {
+			p.sentLongBlock = true
+		}
+		if v.downloaderCount[begin/uint32(v.blockSize)] >= 0 {
+			// Not one we have already, which may be being hashed.
+			if e := v.write(int(index), int(begin), message[9:]); e != nil {
+				ts.logger().Error("Couldn't write block", "piece", index, "begin", begin, "err", e)
+				ts.emit(Event{Type: EVENT_ERROR, Piece: int(index), Err: e})
+				var beyond *ErrWriteBeyondStore
+				if errors.As(e, &beyond) {
+					return e
+				}
+				ts.storageFailed(int(index), e)
+				// It's asked for again, once the files are fixed.
+				delete(p.our_requests, uint64(index)<<32|uint64(begin))
+				ts.removeRequest(int(index), int(begin))
+				break
+			}
+		} else {
+			atomic.AddInt64(&ts.traffic.duplicate, int64(length))
+		}
 
-		p.creditDownload(int64(length))
 		ts.RecordBlock(p, index, begin, uint32(length))
 		err = ts.RequestBlock(p)
 	case CANCEL:
@@ -1131,13 +1885,13 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		if !ts.pieceSet.IsSet(int(index)) {
 			return errors.New("we don't have that piece")
 		}
-		if int64(begin) >= ts.M.Info.PieceLength {
+		if int64(begin) >= int64(ts.pieceLength(int(index))) {
 			return errors.New("begin out of range")
 		}
-		if int64(begin)+int64(length) > ts.M.Info.PieceLength {
+		if int64(begin)+int64(length) > int64(ts.pieceLength(int(index))) {
 			return errors.New("begin + length out of range")
 		}
-		if length != STANDARD_BLOCK_LENGTH {
+		if length > MAX_BLOCK_LENGTH {
 			return errors.New("Unexpected block length")
 		}
 		p.CancelRequest(index, begin, length)
@@ -1148,15 +1902,26 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		if len(message) != 3 {
 			return fmt.Errorf("Unexpected length for port message: %d", len(message))
 		}
-		go ts.dht.AddNode(p.address)
+		if ts.Session.UseDHT {
+			// The message carries the peer's DHT port, which is not
+			// necessarily the port it's talking BitTorrent on.
+			host, _, err := net.SplitHostPort(p.address)
+			if err != nil {
+				return err
+			}
+			dhtPort := (int(message[1]) << 8) | int(message[2])
+			node := net.JoinHostPort(host, strconv.Itoa(dhtPort))
+			// It's only saved if there's a DHT node there to answer.
+			go ts.dht.AddNode(node)
+		}
 	case EXTENSION:
 		err := ts.DoExtension(message[1:], p)
 		if err != nil {
-			log.Printf("[ %s ] Failed extensions for %s: %s\n", ts.M.Info.Name, p.address, err)
+			ts.logger().Debug("Bad extension message", "peer", p.address, "err", err)
 		}
 
-		if ts.Session.HaveTorrent {
-			p.SendBitfield(ts.pieceSet)
+		if ts.Session.HaveTorrent && len(message) > 1 && message[1] == EXTENSION_HANDSHAKE {
+			ts.sendBitfield(p)
 		}
 	default:
 		return fmt.Errorf("Unknown message id: %d\n", messageID)
@@ -1182,27 +1947,42 @@ type ExtensionHandshake struct {
 }
 
 func (ts *TorrentSession) DoExtension(msg []byte, p *peerState) (err error) {
+	if len(msg) == 0 {
+		return errors.New("Extension message without an id")
+	}
 
 	var h ExtensionHandshake
 	if msg[0] == EXTENSION_HANDSHAKE {
-		err = bencode.Unmarshal(bytes.NewReader(msg[1:]), &h)
+		// The decoder has no limits of its own.
+		if _, err = checkBencodePrefix(msg[1:], false, WireLimits); err == nil {
+			err = bencode.Unmarshal(bytes.NewReader(msg[1:]), &h)
+		}
 		if err != nil {
 			log.Println("[", ts.M.Info.Name, "] Error when unmarshaling extension handshake")
 			return err
 		}
 
+		p.client = h.V
 		p.theirExtensions = make(map[string]int)
 		for name, code := range h.M {
 			p.theirExtensions[name] = code
 		}
 
+		if ts.externalAddr != nil && (len(h.Yourip) == net.IPv4len || len(h.Yourip) == net.IPv6len) {
+			ts.externalAddr.Vote(p.address, net.IP(h.Yourip))
+		}
+
 		if ts.Session.HaveTorrent || ts.Session.ME != nil && ts.Session.ME.Transferring {
 			return
 		}
 
 		// Fill metadata info
+		if max := MetaInfoLimits.MaxSize; max > 0 && h.MetadataSize > uint(max) {
+			log.Println("[", ts.M.Info.Name, "] Not fetching", h.MetadataSize, "bytes of metadata from", p.address)
+			return
+		}
 		if h.MetadataSize != uint(0) {
-			nPieces := uint(math.Ceil(float64(h.MetadataSize) / float64(16*1024)))
+			nPieces := uint(math.Ceil(float64(h.MetadataSize) / float64(METADATA_PIECE_SIZE)))
 			ts.Session.ME.Pieces = make([][]byte, nPieces)
 		}
 
@@ -1246,7 +2026,10 @@ func getMetadataPiece(msg []byte) ([]byte, error) {
 
 func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 	var message MetadataMessage
-	err := bencode.Unmarshal(bytes.NewReader(msg), &message)
+	_, err := checkBencodePrefix(msg, false, WireLimits)
+	if err == nil {
+		err = bencode.Unmarshal(bytes.NewReader(msg), &message)
+	}
 	if err != nil {
 		log.Println("[", ts.M.Info.Name, "] Error when parsing metadata:", err)
 		return
@@ -1255,7 +2038,11 @@ func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 	mt := message.MsgType
 	switch mt {
 	case METADATA_REQUEST:
-		//TODO: Answer to metadata request
+		if !ts.Session.HaveTorrent || len(ts.M.rawInfo) == 0 {
+			p.sendMetadataReject(int(message.Piece))
+			return
+		}
+		p.sendMetadataPiece(int(message.Piece), ts.M.rawInfo)
 	case METADATA_DATA:
 		if ts.Session.HaveTorrent {
 			log.Println("[", ts.M.Info.Name, "] Received metadata we don't need, from", p.address)
@@ -1267,7 +2054,11 @@ func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 			log.Println("[", ts.M.Info.Name, "] Error when getting metadata piece: ", err)
 			return
 		}
-		ts.Session.ME.Pieces[message.Piece] = piece
+		if message.Piece >= uint(len(ts.Session.ME.Pieces)) {
+			log.Println("[", ts.M.Info.Name, "] Metadata piece", message.Piece, "out of range from", p.address)
+			return
+		}
+		ts.Session.ME.Pieces[message.Piece] = append([]byte(nil), piece...)
 
 		finished := true
 		for idx, data := range ts.Session.ME.Pieces {
@@ -1292,16 +2083,14 @@ func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 		sha := sha1.New()
 		sha.Write(b)
 		actual := string(sha.Sum(nil))
-		if actual != ts.M.InfoHash {
+		if sum := sha256.Sum256(b); actual != ts.M.InfoHash && string(sum[:]) != ts.M.InfoHashV2 {
 			log.Printf("[ %s ] Invalid metadata; got %x\n", ts.M.Info.Name, actual)
-		}
-
-		metadata := string(b)
-		err = saveMetaInfo(metadata)
-		if err != nil {
+			// Start over, hopefully with a better peer.
+			ts.Session.ME = &MetaDataExchange{}
 			return
 		}
-		ts.reload(metadata)
+
+		ts.gotMetadata(string(b))
 	case METADATA_REJECT:
 		log.Printf("[ %s ] %s didn't want to send piece %d\n", ts.M.Info.Name, p.address, message.Piece)
 	default:
@@ -1309,19 +2098,45 @@ func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 	}
 }
 
+// Loads the metadata a magnet link's session didn't have, which has been
+// checked against the info-hash, and saves it.
+func (ts *TorrentSession) gotMetadata(metadata string) {
+	if ts.reload(metadata) == nil {
+		if ts.flags.MetadataDir != "" {
+			if err := saveMetaInfo(ts.flags.MetadataDir, ts.M); err != nil {
+				log.Println("[", ts.M.Info.Name, "] Couldn't save metadata:", err)
+			}
+		}
+		ts.saveForSession()
+	}
+}
+
 func (ts *TorrentSession) sendRequest(peer *peerState, index, begin, length uint32) (err error) {
 	if !peer.am_choking {
 		// log.Println("[", ts.M.Info.Name, "] Sending block", index, begin, length)
-		buf := make([]byte, length+9)
-		buf[0] = PIECE
-		uint32ToBytes(buf[1:5], index)
-		uint32ToBytes(buf[5:9], begin)
-		_, err = ts.fileStore.ReadAt(buf[9:],
-			int64(index)*ts.M.Info.PieceLength+int64(begin))
-		if err != nil {
-			return
+		header := make([]byte, 9)
+		header[0] = PIECE
+		uint32ToBytes(header[1:5], index)
+		uint32ToBytes(header[5:9], begin)
+		off := int64(index)*ts.M.Info.PieceLength + int64(begin)
+		var block []byte
+		if l, ok := ts.fileStore.(blockLender); ok {
+			block = l.lendBlock(off, int(length))
+		}
+		if f, ok := ts.fileStore.(blockFiler); ok && block == nil && ts.flags.ZeroCopyUploads && zeroCopyConn(peer.conn) != nil {
+			if b := f.fileBlock(off, int(length)); b != nil {
+				peer.sendPieceFromFile(header, b)
+				ts.Session.Uploaded += uint64(length)
+				return
+			}
 		}
-		peer.sendMessage(buf)
+		if block == nil {
+			block = make([]byte, length)
+			if _, err = ts.fileStore.ReadAt(block, off); err != nil {
+				return
+			}
+		}
+		peer.sendPiece(header, block)
 		ts.Session.Uploaded += uint64(length)
 	}
 	return
@@ -1332,12 +2147,7 @@ func (ts *TorrentSession) checkInteresting(p *peerState) {
 }
 
 func (ts *TorrentSession) isInteresting(p *peerState) bool {
-	for i := 0; i < ts.totalPieces; i++ {
-		if !ts.pieceSet.IsSet(i) && p.have.IsSet(i) {
-			return true
-		}
-	}
-	return false
+	return p.have.AnyAndNot(ts.pieceSet)
 }
 
 func min(a, b int) int {
@@ -1,193 +1,614 @@
 package torrent
 
 import (
-	"encoding/hex"
+	"context"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/nictuku/dht"
 	"golang.org/x/net/proxy"
 )
 
 type TorrentFlags struct {
-	Port                int
-	FileDir             string
+	Port         int
+	PortRangeEnd int  // If set, ports from Port to this are tried in turn
+	RandomPort   bool // Try the range's ports in random order
+	//Addresses to listen on, like 203.0.113.5:6881 or [2001:db8::5], in place
+	//of every address. Ones without a port use Port's. The first one's port is
+	//the one we announce.
+	ListenAddresses []string
+	FileDir         string
+	// Where torrents with these labels go, if they're added without a
+	// directory. See labels.go.
+	LabelDirs           map[string]string
 	SeedRatio           float64
 	UseDeadlockDetector bool
 	UseLPD              bool
+	LPDInterval         time.Duration // 0 means LPD_DEFAULT_INTERVAL
 	UseDHT              bool
 	UseUPnP             bool
 	UseNATPMP           bool
 	TrackerlessMode     bool
 	ExecOnSeeding       string
 
+	//Commands run when a torrent is added, other than restored from the saved
+	//session, when it finishes downloading, and when it's removed. See
+	//hooks.go for what's replaced in them.
+	OnAdded     string
+	OnComplete  string
+	OnRemoved   string
+	HookTimeout time.Duration // 0 means HOOK_DEFAULT_TIMEOUT
+
+	//Called with every torrent's status each ProgressInterval, and when one
+	//changes state, from a goroutine of its own. Nil means don't.
+	Progress         func(statuses []TorrentStatus)
+	ProgressInterval time.Duration // 0 means PROGRESS_DEFAULT_INTERVAL
+
 	// The dial function to use. Nil means use net.Dial
 	Dial proxy.Dialer
+	// Where sessions get the time from. Nil means the real clock. Tests
+	// give a fake one.
+	Clock Clock
+	//The local address to send from, outgoing connections, UDP trackers'
+	//requests and the DHT alike. Nil means any. Set Dial to it, or a proxy
+	//dialing through it, or it's used in place of net.Dial.
+	Bind *Binding
 
 	// IP address of gateway used for NAT-PMP
 	Gateway string
+	//A service that says whether it can connect to our port: a GET of the URL,
+	//with {port} replaced by the port, answers "open" or "closed". Without one,
+	//we dial our own external address.
+	PortCheckURL string
 
 	//Provides the filesystems added torrents are saved to
 	FileSystemProvider FsProvider
 
+	//How many of a torrent's files to open at once. 0 means
+	//OPEN_FILES_PARALLEL.
+	OpenFilesParallel int
+
+	//Have the kernel send uploaded blocks straight from the files, where it
+	//can: see zeroCopy.go.
+	ZeroCopyUploads bool
+
 	//Whether to check file hashes when adding torrents
 	InitialCheck bool
 
 	//Provides cache to each torrent
 	Cacher CacheProvider
 
-	//Whether to write and use *.haveBitset resume data
+	//Whether to save resume data in DataDir, and trust it instead of hash
+	//checking files that haven't changed since. Seeds that have been
+	//verified are marked as such there too. See verified.go.
 	QuickResume bool
 
+	//How often to recheck the seed verified longest ago. 0 means never.
+	ReverifyInterval time.Duration
+
 	//How many torrents should be active at a time
 	MaxActive int
-	
+
+	//How many of the active torrents may download, and seed, at a time. The
+	//rest are queued. 0 means no limit.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+
 	//Maximum amount of memory (in MiB) to use for each torrent's Active Pieces.
 	//0 means a single Active Piece. Negative means Unlimited Active Pieces.
 	MemoryPerTorrent int
+
+	//The most memory (in MiB) all the torrents' Active Pieces may take
+	//together. Each torrent may have one, regardless. 0 means no limit.
+	MaxPieceMemory int
+
+	//The most disk space, in bytes, all the torrents' files may take
+	//together, with any disk cache. 0 means no limit. See diskCap.go.
+	MaxDiskUsage int64
+
+	//host:port addresses of the nodes used to join the DHT.
+	//Empty means the DHT library's defaults.
+	DHTBootstrapNodes []string
+
+	//Also run a DHT node over IPv6 (BEP 32).
+	UseDHT6 bool
+
+	//Look peers up in the DHT without running a DHT node for others to
+	//query (BEP 43). See dhtReadOnly.go.
+	DHTReadOnly bool
+
+	//Limits on DHT traffic. Zero means the default.
+	DHTMaxRequestsPerSecond float64 // Peer lookups we start
+	DHTMaxOutstanding       int     // Peer lookups in progress at once
+	DHTMaxInboundPerSecond  int64   // Packets from other nodes we process
+	DHTMaxNodes             int     // Size of the routing table, which bounds its upkeep
+
+	//Directory where session state, such as the known DHT nodes, is kept.
+	//Empty means the current directory.
+	DataDir string
+
+	//Remember the torrents in DataDir, and add them again when restarting,
+	//along with the ones given.
+	SaveSession bool
+
+	//Directory where torrents fetched from magnet links are saved, named by
+	//info-hash, and looked for before fetching them again. Empty means don't.
+	MetadataDir string
+
+	//Directory searched for files that already hold some of a torrent's
+	//data, perhaps under other names. Empty means don't look.
+	CrossSeedDir string
+
+	//Hash a piece of every cross-seed match, not just ambiguous ones.
+	CrossSeedHashCheck bool
+
+	//Asked before using the cross-seed matches for a torrent, since
+	//downloading the rest writes to the matched files. Nil means use them.
+	CrossSeedConfirm func(name string, matches []CrossSeedMatch) bool
+
+	//Download only from the torrent's web seeds: no peers, tracker, DHT or
+	//LPD. The torrent is just a list of checksums for the download.
+	WebSeedOnly bool
+
+	//Limits on the download and upload rates of all the torrents together,
+	//in bytes per second. 0 means no limit.
+	MaxDownloadRate int64
+	MaxUploadRate   int64
+
+	//Alternative limits, in force when AltSpeedSchedule says, or when
+	//they're switched on through the control API.
+	AltDownloadRate  int64
+	AltUploadRate    int64
+	AltSpeedSchedule SpeedSchedule
+
+	//host:port to serve the HTTP control API on. Empty means don't.
+	RPCAddress string
+
+	//The token API requests must carry, as "Authorization: Bearer <token>".
+	RPCToken string
+
+	//Serve Prometheus metrics at /metrics, alongside the control API.
+	RPCMetrics bool
+
+	//Serve Go's profiles and the state of the manager and the torrents'
+	//loops under /debug/, alongside the control API. See debug.go.
+	RPCDebug bool
+
+	//host:port to serve the torrents' files on, for streaming them while
+	//they download. There's no token, so keep it on localhost. Empty means
+	//don't.
+	StreamAddress string
+
+	//A directory to add the .torrent and .magnet files dropped in. Empty
+	//means don't watch one.
+	WatchDir string
+
+	//Delete files from WatchDir once they're added, instead of renaming
+	//them to *.added.
+	WatchDirDelete bool
+
+	//A JSON file of the settings that can be changed while running, read
+	//over these at startup, and again on SIGHUP or through the API. See
+	//reload.go. Empty means don't.
+	ConfigFile string
+
+	//A file of IP ranges peers aren't let in from and aren't connected to.
+	//See blocklist.go. Empty means none.
+	Blocklist string
+
+	//When the blocklist's reloaded, disconnect the peers it now blocks.
+	DisconnectBlocked bool
+
+	//Stop seeding a complete torrent after this long, if its SeedRatio
+	//doesn't stop it first. 0 means no limit. Torrents can have their own
+	//limits, which override these.
+	SeedTime time.Duration
+
+	//At a seed limit, pause the torrent rather than end its session.
+	PauseAtSeedLimit bool
+
+	//Where to serve the control socket, which later invocations hand their
+	//torrents to: a unix socket's path, or on Windows a loopback host:port.
+	//Empty means don't.
+	ControlSocket string
+
+	//The half-life of the smoothed transfer rates that are shown, and of
+	//those the choker goes by. 0 means DEFAULT_RATE_HALF_LIFE and
+	//DEFAULT_CHOKE_RATE_HALF_LIFE.
+	RateHalfLife      time.Duration
+	ChokeRateHalfLife time.Duration
+
+	//How much to ask peers for at a time, a multiple of
+	//STANDARD_BLOCK_LENGTH up to MAX_BLOCK_LENGTH. 0 means
+	//STANDARD_BLOCK_LENGTH. Torrents can
+	//have their own, which override it. See blockSize.go.
+	BlockSize int
 }
 
 func RunTorrents(flags *TorrentFlags, torrentFiles []string) (err error) {
-	conChan, listenPort, err := ListenForPeerConnections(flags)
-	if err != nil {
-		log.Println("Couldn't listen for peers connection: ", err)
-		return
+	return RunTorrentsContext(context.Background(), flags, torrentFiles)
+}
+
+// RunTorrentsContext is like RunTorrents, but also quits when ctx is done,
+// the same way it does on an interrupt: the torrents being added are given up
+// on, and the running ones save their state and tell the trackers they've
+// stopped.
+//
+// With a ControlSocket, it returns ErrAlreadyRunning at once if another
+// instance serves it. HandOff can then give that instance the torrents.
+func RunTorrentsContext(ctx context.Context, flags *TorrentFlags, torrentFiles []string) (err error) {
+	if flags.BlockSize != 0 {
+		if err = checkBlockSize(flags.BlockSize); err != nil {
+			return
+		}
+	}
+	var control *controlServer
+	if flags.ControlSocket != "" {
+		// Before anything else, so that a second instance doesn't touch
+		// the first's files or ports.
+		if control, err = claimControlSocket(flags.ControlSocket); err != nil {
+			return
+		}
+		defer control.Close()
+	}
+	if flags.Bind != nil {
+		if flags.Bind.IP() == nil {
+			err = errNoBindAddress
+			return
+		}
+		f := *flags
+		if f.Dial == nil {
+			f.Dial = f.Bind
+		} else if _, ok := f.Dial.(udpBinder); !ok {
+			f.Dial = boundDialer{f.Dial, f.Bind}
+		}
+		flags = &f
+	}
+	var conChan chan *BtConn
+	var listeners []*peerListener
+	listenPort := 0
+	if flags.WebSeedOnly {
+		f := *flags
+		f.UseDHT, f.UseLPD, f.UseUPnP, f.UseNATPMP = false, false, false, false
+		flags = &f
+	} else {
+		conChan = make(chan *BtConn)
+		listeners, err = startPeerListeners(flags, conChan)
+		if err != nil {
+			log.Println("Couldn't listen for peers connection: ", err)
+			return
+		}
+		listenPort = listeners[0].externalPort
 	}
 	quitChan := listenSigInt()
 
-	createChan := make(chan string, flags.MaxActive)
-	startChan := make(chan *TorrentSession, 1)
-	doneChan := make(chan *TorrentSession, 1)
-
-	var dhtNode dht.DHT
-	if flags.UseDHT {
-		dhtNode = *startDHT(flags.Port)
+	m := newSessionManager(ctx, flags, listenPort)
+	m.conChan = conChan
+	if flags.Bind != nil {
+		go flags.Bind.watch(m.ctx, func(ip net.IP) { m.run(func() { m.bindChanged(ip) }) })
 	}
-
-	torrentSessions := make(map[string]*TorrentSession)
-
-	go func() {
-		for torrentFile := range createChan {
-			ts, err := NewTorrentSession(flags, torrentFile, uint16(listenPort))
-			if err != nil {
-				log.Println("Couldn't create torrent session for " + torrentFile + " .", err)
-				doneChan <- &TorrentSession{}
+	if len(listeners) > 0 {
+		m.listener, m.moreListeners = listeners[0], listeners[1:]
+		m.announceAddrs = announceAddrsFor(listeners)
+		for _, l := range listeners {
+			m.followNAT(l)
+		}
+		m.reachabilityChan = time.Tick(REACHABILITY_CHECK)
+		go m.testReachability()
+	}
+	defer func() {
+		// The loop's done, so the listeners are ours.
+		for _, l := range m.listeners() {
+			l.Close()
+		}
+	}()
+	var routers, routers6 []string
+	if flags.UseDHT {
+		m.dhtNodes = newDHTNodeTable(flags.DataDir)
+		if err := m.dhtNodes.Load(); err != nil && !os.IsNotExist(err) {
+			log.Println("Ignoring saved DHT nodes:", err)
+		}
+		bootstrap := flags.DHTBootstrapNodes
+		if len(bootstrap) == 0 {
+			bootstrap = strings.Split(dht.NewConfig().DHTRouters, ",")
+		}
+		var errs []error
+		routers, errs = resolveBootstrapNodes(bootstrap, false, dhtBootstrapTimeout)
+		for _, err := range errs {
+			log.Println("DHT bootstrap node unavailable:", err)
+		}
+		if len(routers) == 0 {
+			log.Println("No DHT bootstrap nodes available, relying on", m.dhtNodes.Len(), "saved nodes")
+		}
+		if flags.UseDHT6 {
+			bootstrap6 := flags.DHTBootstrapNodes
+			if len(bootstrap6) == 0 {
+				bootstrap6 = DHT_IPV6_BOOTSTRAP_NODES
+			}
+			routers6, errs = resolveBootstrapNodes(bootstrap6, true, dhtBootstrapTimeout)
+			for _, err := range errs {
+				log.Println("IPv6 DHT bootstrap node unavailable:", err)
+			}
+		}
+		if krpc, err := newKRPCClient(flags.Bind.IP()); err == nil {
+			krpc.setPort(m.listenPort)
+			m.krpc = krpc
+		} else if flags.DHTReadOnly {
+			log.Println("Couldn't listen for DHT responses:", err)
+		} else {
+			log.Println("Couldn't listen for DHT responses, so DHT nodes won't be saved:", err)
+		}
+		// The address families we have a DHT presence in, as BEP 32 names
+		// them.
+		var families []string
+		if flags.DHTReadOnly {
+			// Our KRPC client makes all our queries. See dhtReadOnly.go.
+			if m.krpc != nil {
+				m.krpcResults = make(chan map[dht.InfoHash][]string)
+				families = append(families, "n4")
+				if flags.UseDHT6 {
+					families = append(families, "n6")
+				}
+			}
+		} else {
+			if m.dhtNode = startDHT(flags, routers, "udp4"); m.dhtNode != nil {
+				m.dht4Results = m.dhtNode.PeersRequestResults
+				families = append(families, "n4")
+			} else {
+				routers = nil
+			}
+			// Hosts without IPv6 connectivity just don't get an IPv6 node,
+			// and ones without IPv4 keep the IPv6 one.
+			if flags.UseDHT6 {
+				m.dhtNode6 = startDHT(flags, routers6, "udp6")
+			}
+			if m.dhtNode6 != nil {
+				m.dht6Results = m.dhtNode6.PeersRequestResults
+				families = append(families, "n6")
 			} else {
-				log.Printf("Created torrent session for %s", ts.M.Info.Name)
-				startChan <- ts
+				routers6 = nil
 			}
 		}
-	}()
-
-	torrentQueue := []string{}
-	if len(torrentFiles) > flags.MaxActive {
-		torrentQueue = torrentFiles[flags.MaxActive:]
+		if len(families) == 0 {
+			log.Println("Running without the DHT")
+			if m.krpc != nil {
+				m.krpc.Close()
+				m.krpc = nil
+			}
+			f := *flags
+			f.UseDHT = false
+			flags, m.flags, m.dhtNodes = &f, &f, nil
+		} else if m.krpc != nil {
+			m.krpc.families = families
+		}
 	}
-
-	for i, torrentFile := range torrentFiles {
-		if i < flags.MaxActive {
-			createChan <- torrentFile
-		} else {
-			break
+	if flags.UseDHT {
+		m.dhtRouters = append(routers, routers6...)
+		m.dhtHealth = newDHTHealthMonitor(m.dhtNodes, len(m.dhtRouters))
+		m.dhtHealth.readOnly = flags.DHTReadOnly
+		m.dhtLimits = newDHTLimiter(flags.DHTMaxRequestsPerSecond, flags.DHTMaxOutstanding)
+		m.dhtHealth.krpc, m.dhtHealth.limits = m.krpc, m.dhtLimits
+		m.dhtHealthChan = time.Tick(dhtHealthLogPeriod)
+		m.dhtRetryChan = time.Tick(DHT_RETRY_PERIOD)
+		if m.krpc != nil {
+			m.dhtScrapeChan = time.Tick(dhtScrapeCheckPeriod)
+		}
+		// AddNode pings the nodes, so stale entries are weeded out before
+		// they make it into the routing table.
+		dhtClient := m.dhtClient()
+		for _, addr := range m.dhtNodes.Sample(dhtNodesPingSample) {
+			go dhtClient.AddNode(addr)
 		}
+		m.dhtSaveChan = time.Tick(dhtNodesSavePeriod)
+	}
+
+	go m.createSessions()
+	if flags.SaveSession {
+		m.restoreSession()
+	}
+	for _, torrentFile := range torrentFiles {
+		m.add(&addingTorrent{torrent: torrentFile})
 	}
 
-	lpd := &Announcer{}
 	if flags.UseLPD {
-		lpd, err = NewAnnouncer(uint16(listenPort))
+		m.lpd, err = NewAnnouncer(uint16(listenPort), flags.LPDInterval)
 		if err != nil {
 			log.Println("Couldn't listen for Local Peer Discoveries: ", err)
 			flags.UseLPD = false
+			m.lpd = &Announcer{}
 		}
 	}
 
-	theWorldisEnding := false
-mainLoop:
-	for {
-		select {
-		case ts := <-startChan:
-			if !theWorldisEnding {
-				ts.dht = &dhtNode
-				if flags.UseLPD {
-					lpd.Announce(ts.M.InfoHash)
-				}
-				torrentSessions[ts.M.InfoHash] = ts
-				log.Printf("Starting torrent session for %s", ts.M.Info.Name)
-				go func(t *TorrentSession) {
-					t.DoTorrent()
-					doneChan <- t
-				}(ts)
-			}
-		case ts := <-doneChan:
-			if ts.M != nil {
-				delete(torrentSessions, ts.M.InfoHash)
-				if flags.UseLPD {
-					lpd.StopAnnouncing(ts.M.InfoHash)
-				}
-			}
-			if !theWorldisEnding && len(torrentQueue) > 0 {
-				createChan <- torrentQueue[0]
-				torrentQueue = torrentQueue[1:]
-				continue mainLoop
-			}
-
-			if len(torrentSessions) == 0 {
-				break mainLoop
-			}
-		case <-quitChan:
-			theWorldisEnding = true
-			for _, ts := range torrentSessions {
-				go ts.Quit()
-			}
-		case c := <-conChan:
-			//	log.Printf("New bt connection for ih %x", c.Infohash)
-			if ts, ok := torrentSessions[c.Infohash]; ok {
-				ts.AcceptNewPeer(c)
-			}
-		case dhtPeers := <-dhtNode.PeersRequestResults:
-			for key, peers := range dhtPeers {
-				if ts, ok := torrentSessions[string(key)]; ok {
-					// log.Printf("Received %d DHT peers for torrent session %x\n", len(peers), []byte(key))
-					for _, peer := range peers {
-						peer = dht.DecodePeerAddress(peer)
-						ts.HintNewPeer(peer)
-					}
-				} else {
-					log.Printf("Received DHT peer for an unknown torrent session %x\n", []byte(key))
-				}
-			}
-		case announce := <-lpd.Announces:
-			hexhash, err := hex.DecodeString(announce.Infohash)
-			if err != nil {
-				log.Println("Err with hex-decoding:", err)
-			}
-			if ts, ok := torrentSessions[string(hexhash)]; ok {
-				// log.Printf("Received LPD announce for ih %s", announce.Infohash)
-				ts.HintNewPeer(announce.Peer)
-			}
+	if flags.RPCAddress != "" {
+		m.stayUp = true
+		var rpc *rpcServer
+		if rpc, err = startRPCServer(m, flags.RPCAddress, flags.RPCToken); err != nil {
+			log.Println("Couldn't start the RPC server:", err)
+			return
+		}
+		defer rpc.Close()
+	}
+	if flags.StreamAddress != "" {
+		m.stayUp = true
+		var stream *streamServer
+		if stream, err = startStreamServer(m, flags.StreamAddress); err != nil {
+			log.Println("Couldn't start the streaming server:", err)
+			return
+		}
+		defer stream.Close()
+	}
+	if control != nil {
+		m.stayUp = true
+		go control.serve(m)
+	}
+	if flags.ConfigFile != "" || flags.Blocklist != "" {
+		if err = m.loadConfig(); err != nil {
+			log.Println(err)
+			return
 		}
 	}
+	m.watch(m.watchDir, m.watchDirDelete)
+	defer m.watch("", false)
+	reloadChan := make(chan os.Signal, 1)
+	notifyReload(reloadChan)
+	defer signal.Stop(reloadChan)
+	go m.reloadOn(reloadChan)
+
+	if flags.Progress != nil {
+		go m.reportProgress()
+	}
+	if flags.MaxDiskUsage > 0 {
+		go m.checkDiskUsage()
+	}
+
+	m.loop(quitChan)
+	if flags.SaveSession {
+		m.saveFinalSession()
+	}
 	if flags.UseDHT {
-		dhtNode.Stop()
+		if err := m.dhtNodes.Save(); err != nil {
+			log.Println("Couldn't save DHT nodes:", err)
+		}
+		if m.dhtNode != nil {
+			m.dhtNode.Stop()
+		}
+		if m.krpc != nil {
+			m.krpc.Close()
+		}
+		if m.dhtNode6 != nil {
+			m.dhtNode6.Stop()
+		}
 	}
 	return
 }
 
+func hintDHTPeers(dhtPeers map[dht.InfoHash][]string, torrentSessions map[string]*TorrentSession, health *dhtHealthMonitor, limits *dhtLimiter) {
+	found := 0
+	for key, peers := range dhtPeers {
+		found += len(peers)
+		limits.Done(string(key))
+	}
+	health.Success(time.Now(), found)
+	for key, peers := range dhtPeers {
+		if ts, ok := torrentSessions[string(key)]; ok {
+			// log.Printf("Received %d DHT peers for torrent session %x\n", len(peers), []byte(key))
+			for _, peer := range peers {
+				ts.HintNewPeer(decodeDHTPeer(peer), PEER_SOURCE_DHT)
+			}
+		} else {
+			log.Printf("Received DHT peer for an unknown torrent session %x\n", []byte(key))
+		}
+	}
+}
+
 func listenSigInt() chan os.Signal {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 	return c
 }
 
-func startDHT(listenPort int) *dht.DHT {
+// A dhtClient that counts and limits the peer requests made through it, and
+// sends them to both our IPv4 and IPv6 DHT nodes, or in read-only mode makes
+// them itself.
+type monitoredDHT struct {
+	v4     *dht.DHT // nil if we have no IPv4 DHT node
+	v6     *dht.DHT // nil if we have no IPv6 DHT node
+	health *dhtHealthMonitor
+	limits *dhtLimiter
+	nodes  *dhtNodeTable
+	krpc   *krpcClient // nil if it couldn't listen
+
+	// In read-only mode, where lookups start and where they send the peers
+	// they find. results is nil otherwise.
+	routers []string
+	results chan<- map[dht.InfoHash][]string
+	quit    <-chan struct{}
+}
+
+func (m *sessionManager) dhtClient() monitoredDHT {
+	return monitoredDHT{m.dhtNode, m.dhtNode6, m.dhtHealth, m.dhtLimits, m.dhtNodes, m.krpc,
+		m.dhtRouters, m.krpcResults, m.ctx.Done()}
+}
+
+func (d monitoredDHT) PeersRequest(ih string, announce bool) {
+	start, deferred := d.limits.Start(ih, announce, time.Now())
+	if deferred {
+		d.health.Deferred()
+	}
+	if start {
+		d.request(ih, announce)
+	}
+}
+
+// Makes the deferred requests that the limits allow now.
+func (d monitoredDHT) retry(now time.Time) {
+	for _, r := range d.limits.Retry(now) {
+		go d.request(r.ih, r.announce)
+	}
+}
+
+func (d monitoredDHT) request(ih string, announce bool) {
+	d.health.Request()
+	if d.results != nil {
+		go d.lookup(ih, announce)
+		return
+	}
+	if d.v6 != nil {
+		go d.v6.PeersRequest(ih, announce)
+	}
+	if d.v4 != nil {
+		d.v4.PeersRequest(ih, announce)
+	}
+}
+
+// AddNode passes the node to the DHT node of the same address family, once
+// it's answered a ping with an ID BEP 42 allows. Ones that answer are saved,
+// and in read-only mode that's all.
+func (d monitoredDHT) AddNode(addr string) {
+	if d.krpc != nil && !(verifyDHTNode(d.krpc, d.nodes, addr) && d.nodes.Valid(addr)) || d.results != nil {
+		return
+	}
+	if isIPv6Addr(addr) {
+		if d.v6 != nil {
+			d.v6.AddNode(addr)
+		}
+	} else if d.v4 != nil {
+		d.v4.AddNode(addr)
+	}
+}
+
+func startDHT(flags *TorrentFlags, routers []string, proto string) *dht.DHT {
 	// TODO: UPnP UDP port mapping.
 	cfg := dht.NewConfig()
-	cfg.Port = listenPort
+	cfg.Port = flags.Port
+	cfg.DHTRouters = strings.Join(routers, ",")
+	if flags.DHTMaxInboundPerSecond > 0 {
+		cfg.RateLimit = flags.DHTMaxInboundPerSecond
+	}
+	if flags.DHTMaxNodes > 0 {
+		cfg.MaxNodes = flags.DHTMaxNodes
+	}
 	cfg.NumTargetPeers = TARGET_NUM_PEERS
+	cfg.UDPProto = proto
+	if ip := flags.Bind.IP(); ip != nil {
+		// It stays on this address if the interface's changes, until we
+		// restart.
+		if (ip.To4() != nil) != (proto == "udp4") {
+			if proto == "udp6" {
+				log.Println("Not running an IPv6 DHT node, since we're bound to", ip)
+				return nil
+			}
+			log.Println("The DHT node can't send from", ip, "so it won't reach anyone")
+		}
+		cfg.Address = ip.String()
+	}
 	dhtnode, err := dht.New(cfg)
 	if err != nil {
-		log.Println("DHT node creation error:", err)
+		log.Println("DHT node creation error:", proto, err)
 		return nil
 	}
 
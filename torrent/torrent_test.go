@@ -0,0 +1,884 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-process stand-in for the DHT: sessions that announce are handed to
+// every session that asks for peers of the same info-hash.
+type fakeDHTSwarm struct {
+	mu    sync.Mutex
+	peers map[string][]string
+}
+
+type fakeDHT struct {
+	swarm *fakeDHTSwarm
+	addr  string // Where our session listens.
+	ts    *TorrentSession
+}
+
+func (d *fakeDHT) PeersRequest(ih string, announce bool) {
+	d.swarm.mu.Lock()
+	if announce {
+		found := false
+		for _, p := range d.swarm.peers[ih] {
+			found = found || p == d.addr
+		}
+		if !found {
+			d.swarm.peers[ih] = append(d.swarm.peers[ih], d.addr)
+		}
+	}
+	peers := append([]string(nil), d.swarm.peers[ih]...)
+	d.swarm.mu.Unlock()
+	for _, p := range peers {
+		if p != d.addr {
+			go d.ts.HintNewPeer(p, PEER_SOURCE_DHT)
+		}
+	}
+}
+
+func (d *fakeDHT) AddNode(addr string) {}
+
+// startTestSession creates a session for torrent and starts it with its own
+// listener, using swarm in place of the DHT.
+func startTestSession(t testing.TB, flags *TorrentFlags, torrent string, swarm *fakeDHTSwarm) (ts *TorrentSession, done chan bool) {
+	conChan, listenPort, err := ListenForPeerConnections(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err = NewTorrentSession(flags, torrent, uint16(listenPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.dht = &fakeDHT{swarm, "127.0.0.1:" + strconv.Itoa(listenPort), ts}
+	go func() {
+		for c := range conChan {
+			if c.Infohash == ts.M.InfoHash {
+				ts.AcceptNewPeer(c)
+			} else {
+				c.conn.Close()
+			}
+		}
+	}()
+	done = make(chan bool)
+	go func() {
+		ts.DoTorrent()
+		close(done)
+	}()
+	return
+}
+
+func TestTrackerlessMagnet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	seedDir := filepath.Join(dir, "seed")
+	leechDir := filepath.Join(dir, "leech")
+	for _, d := range []string{seedDir, leechDir} {
+		if err = os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := make([]byte, 300*1024+17)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(seedDir, "content"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateMetaInfoFromFileSystem(nil, filepath.Join(seedDir, "content"), "", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	seedFlags := &TorrentFlags{
+		FileDir:            seedDir,
+		SeedRatio:          math.Inf(0),
+		UseDHT:             true,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}
+	seeder, seederDone := startTestSession(t, seedFlags, torrentFile, swarm)
+	defer func() {
+		seeder.Quit()
+		<-seederDone
+	}()
+	if s := waitForCheck(t, seeder); s.GoodPieces != s.Pieces {
+		t.Fatalf("Seeder has %d of %d pieces", s.GoodPieces, s.Pieces)
+	}
+
+	leechFlags := *seedFlags
+	leechFlags.Port = 0 // The seeder's listener filled in its port.
+	leechFlags.FileDir = leechDir
+	leechFlags.SeedRatio = 0
+	leechFlags.MetadataDir = filepath.Join(dir, "metadata")
+	magnet := "magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(seeder.M.InfoHash))
+	leecher, leecherDone := startTestSession(t, &leechFlags, magnet, swarm)
+	if !leecher.trackerLessMode {
+		t.Fatal("A magnet without trackers should be trackerless")
+	}
+	events := leecher.Subscribe(1000)
+
+	select {
+	case <-leecherDone:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for the magnet download")
+	}
+
+	var counts [NUM_EVENT_TYPES]int
+	for e := range events.C {
+		if e.Type == EVENT_PIECE_VERIFIED && counts[EVENT_COMPLETED] != 0 {
+			t.Error("A piece was verified after the torrent completed")
+		}
+		if e.InfoHash != seeder.M.InfoHash {
+			t.Errorf("Event for %x", e.InfoHash)
+		}
+		counts[e.Type]++
+	}
+	if counts[EVENT_METADATA_RECEIVED] != 1 || counts[EVENT_COMPLETED] != 1 ||
+		counts[EVENT_PIECE_VERIFIED] != seeder.totalPieces || events.Dropped() != 0 {
+		t.Errorf("Events %v, dropped %d", counts, events.Dropped())
+	}
+
+	if leecher.peersFound[PEER_SOURCE_DHT] == 0 {
+		t.Errorf("Peers found by the leecher = %v, want some from the DHT", leecher.peersFound)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(leechDir, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Downloaded %d bytes that don't match the %d bytes seeded", len(got), len(content))
+	}
+
+	// The metadata was saved, so the magnet link works without peers now.
+	again, err := NewTorrentSession(&leechFlags, magnet, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Session.HaveTorrent || again.Session.FromMagnet || again.M.Info.Name != "content" {
+		t.Errorf("Saved metadata wasn't used: HaveTorrent %v, FromMagnet %v, Name %q",
+			again.Session.HaveTorrent, again.Session.FromMagnet, again.M.Info.Name)
+	}
+	again.fileStore.Close()
+}
+
+func TestV2Transfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "v2transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "seed")
+	leechDir := filepath.Join(dir, "leech")
+	if err = os.Mkdir(leechDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(4))
+	contents := [][]byte{make([]byte, 100*1024+3), make([]byte, 5), make([]byte, 70*1024)}
+	for _, c := range contents {
+		r.Read(c)
+	}
+	files := []FileDictV2{{Path: []string{"a"}}, {Path: []string{"b"}}, {Path: []string{"sub", "c"}}}
+	torrentFile := makeTorrentV2(t, seedDir, "v2", files, contents, 32*1024)
+
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	seedFlags := &TorrentFlags{
+		FileDir:            seedDir,
+		SeedRatio:          math.Inf(0),
+		UseDHT:             true,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}
+	seeder, seederDone := startTestSession(t, seedFlags, torrentFile, swarm)
+	defer func() {
+		seeder.Quit()
+		<-seederDone
+	}()
+	if s := waitForCheck(t, seeder); s.GoodPieces != s.Pieces {
+		t.Fatalf("Seeder has %d of %d pieces", s.GoodPieces, s.Pieces)
+	}
+
+	leechFlags := *seedFlags
+	leechFlags.Port = 0
+	leechFlags.FileDir = leechDir
+	leechFlags.SeedRatio = 0
+	_, leecherDone := startTestSession(t, &leechFlags, torrentFile, swarm)
+	select {
+	case <-leecherDone:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for the v2 download")
+	}
+
+	for i, f := range files {
+		got, err := ioutil.ReadFile(filepath.Join(append([]string{leechDir, "v2"}, f.Path...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents[i]) {
+			t.Errorf("%v: downloaded %d bytes that don't match the %d bytes seeded", f.Path, len(got), len(contents[i]))
+		}
+	}
+	if _, err = os.Stat(filepath.Join(leechDir, "v2", ".pad")); !os.IsNotExist(err) {
+		t.Errorf("Padding files were written to disk: %v", err)
+	}
+}
+
+// Seeds size bytes in pieces of pieceLength over loopback, for benchmarks to
+// download. stop stops the seeder, and removes dir.
+func startLoopbackSeeder(b *testing.B, size int, pieceLength int64) (seedFlags *TorrentFlags, torrentFile, dir string, swarm *fakeDHTSwarm, stop func()) {
+	dir, err := ioutil.TempDir("", "loopback")
+	if err != nil {
+		b.Fatal(err)
+	}
+	seedDir := filepath.Join(dir, "seed")
+	if err = os.Mkdir(seedDir, 0700); err != nil {
+		b.Fatal(err)
+	}
+	content := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(seedDir, "content"), content, 0600); err != nil {
+		b.Fatal(err)
+	}
+	m, err := CreateMetaInfoFromFileSystem(nil, filepath.Join(seedDir, "content"), "", pieceLength, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	torrentFile = filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	swarm = &fakeDHTSwarm{peers: make(map[string][]string)}
+	seedFlags = &TorrentFlags{
+		FileDir:            seedDir,
+		SeedRatio:          math.Inf(0),
+		UseDHT:             true,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}
+	seeder, seederDone := startTestSession(b, seedFlags, torrentFile, swarm)
+	stop = func() {
+		seeder.Quit()
+		<-seederDone
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// Downloads 8 MiB from a seeder over loopback, a fresh leecher each time, to
+// see what the pieces in flight cost.
+func BenchmarkLoopbackDownload(b *testing.B) {
+	const size = 8 << 20
+	seedFlags, torrentFile, dir, swarm, stop := startLoopbackSeeder(b, size, 256*1024)
+	defer stop()
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		leechFlags := *seedFlags
+		leechFlags.Port = 0
+		leechFlags.FileDir = filepath.Join(dir, "leech"+strconv.Itoa(i))
+		leechFlags.SeedRatio = 0
+		leechFlags.MemoryPerTorrent = 4 // MiB, so 16 pieces at a time
+		if err := os.Mkdir(leechFlags.FileDir, 0700); err != nil {
+			b.Fatal(err)
+		}
+		_, leecherDone := startTestSession(b, &leechFlags, torrentFile, swarm)
+		select {
+		case <-leecherDone:
+		case <-time.After(30 * time.Second):
+			b.Fatal("Timed out waiting for the download")
+		}
+		os.RemoveAll(leechFlags.FileDir)
+	}
+}
+
+// How long the leecher's loop takes to get to a command while it downloads
+// 32 MiB in 4 MiB pieces, which is mostly how long it's kept busy by
+// something else, like hashing a piece.
+func BenchmarkLoopLatency(b *testing.B) {
+	const size = 32 << 20
+	seedFlags, torrentFile, dir, swarm, stop := startLoopbackSeeder(b, size, 4<<20)
+	defer stop()
+
+	var total, worst time.Duration
+	var commands int
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		leechFlags := *seedFlags
+		leechFlags.Port = 0
+		leechFlags.FileDir = filepath.Join(dir, "leech"+strconv.Itoa(i))
+		leechFlags.SeedRatio = 0
+		if err := os.Mkdir(leechFlags.FileDir, 0700); err != nil {
+			b.Fatal(err)
+		}
+		leecher, leecherDone := startTestSession(b, &leechFlags, torrentFile, swarm)
+		timeout := time.After(60 * time.Second)
+	downloading:
+		for {
+			select {
+			case <-leecherDone:
+				break downloading
+			case <-timeout:
+				b.Fatal("Timed out waiting for the download")
+			case <-time.After(time.Millisecond):
+			}
+			start := time.Now()
+			if leecher.runInLoop(func() {}) != nil {
+				break
+			}
+			took := time.Since(start)
+			total += took
+			worst = max(worst, took)
+			commands++
+		}
+		os.RemoveAll(leechFlags.FileDir)
+	}
+	if commands > 0 {
+		b.ReportMetric(float64(total.Microseconds())/float64(commands), "µs/command")
+		b.ReportMetric(float64(worst.Microseconds()), "µs-worst")
+	}
+}
+
+// A seeder and three leechers, which trade among themselves too, for the race
+// detector to look over the peer goroutines and the loops, while the status
+// is asked for from outside. Small pieces make for many messages.
+func TestSwarmStress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "seed")
+	if err = os.Mkdir(seedDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 1<<20+5)
+	rand.New(rand.NewSource(5)).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(seedDir, "content"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateMetaInfoFromFileSystem(nil, filepath.Join(seedDir, "content"), "", 16*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	seedFlags := &TorrentFlags{
+		FileDir:            seedDir,
+		SeedRatio:          math.Inf(0),
+		UseDHT:             true,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}
+	seeder, seederDone := startTestSession(t, seedFlags, torrentFile, swarm)
+	defer func() {
+		seeder.Quit()
+		<-seederDone
+	}()
+
+	const leechers = 3
+	sessions := []*TorrentSession{seeder}
+	var done []chan bool
+	for i := 0; i < leechers; i++ {
+		leechFlags := *seedFlags
+		leechFlags.Port = 0
+		leechFlags.FileDir = filepath.Join(dir, "leech"+strconv.Itoa(i))
+		leechFlags.SeedRatio = 0
+		if err = os.Mkdir(leechFlags.FileDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		ts, d := startTestSession(t, &leechFlags, torrentFile, swarm)
+		sessions = append(sessions, ts)
+		done = append(done, d)
+	}
+	stop := make(chan bool)
+	var polling sync.WaitGroup
+	for _, ts := range sessions {
+		polling.Add(1)
+		go func(ts *TorrentSession) {
+			defer polling.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+				ts.Status()
+				ts.RateHistory()
+			}
+		}(ts)
+	}
+	timeout := time.After(30 * time.Second)
+	for i, d := range done {
+		select {
+		case <-d:
+		case <-timeout:
+			t.Fatalf("Timed out waiting for leecher %d", i)
+		}
+	}
+	close(stop)
+	polling.Wait()
+
+	for i := 0; i < leechers; i++ {
+		got, err := ioutil.ReadFile(filepath.Join(dir, "leech"+strconv.Itoa(i), "content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("Leecher %d downloaded %d bytes that don't match the %d seeded", i, len(got), len(content))
+		}
+	}
+}
+
+func TestMagnetNameDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := InfoDict{PieceLength: 16384, Pieces: "01234567890123456789", Name: "real", Files: []FileDict{
+		{Length: 3, Path: []string{"a"}}, {Length: 4, Path: []string{"b"}}}}
+	var b bytes.Buffer
+	if err = bencodeMarshal(&b, &info); err != nil {
+		t.Fatal(err)
+	}
+	ih := sha1.Sum(b.Bytes())
+	magnet := "magnet:?xt=urn:btih:" + hex.EncodeToString(ih[:]) + "&dn=shown"
+	flags := &TorrentFlags{FileDir: dir, FileSystemProvider: OsFsProvider{}, MemoryPerTorrent: -1}
+
+	// Where the files are stored, once something's written to them.
+	load := func() string {
+		ts, err := NewTorrentSession(flags, magnet, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts.M.Info.Name != "shown" {
+			t.Errorf("Name before metadata = %q, want the magnet's", ts.M.Info.Name)
+		}
+		if err = ts.reload(b.String()); err != nil {
+			t.Fatal(err)
+		}
+		ts.fileStore.Close()
+		return ts.dir
+	}
+	// The torrent's own name wins...
+	if d := load(); d != filepath.Join(dir, "real") {
+		t.Errorf("Stored in %s", d)
+	}
+	// ...unless we've already stored it under the magnet's, even if only
+	// the second file's been written to.
+	os.Mkdir(filepath.Join(dir, "shown"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "shown", "b"), []byte("ab"), 0600)
+	if d := load(); d != filepath.Join(dir, "shown") {
+		t.Errorf("Stored in %s", d)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "real")); !os.IsNotExist(err) {
+		t.Errorf("Made a directory for the torrent's name: %v", err)
+	}
+}
+
+func TestMagnetPeerHints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xpe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "seed")
+	leechDir := filepath.Join(dir, "leech")
+	for _, d := range []string{seedDir, leechDir} {
+		if err = os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := make([]byte, 100*1024+1)
+	rand.New(rand.NewSource(6)).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(seedDir, "content"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateTorrent(filepath.Join(seedDir, "content"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No tracker and no DHT: the leecher only knows the seeder's address.
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	seedFlags := &TorrentFlags{
+		FileDir:            seedDir,
+		SeedRatio:          math.Inf(0),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+	}
+	seeder, seederDone := startTestSession(t, seedFlags, torrentFile, swarm)
+	defer func() {
+		seeder.Quit()
+		<-seederDone
+	}()
+
+	leechFlags := *seedFlags
+	leechFlags.Port = 0
+	leechFlags.FileDir = leechDir
+	leechFlags.SeedRatio = 0
+	magnet := "magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(m.InfoHash)) +
+		"&x.pe=127.0.0.1:" + strconv.Itoa(int(seeder.Session.Port))
+	leecher, leecherDone := startTestSession(t, &leechFlags, magnet, swarm)
+	select {
+	case <-leecherDone:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for the download")
+	}
+	if leecher.peersFound[PEER_SOURCE_MAGNET] == 0 {
+		t.Errorf("Peers found by the leecher = %v, want some from the magnet link", leecher.peersFound)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(leechDir, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Downloaded %d bytes that don't match the %d bytes seeded", len(got), len(content))
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "served")
+	content := writeWebSeedFiles(t, filepath.Join(seedDir, "files"), 40000, 30000)
+
+	var mu sync.Mutex
+	var events []string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.FormValue("event"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	// The web seed hangs until it's let go.
+	blocking, requests := true, 0
+	started, cancelled := make(chan bool, 10), make(chan bool, 10)
+	files := http.FileServer(http.Dir(seedDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		block := blocking
+		mu.Unlock()
+		if block {
+			started <- true
+			<-r.Context().Done()
+			cancelled <- true
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	m, err := CreateTorrent(filepath.Join(seedDir, "files"), &CreateOptions{PieceLength: 16384, Announce: tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.WebSeeds = []string{server.URL}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := &TorrentFlags{
+		FileDir:            filepath.Join(dir, "leech"),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          0,
+	}
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	leecher, done := startTestSession(t, flags, torrentFile, swarm)
+	wait := func(c chan bool, what string) {
+		select {
+		case <-c:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for", what)
+		}
+	}
+	wait(started, "the web seed request")
+
+	if err = leecher.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	wait(cancelled, "the web seed request to be cancelled")
+	if !leecher.Paused() {
+		t.Error("Not paused")
+	}
+	var active int
+	leecher.runInLoop(func() { active = len(leecher.activePieces) })
+	if active != 0 {
+		t.Errorf("%d pieces still claimed while paused", active)
+	}
+	// Peers are turned away.
+	ours, theirs := net.Pipe()
+	go leecher.AcceptNewPeer(&BtConn{conn: ours, Infohash: leecher.M.InfoHash})
+	theirs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := theirs.Read(make([]byte, 68)); err != io.EOF {
+		t.Errorf("Paused torrent answered a peer: %d bytes, %v", n, err)
+	}
+	// Nothing's fetched while paused.
+	mu.Lock()
+	blocking = false
+	before := requests
+	mu.Unlock()
+	time.Sleep(2500 * time.Millisecond)
+	mu.Lock()
+	if requests != before {
+		t.Errorf("Made %d web seed requests while paused", requests-before)
+	}
+	mu.Unlock()
+
+	if err = leecher.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for the download after resuming")
+	}
+	var got []byte
+	for _, name := range []string{"a", "b"} {
+		b, err := ioutil.ReadFile(filepath.Join(flags.FileDir, "files", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Downloaded %d bytes that don't match the %d bytes served", len(got), len(content))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(strings.Join(events, ","), "started,stopped,started") {
+		t.Errorf("Tracker events %v, want started, stopped, started", events)
+	}
+}
+
+func TestQuitAnnouncesStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeWebSeedFiles(t, filepath.Join(dir, "files"), 40000)
+
+	events := make(chan string, 10)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.FormValue("event") + " left=" + r.FormValue("left")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	m, err := CreateTorrent(filepath.Join(dir, "files"), &CreateOptions{PieceLength: 16384, Announce: tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := &TorrentFlags{
+		FileDir:            dir,
+		DataDir:            dir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		QuickResume:        true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          math.Inf(0),
+	}
+	ts, done := startTestSession(t, flags, torrentFile, &fakeDHTSwarm{peers: make(map[string][]string)})
+	if e := <-events; e != "started left=0" {
+		t.Errorf("First event %q", e)
+	}
+	ts.Quit()
+	<-done
+	// The stopped announce is made before the session is done.
+	select {
+	case e := <-events:
+		if e != "stopped left=0" {
+			t.Errorf("Last event %q", e)
+		}
+	default:
+		t.Error("No stopped announce")
+	}
+	if _, err = os.Stat(resumeDataPath(dir, m.InfoHash)); err != nil {
+		t.Error("No resume data:", err)
+	}
+}
+
+func TestForceAnnounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeWebSeedFiles(t, filepath.Join(dir, "files"), 40000)
+
+	events := make(chan string, 10)
+	tracker := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			events <- name + " " + r.FormValue("event")
+			w.Write([]byte("d8:intervali1800e5:peers0:e"))
+		}))
+	}
+	first, second := tracker("first"), tracker("second")
+	defer first.Close()
+	defer second.Close()
+	m, err := CreateTorrent(filepath.Join(dir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AnnounceList = [][]string{{first.URL + "/announce"}, {second.URL + "/announce"}}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := &TorrentFlags{
+		FileDir:            dir,
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          math.Inf(0),
+	}
+	ts, done := startTestSession(t, flags, torrentFile, &fakeDHTSwarm{peers: make(map[string][]string)})
+	defer func() {
+		ts.Quit()
+		<-done
+	}()
+	// The first tier answers, so the second isn't asked.
+	if e := <-events; e != "first started" {
+		t.Errorf("First event %q", e)
+	}
+	if err = ts.ForceAnnounce(); err != errAnnounceTooSoon {
+		t.Errorf("Announcing again straight away: %v", err)
+	}
+	ts.runInLoop(func() { ts.lastAnnounce = time.Now().Add(-FORCE_ANNOUNCE_COOLDOWN) })
+	if err = ts.ForceAnnounce(); err != nil {
+		t.Fatal(err)
+	}
+	heard := map[string]bool{}
+	for len(heard) < 2 {
+		select {
+		case e := <-events:
+			heard[e] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Only heard %v", heard)
+		}
+	}
+	if !heard["first "] || !heard["second "] {
+		t.Errorf("Heard %v", heard)
+	}
+	// The statuses are recorded once the responses are read.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		s, err := ts.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded := 0
+		for _, tr := range s.Trackers {
+			if !tr.LastAnnounce.IsZero() && tr.Error == "" {
+				recorded++
+			}
+		}
+		if recorded == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Tracker statuses %+v", s.Trackers)
+		}
+	}
+}
@@ -2,14 +2,16 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -28,13 +30,154 @@ type ClientStatusReport struct {
 	Uploaded   uint64
 	Downloaded uint64
 	Left       uint64
+	Key        uint32 // Lets trackers know us when our address changes
+	IPv4       string // Addresses, or host:port endpoints, to give as well (BEP 7), or ""
+	IPv6       string
+	// Where the announce's bytes are counted, or nil. See overhead.go.
+	traffic *trafficCounter
 }
 
-func startTrackerClient(dialer proxy.Dialer, announce string, announceList [][]string, trackerInfoChan chan *TrackerResponse, reports chan ClientStatusReport) {
+// TrackerStatus is how our last announce to a tracker went.
+type TrackerStatus struct {
+	URL          string
+	LastAnnounce time.Time // Zero if we haven't tried it yet
+	Error        string    // Why the last announce failed, or ""
+	Seeders      uint
+	Leechers     uint
+	Peers        int // How many peers it gave us
+	Announces    int // This session
+	Failures     int // Announces that failed
+}
+
+const (
+	// How long an HTTP announce may take, all told, before it's given up on,
+	// so that a tracker that never answers costs one announce, not a goroutine
+	// waiting on it forever.
+	TRACKER_HTTP_TIMEOUT = 30 * time.Second
+	// The longest tracker response we read. Anything longer is garbage.
+	MAX_TRACKER_RESPONSE = 1024 * 1024
+)
+
+var errTrackerResponseTooLong = errors.New("Tracker response too long")
+
+// A client for announcing to HTTP trackers through dialer, which may be a
+// proxy, or bound to an address. Its connections are kept between announces,
+// so it's shared by every announce to the same trackers.
+func newTrackerHTTPClient(dialer proxy.Dialer) *http.Client {
+	if dialer == nil {
+		dialer = proxy.Direct
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.Dial(network, addr)
+	}
+	if d, ok := dialer.(interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}); ok {
+		dial = d.DialContext
+	}
+	return &http.Client{
+		Timeout: TRACKER_HTTP_TIMEOUT,
+		Transport: &http.Transport{
+			DialContext:           dial,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: TRACKER_HTTP_TIMEOUT,
+			MaxIdleConnsPerHost:   2,
+			IdleConnTimeout:       2 * time.Minute,
+		},
+	}
+}
+
+// The tracker client keeps these up to date for the torrent session to read.
+type trackerStatuses struct {
+	mu       sync.Mutex
+	statuses []TrackerStatus // In announce list order
+	added    [][]string      // Tiers added since the tracker client last looked
+}
+
+func newTrackerStatuses(announceList [][]string) *trackerStatuses {
+	t := &trackerStatuses{}
+	for _, level := range announceList {
+		for _, tracker := range level {
+			t.statuses = append(t.statuses, TrackerStatus{URL: tracker})
+		}
+	}
+	return t
+}
+
+func (t *trackerStatuses) record(tracker string, tr *TrackerResponse, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.statuses {
+		s := &t.statuses[i]
+		if s.URL != tracker {
+			continue
+		}
+		s.LastAnnounce = time.Now()
+		s.Announces++
+		if err != nil {
+			s.Error = err.Error()
+			s.Failures++
+			return
+		}
+		if tr != nil {
+			s.Error = tr.FailureReason
+			if tr.FailureReason != "" {
+				s.Failures++
+			}
+			s.Seeders, s.Leechers = tr.Complete, tr.Incomplete
+			s.Peers = len(tr.Peers)/6 + len(tr.Peers6)/18
+		}
+		return
+	}
+}
+
+// Adds a tier of trackers, for the tracker client to announce to when the
+// others don't answer.
+func (t *trackerStatuses) addTier(tier []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tracker := range tier {
+		t.statuses = append(t.statuses, TrackerStatus{URL: tracker})
+	}
+	t.added = append(t.added, tier)
+}
+
+// announceList with the tiers added since, shuffled like the rest.
+func (t *trackerStatuses) withAdded(announceList [][]string) [][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tier := range t.added {
+		announceList = append(announceList, shuffleAnnounceListLevel(tier))
+	}
+	t.added = nil
+	return announceList
+}
+
+// A copy of the statuses.
+func (t *trackerStatuses) get() []TrackerStatus {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TrackerStatus(nil), t.statuses...)
+}
+
+// Makes a plain announce into an announce list, to simplify logic.
+func fullAnnounceList(announce string, announceList [][]string) [][]string {
 	if announce != "" && announceList == nil {
-		// Convert the plain announce into an announceList to simplify logic
-		announceList = [][]string{[]string{announce}}
+		return [][]string{[]string{announce}}
 	}
+	return announceList
+}
+
+// The tracker client stops when ctx is done.
+func startTrackerClient(ctx context.Context, dialer proxy.Dialer, client *http.Client, announce string, announceList [][]string, trackerInfoChan chan *TrackerResponse, reports chan ClientStatusReport) (statuses *trackerStatuses) {
+	announceList = fullAnnounceList(announce, announceList)
+	statuses = newTrackerStatuses(announceList)
 
 	if announceList != nil {
 		announceList = shuffleAnnounceList(announceList)
@@ -47,7 +190,12 @@ func startTrackerClient(dialer proxy.Dialer, announce string, announceList [][]s
 	outerLoop:
 		for {
 			// Wait until we have a report.
-			recentReport := <-reports
+			var recentReport ClientStatusReport
+			select {
+			case recentReport = <-reports:
+			case <-ctx.Done():
+				return
+			}
 			for {
 				select {
 				case recentReport = <-reports:
@@ -56,19 +204,63 @@ func startTrackerClient(dialer proxy.Dialer, announce string, announceList [][]s
 				case recentReports <- recentReport:
 					// send the latest report, then wait for new report.
 					continue outerLoop
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
 	}()
 
 	go func() {
-		for report := range recentReports {
-			tr := queryTrackers(dialer, announceList, report)
+		for {
+			var report ClientStatusReport
+			select {
+			case report = <-recentReports:
+			case <-ctx.Done():
+				return
+			}
+			announceList = statuses.withAdded(announceList)
+			tr := queryTrackers(ctx, dialer, client, announceList, report, statuses)
 			if tr != nil {
-				trackerInfoChan <- tr
+				select {
+				case trackerInfoChan <- tr:
+				case <-ctx.Done():
+				}
 			}
 		}
 	}()
+	return
+}
+
+// Tells the trackers we've stopped, waiting up to timeout for one to hear it.
+// It doesn't go through the tracker client, which may be busy retrying a
+// tracker that's down, or already stopped. It says whether one heard.
+func announceStopped(dialer proxy.Dialer, client *http.Client, announceList [][]string, report ClientStatusReport, statuses *trackerStatuses, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return queryTrackers(ctx, dialer, client, shuffleAnnounceList(announceList), report, statuses) != nil
+}
+
+// Announces to every tracker in the announce list at once, rather than to
+// the first one that answers, and sends their responses to responses until
+// done is closed, or ctx is done.
+func announceAll(ctx context.Context, dialer proxy.Dialer, client *http.Client, announceList [][]string, report ClientStatusReport, statuses *trackerStatuses, responses chan<- *TrackerResponse, done <-chan bool) {
+	for _, level := range announceList {
+		for _, tracker := range level {
+			go func(tracker string) {
+				tr, err := queryTracker(ctx, dialer, client, report, tracker)
+				statuses.record(tracker, tr, err)
+				if err != nil || tr == nil {
+					return
+				}
+				select {
+				case responses <- tr:
+				case <-done:
+				case <-ctx.Done():
+				}
+			}(tracker)
+		}
+	}
 }
 
 // Deep copy announcelist and shuffle each level.
@@ -90,11 +282,15 @@ func shuffleAnnounceListLevel(level []string) (shuffled []string) {
 	return
 }
 
-func queryTrackers(dialer proxy.Dialer, announceList [][]string, report ClientStatusReport) (tr *TrackerResponse) {
+func queryTrackers(ctx context.Context, dialer proxy.Dialer, client *http.Client, announceList [][]string, report ClientStatusReport, statuses *trackerStatuses) (tr *TrackerResponse) {
 	for _, level := range announceList {
 		for i, tracker := range level {
+			if ctx.Err() != nil {
+				return nil
+			}
 			var err error
-			tr, err = queryTracker(dialer, report, tracker)
+			tr, err = queryTracker(ctx, dialer, client, report, tracker)
+			statuses.record(tracker, tr, err)
 			if err == nil {
 				// Move successful tracker to front of slice for next announcement
 				// cycle.
@@ -104,31 +300,34 @@ func queryTrackers(dialer proxy.Dialer, announceList [][]string, report ClientSt
 			}
 		}
 	}
-	log.Println("Error: Did not successfully contact a tracker:", announceList)
+	if ctx.Err() == nil {
+		packageLogger().Warn("Couldn't reach a tracker", "trackers", announceList)
+	}
 	return
 }
 
-func queryTracker(dialer proxy.Dialer, report ClientStatusReport, trackerUrl string) (tr *TrackerResponse, err error) {
+// HTTP trackers are announced to with client, or a client of their own if
+// it's nil.
+func queryTracker(ctx context.Context, dialer proxy.Dialer, client *http.Client, report ClientStatusReport, trackerUrl string) (tr *TrackerResponse, err error) {
 	u, err := url.Parse(trackerUrl)
 	if err != nil {
-		log.Println("Error: Invalid announce URL(", trackerUrl, "):", err)
+		packageLogger().Warn("Bad announce URL", "url", trackerUrl, "err", err)
 		return
 	}
 	switch u.Scheme {
 	case "http":
 		fallthrough
 	case "https":
-		return queryHTTPTracker(dialer, report, u)
+		return queryHTTPTracker(ctx, dialer, client, report, u)
 	case "udp":
-		return queryUDPTracker(report, u)
+		return queryUDPTracker(ctx, dialer, report, u)
 	default:
 		errorMessage := fmt.Sprintf("Unknown scheme %v in %v", u.Scheme, trackerUrl)
-		log.Println(errorMessage)
 		return nil, errors.New(errorMessage)
 	}
 }
 
-func queryHTTPTracker(dialer proxy.Dialer, report ClientStatusReport, u *url.URL) (tr *TrackerResponse, err error) {
+func queryHTTPTracker(ctx context.Context, dialer proxy.Dialer, client *http.Client, report ClientStatusReport, u *url.URL) (tr *TrackerResponse, err error) {
 	uq := u.Query()
 	uq.Add("info_hash", report.InfoHash)
 	uq.Add("peer_id", report.PeerID)
@@ -137,17 +336,26 @@ func queryHTTPTracker(dialer proxy.Dialer, report ClientStatusReport, u *url.URL
 	uq.Add("downloaded", strconv.FormatUint(report.Downloaded, 10))
 	uq.Add("left", strconv.FormatUint(report.Left, 10))
 	uq.Add("compact", "1")
+	uq.Add("key", fmt.Sprintf("%08x", report.Key))
 
 	// Don't report IPv6 address, the user might prefer to keep
 	// that information private when communicating with IPv4 hosts.
 	if false {
 		ipv6Address, err := findLocalIPV6AddressFor(u.Host)
 		if err == nil {
-			log.Println("our ipv6", ipv6Address)
+			packageLogger().Debug("Our IPv6 address", "addr", ipv6Address)
 			uq.Add("ipv6", ipv6Address)
 		}
 	}
 
+	// The user chose to listen on these, so they're ours to give.
+	if report.IPv4 != "" {
+		uq.Add("ipv4", report.IPv4)
+	}
+	if report.IPv6 != "" {
+		uq.Add("ipv6", report.IPv6)
+	}
+
 	if report.Event != "" {
 		uq.Add("event", report.Event)
 	}
@@ -157,11 +365,16 @@ func queryHTTPTracker(dialer proxy.Dialer, report ClientStatusReport, u *url.URL
 
 	u.RawQuery = uq.Encode()
 
-	tr, err = getTrackerInfo(dialer, u.String())
+	if client == nil {
+		client = newTrackerHTTPClient(dialer)
+		defer client.CloseIdleConnections()
+	}
+	report.traffic.addSent(TRAFFIC_TRACKER, len(u.String()))
+	tr, err = getTrackerInfo(ctx, client, u.String(), report.traffic)
 	if tr == nil || err != nil {
-		log.Println("Error: Could not fetch tracker info:", err)
+		packageLogger().Warn("Announce failed", "tracker", u.Host, "err", err)
 	} else if tr.FailureReason != "" {
-		log.Println("Error: Tracker returned failure reason:", tr.FailureReason)
+		packageLogger().Warn("Tracker refused the announce", "tracker", u.Host, "reason", tr.FailureReason)
 		err = fmt.Errorf("tracker failure %s", tr.FailureReason)
 	}
 	return
@@ -175,10 +388,10 @@ func findLocalIPV6AddressFor(hostAddr string) (local string, err error) {
 		hostPort = "1234"
 	}
 	dummyAddr := net.JoinHostPort(host, hostPort)
-	log.Println("Looking for host ", dummyAddr)
+	packageLogger().Debug("Looking for host", "addr", dummyAddr)
 	conn, err := net.Dial("udp6", dummyAddr)
 	if err != nil {
-		log.Println("No IPV6 for host ", host, err)
+		packageLogger().Debug("No IPv6 for host", "host", host, "err", err)
 		return "", err
 	}
 	defer conn.Close()
@@ -190,16 +403,27 @@ func findLocalIPV6AddressFor(hostAddr string) (local string, err error) {
 	return
 }
 
-func queryUDPTracker(report ClientStatusReport, u *url.URL) (tr *TrackerResponse, err error) {
+func queryUDPTracker(ctx context.Context, dialer proxy.Dialer, report ClientStatusReport, u *url.URL) (tr *TrackerResponse, err error) {
 	serverAddr, err := net.ResolveUDPAddr("udp", u.Host)
 	if err != nil {
 		return
 	}
-	con, err := net.DialUDP("udp", nil, serverAddr)
+	local, err := localUDPAddr(dialer)
+	if err != nil {
+		return
+	}
+	con, err := net.DialUDP("udp", local, serverAddr)
 	if err != nil {
 		return
 	}
 	defer func() { con.Close() }()
+	// Closing the connection ends any read that's waiting.
+	stop := context.AfterFunc(ctx, func() { con.Close() })
+	defer func() {
+		if !stop() && ctx.Err() != nil {
+			tr, err = nil, ctx.Err()
+		}
+	}()
 
 	var connectionID uint64
 	for retry := uint(0); retry < uint(8); retry++ {
@@ -208,7 +432,7 @@ func queryUDPTracker(report ClientStatusReport, u *url.URL) (tr *TrackerResponse
 			return
 		}
 
-		connectionID, err = connectToUDPTracker(con)
+		connectionID, err = connectToUDPTracker(con, report.traffic)
 		if err == nil {
 			break
 		}
@@ -223,7 +447,7 @@ func queryUDPTracker(report ClientStatusReport, u *url.URL) (tr *TrackerResponse
 	return getAnnouncementFromUDPTracker(con, connectionID, report)
 }
 
-func connectToUDPTracker(con *net.UDPConn) (connectionID uint64, err error) {
+func connectToUDPTracker(con *net.UDPConn, traffic *trafficCounter) (connectionID uint64, err error) {
 	var connectionRequest_connectionID uint64 = 0x41727101980
 	var action uint32 = 0
 	transactionID := rand.Uint32()
@@ -246,6 +470,7 @@ func connectToUDPTracker(con *net.UDPConn) (connectionID uint64, err error) {
 	if err != nil {
 		return
 	}
+	traffic.addSent(TRAFFIC_TRACKER, connectionRequest.Len())
 
 	connectionResponseBytes := make([]byte, 16)
 
@@ -254,6 +479,7 @@ func connectToUDPTracker(con *net.UDPConn) (connectionID uint64, err error) {
 	if err != nil {
 		return
 	}
+	traffic.addReceived(TRAFFIC_TRACKER, connectionResponseLen)
 	if connectionResponseLen != 16 {
 		err = fmt.Errorf("Unexpected response size %d", connectionResponseLen)
 		return
@@ -346,8 +572,7 @@ func getAnnouncementFromUDPTracker(con *net.UDPConn, connectionID uint64, report
 	if err != nil {
 		return
 	}
-	var key uint32 = 0
-	err = binary.Write(announcementRequest, binary.BigEndian, key)
+	err = binary.Write(announcementRequest, binary.BigEndian, report.Key)
 	if err != nil {
 		return
 	}
@@ -367,6 +592,7 @@ func getAnnouncementFromUDPTracker(con *net.UDPConn, connectionID uint64, report
 	if err != nil {
 		return
 	}
+	report.traffic.addSent(TRAFFIC_TRACKER, announcementRequest.Len())
 
 	const minimumResponseLen = 20
 	const peerDataSize = 6
@@ -378,6 +604,7 @@ func getAnnouncementFromUDPTracker(con *net.UDPConn, connectionID uint64, report
 	if err != nil {
 		return
 	}
+	report.traffic.addReceived(TRAFFIC_TRACKER, responseLen)
 	if responseLen < minimumResponseLen {
 		err = fmt.Errorf("Unexpected response size %d", responseLen)
 		return
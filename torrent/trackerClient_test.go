@@ -0,0 +1,140 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAnnounceStopped(t *testing.T) {
+	events := make(chan string, 10)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.FormValue("event")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	hang := make(chan bool)
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer stuck.Close()
+	defer close(hang)
+
+	report := ClientStatusReport{Event: "stopped", InfoHash: "01234567890123456789", PeerID: "-TT0000-012345678901"}
+	list := [][]string{{tracker.URL + "/announce"}}
+	statuses := newTrackerStatuses(list)
+	if !announceStopped(nil, nil, list, report, statuses, 5*time.Second) {
+		t.Error("The tracker didn't hear")
+	}
+	if e := <-events; e != "stopped" {
+		t.Errorf("Event %q", e)
+	}
+	if s := statuses.get(); s[0].LastAnnounce.IsZero() {
+		t.Errorf("Not recorded: %+v", s)
+	}
+
+	start := time.Now()
+	if announceStopped(nil, nil, [][]string{{stuck.URL + "/announce"}}, report, nil, 200*time.Millisecond) {
+		t.Error("A tracker that never answers heard")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Waited %v", elapsed)
+	}
+}
+
+func TestQueryUDPTrackerCancelled(t *testing.T) {
+	// A tracker that never answers, so the query would retry for minutes.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = queryTracker(ctx, nil, nil, ClientStatusReport{}, "udp://"+silent.LocalAddr().String()+"/announce")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Waited %v", elapsed)
+	}
+}
+
+func TestAnnounceAddresses(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	report := ClientStatusReport{InfoHash: "01234567890123456789", PeerID: "-TT0000-012345678901", Port: 6881,
+		IPv6: "[2001:db8::5]:6882"}
+	if _, err := queryTracker(context.Background(), nil, nil, report, tracker.URL+"/announce"); err != nil {
+		t.Fatal(err)
+	}
+	q := <-queries
+	if _, ok := q["ipv4"]; ok || q.Get("ipv6") != "[2001:db8::5]:6882" || q.Get("port") != "6881" {
+		t.Errorf("Announced %v", q)
+	}
+}
+
+func TestTrackerHTTPTimeout(t *testing.T) {
+	hang := make(chan bool)
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer stuck.Close()
+	defer close(hang)
+	client := newTrackerHTTPClient(nil)
+	client.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	if _, err := queryTracker(context.Background(), nil, client, ClientStatusReport{}, stuck.URL+"/announce"); err == nil {
+		t.Error("A tracker that never answers answered")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Waited %v", elapsed)
+	}
+}
+
+func TestTrackerResponseTooLong(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers"))
+		w.Write([]byte("2000000:"))
+		w.Write(bytes.Repeat([]byte{0}, 2000000))
+		w.Write([]byte("e"))
+	}))
+	defer tracker.Close()
+	if _, err := queryTracker(context.Background(), nil, nil, ClientStatusReport{}, tracker.URL+"/announce"); err != errTrackerResponseTooLong {
+		t.Errorf("Got %v", err)
+	}
+}
+
+func TestTrackerHTTPKeepAlive(t *testing.T) {
+	var conns int32
+	tracker := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	tracker.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	tracker.Start()
+	defer tracker.Close()
+	client := newTrackerHTTPClient(nil)
+	for i := 0; i < 3; i++ {
+		if _, err := queryTracker(context.Background(), nil, client, ClientStatusReport{}, tracker.URL+"/announce"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d connections for 3 announces", n)
+	}
+}
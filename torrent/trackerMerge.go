@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Trackers from magnet links. A magnet link for a torrent we have already,
+// or have the .torrent of, adds its tr= trackers to the torrent's, as a tier
+// of their own after the torrent's, rather than being lost or replacing
+// them. Trackers are the same if their URLs are once they're normalized, so
+// that http://Tracker.example:80/announce/ isn't added beside
+// http://tracker.example/announce. The trackers added are kept in the
+// session state.
+//
+// A private torrent's trackers are its own: they're all it may find peers
+// from, and announcing it anywhere else gives it away.
+
+var errPrivateTrackers = errors.New("Can't add trackers to a private torrent")
+
+// The tracker's URL with its scheme and host in lower case, without the
+// scheme's default port, a trailing slash or a fragment. A URL that doesn't
+// parse is only trimmed.
+func normalizeTrackerURL(tracker string) string {
+	tracker = strings.TrimSpace(tracker)
+	u, err := url.Parse(tracker)
+	if err != nil || u.Host == "" {
+		return tracker
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// announceList's tiers, and then a tier of tiers' trackers that aren't in
+// it, in their order, which are added. announceList isn't changed.
+func mergeTrackers(announceList, tiers [][]string) (merged [][]string, added []string) {
+	seen := make(map[string]bool)
+	for _, tier := range announceList {
+		merged = append(merged, append([]string(nil), tier...))
+		for _, tracker := range tier {
+			seen[normalizeTrackerURL(tracker)] = true
+		}
+	}
+	for _, tier := range tiers {
+		for _, tracker := range tier {
+			if n := normalizeTrackerURL(tracker); n != "" && !seen[n] {
+				seen[n] = true
+				added = append(added, strings.TrimSpace(tracker))
+			}
+		}
+	}
+	if len(added) > 0 {
+		merged = append(merged, append([]string(nil), added...))
+	}
+	return
+}
+
+// Adds tiers' trackers to m's, unless it's private.
+func (m *MetaInfo) addTrackers(tiers [][]string) (added []string, err error) {
+	merged, added := mergeTrackers(fullAnnounceList(m.Announce, m.AnnounceList), tiers)
+	if len(added) == 0 {
+		return nil, nil
+	}
+	if m.Info.Private != 0 {
+		return nil, errPrivateTrackers
+	}
+	m.AnnounceList = merged
+	return
+}
+
+// Whether the torrent announces to trackers: it has some, and the flags
+// allow it.
+func (ts *TorrentSession) usesTrackers() bool {
+	return (ts.M.Announce != "" || len(ts.M.AnnounceList) > 0) && !ts.flags.TrackerlessMode && !ts.flags.WebSeedOnly
+}
+
+// Adds tiers' trackers to the torrent's, noting them for the session state,
+// before its loop has started, or on it.
+func (ts *TorrentSession) takeTrackers(tiers [][]string) (added []string, err error) {
+	if added, err = ts.M.addTrackers(tiers); err != nil || len(added) == 0 {
+		return
+	}
+	old, _ := ts.addedTrackers.Load().([][]string)
+	ts.addedTrackers.Store(append(old[:len(old):len(old)], added))
+	ts.trackerLessMode = !ts.usesTrackers()
+	log.Println("[", ts.M.Info.Name, "] Added trackers", added)
+	return
+}
+
+// AddTrackers adds tiers' trackers to the torrent's, as a tier after its
+// own, leaving out those it has, and announces to the new ones at once. It
+// returns those it added. A private torrent's trackers can't be added to.
+func (ts *TorrentSession) AddTrackers(tiers [][]string) (added []string, err error) {
+	if e := ts.runInLoop(func() { added, err = ts.addTrackers(tiers) }); e != nil {
+		return nil, e
+	}
+	return
+}
+
+func (ts *TorrentSession) addTrackers(tiers [][]string) (added []string, err error) {
+	if added, err = ts.takeTrackers(tiers); err != nil || len(added) == 0 || ts.trackerLessMode {
+		return
+	}
+	if ts.trackerStatuses == nil {
+		// It had none when it started.
+		ts.startTrackers()
+		if ts.Session.HaveTorrent && !ts.Paused() {
+			ts.fetchTrackerInfo("started")
+		}
+	} else {
+		ts.trackerStatuses.addTier(added)
+		if !ts.Paused() {
+			announceAll(ts.ctx, ts.flags.Dial, ts.trackerClient, [][]string{added},
+				ts.statusReport(""), ts.trackerStatuses, ts.trackerInfoChan, ts.ended)
+		}
+	}
+	return
+}
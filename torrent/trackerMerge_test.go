@@ -0,0 +1,210 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeTrackers(t *testing.T) {
+	tests := []struct {
+		announceList, tiers [][]string
+		merged              [][]string
+		added               []string
+	}{
+		{nil, [][]string{{"udp://a:1"}}, [][]string{{"udp://a:1"}}, []string{"udp://a:1"}},
+		// The magnet link's come after the torrent's, in their order.
+		{[][]string{{"udp://a:1", "udp://b:1"}, {"http://c/announce"}}, [][]string{{"udp://e:1", "udp://d:1"}},
+			[][]string{{"udp://a:1", "udp://b:1"}, {"http://c/announce"}, {"udp://e:1", "udp://d:1"}}, []string{"udp://e:1", "udp://d:1"}},
+		// Those it has already aren't added, however they're written.
+		{[][]string{{"http://c/announce"}}, [][]string{{"HTTP://C:80/announce/", " http://c/announce", "", "https://c:443/announce"}, {"https://C/announce"}},
+			[][]string{{"http://c/announce"}, {"https://c:443/announce"}}, []string{"https://c:443/announce"}},
+		{[][]string{{"udp://[::1]:6969"}}, [][]string{{"udp://[::1]:6969/"}, {"http://[::1]/announce"}},
+			[][]string{{"udp://[::1]:6969"}, {"http://[::1]/announce"}}, []string{"http://[::1]/announce"}},
+		// The path's case matters.
+		{[][]string{{"http://c/announce"}}, [][]string{{"http://c/Announce"}},
+			[][]string{{"http://c/announce"}, {"http://c/Announce"}}, []string{"http://c/Announce"}},
+		{[][]string{{"udp://a:1"}}, [][]string{{"udp://A:1"}}, [][]string{{"udp://a:1"}}, nil},
+	}
+	for _, test := range tests {
+		before := append([][]string(nil), test.announceList...)
+		merged, added := mergeTrackers(test.announceList, test.tiers)
+		if !reflect.DeepEqual(merged, test.merged) || !reflect.DeepEqual(added, test.added) {
+			t.Errorf("Merging %q into %q: %q, added %q", test.tiers, test.announceList, merged, added)
+		}
+		if !reflect.DeepEqual(before, test.announceList) {
+			t.Errorf("Merging into %q changed it", before)
+		}
+	}
+}
+
+func TestAddTrackersToPrivate(t *testing.T) {
+	m := &MetaInfo{Announce: "http://private/announce"}
+	m.Info.Private = 1
+	if added, err := m.addTrackers([][]string{{"http://private/announce/"}}); err != nil || added != nil {
+		t.Errorf("Adding its own tracker: %q %v", added, err)
+	}
+	if _, err := m.addTrackers([][]string{{"http://private/announce", "udp://public:1"}}); err != errPrivateTrackers {
+		t.Errorf("Adding a public tracker: %v", err)
+	}
+	if m.AnnounceList != nil {
+		t.Errorf("Announce list %q", m.AnnounceList)
+	}
+	m.Info.Private = 0
+	if added, err := m.addTrackers([][]string{{"udp://public:1"}}); err != nil || len(added) != 1 ||
+		!reflect.DeepEqual(m.AnnounceList, [][]string{{"http://private/announce"}, {"udp://public:1"}}) {
+		t.Errorf("Adding to a public torrent: %q %v, %q", added, err, m.AnnounceList)
+	}
+}
+
+// A magnet link for a torrent we have adds its trackers to the torrent's,
+// announcing to them straight away, however many times it's added, and they
+// go in the session state. A private torrent's aren't added to, and one
+// without any starts announcing to them.
+func TestMagnetTrackers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnetTrackers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	events := make(chan string, 10)
+	tracker := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			events <- name + " " + r.FormValue("event")
+			w.Write([]byte("d8:intervali1800e5:peers0:e"))
+		}))
+	}
+	first, second, third := tracker("first"), tracker("second"), tracker("third")
+	defer first.Close()
+	defer second.Close()
+	defer third.Close()
+	heard := func(want string) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e != want {
+				t.Errorf("Heard %q, not %q", e, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Didn't hear %q", want)
+		}
+	}
+
+	var torrents [3]*MetaInfo
+	var data [3][]byte
+	for i, name := range []string{"public", "private", "trackerless"} {
+		announce := first.URL + "/announce"
+		if name == "trackerless" {
+			announce = ""
+		}
+		writeWebSeedFiles(t, filepath.Join(dir, name), 20000+i)
+		if torrents[i], err = CreateTorrent(filepath.Join(dir, name), &CreateOptions{PieceLength: 16384,
+			Announce: announce, Private: name == "private"}); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err = torrents[i].Bencode(&b); err != nil {
+			t.Fatal(err)
+		}
+		data[i] = b.Bytes()
+	}
+	magnet := func(meta *MetaInfo, trackers ...string) string {
+		link := "magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(meta.InfoHash))
+		for _, tr := range trackers {
+			link += "&tr=" + url.QueryEscape(tr)
+		}
+		return link
+	}
+
+	m := newSessionManager(context.Background(), &TorrentFlags{
+		FileDir:            dir,
+		DataDir:            filepath.Join(dir, "data"),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		SeedRatio:          math.Inf(0),
+		MaxActive:          3,
+		MemoryPerTorrent:   -1,
+	}, 0)
+	m.stayUp = true
+	go m.createSessions()
+	go m.loop(nil)
+	defer func() {
+		m.Quit()
+		<-m.ended
+	}()
+	ih, err := m.AddTorrentFromBytes(data[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	heard("first started")
+
+	// The torrent's own tracker, written differently, isn't added again.
+	firstURL := "HTTP" + strings.TrimPrefix(first.URL, "http") + "/announce/"
+	if _, err = m.AddTorrent(magnet(torrents[0], firstURL, second.URL+"/announce")); err != errDuplicateTorrent {
+		t.Errorf("Adding it as a magnet link: %v", err)
+	}
+	heard("second ")
+	if _, err = m.AddTorrent(magnet(torrents[0], second.URL+"/announce", third.URL+"/announce")); err != errDuplicateTorrent {
+		t.Errorf("Adding it again: %v", err)
+	}
+	heard("third ")
+
+	ts, _, err := m.Torrent(ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var announceList [][]string
+	ts.runInLoop(func() { announceList = ts.M.AnnounceList })
+	want := [][]string{{first.URL + "/announce"}, {second.URL + "/announce"}, {third.URL + "/announce"}}
+	if !reflect.DeepEqual(announceList, want) {
+		t.Errorf("Announce list %q", announceList)
+	}
+	s, err := ts.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Trackers) != 3 {
+		t.Errorf("Tracker statuses %+v", s.Trackers)
+	}
+	var state *sessionState
+	m.run(func() { state = m.sessionState() })
+	if len(state.Torrents) != 1 || !reflect.DeepEqual(state.Torrents[0].Trackers, want[1:]) {
+		t.Errorf("Saved %+v", state.Torrents)
+	}
+
+	if _, err = m.AddTorrentFromBytes(data[1]); err != nil {
+		t.Fatal(err)
+	}
+	heard("first started")
+	if _, err = m.AddTorrent(magnet(torrents[1], second.URL+"/announce")); err != errPrivateTrackers {
+		t.Errorf("Adding public trackers to a private torrent: %v", err)
+	}
+	if _, err = m.AddTorrent(magnet(torrents[1], first.URL+"/announce")); err != errDuplicateTorrent {
+		t.Errorf("Adding a private torrent's own tracker: %v", err)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Heard %q", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if ih, err = m.AddTorrentFromBytes(data[2]); err != nil {
+		t.Fatal(err)
+	}
+	waitForComplete(t, m, ih)
+	if _, err = m.AddTorrent(magnet(torrents[2], second.URL+"/announce")); err != errDuplicateTorrent {
+		t.Errorf("Adding trackers to a torrent without any: %v", err)
+	}
+	heard("second started")
+}
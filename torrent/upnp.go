@@ -4,23 +4,45 @@ package torrent
 //
 
 import (
-	"bytes"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type upnpNAT struct {
-	serviceURL string
-	ourIP      string
-	urnDomain  string
+	serviceURL  string
+	ourIP       string
+	serviceType string // Like urn:schemas-upnp-org:service:WANIPConnection:2
 }
 
+// Discovery sends an M-SEARCH for each of ssdpTargets, SSDP_ROUNDS times,
+// waiting SSDP_WAIT after each round for answers. Routers should answer
+// ssdp:all, but some only answer a search for their own device type, and
+// some only for one version of it. Requests to a router have UPNP_TIMEOUT.
+const (
+	SSDP_ROUNDS  = 3
+	SSDP_WAIT    = time.Second
+	UPNP_TIMEOUT = 10 * time.Second
+)
+
+var ssdpTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"ssdp:all",
+}
+
+var upnpClient = &http.Client{Timeout: UPNP_TIMEOUT}
+
 func Discover() (nat NAT, err error) {
 	ssdp, err := net.ResolveUDPAddr("udp4", "239.255.255.250:1900")
 	if err != nil {
@@ -32,70 +54,103 @@ func Discover() (nat NAT, err error) {
 	}
 	socket := conn.(*net.UDPConn)
 	defer socket.Close()
+	return ssdpDiscover(socket, ssdp)
+}
 
-	err = socket.SetDeadline(time.Now().Add(3 * time.Second))
-	if err != nil {
-		return
-	}
-
-	st := "InternetGatewayDevice:1"
-
-	buf := bytes.NewBufferString(
-		"M-SEARCH * HTTP/1.1\r\n" +
-			"HOST: 239.255.255.250:1900\r\n" +
-			"ST: ssdp:all\r\n" +
-			"MAN: \"ssdp:discover\"\r\n" +
-			"MX: 2\r\n\r\n")
-	message := buf.Bytes()
-	answerBytes := make([]byte, 1024)
-	for i := 0; i < 3; i++ {
-		_, err = socket.WriteToUDP(message, ssdp)
-		if err != nil {
+// Searches for gateways by sending to ssdp from socket, and takes the first
+// that answers whose port mappings we can manage.
+func ssdpDiscover(socket *net.UDPConn, ssdp *net.UDPAddr) (nat NAT, err error) {
+	tried := map[string]bool{}
+	var lastErr error
+	answer := make([]byte, 2048)
+	for round := 0; round < SSDP_ROUNDS; round++ {
+		for _, st := range ssdpTargets {
+			if _, err = socket.WriteToUDP(ssdpSearch(st), ssdp); err != nil {
+				return
+			}
+		}
+		if err = socket.SetReadDeadline(time.Now().Add(SSDP_WAIT)); err != nil {
 			return
 		}
-		var n int
-		n, _, err = socket.ReadFromUDP(answerBytes)
 		for {
-			n, _, err = socket.ReadFromUDP(answerBytes)
-			if err != nil {
+			n, from, e := socket.ReadFromUDP(answer)
+			if e != nil {
 				break
 			}
-			answer := string(answerBytes[0:n])
-			if strings.Index(answer, st) < 0 {
+			packageLogger().Debug("SSDP answer", "from", from, "answer", string(answer[:n]))
+			location, ok := parseSSDPAnswer(string(answer[:n]))
+			if !ok || tried[location] {
 				continue
 			}
-			// HTTP header field names are case-insensitive.
-			// http://www.w3.org/Protocols/rfc2616/rfc2616-sec4.html#sec4.2
-			locString := "\r\nlocation:"
-			answer = strings.ToLower(answer)
-			locIndex := strings.Index(answer, locString)
-			if locIndex < 0 {
-				continue
+			tried[location] = true
+			found, e := upnpNATAt(location)
+			if e == nil {
+				return found, nil
 			}
-			loc := answer[locIndex+len(locString):]
-			endIndex := strings.Index(loc, "\r\n")
-			if endIndex < 0 {
-				continue
-			}
-			locURL := strings.TrimSpace(loc[0:endIndex])
-			var serviceURL, urnDomain string
-			serviceURL, urnDomain, err = getServiceURL(locURL)
-			if err != nil {
-				return
-			}
-			var ourIP net.IP
-			ourIP, err = localIPv4()
-			if err != nil {
-				return
-			}
-			nat = &upnpNAT{serviceURL: serviceURL, ourIP: ourIP.String(), urnDomain: urnDomain}
-			return
+			lastErr = e
+			log.Println("Can't use the UPnP gateway at", location+":", lastErr)
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("UPnP port discovery failed: %v", lastErr)
+	}
+	return nil, errors.New("UPnP port discovery failed.")
+}
+
+func ssdpSearch(st string) []byte {
+	return []byte("M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"ST: " + st + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n")
+}
+
+// The URL of a gateway's device description, from its answer to an
+// M-SEARCH, or false if it isn't a gateway's. Header names are
+// case-insensitive (RFC 2616 4.2), some routers end lines with a bare \n, and
+// some only give their device type in the USN, or the NT, or not as a URN.
+func parseSSDPAnswer(answer string) (location string, ok bool) {
+	lower := strings.ToLower(answer)
+	if !strings.Contains(lower, "internetgatewaydevice") && !strings.Contains(lower, "wanipconnection") &&
+		!strings.Contains(lower, "wanpppconnection") {
+		return
+	}
+	for _, line := range strings.Split(answer, "\n") {
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), "location") {
+			location = strings.TrimSpace(value)
+			return location, location != ""
 		}
 	}
-	err = errors.New("UPnP port discovery failed.")
 	return
 }
 
+// A NAT for the gateway whose device description is at location, through
+// the first of its connection services that gives an external address.
+// Gateways can list several, with nothing to say which one's connected.
+func upnpNATAt(location string) (nat *upnpNAT, err error) {
+	services, err := getServices(location)
+	if err != nil {
+		return
+	}
+	ourIP, err := localIPv4For(location)
+	if err != nil {
+		return
+	}
+	for _, s := range services {
+		n := &upnpNAT{serviceURL: s.url, ourIP: ourIP.String(), serviceType: s.serviceType}
+		var ip net.IP
+		if ip, err = n.GetExternalAddress(); err == nil && (ip == nil || ip.IsUnspecified()) {
+			err = errors.New("Not connected")
+		}
+		if err == nil {
+			return n, nil
+		}
+		packageLogger().Debug("Not using a UPnP service", "service", s.serviceType, "url", s.url, "err", err)
+	}
+	return nil, fmt.Errorf("None of its %d connection services will do: %v", len(services), err)
+}
+
 type Envelope struct {
 	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
 	Soap    *SoapBody
@@ -136,27 +191,40 @@ type Device struct {
 }
 
 type Root struct {
-	Device Device
+	URLBase string `xml:"URLBase"` // What control URLs are relative to, if it isn't the description's URL
+	Device  Device
 }
 
-func getChildDevice(d *Device, deviceType string) *Device {
-	dl := d.DeviceList.Device
-	for i := 0; i < len(dl); i++ {
-		if strings.Index(dl[i].DeviceType, deviceType) >= 0 {
-			return &dl[i]
-		}
+// Every service of d and the devices in it.
+func allServices(d *Device) (services []Service) {
+	services = append(services, d.ServiceList.Service...)
+	for i := range d.DeviceList.Device {
+		services = append(services, allServices(&d.DeviceList.Device[i])...)
 	}
-	return nil
+	return
+}
+
+// Whether a device or service type is of kind, like "WANIPConnection:1".
+// Some routers don't get the case right.
+func upnpTypeIs(t, kind string) bool {
+	return strings.Contains(strings.ToLower(t), strings.ToLower(kind))
 }
 
-func getChildService(d *Device, serviceType string) *Service {
-	sl := d.ServiceList.Service
-	for i := 0; i < len(sl); i++ {
-		if strings.Index(sl[i].ServiceType, serviceType) >= 0 {
-			return &sl[i]
+// The address the router at location sees us at: the one we reach it from.
+func localIPv4For(location string) (net.IP, error) {
+	if u, err := url.Parse(location); err == nil && u.Host != "" {
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		if conn, err := net.Dial("udp4", host); err == nil {
+			defer conn.Close()
+			if ip := conn.LocalAddr().(*net.UDPAddr).IP.To4(); ip != nil {
+				return ip, nil
+			}
 		}
 	}
-	return nil
+	return localIPv4()
 }
 
 func localIPv4() (net.IP, error) {
@@ -184,62 +252,82 @@ func localIPv4() (net.IP, error) {
 	return nil, errors.New("cannot find local IP address")
 }
 
-func getServiceURL(rootURL string) (url, urnDomain string, err error) {
-	r, err := http.Get(rootURL)
+// A gateway's service for managing port mappings.
+type upnpService struct {
+	url         string // Where its SOAP requests go
+	serviceType string // Kept whole, since the domain isn't always schemas-upnp-org
+}
+
+// The connection services in the gateway's device description at rootURL,
+// the ones to try first first: IGDv2's WANIPConnection:2, whose leases are
+// better behaved, then WANIPConnection:1, then WANPPPConnection:1, which
+// PPPoE routers have. IGDv2 devices are version 2 all the way down, but
+// their services keep v1's. They're looked for anywhere in the gateway, as
+// some routers don't put them in a WANConnectionDevice, or a WANDevice.
+func getServices(rootURL string) (services []upnpService, err error) {
+	r, err := upnpClient.Get(rootURL)
 	if err != nil {
 		return
 	}
 	defer r.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	packageLogger().Debug("UPnP device description", "url", rootURL, "status", r.StatusCode, "description", string(data))
+	if err != nil {
+		return
+	}
 	if r.StatusCode >= 400 {
-		err = errors.New(string(r.StatusCode))
+		err = fmt.Errorf("Error %d getting the device description", r.StatusCode)
 		return
 	}
 	var root Root
-	err = xml.NewDecoder(r.Body).Decode(&root)
-	if err != nil {
+	if err = xml.Unmarshal(data, &root); err != nil {
 		return
 	}
-	a := &root.Device
-	if strings.Index(a.DeviceType, "InternetGatewayDevice:1") < 0 {
+	if !upnpTypeIs(root.Device.DeviceType, "InternetGatewayDevice:") {
 		err = errors.New("No InternetGatewayDevice")
 		return
 	}
-	b := getChildDevice(a, "WANDevice:1")
-	if b == nil {
-		err = errors.New("No WANDevice")
-		return
-	}
-	c := getChildDevice(b, "WANConnectionDevice:1")
-	if c == nil {
-		err = errors.New("No WANConnectionDevice")
-		return
+	base := rootURL
+	if b := strings.TrimSpace(root.URLBase); b != "" {
+		base = b
 	}
-	d := getChildService(c, "WANIPConnection:1")
-	if d == nil {
-		// Some routers don't follow the UPnP spec, and put WanIPConnection under WanDevice,
-		// instead of under WanConnectionDevice
-		d = getChildService(b, "WANIPConnection:1")
-
-		if d == nil {
-			err = errors.New("No WANIPConnection")
-			return
+	all := allServices(&root.Device)
+	for _, kind := range []string{"WANIPConnection:2", "WANIPConnection:1", "WANPPPConnection:1"} {
+		for _, s := range all {
+			if !upnpTypeIs(s.ServiceType, kind) {
+				continue
+			}
+			u, e := resolveURL(base, s.ControlURL)
+			if e != nil {
+				packageLogger().Debug("Bad UPnP control URL", "url", s.ControlURL, "err", e)
+				continue
+			}
+			services = append(services, upnpService{url: u, serviceType: strings.TrimSpace(s.ServiceType)})
 		}
 	}
-	// Extract the domain name, which isn't always 'schemas-upnp-org'
-	urnDomain = strings.Split(d.ServiceType, ":")[1]
-	url = combineURL(rootURL, d.ControlURL)
+	if len(services) == 0 {
+		err = errors.New("No WANIPConnection or WANPPPConnection")
+	}
 	return
 }
 
-func combineURL(rootURL, subURL string) string {
-	protocolEnd := "://"
-	protoEndIndex := strings.Index(rootURL, protocolEnd)
-	a := rootURL[protoEndIndex+len(protocolEnd):]
-	rootIndex := strings.Index(a, "/")
-	return rootURL[0:protoEndIndex+len(protocolEnd)+rootIndex] + subURL
+// The URL ref refers to from base. Control URLs are mostly paths, but can be
+// whole URLs, or relative to the description's.
+func resolveURL(base, ref string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", err
+	}
+	return b.ResolveReference(r).String(), nil
 }
 
-func soapRequest(url, function, message, domain string) (r *http.Response, err error) {
+// Makes a SOAP request, returning the body of the router's answer, or the
+// UPnPError it gave. Some routers give theirs with 200 OK.
+func soapRequest(url, function, message, serviceType string) (body []byte, err error) {
 	fullMessage := "<?xml version=\"1.0\" ?>" +
 		"<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\" s:encodingStyle=\"http://schemas.xmlsoap.org/soap/encoding/\">\r\n" +
 		"<s:Body>" + message + "</s:Body></s:Envelope>"
@@ -251,58 +339,95 @@ func soapRequest(url, function, message, domain string) (r *http.Response, err e
 	req.Header.Set("Content-Type", "text/xml ; charset=\"utf-8\"")
 	req.Header.Set("User-Agent", "Darwin/10.0.0, UPnP/1.0, MiniUPnPc/1.3")
 	//req.Header.Set("Transfer-Encoding", "chunked")
-	req.Header.Set("SOAPAction", "\"urn:"+domain+":service:WANIPConnection:1#"+function+"\"")
+	req.Header.Set("SOAPAction", "\""+serviceType+"#"+function+"\"")
 	req.Header.Set("Connection", "Close")
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Pragma", "no-cache")
 
 	// log.Stderr("soapRequest ", req)
 
-	r, err = http.DefaultClient.Do(req)
+	r, err := upnpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	/*if r.Body != nil {
-		defer r.Body.Close()
-	}*/
-
-	if r.StatusCode >= 400 {
-		// log.Stderr(function, r.StatusCode)
-		err = errors.New("Error " + strconv.Itoa(r.StatusCode) + " for " + function)
-		r = nil
-		return
+	defer r.Body.Close()
+	body, err = ioutil.ReadAll(io.LimitReader(r.Body, 64<<10))
+	packageLogger().Debug("UPnP answer", "function", function, "status", r.StatusCode, "body", string(body))
+	if err != nil {
+		return nil, err
+	}
+	if e := newUPnPError(function, r.StatusCode, body); r.StatusCode >= 400 || e.code != 0 {
+		return nil, e
 	}
 	return
 }
 
+// UPnP error codes we act on.
+const (
+	upnpActionFailed           = 501
+	upnpNotAuthorized          = 606
+	upnpNoSuchEntry            = 714 // NoSuchEntryInArray
+	upnpConflictInMappingEntry = 718 // The port's mapped to someone else
+	upnpOnlyPermanentLeases    = 725 // OnlyPermanentLeasesSupported
+)
+
+// A SOAP request the router refused, with the UPnPError it gave, if any.
+type upnpError struct {
+	function    string
+	status      int
+	code        int // The UPnPError's errorCode, or 0
+	description string
+}
+
+func newUPnPError(function string, status int, body []byte) *upnpError {
+	e := &upnpError{function: function, status: status}
+	var fault struct {
+		Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+	}
+	if xml.Unmarshal(body, &fault) == nil {
+		e.code, e.description = fault.Code, strings.TrimSpace(fault.Description)
+	}
+	return e
+}
+
+// Whether asking again may work: the router failed without saying why, or
+// was too busy to answer.
+func (e *upnpError) temporary() bool {
+	return e.code == upnpActionFailed || (e.code == 0 && e.status >= 500)
+}
+
+func (e *upnpError) Error() string {
+	switch {
+	case e.status == http.StatusUnauthorized || e.status == http.StatusForbidden || e.code == upnpNotAuthorized:
+		return fmt.Sprintf("Error %d for %s: the router won't let us change its port mappings. Its UPnP setting may be off", e.status, e.function)
+	case e.code != 0:
+		return fmt.Sprintf("Error %d for %s: UPnP error %d %s", e.status, e.function, e.code, e.description)
+	}
+	return "Error " + strconv.Itoa(e.status) + " for " + e.function
+}
+
 type statusInfo struct {
 	externalIpAddress string
 }
 
 func (n *upnpNAT) getExternalIPAddress() (info statusInfo, err error) {
 
-	message := "<u:GetExternalIPAddress xmlns:u=\"urn:" + n.urnDomain + ":service:WANIPConnection:1\">\r\n" +
+	message := "<u:GetExternalIPAddress xmlns:u=\"" + n.serviceType + "\">\r\n" +
 		"</u:GetExternalIPAddress>"
 
-	var response *http.Response
-	response, err = soapRequest(n.serviceURL, "GetExternalIPAddress", message, n.urnDomain)
-	if response != nil {
-		defer response.Body.Close()
-	}
+	data, err := soapRequest(n.serviceURL, "GetExternalIPAddress", message, n.serviceType)
 	if err != nil {
 		return
 	}
 	var envelope Envelope
-	data, err := ioutil.ReadAll(response.Body)
-	reader := bytes.NewReader(data)
-	xml.NewDecoder(reader).Decode(&envelope)
-
-	info = statusInfo{envelope.Soap.ExternalIP.IPAddress}
-
-	if err != nil {
+	xml.Unmarshal(data, &envelope)
+	if envelope.Soap == nil || envelope.Soap.ExternalIP == nil {
+		err = errors.New("No external IP address in the router's answer")
 		return
 	}
 
+	info = statusInfo{strings.TrimSpace(envelope.Soap.ExternalIP.IPAddress)}
 	return
 }
 
@@ -315,9 +440,47 @@ func (n *upnpNAT) GetExternalAddress() (addr net.IP, err error) {
 	return
 }
 
+// How many times AddPortMapping asks again, after errors it can get past,
+// and how long it waits after one that may be temporary.
+const UPNP_RETRIES = 3
+
+var upnpRetryDelay = time.Second // Shortened by tests
+
 func (n *upnpNAT) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (mappedExternalPort int, err error) {
+	for attempt := 0; ; attempt++ {
+		err = n.addPortMapping(protocol, externalPort, internalPort, description, timeout)
+		e, ok := err.(*upnpError)
+		if !ok || attempt == UPNP_RETRIES {
+			break
+		}
+		switch {
+		case e.code == upnpOnlyPermanentLeases && timeout != 0:
+			// IGDv1 routers may only take mappings that never expire. We
+			// delete ours on the way out.
+			log.Println("The UPnP router only takes permanent port mappings, so asking for one")
+			timeout = 0
+		case e.code == upnpConflictInMappingEntry:
+			// Someone else has the port. Any other will do, as we say which
+			// we got.
+			old := externalPort
+			externalPort = 1024 + rand.Intn(65536-1024)
+			log.Println("The UPnP router maps port", old, "to someone else, so asking for", externalPort)
+		case e.temporary():
+			time.Sleep(upnpRetryDelay)
+		default:
+			return
+		}
+	}
+	if err != nil {
+		return
+	}
+	mappedExternalPort = externalPort
+	return
+}
+
+func (n *upnpNAT) addPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (err error) {
 	// A single concatenation would break ARM compilation.
-	message := "<u:AddPortMapping xmlns:u=\"urn:" + n.urnDomain + ":service:WANIPConnection:1\">\r\n" +
+	message := "<u:AddPortMapping xmlns:u=\"" + n.serviceType + "\">\r\n" +
 		"<NewRemoteHost></NewRemoteHost><NewExternalPort>" + strconv.Itoa(externalPort)
 	message += "</NewExternalPort><NewProtocol>" + protocol + "</NewProtocol>"
 	message += "<NewInternalPort>" + strconv.Itoa(internalPort) + "</NewInternalPort>" +
@@ -327,40 +490,42 @@ func (n *upnpNAT) AddPortMapping(protocol string, externalPort, internalPort int
 		"</NewPortMappingDescription><NewLeaseDuration>" + strconv.Itoa(timeout) +
 		"</NewLeaseDuration></u:AddPortMapping>"
 
-	var response *http.Response
-	response, err = soapRequest(n.serviceURL, "AddPortMapping", message, n.urnDomain)
-	if response != nil {
-		defer response.Body.Close()
+	_, err = soapRequest(n.serviceURL, "AddPortMapping", message, n.serviceType)
+	return
+}
+
+// Whether the router still maps externalPort to us. Routers that restart
+// can come back without it.
+func (n *upnpNAT) mappingExists(protocol string, externalPort int) (exists bool, err error) {
+	message := "<u:GetSpecificPortMappingEntry xmlns:u=\"" + n.serviceType + "\">\r\n" +
+		"<NewRemoteHost></NewRemoteHost><NewExternalPort>" + strconv.Itoa(externalPort) +
+		"</NewExternalPort><NewProtocol>" + protocol + "</NewProtocol>" +
+		"</u:GetSpecificPortMappingEntry>"
+
+	data, err := soapRequest(n.serviceURL, "GetSpecificPortMappingEntry", message, n.serviceType)
+	if e, ok := err.(*upnpError); ok && e.code == upnpNoSuchEntry {
+		return false, nil
 	}
 	if err != nil {
 		return
 	}
-
-	// TODO: check response to see if the port was forwarded
-	// log.Println(message, response)
-	mappedExternalPort = externalPort
-	_ = response
-	return
+	var entry struct {
+		InternalClient string `xml:"Body>GetSpecificPortMappingEntryResponse>NewInternalClient"`
+	}
+	if err = xml.Unmarshal(data, &entry); err != nil {
+		return
+	}
+	// Someone else's mapping is as good as none.
+	return strings.TrimSpace(entry.InternalClient) == n.ourIP, nil
 }
 
 func (n *upnpNAT) DeletePortMapping(protocol string, externalPort, internalPort int) (err error) {
 
-	message := "<u:DeletePortMapping xmlns:u=\"urn:" + n.urnDomain + ":service:WANIPConnection:1\">\r\n" +
+	message := "<u:DeletePortMapping xmlns:u=\"" + n.serviceType + "\">\r\n" +
 		"<NewRemoteHost></NewRemoteHost><NewExternalPort>" + strconv.Itoa(externalPort) +
 		"</NewExternalPort><NewProtocol>" + protocol + "</NewProtocol>" +
 		"</u:DeletePortMapping>"
 
-	var response *http.Response
-	response, err = soapRequest(n.serviceURL, "DeletePortMapping", message, n.urnDomain)
-	if response != nil {
-		defer response.Body.Close()
-	}
-	if err != nil {
-		return
-	}
-
-	// TODO: check response to see if the port was deleted
-	// log.Println(message, response)
-	_ = response
+	_, err = soapRequest(n.serviceURL, "DeletePortMapping", message, n.serviceType)
 	return
 }
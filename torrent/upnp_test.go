@@ -0,0 +1,356 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An IGDv2 router, offering both WANIPConnection versions.
+const fakeIGDDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:2</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:2</deviceType>
+<serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl/v1</controlURL></service>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:2</serviceType><controlURL>/ctl/v2</controlURL></service>
+</serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+func upnpFault(code int, description string) string {
+	return `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>` +
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>` + fmt.Sprint(code) +
+		`</errorCode><errorDescription>` + description + `</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`
+}
+
+func upnpResponse(serviceType, function, args string) string {
+	return `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+		`<u:` + function + `Response xmlns:u="` + serviceType + `">` + args + `</u:` + function + `Response></s:Body></s:Envelope>`
+}
+
+// A router with a mapping table, that only takes permanent mappings, and
+// refuses everything once locked.
+type fakeIGD struct {
+	lock     sync.Mutex
+	mappings map[string]string // "protocol port" to internal client
+	locked   bool
+	adds     []string
+
+	description  string          // Or fakeIGDDescription
+	disconnected map[string]bool // Control paths with no external address
+	failures     int             // AddPortMappings to fail with ActionFailed
+	faultsOK     bool            // Faults come with 200 OK
+}
+
+func (f *fakeIGD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/rootDesc.xml" {
+		if f.description != "" {
+			io.WriteString(w, f.description)
+		} else {
+			io.WriteString(w, fakeIGDDescription)
+		}
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.locked {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	fault := func(code int, description string) {
+		if !f.faultsOK {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		io.WriteString(w, upnpFault(code, description))
+	}
+	action := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	serviceType, function, _ := strings.Cut(action, "#")
+	body, _ := io.ReadAll(r.Body)
+	arg := func(name string) string {
+		_, v, _ := strings.Cut(string(body), "<"+name+">")
+		v, _, _ = strings.Cut(v, "</"+name+">")
+		return v
+	}
+	key := arg("NewProtocol") + " " + arg("NewExternalPort")
+	switch function {
+	case "GetExternalIPAddress":
+		ip := "5.6.7.8"
+		if f.disconnected[r.URL.Path] {
+			ip = "0.0.0.0"
+		}
+		io.WriteString(w, upnpResponse(serviceType, function, "<NewExternalIPAddress>"+ip+"</NewExternalIPAddress>"))
+	case "AddPortMapping":
+		f.adds = append(f.adds, arg("NewLeaseDuration"))
+		if f.failures > 0 {
+			f.failures--
+			fault(upnpActionFailed, "Action Failed")
+			return
+		}
+		if arg("NewLeaseDuration") != "0" {
+			fault(upnpOnlyPermanentLeases, "OnlyPermanentLeasesSupported")
+			return
+		}
+		if client, ok := f.mappings[key]; ok && client != arg("NewInternalClient") {
+			fault(upnpConflictInMappingEntry, "ConflictInMappingEntry")
+			return
+		}
+		f.mappings[key] = arg("NewInternalClient")
+		io.WriteString(w, upnpResponse(serviceType, function, ""))
+	case "GetSpecificPortMappingEntry":
+		client, ok := f.mappings[key]
+		if !ok {
+			fault(upnpNoSuchEntry, "NoSuchEntryInArray")
+			return
+		}
+		io.WriteString(w, upnpResponse(serviceType, function, "<NewInternalClient>"+client+"</NewInternalClient>"))
+	case "DeletePortMapping":
+		delete(f.mappings, key)
+		io.WriteString(w, upnpResponse(serviceType, function, ""))
+	default:
+		fault(401, "Invalid Action")
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	igd := &fakeIGD{mappings: map[string]string{}}
+	server := httptest.NewServer(igd)
+	defer server.Close()
+
+	services, err := getServices(server.URL + "/rootDesc.xml")
+	if err != nil || len(services) != 2 || services[0].url != server.URL+"/ctl/v2" ||
+		services[0].serviceType != "urn:schemas-upnp-org:service:WANIPConnection:2" {
+		t.Fatalf("Services %+v, %v", services, err)
+	}
+	n := &upnpNAT{serviceURL: services[0].url, ourIP: "192.168.1.9", serviceType: services[0].serviceType}
+
+	if ip, err := n.GetExternalAddress(); err != nil || ip.String() != "5.6.7.8" {
+		t.Errorf("External address %v, %v", ip, err)
+	}
+	if exists, err := n.mappingExists("TCP", 6881); err != nil || exists {
+		t.Errorf("Unmapped port exists %v, %v", exists, err)
+	}
+	if port, err := n.AddPortMapping("TCP", 6881, 6881, "test", 7200); err != nil || port != 6881 {
+		t.Fatalf("Mapped %d, %v", port, err)
+	}
+	if len(igd.adds) != 2 || igd.adds[1] != "0" {
+		t.Errorf("Asked for leases %v", igd.adds)
+	}
+	if exists, err := n.mappingExists("TCP", 6881); err != nil || !exists {
+		t.Errorf("Mapped port exists %v, %v", exists, err)
+	}
+	igd.mappings["TCP 6881"] = "192.168.1.10"
+	if exists, err := n.mappingExists("TCP", 6881); err != nil || exists {
+		t.Errorf("Someone else's mapping exists %v, %v", exists, err)
+	}
+	if err = n.DeletePortMapping("TCP", 6881, 6881); err != nil || len(igd.mappings) != 0 {
+		t.Errorf("Deleted, leaving %v, %v", igd.mappings, err)
+	}
+
+	igd.locked = true
+	_, err = n.AddPortMapping("TCP", 6881, 6881, "test", 7200)
+	if e, ok := err.(*upnpError); !ok || e.status != http.StatusUnauthorized || !strings.Contains(err.Error(), "UPnP setting") {
+		t.Errorf("Locked router: %v", err)
+	}
+}
+
+// Answers to M-SEARCH modelled on what routers send, and the device
+// description URLs in them.
+var ssdpAnswerTests = []struct {
+	name, answer, location string
+}{
+	{"miniupnpd", "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"USN: uuid:3c5fa8e2-0a4b-4f56-b7a8-1c2d3e4f5a6b::urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"EXT:\r\nSERVER: OpenWRT/OpenWrt UPnP/1.1 MiniUPnPd/2.2.1\r\n" +
+		"LOCATION: http://192.168.1.1:5000/rootDesc.xml\r\nOPT: \"http://schemas.upnp.org/upnp/1/0/\"; ns=01\r\n\r\n",
+		"http://192.168.1.1:5000/rootDesc.xml"},
+	// Bare newlines, the type only in the USN, and a URL whose case matters.
+	{"bare newlines", "HTTP/1.1 200 OK\nLocation:http://192.168.0.1:1900/IGD/rootDesc.xml\nSt: upnp:rootdevice\n" +
+		"Usn: uuid:upnp-InternetGatewayDevice-1_0-A0B1C2D3E4F5::upnp:rootdevice\nServer: Custom/1.0 UPnP/1.0 Proc/Ver\n\n",
+		"http://192.168.0.1:1900/IGD/rootDesc.xml"},
+	{"WAN service", "HTTP/1.1 200 OK\r\nST: urn:schemas-upnp-org:service:WANIPConnection:1\r\n" +
+		"location: http://10.0.0.138:49152/gatedesc.xml \r\n\r\n",
+		"http://10.0.0.138:49152/gatedesc.xml"},
+	{"not a gateway", "HTTP/1.1 200 OK\r\nST: urn:dial-multiscreen-org:service:dial:1\r\n" +
+		"LOCATION: http://192.168.1.20:8008/ssdp/device-desc.xml\r\n\r\n", ""},
+	{"no location", "HTTP/1.1 200 OK\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n", ""},
+}
+
+func TestParseSSDPAnswer(t *testing.T) {
+	for _, tt := range ssdpAnswerTests {
+		if location, ok := parseSSDPAnswer(tt.answer); location != tt.location || ok != (tt.location != "") {
+			t.Errorf("%s: location %q, %v", tt.name, location, ok)
+		}
+	}
+}
+
+// Device descriptions modelled on what routers serve, and the services in
+// them, in the order they're tried.
+var upnpDescriptionTests = []struct {
+	name, description string
+	services          []upnpService
+}{
+	{"miniupnpd", `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><specVersion><major>1</major><minor>1</minor></specVersion>
+<device><deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><friendlyName>OpenWRT router</friendlyName>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/ctl/L3F</controlURL></service></serviceList>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1</serviceType><controlURL>/ctl/CmnIfCfg</controlURL></service></serviceList>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId><controlURL>/ctl/IPConn</controlURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`,
+		[]upnpService{{"http://router/ctl/IPConn", "urn:schemas-upnp-org:service:WANIPConnection:1"}}},
+	// A URLBase, and both PPPoE and IP connections, in devices of their own.
+	{"DSL router", `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><URLBase>http://192.168.0.1:1900</URLBase>
+<device><deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList>
+<device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType><controlURL>/upnp/control/WANPPPConn1</controlURL></service></serviceList></device>
+<device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>http://192.168.0.1:49000/upnp/control/WANIPConn1</controlURL></service></serviceList></device>
+</deviceList></device></deviceList></device></root>`,
+		[]upnpService{{"http://192.168.0.1:49000/upnp/control/WANIPConn1", "urn:schemas-upnp-org:service:WANIPConnection:1"},
+			{"http://192.168.0.1:1900/upnp/control/WANPPPConn1", "urn:schemas-upnp-org:service:WANPPPConnection:1"}}},
+	// Prefixed elements, lower case types padded with spaces, the service
+	// straight under the gateway, and a control URL relative to the
+	// description's.
+	{"quirky", `<?xml version="1.0"?>
+<u:root xmlns:u="urn:schemas-upnp-org:device-1-0"><u:device>
+<u:deviceType>urn:schemas-upnp-org:device:internetgatewaydevice:1</u:deviceType>
+<u:serviceList><u:service><u:serviceType> urn:schemas-upnp-org:service:wanipconnection:1 </u:serviceType>
+<u:controlURL> control/wanip </u:controlURL></u:service></u:serviceList>
+</u:device></u:root>`,
+		[]upnpService{{"http://router/control/wanip", "urn:schemas-upnp-org:service:wanipconnection:1"}}},
+	{"media server", `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device><deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:ContentDirectory:1</serviceType><controlURL>/cd</controlURL></service></serviceList>
+</device></root>`, nil},
+}
+
+func TestGetServices(t *testing.T) {
+	for _, tt := range upnpDescriptionTests {
+		description := tt.description
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, description)
+		}))
+		services, err := getServices(server.URL + "/rootDesc.xml")
+		server.Close()
+		for i := range tt.services {
+			tt.services[i].url = strings.Replace(tt.services[i].url, "http://router", server.URL, 1)
+		}
+		if !reflect.DeepEqual(services, tt.services) || (err == nil) != (tt.services != nil) {
+			t.Errorf("%s: services %+v, %v, want %+v", tt.name, services, err, tt.services)
+		}
+	}
+}
+
+// The first service that's connected is the one used.
+func TestUPnPNATAt(t *testing.T) {
+	igd := &fakeIGD{mappings: map[string]string{}, disconnected: map[string]bool{"/ctl/v2": true}}
+	server := httptest.NewServer(igd)
+	defer server.Close()
+	n, err := upnpNATAt(server.URL + "/rootDesc.xml")
+	if err != nil || n.serviceURL != server.URL+"/ctl/v1" || n.ourIP != "127.0.0.1" {
+		t.Fatalf("NAT %+v, %v", n, err)
+	}
+	igd.disconnected["/ctl/v1"] = true
+	if n, err = upnpNATAt(server.URL + "/rootDesc.xml"); err == nil {
+		t.Errorf("Used %+v, with nothing connected", n)
+	}
+}
+
+func TestUPnPRetries(t *testing.T) {
+	defer func(d time.Duration) { upnpRetryDelay = d }(upnpRetryDelay)
+	upnpRetryDelay = time.Millisecond
+	igd := &fakeIGD{mappings: map[string]string{}}
+	server := httptest.NewServer(igd)
+	defer server.Close()
+	n := &upnpNAT{serviceURL: server.URL + "/ctl/v1", ourIP: "192.168.1.9", serviceType: "urn:schemas-upnp-org:service:WANIPConnection:1"}
+
+	// ActionFailed is tried again, as are faults with 200 OK.
+	igd.failures, igd.faultsOK = 2, true
+	if port, err := n.AddPortMapping("TCP", 6881, 6881, "test", 0); err != nil || port != 6881 {
+		t.Errorf("After failures, mapped %d, %v", port, err)
+	}
+	igd.failures = UPNP_RETRIES + 1
+	if _, err := n.AddPortMapping("TCP", 6881, 6881, "test", 0); err == nil {
+		t.Error("Kept failing, but mapped")
+	}
+	igd.failures, igd.faultsOK = 0, false
+
+	// Someone else's port gets us another.
+	igd.mappings["TCP 6882"] = "192.168.1.10"
+	port, err := n.AddPortMapping("TCP", 6882, 6882, "test", 0)
+	if err != nil || port == 6882 || igd.mappings["TCP "+fmt.Sprint(port)] != "192.168.1.9" {
+		t.Errorf("Conflict mapped %d, %v, leaving %v", port, err, igd.mappings)
+	}
+}
+
+// A router that only answers searches for IGDv2, twice, among other devices.
+func TestSSDPDiscover(t *testing.T) {
+	igd := &fakeIGD{mappings: map[string]string{}}
+	server := httptest.NewServer(igd)
+	defer server.Close()
+	router, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	searched := make(chan string, 10)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, from, err := router.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			_, st, _ := strings.Cut(string(b[:n]), "\r\nST: ")
+			st, _, _ = strings.Cut(st, "\r\n")
+			select {
+			case searched <- st:
+			default:
+			}
+			router.WriteToUDP([]byte(ssdpAnswerTests[3].answer), from)
+			if strings.HasSuffix(st, "InternetGatewayDevice:2") {
+				answer := "HTTP/1.1 200 OK\r\nST: " + st + "\r\nLOCATION: " + server.URL + "/rootDesc.xml\r\n\r\n"
+				router.WriteToUDP([]byte(answer), from)
+				router.WriteToUDP([]byte(answer), from)
+			}
+		}
+	}()
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	nat, err := ssdpDiscover(socket, router.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := nat.(*upnpNAT); n.serviceURL != server.URL+"/ctl/v2" {
+		t.Errorf("Found %+v", n)
+	}
+	var targets []string
+	for len(targets) < len(ssdpTargets) {
+		targets = append(targets, <-searched)
+	}
+	if !reflect.DeepEqual(targets, ssdpTargets) {
+		t.Errorf("Searched for %q", targets)
+	}
+}
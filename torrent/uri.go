@@ -2,18 +2,79 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
 	"fmt"
 	_ "io"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 
 	_ "github.com/nictuku/dht"
 )
 
 type Magnet struct {
-	InfoHashes []string
-	Names      []string
-	Trackers   [][]string
+	InfoHashes        []string // Hex v1 info-hashes, from xt=urn:btih:
+	InfoHashesV2      []string // Hex v2 info-hashes, from xt=urn:btmh:
+	Names             []string
+	Trackers          [][]string
+	WebSeeds          []string // ws=
+	AcceptableSources []string // as=
+	Peers             []string // x.pe=, as host:port
+}
+
+// The multihash prefix of a SHA-256 digest.
+const multihashSHA256 = "1220"
+
+// An InfoHashLengthError is returned for a magnet link whose btih is
+// neither 40 hex digits nor 32 base32 ones.
+type InfoHashLengthError struct {
+	InfoHash string
+}
+
+func (e *InfoHashLengthError) Error() string {
+	return fmt.Sprintf("Magnet URI contains infohash with unexpected length. Wanted %d (hex) or %d (base32), got %d: %v",
+		hex.EncodedLen(sha1.Size), base32.StdEncoding.EncodedLen(sha1.Size), len(e.InfoHash), e.InfoHash)
+}
+
+// Decodes a btih, which is hex or, in older links, base32, into hex.
+func decodeBTIH(ih string) (string, error) {
+	switch len(ih) {
+	case hex.EncodedLen(sha1.Size):
+		if _, err := hex.DecodeString(ih); err != nil {
+			return "", fmt.Errorf("Magnet URI contains an invalid hex infohash: %v", ih)
+		}
+		return strings.ToLower(ih), nil
+	case base32.StdEncoding.EncodedLen(sha1.Size):
+		b, err := base32.StdEncoding.DecodeString(strings.ToUpper(ih))
+		if err != nil {
+			return "", fmt.Errorf("Magnet URI contains an invalid base32 infohash: %v", ih)
+		}
+		return hex.EncodeToString(b), nil
+	}
+	return "", &InfoHashLengthError{ih}
+}
+
+// Appends the values not already in list.
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			found = found || l == v
+		}
+		if !found && v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Whether a torrent to be added is one to download, by an http: or https:
+// URL.
+func isTorrentURL(torrent string) bool {
+	return strings.HasPrefix(torrent, "http:") || strings.HasPrefix(torrent, "https:")
 }
 
 func parseMagnet(s string) (Magnet, error) {
@@ -30,26 +91,46 @@ func parseMagnet(s string) (Magnet, error) {
 	//   ~ btih: bittorrent infohash.
 	// dn: display name (optional).
 	// tr: address tracker (optional).
-	u, err := url.Parse(s)
+	// ws: web seed (optional). http://bittorrent.org/beps/bep_0019.html
+	// as: acceptable source, a direct download of the content (optional).
+	// x.pe: a peer to connect to, host:port (optional). For IPv6, [addr]:port.
+	//
+	// A hybrid v1/v2 torrent (BEP 52) has both an xt=urn:btih: and an
+	// xt=urn:btmh: parameter. The latter is a multihash of the v2 info-hash.
+	//
+	// Older links give the btih in base32 rather than hex.
+	u, err := url.Parse(strings.TrimSpace(s))
 	if err != nil {
 		return Magnet{}, err
 	}
 	xts, ok := u.Query()["xt"]
 	if !ok {
-		return Magnet{}, fmt.Errorf("Magnet URI missing the 'xt' argument: " + s)
+		return Magnet{}, fmt.Errorf("Magnet URI missing the 'xt' argument: %v", s)
 	}
-	infoHashes := make([]string, 0, len(xts))
+	var infoHashes, infoHashesV2 []string
 	for _, xt := range xts {
-		s := strings.Split(xt, "urn:btih:")
-		if len(s) != 2 {
-			return Magnet{}, fmt.Errorf("Magnet URI xt parameter missing the 'urn:btih:' prefix. Not a bittorrent hash link?")
-		}
-		ih := s[1]
-		// TODO: support base32 encoded hashes, if they still exist.
-		if len(ih) != sha1.Size*2 { // hex format.
-			return Magnet{}, fmt.Errorf("Magnet URI contains infohash with unexpected length. Wanted %d, got %d: %v", sha1.Size, len(ih), ih)
+		xt = strings.TrimSpace(xt)
+		// The urn prefix isn't case sensitive.
+		prefix := strings.ToLower(xt[:min(len(xt), len("urn:btih:"))])
+		switch prefix {
+		case "urn:btmh:":
+			mh := strings.TrimSpace(xt[len(prefix):])
+			if !strings.HasPrefix(mh, multihashSHA256) || len(mh) != len(multihashSHA256)+sha256.Size*2 {
+				return Magnet{}, fmt.Errorf("Magnet URI contains a v2 infohash that isn't a SHA-256 multihash: %v", mh)
+			}
+			infoHashesV2 = appendUnique(infoHashesV2, strings.ToLower(mh[len(multihashSHA256):]))
+		case "urn:btih:":
+			ih, err := decodeBTIH(strings.TrimSpace(xt[len(prefix):]))
+			if err != nil {
+				return Magnet{}, err
+			}
+			infoHashes = appendUnique(infoHashes, ih)
+		default:
+			// Some other kind of hash link, for some other client.
 		}
-		infoHashes = append(infoHashes, s[1])
+	}
+	if len(infoHashes) == 0 && len(infoHashesV2) == 0 {
+		return Magnet{}, fmt.Errorf("Magnet URI xt parameter missing the 'urn:btih:' prefix. Not a bittorrent hash link?")
 	}
 
 	var names []string
@@ -61,9 +142,27 @@ func parseMagnet(s string) (Magnet, error) {
 	var trackers [][]string
 	tr, ok := u.Query()["tr"]
 	if ok {
-		trackers = [][]string{tr}
+		trackers = [][]string{appendUnique(nil, tr...)}
+	}
+
+	var peers []string
+	for _, pe := range u.Query()["x.pe"] {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(pe))
+		if n, _ := strconv.Atoi(port); err != nil || host == "" || n <= 0 || n > 65535 {
+			// Not worth failing over.
+			continue
+		}
+		peers = appendUnique(peers, net.JoinHostPort(host, port))
 	}
-	fmt.Println("Trackers: ", trackers)
 
-	return Magnet{InfoHashes: infoHashes, Names: names, Trackers: trackers}, nil
+	// Query() has already URL-decoded the values.
+	return Magnet{
+		InfoHashes:        infoHashes,
+		InfoHashesV2:      infoHashesV2,
+		Names:             names,
+		Trackers:          trackers,
+		WebSeeds:          appendUnique(nil, u.Query()["ws"]...),
+		AcceptableSources: appendUnique(nil, u.Query()["as"]...),
+		Peers:             peers,
+	}, nil
 }
@@ -2,17 +2,47 @@ package torrent
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
 type magnetTest struct {
-	uri        string
-	infoHashes []string
+	uri          string
+	infoHashes   []string
+	infoHashesV2 []string
+	trackers     [][]string
+	webSeeds     []string
+	sources      []string
+	peers        []string
 }
 
 func TestParseMagnet(t *testing.T) {
 	uris := []magnetTest{
-		{uri: "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80&tr=udp%3A%2F%2Ftracker.publicbt.com%3A80&tr=udp%3A%2F%2Ftracker.istole.it%3A6969&tr=udp%3A%2F%2Ftracker.ccc.de%3A80", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"}},
+		{uri: "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80&tr=udp%3A%2F%2Ftracker.publicbt.com%3A80&tr=udp%3A%2F%2Ftracker.istole.it%3A6969&tr=udp%3A%2F%2Ftracker.ccc.de%3A80", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"},
+			trackers: [][]string{{"udp://tracker.openbittorrent.com:80", "udp://tracker.publicbt.com:80", "udp://tracker.istole.it:6969", "udp://tracker.ccc.de:80"}}},
+		// A hybrid torrent, from BEP 52, with duplicated trackers and web seeds.
+		{uri: "magnet:?xt=urn:btih:631a31dd0a46257d5078c0dee4e66e26f73e42ac&xt=urn:btmh:1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb&dn=bittorrent-v1-v2-hybrid-test" +
+			"&tr=http%3A%2F%2Ft%2Fa&tr=http%3A%2F%2Ft%2Fa&ws=http%3A%2F%2Fmirror%2Fx%2F&ws=http%3A%2F%2Fmirror%2Fx%2F&as=http%3A%2F%2Fother%2Fx",
+			infoHashes:   []string{"631a31dd0a46257d5078c0dee4e66e26f73e42ac"},
+			infoHashesV2: []string{"d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb"},
+			trackers:     [][]string{{"http://t/a"}},
+			webSeeds:     []string{"http://mirror/x/"},
+			sources:      []string{"http://other/x"}},
+		// The same torrent with its hash in base32, as older clients wrote it.
+		{uri: "magnet:?xt=urn:btih:XO3NW2MWLL3WT5TEWZRW46IU7BZVCQNT&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80",
+			infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"},
+			trackers:   [][]string{{"udp://tracker.openbittorrent.com:80"}}},
+		// Lower case base32, an upper case prefix, upper case hex and stray spaces.
+		{uri: " magnet:?xt=URN:BTIH:mmnddxikiysx2udyydpojztoe33t4qvm&xt=urn:BtIh:%20BBB6DB69965AF769F664B6636E7914F8735141B3%20 ",
+			infoHashes: []string{"631a31dd0a46257d5078c0dee4e66e26f73e42ac", "bbb6db69965af769f664b6636e7914f8735141b3"}},
+		// Peers to connect to directly, some of them no use.
+		{uri: "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&x.pe=10.0.0.1:6881&x.pe=%5B2001:db8::1%5D:51413&x.pe=seed.example.com:80" +
+			"&x.pe=10.0.0.1:6881&x.pe=noport&x.pe=:1&x.pe=10.0.0.2:0&x.pe=2001:db8::2:1",
+			infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"},
+			peers:      []string{"10.0.0.1:6881", "[2001:db8::1]:51413", "seed.example.com:80"}},
+		// Pure v2.
+		{uri: "magnet:?xt=urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e&dn=bittorrent-v2-test",
+			infoHashesV2: []string{"caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"}},
 	}
 
 	for _, u := range uris {
@@ -23,5 +53,117 @@ func TestParseMagnet(t *testing.T) {
 		if !reflect.DeepEqual(u.infoHashes, m.InfoHashes) {
 			t.Errorf("ParseMagnet failed, wanted %v, got %v", u.infoHashes, m.InfoHashes)
 		}
+		if !reflect.DeepEqual(u.infoHashesV2, m.InfoHashesV2) {
+			t.Errorf("ParseMagnet failed, wanted v2 %v, got %v", u.infoHashesV2, m.InfoHashesV2)
+		}
+		if !reflect.DeepEqual(u.trackers, m.Trackers) {
+			t.Errorf("ParseMagnet failed, wanted trackers %v, got %v", u.trackers, m.Trackers)
+		}
+		if !reflect.DeepEqual(u.peers, m.Peers) {
+			t.Errorf("ParseMagnet failed, wanted peers %v, got %v", u.peers, m.Peers)
+		}
+		if !reflect.DeepEqual(u.webSeeds, m.WebSeeds) || !reflect.DeepEqual(u.sources, m.AcceptableSources) {
+			t.Errorf("ParseMagnet failed, wanted web seeds %v %v, got %v %v", u.webSeeds, u.sources, m.WebSeeds, m.AcceptableSources)
+		}
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	for _, uri := range []string{
+		"magnet:?dn=nothing",
+		"magnet:?xt=urn:ed2k:31d6cfe0d16ae931b73c59d7e0c089c0",
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btmh:1114caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa",
+		"magnet:?xt=urn:btih:zzb6db69965af769f664b6636e7914f8735141b3",
+		"magnet:?xt=urn:btih:XO3NW2MWLL3WT5TEWZRW46IU7BZVCQN1",
+	} {
+		if _, err := parseMagnet(uri); err == nil {
+			t.Errorf("ParseMagnet(%v) succeeded, expected an error", uri)
+		}
+	}
+	_, err := parseMagnet("magnet:?xt=urn:btih:XO3NW2MWLL3WT5TEWZRW46IU7BZVCQN")
+	if e, ok := err.(*InfoHashLengthError); !ok || e.InfoHash != "XO3NW2MWLL3WT5TEWZRW46IU7BZVCQN" {
+		t.Errorf("ParseMagnet of a short hash gave %#v, want an InfoHashLengthError", err)
+	}
+}
+
+func TestMagnetMetaInfo(t *testing.T) {
+	m, err := GetMetaInfo(nil, "magnet:?xt=urn:btih:631a31dd0a46257d5078c0dee4e66e26f73e42ac&xt=urn:btmh:1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb&ws=http%3A%2F%2Fa%2F&as=http%3A%2F%2Fb%2F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.InfoHashes()) != 2 {
+		t.Errorf("InfoHashes() = %x, want the v1 and v2 hashes", m.InfoHashes())
+	}
+	if want := []string{"http://a/", "http://b/"}; !reflect.DeepEqual(m.WebSeeds, want) {
+		t.Errorf("WebSeeds = %v, want %v", m.WebSeeds, want)
+	}
+}
+
+func TestMagnetDisplayName(t *testing.T) {
+	const ih = "631a31dd0a46257d5078c0dee4e66e26f73e42ac"
+	for _, tt := range []struct{ dn, want string }{
+		{"&dn=Ubuntu+12.04%20desktop", "Ubuntu 12.04 desktop"},
+		{"&dn=..%2F..%2Fetc", ".._.._etc"},
+		{"&dn=..", ih},
+		{"&dn=%20", ih},
+		{"", ih},
+	} {
+		m, err := GetMetaInfo(nil, "magnet:?xt=urn:btih:"+ih+tt.dn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Info.Name != tt.want {
+			t.Errorf("Name for %q = %q, want %q", tt.dn, m.Info.Name, tt.want)
+		}
 	}
 }
+
+func TestIsTorrentURL(t *testing.T) {
+	for _, tt := range []struct {
+		torrent string
+		want    bool
+	}{
+		{"http://example.com/a.torrent", true},
+		{"https://example.com/a.torrent", true},
+		{"ftp://example.com/a.torrent", false},
+		{"magnet:?xt=urn:btih:631a31dd0a46257d5078c0dee4e66e26f73e42ac", false},
+		{"/tmp/https:a.torrent", false},
+	} {
+		if got := isTorrentURL(tt.torrent); got != tt.want {
+			t.Errorf("isTorrentURL(%q) = %v, want %v", tt.torrent, got, tt.want)
+		}
+	}
+}
+
+// A magnet link parses, or doesn't, and one that parses names a torrent by
+// an info-hash of the right length, and a name that's safe to use as a path.
+func FuzzParseMagnet(f *testing.F) {
+	f.Add("magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80")
+	f.Add("magnet:?xt=urn:btih:XO3NW2MZLL3WT5TEW2MW46IU7BZVCQNT&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:51413")
+	f.Add("magnet:?xt=urn:btih:631a31dd0a46257d5078c0dee4e66e26f73e42ac&xt=urn:btmh:1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb&ws=http%3A%2F%2Fa%2F&as=http%3A%2F%2Fb%2F")
+	f.Add("magnet:?xt=urn:btmh:1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb&dn=..%2F..")
+	f.Add("magnet:?xt=urn:btih:%25s%25d%25v&dn=%00")
+	f.Fuzz(func(t *testing.T, uri string) {
+		magnet, err := parseMagnet(uri)
+		if err != nil {
+			return
+		}
+		if len(magnet.InfoHashes) == 0 && len(magnet.InfoHashesV2) == 0 {
+			t.Fatalf("%q parsed without an info-hash", uri)
+		}
+		if !strings.HasPrefix(uri, "magnet:") {
+			return
+		}
+		m, err := GetMetaInfo(nil, uri)
+		if err != nil {
+			return
+		}
+		if len(m.InfoHash) != 20 {
+			t.Fatalf("%q has an info-hash of %d bytes", uri, len(m.InfoHash))
+		}
+		if m.Info.Name == "" || sanitizeName(m.Info.Name) != m.Info.Name {
+			t.Fatalf("%q is named %q", uri, m.Info.Name)
+		}
+	})
+}
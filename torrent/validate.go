@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+)
+
+// Everything that's wrong with an InfoDict.
+type InfoDictErrors []error
+
+func (e InfoDictErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return "Invalid torrent: " + strings.Join(s, "; ")
+}
+
+// Whether name is usable as a file or directory name.
+func validPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// sanitizeName makes a name from outside the torrent, like a magnet link's
+// display name, into a valid path element. Returns "" if nothing's left.
+func sanitizeName(name string) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '/' || r == '\x00' {
+			return '_'
+		}
+		return r
+	}, name))
+	if !validPathElement(name) {
+		return ""
+	}
+	return name
+}
+
+// Validate checks that the info dictionary describes something we can
+// store: sensible names and lengths, and one piece hash per piece.
+// It returns an InfoDictErrors listing every problem found.
+// It doesn't know about v2 torrents, which have no v1 piece hashes.
+func (i *InfoDict) Validate() error {
+	var errs InfoDictErrors
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	if i.PieceLength <= 0 {
+		add("piece length %d isn't positive", i.PieceLength)
+	}
+	if len(i.Pieces)%sha1.Size != 0 {
+		add("piece hashes are %d bytes, not a multiple of %d", len(i.Pieces), sha1.Size)
+	}
+	if i.Name != "" && !validPathElement(i.Name) {
+		add("bad name %q", i.Name)
+	}
+
+	var total int64
+	if len(i.Files) == 0 {
+		if i.Name == "" {
+			add("single file torrent has no name")
+		}
+		if i.Length < 0 {
+			add("length %d is negative", i.Length)
+		}
+		total = i.Length
+	} else {
+		if i.Length != 0 {
+			add("has both a length and a list of files")
+		}
+		paths := map[string]bool{}
+		for n, f := range i.Files {
+			if f.Length < 0 {
+				add("file %d has negative length %d", n, f.Length)
+			}
+			total += f.Length
+			if len(f.Path) == 0 {
+				add("file %d has no path", n)
+				continue
+			}
+			for _, p := range f.Path {
+				if !validPathElement(p) {
+					add("file %d has bad path %q", n, f.Path)
+					break
+				}
+			}
+			p := strings.Join(f.Path, "/")
+			if paths[p] {
+				add("duplicate path %q", p)
+			}
+			paths[p] = true
+		}
+		// A file can't also be a directory.
+		for n, f := range i.Files {
+			for j := 1; j < len(f.Path); j++ {
+				if dir := strings.Join(f.Path[:j], "/"); paths[dir] {
+					add("file %d is inside file %q", n, dir)
+					break
+				}
+			}
+		}
+	}
+
+	if i.PieceLength > 0 && total >= 0 {
+		want := (total + i.PieceLength - 1) / i.PieceLength
+		if got := int64(len(i.Pieces) / sha1.Size); got != want {
+			add("%d piece hashes for %d bytes, want %d", got, total, want)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Checks that we can use a torrent we've read.
+func (m *MetaInfo) validate() error {
+	if e := m.Encoding; e != "" && e != "UTF-8" {
+		return fmt.Errorf("Unknown encoding %v", e)
+	}
+	// v2 torrents were checked when we parsed them.
+	if m.isV2Only() {
+		return nil
+	}
+	return m.Info.Validate()
+}
@@ -0,0 +1,44 @@
+package torrent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInfoDictValidate(t *testing.T) {
+	hashes := func(n int) string { return strings.Repeat("x", 20*n) }
+	good := []InfoDict{
+		{PieceLength: 10, Pieces: hashes(2), Name: "a", Length: 15},
+		{PieceLength: 10, Pieces: hashes(1), Name: "dir", Files: []FileDict{
+			{Length: 3, Path: []string{"a"}}, {Length: 0, Path: []string{"b", "c"}}, {Length: 7, Path: []string{"b", "d"}}}},
+	}
+	for _, info := range good {
+		if err := info.Validate(); err != nil {
+			t.Errorf("Validate(%+v) = %v", info, err)
+		}
+	}
+
+	bad := []struct {
+		info InfoDict
+		errs int
+	}{
+		{InfoDict{PieceLength: 0, Pieces: hashes(1), Name: "a", Length: 5}, 1},
+		{InfoDict{PieceLength: 10, Pieces: hashes(1) + "x", Name: "a", Length: 5}, 1},
+		{InfoDict{PieceLength: 10, Pieces: hashes(1), Length: 5}, 1},
+		{InfoDict{PieceLength: 10, Pieces: hashes(1), Name: "..", Length: 5}, 1},
+		{InfoDict{PieceLength: 10, Pieces: hashes(3), Name: "a", Length: 5}, 1},
+		{InfoDict{PieceLength: 10, Pieces: hashes(1), Name: "d", Files: []FileDict{
+			{Length: 1, Path: []string{"a"}}, {Length: 1, Path: []string{"a"}}}}, 1},
+		{InfoDict{PieceLength: 10, Pieces: hashes(1), Name: "d", Files: []FileDict{
+			{Length: 1, Path: []string{"a"}}, {Length: 1, Path: []string{"a", "b"}}}}, 1},
+		{InfoDict{PieceLength: 10, Pieces: hashes(1), Name: "d", Files: []FileDict{
+			{Length: -1, Path: []string{"..", "etc"}}, {Length: 1}}}, 4},
+	}
+	for _, tt := range bad {
+		err := tt.info.Validate()
+		errs, ok := err.(InfoDictErrors)
+		if !ok || len(errs) != tt.errs {
+			t.Errorf("Validate(%+v) = %v, want %d errors", tt.info, err, tt.errs)
+		}
+	}
+}
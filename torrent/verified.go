@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A seed that's been verified, by hashing every piece, leaves a marker
+// saying when, with the sizes and modification times of its files. When it
+// starts without resume data it can use, it trusts the marker instead of
+// checking its files again, as long as they're as they were, and it has as
+// many. Each piece is still hashed, but only when a peer first asks for it:
+// one that's bad is dropped then, and downloaded again.
+//
+// With -reverifyInterval, the seed verified longest ago is rechecked every
+// so often, one at a time, for those who'd rather not trust the file system.
+
+// Bumped whenever verifiedMarker changes in a way older versions can't
+// read.
+const VERIFIED_VERSION = 1
+
+type verifiedMarker struct {
+	path     string
+	Version  int
+	Verified time.Time
+	Files    []resumeFile
+}
+
+func verifiedPath(dataDir, infoHash string) string {
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return filepath.Join(dataDir, hex.EncodeToString([]byte(infoHash))+"-verified.json")
+}
+
+// Returns nil if there's no usable marker for the torrent.
+func loadVerified(dataDir, infoHash string) (v *verifiedMarker) {
+	v = &verifiedMarker{path: verifiedPath(dataDir, infoHash)}
+	data, err := ioutil.ReadFile(v.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Ignoring the verified marker:", err)
+		}
+		return nil
+	}
+	if err = json.Unmarshal(data, v); err != nil || v.Version != VERIFIED_VERSION {
+		log.Println("Ignoring the verified marker", v.path, err)
+		return nil
+	}
+	return
+}
+
+// Whether the torrent's files are as they were when it was verified.
+func (v *verifiedMarker) matches(info *InfoDict, fs FileSystem) bool {
+	current, err := statFiles(info, fs)
+	if err != nil || len(current) != len(v.Files) {
+		return false
+	}
+	for i, f := range current {
+		if f.Size != v.Files[i].Size || !f.ModTime.Equal(v.Files[i].ModTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// Trusts the marker, if the torrent has one and its files still match it,
+// taking every piece as good until it's asked for.
+func (ts *TorrentSession) trustVerified() bool {
+	if !ts.flags.QuickResume {
+		return false
+	}
+	v := loadVerified(ts.flags.DataDir, ts.M.InfoHash)
+	if v == nil {
+		return false
+	}
+	if !v.matches(ts.M.storeInfo(), ts.fileSystem) {
+		log.Println("[", ts.M.Info.Name, "] Its files have changed since it was verified")
+		return false
+	}
+	ts.pieceSet = NewBitset(ts.totalPieces)
+	for i := 0; i < ts.totalPieces; i++ {
+		ts.pieceSet.Set(i)
+	}
+	ts.goodPieces = ts.totalPieces
+	ts.unverified = NewBitsetFromBytes(ts.totalPieces, ts.pieceSet.Bytes())
+	log.Printf("[ %s ] Trusting its files, which were verified at %v\n", ts.M.Info.Name, v.Verified)
+	return true
+}
+
+// Leaves the marker, now that every piece has been hashed. Anything cached
+// is written out first, so the files are as they'll stay.
+func (ts *TorrentSession) saveVerified() {
+	if !ts.flags.QuickResume || ts.goodPieces != ts.totalPieces || ts.unverified != nil {
+		return
+	}
+	if f, ok := ts.fileStore.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			log.Println("[", ts.M.Info.Name, "] Not marking it verified, since flushing the cache failed:", err)
+			return
+		}
+	}
+	files, err := statFiles(ts.M.storeInfo(), ts.fileSystem)
+	if err != nil {
+		log.Println("[", ts.M.Info.Name, "] Can't mark it verified:", err)
+		return
+	}
+	v := &verifiedMarker{Version: VERIFIED_VERSION, Verified: time.Now(), Files: files}
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err == nil {
+		err = writeFileAtomic(verifiedPath(ts.flags.DataDir, ts.M.InfoHash), ".verified", data)
+	}
+	if err != nil {
+		log.Println("[", ts.M.Info.Name, "] Couldn't save the verified marker:", err)
+	}
+}
+
+func (ts *TorrentSession) forgetVerified() {
+	os.Remove(verifiedPath(ts.flags.DataDir, ts.M.InfoHash))
+}
+
+// Hashes a piece trusted from the marker, if it hasn't been yet, before it's
+// uploaded. If it's bad, we don't have it after all, and it isn't sent.
+func (ts *TorrentSession) verifyLazily(piece int) bool {
+	if ts.unverified == nil || !ts.unverified.IsSet(piece) {
+		return true
+	}
+	ts.unverified.Clear(piece)
+	defer func() {
+		if ts.unverified != nil && ts.unverified.Count() == 0 {
+			ts.unverified = nil
+		}
+	}()
+	good, err := checkPieceAt(ts.fileStore, ts.M, piece, ts.pieceLength(piece))
+	if good {
+		return true
+	}
+	ts.logger().Warn("Piece trusted as verified is bad", "piece", piece, "err", err)
+	ts.forgetVerified()
+	ts.setHavePiece(piece, false)
+	ts.goodPieces--
+	ts.Session.Left = ts.bytesLeft()
+	for _, p := range ts.peers {
+		if p.have != nil {
+			ts.checkInteresting(p)
+		}
+	}
+	return false
+}
+
+// Rechecks the seed verified longest ago, or never.
+func (m *sessionManager) reverify() {
+	var seeds []*TorrentSession
+	m.run(func() {
+		for _, ts := range m.sessions {
+			if ts.isComplete() {
+				seeds = append(seeds, ts)
+			}
+		}
+	})
+	var oldest *TorrentSession
+	var oldestTime time.Time
+	for _, ts := range seeds {
+		var verified time.Time
+		if v := loadVerified(m.flags.DataDir, ts.M.InfoHash); v != nil {
+			verified = v.Verified
+		}
+		if oldest == nil || verified.Before(oldestTime) {
+			oldest, oldestTime = ts, verified
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	if err := oldest.ForceRecheck(); err != nil && err != errChecking {
+		log.Println("[", oldest.M.Info.Name, "] Couldn't reverify it:", err)
+	}
+}
@@ -0,0 +1,71 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifiedMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Five pieces: 0 and 1 in a, 2 in both, 3 and 4 in b.
+	m, flags, start := writeResumeTorrent(t, dir, 40000, 30000)
+	restart := func() *TorrentSession {
+		// As if the resume data had been lost.
+		os.Remove(resumeDataPath(flags.DataDir, m.InfoHash))
+		ts, err := NewTorrentSession(flags, filepath.Join(dir, "files.torrent"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	if ts := start(); ts.goodPieces != 5 || loadVerified(flags.DataDir, m.InfoHash) == nil {
+		t.Fatalf("Checked %d pieces, and didn't mark it verified", ts.goodPieces)
+	}
+	ts := restart()
+	if ts.recheck != nil || ts.goodPieces != 5 || ts.unverified.Count() != 5 {
+		t.Fatalf("Trusting the marker, have %d pieces, check %v", ts.goodPieces, ts.recheck)
+	}
+	ts.fileStore.Close()
+
+	// A piece that's gone bad behind its back is caught when it's asked for.
+	corruptFile(t, filepath.Join(dir, "files", "a"), 0, true)
+	ts = restart()
+	if ts.goodPieces != 5 {
+		t.Fatalf("Have %d pieces", ts.goodPieces)
+	}
+	if !ts.verifyLazily(1) || !ts.verifyLazily(1) {
+		t.Error("Piece 1 is bad")
+	}
+	if ts.verifyLazily(0) {
+		t.Error("Piece 0 is good")
+	}
+	if ts.goodPieces != 4 || ts.pieceSet.IsSet(0) || ts.Session.Left != 16384 || ts.unverified.Count() != 3 {
+		t.Errorf("After piece 0 failed, have %d pieces, %d bytes left", ts.goodPieces, ts.Session.Left)
+	}
+	ts.fileStore.Close()
+	if loadVerified(flags.DataDir, m.InfoHash) != nil {
+		t.Fatal("Still marked verified")
+	}
+
+	// Once it's whole, and verified, again, a file that's gone means it's
+	// checked.
+	writeWebSeedFiles(t, filepath.Join(dir, "files"), 40000, 30000)
+	if ts = start(); ts.goodPieces != 5 || loadVerified(flags.DataDir, m.InfoHash) == nil {
+		t.Fatalf("Checked %d pieces", ts.goodPieces)
+	}
+	if err = os.Remove(filepath.Join(dir, "files", "b")); err != nil {
+		t.Fatal(err)
+	}
+	ts = restart()
+	ts.fileStore.Close()
+	if ts.recheck == nil || ts.unverified != nil {
+		t.Error("Trusted the marker with a file gone")
+	}
+}
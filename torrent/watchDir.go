@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often the watch directory is looked at. A file has to look the same
+// twice in a row, so it's picked up after one to two intervals.
+const WATCH_DIR_INTERVAL = 2 * time.Second
+
+// A dirWatcher adds the .torrent files, and .magnet files holding a magnet
+// link, that show up in a directory. It polls, rather than asking the OS, so
+// it works the same everywhere, including on network file systems.
+//
+// A file can say where the torrent's files go: a name.torrent.dir or
+// name.magnet.dir next to it, holding the directory. Write that first.
+type dirWatcher struct {
+	dir string
+	// Delete files once they're added, instead of renaming them to *.added.
+	deleteAdded bool
+	addData     func(data []byte, dir string) (infoHash string, err error)
+	addMagnet   func(link, dir string) (infoHash string, err error)
+
+	seen   map[string]watchedFile // What files looked like on the last poll
+	failed map[string]watchedFile // Files that couldn't be added, until they change
+}
+
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+func newDirWatcher(dir string, deleteAdded bool, m *sessionManager) *dirWatcher {
+	return &dirWatcher{
+		dir:         dir,
+		deleteAdded: deleteAdded,
+		addData:     m.AddTorrentFromBytesTo,
+		addMagnet:   m.AddTorrentTo,
+		seen:        make(map[string]watchedFile),
+		failed:      make(map[string]watchedFile),
+	}
+}
+
+func (w *dirWatcher) run(stop chan bool) {
+	log.Println("Watching", w.dir, "for torrents")
+	ticker := time.NewTicker(WATCH_DIR_INTERVAL)
+	defer ticker.Stop()
+	for {
+		w.scan()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Adds the files that have stopped growing since the last scan.
+func (w *dirWatcher) scan() {
+	entries, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		log.Println("Couldn't read the watch directory:", err)
+		return
+	}
+	seen := make(map[string]watchedFile)
+	for _, fi := range entries {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || strings.HasPrefix(name, ".") ||
+			!(strings.HasSuffix(name, ".torrent") || strings.HasSuffix(name, ".magnet")) {
+			continue
+		}
+		now := watchedFile{fi.Size(), fi.ModTime()}
+		if f, ok := w.failed[name]; ok {
+			if f == now {
+				continue
+			}
+			delete(w.failed, name)
+		}
+		if last, ok := w.seen[name]; !ok || last != now {
+			seen[name] = now
+			continue
+		}
+		if err := w.add(name); err != nil {
+			log.Println("Couldn't add", filepath.Join(w.dir, name)+":", err)
+			w.failed[name] = now
+		}
+	}
+	w.seen = seen
+}
+
+func (w *dirWatcher) add(name string) (err error) {
+	path := filepath.Join(w.dir, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	dir, err := sidecarDir(path + ".dir")
+	if err != nil {
+		return
+	}
+	if strings.HasSuffix(name, ".magnet") {
+		link := strings.TrimSpace(string(data))
+		if i := strings.IndexAny(link, "\r\n"); i >= 0 {
+			link = link[:i]
+		}
+		if !strings.HasPrefix(link, "magnet:") {
+			return errors.New("No magnet link in it")
+		}
+		_, err = w.addMagnet(link, dir)
+	} else {
+		_, err = w.addData(data, dir)
+	}
+	if err == errDuplicateTorrent {
+		log.Println("Skipping", path+", we already have that torrent")
+	} else if err != nil {
+		return
+	} else {
+		log.Println("Added", path)
+	}
+	if dir != "" {
+		w.moveAdded(path + ".dir")
+	}
+	return w.moveAdded(path)
+}
+
+func (w *dirWatcher) moveAdded(path string) error {
+	if w.deleteAdded {
+		return os.Remove(path)
+	}
+	return os.Rename(path, path+".added")
+}
+
+// The directory a sidecar file names, or "" if there's no sidecar.
+func sidecarDir(path string) (dir string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return
+	}
+	dir = strings.TrimSpace(string(data))
+	if i := strings.IndexAny(dir, "\r\n"); i >= 0 {
+		dir = dir[:i]
+	}
+	if dir == "" {
+		err = errors.New("No directory in " + filepath.Base(path))
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package torrent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestDirWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watchDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var added []string
+	w := &dirWatcher{
+		dir: dir,
+		addData: func(data []byte, to string) (string, error) {
+			if string(data) == "duplicate" {
+				return "", errDuplicateTorrent
+			}
+			if string(data) == "bad" {
+				return "", errors.New("Not a torrent")
+			}
+			if to != "" {
+				data = append(data, " in "+to...)
+			}
+			added = append(added, string(data))
+			return "ih", nil
+		},
+		addMagnet: func(link, to string) (string, error) {
+			added = append(added, link)
+			return "ih", nil
+		},
+		seen:   make(map[string]watchedFile),
+		failed: make(map[string]watchedFile),
+	}
+	write := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	write("growing.torrent", "grow")
+	write("link.magnet", "  magnet:?xt=urn:btih:abc\nmore\n")
+	write("empty.magnet", "no link here")
+	write("dup.torrent", "duplicate")
+	write("bad.torrent", "bad")
+	write("notes.txt", "ignored")
+	write(".hidden.torrent", "ignored")
+
+	w.scan()
+	if len(added) != 0 {
+		t.Fatalf("Added files seen once: %v", added)
+	}
+	write("growing.torrent", "growing")
+	w.scan()
+	sort.Strings(added)
+	if len(added) != 1 || added[0] != "magnet:?xt=urn:btih:abc" {
+		t.Fatalf("Added %v", added)
+	}
+	if exists("link.magnet") || !exists("link.magnet.added") {
+		t.Error("The magnet file wasn't renamed")
+	}
+	if exists("dup.torrent") || !exists("dup.torrent.added") {
+		t.Error("The duplicate wasn't renamed")
+	}
+	if !exists("empty.magnet") || !exists("bad.torrent") {
+		t.Error("Files that couldn't be added were moved")
+	}
+
+	added = nil
+	w.scan()
+	if len(added) != 1 || added[0] != "growing" || !exists("growing.torrent.added") {
+		t.Fatalf("Once it stopped growing, added %v", added)
+	}
+	// Failed files aren't retried until they change.
+	added = nil
+	w.scan()
+	write("empty.magnet", "magnet:?xt=urn:btih:def")
+	w.scan()
+	w.scan()
+	if len(added) != 1 || added[0] != "magnet:?xt=urn:btih:def" {
+		t.Errorf("After fixing the magnet file, added %v", added)
+	}
+
+	w.deleteAdded = true
+	write("delete.torrent", "delete")
+	w.scan()
+	w.scan()
+	if exists("delete.torrent") || exists("delete.torrent.added") {
+		t.Error("The added file wasn't deleted")
+	}
+
+	// A sidecar says where its files go, and goes with it.
+	added = nil
+	write("elsewhere.torrent.dir", "/media/films\n")
+	write("elsewhere.torrent", "elsewhere")
+	w.scan()
+	w.scan()
+	if len(added) != 1 || added[0] != "elsewhere in /media/films" {
+		t.Errorf("With a sidecar, added %v", added)
+	}
+	if exists("elsewhere.torrent.dir") {
+		t.Error("The sidecar wasn't deleted")
+	}
+}
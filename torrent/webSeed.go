@@ -0,0 +1,121 @@
+package torrent
+
+import (
+	"log"
+	"net/url"
+	"strings"
+)
+
+// Web seeds (BEP 19): HTTP or FTP servers that have the torrent's files.
+
+// A WebSeed is a web seed URL resolved against the torrent's files.
+type WebSeed struct {
+	URL   string // As given in the url-list or magnet link
+	Files []WebSeedFile
+}
+
+// A WebSeedFile is where a web seed serves one file of the torrent.
+type WebSeedFile struct {
+	URL    string // Empty for BEP 47 padding files, which are all zeros
+	Offset int64  // Where the file starts in the torrent's data
+	Length int64
+}
+
+// Reads the url-list, which may be a single URL or a list of them. Entries
+// that aren't usable URLs are skipped.
+func getWebSeeds(m map[string]interface{}, k string) (urls []string) {
+	var values []interface{}
+	switch v := m[k].(type) {
+	case nil:
+		return
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	default:
+		log.Printf("Ignoring %s of unexpected type %T", k, v)
+		return
+	}
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			log.Printf("Ignoring %s entry of unexpected type %T", k, v)
+			continue
+		}
+		if s == "" {
+			// Some tools write an empty url-list.
+			continue
+		}
+		if !validWebSeed(s) {
+			log.Printf("Ignoring %s entry %q", k, s)
+			continue
+		}
+		urls = appendUnique(urls, s)
+	}
+	return
+}
+
+func validWebSeed(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "ftp":
+		return true
+	}
+	return false
+}
+
+// ResolveWebSeeds works out where each web seed serves each of the torrent's
+// files. A URL ending in "/" is a directory holding the torrent; the torrent
+// name and file path are added to it. Otherwise a single file torrent's URL
+// is the file itself, and a multi-file torrent's is the directory.
+// Returns nil until the torrent's files are known.
+func (m *MetaInfo) ResolveWebSeeds() (seeds []WebSeed) {
+	info := m.storeInfo()
+	if info.Name == "" || (info.Length == 0 && len(info.Files) == 0) {
+		return
+	}
+	for _, u := range m.WebSeeds {
+		if seed, ok := m.resolveWebSeed(u); ok {
+			seeds = append(seeds, seed)
+		}
+	}
+	return
+}
+
+// resolveWebSeed works out where one web seed URL serves the torrent's
+// files, which must be known.
+func (m *MetaInfo) resolveWebSeed(u string) (seed WebSeed, ok bool) {
+	if !validWebSeed(u) {
+		return
+	}
+	info := m.storeInfo()
+	name := url.PathEscape(info.Name)
+	seed = WebSeed{URL: u}
+	if len(info.Files) == 0 {
+		if strings.HasSuffix(u, "/") {
+			u += name
+		}
+		seed.Files = []WebSeedFile{{URL: u, Length: info.Length}}
+		return seed, true
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	var offset int64
+	for _, f := range info.Files {
+		file := WebSeedFile{Offset: offset, Length: f.Length}
+		if f.Attr != "p" {
+			path := make([]string, len(f.Path))
+			for i, p := range f.Path {
+				path[i] = url.PathEscape(p)
+			}
+			file.URL = u + name + "/" + strings.Join(path, "/")
+		}
+		seed.Files = append(seed.Files, file)
+		offset += f.Length
+	}
+	return seed, true
+}
@@ -0,0 +1,528 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Downloading pieces from web seeds. Each web seed fetches one run of
+// consecutive pieces at a time in its own goroutine, streaming the pieces
+// back as they arrive; the torrent's main loop hands out the runs and deals
+// with the pieces, so the web seeds never touch the session's state.
+
+const (
+	WEB_SEED_TIMEOUT        = 60 * time.Second
+	WEB_SEED_RETRY          = 30 * time.Second // How long to wait after a failure, doubled for each one in a row
+	WEB_SEED_MAX_RETRY      = 30 * time.Minute
+	WEB_SEED_MAX_BAD_PIECES = 3       // Pieces that fail the hash check before we drop a URL as corrupt
+	WEB_SEED_RUN_LENGTH     = 4 << 20 // How much to ask a web seed for at once
+)
+
+// A webSeedProtocol knows how to ask one kind of web seed for pieces.
+type webSeedProtocol interface {
+	// webSeedParts says how to fetch the data of the given consecutive
+	// pieces, one part after the other.
+	webSeedParts(pieces []webSeedPiece) []webSeedPart
+}
+
+type webSeedPiece struct {
+	index  int
+	length int
+}
+
+// A webSeedPart is some of the data of a run of pieces, usually one HTTP
+// request's worth.
+type webSeedPart struct {
+	url    string
+	length int64
+	open   func(ctx context.Context, client *http.Client) (io.ReadCloser, error) // nil means zeros
+}
+
+// webSeedStream reads the parts of a run one after the other, opening each
+// as it's needed.
+type webSeedStream struct {
+	ctx    context.Context
+	client *http.Client
+	parts  []webSeedPart
+	part   webSeedPart
+	body   io.ReadCloser
+	left   int64       // Of the current part
+	stall  *time.Timer // Reset whenever data arrives
+}
+
+func (s *webSeedStream) Read(b []byte) (n int, err error) {
+	for s.left == 0 {
+		if err = s.endPart(); err != nil {
+			return
+		}
+		if len(s.parts) == 0 {
+			return 0, io.EOF
+		}
+		s.part, s.parts = s.parts[0], s.parts[1:]
+		s.left = s.part.length
+		if s.part.open != nil {
+			if s.body, err = s.part.open(s.ctx, s.client); err != nil {
+				return
+			}
+		}
+	}
+	if int64(len(b)) > s.left {
+		b = b[:s.left]
+	}
+	if s.body == nil {
+		for i := range b {
+			b[i] = 0
+		}
+		n = len(b)
+	} else {
+		n, err = s.body.Read(b)
+	}
+	s.left -= int64(n)
+	if n > 0 && s.stall != nil {
+		s.stall.Reset(WEB_SEED_TIMEOUT)
+	}
+	if err == io.EOF {
+		err = nil
+		if s.left > 0 {
+			err = fmt.Errorf("Web seed sent too little of %s", s.part.url)
+		}
+	}
+	return
+}
+
+// Finishes with the current part, which should have no more data.
+func (s *webSeedStream) endPart() (err error) {
+	if s.body == nil {
+		return
+	}
+	if n, _ := s.body.Read(make([]byte, 1)); n != 0 {
+		err = fmt.Errorf("Web seed sent too much of %s", s.part.url)
+	}
+	s.body.Close()
+	s.body = nil
+	return
+}
+
+func (s *webSeedStream) Close() error {
+	if s.body != nil {
+		return s.body.Close()
+	}
+	return nil
+}
+
+// A webSeedBusyError says the server wants us to come back later.
+type webSeedBusyError struct {
+	retryAfter time.Duration
+}
+
+func (e *webSeedBusyError) Error() string {
+	return fmt.Sprintf("Web seed is busy, retry in %v", e.retryAfter)
+}
+
+// A webSeedStatusError is an HTTP response we didn't expect.
+type webSeedStatusError struct {
+	url    string
+	status int
+}
+
+func (e *webSeedStatusError) Error() string {
+	return fmt.Sprintf("Web seed says %d %s for %s", e.status, http.StatusText(e.status), e.url)
+}
+
+// WebSeedHealth is how well a web seed URL has been serving us.
+type WebSeedHealth struct {
+	URL        string
+	Requests   int
+	Failures   int
+	BadPieces  int           // Pieces that failed the hash check
+	Downloaded int64         // Good bytes
+	Elapsed    time.Duration // Time spent fetching them
+	Disabled   string        // Why we stopped using it, or ""
+}
+
+// Rate is the download rate in bytes per second, while fetching.
+func (h *WebSeedHealth) Rate() float64 {
+	if h.Elapsed <= 0 {
+		return 0
+	}
+	return float64(h.Downloaded) / h.Elapsed.Seconds()
+}
+
+func (h WebSeedHealth) String() string {
+	s := fmt.Sprintf("%s: %d bytes (%s/s), %d of %d requests failed, %d bad pieces",
+		h.URL, h.Downloaded, humanSize(h.Rate()), h.Failures, h.Requests, h.BadPieces)
+	if h.Disabled != "" {
+		s += ", disabled: " + h.Disabled
+	}
+	return s
+}
+
+// A web seed URL and what we know about it.
+type webSeed struct {
+	url      string
+	protocol webSeedProtocol
+	fetch    *webSeedFetch // What it's fetching, if anything
+	failures int           // Failures in a row
+	retryAt  time.Time     // Don't use before this
+	health   WebSeedHealth
+}
+
+// How much we'd like to use the web seed. Ones we haven't tried yet come
+// first, so that we find out how fast they are.
+func (ws *webSeed) score() float64 {
+	h := &ws.health
+	if h.Requests == 0 {
+		return math.Inf(1)
+	}
+	return h.Rate() * float64(h.Requests-h.Failures) / float64(h.Requests)
+}
+
+// A webSeedFetch is a run of pieces a web seed is fetching.
+type webSeedFetch struct {
+	seed   *webSeed
+	pieces []webSeedPiece
+	active []*ActivePiece // The session's claims on the pieces
+	next   int            // The pieces before this have arrived
+	cancel context.CancelFunc
+	limit  *rateLimiter // The download rate limit, or nil
+	flow   *rateFlow    // The torrent's share of it
+}
+
+// A piece from a web seed, or with piece -1, the end of the fetch.
+type webSeedResult struct {
+	fetch   *webSeedFetch
+	piece   int // Index into fetch.pieces
+	data    []byte
+	err     error
+	elapsed time.Duration
+}
+
+func (f *webSeedFetch) run(ctx context.Context, client *http.Client, results chan<- webSeedResult) {
+	// Give up if the data stops coming.
+	streamCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	stream := &webSeedStream{ctx: streamCtx, client: client, parts: f.seed.protocol.webSeedParts(f.pieces)}
+	stream.stall = time.AfterFunc(WEB_SEED_TIMEOUT, stop)
+	defer stream.stall.Stop()
+	defer stream.Close()
+	var err error
+	start := time.Now()
+	for i, p := range f.pieces {
+		data := make([]byte, p.length)
+		if _, err = io.ReadFull(stream, data); err != nil {
+			if streamCtx.Err() != nil && ctx.Err() == nil {
+				err = fmt.Errorf("Web seed %s stalled", f.seed.url)
+			}
+			break
+		}
+		elapsed := time.Since(start)
+		// Waiting for the rate limit isn't the server stalling.
+		stream.stall.Stop()
+		f.limit.wait(len(data), f.flow)
+		stream.stall.Reset(WEB_SEED_TIMEOUT)
+		select {
+		case results <- webSeedResult{f, i, data, nil, elapsed}:
+		case <-ctx.Done():
+			return
+		}
+		start = time.Now()
+	}
+	select {
+	case results <- webSeedResult{fetch: f, piece: -1, err: err}:
+	case <-ctx.Done():
+	}
+}
+
+// addWebSeed adds a web seed to the ones the session downloads from,
+// unless it already has it.
+func (ts *TorrentSession) addWebSeed(url string, protocol webSeedProtocol) {
+	for _, ws := range ts.webSeedPool {
+		if ws.url == url {
+			return
+		}
+	}
+	ts.webSeedPool = append(ts.webSeedPool, &webSeed{url: url, protocol: protocol, health: WebSeedHealth{URL: url}})
+	ts.logger().Info("Web seed", "url", url)
+}
+
+// scheduleWebSeeds gives a run of pieces to each web seed that's ready for
+// one, the best scoring first. Web seeds only take pieces no peer is working
+// on; peers leave the pieces web seeds are working on alone, until the end
+// game.
+func (ts *TorrentSession) scheduleWebSeeds() {
+	if !ts.Session.HaveTorrent || ts.goodPieces == ts.totalPieces || ts.Paused() {
+		return
+	}
+	now := time.Now()
+	var ready []*webSeed
+	for _, ws := range ts.webSeedPool {
+		if ws.fetch == nil && ws.health.Disabled == "" && !now.Before(ws.retryAt) {
+			ready = append(ready, ws)
+		}
+	}
+	sort.SliceStable(ready, func(i, j int) bool { return ready[i].score() > ready[j].score() })
+	for _, ws := range ready {
+		pieces := ts.chooseWebSeedRun(WEB_SEED_RUN_LENGTH)
+		if len(pieces) == 0 {
+			return
+		}
+		f := &webSeedFetch{seed: ws}
+		if ts.bandwidth != nil {
+			f.limit, f.flow = &ts.bandwidth.down, &ts.bandwidthClass.down
+		}
+		for _, p := range pieces {
+			v := ts.startPiece(p.index, ts.blockSize, len(ts.activePieces) == 0)
+			if v == nil {
+				// The run stops at the memory budget.
+				break
+			}
+			for i := range v.downloaderCount {
+				v.downloaderCount[i] = 1
+			}
+			ts.activePieces[p.index] = v
+			f.pieces = append(f.pieces, p)
+			f.active = append(f.active, v)
+		}
+		if len(f.pieces) == 0 {
+			return
+		}
+		var ctx context.Context
+		ctx, f.cancel = context.WithCancel(ts.ctx)
+		ws.fetch = f
+		ws.health.Requests++
+		go f.run(ctx, ts.webSeedClient, ts.webSeedResults)
+	}
+}
+
+// Picks a run of consecutive pieces that we don't have and nobody is
+// downloading, no longer than maxLength unless it's a single piece. The run
+// starts at the beginning of a gap, so web seeds read sequentially.
+func (ts *TorrentSession) chooseWebSeedRun(maxLength int64) (pieces []webSeedPiece) {
+	start := ts.chooseWebSeedPiece()
+	if start < 0 {
+		return
+	}
+	for start > 0 && ts.webSeedCanTake(start-1) {
+		start--
+	}
+	var length int64
+	for piece := start; piece < ts.totalPieces && ts.webSeedCanTake(piece); piece++ {
+		pieceLength := ts.pieceLength(piece)
+		if len(pieces) > 0 && length+int64(pieceLength) > maxLength {
+			break
+		}
+		pieces = append(pieces, webSeedPiece{piece, pieceLength})
+		length += int64(pieceLength)
+	}
+	return
+}
+
+// Picks a piece we don't have that nobody is downloading, or -1.
+func (ts *TorrentSession) chooseWebSeedPiece() int {
+	n := ts.totalPieces
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		if piece := (start + i) % n; ts.webSeedCanTake(piece) {
+			return piece
+		}
+	}
+	return -1
+}
+
+func (ts *TorrentSession) webSeedCanTake(piece int) bool {
+	_, active := ts.activePieces[piece]
+	return !active && !ts.pieceSet.IsSet(piece)
+}
+
+func (ts *TorrentSession) doWebSeedResult(r webSeedResult) {
+	f := r.fetch
+	ws := f.seed
+	if ws.fetch != f {
+		// We stopped it.
+		return
+	}
+	if r.piece < 0 {
+		ts.endWebSeedFetch(f)
+		if r.err != nil {
+			ts.webSeedFailed(ws, r.err)
+		}
+		return
+	}
+	f.next = r.piece + 1
+	p, v := f.pieces[r.piece], f.active[r.piece]
+	if ts.activePieces[p.index] != v || v.isComplete() {
+		// Peers got it first.
+		return
+	}
+	if err := v.write(p.index, 0, r.data); err != nil {
+		ts.logger().Error("Couldn't write piece", "piece", p.index, "err", err)
+		ts.emit(Event{Type: EVENT_ERROR, Piece: p.index, Err: err})
+		var beyond *ErrWriteBeyondStore
+		if !errors.As(err, &beyond) {
+			ts.storageFailed(p.index, err)
+		}
+		// Its blocks are left to peers.
+		for block := range v.downloaderCount {
+			if v.downloaderCount[block] > 0 {
+				v.downloaderCount[block]--
+			}
+		}
+		return
+	}
+	for block := range v.downloaderCount {
+		if v.recordBlock(block) > 1 {
+			ts.cancelBlockRequests(p.index, block)
+		}
+	}
+	ts.Session.Downloaded += uint64(p.length)
+	ts.Session.WebSeedDownloaded += uint64(p.length)
+	ts.webSeedReceived.Add(int64(p.length))
+	ts.hashPiece(p.index, v, func(good bool, err error) {
+		ts.webSeedPieceHashed(f, p, r.elapsed, good, err)
+	})
+}
+
+// Judges the web seed by a piece it sent, once it's been hashed. The fetch
+// may have ended by then.
+func (ts *TorrentSession) webSeedPieceHashed(f *webSeedFetch, p webSeedPiece, elapsed time.Duration, good bool, err error) {
+	ws := f.seed
+	if (!good || err != nil) && ws.fetch == f {
+		ts.endWebSeedFetch(f)
+	}
+	if !good {
+		ws.health.BadPieces++
+		if ws.health.BadPieces >= WEB_SEED_MAX_BAD_PIECES {
+			ts.disableWebSeed(ws, fmt.Sprintf("%d pieces failed the hash check", ws.health.BadPieces))
+			return
+		}
+		ts.webSeedFailed(ws, fmt.Errorf("Piece %d failed the hash check", p.index))
+		return
+	}
+	if err != nil {
+		ts.webSeedFailed(ws, err)
+		return
+	}
+	ws.health.Downloaded += int64(p.length)
+	ws.health.Elapsed += elapsed
+	ws.failures = 0
+}
+
+// Stops a fetch, giving up its claims on the pieces that haven't arrived.
+func (ts *TorrentSession) endWebSeedFetch(f *webSeedFetch) {
+	f.cancel()
+	f.seed.fetch = nil
+	for i := f.next; i < len(f.pieces); i++ {
+		ts.releaseWebSeedPiece(f.pieces[i].index, f.active[i])
+	}
+	f.next = len(f.pieces)
+}
+
+// Stops the fetches whose remaining pieces peers have all brought us.
+func (ts *TorrentSession) stopRedundantWebSeedFetches() {
+	for _, ws := range ts.webSeedPool {
+		f := ws.fetch
+		if f == nil {
+			continue
+		}
+		redundant := true
+		for _, p := range f.pieces[f.next:] {
+			redundant = redundant && ts.pieceSet.IsSet(p.index)
+		}
+		if redundant {
+			ts.endWebSeedFetch(f)
+		}
+	}
+}
+
+// Whether we've given up on all the web seeds.
+func (ts *TorrentSession) webSeedsDisabled() bool {
+	for _, ws := range ts.webSeedPool {
+		if ws.health.Disabled == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Stops all the web seeds' fetches.
+func (ts *TorrentSession) stopWebSeeds() {
+	for _, ws := range ts.webSeedPool {
+		if ws.fetch != nil {
+			ts.endWebSeedFetch(ws.fetch)
+		}
+	}
+}
+
+// webSeedFailed backs off from a web seed after an error, or drops it if
+// retrying won't help.
+func (ts *TorrentSession) webSeedFailed(ws *webSeed, err error) {
+	ws.failures++
+	ws.health.Failures++
+	switch e := err.(type) {
+	case *webSeedRangeError:
+		ts.disableWebSeed(ws, err.Error())
+		return
+	case *webSeedStatusError:
+		if e.status == http.StatusNotFound || e.status == http.StatusGone {
+			ts.disableWebSeed(ws, err.Error())
+			return
+		}
+	}
+	retry := WEB_SEED_RETRY << uint(min(ws.failures-1, 10))
+	if retry > WEB_SEED_MAX_RETRY {
+		retry = WEB_SEED_MAX_RETRY
+	}
+	if busy, ok := err.(*webSeedBusyError); ok && busy.retryAfter > retry {
+		retry = busy.retryAfter
+	}
+	ws.retryAt = time.Now().Add(retry)
+	ts.logger().Warn("Web seed failed", "url", ws.url, "err", err, "retry", retry)
+}
+
+func (ts *TorrentSession) disableWebSeed(ws *webSeed, reason string) {
+	ws.health.Disabled = reason
+	ts.logger().Warn("Giving up on web seed", "url", ws.url, "reason", reason)
+}
+
+// The health of the session's web seeds.
+func (ts *TorrentSession) webSeedHealth() (health []WebSeedHealth) {
+	for _, ws := range ts.webSeedPool {
+		health = append(health, ws.health)
+	}
+	return
+}
+
+// Gives up a web seed's claim on a piece, so that others can download it.
+func (ts *TorrentSession) releaseWebSeedPiece(piece int, v *ActivePiece) {
+	if ts.activePieces[piece] != v {
+		return
+	}
+	idle := true
+	for i, count := range v.downloaderCount {
+		if count > 0 {
+			v.downloaderCount[i]--
+		}
+		idle = idle && v.downloaderCount[i] == 0
+	}
+	if idle {
+		delete(ts.activePieces, piece)
+		v.release()
+	}
+}
+
+// Cancels the requests peers have for a block we now have.
+func (ts *TorrentSession) cancelBlockRequests(piece, block int) {
+	requestIndex := (uint64(piece) << 32) | uint64(block*ts.activePieces[piece].blockSize)
+	for _, peer := range ts.peers {
+		if _, ok := peer.our_requests[requestIndex]; ok {
+			ts.requestBlockImp(peer, piece, block, false)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSeedFailed(t *testing.T) {
+	ts := &TorrentSession{M: &MetaInfo{}}
+	ws := &webSeed{url: "http://mirror/"}
+	// Errors that might go away back off, more each time.
+	for i, want := range []time.Duration{WEB_SEED_RETRY, 2 * WEB_SEED_RETRY, 4 * WEB_SEED_RETRY} {
+		ts.webSeedFailed(ws, &webSeedStatusError{ws.url, http.StatusBadGateway})
+		if wait := time.Until(ws.retryAt); wait > want || wait < want-time.Second || ws.health.Disabled != "" {
+			t.Errorf("Failure %d: waiting %v, want %v", i+1, wait, want)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		ts.webSeedFailed(ws, errors.New("timeout"))
+	}
+	if wait := time.Until(ws.retryAt); wait > WEB_SEED_MAX_RETRY || ws.health.Disabled != "" || ws.health.Failures != 23 {
+		t.Errorf("Waiting %v after %d failures", wait, ws.health.Failures)
+	}
+	// A busy server can ask for longer.
+	ws = &webSeed{url: "http://mirror/"}
+	ts.webSeedFailed(ws, &webSeedBusyError{time.Hour})
+	if wait := time.Until(ws.retryAt); wait < time.Hour-time.Second {
+		t.Errorf("Waiting %v for a busy server, want an hour", wait)
+	}
+
+	for _, err := range []error{&webSeedStatusError{ws.url, http.StatusNotFound}, &webSeedRangeError{ws.url}} {
+		ws = &webSeed{url: "http://mirror/"}
+		ts.webSeedFailed(ws, err)
+		if ws.health.Disabled == "" {
+			t.Errorf("%v didn't disable the web seed", err)
+		}
+	}
+}
+
+func TestWebSeedScore(t *testing.T) {
+	untried := &webSeed{}
+	fast := &webSeed{health: WebSeedHealth{Requests: 10, Downloaded: 1000, Elapsed: time.Second}}
+	flaky := &webSeed{health: WebSeedHealth{Requests: 10, Failures: 5, Downloaded: 1000, Elapsed: time.Second}}
+	slow := &webSeed{health: WebSeedHealth{Requests: 10, Downloaded: 100, Elapsed: time.Second}}
+	for i, ws := range []*webSeed{untried, fast, flaky, slow} {
+		if i > 0 && ws.score() >= []*webSeed{untried, fast, flaky, slow}[i-1].score() {
+			t.Errorf("Seed %d scores %v, no lower than the one before", i, ws.score())
+		}
+	}
+	if r := fast.health.Rate(); r != 1000 {
+		t.Errorf("Rate = %v, want 1000", r)
+	}
+}
+
+func TestWebSeedCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 5*16384)
+	rand.New(rand.NewSource(3)).Read(content)
+	if err = ioutil.WriteFile(filepath.Join(dir, "content"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateTorrent(filepath.Join(dir, "content"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "content.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := &TorrentFlags{FileDir: filepath.Join(dir, "leech"), FileSystemProvider: OsFsProvider{}, InitialCheck: true, MemoryPerTorrent: -1, TrackerlessMode: true}
+	ts, err := NewTorrentSession(flags, torrentFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.fileStore.Close()
+
+	ws := &webSeed{url: "http://corrupt/", health: WebSeedHealth{URL: "http://corrupt/"}}
+	ts.webSeedPool = []*webSeed{ws}
+	// Has the web seed fetch a piece, and send data for it.
+	arrive := func(piece int, data []byte) {
+		v := &ActivePiece{downloaderCount: []int{1}, buffer: make([]byte, 16384), length: 16384}
+		ts.activePieces[piece] = v
+		f := &webSeedFetch{seed: ws, pieces: []webSeedPiece{{piece, 16384}}, active: []*ActivePiece{v}, cancel: func() {}}
+		ws.fetch = f
+		ws.health.Requests++
+		ts.doWebSeedResult(webSeedResult{f, 0, data, nil, time.Second})
+		ts.doWebSeedResult(webSeedResult{fetch: f, piece: -1})
+		// The hash comes back after the fetch has ended.
+		hashQueued(ts)
+	}
+	for piece := 0; piece < WEB_SEED_MAX_BAD_PIECES; piece++ {
+		arrive(piece, make([]byte, 16384))
+		// Good data from it is still welcome until it's dropped.
+		if piece == 0 {
+			arrive(4, content[4*16384:])
+		}
+	}
+	if ws.health.Disabled == "" || ws.health.BadPieces != WEB_SEED_MAX_BAD_PIECES || ws.health.Requests != WEB_SEED_MAX_BAD_PIECES+1 {
+		t.Errorf("Health after %d bad pieces: %v", WEB_SEED_MAX_BAD_PIECES, ws.health)
+	}
+	if ts.goodPieces != 1 || ws.health.Downloaded != 16384 {
+		t.Errorf("Have %d pieces, %d bytes from the web seed, want 1 good piece", ts.goodPieces, ws.health.Downloaded)
+	}
+}
+
+// Fetches pieces from a web seed all at once.
+func fetchPieces(protocol webSeedProtocol, pieces []webSeedPiece) ([]byte, error) {
+	s := &webSeedStream{ctx: context.Background(), client: http.DefaultClient, parts: protocol.webSeedParts(pieces)}
+	defer s.Close()
+	return ioutil.ReadAll(s)
+}
+
+// A session with ten 100 byte pieces, the last one short.
+func webSeedTestSession() *TorrentSession {
+	return &TorrentSession{
+		M:               &MetaInfo{Info: InfoDict{Name: "t", PieceLength: 100}},
+		activePieces:    make(map[int]*ActivePiece),
+		pieceSet:        NewBitset(10),
+		totalPieces:     10,
+		lastPieceLength: 50,
+	}
+}
+
+func TestChooseWebSeedRun(t *testing.T) {
+	ts := webSeedTestSession()
+	for _, piece := range []int{0, 1, 2, 6} {
+		ts.pieceSet.Set(piece)
+	}
+	for i := 0; i < 20; i++ {
+		// The whole of one of the gaps.
+		pieces := ts.chooseWebSeedRun(1000)
+		if !reflect.DeepEqual(pieces, []webSeedPiece{{3, 100}, {4, 100}, {5, 100}}) &&
+			!reflect.DeepEqual(pieces, []webSeedPiece{{7, 100}, {8, 100}, {9, 50}}) {
+			t.Fatalf("Run of %v", pieces)
+		}
+		// No more than asked for, but at least a piece.
+		if pieces = ts.chooseWebSeedRun(150); len(pieces) != 1 || (pieces[0].index != 3 && pieces[0].index != 7) {
+			t.Fatalf("Short run of %v", pieces)
+		}
+	}
+	ts.activePieces[3] = &ActivePiece{}
+	ts.activePieces[8] = &ActivePiece{}
+	for i := 0; i < 20; i++ {
+		pieces := ts.chooseWebSeedRun(1000)
+		if !reflect.DeepEqual(pieces, []webSeedPiece{{4, 100}, {5, 100}}) &&
+			!reflect.DeepEqual(pieces, []webSeedPiece{{7, 100}}) &&
+			!reflect.DeepEqual(pieces, []webSeedPiece{{9, 50}}) {
+			t.Fatalf("Run of %v around active pieces", pieces)
+		}
+	}
+}
+
+func TestStopRedundantWebSeedFetches(t *testing.T) {
+	ts := webSeedTestSession()
+	ws := &webSeed{url: "http://mirror/"}
+	ts.webSeedPool = []*webSeed{ws}
+	cancelled := false
+	f := &webSeedFetch{seed: ws, pieces: []webSeedPiece{{3, 100}, {4, 100}, {5, 100}}, next: 1, cancel: func() { cancelled = true }}
+	for _, p := range f.pieces {
+		v := &ActivePiece{downloaderCount: []int{1}, buffer: make([]byte, 100), length: 100}
+		ts.activePieces[p.index] = v
+		f.active = append(f.active, v)
+	}
+	ws.fetch = f
+
+	// Peers brought us some of the pieces it's still fetching.
+	ts.pieceSet.Set(4)
+	delete(ts.activePieces, 4)
+	ts.stopRedundantWebSeedFetches()
+	if cancelled || ws.fetch != f {
+		t.Fatal("Stopped a fetch that still has pieces we need")
+	}
+	// And then the rest.
+	ts.pieceSet.Set(5)
+	ts.stopRedundantWebSeedFetches()
+	if !cancelled || ws.fetch != nil {
+		t.Fatal("Didn't stop a fetch whose pieces we have")
+	}
+	if _, ok := ts.activePieces[5]; ok {
+		t.Error("Web seed still has a claim on piece 5")
+	}
+	if ts.activePieces[3] != f.active[0] {
+		t.Error("Dropped the piece that arrived")
+	}
+	// Anything it sends now is ignored.
+	ts.doWebSeedResult(webSeedResult{f, 2, make([]byte, 100), nil, time.Second})
+	if ws.health.Downloaded != 0 || ts.Session.Downloaded != 0 {
+		t.Error("Used data from a stopped fetch")
+	}
+}
+
+func TestWebSeedOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webseedonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "served")
+	content := writeWebSeedFiles(t, filepath.Join(seedDir, "files"), 40000, 30000)
+	m, err := CreateTorrent(filepath.Join(seedDir, "files"), &CreateOptions{PieceLength: 16384, Announce: "http://127.0.0.1:1/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTorrent := func(name string) string {
+		p := filepath.Join(dir, name)
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err = m.Bencode(f); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	flags := &TorrentFlags{
+		FileDir:            filepath.Join(dir, "leech"),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          math.Inf(0),
+		UseDHT:             true,
+		WebSeedOnly:        true,
+	}
+
+	// Without web seeds, there's nothing to download from.
+	if _, err = NewTorrentSession(flags, writeTorrent("none.torrent"), 0); err == nil {
+		t.Error("Started a web seed only session without web seeds")
+	}
+	if _, err = NewTorrentSession(flags, "magnet:?xt=urn:btih:"+strings.Repeat("ab", 20), 0); err == nil {
+		t.Error("Started a web seed only session for a magnet link")
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(seedDir)))
+	defer server.Close()
+	m.WebSeeds = []string{server.URL}
+	torrentFile := writeTorrent("files.torrent")
+	done := make(chan error)
+	go func() { done <- RunTorrents(flags, []string{torrentFile}) }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for the web seed only download")
+	}
+	var got []byte
+	for _, name := range []string{"a", "b"} {
+		b, err := ioutil.ReadFile(filepath.Join(flags.FileDir, "files", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Downloaded %d bytes that don't match the %d bytes served", len(got), len(content))
+	}
+}
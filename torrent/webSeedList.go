@@ -0,0 +1,205 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Web seeds added to and removed from a running torrent. The changes are
+// saved in the data directory, so they outlast restarts.
+
+// The web seed URLs the user added to a torrent, and the ones of the
+// torrent's own they removed.
+type webSeedState struct {
+	path    string
+	Added   []string
+	Removed []string
+}
+
+func loadWebSeedState(dataDir, infoHash string) (s *webSeedState) {
+	if dataDir == "" {
+		dataDir = "."
+	}
+	s = &webSeedState{path: filepath.Join(dataDir, hex.EncodeToString([]byte(infoHash))+"-webseeds.json")}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Ignoring saved web seeds:", err)
+		}
+		return
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		log.Println("Ignoring corrupt saved web seeds", s.path, err)
+		s.Added, s.Removed = nil, nil
+	}
+	return
+}
+
+func (s *webSeedState) save() (err error) {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(s.path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".webseeds")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+func (s *webSeedState) removed(u string) bool {
+	return contains(s.Removed, u)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func without(list []string, s string) (out []string) {
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return
+}
+
+// Whether u is one of the torrent's own web seeds.
+func (ts *TorrentSession) torrentHasWebSeed(u string) bool {
+	return contains(ts.M.WebSeeds, u) || contains(ts.M.HTTPSeeds, u)
+}
+
+// startWebSeeds adds the torrent's web seeds and the ones the user added,
+// less the ones they removed, to those the session downloads from.
+func (ts *TorrentSession) startWebSeeds() {
+	state := ts.webSeedState
+	for _, u := range append(append([]string{}, ts.M.WebSeeds...), state.Added...) {
+		if !state.removed(u) {
+			if err := ts.addGetRightSeed(u); err != nil {
+				log.Println("[", ts.M.Info.Name, "] Ignoring web seed", u, "because", err)
+			}
+		}
+	}
+	for _, u := range ts.M.HTTPSeeds {
+		if !state.removed(u) {
+			ts.addWebSeed(u, &httpSeed{u, ts.M.InfoHash})
+		}
+	}
+}
+
+// Adds a BEP 19 web seed. The torrent's files must be known.
+func (ts *TorrentSession) addGetRightSeed(u string) (err error) {
+	seed, ok := ts.M.resolveWebSeed(u)
+	if !ok {
+		return fmt.Errorf("Not a web seed URL: %q", u)
+	}
+	if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") {
+		return fmt.Errorf("Web seed %s isn't HTTP", u)
+	}
+	ts.addWebSeed(u, &getRightSeed{seed, ts.M.Info.PieceLength})
+	return
+}
+
+func (ts *TorrentSession) findWebSeed(u string) (i int) {
+	for i, ws := range ts.webSeedPool {
+		if ws.url == u {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddWebSeed adds a BEP 19 web seed URL to the torrent, and starts
+// downloading from it if the torrent needs anything. A URL the session
+// already has starts over, forgetting how it did before.
+func (ts *TorrentSession) AddWebSeed(u string) (err error) {
+	if !validWebSeed(u) {
+		return fmt.Errorf("Not a web seed URL: %q", u)
+	}
+	if e := ts.runInLoop(func() { err = ts.addUserWebSeed(u) }); e != nil {
+		return e
+	}
+	return
+}
+
+func (ts *TorrentSession) addUserWebSeed(u string) (err error) {
+	state := ts.webSeedState
+	state.Removed = without(state.Removed, u)
+	if !ts.torrentHasWebSeed(u) && !contains(state.Added, u) {
+		state.Added = append(state.Added, u)
+	}
+	if ts.Session.HaveTorrent {
+		if i := ts.findWebSeed(u); i >= 0 {
+			ws := ts.webSeedPool[i]
+			ws.failures, ws.retryAt, ws.health = 0, time.Time{}, WebSeedHealth{URL: u}
+		} else if err = ts.addGetRightSeed(u); err != nil {
+			return
+		}
+		ts.scheduleWebSeeds()
+	}
+	// Otherwise it's added once we know the torrent's files.
+	return state.save()
+}
+
+// RemoveWebSeed stops the torrent using a web seed URL, whether it was one
+// of the torrent's or one that was added. Pieces it was fetching go back to
+// being downloaded from elsewhere.
+func (ts *TorrentSession) RemoveWebSeed(u string) (err error) {
+	if e := ts.runInLoop(func() { err = ts.removeUserWebSeed(u) }); e != nil {
+		return e
+	}
+	return
+}
+
+func (ts *TorrentSession) removeUserWebSeed(u string) (err error) {
+	state := ts.webSeedState
+	i := ts.findWebSeed(u)
+	if i < 0 && !contains(state.Added, u) && (!ts.torrentHasWebSeed(u) || state.removed(u)) {
+		return fmt.Errorf("No web seed %s", u)
+	}
+	if i >= 0 {
+		ws := ts.webSeedPool[i]
+		if ws.fetch != nil {
+			ts.endWebSeedFetch(ws.fetch)
+		}
+		ts.webSeedPool = append(ts.webSeedPool[:i], ts.webSeedPool[i+1:]...)
+		log.Println("[", ts.M.Info.Name, "] Removed web seed", u)
+	}
+	state.Added = without(state.Added, u)
+	if ts.torrentHasWebSeed(u) && !state.removed(u) {
+		state.Removed = append(state.Removed, u)
+	}
+	return state.save()
+}
+
+// WebSeeds returns the health of the web seeds the torrent is using.
+func (ts *TorrentSession) WebSeeds() (health []WebSeedHealth, err error) {
+	err = ts.runInLoop(func() { health = ts.webSeedHealth() })
+	return
+}
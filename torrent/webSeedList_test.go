@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddWebSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addwebseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir := filepath.Join(dir, "served")
+	content := writeWebSeedFiles(t, filepath.Join(seedDir, "files"), 40000, 30000)
+	m, err := CreateTorrent(filepath.Join(seedDir, "files"), &CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := httptest.NewServer(http.NotFoundHandler())
+	defer dead.Close()
+	good := httptest.NewServer(http.FileServer(http.Dir(seedDir)))
+	defer good.Close()
+	m.WebSeeds = []string{dead.URL}
+	torrentFile := filepath.Join(dir, "files.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Bencode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leechDir := filepath.Join(dir, "leech")
+	flags := &TorrentFlags{
+		FileDir:            leechDir,
+		DataDir:            filepath.Join(dir, "data"),
+		FileSystemProvider: OsFsProvider{},
+		InitialCheck:       true,
+		MaxActive:          1,
+		MemoryPerTorrent:   -1,
+		SeedRatio:          0,
+	}
+	if err = os.Mkdir(leechDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	swarm := &fakeDHTSwarm{peers: make(map[string][]string)}
+	leecher, done := startTestSession(t, flags, torrentFile, swarm)
+	if err = leecher.AddWebSeed("not a url"); err == nil {
+		t.Error("Added a web seed that isn't a URL")
+	}
+	if err = leecher.AddWebSeed(good.URL); err != nil {
+		t.Fatal(err)
+	}
+	health, err := leecher.WebSeeds()
+	if err != nil || len(health) != 2 || health[1].URL != good.URL {
+		t.Errorf("WebSeeds = %v, %v", health, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for the added web seed")
+	}
+	var got []byte
+	for _, name := range []string{"a", "b"} {
+		b, err := ioutil.ReadFile(filepath.Join(leechDir, "files", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Downloaded %d bytes that don't match the %d bytes served", len(got), len(content))
+	}
+	if err = leecher.RemoveWebSeed(good.URL); err != errSessionEnded {
+		t.Errorf("RemoveWebSeed after the session ended: %v", err)
+	}
+
+	// The added web seed is remembered, and so is removing the torrent's own.
+	ts, err := NewTorrentSession(flags, torrentFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.fileStore.Close()
+	if len(ts.webSeedPool) != 2 || ts.webSeedPool[1].url != good.URL || ts.webSeedPool[1].health.Requests != 0 {
+		t.Fatalf("Restarted with web seeds %v", ts.webSeedHealth())
+	}
+	if err = ts.removeUserWebSeed(dead.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.removeUserWebSeed(dead.URL); err == nil {
+		t.Error("Removed a web seed twice")
+	}
+	ts, err = NewTorrentSession(flags, torrentFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.fileStore.Close()
+	if len(ts.webSeedPool) != 1 || ts.webSeedPool[0].url != good.URL {
+		t.Errorf("Restarted with web seeds %v", ts.webSeedHealth())
+	}
+	if want := []string{dead.URL}; !reflect.DeepEqual(ts.webSeedState.Removed, want) {
+		t.Errorf("Removed = %v, want %v", ts.webSeedState.Removed, want)
+	}
+	// Adding it back undoes that.
+	if err = ts.addUserWebSeed(dead.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.webSeedState.Removed) != 0 || len(ts.webSeedState.Added) != 1 || len(ts.webSeedPool) != 2 {
+		t.Errorf("After adding the torrent's web seed back: %+v, %v", ts.webSeedState, ts.webSeedHealth())
+	}
+}
+
+func TestRemoveBusyWebSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "removewebseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := webSeedTestSession()
+	ts.webSeedState = loadWebSeedState(dir, "ih")
+	ws := &webSeed{url: "http://mirror/"}
+	ts.webSeedState.Added = []string{ws.url}
+	ts.webSeedPool = []*webSeed{ws}
+	cancelled := false
+	f := &webSeedFetch{seed: ws, pieces: []webSeedPiece{{3, 100}, {4, 100}}, cancel: func() { cancelled = true }}
+	for _, p := range f.pieces {
+		v := &ActivePiece{downloaderCount: []int{1}, buffer: make([]byte, 100), length: 100}
+		ts.activePieces[p.index] = v
+		f.active = append(f.active, v)
+	}
+	ws.fetch = f
+	if err = ts.removeUserWebSeed(ws.url); err != nil {
+		t.Fatal(err)
+	}
+	if !cancelled || len(ts.activePieces) != 0 || len(ts.webSeedPool) != 0 || len(ts.webSeedState.Added) != 0 {
+		t.Errorf("After removing a busy web seed: cancelled %v, %d active pieces, %d web seeds", cancelled, len(ts.activePieces), len(ts.webSeedPool))
+	}
+}
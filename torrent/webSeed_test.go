@@ -0,0 +1,87 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeWebSeedTorrent(t *testing.T, dir string, urlList interface{}, info InfoDict) *MetaInfo {
+	torrentFile := filepath.Join(dir, "t.torrent")
+	f, err := os.Create(torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bencodeMarshal(f, map[string]interface{}{"info": &info, "url-list": urlList})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := GetMetaInfo(nil, torrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestGetWebSeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := InfoDict{PieceLength: 16384, Pieces: "01234567890123456789", Name: "a b", Length: 10}
+
+	m := writeWebSeedTorrent(t, dir, "http://mirror/pub/", info)
+	if want := []string{"http://mirror/pub/"}; !reflect.DeepEqual(m.WebSeeds, want) {
+		t.Errorf("WebSeeds = %v, want %v", m.WebSeeds, want)
+	}
+	if m.Extra["url-list"] != nil {
+		t.Error("url-list was kept as an unknown key")
+	}
+
+	m = writeWebSeedTorrent(t, dir, []interface{}{"http://mirror/pub/", "", "not a url", int64(1), "https://other/a%20b", "http://mirror/pub/"}, info)
+	if want := []string{"http://mirror/pub/", "https://other/a%20b"}; !reflect.DeepEqual(m.WebSeeds, want) {
+		t.Errorf("WebSeeds = %v, want %v", m.WebSeeds, want)
+	}
+	want := []WebSeed{
+		{"http://mirror/pub/", []WebSeedFile{{URL: "http://mirror/pub/a%20b", Length: 10}}},
+		{"https://other/a%20b", []WebSeedFile{{URL: "https://other/a%20b", Length: 10}}},
+	}
+	if got := m.ResolveWebSeeds(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ResolveWebSeeds = %+v, want %+v", got, want)
+	}
+}
+
+func TestResolveWebSeedsMultiFile(t *testing.T) {
+	m := &MetaInfo{WebSeeds: []string{"http://mirror/pub", "ftp://mirror/pub/"}}
+	if seeds := m.ResolveWebSeeds(); seeds != nil {
+		t.Errorf("Resolved %v before the files are known", seeds)
+	}
+	m.Info = InfoDict{PieceLength: 16384, Name: "dir", Files: []FileDict{
+		{Length: 5, Path: []string{"sub", "x#1"}},
+		{Length: 16379, Path: []string{".pad", "16379"}, Attr: "p"},
+		{Length: 7, Path: []string{"y"}},
+	}}
+	files := []WebSeedFile{
+		{URL: "/dir/sub/x%231", Length: 5},
+		{Offset: 5, Length: 16379},
+		{URL: "/dir/y", Offset: 16384, Length: 7},
+	}
+	seeds := m.ResolveWebSeeds()
+	if len(seeds) != 2 {
+		t.Fatalf("Got %d web seeds, want 2", len(seeds))
+	}
+	for i, prefix := range []string{"http://mirror/pub", "ftp://mirror/pub"} {
+		for j, f := range files {
+			if f.URL != "" {
+				f.URL = prefix + f.URL
+			}
+			if got := seeds[i].Files[j]; got != f {
+				t.Errorf("Web seed %d file %d = %+v, want %+v", i, j, got, f)
+			}
+		}
+	}
+}
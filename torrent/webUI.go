@@ -0,0 +1,34 @@
+package torrent
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The web UI: a page of the torrents' status, with buttons to pause, resume
+// and remove them, served by the RPC server under /ui/. It's built into the
+// binary, so there's nothing to install. The page is the same for everyone,
+// so it's served without the token; it asks for it, and sends it with the
+// API calls it makes, like any other client.
+
+//go:embed webui
+var webUIFiles embed.FS
+
+func newWebUIHandler() http.Handler {
+	files, err := fs.Sub(webUIFiles, "webui")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/ui", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" || r.URL.Path == "/ui" {
+			http.Redirect(w, r, "/ui/", http.StatusFound)
+			return
+		}
+		// The page only talks to us, and isn't to be framed by others.
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, r)
+	})
+}
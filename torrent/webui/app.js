@@ -0,0 +1,350 @@
+// The web UI. Everything comes from the control API, with the same token as
+// any other client, so this page holds nothing of its own. The token stays in
+// the tab's session storage, or can be given as #token=... in the URL.
+"use strict";
+
+const REFRESH = 2000; // Milliseconds between polls
+
+let token = sessionStorage.getItem("token") || "";
+let timer = null;
+const open = new Set(); // Info-hashes whose details are showing
+let label = ""; // Only torrents with it are shown, if it isn't ""
+
+function $(id) {
+	return document.getElementById(id);
+}
+
+// An element with the given text, and maybe a class.
+function el(tag, text, className) {
+	const e = document.createElement(tag);
+	if (text !== undefined && text !== null) {
+		e.textContent = text;
+	}
+	if (className) {
+		e.className = className;
+	}
+	return e;
+}
+
+function bytes(n) {
+	const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function rate(n) {
+	return n >= 1 ? bytes(n) + "/s" : "";
+}
+
+// Durations come in nanoseconds.
+function duration(ns) {
+	if (ns < 0) {
+		return "∞";
+	}
+	let s = Math.round(ns / 1e9);
+	if (s === 0) {
+		return "";
+	}
+	const parts = [];
+	for (const [unit, size] of [["d", 86400], ["h", 3600], ["m", 60], ["s", 1]]) {
+		if (s >= size || (parts.length === 0 && size === 1)) {
+			parts.push(Math.floor(s / size) + unit);
+			s %= size;
+		}
+		if (parts.length === 2) {
+			break;
+		}
+	}
+	return parts.join(" ");
+}
+
+// Like TorrentStatus.State.
+function state(t) {
+	if (t.Error) return "error";
+	if (t.Adding) return "adding";
+	if (t.Checking) return "checking";
+	if (t.Queued) return "queued";
+	if (t.Paused) return "paused";
+	if (t.HaveTorrent && t.Left === 0) return "seeding";
+	return "downloading";
+}
+
+function progress(t) {
+	let part = 0;
+	if (t.Checking || t.Unchecked) {
+		part = t.CheckedPart;
+	} else if (t.Adding && t.FilesToOpen > 0) {
+		part = t.FilesOpened / t.FilesToOpen;
+	} else if (t.Size > 0) {
+		part = t.Completed / t.Size;
+	}
+	const bar = el("span", null, "bar" + (part >= 1 ? " done" : ""));
+	const fill = el("div");
+	fill.style.width = (part * 100).toFixed(1) + "%";
+	bar.appendChild(fill);
+	bar.appendChild(el("span", (part * 100).toFixed(1) + "%"));
+	return bar;
+}
+
+async function api(method, path, body) {
+	const r = await fetch(path, {method: method, headers: {"Authorization": "Bearer " + token},
+		body: body === undefined ? undefined : JSON.stringify(body)});
+	if (r.status === 401) {
+		showLogin("The token was refused");
+		throw new Error("unauthorized");
+	}
+	const body = await r.json();
+	if (!r.ok) {
+		throw new Error(body.Error || r.statusText);
+	}
+	return body;
+}
+
+function button(label, onClick) {
+	const b = el("button", label);
+	b.type = "button";
+	b.addEventListener("click", (e) => {
+		e.stopPropagation();
+		onClick();
+	});
+	return b;
+}
+
+// Runs an action on a torrent, then refreshes.
+async function act(method, t, action, query, body) {
+	try {
+		await api(method, "/api/torrents/" + t.InfoHash + (action ? "/" + action : "") + (query || ""), body);
+		$("error").textContent = "";
+	} catch (e) {
+		$("error").textContent = t.Name + ": " + e.message;
+	}
+	refresh();
+}
+
+function table(headings, rows) {
+	const t = el("table");
+	const head = el("tr");
+	for (const h of headings) {
+		head.appendChild(el("th", h));
+	}
+	t.appendChild(head);
+	for (const row of rows) {
+		const tr = el("tr");
+		for (const cell of row) {
+			tr.appendChild(el("td", cell));
+		}
+		t.appendChild(tr);
+	}
+	return t;
+}
+
+function details(t) {
+	const td = el("td", null, "details");
+	td.colSpan = 10;
+	if (t.Error) {
+		td.appendChild(el("p", t.Error));
+	}
+	td.appendChild(el("p", "Info-hash " + t.InfoHash + (t.FileDir ? ", in " + t.FileDir : "")));
+	td.appendChild(el("p", `Downloaded ${bytes(t.Downloaded || 0)}, uploaded ${bytes(t.Uploaded || 0)}, ` +
+		`${t.GoodPieces || 0} of ${t.Pieces || 0} pieces, ${t.HashFailures || 0} hash failures`));
+	if (t.Overhead) {
+		const o = t.Overhead;
+		td.appendChild(el("p", `Overhead ${bytes(o.TotalReceived)} in, ${bytes(o.TotalSent)} out; ` +
+			`wasted ${bytes(o.Duplicate)} on duplicate blocks and ${bytes(o.HashFailed)} on failed pieces`));
+	}
+	if (t.CompletedAt && !t.CompletedAt.startsWith("0001")) {
+		td.appendChild(el("p", "Completed " + new Date(t.CompletedAt).toLocaleString()));
+	}
+	const peers = t.Peers || [];
+	td.appendChild(el("h3", `Peers (${peers.length} connected, ${t.KnownPeers || 0} known)`));
+	if (t.DryPool) {
+		const d = t.DryPool;
+		let text = "Out of peers since " + new Date(d.Since).toLocaleTimeString();
+		if (d.Attempts > 0) {
+			text += `, asked ${d.Attempts} times, last ${(d.Asked || []).join(", ") || "nowhere"}` +
+				(d.TooSoon ? " (too soon for the trackers)" : "") + `, finding ${d.PeersFound} peers`;
+		}
+		td.appendChild(el("p", text + "; asking again " + new Date(d.NextAttempt).toLocaleTimeString()));
+	}
+	if (peers.length > 0) {
+		td.appendChild(table(["Address", "Client", "Source", "Progress", "Down", "Up", "Flags"], peers.map((p) => [
+			p.Address, p.Client, p.Source, (p.Progress * 100).toFixed(1) + "%",
+			rate(p.DownloadRate), rate(p.UploadRate),
+			(p.AmInterested ? "I" : "") + (p.PeerChoking ? "c" : "") + (p.PeerInterested ? "i" : "") + (p.AmChoking ? "C" : ""),
+		])));
+	}
+	const trackers = t.Trackers || [];
+	if (trackers.length > 0) {
+		td.appendChild(el("h3", "Trackers"));
+		td.appendChild(table(["URL", "Seeders", "Leechers", "Peers", "Last announce", "Error"], trackers.map((tr) => [
+			tr.URL, tr.Seeders, tr.Leechers, tr.Peers,
+			tr.LastAnnounce.startsWith("0001") ? "" : new Date(tr.LastAnnounce).toLocaleTimeString(), tr.Error,
+		])));
+	}
+	if (t.DHTScrape) {
+		const d = t.DHTScrape;
+		td.appendChild(el("p", `The DHT estimates ${d.Seeders} seeders and ${d.Leechers} leechers, ` +
+			`from ${d.Responses} nodes at ${new Date(d.Time).toLocaleTimeString()}`));
+	}
+	const seeds = t.WebSeeds || [];
+	if (seeds.length > 0) {
+		td.appendChild(el("h3", "Web seeds"));
+		td.appendChild(table(["URL", "Downloaded", "Requests", "Failures", "Disabled"], seeds.map((s) => [
+			s.URL, bytes(s.Downloaded), s.Requests, s.Failures, s.Disabled,
+		])));
+	}
+	const tr = el("tr");
+	tr.appendChild(td);
+	return tr;
+}
+
+function row(t) {
+	const s = state(t);
+	const tr = el("tr", null, "torrent" + (open.has(t.InfoHash) ? " open" : ""));
+	const name = el("td", t.Name || t.InfoHash, "name");
+	name.addEventListener("click", () => {
+		if (!open.delete(t.InfoHash)) {
+			open.add(t.InfoHash);
+		}
+		refresh();
+	});
+	for (const l of t.Labels || []) {
+		const tag = el("span", l, "label");
+		tag.addEventListener("click", (e) => {
+			e.stopPropagation();
+			showLabel(l);
+		});
+		name.appendChild(tag);
+	}
+	tr.appendChild(name);
+	tr.appendChild(el("td", s, "state-" + s));
+	const p = el("td", null, "progress");
+	p.appendChild(progress(t));
+	tr.appendChild(p);
+	tr.appendChild(el("td", t.Size ? bytes(t.Size) : ""));
+	tr.appendChild(el("td", rate(t.DownloadRate)));
+	tr.appendChild(el("td", rate(t.UploadRate)));
+	const eta = el("td", s === "downloading" ? duration(t.ETA) : "");
+	if (s === "downloading" && t.ETA > 0) {
+		eta.title = "Done about " + new Date(Date.now() + t.ETA / 1e6).toLocaleString();
+	}
+	tr.appendChild(eta);
+	tr.appendChild(el("td", t.Connected ? `${t.Connected} (${t.Seeds} seeds)` : ""));
+	tr.appendChild(el("td", t.HaveTorrent ? t.Ratio.toFixed(2) : ""));
+	const buttons = el("td");
+	if (!t.Adding && !t.Error) {
+		if (t.Paused) {
+			buttons.appendChild(button("Resume", () => act("POST", t, "resume")));
+		} else {
+			buttons.appendChild(button("Pause", () => act("POST", t, "pause")));
+		}
+	}
+	if (!t.Adding && !t.Error) {
+		buttons.appendChild(button("Labels", () => {
+			const labels = prompt("Labels for " + t.Name + ", comma separated", (t.Labels || []).join(", "));
+			if (labels !== null) {
+				act("PUT", t, "labels", "", {Labels: labels.split(",")});
+			}
+		}));
+	}
+	buttons.appendChild(button("Remove", () => {
+		if (confirm("Remove " + t.Name + "? Its files stay.")) {
+			act("DELETE", t, "");
+		}
+	}));
+	buttons.appendChild(button("Delete", () => {
+		if (confirm("Remove " + t.Name + " and delete its files?")) {
+			act("DELETE", t, "", "?deleteData=true");
+		}
+	}));
+	tr.appendChild(buttons);
+	return tr;
+}
+
+function showStats(s) {
+	const stats = $("stats");
+	stats.textContent = "";
+	stats.appendChild(el("span", `${s.Torrents} torrents: ${s.Downloading} downloading, ${s.Seeding} seeding`));
+	stats.appendChild(el("span", "↓ " + (rate(s.DownloadRate) || "0 B/s")));
+	stats.appendChild(el("span", "↑ " + (rate(s.UploadRate) || "0 B/s")));
+	if (s.Disk && s.Disk.Cap > 0) {
+		stats.appendChild(el("span", `Disk ${bytes(s.Disk.Used)} of ${bytes(s.Disk.Cap)}` + (s.Disk.Full ? ", full" : "")));
+	}
+}
+
+// Shows only the torrents labelled l, or every one if it's "".
+function showLabel(l) {
+	label = l;
+	$("labelFilter").hidden = l === "";
+	$("labelName").textContent = l;
+	refresh();
+}
+
+async function refresh() {
+	clearTimeout(timer);
+	try {
+		const list = "/api/torrents" + (label ? "?label=" + encodeURIComponent(label) : "");
+		const [torrents, stats] = await Promise.all([api("GET", list), api("GET", "/api/stats")]);
+		const body = $("torrents");
+		body.textContent = "";
+		for (const t of torrents) {
+			body.appendChild(row(t));
+			if (open.has(t.InfoHash)) {
+				body.appendChild(details(t));
+			}
+		}
+		$("empty").hidden = torrents.length > 0;
+		showStats(stats);
+	} catch (e) {
+		if (e.message === "unauthorized") {
+			return;
+		}
+		$("error").textContent = "Couldn't get the status: " + e.message;
+	}
+	timer = setTimeout(refresh, REFRESH);
+}
+
+function showLogin(why) {
+	clearTimeout(timer);
+	$("main").hidden = true;
+	$("login").hidden = false;
+	$("loginError").textContent = why || "";
+	$("token").focus();
+}
+
+function start() {
+	$("login").hidden = true;
+	$("main").hidden = false;
+	refresh();
+}
+
+$("login").addEventListener("submit", (e) => {
+	e.preventDefault();
+	token = $("token").value;
+	sessionStorage.setItem("token", token);
+	start();
+});
+
+$("showAll").addEventListener("click", () => showLabel(""));
+
+$("logout").addEventListener("click", () => {
+	token = "";
+	sessionStorage.removeItem("token");
+	$("stats").textContent = "";
+	showLogin();
+});
+
+if (location.hash.startsWith("#token=")) {
+	token = decodeURIComponent(location.hash.slice("#token=".length));
+	sessionStorage.setItem("token", token);
+	history.replaceState(null, "", location.pathname);
+}
+if (token) {
+	start();
+} else {
+	showLogin();
+}
@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// Zero-copy uploads: with ZeroCopyUploads set, a block that lies in one OS
+// file, of a store with no cache in front of it, is queued as where it lies
+// rather than read in, and the peer's writer has the kernel send it from the
+// page cache, after writing the message's header as usual. That's sendfile,
+// on Linux; elsewhere it's never queued that way. It isn't when the
+// connection isn't a plain TCP one either, like a proxy's or an encrypted
+// one, as the kernel would send the block past whatever wraps it. The rate
+// limits are kept to as they are for other writes, the block being waited
+// for as a whole before it's sent.
+
+// Where a block lies in an OS file.
+type fileBlock struct {
+	path   string
+	off    int64
+	length int
+}
+
+// A FileStore whose files are OS files says where a block lies in one with
+// fileBlock. It's nil if the block isn't all in one OS file.
+type blockFiler interface {
+	fileBlock(off int64, length int) *fileBlock
+}
+
+func (f *fileStore) fileBlock(off int64, length int) *fileBlock {
+	if length <= 0 || off < 0 || off+int64(length) > f.size() {
+		return nil
+	}
+	first, last := f.filesFor(off, int64(length))
+	if first != last {
+		return nil
+	}
+	file, ok := f.files[first].file.(*osFile)
+	if !ok || file.isPending() {
+		return nil
+	}
+	return &fileBlock{file.filePath, off - f.offsets[first], length}
+}
+
+// The block's read, as far as the metrics go, as the kernel will read it.
+func (m *meteredStore) fileBlock(off int64, length int) *fileBlock {
+	l, ok := m.FileStore.(blockFiler)
+	if !ok {
+		return nil
+	}
+	b := l.fileBlock(off, length)
+	if b != nil {
+		atomic.AddUint64(&m.stats.read, uint64(length))
+	}
+	return b
+}
+
+// The TCP connection under conn that the kernel can send blocks to, if
+// there's one and it can.
+func zeroCopyConn(conn net.Conn) *net.TCPConn {
+	if !canSendfile {
+		return nil
+	}
+	if l, ok := conn.(*limitedConn); ok {
+		conn = l.Conn
+	}
+	tcp, _ := conn.(*net.TCPConn)
+	return tcp
+}
+
+// Writes head, and then the block from its file, to conn, which
+// zeroCopyConn has said the kernel can send to.
+func writeFileBlock(conn net.Conn, head net.Buffers, b *fileBlock) (err error) {
+	if l, ok := conn.(*limitedConn); ok {
+		n := b.length
+		for _, h := range head {
+			n += len(h)
+		}
+		l.b.up.wait(n, &l.class.up)
+		conn = l.Conn
+	}
+	f, err := os.Open(b.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if tcp, ok := conn.(*net.TCPConn); ok && canSendfile {
+		return sendfile(tcp, head, f, b.off, b.length)
+	}
+	return copyBlock(conn, head, f, b.off, b.length)
+}
+
+// Writes head and the block the usual way, reading it in first.
+func copyBlock(w io.Writer, head net.Buffers, f *os.File, off int64, length int) (err error) {
+	block := make([]byte, length)
+	if _, err = f.ReadAt(block, off); err != nil {
+		return
+	}
+	head = append(head, block)
+	_, err = head.WriteTo(w)
+	return
+}
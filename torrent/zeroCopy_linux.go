@@ -0,0 +1,65 @@
+//go:build linux
+
+package torrent
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+const canSendfile = true
+
+// Writes head, and then length bytes of f from off with sendfile. The socket
+// is corked meanwhile, so the header goes in the same packet as the block's
+// start. A file system that can't be sent from, which only the first
+// sendfile finds out, has the block read in and written instead.
+func sendfile(conn *net.TCPConn, head net.Buffers, f *os.File, off int64, length int) (err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	cork(rc, 1)
+	defer cork(rc, 0)
+	if _, err = head.WriteTo(conn); err != nil {
+		return
+	}
+	src := int(f.Fd())
+	sent := 0
+	var sendErr error
+	err = rc.Write(func(fd uintptr) bool {
+		for sent < length {
+			n, e := syscall.Sendfile(int(fd), src, &off, length-sent)
+			if n > 0 {
+				sent += n
+			}
+			switch {
+			case e == syscall.EAGAIN:
+				// Wait for room in the socket's buffer.
+				return false
+			case e == syscall.EINTR:
+			case e != nil:
+				sendErr = e
+				return true
+			case n == 0:
+				sendErr = io.ErrUnexpectedEOF
+				return true
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = sendErr
+	}
+	if sent == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS) {
+		return copyBlock(conn, nil, f, off, length)
+	}
+	return
+}
+
+func cork(rc syscall.RawConn, on int) {
+	rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK, on)
+	})
+}
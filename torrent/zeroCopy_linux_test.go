@@ -0,0 +1,63 @@
+//go:build linux
+
+package torrent
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The user and system CPU time the process has had.
+func cpuTime(b *testing.B) time.Duration {
+	var u syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &u); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(u.Utime.Nano() + u.Stime.Nano())
+}
+
+// Blocks sent over a local socket from OS files, read in or sent from the
+// files, with the CPU time it takes per gigabyte. That's the whole process's,
+// so it counts the receiving end too, which is the same either way.
+func BenchmarkZeroCopyUpload(b *testing.B) {
+	for _, zeroCopy := range []bool{false, true} {
+		name := "copy"
+		if zeroCopy {
+			name = "sendfile"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "zeroCopy")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			ours, theirs := tcpPair(b)
+			defer ours.Close()
+			defer theirs.Close()
+			ts, p, _ := fileUploadSession(b, dir, zeroCopy, ours)
+			// Done once it's all been sent, not just queued.
+			received := make(chan bool)
+			go func() {
+				io.CopyN(io.Discard, theirs, int64(b.N)*(4+9+STANDARD_BLOCK_LENGTH))
+				close(received)
+			}()
+			blocks := 4 * uploadPieceLength / STANDARD_BLOCK_LENGTH
+			b.SetBytes(STANDARD_BLOCK_LENGTH)
+			b.ResetTimer()
+			start := cpuTime(b)
+			for i := 0; i < b.N; i++ {
+				off := (i % blocks) * STANDARD_BLOCK_LENGTH
+				if err = ts.sendRequest(p, uint32(off/uploadPieceLength), uint32(off%uploadPieceLength), STANDARD_BLOCK_LENGTH); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-received
+			cpu := cpuTime(b) - start
+			b.ReportMetric(cpu.Seconds()*1e3/(float64(b.N)*STANDARD_BLOCK_LENGTH/1e9), "cpu-ms/GB")
+		})
+	}
+}
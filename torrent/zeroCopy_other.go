@@ -0,0 +1,16 @@
+//go:build !linux
+
+package torrent
+
+import (
+	"net"
+	"os"
+)
+
+const canSendfile = false
+
+// Blocks are never queued to be sent from their files here, but if one
+// were, it would be read in.
+func sendfile(conn *net.TCPConn, head net.Buffers, f *os.File, off int64, length int) error {
+	return copyBlock(conn, head, f, off, length)
+}
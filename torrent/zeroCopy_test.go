@@ -0,0 +1,140 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A session that serves 1 MiB from two OS files in dir, the first of them a
+// piece and a half long, to a peer whose writer sends to conn.
+func fileUploadSession(t testing.TB, dir string, zeroCopy bool, conn net.Conn) (ts *TorrentSession, p *peerState, content []byte) {
+	content = make([]byte, 4*uploadPieceLength)
+	rand.New(rand.NewSource(1)).Read(content)
+	fs, _ := OsFsProvider{}.NewFS(dir)
+	info := &InfoDict{Name: "upload", PieceLength: uploadPieceLength, Files: []FileDict{
+		{Length: 3 * uploadPieceLength / 2, Path: []string{"a"}},
+		{Length: 5 * uploadPieceLength / 2, Path: []string{"b"}},
+	}}
+	store, _, err := NewFileStore(info, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		store.WritePiece(content[i*uploadPieceLength:(i+1)*uploadPieceLength], i)
+	}
+	ts = &TorrentSession{M: &MetaInfo{Info: *info}, fileStore: store, flags: &TorrentFlags{ZeroCopyUploads: zeroCopy}}
+	p = NewPeerState(conn)
+	p.am_choking = false
+	go p.peerWriter(make(chan peerMessage, 1))
+	return
+}
+
+// A loopback TCP connection's two ends.
+func tcpPair(t testing.TB) (ours, theirs net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	if ours, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if theirs = <-accepted; theirs == nil {
+		t.Fatal("Couldn't accept")
+	}
+	return
+}
+
+func TestFileBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zeroCopy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts, p, _ := fileUploadSession(t, dir, true, nil)
+	close(p.writeChan)
+	f := ts.fileStore.(blockFiler)
+	if b := f.fileBlock(uploadPieceLength, STANDARD_BLOCK_LENGTH); b == nil ||
+		b.path != filepath.Join(dir, "a") || b.off != uploadPieceLength || b.length != STANDARD_BLOCK_LENGTH {
+		t.Errorf("In the first file: %+v", b)
+	}
+	if b := f.fileBlock(2*uploadPieceLength, STANDARD_BLOCK_LENGTH); b == nil ||
+		b.path != filepath.Join(dir, "b") || b.off != uploadPieceLength/2 {
+		t.Errorf("In the second file: %+v", b)
+	}
+	for _, off := range []int64{3*uploadPieceLength/2 - 1, 4*uploadPieceLength - 1, -1} {
+		if b := f.fileBlock(off, STANDARD_BLOCK_LENGTH); b != nil {
+			t.Errorf("At %d: %+v", off, b)
+		}
+	}
+	ram, _ := NewRAMFileSystem()
+	store, _, _ := NewFileStore(&ts.M.Info, ram)
+	if b := store.(blockFiler).fileBlock(0, STANDARD_BLOCK_LENGTH); b != nil {
+		t.Errorf("From RAM: %+v", b)
+	}
+}
+
+// Blocks sent from their files arrive as they would read in, over TCP, rate
+// limited or not, and over a connection the kernel can't send to, and so do
+// those across files, which are read in.
+func TestZeroCopyUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zeroCopy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, kind := range []string{"tcp", "limited", "pipe"} {
+		var ours, theirs net.Conn
+		if kind == "pipe" {
+			ours, theirs = net.Pipe()
+		} else {
+			ours, theirs = tcpPair(t)
+		}
+		if kind == "limited" {
+			ours = &limitedConn{ours, newBandwidth(&TorrentFlags{MaxUploadRate: 1 << 30}), newBandwidthClass()}
+		}
+		ts, p, content := fileUploadSession(t, dir, true, ours)
+		if got := zeroCopyConn(ours) != nil; got != (canSendfile && kind != "pipe") {
+			t.Errorf("%s: sent from the files %v", kind, got)
+		}
+		blocks := []uint32{0, 3*uploadPieceLength/2 - STANDARD_BLOCK_LENGTH/2, 3 * uploadPieceLength, 4*uploadPieceLength - STANDARD_BLOCK_LENGTH}
+		go func() {
+			for _, off := range blocks {
+				ts.sendRequest(p, off/uploadPieceLength, off%uploadPieceLength, STANDARD_BLOCK_LENGTH)
+			}
+		}()
+		for _, off := range blocks {
+			msg := make([]byte, 4+9+STANDARD_BLOCK_LENGTH)
+			if _, err := io.ReadFull(theirs, msg); err != nil {
+				t.Fatal(kind, err)
+			}
+			if bytesToUint32(msg) != 9+STANDARD_BLOCK_LENGTH || msg[4] != PIECE ||
+				bytesToUint32(msg[5:])*uploadPieceLength+bytesToUint32(msg[9:]) != off ||
+				!bytes.Equal(msg[13:], content[off:off+STANDARD_BLOCK_LENGTH]) {
+				t.Errorf("%s: sent %x... for %d", kind, msg[:16], off)
+			}
+		}
+		// The last is counted once its write returns.
+		want := int64(len(blocks) * STANDARD_BLOCK_LENGTH)
+		for deadline := time.Now().Add(time.Second); p.sent.getTotal() != want && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		if sent := p.sent.getTotal(); sent != want {
+			t.Errorf("%s: counted %d sent", kind, sent)
+		}
+		ours.Close()
+		theirs.Close()
+	}
+}